@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// runAgent serves the local ffmpeg to workers using FFMPEG_REMOTE=agent,
+// over mTLS with the FFMPEG_AGENT_TLS_* files, see serverTLSConfig, and
+// only on the media below FFMPEG_REMOTE_ROOT, the agent's working
+// directory:
+//
+//	FFMPEG_AGENT_TOKEN=secret FFMPEG_REMOTE_ROOT=/mnt/media videoconverter encode-agent [-addr :9090]
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("encode-agent", flag.ExitOnError)
+	addr := fs.String("addr", ":9090", "listen address")
+	fs.Parse(args)
+
+	token := getSecret("FFMPEG_AGENT_TOKEN", "")
+	if token == "" {
+		return fmt.Errorf("encode-agent: FFMPEG_AGENT_TOKEN is required")
+	}
+	root := getEnvOrDefault("FFMPEG_REMOTE_ROOT", "")
+	if !filepath.IsAbs(root) {
+		return fmt.Errorf("encode-agent: FFMPEG_REMOTE_ROOT must be an absolute path")
+	}
+	if err := os.Chdir(root); err != nil {
+		return fmt.Errorf("encode-agent: %w", err)
+	}
+	config, err := serverTLSConfig("FFMPEG_AGENT")
+	if err != nil {
+		return fmt.Errorf("encode-agent: %w", err)
+	}
+	caps, err := ffmpeg.Discover(context.Background(),
+		getEnvOrDefault("FFMPEG_PATH", ""),
+		getEnvOrDefault("FFPROBE_PATH", ""),
+		getEnvOrDefault("FFMPEG_MIN_VERSION", ffmpeg.DefaultMinVersion),
+	)
+	if err != nil {
+		return err
+	}
+	caps.Report("libx264", "libx265", "h264_nvenc", "libvpx-vp9", "aac", "libmp3lame")
+
+	slog.Info("Starting encode agent", slog.String("addr", *addr), slog.String("root", root))
+	server := &http.Server{
+		Addr:      *addr,
+		Handler:   ffmpeg.NewAgent(caps.Runner(), token, root),
+		TLSConfig: config,
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/alert"
+	"imersaofc/internal/rabbitmq"
+)
+
+// newAlertRouter routes alerts to the channels configured with ALERT_*
+// variables, each with its own minimum severity
+func newAlertRouter() (*alert.Router, error) {
+	router := alert.NewRouter()
+	minSeverity := func(key, def string) (alert.Severity, error) {
+		return alert.ParseSeverity(getEnvOrDefault(key, def))
+	}
+
+	if url := getSecret("ALERT_SLACK_WEBHOOK_URL", ""); url != "" {
+		min, err := minSeverity("ALERT_SLACK_MIN_SEVERITY", "error")
+		if err != nil {
+			return nil, err
+		}
+		router.Add(alert.NewSlackNotifier(url), min)
+	}
+	if url := getSecret("ALERT_DISCORD_WEBHOOK_URL", ""); url != "" {
+		min, err := minSeverity("ALERT_DISCORD_MIN_SEVERITY", "error")
+		if err != nil {
+			return nil, err
+		}
+		router.Add(alert.NewDiscordNotifier(url), min)
+	}
+	if addr := getEnvOrDefault("ALERT_SMTP_ADDR", ""); addr != "" {
+		min, err := minSeverity("ALERT_EMAIL_MIN_SEVERITY", "critical")
+		if err != nil {
+			return nil, err
+		}
+		email, err := alert.NewEmailNotifier(alert.EmailConfig{
+			Addr:     addr,
+			Username: getEnvOrDefault("ALERT_SMTP_USERNAME", ""),
+			Password: getSecret("ALERT_SMTP_PASSWORD", ""),
+			From:     getEnvOrDefault("ALERT_EMAIL_FROM", ""),
+			To:       strings.Split(getEnvOrDefault("ALERT_EMAIL_TO", ""), ","),
+		})
+		if err != nil {
+			return nil, err
+		}
+		router.Add(email, min)
+	}
+	return router, nil
+}
+
+// startMonitor watches the free space of the upload root and, when
+// RABBITMQ_DLQ names it, the growth of the dead-letter queue
+func startMonitor(router *alert.Router, uploadRoot string) {
+	interval, err := time.ParseDuration(getEnvOrDefault("ALERT_CHECK_INTERVAL", "1m"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+	warnBelow, _ := strconv.ParseUint(getEnvOrDefault("ALERT_DISK_WARN_BELOW", strconv.Itoa(10<<30)), 10, 64)
+	criticalBelow, _ := strconv.ParseUint(getEnvOrDefault("ALERT_DISK_CRITICAL_BELOW", strconv.Itoa(1<<30)), 10, 64)
+	checks := []alert.Check{alert.DiskSpace{
+		Path:          getEnvOrDefault("ALERT_DISK_PATH", uploadRoot),
+		WarnBelow:     warnBelow,
+		CriticalBelow: criticalBelow,
+	}}
+
+	url := getSecret("RABBITMQ_URL", "")
+	if dlq := getEnvOrDefault("RABBITMQ_DLQ", ""); url != "" && dlq != "" {
+		tls := rabbitmqTLS()
+		minIncrease, _ := strconv.Atoi(getEnvOrDefault("ALERT_DLQ_MIN_INCREASE", "1"))
+		maxDepth, _ := strconv.Atoi(getEnvOrDefault("ALERT_DLQ_MAX_DEPTH", "0"))
+		checks = append(checks, &alert.QueueGrowth{
+			Queue: dlq,
+			Depth: func(ctx context.Context) (int, error) {
+				info, err := rabbitmq.Inspect(url, tls, dlq)
+				return info.Messages, err
+			},
+			MinIncrease: minIncrease,
+			MaxDepth:    maxDepth,
+		})
+	}
+	go alert.NewMonitor(router, interval, checks...).Run(context.Background())
+}
+
+// brokerAlerts returns consumer hooks alerting when consuming the queue
+// pauses because the broker is unreachable, and when it resumes
+func brokerAlerts(router *alert.Router, queue string) (func(error), func()) {
+	notify := func(a alert.Alert) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := router.Notify(ctx, a); err != nil {
+			slog.Error("Error sending alert", slog.String("title", a.Title), slog.String("error", err.Error()))
+		}
+	}
+	onPause := func(err error) {
+		notify(alert.Alert{Severity: alert.SeverityWarning, Title: "Broker connection lost", Message: fmt.Sprintf("consuming %s is paused: %v", queue, err)})
+	}
+	onResume := func() {
+		notify(alert.Alert{Severity: alert.SeverityInfo, Title: "Broker connection restored", Message: fmt.Sprintf("consuming %s resumed", queue)})
+	}
+	return onPause, onResume
+}
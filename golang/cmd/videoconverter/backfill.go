@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// objectLister lists the keys of a remote storage under a prefix
+type objectLister interface {
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// runBackfill enqueues a conversion for every chunk folder of the upload root
+// (or of a bucket prefix mirroring it) that has no MPEG-DASH output yet. The
+// tasks are published as batch messages, paced to at most -rate tasks per
+// second:
+//
+//	videoconverter backfill [-root media/uploads] [-prefix uploads/] [-batch-size 50] [-rate 5] [-ttl 24h] [-dry-run]
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	root := fs.String("root", "media/uploads", "upload root holding one chunk folder per video")
+	prefix := fs.String("prefix", "", "scan this prefix of the STORAGE_BACKEND bucket instead of the upload root")
+	pattern := fs.String("chunk-pattern", converter.DefaultChunkLayout.Pattern, "glob matching the chunk files of a folder")
+	profile := fs.String("profile", "", "encoding profile, the default one when empty")
+	batchSize := fs.Int("batch-size", 50, "tasks per batch message")
+	rate := fs.Float64("rate", 5, "maximum tasks enqueued per second, 0 for no limit")
+	limit := fs.Int("limit", 0, "stop after this many tasks, 0 for no limit")
+	ttl := fs.Duration("ttl", 0, "skip tasks that haven't started within this time of being enqueued, 0 for no deadline")
+	dryRun := fs.Bool("dry-run", false, "print the batches instead of enqueueing them")
+	fs.Parse(args)
+	if *batchSize <= 0 {
+		return fmt.Errorf("backfill: -batch-size must be positive")
+	}
+
+	manifest := getEnvOrDefault("OUTPUT_MANIFEST", converter.DefaultOutputLayout.Manifest)
+	var videoIDs []int
+	var err error
+	if *prefix != "" {
+		videoIDs, err = scanBucket(*prefix, *pattern, manifest)
+	} else {
+		videoIDs, err = scanUploadRoot(*root, *pattern, manifest)
+	}
+	if err != nil {
+		return fmt.Errorf("backfill: %w", err)
+	}
+	if *limit > 0 && len(videoIDs) > *limit {
+		videoIDs = videoIDs[:*limit]
+	}
+	slog.Info("Backfill scan finished", slog.Int("pending", len(videoIDs)))
+
+	runID := time.Now().UTC().Format("20060102T150405")
+	for start, n := 0, 1; start < len(videoIDs); start, n = start+*batchSize, n+1 {
+		end := min(start+*batchSize, len(videoIDs))
+		batch := converter.BatchMessage{BatchID: fmt.Sprintf("backfill-%s-%d", runID, n)}
+		var deadline *time.Time
+		if *ttl > 0 {
+			t := time.Now().Add(*ttl).UTC()
+			deadline = &t
+		}
+		for _, videoID := range videoIDs[start:end] {
+			batch.Tasks = append(batch.Tasks, converter.VideoTask{
+				VideoID:  videoID,
+				Path:     filepath.Join(*root, strconv.Itoa(videoID)),
+				Profile:  *profile,
+				Deadline: deadline,
+			})
+		}
+
+		if *dryRun {
+			body, err := json.Marshal(batch)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(body))
+			continue
+		}
+		if err := publishJSON(batch); err != nil {
+			return fmt.Errorf("backfill: batch %s: %w", batch.BatchID, err)
+		}
+		slog.Info("Backfill batch enqueued", slog.String("batch_id", batch.BatchID), slog.Int("tasks", len(batch.Tasks)))
+
+		if *rate > 0 && end < len(videoIDs) {
+			time.Sleep(time.Duration(float64(len(batch.Tasks)) / *rate * float64(time.Second)))
+		}
+	}
+	return nil
+}
+
+// scanUploadRoot returns, in order, the video ids whose folder under root has
+// chunks (or an upload manifest) but no MPEG-DASH manifest
+func scanUploadRoot(root, pattern, manifest string) ([]int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var videoIDs []int
+	for _, entry := range entries {
+		videoID, err := strconv.Atoi(entry.Name())
+		if !entry.IsDir() || err != nil || videoID <= 0 {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, "mpeg-dash", manifest)); err == nil {
+			continue
+		}
+		chunks, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if _, err := os.Stat(filepath.Join(dir, converter.ManifestFile)); len(chunks) == 0 && err != nil {
+			continue
+		}
+		videoIDs = append(videoIDs, videoID)
+	}
+	sort.Ints(videoIDs)
+	return videoIDs, nil
+}
+
+// scanBucket does what scanUploadRoot does for the "{prefix}{video_id}/..."
+// objects of the configured bucket
+func scanBucket(prefix, pattern, manifest string) ([]int, error) {
+	uploader, err := newUploader()
+	if err != nil {
+		return nil, err
+	}
+	lister, ok := uploader.(objectLister)
+	if !ok {
+		return nil, errors.New("-prefix needs a STORAGE_BACKEND that can list objects")
+	}
+	keys, err := lister.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	hasChunks := map[int]bool{}
+	hasOutput := map[int]bool{}
+	for _, key := range keys {
+		dir, rest, found := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		videoID, err := strconv.Atoi(dir)
+		if !found || err != nil || videoID <= 0 {
+			continue
+		}
+		if rest == "mpeg-dash/"+manifest {
+			hasOutput[videoID] = true
+		}
+		if matched, _ := path.Match(pattern, rest); matched || rest == converter.ManifestFile {
+			hasChunks[videoID] = true
+		}
+	}
+
+	var videoIDs []int
+	for videoID := range hasChunks {
+		if !hasOutput[videoID] {
+			videoIDs = append(videoIDs, videoID)
+		}
+	}
+	sort.Ints(videoIDs)
+	return videoIDs, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/ffmpeg"
+)
+
+// runCompare encodes a source with two profiles and prints their bitrate
+// and VMAF, for tuning a profile before rolling it out:
+//
+//	videoconverter compare -source clip.mp4 -a default -b x265-test [-profiles profiles.json] [-out compare] [-json]
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	source := fs.String("source", "", "source file to encode")
+	nameA := fs.String("a", converter.DefaultProfileName, "baseline profile")
+	nameB := fs.String("b", "", "profile compared with the baseline")
+	profilesFile := fs.String("profiles", getEnvOrDefault("PROFILES_FILE", ""), "JSON file of the profiles")
+	out := fs.String("out", "compare", "directory the encodes are written to")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+	if *source == "" || *nameB == "" {
+		return fmt.Errorf("compare: -source and -b are required")
+	}
+	if *nameA == *nameB {
+		return fmt.Errorf("compare: -a and -b are the same profile")
+	}
+
+	profiles := map[string]converter.Profile{converter.DefaultProfileName: converter.DefaultProfile}
+	if *profilesFile != "" {
+		loaded, err := converter.LoadProfiles(*profilesFile)
+		if err != nil {
+			return fmt.Errorf("compare: %w", err)
+		}
+		for _, p := range loaded {
+			profiles[p.Name] = p
+		}
+	}
+	a, ok := profiles[*nameA]
+	if !ok {
+		return fmt.Errorf("compare: unknown profile %s", *nameA)
+	}
+	b, ok := profiles[*nameB]
+	if !ok {
+		return fmt.Errorf("compare: unknown profile %s", *nameB)
+	}
+
+	runner := ffmpeg.ExecRunner{FFmpegPath: getEnvOrDefault("FFMPEG_PATH", ""), FFprobePath: getEnvOrDefault("FFPROBE_PATH", "")}
+	report, err := converter.CompareProfiles(context.Background(), runner, *source, a, b, *out)
+	if err != nil {
+		return fmt.Errorf("compare: %w", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "profile\tsize MB\tbitrate kb/s\tencode s\tvmaf\t\n")
+	for _, r := range []converter.EncodeResult{report.A, report.B} {
+		fmt.Fprintf(w, "%s\t%.2f\t%d\t%.1f\t%.2f\t\n", r.Profile, float64(r.Bytes)/1e6, r.Bitrate/1000, r.EncodeSeconds, r.VMAF)
+	}
+	fmt.Fprintf(w, "delta\t\t%+.1f%%\t%+.1f%%\t%+.2f\t\n", report.BitrateDelta, report.SpeedDelta, report.VMAFDelta)
+	return w.Flush()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/rabbitmq"
+)
+
+// amqpEnqueuer publishes tasks to the conversion exchange
+type amqpEnqueuer struct{}
+
+func (amqpEnqueuer) Enqueue(task converter.VideoTask) error {
+	return publishTask(task)
+}
+
+// publishTask publishes a task to the exchange the consumer is bound to
+func publishTask(task converter.VideoTask) error {
+	return publishJSON(task)
+}
+
+// publishJSON publishes a message, a task or a batch of tasks, to the
+// exchange the consumer is bound to, or to PUBSUB_TOPIC or the Redis
+// stream when set
+func publishJSON(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if enqueuer, err := pubsubEnqueuer(); err != nil || enqueuer != nil {
+		if err != nil {
+			return err
+		}
+		var orderingKey string
+		if task, ok := v.(converter.VideoTask); ok {
+			orderingKey = strconv.Itoa(task.VideoID)
+		}
+		return enqueuer.PublishJSON(body, orderingKey)
+	}
+	if enqueuer, err := redisEnqueuer(); err != nil || enqueuer != nil {
+		if err != nil {
+			return err
+		}
+		return enqueuer.PublishJSON(body)
+	}
+
+	url := getSecret("RABBITMQ_URL", "")
+	if url == "" {
+		return fmt.Errorf("RABBITMQ_URL is not set")
+	}
+	return rabbitmq.Publish(url, rabbitmqTLS(),
+		getEnvOrDefault("RABBITMQ_EXCHANGE", "conversion_exchange"),
+		getEnvOrDefault("RABBITMQ_ROUTING_KEY", "conversion"),
+		rabbitmq.Publishing{Properties: rabbitmq.Properties{ContentType: "application/json"}, Body: body},
+	)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"imersaofc/internal/converter/convertertest"
+)
+
+// runGenMedia writes a synthetic upload for demos:
+//
+//	videoconverter gen-media -video-id 1 [-out media/uploads] [-duration 10] [-audio-only]
+func runGenMedia(args []string) error {
+	fs := flag.NewFlagSet("gen-media", flag.ExitOnError)
+	videoID := fs.Int("video-id", 0, "video id, the chunks go to <out>/<video-id>")
+	out := fs.String("out", "media/uploads", "upload root")
+	duration := fs.Float64("duration", 10, "duration in seconds")
+	width := fs.Int("width", 640, "video width")
+	height := fs.Int("height", 360, "video height")
+	audioOnly := fs.Bool("audio-only", false, "generate an audio-only upload")
+	chunkSize := fs.Int("chunk-size", 1024*1024, "chunk size in bytes")
+	fs.Parse(args)
+	if *videoID <= 0 {
+		return fmt.Errorf("gen-media: -video-id is required")
+	}
+
+	dir, err := convertertest.GenerateChunks(context.Background(), *out, *videoID, convertertest.MediaOptions{
+		Duration: *duration,
+		Width:    *width,
+		Height:   *height,
+		NoVideo:  *audioOnly,
+	}, *chunkSize)
+	if err != nil {
+		return err
+	}
+	slog.Info("Synthetic upload written", slog.String("path", dir))
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"imersaofc/internal/audit"
+	"imersaofc/internal/converter"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/storage"
+)
+
+// runLive waits for an encoder to publish over RTMP or SRT and packages the
+// stream as low latency DASH into the STORAGE_BACKEND bucket, until the
+// encoder disconnects or the command is interrupted. With -archive the
+// stream is also recorded and converted to a VOD asset once it ends:
+//
+//	videoconverter live -video-id 42 -input rtmp://0.0.0.0:1935/live/key [-profile hd] [-segment 2s] [-window 10] [-archive]
+func runLive(args []string) error {
+	fs := flag.NewFlagSet("live", flag.ExitOnError)
+	videoID := fs.Int("video-id", 0, "video the stream is stored as")
+	input := fs.String("input", "", "rtmp:// or srt:// url the encoder publishes to")
+	profile := fs.String("profile", "", "encoding profile, the default one when empty")
+	tenant := fs.String("tenant", "", "tenant of the video, for the output prefix")
+	dir := fs.String("dir", "", "local directory the stream is packaged into before upload")
+	segment := fs.Duration("segment", 2*time.Second, "segment duration")
+	window := fs.Int("window", 10, "segments listed in the manifest")
+	utcTiming := fs.String("utc-timing-url", converter.DefaultUTCTimingURL, "clock players sync with")
+	archive := fs.Bool("archive", false, "record the stream and convert it to a VOD asset when it ends")
+	archiveDir := fs.String("archive-dir", "", "local directory the recording is kept in until it is converted")
+	archiveProfile := fs.String("archive-profile", "", "encoding profile of the VOD asset, -profile when empty")
+	fs.Parse(args)
+	if *videoID <= 0 || *input == "" {
+		return fmt.Errorf("live: -video-id and -input are required")
+	}
+
+	layout, err := outputLayout()
+	if err != nil {
+		return err
+	}
+	runner, err := newRemoteRunner()
+	if err != nil {
+		return err
+	}
+	if runner == nil {
+		caps, err := ffmpeg.Discover(context.Background(),
+			getEnvOrDefault("FFMPEG_PATH", ""),
+			getEnvOrDefault("FFPROBE_PATH", ""),
+			getEnvOrDefault("FFMPEG_MIN_VERSION", ffmpeg.DefaultMinVersion),
+		)
+		if err != nil {
+			return err
+		}
+		runner = caps.Runner()
+	}
+	profiles := []converter.Profile{converter.DefaultProfile}
+	if path := getEnvOrDefault("PROFILES_FILE", ""); path != "" {
+		loaded, err := converter.LoadProfiles(path)
+		if err != nil {
+			return err
+		}
+		profiles = append(profiles, loaded...)
+	}
+	opts := []converter.Option{
+		converter.WithOutputLayout(layout),
+		converter.WithRunner(runner),
+		converter.WithProfiles(profiles...),
+	}
+
+	uploader, err := newUploader()
+	if err != nil {
+		return err
+	}
+	if uploader != nil {
+		attempts, _ := strconv.Atoi(getEnvOrDefault("UPLOAD_MAX_ATTEMPTS", "3"))
+		backoff, _ := time.ParseDuration(getEnvOrDefault("UPLOAD_RETRY_BACKOFF", "1s"))
+		opts = append(opts, converter.WithUploader(storage.NewRetryUploader(uploader, attempts, backoff)))
+	} else {
+		slog.Warn("No STORAGE_BACKEND, the stream is only packaged locally")
+	}
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	hostname, _ := os.Hostname()
+	recorder := audit.NewRecorder(db, getEnvOrDefault("WORKER_ID", hostname))
+	opts = append(opts, converter.WithSubscriber(recorder.Record))
+	if publisher := newPublisher(db); publisher != nil {
+		opts = append(opts, converter.WithPublisher(publisher))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	vc := converter.NewVideoConverter(db, opts...)
+	return vc.RunLive(ctx, converter.LiveStream{
+		VideoID:         *videoID,
+		Input:           *input,
+		Profile:         *profile,
+		Tenant:          *tenant,
+		Dir:             *dir,
+		SegmentDuration: *segment,
+		Window:          *window,
+		UTCTimingURL:    *utcTiming,
+		Archive:         *archive,
+		ArchiveDir:      *archiveDir,
+		ArchiveProfile:  *archiveProfile,
+	})
+}
@@ -1,36 +1,120 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"imersaofc/internal/converter"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"imersaofc/internal/alert"
+	"imersaofc/internal/api"
+	"imersaofc/internal/audit"
+	"imersaofc/internal/auth"
+	"imersaofc/internal/captions"
+	"imersaofc/internal/cdn"
+	"imersaofc/internal/database"
+	"imersaofc/internal/fetch"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/ingest"
+	"imersaofc/internal/mediaconvert"
+	"imersaofc/internal/metrics"
+	"imersaofc/internal/moderation"
+	"imersaofc/internal/outbox"
+	"imersaofc/internal/pubsub"
+	"imersaofc/internal/rabbitmq"
+	"imersaofc/internal/redaction"
+	"imersaofc/internal/redisstream"
+	"imersaofc/internal/stats"
+	"imersaofc/internal/storage"
+	"imersaofc/internal/webhook"
 
 	_ "github.com/lib/pq"
 )
 
-func connectPostgres() (*sql.DB, error) {
-	user := getEnvOrDefault("POSTGRES_USER", "user")
-	password := getEnvOrDefault("POSTGRES_PASSWORD", "password")
-	dbname := getEnvOrDefault("POSTGRES_DB", "converter")
-	host := getEnvOrDefault("POSTGRES_HOST", "postgres")
-	sslmode := getEnvOrDefault("POSTGRES_SSLMODE", "disable")
+// connectDatabase connects to the database selected by DB_DRIVER (postgres or mysql)
+func connectDatabase() (*database.DB, error) {
+	driver := getEnvOrDefault("DB_DRIVER", "postgres")
+	// The password is read from the secret store for each new connection,
+	// so a rotated one is used once the pool recycles its connections
+	var dsn func(ctx context.Context) (string, error)
+	var host, dbname string
+	switch driver {
+	case "postgres":
+		user := getEnvOrDefault("POSTGRES_USER", "user")
+		dbname = getEnvOrDefault("POSTGRES_DB", "converter")
+		host = getEnvOrDefault("POSTGRES_HOST", "postgres")
+		sslmode := getEnvOrDefault("POSTGRES_SSLMODE", "disable")
+		// With sslmode=verify-full, POSTGRES_SSLROOTCERT is the CA bundle
+		// and POSTGRES_SSLCERT and POSTGRES_SSLKEY the client certificate;
+		// lib/pq reads them on each connection
+		var sslFiles string
+		for _, f := range []struct{ key, env string }{
+			{"sslrootcert", "POSTGRES_SSLROOTCERT"},
+			{"sslcert", "POSTGRES_SSLCERT"},
+			{"sslkey", "POSTGRES_SSLKEY"},
+		} {
+			if path := getEnvOrDefault(f.env, ""); path != "" {
+				sslFiles += fmt.Sprintf(" %s='%s'", f.key, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(path))
+			}
+		}
+		dsn = func(ctx context.Context) (string, error) {
+			password, err := dbPassword(ctx, "POSTGRES_PASSWORD")
+			return fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=%s", user, password, dbname, host, sslmode) + sslFiles, err
+		}
+	case "mysql":
+		// Requires a binary built with the mysql tag, see mysql.go
+		user := getEnvOrDefault("MYSQL_USER", "user")
+		dbname = getEnvOrDefault("MYSQL_DATABASE", "converter")
+		host = getEnvOrDefault("MYSQL_HOST", "mysql")
+		port := getEnvOrDefault("MYSQL_PORT", "3306")
+		dsn = func(ctx context.Context) (string, error) {
+			password, err := dbPassword(ctx, "MYSQL_PASSWORD")
+			return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", user, password, host, port, dbname), err
+		}
+	case "sqlite":
+		// Always linked, see sqlite.go
+		dbname = getEnvOrDefault("SQLITE_PATH", "converter.db")
+		connStr := "file:" + dbname + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+		dsn = func(ctx context.Context) (string, error) { return connStr, nil }
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER: %s", driver)
+	}
+
+	maxOpen, _ := strconv.Atoi(getEnvOrDefault("DB_MAX_OPEN_CONNS", "10"))
+	maxIdle, _ := strconv.Atoi(getEnvOrDefault("DB_MAX_IDLE_CONNS", "5"))
+	lifetime, _ := time.ParseDuration(getEnvOrDefault("DB_CONN_MAX_LIFETIME", "30m"))
+	idleTime, _ := time.ParseDuration(getEnvOrDefault("DB_CONN_MAX_IDLE_TIME", "5m"))
+	timeout, _ := time.ParseDuration(getEnvOrDefault("DB_CONNECT_TIMEOUT", "60s"))
 
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=%s", user, password, dbname, host, sslmode)
-	db, err := sql.Open("postgres", connStr)
+	db, err := database.OpenRotating(driver, dsn, database.PoolConfig{
+		MaxOpenConns:    maxOpen,
+		MaxIdleConns:    maxIdle,
+		ConnMaxLifetime: lifetime,
+		ConnMaxIdleTime: idleTime,
+	}, timeout)
 	if err != nil {
-		slog.Error("Error connecting to database", slog.String("connStr", connStr))
+		slog.Error("Error connecting to database", slog.String("driver", driver), slog.String("host", host), slog.String("dbname", dbname))
 		return nil, err
 	}
 
-	err = db.Ping()
-	if err != nil {
-		slog.Error("Error pinging database", slog.String("connStr", connStr))
-		return nil, err
+	if err := database.EnsureSchema(context.Background(), db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
 	}
 
-	slog.Info("Connected to Postgres successfully")
+	slog.Info("Connected to database successfully", slog.String("driver", driver))
 	return db, nil
 }
 
@@ -41,11 +125,906 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// usableProfiles drops the profiles needing encoders ffmpeg lacks; the
+// default profile is required, so the worker refuses to start without it
+func usableProfiles(caps *ffmpeg.Capabilities, profiles []converter.Profile) []converter.Profile {
+	usable := map[string]converter.Profile{}
+	for _, p := range profiles {
+		var missing []string
+		for _, encoder := range p.RequiredEncoders() {
+			if !caps.HasEncoder(encoder) {
+				missing = append(missing, encoder)
+			}
+		}
+		if len(missing) > 0 {
+			slog.Warn("Disabling profile, missing encoders", slog.String("profile", p.Name), slog.String("encoders", strings.Join(missing, ",")))
+			delete(usable, p.Name)
+			continue
+		}
+		usable[p.Name] = p
+	}
+	if _, ok := usable[converter.DefaultProfileName]; !ok {
+		panic("the default profile needs encoders this ffmpeg build doesn't have")
+	}
+
+	list := make([]converter.Profile, 0, len(usable))
+	for _, p := range usable {
+		list = append(list, p)
+	}
+	return list
+}
+
+// parseRollouts parses a list of profile=canary:percent, such as
+// "default=x265-test:5", dropping the rollouts to profiles that aren't
+// usable, so a canary missing its encoder doesn't stop the worker
+func parseRollouts(list string, usable []converter.Profile) ([]converter.ProfileRollout, error) {
+	var rollouts []converter.ProfileRollout
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		profile, rest, ok := strings.Cut(item, "=")
+		canary, value, ok2 := strings.Cut(rest, ":")
+		percent, err := strconv.ParseFloat(value, 64)
+		if !ok || !ok2 || err != nil {
+			return nil, fmt.Errorf("bad rollout %q, expected profile=canary:percent", item)
+		}
+		if !slices.ContainsFunc(usable, func(p converter.Profile) bool { return p.Name == canary }) {
+			slog.Warn("Disabling rollout, canary profile isn't usable", slog.String("profile", profile), slog.String("canary", canary))
+			continue
+		}
+		rollouts = append(rollouts, converter.ProfileRollout{Profile: profile, Canary: canary, Percent: percent})
+	}
+	return rollouts, nil
+}
+
+// usableRules drops the profile rules picking profiles that aren't usable,
+// so sources they match get the default profile instead
+func usableRules(rules []converter.ProfileRule, usable []converter.Profile) []converter.ProfileRule {
+	var kept []converter.ProfileRule
+	for _, r := range rules {
+		if !slices.ContainsFunc(usable, func(p converter.Profile) bool { return p.Name == r.Profile }) {
+			slog.Warn("Disabling profile rule, profile isn't usable", slog.String("profile", r.Profile))
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept
+}
+
+// setEnvDefault sets an environment variable unless it is already set
+func setEnvDefault(key, value string) {
+	if _, exists := os.LookupEnv(key); !exists {
+		os.Setenv(key, value)
+	}
+}
+
+// outputLayout returns where the output lands in storage, e.g.
+// OUTPUT_PREFIX={tenant}/{video_id}/{profile} and
+// OUTPUT_MEDIA_SEGMENT={rendition}/seg_$Number$.m4s for CDN path conventions,
+// with OUTPUT_SEGMENT_DURATION=10s and OUTPUT_ON_DEMAND=true trading the
+// number of segment files for their size
+func outputLayout() (converter.OutputLayout, error) {
+	onDemand, err := strconv.ParseBool(getEnvOrDefault("OUTPUT_ON_DEMAND", "false"))
+	if err != nil {
+		return converter.OutputLayout{}, fmt.Errorf("invalid OUTPUT_ON_DEMAND: %w", err)
+	}
+	segmentDuration, err := time.ParseDuration(getEnvOrDefault("OUTPUT_SEGMENT_DURATION", "0s"))
+	if err != nil {
+		return converter.OutputLayout{}, fmt.Errorf("invalid OUTPUT_SEGMENT_DURATION: %w", err)
+	}
+	layout := converter.OutputLayout{
+		Prefix:          getEnvOrDefault("OUTPUT_PREFIX", converter.DefaultOutputLayout.Prefix),
+		Manifest:        getEnvOrDefault("OUTPUT_MANIFEST", converter.DefaultOutputLayout.Manifest),
+		InitSegment:     getEnvOrDefault("OUTPUT_INIT_SEGMENT", converter.DefaultOutputLayout.InitSegment),
+		MediaSegment:    getEnvOrDefault("OUTPUT_MEDIA_SEGMENT", converter.DefaultOutputLayout.MediaSegment),
+		SingleFile:      getEnvOrDefault("OUTPUT_SINGLE_FILE", converter.DefaultOutputLayout.SingleFile),
+		OnDemand:        onDemand,
+		SegmentDuration: segmentDuration,
+	}
+	return layout, layout.Validate()
+}
+
+// newUploader builds the remote storage uploader selected by STORAGE_BACKEND
+func newUploader() (storage.Uploader, error) {
+	switch backend := getEnvOrDefault("STORAGE_BACKEND", ""); backend {
+	case "":
+		return nil, nil
+	case "gcs":
+		chunkSize, _ := strconv.Atoi(getEnvOrDefault("GCS_CHUNK_SIZE", "0"))
+		return storage.NewGCSUploader(storage.GCSConfig{
+			Bucket:          getEnvOrDefault("GCS_BUCKET", ""),
+			StorageClass:    getEnvOrDefault("GCS_STORAGE_CLASS", ""),
+			CredentialsFile: getEnvOrDefault("GOOGLE_APPLICATION_CREDENTIALS", ""),
+			ChunkSize:       chunkSize,
+		})
+	case "azure":
+		blockSize, _ := strconv.Atoi(getEnvOrDefault("AZURE_BLOCK_SIZE", "0"))
+		parallelism, _ := strconv.Atoi(getEnvOrDefault("AZURE_UPLOAD_PARALLELISM", "0"))
+		return storage.NewAzureUploader(storage.AzureConfig{
+			Account:     getEnvOrDefault("AZURE_STORAGE_ACCOUNT", ""),
+			Container:   getEnvOrDefault("AZURE_STORAGE_CONTAINER", ""),
+			SASToken:    getSecret("AZURE_STORAGE_SAS_TOKEN", ""),
+			AccountKey:  getSecret("AZURE_STORAGE_ACCOUNT_KEY", ""),
+			ClientID:    getEnvOrDefault("AZURE_CLIENT_ID", ""),
+			BlockSize:   blockSize,
+			Parallelism: parallelism,
+		})
+	case "s3":
+		creds, err := awsCredentials(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewS3Uploader(storage.S3Config{
+			Bucket:       getEnvOrDefault("S3_BUCKET", ""),
+			Region:       getEnvOrDefault("AWS_REGION", ""),
+			Endpoint:     getEnvOrDefault("S3_ENDPOINT", ""),
+			Creds:        creds,
+			RefreshCreds: awsCredentials,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
+
+// workspaceKey returns the key merged mezzanines are encrypted with:
+// WORKSPACE_ENCRYPTION_KEY, 32 hex digits, or with
+// WORKSPACE_ENCRYPTION=true and no key, a random one held in memory only
+func workspaceKey() ([]byte, error) {
+	if encoded := getSecret("WORKSPACE_ENCRYPTION_KEY", ""); encoded != "" {
+		key, err := hex.DecodeString(encoded)
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("WORKSPACE_ENCRYPTION_KEY must be 32 hex digits")
+		}
+		return key, nil
+	}
+	if enabled, _ := strconv.ParseBool(getEnvOrDefault("WORKSPACE_ENCRYPTION", "false")); !enabled {
+		return nil, nil
+	}
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// newAuthenticator builds the authentication of the status and ingest
+// APIs: API_KEYS, as "name:role:key" entries, and bearer JWTs verified
+// with JWT_HS256_SECRET or the RSA key in JWT_PUBLIC_KEY_FILE, checked
+// against JWT_ISSUER and JWT_AUDIENCE and carrying the role in
+// JWT_ROLE_CLAIM. The roles are read, submit and admin. It returns nil
+// when none is set.
+func newAuthenticator() (auth.Authenticator, error) {
+	var authn auth.Multi
+	keys, err := auth.ParseAPIKeys(getSecret("API_KEYS", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		authn = append(authn, keys)
+	}
+	jwt := auth.JWT{
+		Secret:    []byte(getSecret("JWT_HS256_SECRET", "")),
+		Issuer:    getEnvOrDefault("JWT_ISSUER", ""),
+		Audience:  getEnvOrDefault("JWT_AUDIENCE", ""),
+		RoleClaim: getEnvOrDefault("JWT_ROLE_CLAIM", ""),
+	}
+	if path := getEnvOrDefault("JWT_PUBLIC_KEY_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if jwt.PublicKey, err = auth.ParseRSAPublicKey(data); err != nil {
+			return nil, err
+		}
+	}
+	if len(jwt.Secret) > 0 || jwt.PublicKey != nil {
+		authn = append(authn, jwt)
+	}
+	if len(authn) == 0 {
+		return nil, nil
+	}
+	return authn, nil
+}
+
+// newPublisher builds the publisher of completion events: they go to the
+// webhook and, through the outbox relayed by "videoconverter outbox-relay",
+// to Kafka. It returns nil when neither is configured.
+func newPublisher(db *database.DB) converter.Publisher {
+	var publishers converter.Publishers
+	if sender := newWebhookSender(db); sender != nil {
+		publishers = append(publishers, sender)
+	}
+	if getEnvOrDefault("KAFKA_BROKERS", "") != "" {
+		publishers = append(publishers, outbox.NewPublisher(db, getEnvOrDefault("KAFKA_TOPIC", outbox.DefaultTopic), eventSigner()))
+	}
+	switch len(publishers) {
+	case 0:
+		return nil
+	case 1:
+		return publishers[0]
+	}
+	return publishers
+}
+
+// newWebhookSender builds the sender of completion events to WEBHOOK_URL,
+// tracking its deliveries in db, or returns nil when it isn't set
+func newWebhookSender(db *database.DB) *webhook.Sender {
+	url := getEnvOrDefault("WEBHOOK_URL", "")
+	if url == "" {
+		return nil
+	}
+	return webhook.NewSender(url, eventSigner(), db)
+}
+
+// newRemoteTranscoder builds the transcoder selected by TRANSCODER_REMOTE
+// that heavy jobs are offloaded to
+func newRemoteTranscoder() (converter.Transcoder, error) {
+	switch backend := getEnvOrDefault("TRANSCODER_REMOTE", ""); backend {
+	case "":
+		return nil, nil
+	case "mediaconvert":
+		creds, err := awsCredentials(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		region := getEnvOrDefault("AWS_REGION", "")
+		staging, err := storage.NewS3Uploader(storage.S3Config{
+			Bucket:       getEnvOrDefault("MEDIACONVERT_BUCKET", ""),
+			Region:       region,
+			Creds:        creds,
+			RefreshCreds: awsCredentials,
+		})
+		if err != nil {
+			return nil, err
+		}
+		poll, _ := time.ParseDuration(getEnvOrDefault("MEDIACONVERT_POLL_INTERVAL", "15s"))
+		timeout, _ := time.ParseDuration(getEnvOrDefault("MEDIACONVERT_TIMEOUT", "2h"))
+		return mediaconvert.New(mediaconvert.Config{
+			Region:       region,
+			Endpoint:     getEnvOrDefault("MEDIACONVERT_ENDPOINT", ""),
+			RoleARN:      getEnvOrDefault("MEDIACONVERT_ROLE_ARN", ""),
+			Queue:        getEnvOrDefault("MEDIACONVERT_QUEUE", ""),
+			Prefix:       getEnvOrDefault("MEDIACONVERT_PREFIX", "mediaconvert"),
+			PollInterval: poll,
+			Timeout:      timeout,
+		}, creds, staging)
+	default:
+		return nil, fmt.Errorf("unknown remote transcoder: %s", backend)
+	}
+}
+
+// newRemoteRunner builds the runner selected by FFMPEG_REMOTE that encodes
+// on another host; nil means ffmpeg runs locally
+func newRemoteRunner() (ffmpeg.Runner, error) {
+	paths := ffmpeg.PathMap{
+		Local:  getEnvOrDefault("FFMPEG_REMOTE_LOCAL_ROOT", ""),
+		Remote: getEnvOrDefault("FFMPEG_REMOTE_ROOT", ""),
+	}
+	switch remote := getEnvOrDefault("FFMPEG_REMOTE", ""); remote {
+	case "":
+		return nil, nil
+	case "ssh":
+		port, _ := strconv.Atoi(getEnvOrDefault("FFMPEG_SSH_PORT", "0"))
+		return ffmpeg.SSHRunner{
+			Host:        getEnvOrDefault("FFMPEG_SSH_HOST", ""),
+			Port:        port,
+			KeyFile:     getEnvOrDefault("FFMPEG_SSH_KEY_FILE", ""),
+			FFmpegPath:  getEnvOrDefault("FFMPEG_PATH", ""),
+			FFprobePath: getEnvOrDefault("FFPROBE_PATH", ""),
+			Paths:       paths,
+		}, nil
+	case "agent":
+		agentURL := getEnvOrDefault("FFMPEG_AGENT_URL", "")
+		if !strings.HasPrefix(agentURL, "https://") {
+			return nil, fmt.Errorf("FFMPEG_AGENT_URL must be an https:// URL")
+		}
+		config, err := tlsConfig("FFMPEG_AGENT")
+		if err != nil {
+			return nil, err
+		}
+		return ffmpeg.AgentRunner{
+			URL:    agentURL,
+			Token:  getSecret("FFMPEG_AGENT_TOKEN", ""),
+			Paths:  paths,
+			Client: &http.Client{Transport: &http.Transport{TLSClientConfig: config}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown remote ffmpeg: %s", remote)
+	}
+}
+
+// newInvalidator builds the CDN invalidator selected by CDN_PROVIDER
+func newInvalidator() (cdn.Invalidator, error) {
+	switch provider := getEnvOrDefault("CDN_PROVIDER", ""); provider {
+	case "":
+		return nil, nil
+	case "cloudfront":
+		creds, err := awsCredentials(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return cdn.NewCloudFront(getEnvOrDefault("CLOUDFRONT_DISTRIBUTION_ID", ""), creds), nil
+	case "cloudflare":
+		return cdn.NewCloudflare(
+			getEnvOrDefault("CLOUDFLARE_ZONE_ID", ""),
+			getSecret("CLOUDFLARE_API_TOKEN", ""),
+			getEnvOrDefault("CDN_HOST", ""),
+		), nil
+	case "fastly":
+		return cdn.NewFastly(
+			getEnvOrDefault("FASTLY_SERVICE_ID", ""),
+			getSecret("FASTLY_API_KEY", ""),
+			getEnvOrDefault("CDN_HOST", ""),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown cdn provider: %s", provider)
+	}
+}
+
+// newCaptioner builds the speech-to-text engine selected by CAPTIONER that
+// transcribes the tasks asking for captions
+func newCaptioner() (converter.Captioner, error) {
+	switch engine := getEnvOrDefault("CAPTIONER", ""); engine {
+	case "":
+		return nil, nil
+	case "whisper-cpp":
+		threads, _ := strconv.Atoi(getEnvOrDefault("WHISPER_THREADS", "0"))
+		return captions.WhisperCPP{
+			Path:    getEnvOrDefault("WHISPER_CPP_PATH", ""),
+			Model:   getEnvOrDefault("WHISPER_MODEL", ""),
+			Threads: threads,
+		}, nil
+	case "openai":
+		return captions.OpenAI{
+			APIKey:  getSecret("OPENAI_API_KEY", ""),
+			Model:   getEnvOrDefault("OPENAI_TRANSCRIPTION_MODEL", ""),
+			BaseURL: getEnvOrDefault("OPENAI_BASE_URL", ""),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown captioner: %s", engine)
+	}
+}
+
+// newModeration builds the frame classifier of MODERATION_URL and the
+// thresholds of MODERATION_FLAG and MODERATION_BLOCK, lists of label=score
+// such as "nsfw=0.8,violence=0.9"
+func newModeration() (converter.Classifier, converter.ModerationPolicy, error) {
+	url := getEnvOrDefault("MODERATION_URL", "")
+	if url == "" {
+		return nil, converter.ModerationPolicy{}, nil
+	}
+	interval, _ := time.ParseDuration(getEnvOrDefault("MODERATION_INTERVAL", "0"))
+	maxFrames, _ := strconv.Atoi(getEnvOrDefault("MODERATION_MAX_FRAMES", "0"))
+	policy := converter.ModerationPolicy{Interval: interval, MaxFrames: maxFrames}
+	var err error
+	if policy.Flag, err = parseThresholds(getEnvOrDefault("MODERATION_FLAG", "")); err != nil {
+		return nil, policy, fmt.Errorf("MODERATION_FLAG: %w", err)
+	}
+	if policy.Block, err = parseThresholds(getEnvOrDefault("MODERATION_BLOCK", "")); err != nil {
+		return nil, policy, fmt.Errorf("MODERATION_BLOCK: %w", err)
+	}
+	return moderation.HTTPClassifier{URL: url, Token: getSecret("MODERATION_TOKEN", "")}, policy, nil
+}
+
+// parseThresholds parses a list of label=score
+func parseThresholds(list string) (map[string]float64, error) {
+	thresholds := map[string]float64{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		label, value, ok := strings.Cut(item, "=")
+		score, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("bad threshold %q, expected label=score", item)
+		}
+		thresholds[strings.TrimSpace(label)] = score
+	}
+	return thresholds, nil
+}
+
+// newTranslator builds the translation provider selected by TRANSLATOR
+// that translates captions into the languages tasks ask for
+func newTranslator() (converter.Translator, error) {
+	switch provider := getEnvOrDefault("TRANSLATOR", ""); provider {
+	case "":
+		return nil, nil
+	case "deepl":
+		return captions.DeepL{
+			AuthKey: getSecret("DEEPL_AUTH_KEY", ""),
+			BaseURL: getEnvOrDefault("DEEPL_BASE_URL", ""),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown translator: %s", provider)
+	}
+}
+
 func main() {
-	db, err := connectPostgres()
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			if err := runReplay(os.Args[2:]); err != nil {
+				slog.Error("Replay failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "gen-media":
+			if err := runGenMedia(os.Args[2:]); err != nil {
+				slog.Error("Generating media failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "reprocess":
+			if err := runReprocess(os.Args[2:]); err != nil {
+				slog.Error("Reprocess failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "backfill":
+			if err := runBackfill(os.Args[2:]); err != nil {
+				slog.Error("Backfill failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "stats":
+			if err := runStats(os.Args[2:]); err != nil {
+				slog.Error("Stats failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "topology":
+			if err := runTopology(os.Args[2:]); err != nil {
+				slog.Error("Declaring topology failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "outbox-relay":
+			if err := runOutboxRelay(os.Args[2:]); err != nil {
+				slog.Error("Outbox relay failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "live":
+			if err := runLive(os.Args[2:]); err != nil {
+				slog.Error("Live stream failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "compare":
+			if err := runCompare(os.Args[2:]); err != nil {
+				slog.Error("Comparison failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "webhooks":
+			if err := runWebhooks(os.Args[2:]); err != nil {
+				slog.Error("Webhooks failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		case "encode-agent":
+			if err := runAgent(os.Args[2:]); err != nil {
+				slog.Error("Encode agent failed", slog.String("error", err.Error()))
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// --dev runs everything in one process with no external services:
+	// SQLite, the in-process queue, the ingest server and the status api
+	dev := flag.Bool("dev", false, "run with SQLite and an in-memory queue for local development")
+	// --dry-run logs what each task would run and write instead of converting it
+	dryRun := flag.Bool("dry-run", false, "log the plan of each task instead of converting it")
+	flag.Parse()
+	if *dev {
+		setEnvDefault("DB_DRIVER", "sqlite")
+		setEnvDefault("INGEST_ADDR", ":8080")
+		setEnvDefault("API_ADDR", ":8081")
+		setEnvDefault("API_INSECURE", "true")
+	}
+
+	// SIGTERM and interrupts cancel the tasks being converted, which are
+	// left unacknowledged for the broker to deliver again
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := connectDatabase()
+	if err != nil {
+		panic(err)
+	}
+
+	opts := []converter.Option{
+		converter.WithChunkLayout(converter.ChunkLayout{
+			Pattern: getEnvOrDefault("CHUNK_PATTERN", converter.DefaultChunkLayout.Pattern),
+			Order:   converter.ChunkOrder(getEnvOrDefault("CHUNK_ORDER", string(converter.DefaultChunkLayout.Order))),
+		}),
+	}
+	layout, err := outputLayout()
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, converter.WithOutputLayout(layout))
+	if *dryRun {
+		opts = append(opts, converter.WithDryRun())
+	}
+	if stages := getEnvOrDefault("PIPELINE_STAGES", ""); stages != "" {
+		opts = append(opts, converter.WithStageOrder(strings.Split(stages, ",")...))
+	}
+
+	// Locate ffmpeg, here or on the remote encode host, and make sure it
+	// can encode what the profiles ask for
+	runner, err := newRemoteRunner()
+	if err != nil {
+		panic(err)
+	}
+	minVersion := getEnvOrDefault("FFMPEG_MIN_VERSION", ffmpeg.DefaultMinVersion)
+	var caps *ffmpeg.Capabilities
+	if runner != nil {
+		caps, err = ffmpeg.DiscoverRemote(ctx, runner, minVersion)
+	} else {
+		caps, err = ffmpeg.Discover(ctx,
+			getEnvOrDefault("FFMPEG_PATH", ""),
+			getEnvOrDefault("FFPROBE_PATH", ""),
+			minVersion,
+		)
+		if err == nil {
+			runner = caps.Runner()
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	caps.Report("libx264", "libx265", "h264_nvenc", "libvpx-vp9", "aac", "libmp3lame")
+	opts = append(opts, converter.WithRunner(runner), converter.WithFFmpegVersion(caps.Version))
+
+	profiles := []converter.Profile{converter.DefaultProfile}
+	if path := getEnvOrDefault("PROFILES_FILE", ""); path != "" {
+		loaded, err := converter.LoadProfiles(path)
+		if err != nil {
+			panic(err)
+		}
+		profiles = append(profiles, loaded...)
+	}
+	usable := usableProfiles(caps, profiles)
+	opts = append(opts, converter.WithProfiles(usable...))
+	rollouts, err := parseRollouts(getEnvOrDefault("PROFILE_ROLLOUTS", ""), usable)
+	if err != nil {
+		panic(fmt.Errorf("PROFILE_ROLLOUTS: %w", err))
+	}
+	opts = append(opts, converter.WithProfileRollouts(rollouts...))
+	if path := getEnvOrDefault("PROFILE_RULES_FILE", ""); path != "" {
+		rules, err := converter.LoadProfileRules(path)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, converter.WithProfileRules(usableRules(rules, usable)...))
+	}
+	if formats := getEnvOrDefault("SOURCE_FORMATS", ""); formats != "" {
+		opts = append(opts, converter.WithSourceFormats(strings.Split(formats, ",")))
+	}
+	var apiOpts []api.Option
+	if dir := getEnvOrDefault("FFMPEG_LOG_DIR", ""); dir != "" {
+		apiOpts = append(apiOpts, api.WithFFmpegLogs(dir))
+		maxAge, _ := time.ParseDuration(getEnvOrDefault("FFMPEG_LOG_MAX_AGE", "168h"))
+		maxFiles, _ := strconv.Atoi(getEnvOrDefault("FFMPEG_LOG_MAX_FILES", "1000"))
+		upload, _ := strconv.ParseBool(getEnvOrDefault("FFMPEG_LOG_UPLOAD", "false"))
+		opts = append(opts, converter.WithFFmpegLogs(converter.FFmpegLogPolicy{
+			Dir:      dir,
+			MaxAge:   maxAge,
+			MaxFiles: maxFiles,
+			Upload:   upload,
+		}))
+	}
+	// Tasks with a source_url download it, into DOWNLOAD_DIR/{video_id}
+	// when they have no path, at most DOWNLOAD_RATE_LIMIT bytes per second
+	downloadRate, _ := strconv.ParseInt(getEnvOrDefault("DOWNLOAD_RATE_LIMIT", "0"), 10, 64)
+	opts = append(opts, converter.WithDownloads(converter.DownloadPolicy{
+		Dir:       getEnvOrDefault("DOWNLOAD_DIR", ""),
+		RateLimit: downloadRate,
+	}))
+	// Partners delivering over FTP or SFTP; SFTP logs in with SFTP_KEY_FILE
+	// or the keys of the ssh configuration
+	opts = append(opts,
+		converter.WithFetcher("ftp", fetch.FTP{}),
+		converter.WithFetcher("sftp", fetch.SFTP{KeyFile: getEnvOrDefault("SFTP_KEY_FILE", "")}),
+	)
+	key, err := workspaceKey()
+	if err != nil {
+		panic(err)
+	}
+	if key != nil {
+		// The encrypted mezzanine is handed to ffmpeg open, which only a
+		// local ffmpeg can be
+		if _, ok := runner.(ffmpeg.FileRunner); !ok {
+			slog.Error("Workspace encryption needs a local ffmpeg, unset FFMPEG_REMOTE")
+			os.Exit(1)
+		}
+		opts = append(opts, converter.WithWorkspaceEncryption(key))
+	}
+	// Comma separated web seeds and trackers of the torrents of profiles
+	// with torrent set, the web seeds being where uploads are served from
+	var webSeeds, trackers []string
+	if seeds := getEnvOrDefault("TORRENT_WEB_SEEDS", ""); seeds != "" {
+		webSeeds = strings.Split(seeds, ",")
+	}
+	if urls := getEnvOrDefault("TORRENT_TRACKERS", ""); urls != "" {
+		trackers = strings.Split(urls, ",")
+	}
+	if webSeeds != nil || trackers != nil {
+		opts = append(opts, converter.WithTorrentSeeds(webSeeds, trackers))
+	}
+	// Location and device tags of the sources are stripped from the
+	// outputs unless KEEP_SOURCE_METADATA is set
+	if keep, _ := strconv.ParseBool(getEnvOrDefault("KEEP_SOURCE_METADATA", "false")); keep {
+		opts = append(opts, converter.WithSourceMetadata())
+	}
+	if path := getEnvOrDefault("LIMITS_FILE", ""); path != "" {
+		policy, err := converter.LoadLimitPolicy(path)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, converter.WithLimits(policy))
+	}
+	uploader, err := newUploader()
+	if err != nil {
+		panic(err)
+	}
+	if uploader != nil {
+		attempts, _ := strconv.Atoi(getEnvOrDefault("UPLOAD_MAX_ATTEMPTS", "3"))
+		backoff, _ := time.ParseDuration(getEnvOrDefault("UPLOAD_RETRY_BACKOFF", "1s"))
+		concurrency, _ := strconv.Atoi(getEnvOrDefault("UPLOAD_CONCURRENCY", "4"))
+		// UPLOAD_RATE_LIMIT caps the bandwidth in bytes per second, and
+		// UPLOAD_WINDOWS, like "08:00-20:00=pause", overrides it by time
+		// of day
+		var next storage.Uploader = uploader
+		uploadRate, _ := strconv.ParseInt(getEnvOrDefault("UPLOAD_RATE_LIMIT", "0"), 10, 64)
+		windows, err := storage.ParseUploadWindows(getEnvOrDefault("UPLOAD_WINDOWS", ""))
+		if err != nil {
+			panic(err)
+		}
+		if uploadRate > 0 || len(windows) > 0 {
+			next = storage.NewThrottledUploader(uploader, storage.UploadSchedule{BytesPerSecond: uploadRate, Windows: windows})
+		}
+		opts = append(opts,
+			converter.WithUploader(storage.NewRetryUploader(next, attempts, backoff)),
+			converter.WithUploadConcurrency(concurrency),
+		)
+		// Presigned manifest URLs in completion events, for a copy of the
+		// manifest with presigned segment URLs
+		if signer, ok := uploader.(storage.URLSigner); ok {
+			ttl, _ := time.ParseDuration(getEnvOrDefault("PRESIGNED_URL_TTL", "1h"))
+			opts = append(opts, converter.WithURLSigner(signer, ttl))
+		}
+	}
+	captioner, err := newCaptioner()
+	if err != nil {
+		panic(err)
+	}
+	if captioner != nil {
+		opts = append(opts, converter.WithCaptioner(captioner))
+	}
+	classifier, policy, err := newModeration()
 	if err != nil {
 		panic(err)
 	}
-	vc := converter.NewVideoConverter(db)
-	vc.Handle([]byte(`{"video_id": 6, "path": "media/uploads/6"}`))
-}
\ No newline at end of file
+	if classifier != nil {
+		opts = append(opts, converter.WithModeration(classifier, policy))
+	}
+	// Tasks with detect_redactions blur the regions, such as faces, this
+	// service finds in frames sampled every REDACTION_DETECTION_INTERVAL
+	if url := getEnvOrDefault("REDACTION_DETECTOR_URL", ""); url != "" {
+		interval, _ := time.ParseDuration(getEnvOrDefault("REDACTION_DETECTION_INTERVAL", "1s"))
+		detector := redaction.HTTPDetector{URL: url, Token: getSecret("REDACTION_DETECTOR_TOKEN", "")}
+		opts = append(opts, converter.WithRegionDetector(detector, interval))
+	}
+	translator, err := newTranslator()
+	if err != nil {
+		panic(err)
+	}
+	if translator != nil {
+		opts = append(opts, converter.WithTranslator(translator))
+	}
+	invalidator, err := newInvalidator()
+	if err != nil {
+		panic(err)
+	}
+	if invalidator != nil {
+		opts = append(opts, converter.WithInvalidator(invalidator))
+	}
+	remote, err := newRemoteTranscoder()
+	if err != nil {
+		panic(err)
+	}
+	if remote != nil {
+		minDuration, _ := time.ParseDuration(getEnvOrDefault("TRANSCODER_REMOTE_MIN_DURATION", "10m"))
+		minSize, _ := strconv.ParseInt(getEnvOrDefault("TRANSCODER_REMOTE_MIN_SIZE", "0"), 10, 64)
+		opts = append(opts, converter.WithRemoteTranscoder(remote, converter.RemoteThreshold{
+			MinDuration: minDuration,
+			MinSize:     minSize,
+		}))
+	}
+	if publisher := newPublisher(db); publisher != nil {
+		opts = append(opts, converter.WithPublisher(publisher))
+	}
+
+	// Audit every job transition in job_events
+	hostname, _ := os.Hostname()
+	workerID := getEnvOrDefault("WORKER_ID", hostname)
+	recorder := audit.NewRecorder(db, workerID)
+	opts = append(opts, converter.WithSubscriber(recorder.Record))
+
+	// Time finished jobs to estimate when new ones will be done
+	opts = append(opts,
+		converter.WithSubscriber(stats.NewRecorder(db, workerID).Record),
+		converter.WithEstimator(stats.NewEstimator(db, 0)),
+	)
+
+	// Optional Prometheus endpoint with the duration of each stage
+	var registry *metrics.Registry
+	if addr := getEnvOrDefault("METRICS_ADDR", ""); addr != "" {
+		registry = metrics.NewRegistry()
+		opts = append(opts, converter.WithSubscriber(metrics.NewStages(registry).Record))
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", registry)
+		go func() {
+			slog.Info("Starting metrics server", slog.String("addr", addr))
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	// Alert operators about terminal failures and an unhealthy worker
+	router, err := newAlertRouter()
+	if err != nil {
+		panic(err)
+	}
+	if !router.Empty() {
+		opts = append(opts, converter.WithSubscriber(alert.Failures(router)))
+		startMonitor(router, getEnvOrDefault("INGEST_ROOT", "media/uploads"))
+	}
+
+	// Tasks the service enqueues itself, from batch messages and reprocess
+	// requests, go to the in-process queue when ingesting over HTTP, or to
+	// the Pub/Sub topic, Redis stream or exchange the consumer is bound to
+	ingestAddr := getEnvOrDefault("INGEST_ADDR", "")
+	uploadRoot := getEnvOrDefault("INGEST_ROOT", "media/uploads")
+	var vc *converter.VideoConverter
+	var queue *ingest.LocalQueue
+	var enqueuer converter.Enqueuer
+	if ingestAddr != "" {
+		queue = ingest.NewLocalQueue(100, func(msg []byte) converter.Result { return vc.Handle(ctx, msg) })
+		enqueuer = queue
+	} else if topicEnqueuer, err := pubsubEnqueuer(); err != nil {
+		panic(err)
+	} else if topicEnqueuer != nil {
+		enqueuer = topicEnqueuer
+	} else if streamEnqueuer, err := redisEnqueuer(); err != nil {
+		panic(err)
+	} else if streamEnqueuer != nil {
+		enqueuer = streamEnqueuer
+	} else if getSecret("RABBITMQ_URL", "") != "" {
+		enqueuer = amqpEnqueuer{}
+	}
+	if enqueuer != nil {
+		opts = append(opts, converter.WithEnqueuer(enqueuer))
+		apiOpts = append(apiOpts, api.WithReprocess(uploadRoot, enqueuer))
+	}
+	if sender := newWebhookSender(db); sender != nil {
+		apiOpts = append(apiOpts, api.WithRedelivery(sender))
+	}
+
+	vc = converter.NewVideoConverter(db, opts...)
+
+	authn, err := newAuthenticator()
+	if err != nil {
+		panic(err)
+	}
+	// The APIs only run without authentication when API_INSECURE=true
+	// says so, as --dev does
+	if authn != nil {
+		apiOpts = append(apiOpts, api.WithAuth(authn))
+	} else if getEnvOrDefault("API_ADDR", "") != "" || ingestAddr != "" {
+		if insecure, _ := strconv.ParseBool(getEnvOrDefault("API_INSECURE", "false")); !insecure {
+			slog.Error("API_KEYS or JWT_* are required to serve the APIs, or API_INSECURE=true to accept anyone")
+			os.Exit(1)
+		}
+		slog.Warn("API_KEYS and JWT_* aren't set, the APIs accept anyone")
+	}
+
+	// Consume conversion tasks published by the Django app, unless they
+	// come from HTTP ingest, Pub/Sub or Redis; the backlog of the queues is
+	// reported by the API and the metrics
+	var consumers []*rabbitmq.Consumer
+	if url := getSecret("RABBITMQ_URL", ""); url != "" && ingestAddr == "" &&
+		getEnvOrDefault("PUBSUB_SUBSCRIPTION", "") == "" && getSecret("REDIS_URL", "") == "" {
+		consumers, err = newConsumers(url, router, vc)
+		if err != nil {
+			panic(err)
+		}
+		inspectors := make([]api.QueueInspector, 0, len(consumers))
+		for _, consumer := range consumers {
+			inspectors = append(inspectors, consumer)
+		}
+		apiOpts = append(apiOpts, api.WithQueues(inspectors...))
+		if registry != nil {
+			go watchQueues(ctx, metrics.NewQueues(registry), consumers)
+		}
+	}
+
+	// Optional status API
+	if addr := getEnvOrDefault("API_ADDR", ""); addr != "" {
+		go func() {
+			slog.Info("Starting status api", slog.String("addr", addr))
+			if err := http.ListenAndServe(addr, api.NewServer(db, apiOpts...)); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	// Optional HTTP ingest: receive chunks and convert in-process
+	if addr := ingestAddr; addr != "" {
+		maxChunkSize, _ := strconv.ParseInt(getEnvOrDefault("INGEST_MAX_CHUNK_SIZE", "1048576"), 10, 64)
+		maxUploadSize, _ := strconv.ParseInt(getEnvOrDefault("INGEST_MAX_UPLOAD_SIZE", "0"), 10, 64)
+		go queue.Run()
+
+		var server http.Handler = ingest.NewServer(uploadRoot, maxChunkSize, maxUploadSize, queue)
+		if authn != nil {
+			server = auth.Require(authn, auth.RoleSubmit, server)
+		}
+		srv := &http.Server{Addr: addr, Handler: server}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+		slog.Info("Starting ingest server", slog.String("addr", addr))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+		return
+	}
+
+	// Consume conversion tasks from a Pub/Sub subscription on GCP
+	if getEnvOrDefault("PUBSUB_SUBSCRIPTION", "") != "" {
+		client, err := newPubSubClient()
+		if err != nil {
+			panic(err)
+		}
+		cfg, err := pubsubConsumerConfig()
+		if err != nil {
+			panic(err)
+		}
+		if !router.Empty() {
+			cfg.OnPause, cfg.OnResume = brokerAlerts(router, cfg.Subscription)
+		}
+		if err := pubsub.NewConsumer(client, cfg, vc.Handle).Serve(ctx); err != nil && ctx.Err() == nil {
+			panic(err)
+		}
+		return
+	}
+
+	// Consume conversion tasks from a Redis stream, without a broker
+	if url := getSecret("REDIS_URL", ""); url != "" {
+		cfg, err := redisConsumerConfig(url, workerID)
+		if err != nil {
+			panic(err)
+		}
+		if !router.Empty() {
+			cfg.OnPause, cfg.OnResume = brokerAlerts(router, cfg.Stream)
+		}
+		if err := redisstream.NewConsumer(cfg, vc.Handle).Serve(ctx); err != nil && ctx.Err() == nil {
+			panic(err)
+		}
+		return
+	}
+
+	if len(consumers) > 0 {
+		if err := runConsumers(ctx, consumers); err != nil && ctx.Err() == nil {
+			panic(err)
+		}
+		return
+	}
+
+	vc.Handle(ctx, []byte(`{"video_id": 6, "path": "media/uploads/6"}`))
+}
@@ -0,0 +1,6 @@
+//go:build mysql
+
+package main
+
+// The MySQL driver is only linked into binaries built with -tags mysql
+import _ "github.com/go-sql-driver/mysql"
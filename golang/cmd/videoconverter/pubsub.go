@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/pubsub"
+)
+
+// newPubSubClient builds a Pub/Sub client for PUBSUB_PROJECT, talking to
+// the emulator at PUBSUB_EMULATOR_HOST when set
+func newPubSubClient() (*pubsub.Client, error) {
+	cfg := pubsub.ClientConfig{
+		Project:         getEnvOrDefault("PUBSUB_PROJECT", ""),
+		CredentialsFile: getEnvOrDefault("GOOGLE_APPLICATION_CREDENTIALS", ""),
+	}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		cfg.Endpoint = "http://" + host
+	}
+	return pubsub.NewClient(cfg)
+}
+
+// pubsubConsumerConfig reads the Pub/Sub consumer settings:
+// PUBSUB_SUBSCRIPTION, PUBSUB_CONSUMERS, PUBSUB_ACK_DEADLINE and
+// PUBSUB_DEAD_LETTER_TOPIC
+func pubsubConsumerConfig() (pubsub.ConsumerConfig, error) {
+	cfg := pubsub.ConsumerConfig{
+		Subscription:    getEnvOrDefault("PUBSUB_SUBSCRIPTION", ""),
+		DeadLetterTopic: getEnvOrDefault("PUBSUB_DEAD_LETTER_TOPIC", ""),
+	}
+	var err error
+	if cfg.Consumers, err = strconv.Atoi(getEnvOrDefault("PUBSUB_CONSUMERS", "1")); err != nil {
+		return cfg, fmt.Errorf("invalid PUBSUB_CONSUMERS: %w", err)
+	}
+	if cfg.AckDeadline, err = time.ParseDuration(getEnvOrDefault("PUBSUB_ACK_DEADLINE", "60s")); err != nil {
+		return cfg, fmt.Errorf("invalid PUBSUB_ACK_DEADLINE: %w", err)
+	}
+	return cfg, nil
+}
+
+// pubsubEnqueuer publishes to PUBSUB_TOPIC, nil when it isn't set
+func pubsubEnqueuer() (*pubsub.Enqueuer, error) {
+	topic := getEnvOrDefault("PUBSUB_TOPIC", "")
+	if topic == "" {
+		return nil, nil
+	}
+	client, err := newPubSubClient()
+	if err != nil {
+		return nil, err
+	}
+	return pubsub.NewEnqueuer(client, topic), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/redisstream"
+)
+
+// redisConsumerConfig reads the Redis Streams consumer settings for
+// REDIS_URL: REDIS_STREAM, REDIS_GROUP, REDIS_CONSUMERS, REDIS_CLAIM_IDLE,
+// REDIS_MAX_DELIVERIES and REDIS_DEAD_LETTER_STREAM. The consumer is
+// named after the worker.
+func redisConsumerConfig(url, workerID string) (redisstream.ConsumerConfig, error) {
+	cfg := redisstream.ConsumerConfig{
+		URL:              url,
+		Stream:           getEnvOrDefault("REDIS_STREAM", "video_conversion"),
+		Group:            getEnvOrDefault("REDIS_GROUP", "videoconverter"),
+		Consumer:         workerID,
+		DeadLetterStream: getEnvOrDefault("REDIS_DEAD_LETTER_STREAM", ""),
+	}
+	var err error
+	if cfg.Consumers, err = strconv.Atoi(getEnvOrDefault("REDIS_CONSUMERS", "1")); err != nil {
+		return cfg, fmt.Errorf("invalid REDIS_CONSUMERS: %w", err)
+	}
+	if cfg.ClaimIdle, err = time.ParseDuration(getEnvOrDefault("REDIS_CLAIM_IDLE", "5m")); err != nil {
+		return cfg, fmt.Errorf("invalid REDIS_CLAIM_IDLE: %w", err)
+	}
+	if cfg.MaxDeliveries, err = strconv.Atoi(getEnvOrDefault("REDIS_MAX_DELIVERIES", "5")); err != nil {
+		return cfg, fmt.Errorf("invalid REDIS_MAX_DELIVERIES: %w", err)
+	}
+	return cfg, nil
+}
+
+// redisEnqueuer appends to REDIS_STREAM, trimmed to about REDIS_MAX_LEN
+// entries, nil when REDIS_URL isn't set
+func redisEnqueuer() (*redisstream.Enqueuer, error) {
+	url := getSecret("REDIS_URL", "")
+	if url == "" {
+		return nil, nil
+	}
+	maxLen, err := strconv.Atoi(getEnvOrDefault("REDIS_MAX_LEN", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_MAX_LEN: %w", err)
+	}
+	return redisstream.NewEnqueuer(url, getEnvOrDefault("REDIS_STREAM", "video_conversion"), maxLen), nil
+}
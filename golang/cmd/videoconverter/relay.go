@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"imersaofc/internal/kafka"
+	"imersaofc/internal/outbox"
+)
+
+// runOutboxRelay produces the completion events workers add to the outbox,
+// signed with the workers' EVENT_SIGNING_KEY when set, to the
+// KAFKA_BROKERS cluster until interrupted. Relays lock the events they
+// relay, so several can run against Postgres or MySQL; run one against
+// SQLite:
+//
+//	videoconverter outbox-relay [-interval 1s] [-batch-size 100]
+func runOutboxRelay(args []string) error {
+	fs := flag.NewFlagSet("outbox-relay", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "how often the outbox is polled")
+	batchSize := fs.Int("batch-size", 100, "events relayed per poll")
+	fs.Parse(args)
+
+	brokers := getEnvOrDefault("KAFKA_BROKERS", "")
+	if brokers == "" {
+		return fmt.Errorf("outbox-relay: KAFKA_BROKERS is not set")
+	}
+	producer, err := kafka.NewProducer(kafka.ProducerConfig{
+		Brokers:  strings.Split(brokers, ","),
+		ClientID: getEnvOrDefault("KAFKA_CLIENT_ID", "videoconverter"),
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	slog.Info("Relaying outbox events", slog.String("brokers", brokers))
+	relay := outbox.NewRelay(db, producer, outbox.RelayConfig{Interval: *interval, BatchSize: *batchSize})
+	if err := relay.Run(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+
+	"imersaofc/internal/converter"
+)
+
+// runReplay re-enqueues the task of a process_errors_log entry:
+//
+//	videoconverter replay -id 42 [-profile hd] [-dry-run]
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	id := fs.Int64("id", 0, "process_errors_log entry to replay")
+	profile := fs.String("profile", "", "encoding profile overriding the original one")
+	uploadRoot := fs.String("upload-root", "media/uploads", "upload root used when the entry has no recorded task")
+	dryRun := fs.Bool("dry-run", false, "print the task instead of enqueueing it")
+	fs.Parse(args)
+	if *id <= 0 {
+		return fmt.Errorf("replay: -id is required")
+	}
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entry, err := converter.GetError(context.Background(), db, *id)
+	if err != nil {
+		return err
+	}
+
+	// Entries logged before tasks were recorded only have the video id;
+	// rebuild the task the way the Django app sends it
+	task := converter.VideoTask{
+		VideoID: entry.VideoID,
+		Path:    filepath.Join(*uploadRoot, strconv.Itoa(entry.VideoID)),
+	}
+	if entry.Task != nil {
+		task = *entry.Task
+	}
+	if task.VideoID == 0 {
+		return fmt.Errorf("replay: error %d has no video id", *id)
+	}
+	if *profile != "" {
+		task.Profile = *profile
+	}
+
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println(string(body))
+		return nil
+	}
+
+	if err := publishTask(task); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	slog.Info("Task re-enqueued", slog.Int64("error_id", *id), slog.Int("video_id", task.VideoID), slog.String("profile", task.Profile))
+	return nil
+}
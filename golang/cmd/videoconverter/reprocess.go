@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// runReprocess enqueues an already processed video to be converted again,
+// archiving its previous output:
+//
+//	videoconverter reprocess -video-id 42 [-profile hd] [-ttl 24h] [-dry-run]
+func runReprocess(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	videoID := fs.Int("video-id", 0, "video to convert again")
+	profile := fs.String("profile", "", "encoding profile, the default one when empty")
+	uploadRoot := fs.String("upload-root", "media/uploads", "directory holding the video's chunks")
+	ttl := fs.Duration("ttl", 0, "skip the conversion if it hasn't started within this time, 0 for no deadline")
+	dryRun := fs.Bool("dry-run", false, "print the task instead of enqueueing it")
+	fs.Parse(args)
+	if *videoID <= 0 {
+		return fmt.Errorf("reprocess: -video-id is required")
+	}
+
+	task := converter.VideoTask{
+		VideoID:   *videoID,
+		Path:      filepath.Join(*uploadRoot, strconv.Itoa(*videoID)),
+		Profile:   *profile,
+		Reprocess: true,
+	}
+	if *ttl > 0 {
+		deadline := time.Now().Add(*ttl).UTC()
+		task.Deadline = &deadline
+	}
+	if *dryRun {
+		body, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(body))
+		return nil
+	}
+	if err := publishTask(task); err != nil {
+		return fmt.Errorf("reprocess: %w", err)
+	}
+	slog.Info("Reprocess enqueued", slog.Int("video_id", task.VideoID), slog.String("profile", task.Profile))
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"imersaofc/internal/awsauth"
+	"imersaofc/internal/secrets"
+	"imersaofc/internal/signing"
+)
+
+// secretProvider is the store credentials are read from, see
+// newSecretProvider
+var secretProvider = sync.OnceValue(func() secrets.Provider {
+	p, err := newSecretProvider()
+	if err != nil {
+		panic(err)
+	}
+	return p
+})
+
+// newSecretProvider builds the secret store selected by SECRETS_PROVIDER:
+// env, the default, file (a file per secret in SECRETS_DIR), vault or aws.
+// Stored secrets are refreshed every SECRETS_TTL, and anything the store
+// doesn't hold is still read from the environment.
+func newSecretProvider() (secrets.Provider, error) {
+	var store secrets.Provider
+	switch backend := getEnvOrDefault("SECRETS_PROVIDER", "env"); backend {
+	case "env":
+		return secrets.Env{}, nil
+	case "file":
+		return secrets.Chain{secrets.File{Dir: getEnvOrDefault("SECRETS_DIR", "/run/secrets")}, secrets.Env{}}, nil
+	case "vault":
+		store = secrets.Vault{
+			Address:   getEnvOrDefault("VAULT_ADDR", "http://127.0.0.1:8200"),
+			Mount:     getEnvOrDefault("VAULT_MOUNT", ""),
+			Path:      getEnvOrDefault("VAULT_SECRET_PATH", "videoconverter"),
+			Token:     getEnvOrDefault("VAULT_TOKEN", ""),
+			TokenFile: getEnvOrDefault("VAULT_TOKEN_FILE", ""),
+			Namespace: getEnvOrDefault("VAULT_NAMESPACE", ""),
+		}
+	case "aws":
+		creds, err := awsauth.CredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		store = secrets.AWSSecretsManager{
+			Region:   getEnvOrDefault("AWS_REGION", ""),
+			SecretID: getEnvOrDefault("AWS_SECRET_ID", "videoconverter"),
+			Creds:    creds,
+		}
+	default:
+		return nil, fmt.Errorf("unknown secrets provider: %s", backend)
+	}
+	ttl, _ := time.ParseDuration(getEnvOrDefault("SECRETS_TTL", "5m"))
+	return secrets.Chain{secrets.NewCached(store, ttl), secrets.Env{}}, nil
+}
+
+// getSecret reads a secret from the secret store, defaulting like
+// getEnvOrDefault when no one holds it
+func getSecret(key, defaultValue string) string {
+	value, err := secretProvider().Get(context.Background(), key)
+	if errors.Is(err, secrets.ErrNotFound) {
+		return defaultValue
+	}
+	if err != nil {
+		panic(fmt.Errorf("failed to read secret %s: %w", key, err))
+	}
+	return value
+}
+
+// dbPassword reads the database password from the secret store
+func dbPassword(ctx context.Context, key string) (string, error) {
+	password, err := secretProvider().Get(ctx, key)
+	if errors.Is(err, secrets.ErrNotFound) {
+		return "password", nil
+	}
+	return password, err
+}
+
+// awsCredentials reads the AWS keys from the secret store, as each request
+// signs with them so rotated keys are picked up
+func awsCredentials(ctx context.Context) (awsauth.Credentials, error) {
+	var creds awsauth.Credentials
+	for _, s := range []struct {
+		name  string
+		value *string
+	}{
+		{"AWS_ACCESS_KEY_ID", &creds.AccessKeyID},
+		{"AWS_SECRET_ACCESS_KEY", &creds.SecretAccessKey},
+		{"AWS_SESSION_TOKEN", &creds.SessionToken},
+	} {
+		value, err := secretProvider().Get(ctx, s.name)
+		if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+			return creds, err
+		}
+		*s.value = value
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return creds, nil
+}
+
+// eventSigner signs the completion events sent out with EVENT_SIGNING_KEY,
+// "id:hmac-sha256:secret" or "id:ed25519:private key", or returns nil when
+// it isn't set. The key is read from the secret store on each event, so a
+// key rotated there under a new id is picked up without a restart.
+func eventSigner() *signing.Signer {
+	value := getSecret("EVENT_SIGNING_KEY", "")
+	if value == "" {
+		return nil
+	}
+	// Fail at startup rather than on the first event
+	if _, err := signing.ParseKey(value); err != nil {
+		panic(err)
+	}
+	return signing.NewSigner(func(ctx context.Context) (signing.Key, error) {
+		value, err := secretProvider().Get(ctx, "EVENT_SIGNING_KEY")
+		if err != nil {
+			return signing.Key{}, err
+		}
+		return signing.ParseKey(value)
+	})
+}
@@ -0,0 +1,5 @@
+package main
+
+// The pure-Go SQLite driver is always linked, so --dev runs without a C
+// toolchain or a database server
+import _ "modernc.org/sqlite"
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"imersaofc/internal/stats"
+)
+
+// runStats prints the throughput of the jobs finished recently, for
+// capacity planning:
+//
+//	videoconverter stats [-since 24h] [-by hour|worker|profile] [-json]
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	since := fs.Duration("since", 24*time.Hour, "report the jobs finished in this period")
+	by := fs.String("by", stats.GroupByHour, "group by hour, worker or profile")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	to := time.Now()
+	report, err := stats.Throughput(context.Background(), db, to.Add(-*since), to, *by)
+	if err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "%s\tjobs\tsource min\tprocessing min\tactive h\tsource min/h\tspeed\t\n", *by)
+	for _, row := range append(report.Rows, report.Total) {
+		key := row.Key
+		if key == "" {
+			key = "total"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.1f\t%d\t%.1f\t%.2fx\t\n",
+			key, row.Jobs, row.SourceMinutes, row.ProcessingMinutes, row.ActiveHours, row.SourceMinutesPerHour, row.Speed)
+	}
+	return w.Flush()
+}
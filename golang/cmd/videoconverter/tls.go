@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// tlsConfig builds the client TLS configuration of a connection from
+// <prefix>_TLS_CA_FILE, a PEM bundle of the CAs trusted on top of the
+// system ones, <prefix>_TLS_CERT_FILE and <prefix>_TLS_KEY_FILE, the client
+// certificate of mTLS, and <prefix>_TLS_SERVER_NAME. It returns nil when
+// none is set. The certificate is read again on each handshake, so a
+// renewed one is used on the next reconnection.
+func tlsConfig(prefix string) (*tls.Config, error) {
+	caFile := getEnvOrDefault(prefix+"_TLS_CA_FILE", "")
+	certFile := getEnvOrDefault(prefix+"_TLS_CERT_FILE", "")
+	keyFile := getEnvOrDefault(prefix+"_TLS_KEY_FILE", "")
+	serverName := getEnvOrDefault(prefix+"_TLS_SERVER_NAME", "")
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_TLS_CA_FILE: %w", prefix, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s_TLS_CA_FILE has no PEM certificate", prefix)
+		}
+		config.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s_TLS_CERT_FILE and %s_TLS_KEY_FILE go together", prefix, prefix)
+	}
+	if certFile != "" {
+		// Fail at startup rather than on the first handshake
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("failed to load the %s client certificate: %w", prefix, err)
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		}
+	}
+	return config, nil
+}
+
+// rabbitmqTLS is the TLS configuration of amqps:// RABBITMQ_URLs
+func rabbitmqTLS() *tls.Config {
+	config, err := tlsConfig("RABBITMQ")
+	if err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// serverTLSConfig builds the TLS configuration of a server requiring mTLS
+// from <prefix>_TLS_CERT_FILE and <prefix>_TLS_KEY_FILE, the server
+// certificate, and <prefix>_TLS_CLIENT_CA_FILE, a PEM bundle of the CAs
+// client certificates must be signed by. All three are required. The
+// certificate is read again on each handshake, so a renewed one is served
+// without a restart.
+func serverTLSConfig(prefix string) (*tls.Config, error) {
+	certFile := getEnvOrDefault(prefix+"_TLS_CERT_FILE", "")
+	keyFile := getEnvOrDefault(prefix+"_TLS_KEY_FILE", "")
+	clientCAFile := getEnvOrDefault(prefix+"_TLS_CLIENT_CA_FILE", "")
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, fmt.Errorf("%s_TLS_CERT_FILE, %s_TLS_KEY_FILE and %s_TLS_CLIENT_CA_FILE are required", prefix, prefix, prefix)
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s_TLS_CLIENT_CA_FILE: %w", prefix, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s_TLS_CLIENT_CA_FILE has no PEM certificate", prefix)
+	}
+	// Fail at startup rather than on the first handshake
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, fmt.Errorf("failed to load the %s server certificate: %w", prefix, err)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			return &cert, err
+		},
+	}, nil
+}
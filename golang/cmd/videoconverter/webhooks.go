@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"imersaofc/internal/webhook"
+)
+
+// runWebhooks lists the deliveries of completion events to WEBHOOK_URL, or
+// posts one again with -redeliver, to debug an integration:
+//
+//	videoconverter webhooks [-video-id 42] [-status failed] [-limit 100] [-json]
+//	videoconverter webhooks -redeliver 7
+func runWebhooks(args []string) error {
+	fs := flag.NewFlagSet("webhooks", flag.ExitOnError)
+	videoID := fs.Int("video-id", 0, "only list the deliveries of this video")
+	status := fs.String("status", "", "only list the deliveries with this status: pending, delivered or failed")
+	limit := fs.Int("limit", 100, "deliveries listed, newest first")
+	redeliver := fs.Int64("redeliver", 0, "delivery to post again")
+	asJSON := fs.Bool("json", false, "print the deliveries as JSON")
+	fs.Parse(args)
+
+	db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if *redeliver > 0 {
+		sender := newWebhookSender(db)
+		if sender == nil {
+			return fmt.Errorf("webhooks: WEBHOOK_URL is not set")
+		}
+		d, err := sender.Redeliver(ctx, *redeliver)
+		if err != nil {
+			return fmt.Errorf("webhooks: %w", err)
+		}
+		fmt.Printf("Delivery %d of %s delivered after %d attempts\n", d.ID, d.DeliveryID, d.Attempts)
+		return nil
+	}
+
+	deliveries, err := webhook.ListDeliveries(ctx, db, webhook.DeliveryFilter{VideoID: *videoID, Status: *status, Limit: *limit})
+	if err != nil {
+		return fmt.Errorf("webhooks: %w", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(deliveries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "id\tdelivery\tstatus\tattempts\tcode\tupdated\tlast error")
+	for _, d := range deliveries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			d.ID, d.DeliveryID, d.Status, d.Attempts, d.LastStatusCode, d.UpdatedAt.Format(time.RFC3339), d.LastError)
+	}
+	return w.Flush()
+}
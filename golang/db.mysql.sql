@@ -0,0 +1,169 @@
+CREATE TABLE processed_videos (
+    video_id INT PRIMARY KEY,
+    status VARCHAR(50) NOT NULL,
+    processed_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE process_errors_log (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    error_details JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    INDEX process_errors_log_created_at_idx (created_at)
+);
+
+CREATE TABLE job_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    video_id INT NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    stage VARCHAR(50) NOT NULL DEFAULT '',
+    old_status VARCHAR(50) NOT NULL,
+    new_status VARCHAR(50) NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    details JSON,
+    created_at TIMESTAMP NOT NULL,
+    INDEX job_events_video_id_idx (video_id, id)
+);
+
+CREATE TABLE job_labels (
+    video_id INT NOT NULL,
+    name VARCHAR(63) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    PRIMARY KEY (video_id, name),
+    INDEX job_labels_name_value_idx (name, value)
+);
+
+CREATE TABLE video_sources (
+    video_id INT PRIMARY KEY,
+    content_hash CHAR(64) NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    output_video_id INT NOT NULL,
+    output_version INT NOT NULL DEFAULT 1,
+    profile_hash CHAR(64) NOT NULL DEFAULT '',
+    output_prefix VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    INDEX video_sources_content_hash_idx (content_hash, profile, profile_hash)
+);
+
+CREATE TABLE output_versions (
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    prefix VARCHAR(512),
+    active BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (video_id, version)
+);
+
+CREATE TABLE batches (
+    batch_id VARCHAR(64) PRIMARY KEY,
+    total INT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE batch_tasks (
+    batch_id VARCHAR(64) NOT NULL,
+    video_id INT NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (batch_id, video_id)
+);
+
+CREATE TABLE job_timings (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    video_id INT NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    source_seconds DOUBLE NOT NULL,
+    processing_seconds DOUBLE NOT NULL,
+    completed_at TIMESTAMP NOT NULL,
+    INDEX job_timings_profile_idx (profile, completed_at)
+);
+
+CREATE TABLE job_estimates (
+    video_id INT PRIMARY KEY,
+    source_seconds DOUBLE NOT NULL,
+    estimate_seconds DOUBLE NOT NULL,
+    eta TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE throughput_stats (
+    period_start TIMESTAMP NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    jobs INT NOT NULL,
+    source_seconds DOUBLE NOT NULL,
+    processing_seconds DOUBLE NOT NULL,
+    PRIMARY KEY (period_start, worker_id, profile)
+);
+
+CREATE TABLE outbox_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL UNIQUE,
+    topic VARCHAR(255) NOT NULL,
+    event_key VARCHAR(255) NOT NULL,
+    payload TEXT NOT NULL,
+    headers TEXT,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP NULL,
+    INDEX outbox_events_pending_idx (published_at, id)
+);
+
+CREATE TABLE job_claims (
+    claim_key VARCHAR(512) PRIMARY KEY,
+    owner VARCHAR(64) NOT NULL,
+    claimed_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE moderation_verdicts (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    video_id INT NOT NULL,
+    classifier VARCHAR(100) NOT NULL,
+    decision VARCHAR(20) NOT NULL,
+    scores JSON NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    at_seconds DOUBLE NOT NULL DEFAULT 0,
+    frames INT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    INDEX moderation_verdicts_video_id_idx (video_id, id)
+);
+
+CREATE TABLE encode_records (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    profile VARCHAR(255) NOT NULL,
+    settings JSON NOT NULL,
+    transcoder VARCHAR(100) NOT NULL,
+    ffmpeg_version VARCHAR(100) NOT NULL DEFAULT '',
+    commands JSON NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    INDEX encode_records_video_id_idx (video_id, id)
+);
+
+CREATE TABLE webhook_deliveries (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    delivery_id VARCHAR(255) NOT NULL UNIQUE,
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    url TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL,
+    last_status_code INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP NULL,
+    INDEX webhook_deliveries_video_id_idx (video_id, id),
+    INDEX webhook_deliveries_status_idx (status, id)
+);
+
+CREATE TABLE tenant_settings (
+    tenant VARCHAR(255) PRIMARY KEY,
+    default_profile VARCHAR(100) NOT NULL DEFAULT '',
+    watermark VARCHAR(512) NOT NULL DEFAULT '',
+    storage_prefix VARCHAR(512) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL
+);
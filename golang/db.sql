@@ -4,8 +4,175 @@ CREATE TABLE processed_videos (
     processed_at TIMESTAMP NOT NULL
 );
 
-CREATE TABLE process_erros_log (
+CREATE TABLE process_errors_log (
     id SERIAL PRIMARY KEY,
     error_details JSONB NOT NULL,
     created_at TIMESTAMP NOT NULL
-);
\ No newline at end of file
+);
+CREATE TABLE job_events (
+    id BIGSERIAL PRIMARY KEY,
+    video_id INT NOT NULL,
+    event VARCHAR(50) NOT NULL,
+    stage VARCHAR(50) NOT NULL DEFAULT '',
+    old_status VARCHAR(50) NOT NULL,
+    new_status VARCHAR(50) NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    details JSONB,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX job_events_video_id_idx ON job_events (video_id, id);
+
+CREATE TABLE job_labels (
+    video_id INT NOT NULL,
+    name VARCHAR(63) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    PRIMARY KEY (video_id, name)
+);
+
+CREATE INDEX job_labels_name_value_idx ON job_labels (name, value);
+
+CREATE INDEX process_errors_log_video_id_idx ON process_errors_log ((error_details->>'video_id'));
+CREATE INDEX process_errors_log_created_at_idx ON process_errors_log (created_at);
+
+CREATE TABLE video_sources (
+    video_id INT PRIMARY KEY,
+    content_hash CHAR(64) NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    output_video_id INT NOT NULL,
+    output_version INT NOT NULL DEFAULT 1,
+    profile_hash CHAR(64) NOT NULL DEFAULT '',
+    output_prefix VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX video_sources_content_hash_idx ON video_sources (content_hash, profile, profile_hash);
+
+CREATE TABLE output_versions (
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    prefix VARCHAR(512),
+    active BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (video_id, version)
+);
+
+CREATE TABLE batches (
+    batch_id VARCHAR(64) PRIMARY KEY,
+    total INT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE batch_tasks (
+    batch_id VARCHAR(64) NOT NULL,
+    video_id INT NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (batch_id, video_id)
+);
+
+CREATE TABLE job_timings (
+    id BIGSERIAL PRIMARY KEY,
+    video_id INT NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    source_seconds DOUBLE PRECISION NOT NULL,
+    processing_seconds DOUBLE PRECISION NOT NULL,
+    completed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX job_timings_profile_idx ON job_timings (profile, completed_at);
+
+CREATE TABLE job_estimates (
+    video_id INT PRIMARY KEY,
+    source_seconds DOUBLE PRECISION NOT NULL,
+    estimate_seconds DOUBLE PRECISION NOT NULL,
+    eta TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE throughput_stats (
+    period_start TIMESTAMP NOT NULL,
+    worker_id VARCHAR(255) NOT NULL,
+    profile VARCHAR(100) NOT NULL,
+    jobs INT NOT NULL,
+    source_seconds DOUBLE PRECISION NOT NULL,
+    processing_seconds DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (period_start, worker_id, profile)
+);
+
+CREATE TABLE outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(255) NOT NULL UNIQUE,
+    topic VARCHAR(255) NOT NULL,
+    event_key VARCHAR(255) NOT NULL,
+    payload TEXT NOT NULL,
+    headers TEXT,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX outbox_events_pending_idx ON outbox_events (published_at, id);
+
+CREATE TABLE job_claims (
+    claim_key VARCHAR(512) PRIMARY KEY,
+    owner VARCHAR(64) NOT NULL,
+    claimed_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE moderation_verdicts (
+    id BIGSERIAL PRIMARY KEY,
+    video_id INT NOT NULL,
+    classifier VARCHAR(100) NOT NULL,
+    decision VARCHAR(20) NOT NULL,
+    scores JSONB NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    at_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    frames INT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX moderation_verdicts_video_id_idx ON moderation_verdicts (video_id, id);
+
+CREATE TABLE encode_records (
+    id BIGSERIAL PRIMARY KEY,
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    profile VARCHAR(255) NOT NULL,
+    settings JSONB NOT NULL,
+    transcoder VARCHAR(100) NOT NULL,
+    ffmpeg_version VARCHAR(100) NOT NULL DEFAULT '',
+    commands JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX encode_records_video_id_idx ON encode_records (video_id, id);
+
+CREATE TABLE webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id VARCHAR(255) NOT NULL UNIQUE,
+    video_id INT NOT NULL,
+    version INT NOT NULL,
+    url TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    last_status_code INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_video_id_idx ON webhook_deliveries (video_id, id);
+CREATE INDEX webhook_deliveries_status_idx ON webhook_deliveries (status, id);
+
+CREATE TABLE tenant_settings (
+    tenant VARCHAR(255) PRIMARY KEY,
+    default_profile VARCHAR(100) NOT NULL DEFAULT '',
+    watermark VARCHAR(512) NOT NULL DEFAULT '',
+    storage_prefix VARCHAR(512) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL
+);
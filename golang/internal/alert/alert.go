@@ -0,0 +1,144 @@
+// Package alert notifies operators about terminal failures and unhealthy
+// workers through chat webhooks and email, routed by severity
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"imersaofc/internal/events"
+)
+
+// Severity orders alerts; each notifier only receives alerts at or above its minimum
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = []string{"info", "warning", "error", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity parses a severity name such as "warning"
+func ParseSeverity(name string) (Severity, error) {
+	for i, n := range severityNames {
+		if strings.EqualFold(name, n) {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity: %s", name)
+}
+
+// Alert is a problem worth telling an operator about
+type Alert struct {
+	Severity Severity
+	Title    string
+	Message  string
+	// VideoID is the video the alert is about, 0 for worker-wide alerts
+	VideoID int
+	At      time.Time
+}
+
+// text renders the alert as a plain text heading and body
+func (a Alert) text() (string, string) {
+	heading := fmt.Sprintf("[%s] %s", strings.ToUpper(a.Severity.String()), a.Title)
+	body := a.Message
+	if a.VideoID != 0 {
+		body = fmt.Sprintf("Video %d: %s", a.VideoID, body)
+	}
+	return heading, body
+}
+
+// Notifier delivers alerts to a channel
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// route sends alerts at or above min to a notifier
+type route struct {
+	notifier Notifier
+	min      Severity
+}
+
+// Router fans alerts out to the notifiers configured for their severity.
+// It is a Notifier itself.
+type Router struct {
+	routes []route
+}
+
+// NewRouter creates a new instance of Router without notifiers
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Add sends alerts at or above min to n
+func (r *Router) Add(n Notifier, min Severity) {
+	r.routes = append(r.routes, route{notifier: n, min: min})
+}
+
+// Empty reports whether no notifier is configured
+func (r *Router) Empty() bool {
+	return len(r.routes) == 0
+}
+
+// Notify delivers the alert to every matching notifier, even when some fail
+func (r *Router) Notify(ctx context.Context, a Alert) error {
+	if a.At.IsZero() {
+		a.At = time.Now()
+	}
+	var errs []error
+	for _, rt := range r.routes {
+		if a.Severity < rt.min {
+			continue
+		}
+		if err := rt.notifier.Notify(ctx, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// notifyTimeout bounds how long an alert raised from the pipeline may take
+const notifyTimeout = 30 * time.Second
+
+// Failures returns an events.Subscriber alerting n, at SeverityError, about
+// tasks that failed and won't be retried. Alerts are sent in the
+// background so a slow channel never holds up the pipeline.
+func Failures(n Notifier) events.Subscriber {
+	return func(e events.Event) {
+		failed, ok := e.(events.TaskFailed)
+		if !ok || failed.Retryable {
+			return
+		}
+		a := Alert{
+			Severity: SeverityError,
+			Title:    "Conversion failed",
+			Message:  fmt.Sprintf("stage %s: %v", failed.Stage, failed.Err),
+			VideoID:  failed.VideoID,
+			At:       failed.At,
+		}
+		if failed.Stage == "" {
+			a.Message = failed.Err.Error()
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, a); err != nil {
+				slog.Error("Error sending alert", slog.String("title", a.Title), slog.String("error", err.Error()))
+			}
+		}()
+	}
+}
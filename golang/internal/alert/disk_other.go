@@ -0,0 +1,9 @@
+//go:build !unix
+
+package alert
+
+import "errors"
+
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("disk space checks are only supported on unix")
+}
@@ -0,0 +1,71 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailConfig configures the SMTP server alerts are sent through
+type EmailConfig struct {
+	// Addr is the host:port of the SMTP server
+	Addr string
+	// Username and Password enable PLAIN authentication when set
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// EmailNotifier emails alerts over SMTP
+type EmailNotifier struct {
+	cfg EmailConfig
+}
+
+// NewEmailNotifier creates a new instance of EmailNotifier
+func NewEmailNotifier(cfg EmailConfig) (*EmailNotifier, error) {
+	if cfg.Addr == "" || cfg.From == "" || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("email alerts need an smtp address, a sender and recipients")
+	}
+	return &EmailNotifier{cfg: cfg}, nil
+}
+
+func (n *EmailNotifier) Notify(ctx context.Context, a Alert) error {
+	var auth smtp.Auth
+	if n.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(n.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, host)
+	}
+
+	heading, body := a.text()
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", heading))
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.At.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	// net/smtp has no context support; run it aside so ctx still bounds the wait
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.cfg.Addr, auth, n.cfg.From, n.cfg.To, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send alert email: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,137 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Status is the outcome of a check: healthy, or a problem of some severity
+type Status struct {
+	OK       bool
+	Severity Severity
+	Message  string
+}
+
+// Healthy is the status of a check that found no problem
+var Healthy = Status{OK: true}
+
+// Check inspects one aspect of the worker's health
+type Check interface {
+	Name() string
+	Check(ctx context.Context) (Status, error)
+}
+
+// Monitor runs checks periodically and alerts when one turns unhealthy or
+// gets worse, and again once it recovers, instead of on every run
+type Monitor struct {
+	notifier Notifier
+	interval time.Duration
+	checks   []Check
+	last     map[string]Status
+}
+
+// NewMonitor creates a new instance of Monitor
+func NewMonitor(n Notifier, interval time.Duration, checks ...Check) *Monitor {
+	return &Monitor{notifier: n, interval: interval, checks: checks, last: map[string]Status{}}
+}
+
+// Run checks every interval until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.runChecks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) runChecks(ctx context.Context) {
+	for _, check := range m.checks {
+		status, err := check.Check(ctx)
+		if err != nil {
+			slog.Error("Health check failed", slog.String("check", check.Name()), slog.String("error", err.Error()))
+			continue
+		}
+
+		last, seen := m.last[check.Name()]
+		m.last[check.Name()] = status
+		var a Alert
+		switch {
+		case !status.OK && (!seen || last.OK || status.Severity > last.Severity):
+			a = Alert{Severity: status.Severity, Title: check.Name(), Message: status.Message}
+		case status.OK && seen && !last.OK:
+			a = Alert{Severity: SeverityInfo, Title: check.Name() + " recovered", Message: fmt.Sprintf("was: %s", last.Message)}
+		default:
+			continue
+		}
+		a.At = time.Now()
+		if err := m.notifier.Notify(ctx, a); err != nil {
+			slog.Error("Error sending alert", slog.String("title", a.Title), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// DiskSpace checks the free space of the filesystem holding Path
+type DiskSpace struct {
+	Path string
+	// WarnBelow and CriticalBelow are free space thresholds in bytes; zero disables one
+	WarnBelow     uint64
+	CriticalBelow uint64
+}
+
+func (c DiskSpace) Name() string { return "Low disk space" }
+
+func (c DiskSpace) Check(ctx context.Context) (Status, error) {
+	free, err := freeSpace(c.Path)
+	if err != nil {
+		return Status{}, err
+	}
+	message := fmt.Sprintf("%s has %d MiB free", c.Path, free>>20)
+	switch {
+	case c.CriticalBelow > 0 && free < c.CriticalBelow:
+		return Status{Severity: SeverityCritical, Message: message}, nil
+	case c.WarnBelow > 0 && free < c.WarnBelow:
+		return Status{Severity: SeverityWarning, Message: message}, nil
+	}
+	return Healthy, nil
+}
+
+// QueueGrowth watches the depth of a queue, typically the dead-letter
+// queue: it warns while the depth grows by at least MinIncrease between
+// checks and is critical at MaxDepth or more
+type QueueGrowth struct {
+	Queue string
+	Depth func(ctx context.Context) (int, error)
+	// MinIncrease defaults to 1; MaxDepth of zero disables the critical level
+	MinIncrease int
+	MaxDepth    int
+
+	last    int
+	checked bool
+}
+
+func (c *QueueGrowth) Name() string { return "Queue " + c.Queue + " growing" }
+
+func (c *QueueGrowth) Check(ctx context.Context) (Status, error) {
+	depth, err := c.Depth(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+	last, checked := c.last, c.checked
+	c.last, c.checked = depth, true
+
+	message := fmt.Sprintf("%s holds %d messages", c.Queue, depth)
+	if c.MaxDepth > 0 && depth >= c.MaxDepth {
+		return Status{Severity: SeverityCritical, Message: message}, nil
+	}
+	if checked && depth-last >= max(c.MinIncrease, 1) {
+		return Status{Severity: SeverityWarning, Message: fmt.Sprintf("%s, %d more than at the previous check", message, depth-last)}, nil
+	}
+	return Healthy, nil
+}
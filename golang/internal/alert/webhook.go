@@ -0,0 +1,72 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// discordMaxContent is the longest message Discord accepts
+const discordMaxContent = 2000
+
+// SlackNotifier posts alerts to a Slack incoming webhook
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewSlackNotifier creates a new instance of SlackNotifier
+func NewSlackNotifier(webhookURL string) *SlackNotifier {
+	return &SlackNotifier{url: webhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, a Alert) error {
+	heading, body := a.text()
+	return postJSON(ctx, n.client, n.url, map[string]string{"text": "*" + heading + "*\n" + body})
+}
+
+// DiscordNotifier posts alerts to a Discord webhook
+type DiscordNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewDiscordNotifier creates a new instance of DiscordNotifier
+func NewDiscordNotifier(webhookURL string) *DiscordNotifier {
+	return &DiscordNotifier{url: webhookURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *DiscordNotifier) Notify(ctx context.Context, a Alert) error {
+	heading, body := a.text()
+	content := "**" + heading + "**\n" + body
+	if len(content) > discordMaxContent {
+		content = content[:discordMaxContent-3] + "..."
+	}
+	return postJSON(ctx, n.client, n.url, map[string]string{"content": content})
+}
+
+// postJSON posts payload to a chat webhook
+func postJSON(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deliver alert: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned %s", resp.Status)
+	}
+	return nil
+}
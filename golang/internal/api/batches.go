@@ -0,0 +1,22 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"imersaofc/internal/converter"
+)
+
+// handleGetBatch returns the progress of a batch with the status of each task
+func (s *Server) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	batch, err := converter.GetBatch(r.Context(), s.db, r.PathValue("batch_id"))
+	if errors.Is(err, converter.ErrBatchNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error getting batch", err)
+		return
+	}
+	writeJSON(w, batch)
+}
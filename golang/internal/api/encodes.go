@@ -0,0 +1,23 @@
+package api
+
+import (
+	"net/http"
+
+	"imersaofc/internal/converter"
+)
+
+// handleListEncodes returns how each output version of the video was
+// made, oldest first, to reproduce an output or compare encodes across
+// ffmpeg upgrades
+func (s *Server) handleListEncodes(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	records, err := converter.ListEncodeRecords(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing encode records", err)
+		return
+	}
+	writeJSON(w, records)
+}
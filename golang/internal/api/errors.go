@@ -0,0 +1,96 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// errorsPage is a page of logged errors
+type errorsPage struct {
+	Items  []converter.ErrorLogEntry `json:"items"`
+	Limit  int                       `json:"limit"`
+	Offset int                       `json:"offset"`
+}
+
+// handleListErrors lists process_errors_log entries filtered by the
+// video_id, phase, error_type, from and to (RFC 3339) query parameters,
+// paginated with limit and offset
+func (s *Server) handleListErrors(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := converter.ErrorFilter{
+		Phase:     q.Get("phase"),
+		ErrorType: q.Get("error_type"),
+	}
+
+	var err error
+	if filter.VideoID, err = intParam(q.Get("video_id")); err != nil {
+		http.Error(w, "invalid video_id", http.StatusBadRequest)
+		return
+	}
+	if filter.Limit, err = intParam(q.Get("limit")); err != nil || filter.Limit < 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if filter.Offset, err = intParam(q.Get("offset")); err != nil || filter.Offset < 0 {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	if filter.From, err = timeParam(q.Get("from")); err != nil {
+		http.Error(w, "invalid from, expected RFC 3339", http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = timeParam(q.Get("to")); err != nil {
+		http.Error(w, "invalid to, expected RFC 3339", http.StatusBadRequest)
+		return
+	}
+
+	list, err := converter.ListErrors(r.Context(), s.db, filter)
+	if err != nil {
+		serverError(w, "Error listing process errors", err)
+		return
+	}
+	limit := filter.Limit
+	if limit == 0 {
+		limit = converter.DefaultErrorPageSize
+	}
+	writeJSON(w, errorsPage{Items: list, Limit: min(limit, converter.MaxErrorPageSize), Offset: filter.Offset})
+}
+
+// handleGetError returns a single logged error
+func (s *Server) handleGetError(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid error id", http.StatusBadRequest)
+		return
+	}
+	entry, err := converter.GetError(r.Context(), s.db, id)
+	if errors.Is(err, converter.ErrErrorNotFound) {
+		http.Error(w, "error not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error reading process error", err)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// intParam parses an optional integer query parameter
+func intParam(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// timeParam parses an optional RFC 3339 query parameter
+func timeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
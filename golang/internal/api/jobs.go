@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"imersaofc/internal/audit"
+)
+
+// jobsPage is a page of jobs
+type jobsPage struct {
+	Items []audit.Job `json:"items"`
+	Limit int         `json:"limit"`
+}
+
+// handleListJobs lists the latest state of jobs filtered by the status
+// and label query parameters, the latter repeatable as name:value, with at
+// most limit jobs
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := audit.JobFilter{Status: q.Get("status")}
+	for _, label := range q["label"] {
+		name, value, ok := strings.Cut(label, ":")
+		if !ok || name == "" {
+			http.Error(w, "invalid label, expected name:value", http.StatusBadRequest)
+			return
+		}
+		if filter.Labels == nil {
+			filter.Labels = map[string]string{}
+		}
+		filter.Labels[name] = value
+	}
+	var err error
+	if filter.Limit, err = intParam(q.Get("limit")); err != nil || filter.Limit < 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	list, err := audit.ListJobs(r.Context(), s.db, filter)
+	if err != nil {
+		serverError(w, "Error listing jobs", err)
+		return
+	}
+	limit := filter.Limit
+	if limit == 0 {
+		limit = audit.DefaultJobPageSize
+	}
+	writeJSON(w, jobsPage{Items: list, Limit: min(limit, audit.MaxJobPageSize)})
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// logPollInterval is how often a followed log is checked for new output
+const logPollInterval = 500 * time.Millisecond
+
+// WithFFmpegLogs enables GET /jobs/{video_id}/logs, serving the ffmpeg logs
+// the workers write to dir, see converter.WithFFmpegLogs. The api must see
+// the same dir, e.g. by running in the worker or on a shared volume.
+func WithFFmpegLogs(dir string) Option {
+	return func(s *Server) {
+		s.logDir = dir
+	}
+}
+
+// handleJobLogs writes the ffmpeg log of the video's latest job. With
+// follow=true the response stays open and new output is sent as ffmpeg
+// writes it, until the job is done or the client goes away.
+func (s *Server) handleJobLogs(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	path, err := converter.LatestFFmpegLog(s.logDir, videoID)
+	if errors.Is(err, converter.ErrNoFFmpegLog) {
+		http.Error(w, "no logs for this job", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error finding ffmpeg log", err)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		serverError(w, "Error opening ffmpeg log", err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	follow := r.URL.Query().Get("follow") == "true"
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(logPollInterval)
+	defer ticker.Stop()
+
+	// tail holds the last bytes sent, to notice the end of job line
+	var tail []byte
+	buf := make([]byte, 32*1024)
+	for {
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return
+				}
+				tail = append(tail, buf[:n]...)
+				tail = tail[max(len(tail)-len(converter.FFmpegLogEnd), 0):]
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return
+			}
+		}
+		if !follow || bytes.HasSuffix(tail, []byte(converter.FFmpegLogEnd)) {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
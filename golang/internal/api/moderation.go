@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+
+	"imersaofc/internal/converter"
+)
+
+// handleListVerdicts returns the video's moderation verdicts, oldest
+// first, for reviewing flagged and blocked videos
+func (s *Server) handleListVerdicts(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	verdicts, err := converter.ListVerdicts(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing moderation verdicts", err)
+		return
+	}
+	writeJSON(w, verdicts)
+}
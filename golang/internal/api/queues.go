@@ -0,0 +1,35 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"imersaofc/internal/rabbitmq"
+)
+
+// QueueInspector reports the backlog of a queue the worker consumes
+type QueueInspector interface {
+	Stats(ctx context.Context) (rabbitmq.QueueStats, error)
+}
+
+// WithQueues enables GET /queues, which reports the backlog of each of the
+// inspected queues
+func WithQueues(inspectors ...QueueInspector) Option {
+	return func(s *Server) {
+		s.queues = append(s.queues, inspectors...)
+	}
+}
+
+// handleListQueues returns the depth and oldest message age of each queue
+func (s *Server) handleListQueues(w http.ResponseWriter, r *http.Request) {
+	list := make([]rabbitmq.QueueStats, 0, len(s.queues))
+	for _, inspector := range s.queues {
+		stats, err := inspector.Stats(r.Context())
+		if err != nil {
+			serverError(w, "Error inspecting queue", err)
+			return
+		}
+		list = append(list, stats)
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"imersaofc/internal/converter"
+)
+
+// Enqueuer hands a task over for conversion
+type Enqueuer interface {
+	Enqueue(task converter.VideoTask) error
+}
+
+// WithReprocess enables POST /videos/{video_id}/reprocess, which enqueues
+// the video's chunks below uploadRoot to be converted again
+func WithReprocess(uploadRoot string, enqueuer Enqueuer) Option {
+	return func(s *Server) {
+		s.uploadRoot = uploadRoot
+		s.enqueuer = enqueuer
+	}
+}
+
+// reprocessRequest is the optional body of a reprocess request
+type reprocessRequest struct {
+	Profile string `json:"profile"`
+	// SourceFile names the video's single uploaded file, for producers that
+	// don't upload chunks
+	SourceFile string `json:"source_file"`
+}
+
+// handleReprocess enqueues a reprocess task, optionally with another profile
+func (s *Server) handleReprocess(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req reprocessRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	task := converter.VideoTask{
+		VideoID:    videoID,
+		Path:       filepath.Join(s.uploadRoot, strconv.Itoa(videoID)),
+		Profile:    req.Profile,
+		SourceFile: req.SourceFile,
+		Reprocess:  true,
+	}
+	if err := s.enqueuer.Enqueue(task); err != nil {
+		serverError(w, "Error enqueueing reprocess task", err)
+		return
+	}
+	slog.Info("Reprocess requested", slog.Int("video_id", videoID), slog.String("profile", req.Profile))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, task)
+}
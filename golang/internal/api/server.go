@@ -0,0 +1,189 @@
+// Package api serves status and error information about conversion jobs,
+// and lets clients reprocess videos and switch their active output version
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/audit"
+	"imersaofc/internal/auth"
+	"imersaofc/internal/database"
+	"imersaofc/internal/events"
+)
+
+// Server exposes job status over HTTP
+type Server struct {
+	db          *database.DB
+	mux         *http.ServeMux
+	enqueuer    Enqueuer
+	uploadRoot  string
+	logDir      string
+	authn       auth.Authenticator
+	redeliverer Redeliverer
+	queues      []QueueInspector
+}
+
+// Option configures optional Server features
+type Option func(*Server)
+
+// NewServer creates a new instance of Server
+func NewServer(db *database.DB, opts ...Option) *Server {
+	s := &Server{
+		db:  db,
+		mux: http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.handle("GET /videos/{video_id}/status", auth.RoleRead, s.handleStatus)
+	s.handle("GET /videos/{video_id}/events", auth.RoleRead, s.handleEvents)
+	s.handle("GET /videos/{video_id}/versions", auth.RoleRead, s.handleListVersions)
+	s.handle("POST /videos/{video_id}/versions/{version}/activate", auth.RoleAdmin, s.handleActivateVersion)
+	s.handle("GET /videos/{video_id}/moderation", auth.RoleRead, s.handleListVerdicts)
+	s.handle("GET /videos/{video_id}/encodes", auth.RoleRead, s.handleListEncodes)
+	s.handle("GET /jobs", auth.RoleRead, s.handleListJobs)
+	s.handle("GET /batches/{batch_id}", auth.RoleRead, s.handleGetBatch)
+	s.handle("GET /queue/eta", auth.RoleRead, s.handleQueueETA)
+	s.handle("GET /stats/throughput", auth.RoleRead, s.handleThroughput)
+	s.handle("GET /errors", auth.RoleRead, s.handleListErrors)
+	s.handle("GET /errors/{id}", auth.RoleRead, s.handleGetError)
+	s.handle("GET /webhooks/deliveries", auth.RoleRead, s.handleListDeliveries)
+	s.handle("GET /webhooks/deliveries/{id}", auth.RoleRead, s.handleGetDelivery)
+	s.handle("GET /tenants", auth.RoleRead, s.handleListTenants)
+	s.handle("GET /tenants/{tenant}", auth.RoleRead, s.handleGetTenant)
+	s.handle("PUT /tenants/{tenant}", auth.RoleAdmin, s.handlePutTenant)
+	s.handle("DELETE /tenants/{tenant}", auth.RoleAdmin, s.handleDeleteTenant)
+	if s.enqueuer != nil {
+		s.handle("POST /videos/{video_id}/reprocess", auth.RoleAdmin, s.handleReprocess)
+	}
+	if s.redeliverer != nil {
+		s.handle("POST /webhooks/deliveries/{id}/redeliver", auth.RoleAdmin, s.handleRedeliver)
+	}
+	if len(s.queues) > 0 {
+		s.handle("GET /queues", auth.RoleRead, s.handleListQueues)
+	}
+	if s.logDir != "" {
+		s.handle("GET /jobs/{video_id}/logs", auth.RoleRead, s.handleJobLogs)
+	}
+	return s
+}
+
+// WithAuth requires every request to authenticate with a, and to have the
+// role of its endpoint: reprocessing, activating versions, redelivering
+// webhooks and editing tenant settings are for admins, the rest is
+// read-only
+func WithAuth(a auth.Authenticator) Option {
+	return func(s *Server) {
+		s.authn = a
+	}
+}
+
+// handle registers the handler of an endpoint, for clients with the role
+// when the server authenticates requests
+func (s *Server) handle(pattern string, role auth.Role, handler http.HandlerFunc) {
+	if s.authn == nil {
+		s.mux.HandleFunc(pattern, handler)
+		return
+	}
+	s.mux.Handle(pattern, auth.Require(s.authn, role, handler))
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// statusResponse is the current state of a job and how it got there
+type statusResponse struct {
+	VideoID int    `json:"video_id"`
+	Status  string `json:"status"`
+	// ETA is the estimated completion of a job in progress
+	ETA    *time.Time       `json:"eta,omitempty"`
+	Events []audit.JobEvent `json:"events"`
+}
+
+// handleStatus returns the job's current status with its transitions
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	list, err := audit.Events(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing job events", err)
+		return
+	}
+	if len(list) == 0 {
+		http.Error(w, "video not found", http.StatusNotFound)
+		return
+	}
+	status := statusResponse{
+		VideoID: videoID,
+		Status:  list[len(list)-1].NewStatus,
+		Events:  list,
+	}
+	if status.Status == audit.StatusProcessing || status.Status == audit.StatusRetrying {
+		status.ETA = latestETA(list)
+	}
+	writeJSON(w, status)
+}
+
+// latestETA returns the completion time of the job's latest estimate since
+// it last started, nil when it has none
+func latestETA(list []audit.JobEvent) *time.Time {
+	for i := len(list) - 1; i >= 0; i-- {
+		switch list[i].Event {
+		case events.TaskStarted{}.Name():
+			return nil
+		case events.TaskEstimated{}.Name():
+			var details struct {
+				ETA time.Time `json:"eta"`
+			}
+			if json.Unmarshal(list[i].Details, &details) != nil {
+				return nil
+			}
+			return &details.ETA
+		}
+	}
+	return nil
+}
+
+// handleEvents returns the job's transitions, oldest first
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	list, err := audit.Events(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing job events", err)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// videoIDParam parses the video_id path value, answering 400 when invalid
+func videoIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	videoID, err := strconv.Atoi(r.PathValue("video_id"))
+	if err != nil || videoID <= 0 {
+		http.Error(w, "invalid video id", http.StatusBadRequest)
+		return 0, false
+	}
+	return videoID, true
+}
+
+func serverError(w http.ResponseWriter, message string, err error) {
+	slog.Error(message, slog.String("error", err.Error()))
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing response", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"imersaofc/internal/stats"
+)
+
+// handleQueueETA reports the estimated completion of the jobs in progress
+func (s *Server) handleQueueETA(w http.ResponseWriter, r *http.Request) {
+	estimate, err := stats.QueueETA(r.Context(), s.db)
+	if err != nil {
+		serverError(w, "Error estimating queue completion", err)
+		return
+	}
+	writeJSON(w, estimate)
+}
+
+// handleThroughput reports the throughput between the from and to (RFC
+// 3339) query parameters, the last 24 hours by default, grouped by the
+// group_by parameter: hour (default), worker or profile
+func (s *Server) handleThroughput(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to, err := timeParam(q.Get("to"))
+	if err != nil {
+		http.Error(w, "invalid to, expected RFC 3339", http.StatusBadRequest)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from, err := timeParam(q.Get("from"))
+	if err != nil {
+		http.Error(w, "invalid from, expected RFC 3339", http.StatusBadRequest)
+		return
+	}
+	if from.IsZero() {
+		from = to.Add(-24 * time.Hour)
+	}
+	groupBy := q.Get("group_by")
+	if groupBy == "" {
+		groupBy = stats.GroupByHour
+	}
+	if groupBy != stats.GroupByHour && groupBy != stats.GroupByWorker && groupBy != stats.GroupByProfile {
+		http.Error(w, "invalid group_by, expected hour, worker or profile", http.StatusBadRequest)
+		return
+	}
+
+	report, err := stats.Throughput(r.Context(), s.db, from, to, groupBy)
+	if err != nil {
+		serverError(w, "Error reporting throughput", err)
+		return
+	}
+	writeJSON(w, report)
+}
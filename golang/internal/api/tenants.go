@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// handleListTenants returns the settings of every tenant that has some
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	list, err := converter.ListTenantSettings(r.Context(), s.db)
+	if err != nil {
+		serverError(w, "Error listing tenant settings", err)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// handleGetTenant returns the settings of a tenant
+func (s *Server) handleGetTenant(w http.ResponseWriter, r *http.Request) {
+	settings, err := converter.GetTenantSettings(r.Context(), s.db, r.PathValue("tenant"))
+	if errors.Is(err, converter.ErrTenantNotFound) {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error reading tenant settings", err)
+		return
+	}
+	writeJSON(w, settings)
+}
+
+// handlePutTenant creates or replaces the settings of a tenant, which
+// apply to its tasks converted from then on, and returns them. An unknown
+// default profile fails the tenant's tasks naming none as invalid.
+func (s *Server) handlePutTenant(w http.ResponseWriter, r *http.Request) {
+	var settings converter.TenantSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	settings.Tenant = r.PathValue("tenant")
+	settings.UpdatedAt = time.Now().UTC()
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := converter.SaveTenantSettings(r.Context(), s.db, settings); err != nil {
+		serverError(w, "Error saving tenant settings", err)
+		return
+	}
+	slog.Info("Tenant settings saved", slog.String("tenant", settings.Tenant),
+		slog.String("default_profile", settings.DefaultProfile), slog.String("storage_prefix", settings.StoragePrefix))
+	writeJSON(w, settings)
+}
+
+// handleDeleteTenant removes the settings of a tenant, which goes back to
+// the converter's defaults
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	err := converter.DeleteTenantSettings(r.Context(), s.db, tenant)
+	if errors.Is(err, converter.ErrTenantNotFound) {
+		http.Error(w, "tenant not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error deleting tenant settings", err)
+		return
+	}
+	slog.Info("Tenant settings deleted", slog.String("tenant", tenant))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"imersaofc/internal/converter"
+)
+
+// handleListVersions returns the video's output versions, oldest first
+func (s *Server) handleListVersions(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	versions, err := converter.ListVersions(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing output versions", err)
+		return
+	}
+	writeJSON(w, versions)
+}
+
+// handleActivateVersion switches the video to another output version, e.g.
+// to roll back a reprocess, and returns the versions
+func (s *Server) handleActivateVersion(w http.ResponseWriter, r *http.Request) {
+	videoID, ok := videoIDParam(w, r)
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version <= 0 {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+
+	err = converter.ActivateVersion(r.Context(), s.db, videoID, version)
+	if errors.Is(err, converter.ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error activating output version", err)
+		return
+	}
+	slog.Info("Output version activated", slog.Int("video_id", videoID), slog.Int("version", version))
+
+	versions, err := converter.ListVersions(r.Context(), s.db, videoID)
+	if err != nil {
+		serverError(w, "Error listing output versions", err)
+		return
+	}
+	writeJSON(w, versions)
+}
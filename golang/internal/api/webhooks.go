@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"imersaofc/internal/webhook"
+)
+
+// Redeliverer posts a tracked webhook delivery again
+type Redeliverer interface {
+	Redeliver(ctx context.Context, id int64) (webhook.Delivery, error)
+}
+
+// WithRedelivery enables POST /webhooks/deliveries/{id}/redeliver, which
+// posts a delivery again with sender
+func WithRedelivery(sender Redeliverer) Option {
+	return func(s *Server) {
+		s.redeliverer = sender
+	}
+}
+
+// handleListDeliveries lists webhook deliveries filtered by the video_id
+// and status query parameters, newest first, up to limit
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := webhook.DeliveryFilter{Status: q.Get("status")}
+	var err error
+	if filter.VideoID, err = intParam(q.Get("video_id")); err != nil {
+		http.Error(w, "invalid video_id", http.StatusBadRequest)
+		return
+	}
+	if filter.Limit, err = intParam(q.Get("limit")); err != nil || filter.Limit < 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	deliveries, err := webhook.ListDeliveries(r.Context(), s.db, filter)
+	if err != nil {
+		serverError(w, "Error listing webhook deliveries", err)
+		return
+	}
+	writeJSON(w, deliveries)
+}
+
+// handleGetDelivery returns a single webhook delivery with its payload
+func (s *Server) handleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	id, ok := deliveryIDParam(w, r)
+	if !ok {
+		return
+	}
+	delivery, err := webhook.GetDelivery(r.Context(), s.db, id)
+	if errors.Is(err, webhook.ErrDeliveryNotFound) {
+		http.Error(w, "delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, "Error reading webhook delivery", err)
+		return
+	}
+	writeJSON(w, delivery)
+}
+
+// handleRedeliver posts a webhook delivery again and returns it updated:
+// 200 when delivered, 502 with the delivery when the endpoint failed
+func (s *Server) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	id, ok := deliveryIDParam(w, r)
+	if !ok {
+		return
+	}
+	delivery, err := s.redeliverer.Redeliver(r.Context(), id)
+	if errors.Is(err, webhook.ErrDeliveryNotFound) {
+		http.Error(w, "delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil && delivery.ID == 0 {
+		serverError(w, "Error redelivering webhook", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	writeJSON(w, delivery)
+}
+
+// deliveryIDParam parses the {id} path parameter of a delivery
+func deliveryIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid delivery id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,141 @@
+// Package audit keeps an append-only log of every job state transition
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"imersaofc/internal/database"
+	"imersaofc/internal/events"
+)
+
+// Job statuses recorded in job_events
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusRetrying   = "retrying"
+	StatusFailed     = "failed"
+	StatusSuccess    = "success"
+	StatusExpired    = "expired"
+)
+
+// JobEvent is one row of the job_events table
+type JobEvent struct {
+	ID        int64           `json:"id"`
+	VideoID   int             `json:"video_id"`
+	Event     string          `json:"event"`
+	Stage     string          `json:"stage,omitempty"`
+	OldStatus string          `json:"old_status"`
+	NewStatus string          `json:"new_status"`
+	WorkerID  string          `json:"worker_id"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Recorder writes pipeline events to job_events
+type Recorder struct {
+	db       *database.DB
+	workerID string
+}
+
+// NewRecorder creates a new instance of Recorder recording events as workerID
+func NewRecorder(db *database.DB, workerID string) *Recorder {
+	return &Recorder{db: db, workerID: workerID}
+}
+
+// Record stores the transition described by a pipeline event; it is an
+// events.Subscriber. Failures are logged, auditing never fails a task.
+func (r *Recorder) Record(e events.Event) {
+	var (
+		videoID   int
+		stage     string
+		newStatus string
+		details   map[string]interface{}
+		at        time.Time
+	)
+	switch e := e.(type) {
+	case events.TaskStarted:
+		videoID, newStatus, at = e.VideoID, StatusProcessing, e.At
+		if videoID != 0 {
+			r.saveLabels(videoID, e.Labels)
+		}
+	case events.StageCompleted:
+		videoID, stage, newStatus, at = e.VideoID, e.Stage, StatusProcessing, e.At
+		details = map[string]interface{}{"duration_ms": e.Duration.Milliseconds()}
+	case events.TaskEstimated:
+		videoID, newStatus, at = e.VideoID, StatusProcessing, e.At
+		details = map[string]interface{}{
+			"source_seconds":   e.SourceDuration.Seconds(),
+			"estimate_seconds": e.Estimate.Seconds(),
+			"eta":              e.ETA,
+		}
+	case events.TaskFailed:
+		videoID, stage, newStatus, at = e.VideoID, e.Stage, StatusFailed, e.At
+		if e.Retryable {
+			newStatus = StatusRetrying
+		}
+		details = map[string]interface{}{"error": e.Err.Error()}
+	case events.TaskExpired:
+		videoID, newStatus, at = e.VideoID, StatusExpired, e.At
+		details = map[string]interface{}{"deadline": e.Deadline}
+	case events.TaskSucceeded:
+		videoID, newStatus, at = e.VideoID, StatusSuccess, e.At
+		details = map[string]interface{}{"mode": e.Mode, "duration_ms": e.Duration.Milliseconds()}
+	case events.LiveStarted:
+		videoID, newStatus, at = e.VideoID, StatusProcessing, e.At
+		details = map[string]interface{}{"live": true, "prefix": e.Prefix}
+	case events.LiveStopped:
+		videoID, newStatus, at = e.VideoID, StatusSuccess, e.At
+		details = map[string]interface{}{"segments": e.Segments, "duration_ms": e.Duration.Milliseconds()}
+		if e.Err != nil {
+			newStatus = StatusFailed
+			details["error"] = e.Err.Error()
+		}
+	default:
+		return
+	}
+	if videoID == 0 {
+		// Messages that couldn't be decoded have no job to attach to
+		return
+	}
+
+	var serialized []byte
+	if details != nil {
+		serialized, _ = json.Marshal(details)
+	}
+	// The old status is whatever the previous event left the job in
+	query := `INSERT INTO job_events (video_id, event, stage, old_status, new_status, worker_id, details, created_at)
+		SELECT ?, ?, ?, COALESCE((SELECT new_status FROM job_events WHERE video_id = ? ORDER BY id DESC LIMIT 1), ?), ?, ?, ?, ?`
+	_, err := r.db.Exec(r.db.Rebind(query), videoID, e.Name(), stage, videoID, StatusPending, newStatus, r.workerID, serialized, at)
+	if err != nil {
+		slog.Error("Error storing job event", slog.Int("video_id", videoID), slog.String("event", e.Name()), slog.String("error", err.Error()))
+	}
+}
+
+// Events returns the recorded transitions of a video, oldest first
+func Events(ctx context.Context, db *database.DB, videoID int) ([]JobEvent, error) {
+	query := `SELECT id, video_id, event, stage, old_status, new_status, worker_id, details, created_at
+		FROM job_events WHERE video_id = ? ORDER BY id`
+	rows, err := db.QueryContext(ctx, db.Rebind(query), videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []JobEvent{}
+	for rows.Next() {
+		var ev JobEvent
+		var details []byte
+		err := rows.Scan(&ev.ID, &ev.VideoID, &ev.Event, &ev.Stage, &ev.OldStatus, &ev.NewStatus, &ev.WorkerID, &details, &ev.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if len(details) > 0 {
+			ev.Details = details
+		}
+		list = append(list, ev)
+	}
+	return list, rows.Err()
+}
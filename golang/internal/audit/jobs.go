@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Page sizes of ListJobs
+const (
+	DefaultJobPageSize = 50
+	MaxJobPageSize     = 500
+)
+
+// Job is the latest state of a video's job, with the labels of its task
+type Job struct {
+	VideoID   int               `json:"video_id"`
+	Status    string            `json:"status"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// JobFilter selects the jobs ListJobs returns; zero fields match any job
+type JobFilter struct {
+	// Status is the job's latest status
+	Status string
+	// Labels the job's task must all have, with these values
+	Labels map[string]string
+	Limit  int
+}
+
+// saveLabels replaces the labels recorded for a video with those of the
+// task that just started. Failures are logged like those of Record.
+func (r *Recorder) saveLabels(videoID int, labels map[string]string) {
+	ctx := context.Background()
+	del := r.db.Rebind("DELETE FROM job_labels WHERE video_id = ?")
+	ins := r.db.Rebind("INSERT INTO job_labels (video_id, name, value) VALUES (?, ?, ?)")
+	err := database.Retry(ctx, func() error {
+		if _, err := r.db.ExecContext(ctx, del, videoID); err != nil {
+			return err
+		}
+		for name, value := range labels {
+			if _, err := r.db.ExecContext(ctx, ins, videoID, name, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error storing job labels", slog.Int("video_id", videoID), slog.String("error", err.Error()))
+	}
+}
+
+// ListJobs returns the latest state of the jobs matching the filter, most
+// recently updated first
+func ListJobs(ctx context.Context, db *database.DB, filter JobFilter) ([]Job, error) {
+	where := []string{"e.id = (SELECT MAX(id) FROM job_events WHERE video_id = e.video_id)"}
+	var args []interface{}
+	if filter.Status != "" {
+		where = append(where, "e.new_status = ?")
+		args = append(args, filter.Status)
+	}
+	for name, value := range filter.Labels {
+		where = append(where, "EXISTS (SELECT 1 FROM job_labels l WHERE l.video_id = e.video_id AND l.name = ? AND l.value = ?)")
+		args = append(args, name, value)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultJobPageSize
+	}
+	args = append(args, min(limit, MaxJobPageSize))
+	query := "SELECT e.video_id, e.new_status, e.created_at FROM job_events e WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY e.id DESC LIMIT ?"
+
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Job{}
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.VideoID, &job.Status, &job.UpdatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return list, nil
+	}
+	return list, loadLabels(ctx, db, list)
+}
+
+// loadLabels sets the labels of the jobs
+func loadLabels(ctx context.Context, db *database.DB, list []Job) error {
+	byVideo := make(map[int]*Job, len(list))
+	args := make([]interface{}, 0, len(list))
+	for i := range list {
+		byVideo[list[i].VideoID] = &list[i]
+		args = append(args, list[i].VideoID)
+	}
+	query := "SELECT video_id, name, value FROM job_labels WHERE video_id IN (?" + strings.Repeat(", ?", len(args)-1) + ")"
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			videoID     int
+			name, value string
+		)
+		if err := rows.Scan(&videoID, &name, &value); err != nil {
+			return err
+		}
+		job := byVideo[videoID]
+		if job.Labels == nil {
+			job.Labels = map[string]string{}
+		}
+		job.Labels[name] = value
+	}
+	return rows.Err()
+}
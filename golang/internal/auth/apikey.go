@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIKey is a static key of a client
+type APIKey struct {
+	Name string
+	Role Role
+	Key  string
+}
+
+// APIKeys authenticates requests carrying one of its keys as a bearer
+// token or in the X-API-Key header
+type APIKeys []APIKey
+
+// ParseAPIKeys parses keys written as "name:role:key", separated by commas
+func ParseAPIKeys(list string) (APIKeys, error) {
+	var keys APIKeys
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("api key entry of %q isn't name:role:key", parts[0])
+		}
+		role, ok := ParseRole(parts[1])
+		if !ok {
+			return nil, fmt.Errorf("api key %s: unknown role %q", parts[0], parts[1])
+		}
+		keys = append(keys, APIKey{Name: parts[0], Role: role, Key: parts[2]})
+	}
+	return keys, nil
+}
+
+// Authenticate implements Authenticator
+func (k APIKeys) Authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if key == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+	// Comparing digests keeps the time independent of the key lengths
+	sum := sha256.Sum256([]byte(key))
+	for _, k := range k {
+		want := sha256.Sum256([]byte(k.Key))
+		if subtle.ConstantTimeCompare(sum[:], want[:]) == 1 {
+			return Principal{Subject: k.Name, Role: k.Role}, nil
+		}
+	}
+	return Principal{}, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+}
@@ -0,0 +1,113 @@
+// Package auth authenticates API requests with API keys or JWTs and
+// authorizes them by role, so only trusted clients submit uploads and only
+// operators reprocess videos or switch their output versions
+package auth
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ErrUnauthenticated is returned when a request has no valid credentials
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Role is what a client may do; each role may do what the lower ones do
+type Role string
+
+// Roles, from the least to the most privileged
+const (
+	// RoleRead reads job status, versions, errors and stats
+	RoleRead Role = "read"
+	// RoleSubmit also uploads sources for conversion
+	RoleSubmit Role = "submit"
+	// RoleAdmin also reprocesses videos and activates output versions
+	RoleAdmin Role = "admin"
+)
+
+// roleRanks orders the roles
+var roleRanks = map[Role]int{RoleRead: 1, RoleSubmit: 2, RoleAdmin: 3}
+
+// ParseRole returns the role named s, false for an unknown one
+func ParseRole(s string) (Role, bool) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	_, ok := roleRanks[role]
+	return role, ok
+}
+
+// Allows reports whether the role may do what required may
+func (r Role) Allows(required Role) bool {
+	return roleRanks[r] > 0 && roleRanks[r] >= roleRanks[required]
+}
+
+// Principal is the authenticated client of a request
+type Principal struct {
+	// Subject names the client: the API key's name or the JWT's subject
+	Subject string
+	Role    Role
+}
+
+// Authenticator finds the principal of a request
+type Authenticator interface {
+	// Authenticate returns ErrUnauthenticated, possibly wrapped, when the
+	// request has no valid credentials of its kind
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// Multi authenticates with the first of its authenticators accepting the
+// request
+type Multi []Authenticator
+
+// Authenticate implements Authenticator
+func (m Multi) Authenticate(r *http.Request) (Principal, error) {
+	err := ErrUnauthenticated
+	for _, a := range m {
+		var p Principal
+		if p, err = a.Authenticate(r); err == nil {
+			return p, nil
+		}
+	}
+	return Principal{}, err
+}
+
+// principalKey is the context key of the request's principal
+type principalKey struct{}
+
+// FromContext returns the principal of an authenticated request
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Require wraps next so only requests of a principal allowed the role reach
+// it: others get 401 without valid credentials and 403 with a lower role
+func Require(a Authenticator, role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			slog.Warn("Rejected unauthenticated request", slog.String("method", r.Method),
+				slog.String("path", r.URL.Path), slog.String("error", err.Error()))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="videoconverter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !p.Role.Allows(role) {
+			slog.Warn("Rejected unauthorized request", slog.String("method", r.Method),
+				slog.String("path", r.URL.Path), slog.String("subject", p.Subject), slog.String("role", string(p.Role)))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// bearerToken returns the token of the request's Authorization header
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// leeway tolerates clock skew with the token issuer
+const leeway = time.Minute
+
+// JWT authenticates requests carrying a bearer JWT signed by the identity
+// provider, with HS256 and a shared secret or RS256 and its public key.
+// The role is read from a claim holding a role name or a list of them, the
+// highest one winning.
+type JWT struct {
+	// Secret verifies HS256 tokens, PublicKey RS256 ones; only the
+	// algorithm of the key set is accepted
+	Secret    []byte
+	PublicKey *rsa.PublicKey
+	// Issuer and Audience, when set, must match the token's iss and aud
+	Issuer   string
+	Audience string
+	// RoleClaim is the claim holding the role, "role" when empty
+	RoleClaim string
+}
+
+// ParseRSAPublicKey parses a PEM encoded RSA public key or certificate
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in public key")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Authenticate implements Authenticator
+func (j JWT) Authenticate(r *http.Request) (Principal, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return Principal{}, ErrUnauthenticated
+	}
+	claims, err := j.verify(token)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+
+	var p Principal
+	if sub, ok := claims["sub"].(string); ok {
+		p.Subject = sub
+	}
+	claim := j.RoleClaim
+	if claim == "" {
+		claim = "role"
+	}
+	var names []string
+	switch v := claims[claim].(type) {
+	case string:
+		names = []string{v}
+	case []any:
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	for _, name := range names {
+		if role, ok := ParseRole(name); ok && role.Allows(p.Role) {
+			p.Role = role
+		}
+	}
+	if p.Role == "" {
+		return Principal{}, fmt.Errorf("%w: no known role in the %s claim", ErrUnauthenticated, claim)
+	}
+	return p, nil
+}
+
+// verify checks the token's signature and time and audience claims and
+// returns its claims
+func (j JWT) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	// The algorithm follows the configured key, never the token alone
+	switch {
+	case header.Alg == "HS256" && len(j.Secret) > 0:
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	case header.Alg == "RS256" && j.PublicKey != nil:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(j.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token without expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// names the audience
+func hasAudience(aud any, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []any:
+		return slices.Contains(v, any(audience))
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
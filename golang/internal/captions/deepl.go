@@ -0,0 +1,110 @@
+package captions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// deeplBatch is the most texts DeepL translates in one request
+const deeplBatch = 50
+
+// DeepL translates captions with the DeepL API
+type DeepL struct {
+	AuthKey string
+	// BaseURL is the API of the key's plan, the free one for keys ending
+	// in ":fx" and the pro one otherwise when empty
+	BaseURL string
+	// Client is a client with a 1 minute timeout when nil
+	Client *http.Client
+}
+
+// Name implements converter.Translator
+func (d DeepL) Name() string { return "deepl" }
+
+// Translate implements converter.Translator
+func (d DeepL) Translate(ctx context.Context, texts []string, from, to string) ([]string, error) {
+	translations := make([]string, 0, len(texts))
+	for start := 0; start < len(texts); start += deeplBatch {
+		end := min(start+deeplBatch, len(texts))
+		batch, err := d.translate(ctx, texts[start:end], from, to)
+		if err != nil {
+			return nil, err
+		}
+		translations = append(translations, batch...)
+	}
+	return translations, nil
+}
+
+// translate translates a batch of texts in a single request
+func (d DeepL) translate(ctx context.Context, texts []string, from, to string) ([]string, error) {
+	payload := map[string]any{"text": texts, "target_lang": deeplTarget(to)}
+	if from != "" {
+		// Source languages have no regional variants
+		lang, _, _ := strings.Cut(from, "-")
+		payload["source_lang"] = strings.ToUpper(lang)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := d.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.deepl.com"
+		if strings.HasSuffix(d.AuthKey, ":fx") {
+			baseURL = "https://api-free.deepl.com"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/v2/translate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+d.AuthKey)
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call deepl: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("deepl returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode deepl response: %w", err)
+	}
+	translations := make([]string, len(result.Translations))
+	for i, t := range result.Translations {
+		translations[i] = t.Text
+	}
+	return translations, nil
+}
+
+// deeplTarget returns DeepL's code for a target language; English and
+// Portuguese need a regional variant, American and Brazilian by default
+func deeplTarget(language string) string {
+	switch code := strings.ToUpper(language); code {
+	case "EN":
+		return "EN-US"
+	case "PT":
+		return "PT-BR"
+	default:
+		return code
+	}
+}
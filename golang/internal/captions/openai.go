@@ -0,0 +1,147 @@
+package captions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultOpenAIBaseURL is the OpenAI API, which compatible services replace
+const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// openAIMaxUpload is the largest file the transcription endpoint accepts
+const openAIMaxUpload = 25 << 20
+
+// OpenAI transcribes through the OpenAI audio transcription API, or a
+// compatible service at BaseURL
+type OpenAI struct {
+	APIKey string
+	// Model is the transcription model, whisper-1 when empty
+	Model string
+	// BaseURL is DefaultOpenAIBaseURL when empty
+	BaseURL string
+	// Client is a client with a 10 minute timeout when nil
+	Client *http.Client
+}
+
+// Name implements converter.Captioner
+func (o OpenAI) Name() string { return "openai" }
+
+// AudioFormat implements converter.Captioner; MP3 keeps about 100 minutes
+// of speech under the API's upload limit
+func (o OpenAI) AudioFormat() string { return "mp3" }
+
+// Caption implements converter.Captioner. Detecting the language, when
+// none is given, needs a model with verbose responses, like whisper-1.
+func (o OpenAI) Caption(ctx context.Context, audio, language, output string) (string, error) {
+	info, err := os.Stat(audio)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > openAIMaxUpload {
+		return "", fmt.Errorf("audio of %d bytes is over the %d bytes the transcription api accepts", info.Size(), openAIMaxUpload)
+	}
+	model := o.Model
+	if model == "" {
+		model = "whisper-1"
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	// Without a language, the verbose response reports the one detected
+	// along with the timed segments the captions are written from
+	fields := map[string]string{"model": model, "response_format": "verbose_json"}
+	if language != "" {
+		fields["language"] = language
+		fields["response_format"] = "vtt"
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return "", err
+		}
+	}
+	part, err := form.CreateFormFile("file", filepath.Base(audio))
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(audio)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(part, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultOpenAIBaseURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call the transcription api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("transcription api returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if language != "" {
+		vtt, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		return language, os.WriteFile(output, vtt, 0o644)
+	}
+
+	var transcription struct {
+		Language string `json:"language"`
+		Segments []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Text  string  `json:"text"`
+		} `json:"segments"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&transcription); err != nil {
+		return "", fmt.Errorf("failed to decode transcription: %w", err)
+	}
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for _, segment := range transcription.Segments {
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s\n", vttTimestamp(segment.Start), vttTimestamp(segment.End), strings.TrimSpace(segment.Text))
+	}
+	if err := os.WriteFile(output, []byte(vtt.String()), 0o644); err != nil {
+		return "", err
+	}
+	return whisperLanguages[strings.ToLower(transcription.Language)], nil
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,76 @@
+// Package captions transcribes speech into WebVTT captions for the
+// converter's caption stage, locally with whisper.cpp or through a cloud
+// speech-to-text API
+package captions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// detectedLanguagePattern matches the language whisper.cpp reports when
+// it detects it
+var detectedLanguagePattern = regexp.MustCompile(`auto-detected language: ([a-z]{2,3})`)
+
+// WhisperCPP transcribes with the whisper.cpp command line tool on the
+// worker, which needs no network access but a model file and CPU time
+type WhisperCPP struct {
+	// Path is the whisper.cpp binary, whisper-cli on the PATH when empty
+	Path string
+	// Model is the ggml model file, such as ggml-base.bin
+	Model string
+	// Threads is the number of threads whisper.cpp uses, its default when zero
+	Threads int
+}
+
+// Name implements converter.Captioner
+func (w WhisperCPP) Name() string { return "whisper-cpp" }
+
+// AudioFormat implements converter.Captioner; whisper.cpp reads 16kHz WAV
+func (w WhisperCPP) AudioFormat() string { return "wav" }
+
+// Caption implements converter.Captioner, detecting the language when
+// none is given
+func (w WhisperCPP) Caption(ctx context.Context, audio, language, output string) (string, error) {
+	path := w.Path
+	if path == "" {
+		path = "whisper-cli"
+	}
+	lang := language
+	if lang == "" {
+		lang = "auto"
+	}
+	// whisper.cpp adds the .vtt extension to the output name itself
+	base := strings.TrimSuffix(output, ".vtt")
+	args := []string{"-m", w.Model, "-f", audio, "-l", lang, "-ovtt", "-of", base, "-np"}
+	if w.Threads > 0 {
+		args = append(args, "-t", strconv.Itoa(w.Threads))
+	}
+	out, err := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("whisper.cpp failed: %v: %s", err, lastLine(out))
+	}
+	if base+".vtt" != output {
+		if err := os.Rename(base+".vtt", output); err != nil {
+			return "", err
+		}
+	}
+	if language == "" {
+		if m := detectedLanguagePattern.FindSubmatch(out); m != nil {
+			language = string(m[1])
+		}
+	}
+	return language, nil
+}
+
+// lastLine returns the last non empty line of a command's output, where
+// tools print the reason they failed
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return lines[len(lines)-1]
+}
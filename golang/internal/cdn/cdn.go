@@ -0,0 +1,21 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Invalidator purges cached paths from a CDN. Paths start with "/" and may
+// end with "*" to purge everything below a prefix.
+type Invalidator interface {
+	Invalidate(ctx context.Context, paths []string) error
+}
+
+// responseError builds an error from a failed CDN API response
+func responseError(message string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s: %s", message, resp.Status, bytes.TrimSpace(body))
+}
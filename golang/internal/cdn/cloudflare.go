@@ -0,0 +1,67 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cloudflare purges cached files of a Cloudflare zone
+type Cloudflare struct {
+	zoneID   string
+	apiToken string
+	host     string
+	client   *http.Client
+}
+
+// NewCloudflare creates a new instance of Cloudflare; host is the public
+// hostname the outputs are served from (e.g. cdn.example.com)
+func NewCloudflare(zoneID, apiToken, host string) *Cloudflare {
+	return &Cloudflare{
+		zoneID:   zoneID,
+		apiToken: apiToken,
+		host:     host,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Invalidate purges exact paths by URL and wildcard paths by prefix
+func (c *Cloudflare) Invalidate(ctx context.Context, paths []string) error {
+	purge := struct {
+		Files    []string `json:"files,omitempty"`
+		Prefixes []string `json:"prefixes,omitempty"`
+	}{}
+	for _, p := range paths {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			purge.Prefixes = append(purge.Prefixes, c.host+prefix)
+		} else {
+			purge.Files = append(purge.Files, "https://"+c.host+p)
+		}
+	}
+	body, err := json.Marshal(purge)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/purge_cache", c.zoneID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to purge cloudflare cache: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("failed to purge cloudflare cache", resp)
+	}
+	return nil
+}
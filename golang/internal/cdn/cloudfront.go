@@ -0,0 +1,70 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/awsauth"
+)
+
+// CloudFront invalidates paths of an Amazon CloudFront distribution
+type CloudFront struct {
+	distributionID string
+	creds          awsauth.Credentials
+	client         *http.Client
+}
+
+// NewCloudFront creates a new instance of CloudFront
+func NewCloudFront(distributionID string, creds awsauth.Credentials) *CloudFront {
+	return &CloudFront{
+		distributionID: distributionID,
+		creds:          creds,
+		client:         &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Invalidate creates a CloudFront invalidation batch for the paths
+func (c *CloudFront) Invalidate(ctx context.Context, paths []string) error {
+	type items struct {
+		Path []string `xml:"Path"`
+	}
+	batch := struct {
+		XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+		Quantity        int      `xml:"Paths>Quantity"`
+		Items           items    `xml:"Paths>Items"`
+		CallerReference string   `xml:"CallerReference"`
+	}{
+		Quantity:        len(paths),
+		Items:           items{Path: paths},
+		CallerReference: strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://cloudfront.amazonaws.com/2020-05-31/distribution/%s/invalidation", c.distributionID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if err := awsauth.Sign(req, c.creds, "us-east-1", "cloudfront", time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to create cloudfront invalidation: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("failed to create cloudfront invalidation", resp)
+	}
+	return nil
+}
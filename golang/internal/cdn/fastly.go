@@ -0,0 +1,67 @@
+package cdn
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fastly purges content from a Fastly service. Exact paths are purged by
+// URL; wildcard paths are purged by surrogate key, so the origin must tag
+// objects with a Surrogate-Key equal to their prefix (e.g. "6/mpeg-dash").
+type Fastly struct {
+	serviceID string
+	apiKey    string
+	host      string
+	client    *http.Client
+}
+
+// NewFastly creates a new instance of Fastly
+func NewFastly(serviceID, apiKey, host string) *Fastly {
+	return &Fastly{
+		serviceID: serviceID,
+		apiKey:    apiKey,
+		host:      host,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Invalidate purges every path, stopping at the first failure
+func (f *Fastly) Invalidate(ctx context.Context, paths []string) error {
+	for _, p := range paths {
+		var endpoint string
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			key := strings.Trim(prefix, "/")
+			endpoint = fmt.Sprintf("https://api.fastly.com/service/%s/purge/%s", f.serviceID, url.PathEscape(key))
+		} else {
+			endpoint = "https://api.fastly.com/purge/" + f.host + p
+		}
+		if err := f.purge(ctx, endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge sends a single purge request
+func (f *Fastly) purge(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", f.apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to purge fastly cache: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("failed to purge fastly cache", resp)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+const (
+	// scte35Scheme signals SCTE-35 cues as XML in a DASH event stream
+	scte35Scheme = "urn:scte:scte35:2013:xml"
+	// scte35Namespace is the namespace of the SCTE-35 XML elements
+	scte35Namespace = "http://www.scte.org/schemas/35/2016"
+	// cueTolerance is how far, in seconds, a segment may start before a
+	// break and still be the one the break is signaled on
+	cueTolerance = 0.01
+)
+
+// AdBreak is a cue point where downstream SSAI systems insert ads: Time is
+// the second of the video the break starts at, and Duration how long the
+// content the ads replace lasts, zero for an insertion point that replaces
+// nothing
+type AdBreak struct {
+	Time     float64 `json:"time"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// adBreaks returns the ad breaks of the job, in order: those of the task
+// or, when it lists none, the SCTE-35 cues embedded in the source
+func (vc *VideoConverter) adBreaks(ctx context.Context, job *Job) ([]AdBreak, error) {
+	duration := job.Probe.DurationSeconds()
+	if len(job.Task.AdBreaks) > 0 {
+		breaks := append([]AdBreak(nil), job.Task.AdBreaks...)
+		for _, b := range breaks {
+			if b.Time < 0 || b.Duration < 0 || (duration > 0 && b.Time >= duration) {
+				return nil, fmt.Errorf("%w: ad break at %gs for %gs is outside the video", ErrInvalidTask, b.Time, b.Duration)
+			}
+		}
+		sort.Slice(breaks, func(i, j int) bool { return breaks[i].Time < breaks[j].Time })
+		return breaks, nil
+	}
+
+	stream := scte35Stream(job.Probe)
+	if stream == nil || job.Task.DryRun || vc.dryRun {
+		// A plan lists the extraction instead, the source isn't merged
+		return nil, nil
+	}
+	cues, err := vc.extractSCTE35(ctx, vc.runnerFor(job), job.MergedFile, stream.Index)
+	if err != nil {
+		return nil, err
+	}
+	breaks := cueBreaks(cues, job.Probe.StartSeconds(), duration)
+	slog.Info("Read ad breaks from scte-35", slog.String("path", job.MergedFile), slog.Int("breaks", len(breaks)))
+	return breaks, nil
+}
+
+// scte35Stream returns the source's SCTE-35 data stream, if any
+func scte35Stream(probe *ffmpeg.ProbeResult) *ffmpeg.Stream {
+	for i := range probe.Streams {
+		if probe.Streams[i].CodecName == "scte_35" {
+			return &probe.Streams[i]
+		}
+	}
+	return nil
+}
+
+// extractSCTE35 copies the splice_info_sections of the source's stream
+// to a file and reads their cues
+func (vc *VideoConverter) extractSCTE35(ctx context.Context, runner ffmpeg.Runner, source string, index int) ([]scte35Cue, error) {
+	dump := source + ".scte35"
+	defer os.Remove(dump)
+	output, err := runner.Run(ctx, scte35Args(source, index, dump)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract scte-35: %w", ffmpeg.ParseError(err, output))
+	}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scte-35: %v", err)
+	}
+	cues, err := parseSCTE35(data)
+	if err != nil {
+		// A cut off last section doesn't spoil the others
+		slog.Warn("Ignoring unreadable scte-35", slog.String("path", source), slog.String("error", err.Error()))
+	}
+	return cues, nil
+}
+
+// scte35Args are the ffmpeg options copying the SCTE-35 stream of the
+// source, as is, to dump
+func scte35Args(source string, index int, dump string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs:   []ffmpeg.Output{{Maps: []string{"0:" + strconv.Itoa(index)}, Codec: "copy", Format: "data", File: dump}},
+	}.Args()
+}
+
+// cueBreaks turns SCTE-35 cues into ad breaks, in seconds of the output,
+// which ffmpeg starts at zero rather than at the source's start. A break
+// without a duration lasts until the cue resuming the program, if any.
+func cueBreaks(cues []scte35Cue, start, duration float64) []AdBreak {
+	var breaks []AdBreak
+	open := -1
+	for _, cue := range cues {
+		t := float64(cue.pts)/scte35ClockRate - start
+		if t < 0 {
+			// The PTS wrapped around since the source started
+			t += float64(scte35PTSWrap) / scte35ClockRate
+		}
+		if duration > 0 && t >= duration {
+			continue
+		}
+		if !cue.out {
+			if open >= 0 && t > breaks[open].Time {
+				breaks[open].Duration = t - breaks[open].Time
+			}
+			open = -1
+			continue
+		}
+		breaks = append(breaks, AdBreak{Time: t, Duration: float64(cue.duration) / scte35ClockRate})
+		open = -1
+		if cue.duration == 0 {
+			open = len(breaks) - 1
+		}
+	}
+	sort.Slice(breaks, func(i, j int) bool { return breaks[i].Time < breaks[j].Time })
+	return breaks
+}
+
+// signalAdBreaks signals the job's ad breaks in its DASH manifest, as
+// events or period splits, and in the HLS media playlists next to it
+func signalAdBreaks(job *Job) error {
+	if wantsMultiPeriod(job) {
+		if err := splitPeriods(job.Manifest, job.AdBreaks, job.Probe.DurationSeconds()); err != nil {
+			return fmt.Errorf("failed to split the dash manifest in periods: %w", err)
+		}
+	} else if err := addSCTE35EventStream(job.Manifest, job.AdBreaks); err != nil {
+		return fmt.Errorf("failed to add ad breaks to the dash manifest: %w", err)
+	}
+	playlists, err := filepath.Glob(filepath.Join(job.OutputDir, "media_*.m3u8"))
+	if err != nil {
+		return err
+	}
+	if len(playlists) == 0 {
+		slog.Warn("No hls playlists, ad breaks are only signaled in the dash manifest", slog.String("path", job.OutputDir))
+	}
+	for _, playlist := range playlists {
+		if err := addCueTags(playlist, job.AdBreaks); err != nil {
+			return fmt.Errorf("failed to add ad breaks to %s: %w", filepath.Base(playlist), err)
+		}
+	}
+	return nil
+}
+
+var periodStartPattern = regexp.MustCompile(`<Period\b[^>]*>`)
+
+// addSCTE35EventStream adds an SCTE-35 event stream with a splice_insert
+// per ad break to the first period of the manifest
+func addSCTE35EventStream(manifest string, breaks []AdBreak) error {
+	mpd, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	loc := periodStartPattern.FindIndex(mpd)
+	if loc == nil {
+		return errors.New("no period in the manifest")
+	}
+
+	var stream strings.Builder
+	fmt.Fprintf(&stream, "\n\t\t<EventStream schemeIdUri=\"%s\" timescale=\"%d\">", scte35Scheme, scte35ClockRate)
+	for i, b := range breaks {
+		stream.WriteString(scte35Event(i+1, int64(b.Time*scte35ClockRate), int64(b.Duration*scte35ClockRate)))
+	}
+	stream.WriteString("\n\t\t</EventStream>")
+
+	var updated bytes.Buffer
+	updated.Write(mpd[:loc[1]])
+	updated.WriteString(stream.String())
+	updated.Write(mpd[loc[1]:])
+	return os.WriteFile(manifest, updated.Bytes(), 0o644)
+}
+
+// scte35Event returns the DASH event of an ad break at pts, on the 90kHz
+// clock, as a splice_insert
+func scte35Event(id int, pts, duration int64) string {
+	var event strings.Builder
+	fmt.Fprintf(&event, "\n\t\t\t<Event presentationTime=\"%d\" duration=\"%d\" id=\"%d\">", pts, duration, id)
+	fmt.Fprintf(&event, "\n\t\t\t\t<scte35:SpliceInfoSection xmlns:scte35=\"%s\">", scte35Namespace)
+	fmt.Fprintf(&event, "<scte35:SpliceInsert spliceEventId=\"%d\" outOfNetworkIndicator=\"true\" spliceImmediateFlag=\"false\">", id)
+	fmt.Fprintf(&event, "<scte35:Program><scte35:SpliceTime ptsTime=\"%d\"/></scte35:Program>", pts)
+	if duration > 0 {
+		fmt.Fprintf(&event, "<scte35:BreakDuration autoReturn=\"true\" duration=\"%d\"/>", duration)
+	}
+	event.WriteString("</scte35:SpliceInsert></scte35:SpliceInfoSection>\n\t\t\t</Event>")
+	return event.String()
+}
+
+// addCueTags adds an EXT-X-CUE-OUT before the first segment starting at or
+// after each ad break, and an EXT-X-CUE-IN before the first one starting
+// once the break is over; segments don't split at breaks, so a break is
+// signaled at the next segment boundary
+func addCueTags(playlist string, breaks []AdBreak) error {
+	data, err := os.ReadFile(playlist)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	var elapsed, cueIn float64
+	next, open := 0, false
+	for _, line := range strings.Split(string(data), "\n") {
+		rest, ok := strings.CutPrefix(line, "#EXTINF:")
+		if !ok {
+			lines = append(lines, line)
+			continue
+		}
+		if open && elapsed >= cueIn-cueTolerance {
+			lines = append(lines, "#EXT-X-CUE-IN")
+			open = false
+		}
+		for ; next < len(breaks) && elapsed >= breaks[next].Time-cueTolerance; next++ {
+			if open {
+				// Overlaps the break still running
+				continue
+			}
+			b := breaks[next]
+			lines = append(lines, "#EXT-X-CUE-OUT:DURATION="+strconv.FormatFloat(b.Duration, 'f', -1, 64))
+			if b.Duration == 0 {
+				lines = append(lines, "#EXT-X-CUE-IN")
+			} else {
+				open, cueIn = true, b.Time+b.Duration
+			}
+		}
+		lines = append(lines, line)
+		seconds, _, _ := strings.Cut(rest, ",")
+		d, err := strconv.ParseFloat(strings.TrimSpace(seconds), 64)
+		if err != nil {
+			return fmt.Errorf("bad segment duration %q", seconds)
+		}
+		elapsed += d
+	}
+	return os.WriteFile(playlist, []byte(strings.Join(lines, "\n")), 0o644)
+}
@@ -0,0 +1,218 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Statuses of the tasks of a batch
+const (
+	BatchTaskPending = "pending"
+	BatchTaskSuccess = "success"
+	BatchTaskFailed  = "failed"
+	BatchTaskExpired = "expired"
+)
+
+// ErrBatchNotFound is returned when no batch has the requested id
+var ErrBatchNotFound = errors.New("batch not found")
+
+// Enqueuer hands a task over to be handled as its own message
+type Enqueuer interface {
+	Enqueue(task VideoTask) error
+}
+
+// BatchMessage carries many tasks in one message, e.g. for a bulk backfill.
+// A bare JSON array of tasks is accepted too and gets a generated id.
+type BatchMessage struct {
+	BatchID string      `json:"batch_id"`
+	Tasks   []VideoTask `json:"tasks"`
+}
+
+// Batch is the progress of a batch
+type Batch struct {
+	ID        string      `json:"batch_id"`
+	Total     int         `json:"total"`
+	Pending   int         `json:"pending"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Expired   int         `json:"expired"`
+	CreatedAt time.Time   `json:"created_at"`
+	Tasks     []BatchTask `json:"tasks"`
+}
+
+// BatchTask is the status of one task of a batch
+type BatchTask struct {
+	VideoID   int       `json:"video_id"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// parseBatch decodes msg when it is a batch message
+func parseBatch(msg []byte) (BatchMessage, bool) {
+	var batch BatchMessage
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &batch.Tasks); err != nil {
+			return batch, false
+		}
+		return batch, true
+	}
+	if err := json.Unmarshal(trimmed, &batch); err != nil || batch.Tasks == nil {
+		return batch, false
+	}
+	return batch, true
+}
+
+// handleBatches expands batch messages into one message per task, tagged
+// with the batch id, and records the outcome of each tagged task so the
+// batch progress can be queried
+func (vc *VideoConverter) handleBatches(next Handler) Handler {
+	return func(ctx context.Context, msg []byte) Result {
+		if batch, ok := parseBatch(msg); ok {
+			return vc.expandBatch(batch)
+		}
+
+		var task VideoTask
+		if err := json.Unmarshal(msg, &task); err != nil || task.BatchID == "" {
+			return next(ctx, msg)
+		}
+		result := next(ctx, msg)
+		status := BatchTaskSuccess
+		switch result.Outcome {
+		case OutcomeRetry:
+			return result
+		case OutcomePermanent:
+			status = BatchTaskFailed
+		}
+		if err := vc.repo.UpdateBatchTask(ctx, task.BatchID, task.VideoID, status); err != nil {
+			slog.Error("Error updating batch progress",
+				slog.String("batch_id", task.BatchID),
+				slog.Int("video_id", task.VideoID),
+				slog.String("error", err.Error()))
+		}
+		return result
+	}
+}
+
+// expandBatch records the batch and enqueues its tasks. A redelivered batch
+// is enqueued again; tasks already processed are skipped by SkipProcessed.
+func (vc *VideoConverter) expandBatch(batch BatchMessage) Result {
+	if vc.enqueuer == nil {
+		return Permanent(fmt.Errorf("%w: batch messages need an enqueuer", ErrInvalidTask))
+	}
+	if len(batch.Tasks) == 0 {
+		return Permanent(fmt.Errorf("%w: empty batch", ErrInvalidTask))
+	}
+	if batch.BatchID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		batch.BatchID = hex.EncodeToString(id)
+	}
+
+	videoIDs := make([]int, len(batch.Tasks))
+	for i, task := range batch.Tasks {
+		if task.VideoID <= 0 {
+			return Permanent(fmt.Errorf("%w: batch task %d has no video id", ErrInvalidTask, i))
+		}
+		videoIDs[i] = task.VideoID
+	}
+	if err := vc.repo.CreateBatch(context.Background(), batch.BatchID, videoIDs); err != nil {
+		return Retry(fmt.Errorf("failed to record batch: %w", err))
+	}
+
+	for _, task := range batch.Tasks {
+		task.BatchID = batch.BatchID
+		if err := vc.enqueuer.Enqueue(task); err != nil {
+			return Retry(fmt.Errorf("failed to enqueue batch task %d: %w", task.VideoID, err))
+		}
+	}
+	slog.Info("Batch expanded", slog.String("batch_id", batch.BatchID), slog.Int("tasks", len(batch.Tasks)))
+	return Success()
+}
+
+// CreateBatch records a batch with its tasks pending, replacing an earlier
+// record of the same batch
+func CreateBatch(ctx context.Context, db *database.DB, batchID string, videoIDs []int) error {
+	now := time.Now()
+	return database.Retry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, db.Rebind("DELETE FROM batch_tasks WHERE batch_id = ?"), batchID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, db.Rebind("DELETE FROM batches WHERE batch_id = ?"), batchID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, db.Rebind("INSERT INTO batches (batch_id, total, created_at) VALUES (?, ?, ?)"),
+			batchID, len(videoIDs), now); err != nil {
+			return err
+		}
+		insert := db.Rebind("INSERT INTO batch_tasks (batch_id, video_id, status, updated_at) VALUES (?, ?, ?, ?)")
+		for _, videoID := range videoIDs {
+			if _, err := tx.ExecContext(ctx, insert, batchID, videoID, BatchTaskPending, now); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// UpdateBatchTask records the final status of a batch task
+func UpdateBatchTask(ctx context.Context, db *database.DB, batchID string, videoID int, status string) error {
+	query := db.Rebind("UPDATE batch_tasks SET status = ?, updated_at = ? WHERE batch_id = ? AND video_id = ?")
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, query, status, time.Now(), batchID, videoID)
+		return err
+	})
+}
+
+// GetBatch returns the batch with the status of each of its tasks
+func GetBatch(ctx context.Context, db *database.DB, batchID string) (Batch, error) {
+	batch := Batch{ID: batchID, Tasks: []BatchTask{}}
+	err := db.QueryRowContext(ctx, db.Rebind("SELECT total, created_at FROM batches WHERE batch_id = ?"), batchID).
+		Scan(&batch.Total, &batch.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return batch, ErrBatchNotFound
+	}
+	if err != nil {
+		return batch, err
+	}
+
+	rows, err := db.QueryContext(ctx, db.Rebind("SELECT video_id, status, updated_at FROM batch_tasks WHERE batch_id = ? ORDER BY video_id"), batchID)
+	if err != nil {
+		return batch, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t BatchTask
+		if err := rows.Scan(&t.VideoID, &t.Status, &t.UpdatedAt); err != nil {
+			return batch, err
+		}
+		switch t.Status {
+		case BatchTaskSuccess:
+			batch.Succeeded++
+		case BatchTaskFailed:
+			batch.Failed++
+		case BatchTaskExpired:
+			batch.Expired++
+		default:
+			batch.Pending++
+		}
+		batch.Tasks = append(batch.Tasks, t)
+	}
+	return batch, rows.Err()
+}
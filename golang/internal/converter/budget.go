@@ -0,0 +1,170 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// What to do with a rendition over its profile's MaxBytesPerMinute
+const (
+	// BudgetReencode encodes the video again at a lower quality, up to
+	// maxBudgetSteps times, and flags the job if it's still over
+	BudgetReencode = "reencode"
+	// BudgetFlag keeps the output and flags the job
+	BudgetFlag = "flag"
+)
+
+// maxBudgetSteps is how many times an over budget video is encoded again
+const maxBudgetSteps = 3
+
+// budgetCRFStep is how much each step raises the CRF; +6 roughly halves
+// the bitrate of x264 and x265
+const budgetCRFStep = 4
+
+// defaultCRFs are the CRF the encoders use when none is set, where a
+// stepped-down encode starts from
+var defaultCRFs = map[string]int{"libx264": 23, "libx265": 28}
+
+// segmentPattern matches the DASH muxer's $Number$ and $Time$ identifiers
+var segmentPattern = regexp.MustCompile(`\$(Number|Time)[^$]*\$`)
+
+// checkBudgetAction returns an error for an unknown budget action
+func checkBudgetAction(action string) error {
+	switch action {
+	case "", BudgetReencode, BudgetFlag:
+		return nil
+	}
+	return fmt.Errorf("unknown budget action %q", action)
+}
+
+// wantsBudget reports whether the job's renditions are held to a size
+// budget
+func wantsBudget(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && job.Profile.MaxBytesPerMinute > 0
+}
+
+// enforceBudget checks the renditions the transcoder wrote against the
+// profile's MaxBytesPerMinute, encoding the video again at a lower quality
+// or flagging the job as the profile's BudgetAction says
+func (vc *VideoConverter) enforceBudget(ctx context.Context, job *Job, transcoder Transcoder) error {
+	if _, ok := transcoder.(localTranscoder); !ok {
+		// Remote transcoders keep their own segment names
+		slog.Warn("Size budget isn't enforced on remote transcodes", slog.Int("video_id", job.Task.VideoID), slog.String("transcoder", transcoder.Name()))
+		return nil
+	}
+	minutes := job.Probe.DurationSeconds() / 60
+	if minutes <= 0 {
+		return nil
+	}
+
+	for step := 0; ; step++ {
+		over, err := vc.overBudget(job, minutes)
+		if err != nil {
+			return err
+		}
+		if len(over) == 0 {
+			return nil
+		}
+		// Only the video has a quality to step down, representation 0
+		stepped, ok := stepDownQuality(job.Profile)
+		if job.Profile.BudgetAction == BudgetFlag || step == maxBudgetSteps || over[0] != 0 || !ok {
+			slog.Warn("Renditions over size budget", slog.Int("video_id", job.Task.VideoID),
+				slog.Any("renditions", over), slog.Int64("max_bytes_per_minute", job.Profile.MaxBytesPerMinute))
+			job.OverBudget = true
+			return nil
+		}
+
+		slog.Info("Encoding video again over size budget", slog.Int("video_id", job.Task.VideoID),
+			slog.Int("step", step+1), slog.Int("crf", stepped.CRF), slog.String("bitrate", stepped.VideoBitrate))
+		job.Profile = stepped
+		job.OutputArgs = vc.dashArgs(job)
+		if err := os.RemoveAll(job.OutputDir); err != nil {
+			return fmt.Errorf("failed to remove over budget output: %w", err)
+		}
+		if err := vc.createOutputDirs(job); err != nil {
+			return err
+		}
+		if err := transcoder.Transcode(ctx, job); err != nil {
+			return err
+		}
+	}
+}
+
+// overBudget returns the representations of the job over the budget
+func (vc *VideoConverter) overBudget(job *Job, minutes float64) ([]int, error) {
+	var over []int
+	for id := range representations(job) {
+		size, err := vc.renditionSize(job, id)
+		if err != nil {
+			return nil, err
+		}
+		if float64(size)/minutes > float64(job.Profile.MaxBytesPerMinute) {
+			over = append(over, id)
+		}
+	}
+	return over, nil
+}
+
+// renditionSize returns the size of the init and media segments of a
+// representation, or of its single file, named by the output layout
+func (vc *VideoConverter) renditionSize(job *Job, id int) (int64, error) {
+	var size int64
+	for _, template := range vc.outputLayout.segmentTemplates(job) {
+		name := expand(template, job.Task, job.Task.VideoID, job.Version)
+		name = strings.ReplaceAll(name, "$RepresentationID$", strconv.Itoa(id))
+		files, err := filepath.Glob(filepath.Join(job.OutputDir, filepath.FromSlash(segmentPattern.ReplaceAllString(name, "*"))))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return 0, err
+			}
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// stepDownQuality returns the profile with a lower video quality: a
+// quarter less bitrate when the profile sets one, a higher CRF otherwise.
+// It reports false for copied video and encoders without a known CRF.
+func stepDownQuality(p Profile) (Profile, bool) {
+	codec := p.VideoCodec
+	if codec == "copy" {
+		return p, false
+	}
+	if p.VideoBitrate != "" {
+		rate := parseBitrate(p.VideoBitrate, 0)
+		if rate == 0 {
+			return p, false
+		}
+		p.VideoBitrate = strconv.Itoa(rate * 3 / 4)
+		return p, true
+	}
+	if codec == "" {
+		// A copied stream has no quality to step down, encode it
+		codec = "libx264"
+	}
+	crf := p.CRF
+	if crf == 0 {
+		def, ok := defaultCRFs[codec]
+		if !ok {
+			return p, false
+		}
+		crf = def
+	}
+	if crf >= 51 {
+		return p, false
+	}
+	p.VideoCodec = codec
+	p.CRF = min(crf+budgetCRFStep, 51)
+	return p, true
+}
@@ -0,0 +1,210 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// CaptionsDir holds the caption tracks, below the output directory
+const CaptionsDir = "captions"
+
+// Captioner transcribes the speech of a video into WebVTT captions for the
+// caption stage, see WithCaptioner
+type Captioner interface {
+	Name() string
+	// AudioFormat is the format of the audio the captioner transcribes:
+	// "wav" for 16kHz mono PCM, or "mp3" for 16kHz mono MP3, which keeps
+	// long videos under the upload limits of cloud services
+	AudioFormat() string
+	// Caption transcribes audio into WebVTT written to output. language is
+	// the spoken language as an ISO 639-1 code, empty to let the captioner
+	// detect it; the language of the captions is returned, empty when
+	// unknown.
+	Caption(ctx context.Context, audio, language, output string) (string, error)
+}
+
+// CaptionTrack is a WebVTT file of the output, transcribed or translated
+type CaptionTrack struct {
+	// Language is the ISO 639-1 code of the captions, "und" when unknown
+	Language string `json:"language"`
+	// File is the captions file, relative to the manifest
+	File string `json:"file"`
+}
+
+// WithCaptioner generates captions, with c, for the tasks asking for them
+func WithCaptioner(c Captioner) Option {
+	return func(vc *VideoConverter) {
+		vc.captioner = c
+	}
+}
+
+// wantsCaptions reports whether the job generates captions: its task asks
+// for them, a captioner is configured and the source has speech to
+// transcribe
+func (vc *VideoConverter) wantsCaptions(job *Job) bool {
+	return job.Task.Captions && vc.captioner != nil && job.DuplicateOf == 0 && job.Probe != nil && job.Probe.AudioStream() != nil
+}
+
+// captionStage transcribes the source's audio into a caption track, which
+// the package stage signals in the manifests
+func (vc *VideoConverter) captionStage(ctx context.Context, job *Job) error {
+	if job.Task.Captions && vc.captioner == nil {
+		slog.Warn("Captions requested but no captioner is configured", slog.Int("video_id", job.Task.VideoID))
+	}
+	if !vc.wantsCaptions(job) {
+		return nil
+	}
+
+	dir := filepath.Join(job.OutputDir, CaptionsDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create captions directory: %w", err)
+	}
+	audio := captionAudioPath(job, vc.captioner)
+	defer os.Remove(audio)
+	args, err := captionAudioArgs(job.MergedFile, vc.captioner.AudioFormat(), audio)
+	if err != nil {
+		return err
+	}
+	output, err := vc.runnerFor(job).Run(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("failed to extract audio for captions: %w", ffmpeg.ParseError(err, output))
+	}
+
+	slog.Info("Generating captions", slog.Int("video_id", job.Task.VideoID), slog.String("captioner", vc.captioner.Name()))
+	transcript := filepath.Join(dir, "transcript.vtt")
+	language, err := vc.captioner.Caption(ctx, audio, job.Task.CaptionLanguage, transcript)
+	if err != nil {
+		os.Remove(transcript)
+		return fmt.Errorf("failed to generate captions: %w", err)
+	}
+	if language == "" {
+		language = "und"
+	}
+	name := path.Join(CaptionsDir, language+".vtt")
+	if err := os.Rename(transcript, filepath.Join(job.OutputDir, filepath.FromSlash(name))); err != nil {
+		return fmt.Errorf("failed to store captions: %v", err)
+	}
+	track := CaptionTrack{Language: language, File: name}
+	job.Captions = append(job.Captions, track)
+	vc.translateCaptions(ctx, job, track)
+	return nil
+}
+
+// captionAudioPath is where the audio transcribed by c is extracted to
+func captionAudioPath(job *Job, c Captioner) string {
+	return filepath.Join(job.Task.Path, "captions."+c.AudioFormat())
+}
+
+// captionAudioArgs are the ffmpeg options extracting the first audio
+// stream of the source, downmixed to 16kHz mono, in the format
+func captionAudioArgs(source, format, output string) ([]string, error) {
+	out := ffmpeg.Output{
+		Maps:    []string{"0:a:0"},
+		NoVideo: true,
+		Options: []string{"-ac", "1", "-ar", "16000"},
+		File:    output,
+	}
+	switch format {
+	case "wav":
+		out.AudioCodec = "pcm_s16le"
+	case "mp3":
+		out.AudioCodec = "libmp3lame"
+		out.Options = append(out.Options, "-b:a", "32k")
+	default:
+		return nil, fmt.Errorf("unsupported captions audio format: %s", format)
+	}
+	return ffmpeg.Command{Overwrite: true, Inputs: []ffmpeg.Input{{File: source}}, Outputs: []ffmpeg.Output{out}}.Args(), nil
+}
+
+// signalCaptions adds the job's caption tracks to its DASH manifest and,
+// when there is one, its HLS master playlist
+func signalCaptions(job *Job) error {
+	if err := addCaptionAdaptationSets(job.Manifest, job.Captions); err != nil {
+		return fmt.Errorf("failed to add captions to the dash manifest: %w", err)
+	}
+	master := filepath.Join(job.OutputDir, "master.m3u8")
+	if _, err := os.Stat(master); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := addSubtitlesGroup(master, job.OutputDir, job.Captions, job.Probe.DurationSeconds()); err != nil {
+		return fmt.Errorf("failed to add captions to the hls playlist: %w", err)
+	}
+	return nil
+}
+
+// addCaptionAdaptationSets adds a text adaptation set per caption track
+// to the last period of the manifest, each a single WebVTT file
+func addCaptionAdaptationSets(manifest string, tracks []CaptionTrack) error {
+	main, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	i := strings.LastIndex(string(main), "</Period>")
+	if i < 0 {
+		return errors.New("no period in the manifest")
+	}
+
+	var sets strings.Builder
+	for _, track := range tracks {
+		id := "captions-" + track.Language
+		fmt.Fprintf(&sets, "\t<AdaptationSet id=\"%s\" contentType=\"text\" mimeType=\"text/vtt\" lang=\"%s\">\n", id, track.Language)
+		sets.WriteString("\t\t\t<Role schemeIdUri=\"urn:mpeg:dash:role:2011\" value=\"subtitle\"/>\n")
+		fmt.Fprintf(&sets, "\t\t\t<Representation id=\"%s\" bandwidth=\"256\">\n", id)
+		fmt.Fprintf(&sets, "\t\t\t\t<BaseURL>%s</BaseURL>\n", track.File)
+		sets.WriteString("\t\t\t</Representation>\n\t\t</AdaptationSet>\n\t")
+	}
+	updated := string(main[:i]) + sets.String() + string(main[i:])
+	return os.WriteFile(manifest, []byte(updated), 0o644)
+}
+
+// addSubtitlesGroup writes a media playlist per caption track, holding the
+// whole WebVTT file as a single segment, and adds them to the master
+// playlist as a subtitles group of every variant stream
+func addSubtitlesGroup(master, outputDir string, tracks []CaptionTrack, duration float64) error {
+	main, err := os.ReadFile(master)
+	if err != nil {
+		return err
+	}
+
+	var media []string
+	for i, track := range tracks {
+		playlist := strings.TrimSuffix(track.File, ".vtt") + ".m3u8"
+		body := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+			int(math.Ceil(duration)), duration, path.Base(track.File))
+		if err := os.WriteFile(filepath.Join(outputDir, filepath.FromSlash(playlist)), []byte(body), 0o644); err != nil {
+			return err
+		}
+		isDefault := "NO"
+		if i == 0 {
+			isDefault = "YES"
+		}
+		media = append(media, fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="%s",LANGUAGE="%s",DEFAULT=%s,AUTOSELECT=YES,URI="%s"`,
+			track.Language, track.Language, isDefault, playlist))
+	}
+
+	var lines []string
+	added := false
+	for _, line := range strings.Split(strings.TrimRight(string(main), "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			if !added {
+				lines = append(lines, media...)
+				added = true
+			}
+			line += `,SUBTITLES="subs"`
+		}
+		lines = append(lines, line)
+	}
+	if !added {
+		return errors.New("no variant stream in the master playlist")
+	}
+	return os.WriteFile(master, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+}
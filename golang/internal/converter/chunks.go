@@ -0,0 +1,83 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	// ErrNoChunks is returned when a task's directory contains no chunks to merge
+	ErrNoChunks = errors.New("no chunks found")
+	// ErrMergedTooSmall is returned when the merged file is smaller than the configured minimum
+	ErrMergedTooSmall = errors.New("merged file is too small")
+)
+
+// DefaultMinMergedSize is the smallest merged file considered a plausible video
+const DefaultMinMergedSize = 1024
+
+// ChunkOrder controls how chunk files are ordered before merging
+type ChunkOrder string
+
+const (
+	// ChunkOrderNumeric sorts by the number in the file name (1.chunk, 2.chunk, 10.chunk)
+	ChunkOrderNumeric ChunkOrder = "numeric"
+	// ChunkOrderLexical sorts by file name, for zero-padded names (part-0001, part-0002)
+	ChunkOrderLexical ChunkOrder = "lexical"
+)
+
+// ChunkLayout describes how an uploader names the chunks of a video
+type ChunkLayout struct {
+	Pattern string     `json:"chunk_pattern,omitempty"` // glob relative to the task path, e.g. "part-*.bin"
+	Order   ChunkOrder `json:"chunk_order,omitempty"`
+}
+
+// DefaultChunkLayout matches the "{n}.chunk" files written by the Django uploader
+var DefaultChunkLayout = ChunkLayout{Pattern: "*.chunk", Order: ChunkOrderNumeric}
+
+// findChunks returns the chunk files of the task in merge order. An explicit
+// list in the task wins over the upload manifest, which wins over the glob.
+func (vc *VideoConverter) findChunks(task *VideoTask) ([]string, *UploadManifest, error) {
+	if len(task.Chunks) > 0 {
+		chunks := make([]string, len(task.Chunks))
+		for i, name := range task.Chunks {
+			chunks[i] = filepath.Join(task.Path, filepath.Clean("/"+name))
+		}
+		return chunks, nil, nil
+	}
+
+	manifest, err := ReadManifest(task.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest != nil {
+		chunks, err := manifest.chunkPaths(task.Path)
+		return chunks, manifest, err
+	}
+
+	layout := vc.chunkLayout
+	if task.ChunkLayout.Pattern != "" {
+		layout.Pattern = task.ChunkLayout.Pattern
+	}
+	if task.ChunkLayout.Order != "" {
+		layout.Order = task.ChunkLayout.Order
+	}
+
+	chunks, err := filepath.Glob(filepath.Join(task.Path, layout.Pattern))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find chunks: %v", err)
+	}
+
+	switch layout.Order {
+	case ChunkOrderLexical:
+		sort.Strings(chunks)
+	case ChunkOrderNumeric, "":
+		sort.Slice(chunks, func(i, j int) bool {
+			return vc.extractNumber(chunks[i]) < vc.extractNumber(chunks[j])
+		})
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown chunk order: %s", ErrInvalidTask, layout.Order)
+	}
+	return chunks, nil, nil
+}
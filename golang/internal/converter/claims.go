@@ -0,0 +1,146 @@
+package converter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+const (
+	// claimTTL is how long a claim outlives a worker that stopped renewing
+	// it, e.g. because it died mid-encode
+	claimTTL = 2 * time.Minute
+	// claimRenewal is how often a claim is renewed while the task runs
+	claimRenewal = claimTTL / 3
+	// DuplicateRetryDelay is how long a duplicate of a task being converted
+	// waits before it is handed out again
+	DuplicateRetryDelay = 30 * time.Second
+)
+
+// ErrTaskClaimed is returned for a task whose folder another delivery is
+// converting right now
+var ErrTaskClaimed = errors.New("task is being converted by another delivery")
+
+// claimKey identifies what two deliveries must not convert at the same
+// time: the folder ffmpeg reads and writes
+func claimKey(task VideoTask) string {
+	return filepath.Clean(task.Path)
+}
+
+// claimTasks claims the task's folder for the rest of the chain. A
+// duplicate delivered while the first copy is still converting, e.g.
+// requeued after a consumer lost its connection, is deferred instead of
+// running a second ffmpeg on the same files; once the first copy is done,
+// SkipProcessed acknowledges it.
+func (vc *VideoConverter) claimTasks(next Handler) Handler {
+	return func(ctx context.Context, msg []byte) Result {
+		var task VideoTask
+		if err := json.Unmarshal(msg, &task); err != nil || task.Path == "" || task.DryRun || vc.dryRun {
+			return next(ctx, msg)
+		}
+
+		key := claimKey(task)
+		owner := newClaimOwner()
+		claimed, err := vc.repo.ClaimTask(ctx, key, owner, claimTTL)
+		if err != nil {
+			return Retry(fmt.Errorf("failed to claim task: %w", err))
+		}
+		if !claimed {
+			slog.Warn("Task already being converted, deferring duplicate",
+				slog.Int("video_id", task.VideoID),
+				slog.String("path", key),
+				slog.Duration("delay", DuplicateRetryDelay))
+			return Defer(fmt.Errorf("%w: %s", ErrTaskClaimed, key), DuplicateRetryDelay)
+		}
+
+		done := make(chan struct{})
+		go vc.renewClaim(key, owner, done)
+		defer func() {
+			close(done)
+			if err := vc.repo.ReleaseClaim(context.WithoutCancel(ctx), key, owner); err != nil {
+				slog.Error("Error releasing task claim", slog.String("path", key), slog.String("error", err.Error()))
+			}
+		}()
+		return next(ctx, msg)
+	}
+}
+
+// renewClaim keeps the claim alive until done is closed. A claim that
+// can't be renewed expires after claimTTL and lets a duplicate in.
+func (vc *VideoConverter) renewClaim(key, owner string, done <-chan struct{}) {
+	ticker := time.NewTicker(claimRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := vc.repo.RenewClaim(context.Background(), key, owner, claimTTL); err != nil {
+				slog.Warn("Error renewing task claim", slog.String("path", key), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// newClaimOwner returns a token identifying one delivery's claim
+func newClaimOwner() string {
+	token := make([]byte, 8)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// ClaimTask records that owner converts the task with the key until ttl
+// passes, unless another owner's claim hasn't expired yet. Expired claims
+// are cleared first; the primary key settles two workers racing for the
+// same key.
+func ClaimTask(ctx context.Context, db *database.DB, key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	var claimed bool
+	err := database.Retry(ctx, func() error {
+		if _, err := db.ExecContext(ctx, db.Rebind("DELETE FROM job_claims WHERE claim_key = ? AND expires_at < ?"), key, now); err != nil {
+			return err
+		}
+		insert := db.Rebind("INSERT INTO job_claims (claim_key, owner, claimed_at, expires_at) VALUES (?, ?, ?, ?)")
+		_, insertErr := db.ExecContext(ctx, insert, key, owner, now, now.Add(ttl))
+		if insertErr == nil {
+			claimed = true
+			return nil
+		}
+		// The insert failed either because the key is taken or for some
+		// other reason, which the claim's absence tells apart
+		var holder string
+		err := db.QueryRowContext(ctx, db.Rebind("SELECT owner FROM job_claims WHERE claim_key = ?"), key).Scan(&holder)
+		if err != nil {
+			return insertErr
+		}
+		claimed = holder == owner
+		return nil
+	})
+	return claimed, err
+}
+
+// RenewClaim extends owner's claim by ttl
+func RenewClaim(ctx context.Context, db *database.DB, key, owner string, ttl time.Duration) error {
+	query := db.Rebind("UPDATE job_claims SET expires_at = ? WHERE claim_key = ? AND owner = ?")
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, query, time.Now().Add(ttl), key, owner)
+		return err
+	})
+}
+
+// ReleaseClaim removes owner's claim
+func ReleaseClaim(ctx context.Context, db *database.DB, key, owner string) error {
+	query := db.Rebind("DELETE FROM job_claims WHERE claim_key = ? AND owner = ?")
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, query, key, owner)
+		return err
+	})
+}
@@ -0,0 +1,141 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// vmafScorePattern matches the pooled score libvmaf logs once done
+var vmafScorePattern = regexp.MustCompile(`VMAF score[:=]\s*([0-9.]+)`)
+
+// EncodeResult is how one profile encoded the source of a comparison
+type EncodeResult struct {
+	Profile string `json:"profile"`
+	File    string `json:"file"`
+	Bytes   int64  `json:"bytes"`
+	// Bitrate is the average over the source's duration, in bits per second
+	Bitrate       int64   `json:"bitrate"`
+	EncodeSeconds float64 `json:"encode_seconds"`
+	// VMAF is the mean score, from 0 to 100, against the source
+	VMAF float64 `json:"vmaf"`
+}
+
+// Comparison is the report of encoding the same source with two profiles,
+// for tuning a profile against the one it would replace. Deltas are B
+// relative to A: a negative BitrateDelta with a VMAFDelta near zero means
+// B saves bits at the same quality.
+type Comparison struct {
+	Source   string       `json:"source"`
+	Duration float64      `json:"duration_seconds"`
+	A        EncodeResult `json:"a"`
+	B        EncodeResult `json:"b"`
+	// BitrateDelta is the change in bitrate, in percent
+	BitrateDelta float64 `json:"bitrate_delta_percent"`
+	// VMAFDelta is the change in VMAF score, in points
+	VMAFDelta float64 `json:"vmaf_delta"`
+	// SpeedDelta is the change in encode time, in percent
+	SpeedDelta float64 `json:"encode_time_delta_percent"`
+}
+
+// CompareProfiles encodes source with profiles a and b into dir, as MP4
+// with the renditions' codec options, and scores each against the source
+// with VMAF, which needs an ffmpeg built with libvmaf. VMAF pairs frames
+// in order, so profiles capping the frame rate of the source score low.
+func CompareProfiles(ctx context.Context, runner ffmpeg.Runner, source string, a, b Profile, dir string) (*Comparison, error) {
+	probe, err := runner.Probe(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe source: %w", err)
+	}
+	video := probe.VideoStream()
+	if video == nil {
+		return nil, fmt.Errorf("%s has no video to compare", source)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	c := &Comparison{Source: source, Duration: probe.DurationSeconds()}
+	for _, side := range []struct {
+		profile Profile
+		result  *EncodeResult
+	}{{a, &c.A}, {b, &c.B}} {
+		result, err := compareEncode(ctx, runner, probe, source, side.profile, dir)
+		if err != nil {
+			return nil, err
+		}
+		*side.result = result
+	}
+	if c.A.Bitrate > 0 {
+		c.BitrateDelta = roundMillis(float64(c.B.Bitrate-c.A.Bitrate) / float64(c.A.Bitrate) * 100)
+	}
+	if c.A.EncodeSeconds > 0 {
+		c.SpeedDelta = roundMillis((c.B.EncodeSeconds - c.A.EncodeSeconds) / c.A.EncodeSeconds * 100)
+	}
+	c.VMAFDelta = roundMillis(c.B.VMAF - c.A.VMAF)
+	return c, nil
+}
+
+// compareEncode encodes the source with the profile and scores the result
+func compareEncode(ctx context.Context, runner ffmpeg.Runner, probe *ffmpeg.ProbeResult, source string, profile Profile, dir string) (EncodeResult, error) {
+	result := EncodeResult{Profile: profile.Name, File: filepath.Join(dir, profile.Name+".mp4")}
+	slog.Info("Encoding for comparison", slog.String("profile", profile.Name), slog.String("path", result.File))
+	started := time.Now()
+	output, err := runner.Run(ctx, compareEncodeArgs(source, codecArgs(probe, profile), result.File)...)
+	if err != nil {
+		return result, fmt.Errorf("failed to encode with %s: %w", profile.Name, ffmpeg.ParseError(err, output))
+	}
+	result.EncodeSeconds = roundMillis(time.Since(started).Seconds())
+	info, err := os.Stat(result.File)
+	if err != nil {
+		return result, err
+	}
+	result.Bytes = info.Size()
+	if duration := probe.DurationSeconds(); duration > 0 {
+		result.Bitrate = int64(float64(result.Bytes*8) / duration)
+	}
+
+	video := probe.VideoStream()
+	output, err = runner.Run(ctx, vmafArgs(result.File, source, video.Width, video.Height)...)
+	if err != nil {
+		return result, fmt.Errorf("failed to score %s with vmaf: %w", profile.Name, ffmpeg.ParseError(err, output))
+	}
+	m := vmafScorePattern.FindSubmatch(output)
+	if m == nil {
+		return result, fmt.Errorf("no vmaf score in the ffmpeg output for %s", profile.Name)
+	}
+	result.VMAF, _ = strconv.ParseFloat(string(m[1]), 64)
+	return result, nil
+}
+
+// compareEncodeArgs are the ffmpeg options encoding the source's first
+// video and audio streams with the codec options into an MP4
+func compareEncodeArgs(source string, codec []string, output string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:    []string{"0:v:0", "0:a:0?"},
+			Options: codec,
+			Format:  "mp4",
+			File:    output,
+		}},
+	}.Args()
+}
+
+// vmafArgs are the ffmpeg options scoring the encode against the source,
+// scaled back to the source's size as VMAF compares frames pixel by pixel
+func vmafArgs(encoded, source string, width, height int) []string {
+	graph := fmt.Sprintf("[0:v]scale=%d:%d:flags=bicubic,setsar=1[distorted];[1:v]setsar=1[reference];[distorted][reference]libvmaf", width, height)
+	return ffmpeg.Command{
+		Inputs:  []ffmpeg.Input{{File: encoded}, {File: source}},
+		Outputs: []ffmpeg.Output{{Options: []string{"-lavfi", graph}, Format: "null", File: "-"}},
+	}.Args()
+}
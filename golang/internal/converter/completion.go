@@ -0,0 +1,177 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// CompletionEvent is published once a video has been converted successfully
+type CompletionEvent struct {
+	VideoID      int        `json:"video_id"`
+	Status       string     `json:"status"`
+	Mode         string     `json:"mode"`
+	ManifestKey  string     `json:"manifest_key,omitempty"`
+	ScrubbingKey string     `json:"scrubbing_key,omitempty"` // all-intra proxy for frame-accurate seeking
+	Version      int        `json:"version,omitempty"`
+	DuplicateOf  int        `json:"duplicate_of,omitempty"` // video whose output was reused
+	ManifestURL  string     `json:"manifest_url,omitempty"` // presigned, see WithURLSigner and SegmentsSigned
+	URLExpiresAt *time.Time `json:"url_expires_at,omitempty"`
+	Timings      *Timings   `json:"timings,omitempty"`
+	CompletedAt  time.Time  `json:"completed_at"`
+
+	// SegmentsSigned is set when the manifest at ManifestURL names its
+	// segments by presigned URLs too, expiring at URLExpiresAt, so it plays
+	// from a private bucket. Otherwise only the manifest is signed and its
+	// segments must be public: a duplicate's reused output isn't signed
+	// again, and neither are the HLS and Smooth Streaming manifests.
+	SegmentsSigned bool `json:"segments_signed,omitempty"`
+
+	// CaptionLanguages are the languages of the caption tracks produced,
+	// the transcribed one first
+	CaptionLanguages []string `json:"caption_languages,omitempty"`
+	// Moderation is "flag" for a video published but flagged for review
+	Moderation string `json:"moderation,omitempty"`
+	// ThumbnailKey is the object key of the thumbnail, when one was asked for
+	ThumbnailKey string `json:"thumbnail_key,omitempty"`
+	// StoryboardKey is the object key of the storyboard JSON, when one was
+	// asked for
+	StoryboardKey string `json:"storyboard_key,omitempty"`
+	// Profile is the profile the video was converted with, and CanaryOf
+	// the one the task asked for when a rollout picked a canary instead
+	Profile  string `json:"profile,omitempty"`
+	CanaryOf string `json:"canary_of,omitempty"`
+	// OverBudget is set when a rendition is over the profile's size
+	// budget, as checked for CDN costs
+	OverBudget bool `json:"over_budget,omitempty"`
+	// TorrentKey is the object key of the torrent, when the profile asks
+	// for one
+	TorrentKey string `json:"torrent_key,omitempty"`
+	// SmoothStreamingKey is the object key of the Smooth Streaming client
+	// manifest, when the profile asks for one
+	SmoothStreamingKey string `json:"smooth_streaming_key,omitempty"`
+	// Labels are the task's labels, for consumers routing on them
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Timings are how long the costly stages of a job took, in milliseconds,
+// with the size of its source so producers can relate the two. Stages
+// that were skipped, like the encode of a deduplicated source, are left
+// out.
+type Timings struct {
+	SourceBytes int64 `json:"source_bytes,omitempty"`
+	DownloadMS  int64 `json:"download_ms,omitempty"`
+	MergeMS     int64 `json:"merge_ms,omitempty"`
+	// TranscodeMS is the encoding time by rendition
+	TranscodeMS map[string]int64 `json:"transcode_ms,omitempty"`
+	UploadMS    int64            `json:"upload_ms,omitempty"`
+}
+
+// Publisher delivers completion events to interested parties (webhooks, queues)
+type Publisher interface {
+	Publish(ctx context.Context, event CompletionEvent) error
+}
+
+// Publishers publishes each event with every one of its publishers
+type Publishers []Publisher
+
+// Publish publishes the event with each publisher, even when one fails
+func (ps Publishers) Publish(ctx context.Context, event CompletionEvent) error {
+	var errs []error
+	for _, p := range ps {
+		if err := p.Publish(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// publishCompletion notifies the publishers that the task finished, but
+// for the outbox publishers whose events the record stage stored; failures
+// are only logged
+func (vc *VideoConverter) publishCompletion(ctx context.Context, job *Job) {
+	_, publishers := splitPublisher(vc.publisher)
+	if len(publishers) == 0 {
+		return
+	}
+
+	task := *job.Task
+	err := publishers.Publish(ctx, vc.completionEvent(job))
+	if err != nil {
+		slog.Error("Error publishing completion event", slog.Int("video_id", task.VideoID), slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Completion event published", slog.Int("video_id", task.VideoID))
+}
+
+// completionEvent returns the completion event of the job, built once so
+// the outbox events stored by the record stage and those published by the
+// notify stage are the same
+func (vc *VideoConverter) completionEvent(job *Job) CompletionEvent {
+	if job.completion != nil {
+		return *job.completion
+	}
+
+	task := *job.Task
+	event := CompletionEvent{
+		VideoID:     task.VideoID,
+		Status:      "success",
+		Mode:        job.Mode,
+		Version:     job.Version,
+		DuplicateOf: job.DuplicateOf,
+		Timings:     &job.Timings,
+		CompletedAt: time.Now(),
+		Profile:     profileName(&task),
+		CanaryOf:    job.CanaryOf,
+		OverBudget:  job.OverBudget,
+		Labels:      task.Labels,
+	}
+	if job.Moderation == ModerationFlag {
+		event.Moderation = job.Moderation
+	}
+	for _, track := range job.Captions {
+		event.CaptionLanguages = append(event.CaptionLanguages, track.Language)
+	}
+	if vc.uploader != nil {
+		prefix := job.Prefix
+		if job.DuplicateOf != 0 {
+			prefix = job.DuplicatePrefix
+			event.Version = job.DuplicateVersion
+		}
+		event.ManifestKey = path.Join(prefix, vc.outputLayout.Manifest)
+		if wantsScrubbingProxy(job) {
+			event.ScrubbingKey = path.Join(prefix, ScrubbingProxyName)
+		}
+		if wantsThumbnail(job) {
+			event.ThumbnailKey = path.Join(prefix, ThumbnailName)
+		}
+		if wantsStoryboard(job) {
+			event.StoryboardKey = path.Join(prefix, StoryboardName)
+		}
+		if wantsSmoothStreaming(job) {
+			event.SmoothStreamingKey = path.Join(prefix, SmoothStreamingDir, SmoothStreamingManifest)
+		}
+		if wantsTorrent(job) {
+			event.TorrentKey = path.Join(prefix, TorrentName)
+		}
+		if vc.signer != nil {
+			key, expiresAt := event.ManifestKey, time.Now().Add(vc.signedURLTTL)
+			if !job.segmentsSignedAt.IsZero() {
+				key, expiresAt = signedManifestName(event.ManifestKey), job.segmentsSignedAt.Add(vc.signedURLTTL)
+			}
+			url, err := vc.signer.SignedURL(key, vc.signedURLTTL)
+			if err != nil {
+				slog.Warn("Error signing manifest url", slog.Int("video_id", task.VideoID), slog.String("error", err.Error()))
+			} else {
+				event.ManifestURL = url
+				event.URLExpiresAt = &expiresAt
+				event.SegmentsSigned = !job.segmentsSignedAt.IsZero()
+			}
+		}
+	}
+
+	job.completion = &event
+	return event
+}
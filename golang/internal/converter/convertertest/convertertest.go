@@ -0,0 +1,577 @@
+// Package convertertest provides in-memory fakes of the converter's
+// external dependencies, so the pipeline can be exercised without
+// Postgres, RabbitMQ, cloud storage or ffmpeg
+package convertertest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/ffmpeg"
+)
+
+// Repository is an in-memory converter.Repository
+type Repository struct {
+	mu        sync.Mutex
+	processed map[int]bool
+	errors    []map[string]interface{}
+	sources   []converter.SourceRecord
+	versions  map[int][]int
+	active    map[int]int
+	batches   map[string]map[int]string
+	claims    map[string]claim
+	verdicts  []converter.ModerationVerdict
+	encodes   []converter.EncodeRecord
+	tenants   map[string]converter.TenantSettings
+	outbox    []converter.OutboxEvent
+
+	// Err, when set, is returned by every method
+	Err error
+}
+
+// NewRepository creates an empty Repository
+func NewRepository() *Repository {
+	return &Repository{
+		processed: make(map[int]bool),
+		versions:  make(map[int][]int),
+		active:    make(map[int]int),
+		batches:   make(map[string]map[int]string),
+		claims:    make(map[string]claim),
+		tenants:   make(map[string]converter.TenantSettings),
+	}
+}
+
+func (r *Repository) IsProcessed(ctx context.Context, videoID int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.processed[videoID], r.Err
+}
+
+func (r *Repository) MarkProcessed(ctx context.Context, videoID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.processed[videoID] = true
+	return nil
+}
+
+func (r *Repository) RegisterError(ctx context.Context, errorData map[string]interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.errors = append(r.errors, errorData)
+	return nil
+}
+
+func (r *Repository) FindSource(ctx context.Context, contentHash, profile, profileHash string) (converter.SourceRecord, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return converter.SourceRecord{}, false, r.Err
+	}
+	for _, s := range r.sources {
+		if s.ContentHash == contentHash && s.Profile == profile && s.ProfileHash == profileHash && r.processed[s.VideoID] {
+			return s, true, nil
+		}
+	}
+	return converter.SourceRecord{}, false, nil
+}
+
+func (r *Repository) SaveSource(ctx context.Context, record converter.SourceRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.sources = slices.DeleteFunc(r.sources, func(s converter.SourceRecord) bool {
+		return s.VideoID == record.VideoID
+	})
+	r.sources = append(r.sources, record)
+	return nil
+}
+
+func (r *Repository) LatestVersion(ctx context.Context, videoID int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return 0, r.Err
+	}
+	latest := 0
+	for _, v := range r.versions[videoID] {
+		latest = max(latest, v)
+	}
+	return latest, nil
+}
+
+func (r *Repository) SaveVersion(ctx context.Context, videoID, version int, profile, prefix string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	if !slices.Contains(r.versions[videoID], version) {
+		r.versions[videoID] = append(r.versions[videoID], version)
+	}
+	r.active[videoID] = version
+	return nil
+}
+
+// ActiveVersion returns the active output version of the video, 0 when none
+func (r *Repository) ActiveVersion(videoID int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active[videoID]
+}
+
+func (r *Repository) CreateBatch(ctx context.Context, batchID string, videoIDs []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	tasks := make(map[int]string, len(videoIDs))
+	for _, id := range videoIDs {
+		tasks[id] = converter.BatchTaskPending
+	}
+	r.batches[batchID] = tasks
+	return nil
+}
+
+func (r *Repository) UpdateBatchTask(ctx context.Context, batchID string, videoID int, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	if tasks, ok := r.batches[batchID]; ok {
+		if _, ok := tasks[videoID]; ok {
+			tasks[videoID] = status
+		}
+	}
+	return nil
+}
+
+// claim is a task claim of an owner
+type claim struct {
+	owner   string
+	expires time.Time
+}
+
+func (r *Repository) ClaimTask(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return false, r.Err
+	}
+	if c, ok := r.claims[key]; ok && c.owner != owner && time.Now().Before(c.expires) {
+		return false, nil
+	}
+	r.claims[key] = claim{owner: owner, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (r *Repository) RenewClaim(ctx context.Context, key, owner string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	if c, ok := r.claims[key]; ok && c.owner == owner {
+		r.claims[key] = claim{owner: owner, expires: time.Now().Add(ttl)}
+	}
+	return nil
+}
+
+func (r *Repository) ReleaseClaim(ctx context.Context, key, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	if c, ok := r.claims[key]; ok && c.owner == owner {
+		delete(r.claims, key)
+	}
+	return nil
+}
+
+func (r *Repository) SaveVerdict(ctx context.Context, verdict converter.ModerationVerdict) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.verdicts = append(r.verdicts, verdict)
+	return nil
+}
+
+// Verdicts returns the recorded moderation verdicts, oldest first
+func (r *Repository) Verdicts() []converter.ModerationVerdict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.verdicts)
+}
+
+func (r *Repository) SaveEncodeRecord(ctx context.Context, record converter.EncodeRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.encodes = append(r.encodes, record)
+	return nil
+}
+
+// EncodeRecords returns the recorded encodes, oldest first
+func (r *Repository) EncodeRecords() []converter.EncodeRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.encodes)
+}
+
+func (r *Repository) TenantSettings(ctx context.Context, tenant string) (converter.TenantSettings, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return converter.TenantSettings{}, false, r.Err
+	}
+	settings, ok := r.tenants[tenant]
+	return settings, ok, nil
+}
+
+// SetTenantSettings stores the settings of a tenant
+func (r *Repository) SetTenantSettings(settings converter.TenantSettings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants[settings.Tenant] = settings
+}
+
+func (r *Repository) RecordConversion(ctx context.Context, c converter.Conversion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	if v := c.Version; v != nil {
+		if !slices.Contains(r.versions[c.VideoID], v.Version) {
+			r.versions[c.VideoID] = append(r.versions[c.VideoID], v.Version)
+		}
+		r.active[c.VideoID] = v.Version
+	}
+	if c.Encode != nil {
+		r.encodes = append(r.encodes, *c.Encode)
+	}
+	if c.Source != nil {
+		r.sources = slices.DeleteFunc(r.sources, func(s converter.SourceRecord) bool {
+			return s.VideoID == c.VideoID
+		})
+		r.sources = append(r.sources, *c.Source)
+	}
+	r.processed[c.VideoID] = true
+	for _, event := range c.Events {
+		if !slices.ContainsFunc(r.outbox, func(e converter.OutboxEvent) bool { return e.EventID == event.EventID }) {
+			r.outbox = append(r.outbox, event)
+		}
+	}
+	return nil
+}
+
+// OutboxEvents returns the events added to the outbox, oldest first
+func (r *Repository) OutboxEvents() []converter.OutboxEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.outbox)
+}
+
+// BatchStatus returns the status of each task of the batch by video id
+func (r *Repository) BatchStatus(batchID string) map[int]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := make(map[int]string)
+	for id, s := range r.batches[batchID] {
+		status[id] = s
+	}
+	return status
+}
+
+// Errors returns the registered errors, oldest first
+func (r *Repository) Errors() []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]interface{}(nil), r.errors...)
+}
+
+// Publisher records the completion events it receives
+type Publisher struct {
+	mu     sync.Mutex
+	events []converter.CompletionEvent
+
+	// Err, when set, is returned by Publish
+	Err error
+}
+
+func (p *Publisher) Publish(ctx context.Context, event converter.CompletionEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return p.Err
+	}
+	p.events = append(p.events, event)
+	return nil
+}
+
+// Events returns the published events, oldest first
+func (p *Publisher) Events() []converter.CompletionEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]converter.CompletionEvent(nil), p.events...)
+}
+
+// Uploader stores uploaded files in memory
+type Uploader struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+
+	// Err, when set, is returned by Upload
+	Err error
+}
+
+// NewUploader creates an empty Uploader
+func NewUploader() *Uploader {
+	return &Uploader{objects: make(map[string][]byte)}
+}
+
+func (u *Uploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	if u.Err != nil {
+		return u.Err
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.objects[objectKey] = data
+	return nil
+}
+
+// Object returns an uploaded object
+func (u *Uploader) Object(key string) ([]byte, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	data, ok := u.objects[key]
+	return data, ok
+}
+
+// Keys returns the uploaded object keys, sorted
+func (u *Uploader) Keys() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	keys := make([]string, 0, len(u.objects))
+	for k := range u.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// outputExtensions are the files the fake ffmpeg creates when they appear as outputs
+var outputExtensions = []string{".mpd", ".m3u8", ".mp3", ".mp4"}
+
+// Runner is a fake ffmpeg.Runner: it records ffmpeg calls, creates small
+// placeholder output files and answers probes with ProbeResult
+type Runner struct {
+	mu    sync.Mutex
+	calls [][]string
+
+	// ProbeResult is returned by Probe, H.264/AAC in MP4 when nil
+	ProbeResult *ffmpeg.ProbeResult
+	// ProbeErr and RunErr, when set, fail the corresponding calls
+	ProbeErr error
+	RunErr   error
+}
+
+func (r *Runner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string(nil), args...))
+	r.mu.Unlock()
+	if r.RunErr != nil {
+		return []byte("fake ffmpeg failure"), r.RunErr
+	}
+
+	for i, arg := range args {
+		if i > 0 && args[i-1] == "-i" {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(arg))
+		if !slices.Contains(outputExtensions, ext) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(arg), os.ModePerm); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(arg, []byte("fake "+ext+" output"), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (r *Runner) Probe(ctx context.Context, file string) (*ffmpeg.ProbeResult, error) {
+	if r.ProbeErr != nil {
+		return nil, r.ProbeErr
+	}
+	if r.ProbeResult != nil {
+		return r.ProbeResult, nil
+	}
+	return &ffmpeg.ProbeResult{
+		Format: ffmpeg.Format{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: "10.0", Tags: map[string]string{"major_brand": "isom"}},
+		Streams: []ffmpeg.Stream{
+			{Index: 0, CodecType: "video", CodecName: "h264", Width: 1280, Height: 720, PixFmt: "yuv420p"},
+			{Index: 1, CodecType: "audio", CodecName: "aac"},
+		},
+	}, nil
+}
+
+// Calls returns the argument lists of every ffmpeg run
+func (r *Runner) Calls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.calls...)
+}
+
+// Queue is a fake consumer: tasks enqueued on it are handed to a handler
+// by Drain, which settles them like the RabbitMQ consumer would
+type Queue struct {
+	mu       sync.Mutex
+	pending  [][]byte
+	acked    [][]byte
+	dead     [][]byte
+	requeued int
+}
+
+// Enqueue adds a task; Queue satisfies ingest.Enqueuer
+func (q *Queue) Enqueue(task converter.VideoTask) error {
+	msg, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	q.Publish(msg)
+	return nil
+}
+
+// Publish adds a raw message
+func (q *Queue) Publish(msg []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, msg)
+}
+
+// Drain handles messages until the queue is empty or maxDeliveries
+// messages were handled; retried messages go back to the end of the queue
+func (q *Queue) Drain(handle converter.Handler, maxDeliveries int) int {
+	handled := 0
+	for handled < maxDeliveries {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			break
+		}
+		msg := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		result := handle(context.Background(), msg)
+		handled++
+
+		q.mu.Lock()
+		switch result.Outcome {
+		case converter.OutcomeSuccess:
+			q.acked = append(q.acked, msg)
+		case converter.OutcomeRetry:
+			q.requeued++
+			q.pending = append(q.pending, msg)
+		default:
+			q.dead = append(q.dead, msg)
+		}
+		q.mu.Unlock()
+	}
+	return handled
+}
+
+// Stats returns how many messages are pending, acked, dead-lettered and were requeued
+func (q *Queue) Stats() (pending, acked, deadLettered, requeued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), len(q.acked), len(q.dead), q.requeued
+}
+
+// Env bundles a fake of every dependency
+type Env struct {
+	Repository *Repository
+	Publisher  *Publisher
+	Uploader   *Uploader
+	Runner     *Runner
+	Queue      *Queue
+}
+
+// NewEnv creates a set of fakes
+func NewEnv() *Env {
+	return &Env{
+		Repository: NewRepository(),
+		Publisher:  &Publisher{},
+		Uploader:   NewUploader(),
+		Runner:     &Runner{},
+		Queue:      &Queue{},
+	}
+}
+
+// Converter creates a VideoConverter wired to the fakes; opts are applied after them
+func (e *Env) Converter(opts ...converter.Option) *converter.VideoConverter {
+	base := []converter.Option{
+		converter.WithRepository(e.Repository),
+		converter.WithPublisher(e.Publisher),
+		converter.WithUploader(e.Uploader),
+		converter.WithRunner(e.Runner),
+	}
+	return converter.NewVideoConverter(nil, append(base, opts...)...)
+}
+
+// WriteChunks splits data into chunkSize pieces named like the Django app
+// does ({i}.chunk) in a new directory below dir, returning the directory
+func WriteChunks(dir string, videoID int, data []byte, chunkSize int) (string, error) {
+	videoDir := filepath.Join(dir, fmt.Sprint(videoID))
+	if err := os.MkdirAll(videoDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	r := bytes.NewReader(data)
+	buf := make([]byte, chunkSize)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := os.WriteFile(filepath.Join(videoDir, fmt.Sprintf("%d.chunk", i)), buf[:n], 0o644); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return videoDir, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
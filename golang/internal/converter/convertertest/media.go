@@ -0,0 +1,104 @@
+package convertertest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// MediaOptions describes a synthetic test video
+type MediaOptions struct {
+	// Duration in seconds, 2 when zero
+	Duration float64
+	// Width and Height, 320x240 when zero
+	Width, Height int
+	// FPS, 25 when zero
+	FPS int
+	// NoAudio leaves out the sine tone; NoVideo makes an audio-only file
+	NoAudio bool
+	NoVideo bool
+	// VideoCodec and AudioCodec default to libx264 and aac
+	VideoCodec string
+	AudioCodec string
+}
+
+func (o MediaOptions) withDefaults() MediaOptions {
+	if o.Duration <= 0 {
+		o.Duration = 2
+	}
+	if o.Width <= 0 || o.Height <= 0 {
+		o.Width, o.Height = 320, 240
+	}
+	if o.FPS <= 0 {
+		o.FPS = 25
+	}
+	if o.VideoCodec == "" {
+		o.VideoCodec = "libx264"
+	}
+	if o.AudioCodec == "" {
+		o.AudioCodec = "aac"
+	}
+	return o
+}
+
+// GenerateMedia writes a synthetic video using ffmpeg's testsrc and sine
+// sources; the container follows the output extension
+func GenerateMedia(ctx context.Context, output string, opts MediaOptions) error {
+	opts = opts.withDefaults()
+	if opts.NoVideo && opts.NoAudio {
+		return fmt.Errorf("media needs a video or an audio stream")
+	}
+	duration := strconv.FormatFloat(opts.Duration, 'f', -1, 64)
+
+	args := []string{"-y"}
+	if !opts.NoVideo {
+		args = append(args, "-f", "lavfi", "-i",
+			fmt.Sprintf("testsrc=duration=%s:size=%dx%d:rate=%d", duration, opts.Width, opts.Height, opts.FPS))
+	}
+	if !opts.NoAudio {
+		args = append(args, "-f", "lavfi", "-i", fmt.Sprintf("sine=duration=%s:frequency=440", duration))
+	}
+	if !opts.NoVideo {
+		args = append(args, "-c:v", opts.VideoCodec, "-pix_fmt", "yuv420p")
+	}
+	if !opts.NoAudio {
+		args = append(args, "-c:a", opts.AudioCodec)
+	}
+	args = append(args, "-shortest", output)
+
+	if err := os.MkdirAll(filepath.Dir(output), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to generate media: %w: %s", err, out)
+	}
+	return nil
+}
+
+// GenerateChunks generates a synthetic video and slices it into chunkSize
+// chunks in dir/{videoID}, like an upload from the Django app, returning
+// the chunk directory
+func GenerateChunks(ctx context.Context, dir string, videoID int, opts MediaOptions, chunkSize int) (string, error) {
+	tmp, err := os.MkdirTemp("", "convertertest-media")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	source := filepath.Join(tmp, "source.mp4")
+	if opts.NoVideo {
+		source = filepath.Join(tmp, "source.m4a")
+	}
+	if err := GenerateMedia(ctx, source, opts); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+	return WriteChunks(dir, videoID, data, chunkSize)
+}
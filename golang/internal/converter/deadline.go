@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"imersaofc/internal/events"
+)
+
+// skipExpired acknowledges tasks picked up after their deadline without
+// converting them, see Expire
+func (vc *VideoConverter) skipExpired(next Handler) Handler {
+	return func(ctx context.Context, msg []byte) Result {
+		var task VideoTask
+		if err := json.Unmarshal(msg, &task); err != nil || task.Deadline == nil || task.DryRun {
+			return next(ctx, msg)
+		}
+		if time.Now().Before(*task.Deadline) {
+			return next(ctx, msg)
+		}
+		return vc.Expire(msg, *task.Deadline)
+	}
+}
+
+// Expire records that the task of msg was picked up after its deadline and
+// won't be converted: the job is marked expired, as is its batch task, and
+// a TaskExpired event is published. Transports that carry the deadline out
+// of the message, such as an AMQP header, call it instead of Handle.
+func (vc *VideoConverter) Expire(msg []byte, deadline time.Time) Result {
+	var task VideoTask
+	json.Unmarshal(msg, &task)
+	slog.Warn("Task expired, skipping",
+		slog.Int("video_id", task.VideoID),
+		slog.Time("deadline", deadline),
+		slog.Duration("late_by", time.Since(deadline)))
+
+	if task.BatchID != "" {
+		if err := vc.repo.UpdateBatchTask(context.Background(), task.BatchID, task.VideoID, BatchTaskExpired); err != nil {
+			slog.Error("Error updating batch progress",
+				slog.String("batch_id", task.BatchID),
+				slog.Int("video_id", task.VideoID),
+				slog.String("error", err.Error()))
+		}
+	}
+	vc.events.Publish(events.TaskExpired{VideoID: task.VideoID, Deadline: deadline, At: time.Now()})
+	return Success()
+}
@@ -0,0 +1,159 @@
+package converter
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// SourceRecord ties a video to the hash of its merged source and to the
+// video and output version it plays, itself unless the output was reused
+type SourceRecord struct {
+	VideoID       int
+	ContentHash   string
+	Profile       string
+	OutputVideoID int
+	OutputVersion int
+
+	// ProfileHash is the outputFingerprint of the conversion, so editing
+	// a profile stops its earlier outputs from being reused
+	ProfileHash string
+	// OutputPrefix is where the output was uploaded, which the tenant's
+	// storage prefix may have moved since; empty in records from before
+	// it was stored
+	OutputPrefix string
+}
+
+// dedupStage reuses the uploaded output of an identical source converted
+// with the same profile settings and output options, so re-uploads of a
+// file, such as the same course intro published again, aren't encoded
+// again. It only applies with remote storage: local output lives in each
+// task's own directory, so there would be nothing to point the video at.
+// Reprocessing always encodes again.
+func (vc *VideoConverter) dedupStage(ctx context.Context, job *Job) error {
+	if vc.uploader == nil || job.SourceHash == "" || job.Task.Reprocess || redacts(job.Task) {
+		return nil
+	}
+	fingerprint, err := vc.outputFingerprint(job)
+	if err != nil {
+		return err
+	}
+	source, found, err := vc.repo.FindSource(ctx, job.SourceHash, profileName(job.Task), fingerprint)
+	if err != nil {
+		return fmt.Errorf("failed to look up source hash: %w", err)
+	}
+	if !found || source.OutputVideoID == job.Task.VideoID {
+		return nil
+	}
+	slog.Info("Identical source already converted, reusing its output",
+		slog.Int("video_id", job.Task.VideoID),
+		slog.Int("output_video_id", source.OutputVideoID),
+		slog.Int("output_version", source.OutputVersion),
+		slog.String("sha256", job.SourceHash))
+	job.DuplicateOf = source.OutputVideoID
+	job.DuplicateVersion = source.OutputVersion
+	job.DuplicatePrefix = source.OutputPrefix
+	if job.DuplicatePrefix == "" {
+		// Recorded before tenants, whose prefixes were the layout's
+		job.DuplicatePrefix = vc.outputLayout.prefix(job.Task, source.OutputVideoID, source.OutputVersion)
+	}
+	return nil
+}
+
+// outputFingerprint is the hex sha256 of everything besides the source
+// shaping a task's output: the settings of its profile, its output options
+// and whether the source's metadata is kept. It includes the tenant, so a
+// tenant's outputs are never reused for another one.
+func (vc *VideoConverter) outputFingerprint(job *Job) (string, error) {
+	task := job.Task
+	profile, err := vc.profile(task)
+	if err != nil {
+		return "", err
+	}
+	profile = job.Tenant.override(profile)
+	data, err := json.Marshal(struct {
+		// Tenant is omitted when empty, keeping the fingerprints recorded
+		// before tenants were
+		Tenant              string          `json:"tenant,omitempty"`
+		Profile             Profile         `json:"profile"`
+		ScrubbingProxy      bool            `json:"scrubbing_proxy"`
+		TrickPlay           bool            `json:"trick_play"`
+		AdBreaks            []AdBreak       `json:"ad_breaks"`
+		MultiPeriod         bool            `json:"multi_period"`
+		Captions            bool            `json:"captions"`
+		CaptionLanguage     string          `json:"caption_language"`
+		CaptionTranslations []string        `json:"caption_translations"`
+		Thumbnail           string          `json:"thumbnail"`
+		Storyboard          bool            `json:"storyboard"`
+		Metadata            *OutputMetadata `json:"metadata"`
+		KeepMetadata        bool            `json:"keep_metadata"`
+	}{
+		Tenant:              task.Tenant,
+		Profile:             profile,
+		ScrubbingProxy:      task.ScrubbingProxy,
+		TrickPlay:           task.TrickPlay,
+		AdBreaks:            task.AdBreaks,
+		MultiPeriod:         task.MultiPeriod,
+		Captions:            task.Captions,
+		CaptionLanguage:     task.CaptionLanguage,
+		CaptionTranslations: task.CaptionTranslations,
+		Thumbnail:           task.Thumbnail,
+		Storyboard:          task.Storyboard,
+		Metadata:            task.outputMetadata(),
+		KeepMetadata:        vc.keepMetadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// FindSource returns the record of a successfully processed video whose
+// source had the hash and was converted with the profile, as fingerprinted
+// by profileHash
+func FindSource(ctx context.Context, db *database.DB, contentHash, profile, profileHash string) (SourceRecord, bool, error) {
+	var record SourceRecord
+	query := db.Rebind(`SELECT s.video_id, s.content_hash, s.profile, s.output_video_id, s.output_version, s.profile_hash, s.output_prefix FROM video_sources s
+		JOIN processed_videos p ON p.video_id = s.video_id AND p.status = 'success'
+		WHERE s.content_hash = ? AND s.profile = ? AND s.profile_hash = ?
+		ORDER BY s.created_at LIMIT 1`)
+	err := database.Retry(ctx, func() error {
+		return db.QueryRowContext(ctx, query, contentHash, profile, profileHash).Scan(
+			&record.VideoID, &record.ContentHash, &record.Profile, &record.OutputVideoID, &record.OutputVersion, &record.ProfileHash, &record.OutputPrefix)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+// SaveSource records the source of a video, replacing an earlier record
+// when the video is converted again
+func SaveSource(ctx context.Context, db *database.DB, record SourceRecord) error {
+	return database.Retry(ctx, func() error {
+		return saveSource(ctx, db, db, record)
+	})
+}
+
+// saveSource records the source of a video with q, the pool or a transaction
+func saveSource(ctx context.Context, db *database.DB, q querier, record SourceRecord) error {
+	del := db.Rebind("DELETE FROM video_sources WHERE video_id = ?")
+	ins := db.Rebind("INSERT INTO video_sources (video_id, content_hash, profile, output_video_id, output_version, profile_hash, output_prefix, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if _, err := q.ExecContext(ctx, del, record.VideoID); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, ins, record.VideoID, record.ContentHash, record.Profile, record.OutputVideoID, record.OutputVersion, record.ProfileHash, record.OutputPrefix, time.Now())
+	return err
+}
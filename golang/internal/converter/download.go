@@ -0,0 +1,407 @@
+package converter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDownloadRejected is returned when the source server refuses the
+	// download for good, e.g. with a 404 or a 403
+	ErrDownloadRejected = errors.New("source download rejected")
+	// ErrChecksumMismatch is returned when a downloaded source doesn't
+	// match the task's checksum; the download starts over on the next try
+	ErrChecksumMismatch = errors.New("source checksum mismatch")
+)
+
+// DownloadPolicy configures the download of sources given by URL
+type DownloadPolicy struct {
+	// Dir holds the work folder, {dir}/{video_id}, of tasks without a path
+	Dir string
+	// RateLimit caps the download speed in bytes per second; zero doesn't
+	// limit it
+	RateLimit int64
+	// Client downloads HTTP(S) sources, defaultDownloadClient when nil
+	Client *http.Client
+}
+
+// WithDownloads sets how sources given by URL are downloaded
+func WithDownloads(policy DownloadPolicy) Option {
+	return func(vc *VideoConverter) {
+		vc.downloads = policy
+	}
+}
+
+// defaultDownloadClient has no overall timeout, since sources can take long
+// to download, but gives up on servers that don't answer
+var defaultDownloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// redactURL drops the query of a source URL, which often holds a signature,
+// before it is logged
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid url"
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
+
+// downloadDir returns the work folder of a task downloading its source
+func (vc *VideoConverter) downloadDir(task *VideoTask) (string, error) {
+	if task.Path != "" {
+		return task.Path, nil
+	}
+	if vc.downloads.Dir == "" {
+		return "", fmt.Errorf("%w: source_url task without a path, and no download dir is configured", ErrInvalidTask)
+	}
+	return filepath.Join(vc.downloads.Dir, strconv.Itoa(task.VideoID)), nil
+}
+
+// checkSourceURL rejects source URLs without a fetcher for their scheme
+func (vc *VideoConverter) checkSourceURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%w: invalid source_url", ErrInvalidTask)
+	}
+	if _, ok := vc.fetcherFor(u); !ok {
+		return fmt.Errorf("%w: no fetcher for %s source urls", ErrInvalidTask, u.Scheme)
+	}
+	return nil
+}
+
+// downloadStage downloads the source of a task given by URL in place of
+// the merged file; other tasks pass through
+func (vc *VideoConverter) downloadStage(ctx context.Context, job *Job) error {
+	task := job.Task
+	if sourceType(task) != SourceDownload {
+		return nil
+	}
+	if err := vc.checkSourceURL(task.SourceURL); err != nil {
+		return err
+	}
+	dir, err := vc.downloadDir(task)
+	if err != nil {
+		return err
+	}
+	if task.Path == "" {
+		task.Path = dir
+		job.MergedFile = filepath.Join(dir, "merged")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create download directory: %v", err)
+	}
+
+	slog.Info("Downloading source", slog.Int("video_id", task.VideoID), slog.String("url", redactURL(task.SourceURL)))
+	sum, err := vc.download(ctx, task, job.MergedFile)
+	if err != nil {
+		return err
+	}
+	job.SourceHash = sum
+	return nil
+}
+
+// Fetcher opens sources given by URL for the download stage, see
+// WithFetcher. HTTP(S) is built in.
+type Fetcher interface {
+	// Open returns the source from offset on, when a partial download of
+	// the same version of it can be resumed, or from its start otherwise.
+	// version is the Version of the earlier FetchedSource, empty when
+	// there is none. Errors wrap ErrDownloadRejected when a retry can't
+	// succeed.
+	Open(ctx context.Context, source *url.URL, offset int64, version string) (*FetchedSource, error)
+}
+
+// FetchedSource is an opened source, read from Offset on
+type FetchedSource struct {
+	Body io.ReadCloser
+	// Offset is where Body starts: the requested offset or zero
+	Offset int64
+	// Size is the size of the whole source, -1 when unknown
+	Size int64
+	// Version identifies the content of the source, e.g. an ETag, so a
+	// partial download is only resumed from the same content; empty when
+	// the source can't tell, which disables resuming
+	Version string
+}
+
+// WithFetcher downloads the sources of tasks whose source_url has the
+// scheme, e.g. "ftp", with f
+func WithFetcher(scheme string, f Fetcher) Option {
+	return func(vc *VideoConverter) {
+		if vc.fetchers == nil {
+			vc.fetchers = map[string]Fetcher{}
+		}
+		vc.fetchers[scheme] = f
+	}
+}
+
+// fetcherFor returns the fetcher of the URL's scheme
+func (vc *VideoConverter) fetcherFor(source *url.URL) (Fetcher, bool) {
+	if f, ok := vc.fetchers[source.Scheme]; ok {
+		return f, true
+	}
+	if source.Scheme == "http" || source.Scheme == "https" {
+		return httpFetcher{client: vc.downloads.Client}, true
+	}
+	return nil, false
+}
+
+// downloadState is saved next to a partial download, so it is only resumed
+// from the same version of the same source
+type downloadState struct {
+	URL     string `json:"url"`
+	Version string `json:"version,omitempty"`
+}
+
+// loadDownloadState returns the state of a partial download, or a zero
+// state when there is none
+func loadDownloadState(stateFile string) downloadState {
+	var state downloadState
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return downloadState{}
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return downloadState{}
+	}
+	return state
+}
+
+// download writes the task's source to outputFile, resuming a partial
+// download of the same source, and returns its hex sha256
+func (vc *VideoConverter) download(ctx context.Context, task *VideoTask, outputFile string) (string, error) {
+	source, err := url.Parse(task.SourceURL)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	fetcher, ok := vc.fetcherFor(source)
+	if !ok {
+		return "", fmt.Errorf("%w: no fetcher for %s source urls", ErrInvalidTask, source.Scheme)
+	}
+	stateFile := outputFile + ".download"
+	state := loadDownloadState(stateFile)
+
+	output, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create download file: %v", err)
+	}
+	defer output.Close()
+	var offset int64
+	if info, err := output.Stat(); err == nil && state.URL == task.SourceURL && state.Version != "" {
+		offset = info.Size()
+	}
+
+	fetched, err := fetcher.Open(ctx, source, offset, state.Version)
+	if err != nil {
+		return "", fmt.Errorf("failed to download source: %w", err)
+	}
+	defer fetched.Body.Close()
+	if fetched.Offset != 0 && fetched.Offset != offset {
+		return "", fmt.Errorf("failed to resume source download: got offset %d, asked for %d", fetched.Offset, offset)
+	}
+	if fetched.Offset > 0 {
+		slog.Info("Resuming download", slog.Int("video_id", task.VideoID), slog.Int64("offset", offset))
+	}
+	offset = fetched.Offset
+	if fetched.Size >= 0 {
+		if err := vc.checkSize(task, fetched.Size); err != nil {
+			return "", err
+		}
+	}
+
+	state = downloadState{URL: task.SourceURL, Version: fetched.Version}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(stateFile, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to save download state: %v", err)
+	}
+
+	// The hash of the whole file includes the bytes downloaded before
+	if err := output.Truncate(offset); err != nil {
+		return "", fmt.Errorf("failed to truncate download file: %v", err)
+	}
+	fileHash := sha256.New()
+	if _, err := io.CopyN(fileHash, output, offset); err != nil {
+		return "", fmt.Errorf("failed to hash resumed download: %v", err)
+	}
+	if _, err := output.Seek(offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to seek download file: %v", err)
+	}
+
+	var body io.Reader = fetched.Body
+	if maxSize := vc.limits.For(task).MaxSize; maxSize > 0 {
+		// Sources of unknown length are cut off right after the limit
+		body = io.LimitReader(body, maxSize-offset+1)
+	}
+	if vc.downloads.RateLimit > 0 {
+		body = &rateLimitedReader{ctx: ctx, r: body, rate: vc.downloads.RateLimit, start: time.Now()}
+	}
+	written, err := io.Copy(io.MultiWriter(output, fileHash), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to download source: %w", err)
+	}
+	size := offset + written
+	if fetched.Size >= 0 && size != fetched.Size {
+		return "", fmt.Errorf("failed to download source: got %d of %d bytes", size, fetched.Size)
+	}
+	if err := output.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync download file: %v", err)
+	}
+	os.Remove(stateFile)
+
+	if err := vc.checkSize(task, size); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(fileHash.Sum(nil))
+	if task.SourceSHA256 != "" && !strings.EqualFold(sum, task.SourceSHA256) {
+		// A corrupt transfer is worth another try, from the first byte
+		os.Remove(outputFile)
+		return "", fmt.Errorf("%w: got %s", ErrChecksumMismatch, sum)
+	}
+	if size < vc.minMergedSize {
+		return "", fmt.Errorf("%w: %d bytes, expected at least %d", ErrMergedTooSmall, size, vc.minMergedSize)
+	}
+	return sum, nil
+}
+
+// httpFetcher downloads HTTP(S) sources, resuming with range requests
+type httpFetcher struct {
+	client *http.Client
+}
+
+func (f httpFetcher) Open(ctx context.Context, source *url.URL, offset int64, version string) (*FetchedSource, error) {
+	client := f.client
+	if client == nil {
+		client = defaultDownloadClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		// If-Range makes the server send the whole source once it changed
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", version)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := &FetchedSource{Body: resp.Body, Size: -1, Version: httpVersion(resp.Header)}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+		fetched.Offset = start
+		fetched.Size = size
+		return fetched, nil
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range, or the source changed
+		fetched.Size = resp.ContentLength
+		return fetched, nil
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is no longer a prefix of the source
+		return f.Open(ctx, source, 0, "")
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: %s", ErrDownloadRejected, resp.Status)
+	}
+	return nil, fmt.Errorf("source server returned %s", resp.Status)
+}
+
+// httpVersion returns the If-Range validator of a response: its ETag, or
+// its Last-Modified date, as weak ETags can't be used
+func httpVersion(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// parseContentRange parses a "bytes start-end/size" Content-Range, where
+// size is -1 when the server sent "*"
+func parseContentRange(header string) (start, size int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	byteRange, sizeSpec, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size = -1
+	if sizeSpec != "*" {
+		if size, err = strconv.ParseInt(sizeSpec, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, size, true
+}
+
+// rateLimitedReader sleeps between reads to stay under rate bytes per
+// second on average
+type rateLimitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// At most a second's worth at a time, so the pace stays even
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	due := r.start.Add(time.Duration(float64(r.read) / float64(r.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
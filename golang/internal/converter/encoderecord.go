@@ -0,0 +1,133 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"imersaofc/internal/database"
+	"imersaofc/internal/ffmpeg"
+)
+
+// EncodeRecord is how an output version was made: the exact ffmpeg
+// command lines, the ffmpeg release and the profile's settings, so the
+// output can be reproduced and a regression after an ffmpeg upgrade
+// bisected
+type EncodeRecord struct {
+	ID      int64  `json:"id"`
+	VideoID int    `json:"video_id"`
+	Version int    `json:"version"`
+	Profile string `json:"profile"`
+	// Settings are the profile's settings as the job used them
+	Settings json.RawMessage `json:"settings"`
+	// Transcoder is the transcoder of the renditions, "ffmpeg" unless
+	// offloaded to a remote one, whose commands aren't recorded
+	Transcoder string `json:"transcoder"`
+	// FFmpegVersion is the release of the ffmpeg that ran the commands,
+	// see WithFFmpegVersion
+	FFmpegVersion string `json:"ffmpeg_version,omitempty"`
+	// Commands are the ffmpeg command lines the job ran, in order, quoted
+	// for a shell
+	Commands  []string  `json:"commands"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WithFFmpegVersion sets the ffmpeg release recorded with each encode, as
+// ffmpeg.Capabilities reports it
+func WithFFmpegVersion(version string) Option {
+	return func(vc *VideoConverter) {
+		vc.ffmpegVersion = version
+	}
+}
+
+// recordingRunner remembers the command line of every ffmpeg run of a job
+type recordingRunner struct {
+	runner ffmpeg.Runner
+	mu     sync.Mutex
+	lines  []string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.lines = append(r.lines, ffmpeg.CommandLine(args))
+	r.mu.Unlock()
+	return r.runner.Run(ctx, args...)
+}
+
+func (r *recordingRunner) Probe(ctx context.Context, file string) (*ffmpeg.ProbeResult, error) {
+	return r.runner.Probe(ctx, file)
+}
+
+// commands returns the command lines run so far
+func (r *recordingRunner) commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.lines...)
+}
+
+// encodeRecord returns the record of the job's encode
+func (vc *VideoConverter) encodeRecord(job *Job) (EncodeRecord, error) {
+	settings, err := json.Marshal(job.Profile)
+	if err != nil {
+		return EncodeRecord{}, err
+	}
+	record := EncodeRecord{
+		VideoID:       job.Task.VideoID,
+		Version:       job.Version,
+		Profile:       profileName(job.Task),
+		Settings:      settings,
+		Transcoder:    vc.transcoderFor(job).Name(),
+		FFmpegVersion: vc.ffmpegVersion,
+		Commands:      []string{},
+		CreatedAt:     time.Now(),
+	}
+	if job.recorder != nil {
+		record.Commands = job.recorder.commands()
+	}
+	return record, nil
+}
+
+// SaveEncodeRecord records how an output version was made
+func SaveEncodeRecord(ctx context.Context, db *database.DB, r EncodeRecord) error {
+	return database.Retry(ctx, func() error {
+		return saveEncodeRecord(ctx, db, db, r)
+	})
+}
+
+// saveEncodeRecord records an encode with q, the pool or a transaction
+func saveEncodeRecord(ctx context.Context, db *database.DB, q querier, r EncodeRecord) error {
+	commands, err := json.Marshal(r.Commands)
+	if err != nil {
+		return err
+	}
+	query := db.Rebind(`INSERT INTO encode_records (video_id, version, profile, settings, transcoder, ffmpeg_version, commands, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	_, err = q.ExecContext(ctx, query, r.VideoID, r.Version, r.Profile, string(r.Settings), r.Transcoder, r.FFmpegVersion, string(commands), r.CreatedAt)
+	return err
+}
+
+// ListEncodeRecords returns the encode records of the video, oldest first
+func ListEncodeRecords(ctx context.Context, db *database.DB, videoID int) ([]EncodeRecord, error) {
+	query := db.Rebind("SELECT id, version, profile, settings, transcoder, ffmpeg_version, commands, created_at FROM encode_records WHERE video_id = ? ORDER BY id")
+	rows, err := db.QueryContext(ctx, query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []EncodeRecord{}
+	for rows.Next() {
+		r := EncodeRecord{VideoID: videoID}
+		var settings, commands string
+		if err := rows.Scan(&r.ID, &r.Version, &r.Profile, &settings, &r.Transcoder, &r.FFmpegVersion, &commands, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.Settings = json.RawMessage(settings)
+		if err := json.Unmarshal([]byte(commands), &r.Commands); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
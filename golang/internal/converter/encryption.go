@@ -0,0 +1,239 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// sealChunkSize is how much of the mezzanine is encrypted or decrypted at
+// a time, a multiple of the AES block size
+const sealChunkSize = 1 << 20
+
+// WithWorkspaceEncryption encrypts the merged mezzanine of each job at rest
+// with key, a 16 bytes AES-128 key local to the worker, for deployments
+// handling sensitive content on shared nodes. The mezzanine is encrypted
+// as soon as it is merged, replacing the plaintext, and decrypted for each
+// ffmpeg and ffprobe run into an anonymous file in memory they are handed
+// open, so neither the key nor the plaintext can be read by other users of
+// the node. Workers need the memory to hold a decrypted mezzanine per run,
+// and a local ffmpeg, see ffmpeg.FileRunner. Jobs of encrypted mezzanines
+// aren't offloaded to a remote transcoder.
+func WithWorkspaceEncryption(key []byte) Option {
+	if len(key) != aes.BlockSize {
+		panic(fmt.Sprintf("workspace encryption key must be %d bytes, got %d", aes.BlockSize, len(key)))
+	}
+	return func(vc *VideoConverter) {
+		vc.workspaceKey = key
+	}
+}
+
+// sealedRunner lets ffmpeg read the job's encrypted files: each input that
+// is one is decrypted into memory and handed to ffmpeg open in its place.
+// It sits below the logging and recording runners, which log the path of
+// the open file.
+type sealedRunner struct {
+	runner ffmpeg.FileRunner
+	key    []byte
+
+	mu sync.Mutex
+	// ivs are the IVs of the encrypted files, by path
+	ivs map[string][]byte
+}
+
+// newSealedRunner wraps runner, which must be able to hand ffmpeg open files
+func newSealedRunner(runner ffmpeg.Runner, key []byte) (*sealedRunner, error) {
+	files, ok := runner.(ffmpeg.FileRunner)
+	if !ok {
+		return nil, errors.New("workspace encryption needs a local ffmpeg")
+	}
+	return &sealedRunner{runner: files, key: key, ivs: map[string][]byte{}}, nil
+}
+
+func (r *sealedRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	rewritten := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-i" && i+1 < len(args) && r.sealed(args[i+1]) {
+			file, err := r.open(args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s: %w", args[i+1], err)
+			}
+			files = append(files, file)
+			rewritten = append(rewritten, "-i", ffmpeg.FilePath(len(files)-1))
+			i++
+			continue
+		}
+		rewritten = append(rewritten, args[i])
+	}
+	return r.runner.RunFiles(ctx, files, rewritten...)
+}
+
+func (r *sealedRunner) Probe(ctx context.Context, file string) (*ffmpeg.ProbeResult, error) {
+	if !r.sealed(file) {
+		return r.runner.Probe(ctx, file)
+	}
+	open, err := r.open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", file, err)
+	}
+	defer open.Close()
+	return r.runner.ProbeFile(ctx, open)
+}
+
+// sealed reports whether the file is encrypted
+func (r *sealedRunner) sealed(file string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ivs[file]
+	return ok
+}
+
+// open decrypts the encrypted file into an anonymous file in memory
+func (r *sealedRunner) open(name string) (*os.File, error) {
+	r.mu.Lock()
+	iv := r.ivs[name]
+	r.mu.Unlock()
+	file, err := memoryFile(filepath.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := openFile(name, file, r.key, iv); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// sealMerged encrypts the job's merged file, when the converter encrypts
+// workspaces and the file is the job's own, replacing the plaintext
+func (vc *VideoConverter) sealMerged(job *Job) error {
+	if job.sealer == nil || !ownsMergedFile(job) || job.sealer.sealed(job.MergedFile) {
+		return nil
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return err
+	}
+	slog.Info("Encrypting merged file", slog.String("path", job.MergedFile))
+	sealed := job.MergedFile + ".sealed"
+	if err := sealFile(job.MergedFile, sealed, job.sealer.key, iv); err != nil {
+		os.Remove(sealed)
+		return fmt.Errorf("failed to encrypt merged file: %w", err)
+	}
+	// Renaming over the merged file deletes the plaintext
+	if err := os.Rename(sealed, job.MergedFile); err != nil {
+		os.Remove(sealed)
+		return fmt.Errorf("failed to replace merged file: %w", err)
+	}
+	job.sealer.mu.Lock()
+	job.sealer.ivs[job.MergedFile] = iv
+	job.sealer.mu.Unlock()
+	return nil
+}
+
+// sealFile encrypts the file src into dst with AES-128-CBC and PKCS#7
+// padding, a chunk at a time
+func sealFile(src, dst string, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	mode := cipher.NewCBCEncrypter(block, iv)
+	buf := make([]byte, sealChunkSize)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		chunk := buf[:n]
+		last := n < sealChunkSize
+		if last {
+			padding := aes.BlockSize - n%aes.BlockSize
+			chunk = append(chunk, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		}
+		mode.CryptBlocks(chunk, chunk)
+		if _, err := out.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return out.Sync()
+		}
+	}
+}
+
+// openFile decrypts the file sealFile encrypted into w
+func openFile(name string, w io.Writer, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 || size%aes.BlockSize != 0 {
+		return errors.New("encrypted file size isn't a multiple of the block size")
+	}
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+	buf := make([]byte, sealChunkSize)
+	for offset := int64(0); offset < size; {
+		n, err := io.ReadFull(in, buf[:min(int64(sealChunkSize), size-offset)])
+		if err != nil {
+			return err
+		}
+		chunk := buf[:n]
+		mode.CryptBlocks(chunk, chunk)
+		offset += int64(n)
+		if offset == size {
+			padding := int(chunk[n-1])
+			if padding == 0 || padding > aes.BlockSize || padding > n ||
+				!bytes.Equal(chunk[n-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+				return errors.New("invalid padding, wrong key or damaged file")
+			}
+			chunk = chunk[:n-padding]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
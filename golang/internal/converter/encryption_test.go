@@ -0,0 +1,107 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+func TestSealFile(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	iv := bytes.Repeat([]byte{9}, 16)
+	for _, size := range []int{0, 1, 16, 100, sealChunkSize, sealChunkSize + 5} {
+		dir := t.TempDir()
+		plain := make([]byte, size)
+		rand.Read(plain)
+		src := filepath.Join(dir, "merged")
+		if err := os.WriteFile(src, plain, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sealed := filepath.Join(dir, "merged.sealed")
+		if err := sealFile(src, sealed, key, iv); err != nil {
+			t.Fatalf("size %d: sealFile() error = %v", size, err)
+		}
+		encrypted, _ := os.ReadFile(sealed)
+		if len(encrypted) == 0 || len(encrypted)%16 != 0 || (size >= 16 && bytes.Contains(encrypted, plain[:16])) {
+			t.Fatalf("size %d: sealed file of %d bytes isn't encrypted", size, len(encrypted))
+		}
+
+		var opened bytes.Buffer
+		if err := openFile(sealed, &opened, key, iv); err != nil {
+			t.Fatalf("size %d: openFile() error = %v", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), plain) {
+			t.Errorf("size %d: opened %d bytes that don't match the plaintext", size, opened.Len())
+		}
+	}
+}
+
+// fileRunner records what ffmpeg would read from the files it is handed
+type fileRunner struct {
+	ffmpeg.Runner
+	args   []string
+	inputs [][]byte
+}
+
+func (r *fileRunner) RunFiles(ctx context.Context, files []*os.File, args ...string) ([]byte, error) {
+	r.args = args
+	for _, file := range files {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		r.inputs = append(r.inputs, data)
+	}
+	return nil, nil
+}
+
+func (r *fileRunner) ProbeFile(ctx context.Context, file *os.File) (*ffmpeg.ProbeResult, error) {
+	return nil, nil
+}
+
+func TestSealedRunner(t *testing.T) {
+	dir := t.TempDir()
+	merged := filepath.Join(dir, "merged")
+	plain := []byte("not really a video")
+	os.WriteFile(merged, plain, 0o644)
+
+	files := &fileRunner{}
+	sealer, err := newSealedRunner(files, bytes.Repeat([]byte{7}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &Job{Task: &VideoTask{Path: dir}, MergedFile: merged, sealer: sealer}
+	if err := (&VideoConverter{}).sealMerged(job); err != nil {
+		t.Fatalf("sealMerged() error = %v", err)
+	}
+	if data, _ := os.ReadFile(merged); bytes.Contains(data, plain) {
+		t.Fatal("merged file is still in plaintext")
+	}
+	if _, err := os.Stat(merged + ".sealed"); !os.IsNotExist(err) {
+		t.Errorf("sealed copy left behind: %v", err)
+	}
+
+	if _, err := sealer.Run(context.Background(), "-y", "-i", merged, "-i", "logo.png", "out.mp4"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := []string{"-y", "-i", "/dev/fd/3", "-i", "logo.png", "out.mp4"}
+	if !slices.Equal(files.args, want) {
+		t.Errorf("args = %q, want %q", files.args, want)
+	}
+	if len(files.inputs) != 1 || !bytes.Equal(files.inputs[0], plain) {
+		t.Errorf("ffmpeg read %q, want %q", files.inputs, plain)
+	}
+}
+
+func TestNewSealedRunnerRemote(t *testing.T) {
+	if _, err := newSealedRunner(ffmpeg.SSHRunner{Host: "encoder"}, bytes.Repeat([]byte{7}, 16)); err == nil {
+		t.Error("newSealedRunner() accepted a remote runner")
+	}
+}
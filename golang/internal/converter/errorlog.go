@@ -0,0 +1,157 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Phases recorded for errors that happen outside of a pipeline stage
+const (
+	PhaseDecode = "decode"
+	PhaseHandle = "handle"
+)
+
+// DefaultErrorPageSize and MaxErrorPageSize bound ErrorFilter.Limit
+const (
+	DefaultErrorPageSize = 50
+	MaxErrorPageSize     = 500
+)
+
+// ErrErrorNotFound is returned when no logged error has the requested id
+var ErrErrorNotFound = errors.New("error log entry not found")
+
+// ErrorLogEntry is one row of process_errors_log
+type ErrorLogEntry struct {
+	ID        int64  `json:"id"`
+	VideoID   int    `json:"video_id"`
+	Phase     string `json:"phase,omitempty"`
+	ErrorType string `json:"error_type,omitempty"`
+	Message   string `json:"error"`
+	Details   string `json:"details"`
+	// Cause and Hint identify a recognized ffmpeg failure, see ffmpeg.Error
+	Cause string `json:"cause,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+	// Task is the payload that failed, nil for entries logged before it was recorded
+	Task      *VideoTask      `json:"task,omitempty"`
+	Raw       json.RawMessage `json:"raw"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ErrorFilter selects process_errors_log entries; zero fields don't filter
+type ErrorFilter struct {
+	VideoID   int
+	Phase     string
+	ErrorType string
+	From      time.Time
+	To        time.Time
+
+	// Limit and Offset paginate the results, newest first
+	Limit  int
+	Offset int
+}
+
+// ListErrors returns the logged errors matching the filter, newest first
+func ListErrors(ctx context.Context, db *database.DB, filter ErrorFilter) ([]ErrorLogEntry, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, cond)
+	}
+	if filter.VideoID != 0 {
+		add(db.Dialect.JSONText("error_details", "video_id")+" = ?", strconv.Itoa(filter.VideoID))
+	}
+	if filter.Phase != "" {
+		add(db.Dialect.JSONText("error_details", "phase")+" = ?", filter.Phase)
+	}
+	if filter.ErrorType != "" {
+		add(db.Dialect.JSONText("error_details", "error_type")+" = ?", filter.ErrorType)
+	}
+	if !filter.From.IsZero() {
+		add("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("created_at < ?", filter.To)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultErrorPageSize
+	}
+	limit = min(limit, MaxErrorPageSize)
+
+	query := "SELECT id, error_details, created_at FROM process_errors_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, limit, max(filter.Offset, 0))
+	query += " ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []ErrorLogEntry{}
+	for rows.Next() {
+		entry, err := scanErrorLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, rows.Err()
+}
+
+// GetError returns the logged error with the given id
+func GetError(ctx context.Context, db *database.DB, id int64) (ErrorLogEntry, error) {
+	row := db.QueryRowContext(ctx, db.Rebind("SELECT id, error_details, created_at FROM process_errors_log WHERE id = ?"), id)
+	entry, err := scanErrorLogEntry(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, ErrErrorNotFound
+	}
+	return entry, err
+}
+
+// scanErrorLogEntry reads a row and extracts the well-known error_details fields
+func scanErrorLogEntry(row interface{ Scan(...any) error }) (ErrorLogEntry, error) {
+	var entry ErrorLogEntry
+	var raw []byte
+	if err := row.Scan(&entry.ID, &raw, &entry.CreatedAt); err != nil {
+		return entry, err
+	}
+	entry.Raw = raw
+
+	var details struct {
+		VideoID   int        `json:"video_id"`
+		Phase     string     `json:"phase"`
+		ErrorType string     `json:"error_type"`
+		Error     string     `json:"error"`
+		Details   string     `json:"details"`
+		Cause     string     `json:"cause"`
+		Hint      string     `json:"hint"`
+		Task      *VideoTask `json:"task"`
+	}
+	json.Unmarshal(raw, &details)
+	entry.VideoID = details.VideoID
+	entry.Phase = details.Phase
+	entry.ErrorType = details.ErrorType
+	entry.Message = details.Error
+	entry.Details = details.Details
+	entry.Cause = details.Cause
+	entry.Hint = details.Hint
+	if details.Task != nil && details.Task.VideoID != 0 {
+		entry.Task = details.Task
+	}
+	return entry, nil
+}
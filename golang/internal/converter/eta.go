@@ -0,0 +1,43 @@
+package converter
+
+import (
+	"context"
+	"time"
+
+	"imersaofc/internal/events"
+)
+
+// Estimator predicts how long converting a source of the given duration
+// with a profile takes, usually from the throughput of past jobs. It
+// reports false when it has nothing to base an estimate on.
+type Estimator interface {
+	Estimate(ctx context.Context, profile string, source time.Duration) (time.Duration, bool)
+}
+
+// sourceDuration returns the duration of the probed source, zero when unknown
+func sourceDuration(job *Job) time.Duration {
+	if job.Probe == nil {
+		return 0
+	}
+	return time.Duration(job.Probe.DurationSeconds() * float64(time.Second))
+}
+
+// publishEstimate emits the expected completion time of the job, counted
+// from when its pipeline started
+func (vc *VideoConverter) publishEstimate(ctx context.Context, job *Job) {
+	source := sourceDuration(job)
+	if vc.estimator == nil || source <= 0 {
+		return
+	}
+	estimate, ok := vc.estimator.Estimate(ctx, profileName(job.Task), source)
+	if !ok {
+		return
+	}
+	vc.events.Publish(events.TaskEstimated{
+		VideoID:        job.Task.VideoID,
+		SourceDuration: source,
+		Estimate:       estimate,
+		ETA:            job.StartedAt.Add(estimate),
+		At:             time.Now(),
+	})
+}
@@ -0,0 +1,209 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// FFmpegLogName is the name of a job's ffmpeg log among its uploaded outputs
+const FFmpegLogName = "ffmpeg.log"
+
+// FFmpegLogEnd is the last line of a job's log, written once the job is done
+const FFmpegLogEnd = "=== end of job\n"
+
+// ErrNoFFmpegLog is returned when a video has no ffmpeg log
+var ErrNoFFmpegLog = errors.New("no ffmpeg log found")
+
+// FFmpegLogPolicy keeps the full output of every ffmpeg and ffprobe run of
+// a job in a file of its own, so a failed conversion can be debugged
+// without searching the worker's logs
+type FFmpegLogPolicy struct {
+	// Dir holds the log files, named {video_id}-{started}.log
+	Dir string
+	// MaxAge removes logs older than it when a job starts; zero keeps them
+	MaxAge time.Duration
+	// MaxFiles keeps only the newest logs; zero doesn't limit them
+	MaxFiles int
+	// Upload uploads the log next to the outputs, as FFmpegLogName
+	Upload bool
+}
+
+// WithFFmpegLogs writes each job's ffmpeg output to a log file kept per policy
+func WithFFmpegLogs(policy FFmpegLogPolicy) Option {
+	return func(vc *VideoConverter) {
+		vc.ffmpegLogs = policy
+	}
+}
+
+// openFFmpegLog creates the job's log file after rotating the old ones, and
+// makes the job's runner write to it. The caller closes the file.
+func (vc *VideoConverter) openFFmpegLog(job *Job) (*os.File, error) {
+	policy := vc.ffmpegLogs
+	if err := os.MkdirAll(policy.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	vc.rotateFFmpegLogs()
+
+	name := fmt.Sprintf("%d-%s.log", job.Task.VideoID, job.StartedAt.UTC().Format("20060102T150405.000"))
+	file, err := os.Create(filepath.Join(policy.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	job.FFmpegLog = file.Name()
+	job.Runner = &loggingRunner{runner: job.Runner, w: &lockedWriter{w: file}}
+	return file, nil
+}
+
+// closeFFmpegLog marks the job's log complete, which stops anyone following
+// it, and closes it
+func closeFFmpegLog(file *os.File) {
+	io.WriteString(file, FFmpegLogEnd)
+	file.Close()
+}
+
+// LatestFFmpegLog returns the path of the video's newest log in dir
+func LatestFFmpegLog(dir string, videoID int) (string, error) {
+	// The start time in the names sorts them chronologically
+	matches, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%d-*.log", videoID)))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", ErrNoFFmpegLog
+	}
+	sort.Strings(matches)
+	return matches[len(matches)-1], nil
+}
+
+// rotateFFmpegLogs removes the logs past the policy's age or count; failures
+// are only logged
+func (vc *VideoConverter) rotateFFmpegLogs() {
+	policy := vc.ffmpegLogs
+	if policy.MaxAge <= 0 && policy.MaxFiles <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(policy.Dir)
+	if err != nil {
+		slog.Warn("Error listing ffmpeg logs", slog.String("dir", policy.Dir), slog.String("error", err.Error()))
+		return
+	}
+
+	type logFile struct {
+		path    string
+		modTime time.Time
+	}
+	var logs []logFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".log") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		logs = append(logs, logFile{filepath.Join(policy.Dir, entry.Name()), info.ModTime()})
+	}
+	// Newest first; the job about to start takes one of the MaxFiles
+	sort.Slice(logs, func(i, j int) bool { return logs[i].modTime.After(logs[j].modTime) })
+	for i, log := range logs {
+		expired := policy.MaxAge > 0 && time.Since(log.modTime) > policy.MaxAge
+		if !expired && (policy.MaxFiles <= 0 || i < policy.MaxFiles-1) {
+			continue
+		}
+		if err := os.Remove(log.path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Error removing ffmpeg log", slog.String("path", log.path), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// uploadFFmpegLog uploads the job's log so far next to its outputs
+func (vc *VideoConverter) uploadFFmpegLog(ctx context.Context, job *Job, prefix string) error {
+	if !vc.ffmpegLogs.Upload || job.FFmpegLog == "" {
+		return nil
+	}
+	return vc.uploader.Upload(ctx, job.FFmpegLog, path.Join(prefix, FFmpegLogName))
+}
+
+// runnerFor returns the runner of the job, which logs its runs when the
+// converter keeps ffmpeg logs
+func (vc *VideoConverter) runnerFor(job *Job) ffmpeg.Runner {
+	if job.Runner != nil {
+		return job.Runner
+	}
+	return vc.runner
+}
+
+// loggingRunner writes every command it runs and its output to w, as
+// the output comes when the runner can stream it
+type loggingRunner struct {
+	runner ffmpeg.Runner
+	w      io.Writer
+}
+
+func (r *loggingRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	started := time.Now()
+	r.begin(started, ffmpeg.CommandLine(args))
+	var output []byte
+	var err error
+	if streamer, ok := r.runner.(ffmpeg.Streamer); ok {
+		var buf bytes.Buffer
+		err = streamer.Stream(ctx, io.MultiWriter(&buf, r.w), args...)
+		output = buf.Bytes()
+	} else {
+		output, err = r.runner.Run(ctx, args...)
+		r.w.Write(output)
+	}
+	r.end(started, output, err)
+	return output, err
+}
+
+func (r *loggingRunner) Probe(ctx context.Context, file string) (*ffmpeg.ProbeResult, error) {
+	started := time.Now()
+	r.begin(started, "ffprobe "+file)
+	probe, err := r.runner.Probe(ctx, file)
+	r.end(started, nil, err)
+	return probe, err
+}
+
+func (r *loggingRunner) begin(started time.Time, command string) {
+	fmt.Fprintf(r.w, "=== %s $ %s\n", started.UTC().Format(time.RFC3339), command)
+}
+
+func (r *loggingRunner) end(started time.Time, output []byte, err error) {
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		io.WriteString(r.w, "\n")
+	}
+	fmt.Fprintf(r.w, "=== %s after %s\n\n", status, time.Since(started).Round(time.Millisecond))
+}
+
+// lockedWriter serializes writes, for output copied from several
+// goroutines, and drops write errors: a log that can't be written must not
+// fail the ffmpeg it is copied from
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.w.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,306 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// playerSafePixFmts are the pixel formats every player decodes
+var playerSafePixFmts = []string{"yuv420p", "yuvj420p"}
+
+// hdrTransfers are the transfer characteristics of HDR video
+var hdrTransfers = []string{"smpte2084", "arib-std-b67"}
+
+// Aspect ratio policies of a profile with both a width and a height, for
+// sources of another aspect ratio
+const (
+	// AspectPreserve fits the video in the box, smaller on one side
+	AspectPreserve = "preserve"
+	// AspectPad fits the video in the box and pads it with black bars
+	AspectPad = "pad"
+	// AspectCrop fills the box and crops what overflows, centered
+	AspectCrop = "crop"
+)
+
+// maxCustomFilterLength caps the filter chain a profile may add
+const maxCustomFilterLength = 512
+
+// deniedFilters are the filters a profile may not add: they read or write
+// files, open URLs or sockets, or take commands at runtime
+var deniedFilters = []string{
+	"movie", "amovie", "sendcmd", "asendcmd", "zmq", "azmq",
+	"metadata", "ametadata", "drawtext", "subtitles", "ass",
+}
+
+// customFilterName matches the name of a filter of the chain
+var customFilterName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// videoFilters returns the filter chain of the video rendition:
+// conforming the frame rate, scaling to the profile's size, normalizing
+// the colors, then the profile's own filters, which see the output size
+// and 8-bit BT.709 frames
+func videoFilters(video *ffmpeg.Stream, profile Profile) []string {
+	var filters []string
+	if rate := conformFrameRate(video, profile); rate != "" {
+		filters = append(filters, "fps="+rate)
+	}
+	filters = append(filters, scaleFilters(video, profile)...)
+	filters = append(filters, colorFilters(video)...)
+	if profile.VideoFilter != "" {
+		filters = append(filters, profile.VideoFilter)
+	}
+	return filters
+}
+
+// watermarkMargin is the distance, in pixels, of a watermark from the
+// edges of the video
+const watermarkMargin = 16
+
+// watermarkGraph overlays the image on the bottom right corner of the
+// video, after the filter chain, which may be empty
+func watermarkGraph(chain, image string) string {
+	overlay := fmt.Sprintf("movie=%s[watermark];[main][watermark]overlay=W-w-%d:H-h-%d[out]", image, watermarkMargin, watermarkMargin)
+	if chain == "" {
+		return "[in]null[main];" + overlay
+	}
+	return "[in]" + chain + "[main];" + overlay
+}
+
+// checkCustomFilter returns an error unless chain is a single linear
+// filter chain, such as "hqdn3d=4:3:6:4.5,unsharp", of allowed filters
+// and at most maxCustomFilterLength long. Labels and ";" are rejected, so
+// the chain can't reach other streams or add outputs.
+func checkCustomFilter(chain string) error {
+	if len(chain) > maxCustomFilterLength {
+		return fmt.Errorf("filter is %d characters long, over %d", len(chain), maxCustomFilterLength)
+	}
+	var filters []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, c := range chain {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == ';' || c == '[' || c == ']':
+			return fmt.Errorf("filter %q isn't a single filter chain", chain)
+		case c == ',':
+			filters = append(filters, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if quoted || escaped {
+		return fmt.Errorf("filter %q has an unterminated quote or escape", chain)
+	}
+	filters = append(filters, current.String())
+	for _, f := range filters {
+		name, _, _ := strings.Cut(strings.TrimSpace(f), "=")
+		if !customFilterName.MatchString(name) {
+			return fmt.Errorf("filter %q in %q has a bad name", name, chain)
+		}
+		if slices.Contains(deniedFilters, name) {
+			return fmt.Errorf("filter %s isn't allowed in profiles", name)
+		}
+	}
+	return nil
+}
+
+// scaleFilters scales the video to the profile's size, following its
+// aspect policy, never upscaling unless padding or cropping to an exact
+// size. Anamorphic video has its pixels squared first, so the sizes are
+// those it is displayed at. Dimensions are kept even, as 4:2:0 encoders
+// require.
+func scaleFilters(video *ffmpeg.Stream, profile Profile) []string {
+	filters := squarePixels(video)
+	w, h := profile.Width, profile.Height
+	switch {
+	case w > 0 && h > 0 && profile.AspectPolicy == AspectPad:
+		return append(filters,
+			fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2", w, h),
+			fmt.Sprintf("pad=%d:%d:(ow-iw)/2:(oh-ih)/2", w, h),
+			"setsar=1",
+		)
+	case w > 0 && h > 0 && profile.AspectPolicy == AspectCrop:
+		return append(filters,
+			fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase", w, h),
+			fmt.Sprintf("crop=%d:%d", w, h),
+			"setsar=1",
+		)
+	case w > 0 && h > 0:
+		return append(filters, fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease:force_divisible_by=2", w, h))
+	case h > 0:
+		return append(filters, fmt.Sprintf("scale=-2:'min(%d,ih)'", h))
+	case w > 0:
+		return append(filters, fmt.Sprintf("scale='min(%d,iw)':-2", w))
+	case video.Width%2 != 0 || video.Height%2 != 0:
+		return append(filters, "scale=trunc(iw/2)*2:trunc(ih/2)*2")
+	}
+	return filters
+}
+
+// isAnamorphic reports whether the video's pixels aren't square, which
+// many players ignore, showing it squished or stretched
+func isAnamorphic(video *ffmpeg.Stream) bool {
+	return math.Abs(video.PixelAspect()-1) > 0.01
+}
+
+// squarePixels resamples anamorphic video to square pixels at its display
+// aspect ratio, keeping its height, so no line of the source is lost:
+// 720x576 PAL at 16:9 becomes 1024x576
+func squarePixels(video *ffmpeg.Stream) []string {
+	if !isAnamorphic(video) {
+		return nil
+	}
+	return []string{"scale=trunc(iw*sar/2)*2:ih", "setsar=1"}
+}
+
+// previewScale scales any video, anamorphic or not, to square pixels at
+// most height high, for the previews that don't go through videoFilters
+func previewScale(height int) string {
+	return fmt.Sprintf("scale='trunc(min(%d,ih)*dar/2)*2':'min(%d,ih)',setsar=1", height, height)
+}
+
+// needsNormalization reports whether the video can't be played as is by
+// every device: 10-bit or 4:4:4 pixels, wide gamut or HDR
+func needsNormalization(video *ffmpeg.Stream) bool {
+	return len(colorFilters(video)) > 0
+}
+
+// isWideGamut reports whether the video uses BT.2020 colors
+func isWideGamut(video *ffmpeg.Stream) bool {
+	return video.ColorPrimaries == "bt2020" || strings.HasPrefix(video.ColorSpace, "bt2020")
+}
+
+// colorFilters converts the video to 8-bit 4:2:0 BT.709 SDR, the format
+// player-safe renditions are in: HDR is tone mapped, which needs ffmpeg
+// built with zimg, and BT.2020 SDR converted
+func colorFilters(video *ffmpeg.Stream) []string {
+	switch {
+	case slices.Contains(hdrTransfers, video.ColorTransfer):
+		return []string{
+			"zscale=t=linear:npl=100",
+			"format=gbrpf32le",
+			"zscale=p=bt709",
+			"tonemap=hable:desat=0",
+			"zscale=t=bt709:m=bt709:r=tv",
+			"format=yuv420p",
+		}
+	case isWideGamut(video):
+		return []string{"colorspace=all=bt709:iall=bt2020:format=yuv420p"}
+	case video.PixFmt != "" && !slices.Contains(playerSafePixFmts, video.PixFmt):
+		return []string{"format=yuv420p"}
+	}
+	return nil
+}
+
+// colorTagArgs tags the output as BT.709 when its colors were converted,
+// so players don't assume the source's
+func colorTagArgs(video *ffmpeg.Stream) []string {
+	if !slices.Contains(hdrTransfers, video.ColorTransfer) && !isWideGamut(video) {
+		return nil
+	}
+	return []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709"}
+}
+
+// frameRate is a standard frame rate, as the rational ffmpeg takes
+type frameRate struct {
+	num, den int
+}
+
+func (r frameRate) value() float64 { return float64(r.num) / float64(r.den) }
+func (r frameRate) String() string { return strconv.Itoa(r.num) + "/" + strconv.Itoa(r.den) }
+
+// standardFrameRates are the rates of the two families renditions stay
+// within: the NTSC one, with a 1000/1001 factor, and the integer one
+var standardFrameRates = []frameRate{
+	{24000, 1001}, {24, 1}, {25, 1}, {30000, 1001}, {30, 1},
+	{48000, 1001}, {48, 1}, {50, 1}, {60000, 1001}, {60, 1},
+	{100, 1}, {120000, 1001}, {120, 1},
+}
+
+// frameRateTolerance is how far, relatively, a measured rate may be from
+// a standard one and still belong to it; 23.976 and 24 are 0.1% apart
+const frameRateTolerance = 0.0005
+
+// vfrTolerance is how far, relatively, the average rate may drift from
+// the base one before the source is considered variable frame rate
+const vfrTolerance = 0.01
+
+// standardFrameRate returns the standard rate the measured one belongs to
+func standardFrameRate(rate float64) (frameRate, bool) {
+	for _, r := range standardFrameRates {
+		if math.Abs(rate-r.value())/r.value() <= frameRateTolerance {
+			return r, true
+		}
+	}
+	return frameRate{}, false
+}
+
+// conformFrameRate returns the frame rate the rendition is conformed to,
+// or "" to keep the source's. A rate over the profile's MaxFrameRate is
+// divided by the smallest whole number bringing it under, so it stays in
+// its family: 59.94 becomes 29.97, never 30. A variable frame rate source
+// is conformed to the standard rate closest to its average, so segments
+// hold the same number of frames across renditions.
+func conformFrameRate(video *ffmpeg.Stream, profile Profile) string {
+	avg, base := video.FrameRate(), ffmpeg.ParseRational(video.RFrameRate)
+	if avg <= 0 {
+		return ""
+	}
+	rate, standard := standardFrameRate(avg)
+	vfr := base > 0 && math.Abs(avg-base)/base > vfrTolerance
+	switch {
+	case !standard && vfr:
+		rate = closestFrameRate(avg)
+	case !standard && !exceedsFrameRate(video, profile):
+		// An unusual but constant rate is kept
+		return ""
+	case !standard:
+		rate = frameRate{int(math.Round(avg * 1000)), 1000}
+	}
+	if profile.MaxFrameRate > 0 && rate.value() > profile.MaxFrameRate*(1+frameRateTolerance) {
+		for n := 2; ; n++ {
+			if divided := rate.value() / float64(n); divided <= profile.MaxFrameRate*(1+frameRateTolerance) {
+				if r, ok := standardFrameRate(divided); ok {
+					rate = r
+				} else {
+					rate = frameRate{rate.num, rate.den * n}
+				}
+				return rate.String()
+			}
+		}
+	}
+	if vfr {
+		return rate.String()
+	}
+	return ""
+}
+
+// exceedsFrameRate reports whether the video is faster than the
+// profile's MaxFrameRate
+func exceedsFrameRate(video *ffmpeg.Stream, profile Profile) bool {
+	return profile.MaxFrameRate > 0 && video.FrameRate() > profile.MaxFrameRate*(1+frameRateTolerance)
+}
+
+// closestFrameRate returns the standard rate closest to the measured one
+func closestFrameRate(rate float64) frameRate {
+	closest := standardFrameRates[0]
+	for _, r := range standardFrameRates[1:] {
+		if math.Abs(rate-r.value()) < math.Abs(rate-closest.value()) {
+			closest = r
+		}
+	}
+	return closest
+}
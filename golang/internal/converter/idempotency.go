@@ -1,17 +1,21 @@
 package converter
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"log/slog"
 	"time"
+
+	"imersaofc/internal/database"
 )
 
 // IsProcessed checks if the video has already been processed successfully
-func IsProcessed(db *sql.DB, videoID int) bool {
+func IsProcessed(db *database.DB, videoID int) bool {
 	var IsProcessed bool
-	query := "SELECT EXISTS(SELECT 1 FROM processed_videos where video_id = $1 and status='success')"
-	err := db.QueryRow(query, videoID).Scan(&IsProcessed)
+	query := db.Rebind("SELECT EXISTS(SELECT 1 FROM processed_videos where video_id = ? and status='success')")
+	err := database.Retry(context.Background(), func() error {
+		return db.QueryRow(query, videoID).Scan(&IsProcessed)
+	})
 	if err != nil {
 		slog.Error("Error checking if video is processed", slog.Int("video_id", videoID))
 		return false
@@ -19,10 +23,13 @@ func IsProcessed(db *sql.DB, videoID int) bool {
 	return IsProcessed
 }
 
-// MarkProcessed registers that the video has been processed successfully
-func MarkProcess(db *sql.DB, videoID int) error {
-	query := "INSERT INTO processed_videos (video_id, status, processed_at) values ($1, $2, $3)"
-	_, err := db.Exec(query, videoID, "success", time.Now())
+// MarkProcessed registers that the video has been processed successfully,
+// replacing the previous row when it was reprocessed
+func MarkProcess(db *database.DB, videoID int) error {
+	ctx := context.Background()
+	err := database.Retry(ctx, func() error {
+		return markProcessed(ctx, db, db, videoID)
+	})
 	if err != nil {
 		slog.Error("Error marking video as processed", slog.Int("video_id", videoID))
 		return err
@@ -30,14 +37,32 @@ func MarkProcess(db *sql.DB, videoID int) error {
 	return nil
 }
 
+// markProcessed registers a successful conversion with q, the pool or a
+// transaction
+func markProcessed(ctx context.Context, db *database.DB, q querier, videoID int) error {
+	del := db.Rebind("DELETE FROM processed_videos WHERE video_id = ?")
+	query := db.Rebind("INSERT INTO processed_videos (video_id, status, processed_at) values (?, ?, ?)")
+	if _, err := q.ExecContext(ctx, del, videoID); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, query, videoID, "success", time.Now())
+	return err
+}
+
 // RegisterError stores the error details and phase history in the database
-func RegisterError(db *sql.DB, errorData map[string]interface{}, err error) {
-	serializedError, _ := json.Marshal(errorData)
-	query := "INSERT INTO process_errors_log (error_details, created_at) VALUES ($1, $2)"
-	_, dbErr := db.Exec(query, serializedError, time.Now())
-	if dbErr != nil {
+func RegisterError(db *database.DB, errorData map[string]interface{}, err error) {
+	if dbErr := registerError(db, errorData); dbErr != nil {
 		slog.Error("Error storing error log in database", slog.String("error", dbErr.Error()))
 		return
 	}
 	slog.Info("Error log stored successfully", slog.String("error", err.Error()))
-}
\ No newline at end of file
+}
+
+func registerError(db *database.DB, errorData map[string]interface{}) error {
+	serializedError, _ := json.Marshal(errorData)
+	query := db.Rebind("INSERT INTO process_errors_log (error_details, created_at) VALUES (?, ?)")
+	return database.Retry(context.Background(), func() error {
+		_, err := db.Exec(query, serializedError, time.Now())
+		return err
+	})
+}
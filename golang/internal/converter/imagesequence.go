@@ -0,0 +1,136 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// Source types accepted in VideoTask.SourceType
+const (
+	SourceChunks        = "chunks"
+	SourceImageSequence = "image_sequence"
+	// SourceSingleFile is a finished file, see VideoTask.SourceFile
+	SourceSingleFile = "file"
+	// SourceDownload is a file downloaded from VideoTask.SourceURL
+	SourceDownload = "url"
+)
+
+// DefaultImageSequenceFPS is used when an image sequence task has no fps
+const DefaultImageSequenceFPS = 25
+
+// ErrNoFrames is returned when an image sequence task has no frames
+var ErrNoFrames = errors.New("no frames found")
+
+// imageSequencePatterns are tried in order when the task doesn't set a chunk pattern
+var imageSequencePatterns = []string{"*.png", "*.jpg", "*.jpeg"}
+
+// encodeImageSequence builds a video from the task's frames using ffmpeg's
+// image2 demuxer. Frames are ordered like chunks and linked into a
+// temporary, sequentially numbered directory so any naming scheme works.
+func (vc *VideoConverter) encodeImageSequence(runner ffmpeg.Runner, task *VideoTask, outputFile string) error {
+	frames, ext, err := vc.findFrames(task)
+	if err != nil {
+		return err
+	}
+	size, err := totalSize(frames)
+	if err != nil {
+		return err
+	}
+	if err := vc.checkSize(task, size); err != nil {
+		return err
+	}
+
+	seqDir := filepath.Join(task.Path, "frames")
+	if err := os.RemoveAll(seqDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(seqDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create frames directory: %v", err)
+	}
+	defer os.RemoveAll(seqDir)
+
+	for i, frame := range frames {
+		target := filepath.Join(seqDir, fmt.Sprintf("%08d%s", i, ext))
+		abs, err := filepath.Abs(frame)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(abs, target); err != nil {
+			if err := os.Symlink(abs, target); err != nil {
+				return fmt.Errorf("failed to link frame %s: %v", frame, err)
+			}
+		}
+	}
+
+	fps := task.FPS
+	if fps <= 0 {
+		fps = DefaultImageSequenceFPS
+	}
+	slog.Info("Encoding image sequence",
+		slog.Int("video_id", task.VideoID),
+		slog.Int("frames", len(frames)),
+		slog.Float64("fps", fps))
+
+	output, err := runner.Run(context.Background(), imageSequenceArgs(seqDir, ext, fps, outputFile)...)
+	if err != nil {
+		return fmt.Errorf("failed to encode image sequence: %w", ffmpeg.ParseError(err, output))
+	}
+	return nil
+}
+
+// imageSequenceArgs are the ffmpeg options encoding the numbered frames of
+// seqDir into an H.264 MP4
+func imageSequenceArgs(seqDir, ext string, fps float64, outputFile string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs: []ffmpeg.Input{{
+			Format:  "image2",
+			Options: []string{"-framerate", strconv.FormatFloat(fps, 'f', -1, 64)},
+			File:    filepath.Join(seqDir, "%08d"+ext),
+		}},
+		Outputs: []ffmpeg.Output{{
+			VideoCodec: "libx264",
+			// libx264 with yuv420p needs even dimensions
+			VideoFilters: []string{"pad=ceil(iw/2)*2:ceil(ih/2)*2"},
+			Options:      []string{"-pix_fmt", "yuv420p"},
+			Format:       "mp4",
+			File:         outputFile,
+		}},
+	}.Args()
+}
+
+// findFrames returns the ordered frame files and their shared extension
+func (vc *VideoConverter) findFrames(task *VideoTask) ([]string, string, error) {
+	patterns := imageSequencePatterns
+	if task.ChunkLayout.Pattern != "" {
+		patterns = []string{task.ChunkLayout.Pattern}
+	}
+
+	for _, pattern := range patterns {
+		frameTask := *task
+		frameTask.ChunkLayout.Pattern = pattern
+		frames, _, err := vc.findChunks(&frameTask)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(frames[0]))
+		for _, frame := range frames {
+			if strings.ToLower(filepath.Ext(frame)) != ext {
+				return nil, "", fmt.Errorf("%w: image sequence mixes %s and %s frames", ErrInvalidTask, ext, filepath.Ext(frame))
+			}
+		}
+		return frames, ext, nil
+	}
+	return nil, "", fmt.Errorf("%w in %s", ErrNoFrames, task.Path)
+}
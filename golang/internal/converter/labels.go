@@ -0,0 +1,33 @@
+package converter
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// maxLabels is how many labels a task may have
+	maxLabels = 16
+	// maxLabelValueLength is the longest label value, in bytes
+	maxLabelValueLength = 255
+)
+
+// labelName matches label names: lowercase identifiers, like Prometheus
+// label names, so they can be attached to metrics as they are
+var labelName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// checkLabels returns an error for labels that can't be recorded
+func checkLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("%d labels, at most %d are allowed", len(labels), maxLabels)
+	}
+	for name, value := range labels {
+		if !labelName.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("label %s is %d bytes long, over %d", name, len(value), maxLabelValueLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputLayout names the MPEG-DASH output of a job in remote storage. Its
+// templates may use {tenant}, {video_id}, {profile} and {version}, which is
+// empty for the first version and "v2", "v3"... for the next ones; the
+// segment templates also take {rendition} and the DASH muxer's $Number$
+// and $Time$ identifiers. For example, with the Prefix
+// "{tenant}/{video_id}/{profile}" and the MediaSegment
+// "{rendition}/seg_$Number$.m4s", segments are stored as
+// {tenant}/{video_id}/{profile}/{rendition}/seg_$Number$.m4s.
+type OutputLayout struct {
+	// Prefix is the storage prefix the output of a version is uploaded to;
+	// without {version}, reprocessing replaces the previous version in place
+	Prefix string
+	// Manifest is the file name of the DASH manifest
+	Manifest string
+	// InitSegment and MediaSegment name the segments, relative to the
+	// manifest; the MediaConvert transcoder keeps its own segment names
+	InitSegment  string
+	MediaSegment string
+	// SingleFile names the one fragmented MP4 of each rendition of the
+	// profiles with OnDemand, relative to the manifest
+	SingleFile string
+	// OnDemand writes every profile as on demand, a single file per
+	// rendition, as if each had OnDemand set
+	OnDemand bool
+	// SegmentDuration is the target length of the segments, cut at the
+	// next keyframe; longer segments mean fewer, bigger files. The DASH
+	// muxer's default, 5s, when zero.
+	SegmentDuration time.Duration
+}
+
+// defaultSegmentDuration is the DASH muxer's segment duration
+const defaultSegmentDuration = 5 * time.Second
+
+// DefaultOutputLayout is the layout the CDN has always served:
+// {video_id}/mpeg-dash/output.mpd, with ffmpeg's own segment names
+var DefaultOutputLayout = OutputLayout{
+	Prefix:       "{video_id}/mpeg-dash/{version}",
+	Manifest:     "output.mpd",
+	InitSegment:  "init-stream{rendition}.m4s",
+	MediaSegment: "chunk-stream{rendition}-$Number%05d$.m4s",
+	SingleFile:   "stream{rendition}.mp4",
+}
+
+// withDefaults fills the templates left empty from DefaultOutputLayout
+func (l OutputLayout) withDefaults() OutputLayout {
+	if l.Prefix == "" {
+		l.Prefix = DefaultOutputLayout.Prefix
+	}
+	if l.Manifest == "" {
+		l.Manifest = DefaultOutputLayout.Manifest
+	}
+	if l.InitSegment == "" {
+		l.InitSegment = DefaultOutputLayout.InitSegment
+	}
+	if l.MediaSegment == "" {
+		l.MediaSegment = DefaultOutputLayout.MediaSegment
+	}
+	if l.SingleFile == "" {
+		l.SingleFile = DefaultOutputLayout.SingleFile
+	}
+	return l
+}
+
+// Validate reports templates the DASH muxer or the CDN can't use
+func (l OutputLayout) Validate() error {
+	l = l.withDefaults()
+	if strings.Contains(l.Manifest, "/") || path.Ext(l.Manifest) != ".mpd" {
+		return fmt.Errorf("manifest name %q must be a .mpd file name", l.Manifest)
+	}
+	if !strings.Contains(l.MediaSegment, "$Number") && !strings.Contains(l.MediaSegment, "$Time") {
+		return fmt.Errorf("media segment template %q must use $Number$ or $Time$", l.MediaSegment)
+	}
+	if segmentPattern.MatchString(l.InitSegment) {
+		return fmt.Errorf("init segment template %q can't use $Number$ or $Time$", l.InitSegment)
+	}
+	if segmentPattern.MatchString(l.SingleFile) {
+		return fmt.Errorf("single file template %q can't use $Number$ or $Time$", l.SingleFile)
+	}
+	for _, template := range []string{l.Prefix, l.InitSegment, l.MediaSegment, l.SingleFile} {
+		if path.IsAbs(template) || strings.Contains(template, "..") {
+			return fmt.Errorf("template %q must be a relative path", template)
+		}
+	}
+	if !strings.Contains(l.Prefix, "{video_id}") {
+		return errors.New("prefix template must use {video_id}, or videos would overwrite each other")
+	}
+	if l.SegmentDuration < 0 || (l.SegmentDuration > 0 && l.SegmentDuration < time.Second) {
+		return fmt.Errorf("segment duration %s must be at least 1s", l.SegmentDuration)
+	}
+	return nil
+}
+
+// WithOutputLayout sets where the output is stored and how its manifest and
+// segments are named; empty templates keep those of DefaultOutputLayout
+func WithOutputLayout(layout OutputLayout) Option {
+	return func(vc *VideoConverter) {
+		vc.outputLayout = layout.withDefaults()
+	}
+}
+
+// expand replaces the placeholders of a template for a version of a video
+// converted by the task; values can't add path segments of their own
+func expand(template string, task *VideoTask, videoID, version int) string {
+	clean := strings.NewReplacer("/", "_", "\\", "_")
+	return strings.NewReplacer(
+		"{tenant}", clean.Replace(task.Tenant),
+		"{video_id}", strconv.Itoa(videoID),
+		"{profile}", clean.Replace(profileName(task)),
+		"{version}", versionDir(version),
+		"{rendition}", "$RepresentationID$",
+	).Replace(template)
+}
+
+// prefix returns the storage prefix of a version of a video converted by
+// the task
+func (l OutputLayout) prefix(task *VideoTask, videoID, version int) string {
+	return path.Clean(expand(l.Prefix, task, videoID, version))
+}
+
+// segmentTemplates returns the templates naming the job's segments: the
+// single file of each rendition for on demand profiles, the init and
+// media segments otherwise
+func (l OutputLayout) segmentTemplates(job *Job) []string {
+	if job.Profile.OnDemand {
+		return []string{l.SingleFile}
+	}
+	return []string{l.InitSegment, l.MediaSegment}
+}
+
+// segmentArgs are the DASH muxer options naming and cutting the job's
+// segments
+func (l OutputLayout) segmentArgs(job *Job) []string {
+	var args []string
+	if l.SegmentDuration > 0 {
+		args = append(args, "-seg_duration", strconv.FormatFloat(l.SegmentDuration.Seconds(), 'f', -1, 64))
+	}
+	if job.Profile.OnDemand {
+		return append(args,
+			"-single_file", "1",
+			"-single_file_name", expand(l.SingleFile, job.Task, job.Task.VideoID, job.Version),
+			"-global_sidx", "1",
+		)
+	}
+	return append(args,
+		"-init_seg_name", expand(l.InitSegment, job.Task, job.Task.VideoID, job.Version),
+		"-media_seg_name", expand(l.MediaSegment, job.Task, job.Task.VideoID, job.Version),
+	)
+}
+
+// estimateSegments returns roughly how many segment files the job's
+// renditions take: an init segment and a media segment per segment
+// duration each, or a single file each when on demand
+func (l OutputLayout) estimateSegments(job *Job) int {
+	if job.Profile.OnDemand {
+		return representations(job)
+	}
+	duration := l.SegmentDuration
+	if duration <= 0 {
+		duration = defaultSegmentDuration
+	}
+	media := int(math.Ceil(job.Probe.DurationSeconds() / duration.Seconds()))
+	return representations(job) * (1 + media)
+}
+
+// segmentDirs returns the directories, relative to the manifest, the job's
+// segments are written to; the DASH muxer doesn't create them itself
+func (l OutputLayout) segmentDirs(job *Job) []string {
+	var dirs []string
+	for _, template := range l.segmentTemplates(job) {
+		name := expand(template, job.Task, job.Task.VideoID, job.Version)
+		for id := range representations(job) {
+			dir := path.Dir(strings.ReplaceAll(name, "$RepresentationID$", strconv.Itoa(id)))
+			if dir != "." {
+				dirs = append(dirs, filepath.FromSlash(dir))
+			}
+		}
+	}
+	return dirs
+}
+
+// representations returns how many representations the job's manifest
+// has: one per mapped stream
+func representations(job *Job) int {
+	if job.Mode == ModeAudioOnly {
+		return 1
+	}
+	count := 0
+	if job.Probe != nil && job.Probe.VideoStream() != nil {
+		count++
+	}
+	if job.Probe != nil && job.Probe.AudioStream() != nil {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,146 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// ErrLimitExceeded is wrapped by every LimitError
+var ErrLimitExceeded = errors.New("source exceeds limits")
+
+// Limits caps the sources a task may convert; zero fields don't limit
+type Limits struct {
+	MaxDurationSeconds float64 `json:"max_duration_seconds,omitempty"`
+	// MaxWidth and MaxHeight cap the resolution of the video stream
+	MaxWidth  int   `json:"max_width,omitempty"`
+	MaxHeight int   `json:"max_height,omitempty"`
+	MaxSize   int64 `json:"max_size,omitempty"`
+}
+
+// merge returns l with the limits set in override replacing its own
+func (l Limits) merge(override Limits) Limits {
+	if override.MaxDurationSeconds > 0 {
+		l.MaxDurationSeconds = override.MaxDurationSeconds
+	}
+	if override.MaxWidth > 0 {
+		l.MaxWidth = override.MaxWidth
+	}
+	if override.MaxHeight > 0 {
+		l.MaxHeight = override.MaxHeight
+	}
+	if override.MaxSize > 0 {
+		l.MaxSize = override.MaxSize
+	}
+	return l
+}
+
+// LimitPolicy chooses the limits of a task: the defaults, overridden by
+// those of the task's profile and then by those of its tenant
+type LimitPolicy struct {
+	Default  Limits            `json:"default"`
+	Profiles map[string]Limits `json:"profiles,omitempty"`
+	Tenants  map[string]Limits `json:"tenants,omitempty"`
+}
+
+// LoadLimitPolicy reads a LimitPolicy from a JSON file
+func LoadLimitPolicy(path string) (LimitPolicy, error) {
+	var policy LimitPolicy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse limits: %w", err)
+	}
+	return policy, nil
+}
+
+// For returns the limits applying to the task
+func (p LimitPolicy) For(task *VideoTask) Limits {
+	limits := p.Default.merge(p.Profiles[profileName(task)])
+	if task.Tenant != "" {
+		limits = limits.merge(p.Tenants[task.Tenant])
+	}
+	return limits
+}
+
+// WithLimits rejects tasks whose source exceeds the limits of the policy,
+// before it is merged and encoded
+func WithLimits(policy LimitPolicy) Option {
+	return func(vc *VideoConverter) {
+		vc.limits = policy
+	}
+}
+
+// Limit names reported by LimitError
+const (
+	LimitDuration   = "duration"
+	LimitResolution = "resolution"
+	LimitSize       = "size"
+)
+
+// LimitError is the permanent failure of a task whose source exceeds one
+// of its limits
+type LimitError struct {
+	Limit  string
+	Actual string
+	Max    string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s %s is over the maximum of %s", ErrLimitExceeded, e.Limit, e.Actual, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// checkSize rejects a source of size bytes that is too big for the task
+func (vc *VideoConverter) checkSize(task *VideoTask, size int64) error {
+	limits := vc.limits.For(task)
+	if limits.MaxSize > 0 && size > limits.MaxSize {
+		return &LimitError{Limit: LimitSize, Actual: strconv.FormatInt(size, 10), Max: strconv.FormatInt(limits.MaxSize, 10)}
+	}
+	return nil
+}
+
+// checkProbe rejects a source that is too long or too large for the task
+func (vc *VideoConverter) checkProbe(task *VideoTask, probe *ffmpeg.ProbeResult) error {
+	limits := vc.limits.For(task)
+	if seconds := probe.DurationSeconds(); limits.MaxDurationSeconds > 0 && seconds > limits.MaxDurationSeconds {
+		return &LimitError{
+			Limit:  LimitDuration,
+			Actual: time.Duration(seconds * float64(time.Second)).Round(time.Second).String(),
+			Max:    time.Duration(limits.MaxDurationSeconds * float64(time.Second)).Round(time.Second).String(),
+		}
+	}
+	video := probe.VideoStream()
+	if video == nil {
+		return nil
+	}
+	if (limits.MaxWidth > 0 && video.Width > limits.MaxWidth) || (limits.MaxHeight > 0 && video.Height > limits.MaxHeight) {
+		return &LimitError{
+			Limit:  LimitResolution,
+			Actual: fmt.Sprintf("%dx%d", video.Width, video.Height),
+			Max:    maxResolution(limits),
+		}
+	}
+	return nil
+}
+
+// maxResolution formats the resolution limits
+func maxResolution(limits Limits) string {
+	switch {
+	case limits.MaxWidth > 0 && limits.MaxHeight > 0:
+		return fmt.Sprintf("%dx%d", limits.MaxWidth, limits.MaxHeight)
+	case limits.MaxWidth > 0:
+		return fmt.Sprintf("%dpx wide", limits.MaxWidth)
+	}
+	return fmt.Sprintf("%dpx high", limits.MaxHeight)
+}
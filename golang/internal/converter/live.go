@@ -0,0 +1,446 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imersaofc/internal/events"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/storage"
+)
+
+// DefaultUTCTimingURL is the clock low latency players sync with, as
+// signaled in the live manifest
+const DefaultUTCTimingURL = "https://time.akamai.com/?iso"
+
+// ErrLiveInput is returned for a live input other than an RTMP or SRT URL
+var ErrLiveInput = errors.New("live input must be an rtmp:// or srt:// url")
+
+// LiveStream is a live ingest: the converter waits for the encoder on
+// Input and packages what it receives as low latency DASH, with an HLS
+// playlist next to the manifest, uploading a sliding window of segments
+// as the stream goes. The output is stored like the first version of the
+// video, see OutputLayout.
+type LiveStream struct {
+	VideoID int
+	// Input is where the encoder publishes: rtmp://0.0.0.0:1935/live/{key}
+	// listens for an RTMP push, srt://0.0.0.0:9000?mode=listener for SRT
+	Input   string
+	Profile string
+	Tenant  string
+	// Dir holds the packaged output until it is uploaded, a directory of
+	// the system's temp dir when empty; it is removed when the stream ends
+	// unless the converter has no uploader, and then serves the stream
+	Dir string
+	// SegmentDuration is the length of a segment, 2s when zero
+	SegmentDuration time.Duration
+	// Window is how many segments the manifest lists, 10 when zero; as
+	// many again stay in storage behind it for players running late
+	Window int
+	// UTCTimingURL is the clock signaled in the manifest,
+	// DefaultUTCTimingURL when empty
+	UTCTimingURL string
+	// Archive records the stream as received and, once it ends, converts
+	// the recording like an upload, see archiveLive
+	Archive bool
+	// ArchiveDir holds the recording, a directory of the system's temp dir
+	// when empty
+	ArchiveDir string
+	// ArchiveProfile is the profile the recording is converted with,
+	// Profile when empty
+	ArchiveProfile string
+}
+
+// RunLive packages the live stream until the encoder disconnects or ctx is
+// done. Object storage can't serve a segment still being written, so
+// segments are uploaded once complete while the manifest is uploaded
+// every time it changes; players reading the manifest ahead of the
+// upload retry the newest segment.
+func (vc *VideoConverter) RunLive(ctx context.Context, stream LiveStream) error {
+	input, err := url.Parse(stream.Input)
+	if err != nil || (input.Scheme != "rtmp" && input.Scheme != "rtmps" && input.Scheme != "srt") {
+		return ErrLiveInput
+	}
+	if stream.VideoID <= 0 {
+		return fmt.Errorf("%w: live stream without a video_id", ErrInvalidTask)
+	}
+	if stream.SegmentDuration <= 0 {
+		stream.SegmentDuration = 2 * time.Second
+	}
+	if stream.Window <= 0 {
+		stream.Window = 10
+	}
+	if stream.UTCTimingURL == "" {
+		stream.UTCTimingURL = DefaultUTCTimingURL
+	}
+	if stream.Dir == "" {
+		stream.Dir = filepath.Join(os.TempDir(), "live", strconv.Itoa(stream.VideoID))
+	}
+	if stream.ArchiveDir == "" {
+		stream.ArchiveDir = filepath.Join(os.TempDir(), "live-archive", strconv.Itoa(stream.VideoID))
+	}
+
+	job := &Job{
+		Task:      &VideoTask{VideoID: stream.VideoID, Profile: stream.Profile, Tenant: stream.Tenant},
+		OutputDir: stream.Dir,
+		Version:   1,
+		StartedAt: time.Now(),
+	}
+	profile, err := vc.profile(job.Task)
+	if err != nil {
+		return err
+	}
+	job.Profile = profile
+	job.Manifest = filepath.Join(stream.Dir, vc.outputLayout.Manifest)
+	job.Prefix = vc.outputLayout.prefix(job.Task, stream.VideoID, job.Version)
+
+	// Leftovers of a previous run would be uploaded into this one
+	if err := os.RemoveAll(stream.Dir); err != nil {
+		return fmt.Errorf("failed to clean live dir: %v", err)
+	}
+	for _, dir := range append(vc.liveSegmentDirs(job), "") {
+		if err := os.MkdirAll(filepath.Join(stream.Dir, dir), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create live dir: %v", err)
+		}
+	}
+	if stream.Archive {
+		if err := os.RemoveAll(stream.ArchiveDir); err != nil {
+			return fmt.Errorf("failed to clean live archive dir: %v", err)
+		}
+		if err := os.MkdirAll(stream.ArchiveDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create live archive dir: %v", err)
+		}
+	}
+
+	mirror := &liveSync{
+		uploader: vc.uploader,
+		dir:      stream.Dir,
+		prefix:   job.Prefix,
+		// Fragments are flushed four times per segment, a segment left
+		// alone for two of them is complete
+		settle:   stream.SegmentDuration / 2,
+		uploaded: make(map[string]time.Time),
+	}
+
+	slog.Info("Starting live stream",
+		slog.Int("video_id", stream.VideoID),
+		slog.String("input", input.Scheme+"://"+input.Host),
+		slog.String("prefix", job.Prefix))
+	vc.events.Publish(events.LiveStarted{VideoID: stream.VideoID, Prefix: job.Prefix, At: time.Now()})
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- vc.runLiveFFmpeg(runCtx, vc.liveArgs(stream, job))
+	}()
+
+	ticker := time.NewTicker(stream.SegmentDuration / 4)
+	defer ticker.Stop()
+	var runErr error
+loop:
+	for {
+		select {
+		case runErr = <-done:
+			break loop
+		case <-ticker.C:
+			if err := mirror.run(ctx, false); err != nil {
+				slog.Warn("Failed to upload live output, retrying",
+					slog.Int("video_id", stream.VideoID),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+	// Stopping the stream isn't a failure of it
+	if ctx.Err() != nil {
+		runErr = nil
+	}
+
+	// Everything left is complete now; the last upload goes on even if ctx
+	// stopped the stream, so storage ends with the final manifest
+	syncCtx, cancelSync := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancelSync()
+	if err := mirror.run(syncCtx, true); err != nil && runErr == nil {
+		runErr = fmt.Errorf("failed to upload live output: %w", err)
+	}
+	if vc.uploader != nil {
+		os.RemoveAll(stream.Dir)
+	}
+
+	vc.events.Publish(events.LiveStopped{
+		VideoID:  stream.VideoID,
+		Segments: mirror.segments,
+		Duration: time.Since(job.StartedAt),
+		Err:      runErr,
+		At:       time.Now(),
+	})
+	slog.Info("Live stream stopped",
+		slog.Int("video_id", stream.VideoID),
+		slog.Int("segments", mirror.segments),
+		slog.Duration("duration", time.Since(job.StartedAt)))
+
+	// The recording is complete even if the stream failed midway
+	if stream.Archive {
+		if err := vc.archiveLive(context.WithoutCancel(ctx), stream); err != nil {
+			return errors.Join(runErr, fmt.Errorf("failed to archive live stream: %w", err))
+		}
+	}
+	return runErr
+}
+
+// liveArgs are the ffmpeg options receiving the stream and packaging it as
+// low latency DASH and HLS with a sliding window
+func (vc *VideoConverter) liveArgs(stream LiveStream, job *Job) []string {
+	segment := strconv.FormatFloat(stream.SegmentDuration.Seconds(), 'f', -1, 64)
+	fragment := strconv.FormatFloat(stream.SegmentDuration.Seconds()/4, 'f', -1, 64)
+	window := strconv.Itoa(stream.Window)
+
+	var args []string
+	if strings.HasPrefix(stream.Input, "rtmp") {
+		args = append(args, "-listen", "1")
+	}
+	args = append(args, "-i", stream.Input, "-map", "0:v:0", "-map", "0:a:0?")
+	args = append(args, liveCodecArgs(job.Profile, segment)...)
+	// $Time$ segment names need the timeline in the manifest
+	timeline := "0"
+	if strings.Contains(vc.outputLayout.MediaSegment, "$Time") {
+		timeline = "1"
+	}
+	args = append(args,
+		"-f", "dash",
+		"-ldash", "1",
+		"-streaming", "1",
+		"-use_template", "1",
+		"-use_timeline", timeline,
+		"-seg_duration", segment,
+		"-frag_type", "duration",
+		"-frag_duration", fragment,
+		"-window_size", window,
+		"-extra_window_size", window,
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		"-utc_timing_url", stream.UTCTimingURL,
+		"-hls_playlist", "1",
+		"-lhls", "1",
+	)
+	args = append(args, vc.outputLayout.segmentArgs(job)...)
+	args = append(args, job.Manifest)
+	if stream.Archive {
+		args = append(args, liveArchiveArgs(stream.ArchiveDir)...)
+	}
+	return args
+}
+
+// liveCodecArgs returns the encoder options of the profile for a live
+// stream. The source can't be probed ahead, so unless the profile copies
+// it is encoded to H.264/AAC with a keyframe starting every segment.
+func liveCodecArgs(profile Profile, segment string) []string {
+	videoCodec := profile.VideoCodec
+	if videoCodec == "" {
+		videoCodec = "libx264"
+	}
+	args := []string{"-c:v", videoCodec}
+	if videoCodec != "copy" {
+		preset := profile.Preset
+		if preset == "" && videoCodec == "libx264" {
+			preset = "veryfast"
+		}
+		if preset != "" {
+			args = append(args, "-preset", preset)
+		}
+		if videoCodec == "libx264" {
+			args = append(args, "-tune", "zerolatency", "-sc_threshold", "0")
+		}
+		if profile.VideoBitrate != "" {
+			args = append(args, "-b:v", profile.VideoBitrate)
+		}
+		if profile.CRF > 0 {
+			args = append(args, "-crf", strconv.Itoa(profile.CRF))
+		}
+		// The stream isn't probed, its size is unknown
+		if filters := scaleFilters(&ffmpeg.Stream{}, profile); len(filters) > 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		args = append(args, "-force_key_frames", "expr:gte(t,n_forced*"+segment+")")
+	}
+	audioCodec := profile.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "aac"
+	}
+	args = append(args, "-c:a", audioCodec)
+	if audioCodec != "copy" && profile.AudioBitrate != "" {
+		args = append(args, "-b:a", profile.AudioBitrate)
+	}
+	return args
+}
+
+// liveSegmentDirs returns the directories the live segments are written
+// to: the stream has a video and an audio representation
+func (vc *VideoConverter) liveSegmentDirs(job *Job) []string {
+	job.Probe = &ffmpeg.ProbeResult{Streams: []ffmpeg.Stream{{CodecType: "video"}, {CodecType: "audio"}}}
+	defer func() { job.Probe = nil }()
+	return vc.outputLayout.segmentDirs(job)
+}
+
+// runLiveFFmpeg runs ffmpeg until the stream ends, keeping the end of its
+// output to explain a failure
+func (vc *VideoConverter) runLiveFFmpeg(ctx context.Context, args []string) error {
+	streamer, ok := vc.runner.(ffmpeg.Streamer)
+	if !ok {
+		output, err := vc.runner.Run(ctx, args...)
+		if err != nil {
+			return ffmpeg.ParseError(err, output)
+		}
+		return nil
+	}
+	tail := &tailWriter{max: 16 << 10}
+	if err := streamer.Stream(ctx, tail, args...); err != nil {
+		return ffmpeg.ParseError(err, tail.bytes())
+	}
+	return nil
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = append([]byte(nil), w.buf[len(w.buf)-w.max:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.buf...)
+}
+
+// liveSync mirrors the live output dir to storage: complete segments once,
+// manifests and playlists whenever they change, and segments ffmpeg
+// removed from the window are deleted from storage too
+type liveSync struct {
+	uploader storage.Uploader
+	dir      string
+	prefix   string
+	settle   time.Duration
+	// uploaded maps the files in storage, relative to dir, to the
+	// modification time they were uploaded at
+	uploaded map[string]time.Time
+	segments int
+	noDelete bool
+}
+
+// run uploads what changed since the last run; final uploads the segments
+// still being written too, as ffmpeg is done with them
+func (s *liveSync) run(ctx context.Context, final bool) error {
+	if s.uploader == nil {
+		return nil
+	}
+	var segments, playlists []string
+	present := make(map[string]time.Time)
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// Manifests are written to a temporary file and renamed
+		if strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		present[rel] = info.ModTime()
+		if uploaded, ok := s.uploaded[rel]; ok && uploaded.Equal(info.ModTime()) {
+			return nil
+		}
+		if isPlaylist(rel) {
+			playlists = append(playlists, rel)
+		} else if final || time.Since(info.ModTime()) >= s.settle {
+			segments = append(segments, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Segments go first, so the manifests never list a complete segment
+	// missing from storage
+	for _, rel := range append(segments, playlists...) {
+		if err := s.uploader.Upload(ctx, filepath.Join(s.dir, rel), s.key(rel)); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if _, ok := s.uploaded[rel]; !ok && !isPlaylist(rel) {
+			s.segments++
+		}
+		s.uploaded[rel] = present[rel]
+	}
+
+	for rel := range s.uploaded {
+		if _, ok := present[rel]; ok {
+			continue
+		}
+		delete(s.uploaded, rel)
+		if err := s.remove(ctx, rel); err != nil {
+			slog.Warn("Failed to delete live segment",
+				slog.String("key", s.key(rel)),
+				slog.String("error", err.Error()))
+		}
+	}
+	return nil
+}
+
+// remove deletes a segment that left the window from storage, when the
+// uploader can delete
+func (s *liveSync) remove(ctx context.Context, rel string) error {
+	deleter, ok := s.uploader.(storage.Deleter)
+	if !ok || s.noDelete {
+		return nil
+	}
+	err := deleter.Delete(ctx, s.key(rel))
+	if errors.Is(err, errors.ErrUnsupported) {
+		slog.Info("Storage backend can't delete, live segments are kept",
+			slog.String("prefix", s.prefix))
+		s.noDelete = true
+		return nil
+	}
+	return err
+}
+
+func (s *liveSync) key(rel string) string {
+	return path.Join(s.prefix, filepath.ToSlash(rel))
+}
+
+func isPlaylist(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".mpd" || ext == ".m3u8"
+}
@@ -0,0 +1,116 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// LiveArchiveFile is the file, in the archive dir, a live stream's
+// recording is stitched into
+const LiveArchiveFile = "archive.mkv"
+
+// ErrNoLiveArchive is returned when a live stream ended without recording anything
+var ErrNoLiveArchive = errors.New("live stream recorded nothing")
+
+// liveArchivePattern names the recording's segments; they sort in order
+const liveArchivePattern = "rec-%05d.ts"
+
+// liveArchiveArgs are the ffmpeg options recording the stream as received,
+// in minute long MPEG-TS segments: a crash loses at most the last one
+func liveArchiveArgs(dir string) []string {
+	return []string{
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_time", "60",
+		"-segment_format", "mpegts",
+		"-reset_timestamps", "0",
+		filepath.Join(dir, liveArchivePattern),
+	}
+}
+
+// archiveLive turns the recording of an ended live stream into a VOD
+// asset: the segments are stitched into LiveArchiveFile, which is then
+// converted through the pipeline with the profile's ladder, publishing
+// the completion event like for an upload. It is converted as a reprocess,
+// so it doesn't need the video to be new and, when it is, replaces the
+// live output in place.
+func (vc *VideoConverter) archiveLive(ctx context.Context, stream LiveStream) error {
+	slog.Info("Archiving live stream", slog.Int("video_id", stream.VideoID), slog.String("path", stream.ArchiveDir))
+	if err := vc.stitchLiveArchive(ctx, stream.ArchiveDir); err != nil {
+		return err
+	}
+
+	profile := stream.ArchiveProfile
+	if profile == "" {
+		profile = stream.Profile
+	}
+	task := VideoTask{
+		VideoID:    stream.VideoID,
+		Path:       stream.ArchiveDir,
+		SourceFile: LiveArchiveFile,
+		Profile:    profile,
+		Tenant:     stream.Tenant,
+		Reprocess:  true,
+	}
+	msg, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	if result := vc.Handle(ctx, msg); result.Outcome != OutcomeSuccess {
+		return result.Err
+	}
+	if vc.uploader != nil {
+		os.RemoveAll(stream.ArchiveDir)
+	}
+	return nil
+}
+
+// stitchLiveArchive joins the recorded segments of dir, in order, into
+// LiveArchiveFile without re-encoding, and removes them
+func (vc *VideoConverter) stitchLiveArchive(ctx context.Context, dir string) error {
+	segments, err := filepath.Glob(filepath.Join(dir, "rec-*.ts"))
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return ErrNoLiveArchive
+	}
+	sort.Strings(segments)
+
+	// The concat demuxer resolves the names relative to the list
+	var list strings.Builder
+	for _, segment := range segments {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(filepath.Base(segment), "'", `'\''`))
+	}
+	listFile := filepath.Join(dir, "segments.txt")
+	if err := os.WriteFile(listFile, []byte(list.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write segment list: %v", err)
+	}
+	defer os.Remove(listFile)
+
+	output, err := vc.runner.Run(ctx,
+		"-y",
+		"-f", "concat", "-safe", "0",
+		"-i", listFile,
+		"-map", "0", "-c", "copy",
+		filepath.Join(dir, LiveArchiveFile),
+	)
+	if err != nil {
+		return ffmpeg.ParseError(err, output)
+	}
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+	slog.Info("Live recording stitched", slog.String("path", dir), slog.Int("segments", len(segments)))
+	return nil
+}
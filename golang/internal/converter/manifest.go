@@ -0,0 +1,89 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFile is the name of the upload manifest written next to the chunks
+const ManifestFile = "upload_manifest.json"
+
+// ErrManifestMismatch is returned when the chunks on disk don't match the upload manifest
+var ErrManifestMismatch = errors.New("upload does not match manifest")
+
+// UploadManifest describes the chunks an uploader wrote for a video
+type UploadManifest struct {
+	OriginalFilename string          `json:"original_filename"`
+	SHA256           string          `json:"sha256,omitempty"` // hash of the whole file, optional
+	ChunkCount       int             `json:"chunk_count"`
+	Chunks           []ManifestChunk `json:"chunks"`
+}
+
+// ManifestChunk describes a single uploaded chunk
+type ManifestChunk struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name,omitempty"` // file name; defaults to "{index}.chunk"
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReadManifest loads the upload manifest from dir; it returns nil when the uploader didn't write one
+func ReadManifest(dir string) (*UploadManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload manifest: %w", err)
+	}
+	var manifest UploadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse upload manifest: %w", err)
+	}
+	if manifest.ChunkCount != len(manifest.Chunks) {
+		return nil, fmt.Errorf("%w: chunk_count is %d but %d chunks are listed",
+			ErrManifestMismatch, manifest.ChunkCount, len(manifest.Chunks))
+	}
+	return &manifest, nil
+}
+
+// WriteManifest stores the manifest in dir
+func WriteManifest(dir string, manifest UploadManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0o644)
+}
+
+// chunkPaths returns the chunk files in manifest order, checking every chunk
+// exists with the expected size
+func (m *UploadManifest) chunkPaths(dir string) ([]string, error) {
+	paths := make([]string, 0, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		if chunk.Index != i {
+			return nil, fmt.Errorf("%w: chunk %d listed at position %d", ErrManifestMismatch, chunk.Index, i)
+		}
+		name := chunk.Name
+		if name == "" {
+			name = fmt.Sprintf("%d.chunk", chunk.Index)
+		}
+		p := filepath.Join(dir, filepath.Base(name))
+		info, err := os.Stat(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: missing chunk %d", ErrManifestMismatch, chunk.Index)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != chunk.Size {
+			return nil, fmt.Errorf("%w: chunk %d has %d bytes, expected %d",
+				ErrManifestMismatch, chunk.Index, info.Size(), chunk.Size)
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package converter
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// memoryFile creates an anonymous file held in memory, which no other
+// process can open by path and which is freed once closed
+func memoryFile(name string) (*os.File, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package converter
+
+import (
+	"errors"
+	"os"
+)
+
+func memoryFile(name string) (*os.File, error) {
+	return nil, errors.New("workspace encryption is only supported on linux")
+}
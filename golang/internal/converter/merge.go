@@ -0,0 +1,229 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// mergeBufferSize is the size of the pooled buffers used to copy chunks
+	mergeBufferSize = 1024 * 1024
+	// mergeCheckpointBytes is how much data is merged between progress checkpoints
+	mergeCheckpointBytes = 256 * 1024 * 1024
+)
+
+// mergeBuffers reuses copy buffers across merges
+var mergeBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, mergeBufferSize)
+		return &buf
+	},
+}
+
+// Método para extrair o número do nome do arquivo
+func (vc *VideoConverter) extractNumber(fileName string) int {
+	re := regexp.MustCompile(`\d+`)
+	numStr := re.FindString(filepath.Base(fileName)) // Pega o nome do arquivo, sem o caminho
+	num, err := strconv.Atoi(numStr)
+	if err != nil {
+		return -1
+	}
+	return num
+}
+
+// Método para mesclar os chunks; retorna o sha256 do arquivo final
+func (vc *VideoConverter) mergeChunks(task *VideoTask, outputFile string) (string, error) {
+	// Buscar os chunks na ordem definida pela task, manifesto ou padrão configurado
+	chunks, manifest, err := vc.findChunks(task)
+	if err != nil {
+		return "", err
+	}
+	if len(chunks) == 0 {
+		return "", fmt.Errorf("%w in %s", ErrNoChunks, task.Path)
+	}
+
+	// Somar o tamanho dos chunks para reportar o progresso
+	sizes := make([]int64, len(chunks))
+	var total int64
+	for i, chunk := range chunks {
+		info, err := os.Stat(chunk)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat chunk: %v", err)
+		}
+		sizes[i] = info.Size()
+		total += info.Size()
+	}
+	if err := vc.checkSize(task, total); err != nil {
+		return "", err
+	}
+
+	// Retomar um merge interrompido a partir do último checkpoint
+	progressFile := outputFile + ".progress"
+	progress := loadMergeProgress(progressFile, outputFile, len(chunks), total)
+	output, err := os.OpenFile(outputFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer output.Close()
+	if err := output.Truncate(progress.Offset); err != nil {
+		return "", fmt.Errorf("failed to truncate output file: %v", err)
+	}
+
+	// O hash do arquivo completo precisa incluir os bytes já mesclados
+	fileHash := sha256.New()
+	if _, err := io.CopyN(fileHash, output, progress.Offset); err != nil {
+		return "", fmt.Errorf("failed to hash resumed output: %v", err)
+	}
+	if _, err := output.Seek(progress.Offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to seek output file: %v", err)
+	}
+	if progress.Chunk > 0 {
+		slog.Info("Resuming merge",
+			slog.Int("video_id", task.VideoID),
+			slog.Int("chunk", progress.Chunk),
+			slog.Int64("offset", progress.Offset))
+	}
+
+	bufPtr := mergeBuffers.Get().(*[]byte)
+	defer mergeBuffers.Put(bufPtr)
+
+	// Ler cada chunk e escrever no arquivo final
+	merged := progress.Offset
+	lastCheckpoint := merged
+	lastReported := -1
+	for i := progress.Chunk; i < len(chunks); i++ {
+		chunk := chunks[i]
+		written, sum, err := copyChunk(output, chunk, *bufPtr, manifest != nil, fileHash)
+		if err != nil {
+			return "", err
+		}
+		if written != sizes[i] {
+			return "", fmt.Errorf("short write for chunk %s: wrote %d of %d bytes", chunk, written, sizes[i])
+		}
+		if manifest != nil && manifest.Chunks[i].SHA256 != "" && !strings.EqualFold(sum, manifest.Chunks[i].SHA256) {
+			return "", fmt.Errorf("%w: checksum mismatch for chunk %d", ErrManifestMismatch, manifest.Chunks[i].Index)
+		}
+		merged += written
+
+		// Salvar um checkpoint periodicamente, com os dados já no disco
+		if merged-lastCheckpoint >= mergeCheckpointBytes {
+			if err := output.Sync(); err != nil {
+				return "", fmt.Errorf("failed to sync merged file: %v", err)
+			}
+			progress = mergeProgress{Chunk: i + 1, Offset: merged, ChunkCount: len(chunks), TotalSize: total}
+			if err := progress.save(progressFile); err != nil {
+				slog.Warn("Error saving merge progress", slog.String("path", progressFile), slog.String("error", err.Error()))
+			}
+			lastCheckpoint = merged
+		}
+
+		// Reportar o progresso a cada 10%
+		if percent := int(merged * 100 / max(total, 1)); percent/10 > lastReported/10 {
+			lastReported = percent
+			slog.Info("Merge progress",
+				slog.Int("video_id", task.VideoID),
+				slog.Int("percent", percent),
+				slog.Int("chunks", i+1),
+				slog.Int64("bytes", merged))
+		}
+	}
+
+	// Garantir que os dados estão no disco antes de chamar o ffmpeg
+	if err := output.Sync(); err != nil {
+		return "", fmt.Errorf("failed to sync merged file: %v", err)
+	}
+	os.Remove(progressFile)
+
+	// Validar o hash do arquivo completo contra o manifesto
+	sum := hex.EncodeToString(fileHash.Sum(nil))
+	if manifest != nil && manifest.SHA256 != "" && !strings.EqualFold(sum, manifest.SHA256) {
+		return "", fmt.Errorf("%w: checksum mismatch for merged file", ErrManifestMismatch)
+	}
+
+	// Um arquivo final minúsculo indica chunks vazios ou truncados
+	if merged < vc.minMergedSize {
+		return "", fmt.Errorf("%w: %d bytes, expected at least %d", ErrMergedTooSmall, merged, vc.minMergedSize)
+	}
+	return sum, nil
+}
+
+// copyChunk appends a chunk to output using buf, returning the bytes copied
+// and, when checksum is set, the chunk's hex sha256. The data is also
+// written to fileHash when it isn't nil.
+func copyChunk(output io.Writer, chunk string, buf []byte, checksum bool, fileHash hash.Hash) (int64, string, error) {
+	input, err := os.Open(chunk)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open chunk: %v", err)
+	}
+	defer input.Close()
+
+	writers := []io.Writer{output}
+	chunkHash := sha256.New()
+	if checksum {
+		writers = append(writers, chunkHash)
+	}
+	if fileHash != nil {
+		writers = append(writers, fileHash)
+	}
+
+	// Esconder o ReadFrom do *os.File para que o CopyBuffer use o buffer do pool
+	dst := struct{ io.Writer }{io.MultiWriter(writers...)}
+	written, err := io.CopyBuffer(dst, input, buf)
+	if err != nil {
+		return written, "", fmt.Errorf("failed to write chunk %s to merged file: %v", chunk, err)
+	}
+	return written, hex.EncodeToString(chunkHash.Sum(nil)), nil
+}
+
+// mergeProgress is the checkpoint of an interrupted merge
+type mergeProgress struct {
+	Chunk      int   `json:"chunk"`  // next chunk to merge
+	Offset     int64 `json:"offset"` // bytes of the output known to be on disk
+	ChunkCount int   `json:"chunk_count"`
+	TotalSize  int64 `json:"total_size"`
+}
+
+// loadMergeProgress returns the saved checkpoint when it still matches the
+// chunks and the output file, or a zero checkpoint to start over
+func loadMergeProgress(progressFile, outputFile string, chunkCount int, totalSize int64) mergeProgress {
+	var progress mergeProgress
+	data, err := os.ReadFile(progressFile)
+	if err != nil {
+		return mergeProgress{}
+	}
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return mergeProgress{}
+	}
+	if progress.ChunkCount != chunkCount || progress.TotalSize != totalSize || progress.Chunk > chunkCount {
+		return mergeProgress{}
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil || info.Size() < progress.Offset {
+		return mergeProgress{}
+	}
+	return progress
+}
+
+// save writes the checkpoint atomically
+func (p mergeProgress) save(progressFile string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := progressFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, progressFile)
+}
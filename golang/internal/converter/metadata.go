@@ -0,0 +1,171 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// metadataNamespace is the XML namespace of the custom tags written to the
+// DASH manifest's ProgramInformation
+const metadataNamespace = "urn:imersaofc:metadata:2024"
+
+var (
+	// languageTag matches the ISO 639 and BCP 47 language tags kept from
+	// the source's audio stream
+	languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+	// metadataKey matches the keys of custom tags
+	metadataKey = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+	// programInformationPattern matches the ProgramInformation ffmpeg
+	// writes, replaced by the task's
+	programInformationPattern = regexp.MustCompile(`(?s)\s*<ProgramInformation\b[^>]*(/>|>.*?</ProgramInformation>)`)
+	mpdStartPattern           = regexp.MustCompile(`<MPD\b[^>]*>`)
+)
+
+// OutputMetadata is metadata of the task embedded into its outputs: tagged
+// in the containers and written to the DASH manifest's ProgramInformation
+type OutputMetadata struct {
+	Title     string `json:"title,omitempty"`
+	Copyright string `json:"copyright,omitempty"`
+	// Tenant defaults to the task's Tenant
+	Tenant string `json:"tenant,omitempty"`
+	// Tags are custom key/values, keys made of letters, digits, dots,
+	// dashes and underscores
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// WithSourceMetadata keeps the metadata of the sources in the outputs. By
+// default it is stripped, since phone uploads carry the GPS coordinates of
+// the recording, the device's make, model and serial and its software in
+// their QuickTime and EXIF tags, which would otherwise be published with
+// the segments.
+func WithSourceMetadata() Option {
+	return func(vc *VideoConverter) {
+		vc.keepMetadata = true
+	}
+}
+
+// metadataArgs are the ffmpeg output options dropping the global and
+// per-stream metadata of the source, unless the converter keeps it, and
+// tagging the output with the embedded metadata, nil when there is none.
+// The language of the audio stream, when tagged, is the only source tag
+// kept, as players pick tracks by it; audio is the source's audio stream,
+// nil when the output has none.
+func (vc *VideoConverter) metadataArgs(audio *ffmpeg.Stream, embedded *OutputMetadata) []string {
+	var args []string
+	if !vc.keepMetadata {
+		args = append(args, "-map_metadata", "-1", "-map_metadata:s", "-1")
+		if audio != nil {
+			if language := audio.Tags["language"]; language != "und" && languageTag.MatchString(language) {
+				args = append(args, "-metadata:s:a:0", "language="+language)
+			}
+		}
+	}
+	for _, tag := range embedded.pairs() {
+		args = append(args, "-metadata", tag[0]+"="+tag[1])
+	}
+	return args
+}
+
+// outputMetadata is the metadata embedded into the task's outputs, nil
+// when it has none
+func (t *VideoTask) outputMetadata() *OutputMetadata {
+	if t.Metadata == nil {
+		return nil
+	}
+	m := *t.Metadata
+	if m.Tenant == "" {
+		m.Tenant = t.Tenant
+	}
+	return &m
+}
+
+// check validates the keys of the custom tags
+func (m *OutputMetadata) check() error {
+	if m == nil {
+		return nil
+	}
+	for key := range m.Tags {
+		if !metadataKey.MatchString(key) {
+			return fmt.Errorf("invalid metadata tag %q", key)
+		}
+		if key == "title" || key == "copyright" || key == "tenant" {
+			return fmt.Errorf("metadata tag %q must be set with its own field", key)
+		}
+	}
+	return nil
+}
+
+// pairs are the set key/values of the metadata: title, copyright and
+// tenant first, then the custom tags by key
+func (m *OutputMetadata) pairs() [][2]string {
+	if m == nil {
+		return nil
+	}
+	var pairs [][2]string
+	for _, tag := range [][2]string{{"title", m.Title}, {"copyright", m.Copyright}, {"tenant", m.Tenant}} {
+		if tag[1] != "" {
+			pairs = append(pairs, tag)
+		}
+	}
+	keys := make([]string, 0, len(m.Tags))
+	for key := range m.Tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		pairs = append(pairs, [2]string{key, m.Tags[key]})
+	}
+	return pairs
+}
+
+// setProgramInformation replaces the ProgramInformation of the manifest
+// with the metadata's: its title and copyright, and its tenant and custom
+// tags as elements of metadataNamespace
+func setProgramInformation(manifest string, m *OutputMetadata) error {
+	mpd, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	mpd = programInformationPattern.ReplaceAll(mpd, nil)
+	loc := mpdStartPattern.FindIndex(mpd)
+	if loc == nil {
+		return errors.New("no MPD element in the manifest")
+	}
+
+	var info strings.Builder
+	info.WriteString("\n\t<ProgramInformation>")
+	if m.Title != "" {
+		fmt.Fprintf(&info, "\n\t\t<Title>%s</Title>", escapeXML(m.Title))
+	}
+	if m.Copyright != "" {
+		fmt.Fprintf(&info, "\n\t\t<Copyright>%s</Copyright>", escapeXML(m.Copyright))
+	}
+	for _, tag := range m.pairs() {
+		if tag[0] == "title" || tag[0] == "copyright" {
+			continue
+		}
+		fmt.Fprintf(&info, "\n\t\t<vc:Tag xmlns:vc=\"%s\" key=\"%s\">%s</vc:Tag>", metadataNamespace, escapeXML(tag[0]), escapeXML(tag[1]))
+	}
+	info.WriteString("\n\t</ProgramInformation>")
+
+	var updated bytes.Buffer
+	updated.Write(mpd[:loc[1]])
+	updated.WriteString(info.String())
+	updated.Write(mpd[loc[1]:])
+	return os.WriteFile(manifest, updated.Bytes(), 0o644)
+}
+
+// escapeXML escapes s as XML text or attribute value
+func escapeXML(s string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
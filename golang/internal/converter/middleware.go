@@ -0,0 +1,113 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Handler handles a task message and reports how the consumer should settle
+// it; ctx is the delivery's, done when the consumer shuts down
+type Handler func(ctx context.Context, msg []byte) Result
+
+// Middleware wraps a Handler with a cross-cutting concern
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the middlewares; the first one is the outermost
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// taskID reads the video id of a message for logging, or 0 when it isn't valid
+func taskID(msg []byte) int {
+	var task VideoTask
+	json.Unmarshal(msg, &task)
+	return task.VideoID
+}
+
+// Logging logs when each task starts and how it finished
+func Logging(next Handler) Handler {
+	return func(ctx context.Context, msg []byte) Result {
+		videoID := taskID(msg)
+		start := time.Now()
+		slog.Info("Task started", slog.Int("video_id", videoID))
+
+		result := next(ctx, msg)
+
+		attrs := []any{
+			slog.Int("video_id", videoID),
+			slog.String("outcome", result.Outcome.String()),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if result.Err != nil {
+			attrs = append(attrs, slog.String("error", result.Err.Error()))
+		}
+		slog.Info("Task finished", attrs...)
+		return result
+	}
+}
+
+// Observe calls fn with the result and duration of each task, e.g. to record metrics
+func Observe(fn func(result Result, duration time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg []byte) Result {
+			start := time.Now()
+			result := next(ctx, msg)
+			fn(result, time.Since(start))
+			return result
+		}
+	}
+}
+
+// SkipProcessed acknowledges tasks for videos that were already processed
+// without running the rest of the chain; reprocessing and dry runs go through
+func SkipProcessed(repo Repository) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg []byte) Result {
+			var task VideoTask
+			if err := json.Unmarshal(msg, &task); err != nil || task.Reprocess || task.DryRun {
+				return next(ctx, msg)
+			}
+			processed, err := repo.IsProcessed(ctx, task.VideoID)
+			if err != nil {
+				slog.Error("Error checking if video is processed", slog.Int("video_id", task.VideoID), slog.String("error", err.Error()))
+			}
+			if processed {
+				slog.Warn("Video already processed", slog.Int("video_id", task.VideoID))
+				return Success()
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// recoverPanics turns a panic in the rest of the chain into a permanent
+// failure recorded with its stack trace, so the worker keeps running
+func (vc *VideoConverter) recoverPanics(next Handler) Handler {
+	return func(ctx context.Context, msg []byte) (result Result) {
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("panic: %v", r)
+				errorData := map[string]interface{}{
+					"video_id":   taskID(msg),
+					"phase":      PhaseHandle,
+					"error_type": OutcomePermanent.String(),
+					"error":      "panic while handling task",
+					"details":    err.Error(),
+					"stack":      string(debug.Stack()),
+					"time":       time.Now(),
+				}
+				slog.Error("Recovered from panic", slog.Int("video_id", taskID(msg)), slog.String("error", err.Error()))
+				vc.registerError(errorData, err)
+				result = Permanent(err)
+			}
+		}()
+		return next(ctx, msg)
+	}
+}
@@ -0,0 +1,237 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/database"
+	"imersaofc/internal/ffmpeg"
+)
+
+// Decisions of the moderation stage
+const (
+	ModerationPass  = "pass"
+	ModerationFlag  = "flag"
+	ModerationBlock = "block"
+)
+
+const (
+	// DefaultModerationInterval is how often frames are sampled
+	DefaultModerationInterval = 10 * time.Second
+	// DefaultModerationFrames caps the frames sampled from long videos,
+	// which are spread further apart instead
+	DefaultModerationFrames = 60
+)
+
+// ErrContentBlocked is returned for a source the moderation policy blocks
+// from being published
+var ErrContentBlocked = errors.New("content blocked by moderation")
+
+// Classifier scores frames for content moderation, see WithModeration
+type Classifier interface {
+	Name() string
+	// Classify scores a JPEG frame from 0 to 1 per label, such as "nsfw"
+	// or "violence"
+	Classify(ctx context.Context, frame string) (map[string]float64, error)
+}
+
+// ModerationPolicy is when sampled frames flag a video for review or
+// block it: a label scoring at least its threshold in any frame. Labels
+// without a threshold never do.
+type ModerationPolicy struct {
+	// Interval is the time between sampled frames, DefaultModerationInterval when zero
+	Interval time.Duration
+	// MaxFrames caps the frames sampled, DefaultModerationFrames when zero
+	MaxFrames int
+	Flag      map[string]float64
+	Block     map[string]float64
+}
+
+// ModerationVerdict is the outcome of moderating a video, kept for review
+type ModerationVerdict struct {
+	ID         int64  `json:"id"`
+	VideoID    int    `json:"video_id"`
+	Classifier string `json:"classifier"`
+	Decision   string `json:"decision"`
+	// Scores are the highest score of each label over the sampled frames
+	Scores map[string]float64 `json:"scores"`
+	// Label is the label that decided a flag or block, and AtSeconds the
+	// time of the frame it scored highest in
+	Label     string    `json:"label,omitempty"`
+	AtSeconds float64   `json:"at_seconds,omitempty"`
+	Frames    int       `json:"frames"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WithModeration samples the frames of every video and classifies them
+// with c, flagging or blocking videos as the policy says
+func WithModeration(c Classifier, policy ModerationPolicy) Option {
+	return func(vc *VideoConverter) {
+		vc.classifier = c
+		vc.moderation = policy
+	}
+}
+
+// wantsModeration reports whether the job is moderated: a classifier is
+// configured and the source is a new video, not one already moderated
+func (vc *VideoConverter) wantsModeration(job *Job) bool {
+	return vc.classifier != nil && job.DuplicateOf == 0 && job.Probe != nil && job.Probe.VideoStream() != nil
+}
+
+// moderationInterval returns the time between sampled frames of a video
+// lasting duration seconds
+func (p ModerationPolicy) moderationInterval(duration float64) float64 {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultModerationInterval
+	}
+	maxFrames := p.MaxFrames
+	if maxFrames <= 0 {
+		maxFrames = DefaultModerationFrames
+	}
+	return max(interval.Seconds(), duration/float64(maxFrames))
+}
+
+// moderateStage samples frames of the source and classifies them before
+// anything is encoded; a blocked video fails permanently, a flagged one
+// is converted and reported in the completion event
+func (vc *VideoConverter) moderateStage(ctx context.Context, job *Job) error {
+	if !vc.wantsModeration(job) {
+		return nil
+	}
+
+	dir := filepath.Join(job.Task.Path, "moderation")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create moderation directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	interval := vc.moderation.moderationInterval(job.Probe.DurationSeconds())
+	output, err := vc.runnerFor(job).Run(ctx, moderationArgs(job.MergedFile, interval, dir)...)
+	if err != nil {
+		return fmt.Errorf("failed to sample frames for moderation: %w", ffmpeg.ParseError(err, output))
+	}
+	frames, err := filepath.Glob(filepath.Join(dir, "frame-*.jpg"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(frames)
+
+	verdict := ModerationVerdict{
+		VideoID:    job.Task.VideoID,
+		Classifier: vc.classifier.Name(),
+		Scores:     map[string]float64{},
+		Frames:     len(frames),
+		CreatedAt:  time.Now(),
+	}
+	worst := map[string]float64{}
+	for i, frame := range frames {
+		scores, err := vc.classifier.Classify(ctx, frame)
+		if err != nil {
+			return fmt.Errorf("failed to classify frame %d: %w", i+1, err)
+		}
+		for label, score := range scores {
+			if score > verdict.Scores[label] {
+				verdict.Scores[label] = score
+				worst[label] = float64(i) * interval
+			}
+		}
+	}
+	verdict.Decision, verdict.Label = vc.moderation.decide(verdict.Scores)
+	if verdict.Label != "" {
+		verdict.AtSeconds = worst[verdict.Label]
+	}
+	if err := vc.repo.SaveVerdict(ctx, verdict); err != nil {
+		return fmt.Errorf("failed to save moderation verdict: %w", err)
+	}
+	job.Moderation = verdict.Decision
+
+	switch verdict.Decision {
+	case ModerationBlock:
+		return fmt.Errorf("%w: %s scored %.2f at %gs", ErrContentBlocked, verdict.Label, verdict.Scores[verdict.Label], verdict.AtSeconds)
+	case ModerationFlag:
+		slog.Warn("Video flagged by moderation", slog.Int("video_id", job.Task.VideoID),
+			slog.String("label", verdict.Label), slog.Float64("score", verdict.Scores[verdict.Label]))
+	}
+	return nil
+}
+
+// decide returns the decision for the highest scores of each label, and
+// the label deciding it; blocking takes precedence over flagging
+func (p ModerationPolicy) decide(scores map[string]float64) (string, string) {
+	for _, rule := range []struct {
+		decision   string
+		thresholds map[string]float64
+	}{{ModerationBlock, p.Block}, {ModerationFlag, p.Flag}} {
+		label, margin := "", -1.0
+		for l, threshold := range rule.thresholds {
+			if score, ok := scores[l]; ok && score >= threshold && score-threshold > margin {
+				label, margin = l, score-threshold
+			}
+		}
+		if label != "" {
+			return rule.decision, label
+		}
+	}
+	return ModerationPass, ""
+}
+
+// moderationArgs are the ffmpeg options sampling a frame of the source
+// every interval seconds, downscaled for the classifier, into dir
+func moderationArgs(source string, interval float64, dir string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0"},
+			VideoFilters: []string{"fps=1/" + strconv.FormatFloat(interval, 'f', -1, 64), "scale=512:-2"},
+			Options:      []string{"-q:v", "3"},
+			File:         filepath.Join(dir, "frame-%04d.jpg"),
+		}},
+	}.Args()
+}
+
+// SaveVerdict records a moderation verdict
+func SaveVerdict(ctx context.Context, db *database.DB, v ModerationVerdict) error {
+	scores, err := json.Marshal(v.Scores)
+	if err != nil {
+		return err
+	}
+	query := db.Rebind(`INSERT INTO moderation_verdicts (video_id, classifier, decision, scores, label, at_seconds, frames, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, query, v.VideoID, v.Classifier, v.Decision, string(scores), v.Label, v.AtSeconds, v.Frames, v.CreatedAt)
+		return err
+	})
+}
+
+// ListVerdicts returns the moderation verdicts of the video, oldest first
+func ListVerdicts(ctx context.Context, db *database.DB, videoID int) ([]ModerationVerdict, error) {
+	query := db.Rebind("SELECT id, classifier, decision, scores, label, at_seconds, frames, created_at FROM moderation_verdicts WHERE video_id = ? ORDER BY id")
+	rows, err := db.QueryContext(ctx, query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	verdicts := []ModerationVerdict{}
+	for rows.Next() {
+		v := ModerationVerdict{VideoID: videoID}
+		var scores string
+		if err := rows.Scan(&v.ID, &v.Classifier, &v.Decision, &scores, &v.Label, &v.AtSeconds, &v.Frames, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(scores), &v.Scores); err != nil {
+			return nil, err
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts, rows.Err()
+}
@@ -0,0 +1,130 @@
+package converter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// onDemandProfile is the DASH profile of manifests addressing a single
+// file per rendition by byte ranges
+const onDemandProfile = "urn:mpeg:dash:profile:isoff-on-demand:2011"
+
+var (
+	// singleFilePattern matches a representation's single file and the
+	// segment list ffmpeg writes for it, a byte range per segment
+	singleFilePattern = regexp.MustCompile(`(?s)<BaseURL>([^<]*)</BaseURL>(\s*)<SegmentList\b[^>]*>.*?</SegmentList>`)
+	// mpdProfilesPattern matches the profiles attribute of the MPD element
+	mpdProfilesPattern = regexp.MustCompile(`(<MPD\b[^>]*?\bprofiles=")[^"]*(")`)
+)
+
+// checkOnDemand returns an error when an on demand profile, or the task
+// when not nil, asks for what only segment files support: trick play,
+// whose I-frame stream is merged into the HLS master playlist, and
+// periods, which reference segment numbers
+func checkOnDemand(p Profile, task *VideoTask) error {
+	if !p.OnDemand {
+		return nil
+	}
+	if p.TrickPlay || (task != nil && task.TrickPlay) {
+		return errors.New("trick play needs segment files, not an on demand profile")
+	}
+	if p.MultiPeriod || (task != nil && task.MultiPeriod) {
+		return errors.New("multiple periods need segment files, not an on demand profile")
+	}
+	return nil
+}
+
+// setSegmentBase rewrites the manifest of an on demand job to the on
+// demand profile: the segment list of each rendition's file becomes a
+// SegmentBase pointing at the file's global sidx, as players expect of
+// the profile, which ffmpeg doesn't write itself
+func setSegmentBase(job *Job) error {
+	mpd, err := os.ReadFile(job.Manifest)
+	if err != nil {
+		return err
+	}
+	found := false
+	var rangeErr error
+	mpd = singleFilePattern.ReplaceAllFunc(mpd, func(m []byte) []byte {
+		found = true
+		sub := singleFilePattern.FindSubmatch(m)
+		file := filepath.Join(filepath.Dir(job.Manifest), filepath.FromSlash(string(sub[1])))
+		initEnd, sidxStart, sidxEnd, err := sidxRange(file)
+		if err != nil {
+			rangeErr = fmt.Errorf("%s: %w", filepath.Base(file), err)
+			return m
+		}
+		return fmt.Appendf(nil, `<BaseURL>%s</BaseURL>%s<SegmentBase indexRange="%d-%d" indexRangeExact="true">%s	<Initialization range="0-%d"/>%s</SegmentBase>`,
+			sub[1], sub[2], sidxStart, sidxEnd-1, sub[2], initEnd-1, sub[2])
+	})
+	if rangeErr != nil {
+		return rangeErr
+	}
+	if !found {
+		return errors.New("no single file representation in the manifest")
+	}
+	mpd = mpdProfilesPattern.ReplaceAll(mpd, []byte("${1}"+onDemandProfile+"${2}"))
+	return os.WriteFile(job.Manifest, mpd, 0o644)
+}
+
+// sidxRange scans the top-level boxes of a fragmented MP4 and returns
+// where its initialization (ftyp and moov) ends and where its first sidx
+// starts and ends, as byte offsets
+func sidxRange(file string) (initEnd, sidxStart, sidxEnd int64, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(f, header[:8]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, 0, 0, err
+		}
+		size, kind := int64(binary.BigEndian.Uint32(header[:4])), string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 1:
+			if _, err := io.ReadFull(f, header[8:16]); err != nil {
+				return 0, 0, 0, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		case 0:
+			// The box runs to the end of the file
+			end, err := f.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			size = end - offset
+		}
+		if size < headerSize {
+			return 0, 0, 0, fmt.Errorf("invalid %q box size %d at %d", kind, size, offset)
+		}
+		switch kind {
+		case "moov":
+			initEnd = offset + size
+		case "sidx":
+			if initEnd > 0 {
+				return initEnd, offset, offset + size, nil
+			}
+		}
+		offset += size
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if initEnd == 0 {
+		return 0, 0, 0, errors.New("no moov box")
+	}
+	return 0, 0, 0, errors.New("no sidx box after the moov box")
+}
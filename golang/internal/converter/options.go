@@ -0,0 +1,175 @@
+package converter
+
+import (
+	"time"
+
+	"imersaofc/internal/cdn"
+	"imersaofc/internal/events"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/storage"
+)
+
+// Option configures optional VideoConverter dependencies
+type Option func(*VideoConverter)
+
+// WithUploader uploads the MPEG-DASH output to remote storage after conversion
+func WithUploader(u storage.Uploader) Option {
+	return func(vc *VideoConverter) {
+		vc.uploader = u
+	}
+}
+
+// WithUploadConcurrency sets how many output files are uploaded in parallel
+func WithUploadConcurrency(n int) Option {
+	return func(vc *VideoConverter) {
+		vc.uploadConcurrency = n
+	}
+}
+
+// WithPublisher publishes a CompletionEvent after each successful conversion
+func WithPublisher(p Publisher) Option {
+	return func(vc *VideoConverter) {
+		vc.publisher = p
+	}
+}
+
+// WithURLSigner includes a presigned manifest URL valid for ttl in completion
+// events. Players request segments by URLs relative to the manifest, which
+// don't carry its signature, so the upload stage also uploads a signed copy
+// of the DASH manifest naming each segment by a URL presigned for ttl, which
+// the event's URL is for. CompletionEvent.SegmentsSigned is unset when the
+// event's manifest still needs its segments served publicly.
+func WithURLSigner(s storage.URLSigner, ttl time.Duration) Option {
+	return func(vc *VideoConverter) {
+		vc.signer = s
+		vc.signedURLTTL = ttl
+	}
+}
+
+// WithInvalidator purges the CDN cache for a video's output after it is uploaded
+func WithInvalidator(i cdn.Invalidator) Option {
+	return func(vc *VideoConverter) {
+		vc.invalidator = i
+	}
+}
+
+// WithChunkLayout sets how chunk files are found and ordered when tasks don't say otherwise
+func WithChunkLayout(layout ChunkLayout) Option {
+	return func(vc *VideoConverter) {
+		vc.chunkLayout = layout
+	}
+}
+
+// WithMinMergedSize rejects merged files smaller than size bytes
+func WithMinMergedSize(size int64) Option {
+	return func(vc *VideoConverter) {
+		vc.minMergedSize = size
+	}
+}
+
+// WithSourceFormats sets the accepted source containers (mp4, mov, mkv, webm, avi)
+func WithSourceFormats(formats []string) Option {
+	return func(vc *VideoConverter) {
+		vc.sourceFormats = formats
+	}
+}
+
+// WithMiddleware adds middlewares around task handling, inside logging and
+// panic recovery and before the idempotency check, in the order given
+func WithMiddleware(mws ...Middleware) Option {
+	return func(vc *VideoConverter) {
+		vc.middlewares = append(vc.middlewares, mws...)
+	}
+}
+
+// WithStage registers a pipeline stage, replacing the built-in stage with
+// the same name; new stages only run once they appear in the stage order
+func WithStage(s Stage) Option {
+	return func(vc *VideoConverter) {
+		if vc.customStages == nil {
+			vc.customStages = make(map[string]Stage)
+		}
+		vc.customStages[s.Name()] = s
+	}
+}
+
+// WithStageOrder sets which stages run and in what order
+func WithStageOrder(names ...string) Option {
+	return func(vc *VideoConverter) {
+		vc.stageOrder = names
+	}
+}
+
+// WithEventBus emits the pipeline events on bus instead of a private one
+func WithEventBus(bus *events.Bus) Option {
+	return func(vc *VideoConverter) {
+		vc.events = bus
+	}
+}
+
+// WithSubscriber subscribes s to the pipeline events
+func WithSubscriber(s events.Subscriber) Option {
+	return func(vc *VideoConverter) {
+		vc.subscribers = append(vc.subscribers, s)
+	}
+}
+
+// WithProfiles registers encoding profiles tasks can select by name; a
+// profile named DefaultProfileName replaces the default one
+func WithProfiles(profiles ...Profile) Option {
+	return func(vc *VideoConverter) {
+		if vc.profiles == nil {
+			vc.profiles = make(map[string]Profile)
+		}
+		for _, p := range profiles {
+			vc.profiles[p.Name] = p
+		}
+	}
+}
+
+// WithRepository stores the converter's state in repo instead of the database
+func WithRepository(repo Repository) Option {
+	return func(vc *VideoConverter) {
+		vc.repo = repo
+	}
+}
+
+// WithRunner runs ffmpeg and ffprobe through r
+func WithRunner(r ffmpeg.Runner) Option {
+	return func(vc *VideoConverter) {
+		vc.runner = r
+	}
+}
+
+// WithRemoteTranscoder offloads video jobs at or above threshold to t; the
+// rest, and audio-only jobs, are still transcoded with the local ffmpeg
+func WithRemoteTranscoder(t Transcoder, threshold RemoteThreshold) Option {
+	return func(vc *VideoConverter) {
+		vc.remoteTranscoder = t
+		vc.remoteThreshold = threshold
+	}
+}
+
+// WithEnqueuer accepts batch messages, whose tasks are enqueued through e
+// as individual messages
+func WithEnqueuer(e Enqueuer) Option {
+	return func(vc *VideoConverter) {
+		vc.enqueuer = e
+	}
+}
+
+// WithDryRun logs the plan of every task instead of converting it, as if
+// each task had DryRun set
+func WithDryRun() Option {
+	return func(vc *VideoConverter) {
+		vc.dryRun = true
+	}
+}
+
+// WithEstimator estimates the completion time of each task once its source
+// is probed, published as an events.TaskEstimated
+func WithEstimator(e Estimator) Option {
+	return func(vc *VideoConverter) {
+		vc.estimator = e
+	}
+}
@@ -0,0 +1,80 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// OutboxEvent is an event stored in the outbox_events table with the
+// conversion it reports, for a relay to send once it is committed
+type OutboxEvent struct {
+	// EventID identifies the event, so storing it again is a no-op
+	EventID string
+	Topic   string
+	Key     string
+	Payload []byte
+	// Headers are sent with the event, e.g. its signature
+	Headers map[string]string
+}
+
+// OutboxPublisher is a Publisher whose events are stored in the outbox by
+// the record stage, in the transaction recording the conversion, rather
+// than published by the notify stage: an event is then stored if and only
+// if its conversion is, and a failure to store it fails the task so it is
+// retried.
+type OutboxPublisher interface {
+	Publisher
+	// OutboxEvent builds the outbox event of a completion event
+	OutboxEvent(ctx context.Context, event CompletionEvent) (OutboxEvent, error)
+}
+
+// splitPublisher separates the outbox publishers of p from the others
+func splitPublisher(p Publisher) ([]OutboxPublisher, Publishers) {
+	var outbox []OutboxPublisher
+	var others Publishers
+	publishers, ok := p.(Publishers)
+	if !ok && p != nil {
+		publishers = Publishers{p}
+	}
+	for _, p := range publishers {
+		if op, ok := p.(OutboxPublisher); ok {
+			outbox = append(outbox, op)
+		} else {
+			others = append(others, p)
+		}
+	}
+	return outbox, others
+}
+
+// SaveOutboxEvent adds the event to the outbox unless it is already there
+func SaveOutboxEvent(ctx context.Context, db *database.DB, event OutboxEvent) error {
+	return database.Retry(ctx, func() error {
+		return saveOutboxEvent(ctx, db, db, event)
+	})
+}
+
+// saveOutboxEvent adds the event to the outbox with q, the pool or a
+// transaction, unless it is already there
+func saveOutboxEvent(ctx context.Context, db *database.DB, q querier, event OutboxEvent) error {
+	var count int
+	err := q.QueryRowContext(ctx, db.Rebind("SELECT COUNT(*) FROM outbox_events WHERE event_id = ?"), event.EventID).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	var headers sql.NullString
+	if len(event.Headers) > 0 {
+		encoded, err := json.Marshal(event.Headers)
+		if err != nil {
+			return err
+		}
+		headers = sql.NullString{String: string(encoded), Valid: true}
+	}
+	query := db.Rebind(`INSERT INTO outbox_events (event_id, topic, event_key, payload, headers, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	_, err = q.ExecContext(ctx, query, event.EventID, event.Topic, event.Key, string(event.Payload), headers, time.Now())
+	return err
+}
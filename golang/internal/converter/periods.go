@@ -0,0 +1,258 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	periodPattern          = regexp.MustCompile(`(?s)(<Period\b[^>]*>)(.*?)</Period>`)
+	segmentTemplatePattern = regexp.MustCompile(`(?s)<SegmentTemplate\b([^>]*?)(?:/>|>(.*?)</SegmentTemplate>)`)
+	timelineEntryPattern   = regexp.MustCompile(`<S\b([^>]*?)/?>`)
+	xmlAttrPattern         = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	periodAttrPattern      = regexp.MustCompile(`\s(?:id|start|duration)="[^"]*"`)
+)
+
+// wantsMultiPeriod reports whether the job's manifest is split into a
+// period per stretch of content between ad breaks: the task or profile
+// asks for it and there are breaks to split at
+func wantsMultiPeriod(job *Job) bool {
+	return len(job.AdBreaks) > 0 && (job.Task.MultiPeriod || job.Profile.MultiPeriod)
+}
+
+// segmentTemplate is a SegmentTemplate of the manifest with the start
+// time and duration, in its timescale, of each of its segments
+type segmentTemplate struct {
+	attrs     string
+	timescale int64
+	start     int64 // startNumber
+	offset    int64 // presentationTimeOffset
+	timeline  bool
+	times     []int64
+	durations []int64
+}
+
+// parseSegmentTemplate reads a SegmentTemplate of a VOD manifest, with a
+// SegmentTimeline or a fixed segment duration; the total duration is
+// needed to count the segments of the latter
+func parseSegmentTemplate(attrs, body string, total float64) (*segmentTemplate, error) {
+	t := &segmentTemplate{attrs: attrs, timescale: 1, start: 1}
+	values := map[string]string{}
+	for _, m := range xmlAttrPattern.FindAllStringSubmatch(attrs, -1) {
+		values[m[1]] = m[2]
+	}
+	var err error
+	for name, dst := range map[string]*int64{"timescale": &t.timescale, "startNumber": &t.start, "presentationTimeOffset": &t.offset} {
+		if v, ok := values[name]; ok {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("bad segment template %s %q", name, v)
+			}
+		}
+	}
+
+	entries := timelineEntryPattern.FindAllStringSubmatch(body, -1)
+	if len(entries) > 0 {
+		t.timeline = true
+		next := t.offset
+		for _, entry := range entries {
+			s := map[string]int64{"r": 0}
+			for _, m := range xmlAttrPattern.FindAllStringSubmatch(entry[1], -1) {
+				if s[m[1]], err = strconv.ParseInt(m[2], 10, 64); err != nil {
+					return nil, fmt.Errorf("bad segment timeline %s %q", m[1], m[2])
+				}
+			}
+			if at, ok := s["t"]; ok {
+				next = at
+			}
+			if s["d"] <= 0 || s["r"] < 0 {
+				return nil, errors.New("segment timeline isn't a complete vod timeline")
+			}
+			for i := int64(0); i <= s["r"]; i++ {
+				t.times = append(t.times, next)
+				t.durations = append(t.durations, s["d"])
+				next += s["d"]
+			}
+		}
+		return t, nil
+	}
+
+	d, err := strconv.ParseInt(values["duration"], 10, 64)
+	if err != nil || d <= 0 {
+		return nil, errors.New("segment template without a timeline or duration")
+	}
+	count := int64(math.Ceil(total * float64(t.timescale) / float64(d)))
+	for i := int64(0); i < count; i++ {
+		t.times = append(t.times, t.offset+i*d)
+		t.durations = append(t.durations, d)
+	}
+	return t, nil
+}
+
+// seconds returns when segment i starts, in seconds of the presentation
+func (t *segmentTemplate) seconds(i int) float64 {
+	return float64(t.times[i]-t.offset) / float64(t.timescale)
+}
+
+// cut returns the index of the segment starting closest to the second at
+func (t *segmentTemplate) cut(at float64) int {
+	best := 0
+	for i := range t.times {
+		if math.Abs(t.seconds(i)-at) < math.Abs(t.seconds(best)-at) {
+			best = i
+		}
+	}
+	return best
+}
+
+// next returns the index of the first segment starting at or after the
+// second at, as HLS cue tags are placed, or -1 when none does
+func (t *segmentTemplate) next(at float64) int {
+	for i := range t.times {
+		if t.seconds(i) >= at-cueTolerance {
+			return i
+		}
+	}
+	return -1
+}
+
+// slice returns the SegmentTemplate of segments [from, to) for a period
+// of their own
+func (t *segmentTemplate) slice(from, to int) string {
+	attrs := xmlAttrPattern.ReplaceAllStringFunc(t.attrs, func(attr string) string {
+		name, _, _ := strings.Cut(attr, "=")
+		switch name {
+		case "startNumber", "presentationTimeOffset":
+			return ""
+		}
+		return attr
+	})
+	attrs = strings.Join(strings.Fields(attrs), " ")
+	attrs += fmt.Sprintf(` startNumber="%d" presentationTimeOffset="%d"`, t.start+int64(from), t.times[from])
+	if !t.timeline {
+		return "<SegmentTemplate " + attrs + "/>"
+	}
+	return "<SegmentTemplate " + attrs + ">\n\t\t\t\t\t" + t.segmentTimeline(from, to) + "\n\t\t\t\t</SegmentTemplate>"
+}
+
+// segmentTimeline returns the SegmentTimeline of segments [from, to),
+// runs of segments of the same duration as a single entry
+func (t *segmentTemplate) segmentTimeline(from, to int) string {
+	var timeline strings.Builder
+	for i := from; i < to; {
+		run := i
+		for run+1 < to && t.durations[run+1] == t.durations[i] {
+			run++
+		}
+		fmt.Fprintf(&timeline, "\n\t\t\t\t\t\t<S t=\"%d\" d=\"%d\"", t.times[i], t.durations[i])
+		if run > i {
+			fmt.Fprintf(&timeline, " r=\"%d\"", run-i)
+		}
+		timeline.WriteString(" />")
+		i = run + 1
+	}
+	return "<SegmentTimeline>" + timeline.String() + "\n\t\t\t\t\t</SegmentTimeline>"
+}
+
+// splitPeriods rewrites the single period of the manifest as a period per
+// stretch of content between ad breaks, each starting at the segment
+// boundary following its break, with the SCTE-35 event of the break at
+// its start. The periods reference the same segments, through their
+// startNumber and presentationTimeOffset, so nothing is re-encoded.
+func splitPeriods(manifest string, breaks []AdBreak, total float64) error {
+	mpd, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	loc := periodPattern.FindSubmatchIndex(mpd)
+	if loc == nil {
+		return errors.New("no period in the manifest")
+	}
+	open, body := string(mpd[loc[2]:loc[3]]), string(mpd[loc[4]:loc[5]])
+
+	matches := segmentTemplatePattern.FindAllStringSubmatchIndex(body, -1)
+	if len(matches) == 0 {
+		return errors.New("no segment template in the period")
+	}
+	templates := make([]*segmentTemplate, len(matches))
+	for i, m := range matches {
+		var inner string
+		if m[4] >= 0 {
+			inner = body[m[4]:m[5]]
+		}
+		if templates[i], err = parseSegmentTemplate(body[m[2]:m[3]], inner, total); err != nil {
+			return err
+		}
+	}
+
+	// The first template, the video's unless audio only, decides the
+	// boundaries at the segment after each break, like the HLS cue tags;
+	// the others cut at their segment closest to them. A break landing on
+	// the boundary of an earlier one shares its period.
+	reference := templates[0]
+	starts := []float64{0}
+	events := map[int]int{}
+	for i, b := range breaks {
+		next := reference.next(b.Time)
+		if next < 0 {
+			continue
+		}
+		at := reference.seconds(next)
+		if at > starts[len(starts)-1] {
+			starts = append(starts, at)
+		}
+		if _, ok := events[len(starts)-1]; !ok && at == starts[len(starts)-1] {
+			events[len(starts)-1] = i
+		}
+	}
+	if len(starts) == 1 {
+		return addSCTE35EventStream(manifest, breaks)
+	}
+
+	var periods strings.Builder
+	for p, start := range starts {
+		var rewritten strings.Builder
+		last := 0
+		for i, m := range matches {
+			t := templates[i]
+			from, to := t.cut(start), len(t.times)
+			if p+1 < len(starts) {
+				to = t.cut(starts[p+1])
+			}
+			if to <= from {
+				return fmt.Errorf("period at %gs has no segments", start)
+			}
+			rewritten.WriteString(body[last:m[0]])
+			rewritten.WriteString(t.slice(from, to))
+			last = m[1]
+		}
+		rewritten.WriteString(body[last:])
+
+		attrs := periodAttrPattern.ReplaceAllString(open, "")
+		attrs = strings.TrimSuffix(attrs, ">") + fmt.Sprintf(` id="%d" start="PT%.3fS">`, p, start)
+		periods.WriteString(attrs)
+		if b, ok := events[p]; ok {
+			periods.WriteString(periodEventStream(breaks[b], b+1, start))
+		}
+		periods.WriteString(rewritten.String() + "</Period>")
+		if p+1 < len(starts) {
+			periods.WriteString("\n\t")
+		}
+	}
+
+	updated := string(mpd[:loc[0]]) + periods.String() + string(mpd[loc[1]:])
+	return os.WriteFile(manifest, []byte(updated), 0o644)
+}
+
+// periodEventStream returns the SCTE-35 event stream of a period starting
+// at start, with the splice of its break at the period start
+func periodEventStream(b AdBreak, id int, start float64) string {
+	offset := int64(start * scte35ClockRate)
+	return fmt.Sprintf("\n\t\t<EventStream schemeIdUri=\"%s\" timescale=\"%d\" presentationTimeOffset=\"%d\">", scte35Scheme, scte35ClockRate, offset) +
+		scte35Event(id, offset, int64(b.Duration*scte35ClockRate)) +
+		"\n\t\t</EventStream>"
+}
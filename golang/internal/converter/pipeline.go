@@ -0,0 +1,629 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imersaofc/internal/events"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/storage"
+)
+
+// Names of the built-in pipeline stages, in their default order
+const (
+	StageDownload  = "download"
+	StageMerge     = "merge"
+	StageProbe     = "probe"
+	StageDedup     = "dedup"
+	StageModerate  = "moderate"
+	StageTranscode = "transcode"
+	StageRedact    = "redact"
+	StageCaption   = "caption"
+	StagePackage   = "package"
+	StageUpload    = "upload"
+	StageRecord    = "record"
+	StageNotify    = "notify"
+)
+
+// DefaultStageOrder is the pipeline used when no order is configured
+var DefaultStageOrder = []string{StageDownload, StageMerge, StageProbe, StageDedup, StageModerate, StageTranscode, StageRedact, StageCaption, StagePackage, StageUpload, StageRecord, StageNotify}
+
+// Job is the state of a task as it moves through the pipeline stages
+type Job struct {
+	Task *VideoTask
+
+	// MergedFile is the source file built by the merge stage
+	MergedFile string
+	// Redacted is set once the redact stage replaced MergedFile with a
+	// redacted copy
+	Redacted bool
+	// OutputDir holds the MPEG-DASH output
+	OutputDir string
+	// Manifest is the DASH manifest in OutputDir
+	Manifest string
+	// Prefix is the storage prefix the output is uploaded to, see OutputLayout
+	Prefix string
+	// Probe describes the source once the probe stage ran
+	Probe *ffmpeg.ProbeResult
+	// Mode is the output mode reported in the completion event
+	Mode string
+	// OutputArgs are the ffmpeg output options chosen by the transcode stage
+	OutputArgs []string
+	// Profile is the encoding profile chosen by the transcode stage
+	Profile Profile
+	// AdBreaks are the task's ad breaks, or the source's SCTE-35 cues,
+	// found by the transcode stage
+	AdBreaks []AdBreak
+	// Captions are the caption tracks written by the caption stage
+	Captions []CaptionTrack
+	// SourceHash is the sha256 of the merged chunks, empty for image sequences
+	SourceHash string
+	// DuplicateOf is the video whose output is reused because its source
+	// was identical, and DuplicateVersion the reused version; set by the
+	// dedup stage
+	DuplicateOf      int
+	DuplicateVersion int
+	// DuplicatePrefix is where the reused output was uploaded
+	DuplicatePrefix string
+	// Moderation is the decision of the moderate stage, empty when the
+	// job isn't moderated
+	Moderation string
+	// Version is the output version written, see OutputVersion
+	Version int
+	// StartedAt is when the pipeline started on the task
+	StartedAt time.Time
+	// Timings are filled in as the stages complete
+	Timings Timings
+	// Runner runs the job's ffmpeg commands, logging them to FFmpegLog when
+	// the converter keeps ffmpeg logs
+	Runner    ffmpeg.Runner
+	FFmpegLog string
+
+	// CanaryOf is the profile the task asked for when a ProfileRollout
+	// switched it to a canary
+	CanaryOf string
+
+	// OverBudget is set when a rendition is still over the profile's
+	// MaxBytesPerMinute, see BudgetReencode
+	OverBudget bool
+
+	// Tenant are the settings of the task's tenant, nil when it has none
+	Tenant *TenantSettings
+
+	// recorder keeps the command lines Runner ran, for the EncodeRecord
+	recorder *recordingRunner
+	// sealer decrypts the job's encrypted files for ffmpeg, see
+	// WithWorkspaceEncryption
+	sealer *sealedRunner
+	// completion is the job's completion event once built, see
+	// completionEvent
+	completion *CompletionEvent
+	// segmentsSignedAt is when the upload stage signed the segment URLs of
+	// the signed manifest, see WithURLSigner; zero when it didn't
+	segmentsSignedAt time.Time
+}
+
+// Stage is one step of the conversion pipeline
+type Stage interface {
+	Name() string
+	Run(ctx context.Context, job *Job) error
+}
+
+// stageFunc adapts a function to the Stage interface
+type stageFunc struct {
+	name string
+	run  func(ctx context.Context, job *Job) error
+}
+
+func (s stageFunc) Name() string                            { return s.name }
+func (s stageFunc) Run(ctx context.Context, job *Job) error { return s.run(ctx, job) }
+
+// NewStage creates a Stage from a function
+func NewStage(name string, run func(ctx context.Context, job *Job) error) Stage {
+	return stageFunc{name: name, run: run}
+}
+
+// builtinStages returns the converter's own stages by name
+func (vc *VideoConverter) builtinStages() map[string]Stage {
+	return map[string]Stage{
+		StageDownload:  NewStage(StageDownload, vc.downloadStage),
+		StageMerge:     NewStage(StageMerge, vc.mergeStage),
+		StageProbe:     NewStage(StageProbe, vc.probeStage),
+		StageDedup:     NewStage(StageDedup, vc.dedupStage),
+		StageModerate:  NewStage(StageModerate, vc.moderateStage),
+		StageTranscode: NewStage(StageTranscode, vc.transcodeStage),
+		StageRedact:    NewStage(StageRedact, vc.redactStage),
+		StageCaption:   NewStage(StageCaption, vc.captionStage),
+		StagePackage:   NewStage(StagePackage, vc.packageStage),
+		StageUpload:    NewStage(StageUpload, vc.uploadStage),
+		StageRecord:    NewStage(StageRecord, vc.recordStage),
+		StageNotify:    NewStage(StageNotify, vc.notifyStage),
+	}
+}
+
+// resolveStages builds the pipeline from the configured order, with
+// registered stages replacing built-in ones of the same name
+func (vc *VideoConverter) resolveStages() ([]Stage, error) {
+	available := vc.builtinStages()
+	for name, stage := range vc.customStages {
+		available[name] = stage
+	}
+	order := vc.stageOrder
+	if order == nil {
+		order = DefaultStageOrder
+	}
+
+	stages := make([]Stage, 0, len(order))
+	for _, name := range order {
+		stage, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage: %s", name)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// runPipeline runs the task through every stage, stopping at the first
+// error, and emits the task's events
+func (vc *VideoConverter) runPipeline(ctx context.Context, task *VideoTask) error {
+	job := &Job{
+		Task:       task,
+		MergedFile: filepath.Join(task.Path, "merged"),
+		OutputDir:  filepath.Join(task.Path, "mpeg-dash"),
+		Mode:       ModeVideo,
+		Version:    1,
+		StartedAt:  time.Now(),
+		Runner:     vc.runner,
+	}
+	// fail logs and publishes a failure of the task at a stage
+	fail := func(stage, message string, err error) error {
+		vc.logError(*task, stage, message, err)
+		vc.events.Publish(events.TaskFailed{
+			VideoID:   task.VideoID,
+			Stage:     stage,
+			Err:       err,
+			Retryable: classify(err).Outcome == OutcomeRetry,
+			At:        time.Now(),
+		})
+		return err
+	}
+	if err := checkLabels(task.Labels); err != nil {
+		return fail("labels", "invalid labels", fmt.Errorf("%w: %v", ErrInvalidTask, err))
+	}
+	if err := vc.applyTenantSettings(ctx, job); err != nil {
+		return fail("tenant", "failed to read tenant settings", err)
+	}
+	job.CanaryOf = vc.applyRollout(task)
+	if vc.workspaceKey != nil {
+		sealer, err := newSealedRunner(job.Runner, vc.workspaceKey)
+		if err != nil {
+			return fail("encryption", "failed to set up workspace encryption", err)
+		}
+		job.sealer = sealer
+		job.Runner = sealer
+	}
+	if vc.ffmpegLogs.Dir != "" {
+		logFile, err := vc.openFFmpegLog(job)
+		if err != nil {
+			slog.Warn("Error creating ffmpeg log", slog.Int("video_id", task.VideoID), slog.String("error", err.Error()))
+		} else {
+			defer closeFFmpegLog(logFile)
+		}
+	}
+	// Outermost, so the logging runner still sees whether the runner
+	// streams
+	job.recorder = &recordingRunner{runner: job.Runner}
+	job.Runner = job.recorder
+	vc.events.Publish(events.TaskStarted{VideoID: task.VideoID, Labels: task.Labels, At: job.StartedAt})
+	estimated := false
+
+	for _, stage := range vc.stages {
+		slog.Info("Running stage", slog.Int("video_id", task.VideoID), slog.String("stage", stage.Name()))
+		stageStart := time.Now()
+		if err := stage.Run(ctx, job); err != nil {
+			return fail(stage.Name(), "failed at stage "+stage.Name(), err)
+		}
+		duration := time.Since(stageStart)
+		vc.events.Publish(events.StageCompleted{
+			VideoID:   task.VideoID,
+			Stage:     stage.Name(),
+			Rendition: recordTiming(job, stage.Name(), duration),
+			Duration:  duration,
+			At:        time.Now(),
+		})
+		if !estimated && job.Probe != nil {
+			vc.publishEstimate(ctx, job)
+			estimated = true
+		}
+	}
+
+	vc.events.Publish(events.TaskSucceeded{
+		VideoID:        task.VideoID,
+		Mode:           job.Mode,
+		Profile:        profileName(task),
+		SourceDuration: sourceDuration(job),
+		Duration:       time.Since(job.StartedAt),
+		Labels:         task.Labels,
+		At:             time.Now(),
+	})
+	return nil
+}
+
+// recordTiming adds the duration of a completed stage to the job's timings
+// and returns the rendition the stage encoded, if any. The package stage
+// runs the encode, so its duration is the rendition's transcode time.
+func recordTiming(job *Job, stage string, d time.Duration) string {
+	switch stage {
+	case StageDownload:
+		job.Timings.DownloadMS = d.Milliseconds()
+	case StageMerge:
+		job.Timings.MergeMS = d.Milliseconds()
+	case StageProbe:
+		job.Timings.SourceBytes = sourceSize(job)
+	case StagePackage:
+		if job.DuplicateOf != 0 {
+			return ""
+		}
+		rendition := renditionName(job)
+		if job.Timings.TranscodeMS == nil {
+			job.Timings.TranscodeMS = map[string]int64{}
+		}
+		// The stage also encoded the scrubbing proxy, if any, which
+		// recorded its own time
+		job.Timings.TranscodeMS[rendition] = d.Milliseconds() - job.Timings.TranscodeMS[ScrubbingRendition]
+		return rendition
+	case StageUpload:
+		job.Timings.UploadMS = d.Milliseconds()
+	}
+	return ""
+}
+
+// renditionName names what the job encodes: its profile, or the audio
+// track of an audio-only source
+func renditionName(job *Job) string {
+	if job.Mode == ModeAudioOnly {
+		return ModeAudioOnly
+	}
+	if job.Profile.Name != "" {
+		return job.Profile.Name
+	}
+	return profileName(job.Task)
+}
+
+// mergeStage merges chunks, or encodes the frames of an image sequence; a
+// single file source is used as is
+func (vc *VideoConverter) mergeStage(ctx context.Context, job *Job) error {
+	task := job.Task
+	var err error
+	switch sourceType(task) {
+	case SourceChunks:
+		slog.Info("Merging chunks", slog.String("path", task.Path))
+		job.SourceHash, err = vc.mergeChunks(task, job.MergedFile)
+	case SourceImageSequence:
+		err = vc.encodeImageSequence(vc.runnerFor(job), task, job.MergedFile)
+	case SourceSingleFile:
+		slog.Info("Using source file, skipping merge", slog.String("path", sourceFilePath(task)))
+		err = vc.useSourceFile(job)
+	case SourceDownload:
+		if job.SourceHash == "" {
+			err = fmt.Errorf("%w: source_url needs the %s stage", ErrInvalidTask, StageDownload)
+		}
+	default:
+		err = fmt.Errorf("%w: unknown source type: %s", ErrInvalidTask, task.SourceType)
+	}
+	if err != nil {
+		return err
+	}
+	// The merged file is encrypted as soon as it's written, before any
+	// other stage reads it
+	return vc.sealMerged(job)
+}
+
+// probeStage detects the real source container and its streams
+func (vc *VideoConverter) probeStage(ctx context.Context, job *Job) error {
+	slog.Info("Probing merged file", slog.String("path", job.MergedFile))
+	// An encrypted merged file keeps its name, as ffmpeg is handed it open
+	rename := ownsMergedFile(job) && (job.sealer == nil || !job.sealer.sealed(job.MergedFile))
+	mergedFile, probe, err := vc.detectSource(vc.runnerFor(job), job.MergedFile, rename)
+	job.MergedFile = mergedFile
+	if err != nil {
+		return err
+	}
+	job.Probe = probe
+	if err := vc.checkProbe(job.Task, probe); err != nil {
+		return err
+	}
+	vc.selectProfile(job)
+	return vc.sealMerged(job)
+}
+
+// transcodeStage chooses between audio-only packaging and transmuxing or
+// transcoding the video
+func (vc *VideoConverter) transcodeStage(ctx context.Context, job *Job) error {
+	if job.Probe == nil {
+		return fmt.Errorf("%s stage requires the %s stage", StageTranscode, StageProbe)
+	}
+	if err := vc.assignVersion(ctx, job); err != nil {
+		return fmt.Errorf("failed to assign output version: %w", err)
+	}
+	adBreaks, err := vc.adBreaks(ctx, job)
+	if err != nil {
+		return err
+	}
+	job.AdBreaks = adBreaks
+	if err := job.Task.Metadata.check(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	if job.Probe.VideoStream() == nil && job.Probe.AudioStream() != nil {
+		// Podcast mode: no video stream, package audio only
+		job.Mode = ModeAudioOnly
+		slog.Info("No video stream found, packaging audio only", slog.String("path", job.MergedFile))
+		job.OutputArgs = audioOnlyArgs(job, vc.outputLayout, vc.metadataArgs(job.Probe.AudioStream(), job.Task.outputMetadata()))
+		return nil
+	}
+	profile, err := vc.profile(job.Task)
+	if err != nil {
+		return err
+	}
+	if err := checkThumbnailMode(job.Task.Thumbnail); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	if vc.outputLayout.OnDemand {
+		profile.OnDemand = true
+	}
+	profile = job.Tenant.override(profile)
+	profile = orientProfile(profile, job.Probe.VideoStream())
+	job.Mode = ModeVideo
+	job.Profile = profile
+	if err := checkOnDemand(profile, job.Task); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTask, err)
+	}
+	job.OutputArgs = vc.dashArgs(job)
+	return nil
+}
+
+// dashArgs are the ffmpeg output options packaging the job's video to
+// MPEG-DASH with its profile
+func (vc *VideoConverter) dashArgs(job *Job) []string {
+	args := append(codecArgs(job.Probe, job.Profile), vc.metadataArgs(job.Probe.AudioStream(), job.Task.outputMetadata())...)
+	args = append(args, "-f", "dash") // Formato de saída
+	if job.Task.Metadata != nil {
+		// The tenant and custom tags are only written to MP4 as such
+		args = append(args, "-format_options", "movflags=+use_metadata_tags")
+	}
+	if (wantsTrickPlay(job) || len(job.AdBreaks) > 0 || vc.wantsCaptions(job)) && !job.Profile.OnDemand {
+		// The I-frame stream and captions are added to an HLS master
+		// playlist, and ad breaks are signaled in the HLS media playlists
+		// too; not for on demand profiles, whose global sidx is inserted
+		// once the files are written, shifting the playlists' byte ranges
+		args = append(args, "-hls_playlist", "1")
+	}
+	args = append(args, vc.outputLayout.segmentArgs(job)...)
+	return append(args, job.Manifest) // Caminho para salvar o arquivo .mpd
+}
+
+// packageStage writes the MPEG-DASH output with the local ffmpeg or, for
+// heavy jobs, the remote transcoder
+func (vc *VideoConverter) packageStage(ctx context.Context, job *Job) error {
+	if job.DuplicateOf != 0 {
+		return removeMerged(job)
+	}
+
+	slog.Info("Creating mpeg-dash dir", slog.String("path", job.Task.Path))
+	if err := vc.createOutputDirs(job); err != nil {
+		return err
+	}
+
+	transcoder := vc.transcoderFor(job)
+	slog.Info("Converting video to mpeg-dash", slog.String("path", job.Task.Path), slog.String("transcoder", transcoder.Name()))
+	if err := transcoder.Transcode(ctx, job); err != nil {
+		return err
+	}
+	slog.Info("Video convert to mpeg-dash", slog.String("path", job.OutputDir))
+	// Before anything else is written to the output, which the budget
+	// would count as segments
+	if wantsBudget(job) {
+		if err := vc.enforceBudget(ctx, job, transcoder); err != nil {
+			return err
+		}
+	}
+	if job.Profile.OnDemand {
+		if _, ok := transcoder.(localTranscoder); ok {
+			if err := setSegmentBase(job); err != nil {
+				return fmt.Errorf("failed to write the on demand dash manifest: %w", err)
+			}
+		} else {
+			slog.Warn("On demand profile isn't applied to remote transcodes", slog.Int("video_id", job.Task.VideoID), slog.String("transcoder", transcoder.Name()))
+		}
+	}
+	// From the renditions alone, before trick play and captions are added
+	// to the DASH manifest
+	if wantsSmoothStreaming(job) {
+		if err := vc.packageSmoothStreaming(ctx, job, vc.runnerFor(job)); err != nil {
+			return err
+		}
+	}
+	if wantsScrubbingProxy(job) {
+		if err := vc.encodeScrubbingProxy(ctx, job, vc.runnerFor(job)); err != nil {
+			return err
+		}
+	}
+	if wantsTrickPlay(job) {
+		if err := vc.encodeTrickPlay(ctx, job, vc.runnerFor(job)); err != nil {
+			return err
+		}
+	}
+	if wantsThumbnail(job) {
+		if err := vc.encodeThumbnail(ctx, job, vc.runnerFor(job)); err != nil {
+			return err
+		}
+	}
+	if wantsStoryboard(job) {
+		if err := vc.encodeStoryboard(ctx, job, vc.runnerFor(job)); err != nil {
+			return err
+		}
+	}
+	if len(job.Captions) > 0 {
+		if err := signalCaptions(job); err != nil {
+			return err
+		}
+	}
+	// After trick play and captions, so period splits cover their
+	// adaptation sets too
+	if len(job.AdBreaks) > 0 {
+		if err := signalAdBreaks(job); err != nil {
+			return err
+		}
+	}
+	if metadata := job.Task.outputMetadata(); metadata != nil {
+		if err := setProgramInformation(job.Manifest, metadata); err != nil {
+			return fmt.Errorf("failed to add metadata to the dash manifest: %w", err)
+		}
+	}
+	// Last, as it hashes every file of the output
+	if wantsTorrent(job) {
+		if err := vc.writeTorrent(job); err != nil {
+			return err
+		}
+	}
+	return removeMerged(job)
+}
+
+// createOutputDirs creates the output directory and the directories of
+// its segments
+func (vc *VideoConverter) createOutputDirs(job *Job) error {
+	if err := os.MkdirAll(job.OutputDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create mpeg-dash directory: %w", err)
+	}
+	for _, dir := range vc.outputLayout.segmentDirs(job) {
+		if err := os.MkdirAll(filepath.Join(job.OutputDir, dir), os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create segment directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeMerged removes the merged file once it's no longer needed; a
+// single file source is left to its producer
+func removeMerged(job *Job) error {
+	if !ownsMergedFile(job) {
+		return nil
+	}
+	slog.Info("Removing merged file", slog.String("path", job.MergedFile))
+	if err := os.Remove(job.MergedFile); err != nil {
+		return fmt.Errorf("failed to remove merged file: %w", err)
+	}
+	return nil
+}
+
+// uploadStage uploads the output to remote storage and purges it from the
+// CDN when it replaced an output served before
+func (vc *VideoConverter) uploadStage(ctx context.Context, job *Job) error {
+	if vc.uploader == nil || job.DuplicateOf != 0 {
+		return nil
+	}
+	prefix := job.Prefix
+	slog.Info("Uploading mpeg-dash output", slog.String("path", job.OutputDir), slog.String("prefix", prefix))
+	err := storage.UploadDir(ctx, vc.uploader, job.OutputDir, prefix, vc.uploadConcurrency)
+	if err != nil {
+		return fmt.Errorf("failed to upload mpeg-dash output: %w", err)
+	}
+	if err := vc.uploadFFmpegLog(ctx, job, prefix); err != nil {
+		vc.logError(*job.Task, StageUpload, "failed to upload ffmpeg log", err)
+	}
+	// Without a signed manifest the event only signs the manifest, which
+	// it says, so the segments must be public
+	if vc.signer != nil {
+		if err := vc.uploadSignedManifest(ctx, job); err != nil {
+			vc.logError(*job.Task, StageUpload, "failed to upload signed manifest", err)
+		}
+	}
+
+	// Purge replaced outputs from the CDN so stale manifests aren't served;
+	// the upload already succeeded, so a failure here is recorded but not fatal
+	if vc.invalidator != nil && vc.replacesOutput(job) {
+		slog.Info("Invalidating cdn cache", slog.String("prefix", prefix))
+		err = vc.invalidator.Invalidate(ctx, []string{"/" + prefix + "/*"})
+		if err != nil {
+			vc.logError(*job.Task, StageUpload, "failed to invalidate cdn cache", err)
+		}
+	}
+	return nil
+}
+
+// replacesOutput reports whether the job uploaded over an output the CDN
+// may have cached: a reprocess whose layout doesn't put the version in
+// the prefix, so the previous version was uploaded to the same one. Fresh
+// prefixes have never been served, so purging them would be a paid no-op.
+func (vc *VideoConverter) replacesOutput(job *Job) bool {
+	if !job.Task.Reprocess || job.Version <= 1 {
+		return false
+	}
+	return vc.layoutFor(job).prefix(job.Task, job.Task.VideoID, job.Version-1) == job.Prefix
+}
+
+// recordStage activates the new output version, remembers the source for
+// deduplication, marks the video as processed and adds the completion
+// event to the outbox, in one transaction
+func (vc *VideoConverter) recordStage(ctx context.Context, job *Job) error {
+	conversion := Conversion{VideoID: job.Task.VideoID}
+	if job.DuplicateOf == 0 {
+		conversion.Version = &OutputVersion{
+			VideoID: job.Task.VideoID,
+			Version: job.Version,
+			Profile: profileName(job.Task),
+			Prefix:  job.Prefix,
+		}
+		record, err := vc.encodeRecord(job)
+		if err != nil {
+			return err
+		}
+		conversion.Encode = &record
+	}
+	if job.SourceHash != "" {
+		fingerprint, err := vc.outputFingerprint(job)
+		if err != nil {
+			return err
+		}
+		record := SourceRecord{
+			VideoID:       job.Task.VideoID,
+			ContentHash:   job.SourceHash,
+			Profile:       profileName(job.Task),
+			OutputVideoID: job.Task.VideoID,
+			OutputVersion: job.Version,
+			ProfileHash:   fingerprint,
+			OutputPrefix:  job.Prefix,
+		}
+		if job.DuplicateOf != 0 {
+			record.OutputVideoID = job.DuplicateOf
+			record.OutputVersion = job.DuplicateVersion
+			record.OutputPrefix = job.DuplicatePrefix
+		}
+		conversion.Source = &record
+	}
+	outbox, _ := splitPublisher(vc.publisher)
+	for _, p := range outbox {
+		event, err := p.OutboxEvent(ctx, vc.completionEvent(job))
+		if err != nil {
+			return fmt.Errorf("failed to build outbox event: %w", err)
+		}
+		conversion.Events = append(conversion.Events, event)
+	}
+	if err := vc.repo.RecordConversion(ctx, conversion); err != nil {
+		return fmt.Errorf("failed to record conversion: %w", err)
+	}
+	slog.Info("Video marked as processed", slog.Int("video_id", job.Task.VideoID))
+	return nil
+}
+
+// notifyStage publishes the completion event to the publishers that don't
+// go through the outbox
+func (vc *VideoConverter) notifyStage(ctx context.Context, job *Job) error {
+	vc.publishCompletion(ctx, job)
+	return nil
+}
@@ -0,0 +1,417 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// defaultAudioBitrate is the bitrate, in bits per second, assumed for audio
+// encoded without an explicit bitrate
+const defaultAudioBitrate = 128000
+
+// Plan is what converting a task would do, worked out without merging,
+// encoding or recording anything, so profile changes can be reviewed safely
+type Plan struct {
+	VideoID    int    `json:"video_id"`
+	SourceType string `json:"source_type"`
+	// Inputs is the number of chunks, or of frames for an image sequence
+	Inputs        int      `json:"inputs"`
+	SourceSize    int64    `json:"source_size"`
+	Container     string   `json:"container"`
+	Duration      float64  `json:"duration_seconds"`
+	Mode          string   `json:"mode"`
+	Profile       string   `json:"profile"`
+	Version       int      `json:"version"`
+	Transcoder    string   `json:"transcoder"`
+	Commands      []string `json:"commands"`
+	OutputDir     string   `json:"output_dir"`
+	Outputs       []string `json:"outputs"`
+	UploadPrefix  string   `json:"upload_prefix,omitempty"`
+	EstimatedSize int64    `json:"estimated_size"`
+	// EstimatedSegments is roughly how many segment files the renditions
+	// take, to tune the output layout's segment duration against
+	EstimatedSegments int `json:"estimated_segments"`
+	// EstimatedSeconds is the expected processing time, when an Estimator is configured
+	EstimatedSeconds float64 `json:"estimated_seconds,omitempty"`
+}
+
+// PlanTask validates the task's input and returns the commands, output
+// layout and estimated output size of its conversion. Chunks are probed in
+// place through ffmpeg's concat protocol instead of being merged.
+func (vc *VideoConverter) PlanTask(ctx context.Context, task *VideoTask) (*Plan, error) {
+	job := &Job{
+		Task:       task,
+		MergedFile: filepath.Join(task.Path, "merged"),
+		OutputDir:  filepath.Join(task.Path, "mpeg-dash"),
+		Mode:       ModeVideo,
+		Version:    1,
+	}
+	if err := vc.applyTenantSettings(ctx, job); err != nil {
+		return nil, err
+	}
+	job.CanaryOf = vc.applyRollout(task)
+	plan := &Plan{VideoID: task.VideoID}
+
+	switch sourceType(task) {
+	case SourceChunks:
+		chunks, _, err := vc.findChunks(task)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunks) == 0 {
+			return nil, fmt.Errorf("%w in %s", ErrNoChunks, task.Path)
+		}
+		if plan.SourceSize, err = totalSize(chunks); err != nil {
+			return nil, err
+		}
+		if plan.SourceSize < vc.minMergedSize {
+			return nil, fmt.Errorf("%w: %d bytes, expected at least %d", ErrMergedTooSmall, plan.SourceSize, vc.minMergedSize)
+		}
+
+		input := chunks[0]
+		if len(chunks) > 1 {
+			input = "concat:" + strings.Join(chunks, "|")
+		}
+		probe, err := vc.runner.Probe(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		container := probe.Container()
+		if !slices.Contains(vc.sourceFormats, container) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedContainer, container)
+		}
+		probe.Format.Size = strconv.FormatInt(plan.SourceSize, 10)
+		job.Probe = probe
+		job.MergedFile = filepath.Join(task.Path, "merged."+container)
+		plan.SourceType = SourceChunks
+		plan.Inputs = len(chunks)
+		plan.Commands = append(plan.Commands, fmt.Sprintf("merge %d chunks into %s", len(chunks), job.MergedFile))
+
+	case SourceImageSequence:
+		frames, ext, err := vc.findFrames(task)
+		if err != nil {
+			return nil, err
+		}
+		if plan.SourceSize, err = totalSize(frames); err != nil {
+			return nil, err
+		}
+		fps := task.FPS
+		if fps <= 0 {
+			fps = DefaultImageSequenceFPS
+		}
+		// The encoded sequence is an H.264 MP4 without audio
+		job.Probe = &ffmpeg.ProbeResult{
+			Format: ffmpeg.Format{
+				FormatName: "mov,mp4,m4a,3gp,3g2,mj2",
+				Duration:   strconv.FormatFloat(float64(len(frames))/fps, 'f', -1, 64),
+				Size:       strconv.FormatInt(plan.SourceSize, 10),
+			},
+			Streams: []ffmpeg.Stream{{CodecType: "video", CodecName: "h264"}},
+		}
+		job.MergedFile = filepath.Join(task.Path, "merged.mp4")
+		plan.SourceType = SourceImageSequence
+		plan.Inputs = len(frames)
+		seqArgs := imageSequenceArgs(filepath.Join(task.Path, "frames"), ext, fps, filepath.Join(task.Path, "merged"))
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(seqArgs))
+
+	case SourceSingleFile:
+		if task.SourceFile == "" {
+			return nil, fmt.Errorf("%w: %s source without a source_file", ErrInvalidTask, SourceSingleFile)
+		}
+		job.MergedFile = sourceFilePath(task)
+		info, err := os.Stat(job.MergedFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSourceFile, job.MergedFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.SourceSize = info.Size()
+		if plan.SourceSize < vc.minMergedSize {
+			return nil, fmt.Errorf("%w: %d bytes, expected at least %d", ErrMergedTooSmall, plan.SourceSize, vc.minMergedSize)
+		}
+		probe, err := vc.runner.Probe(ctx, job.MergedFile)
+		if err != nil {
+			return nil, err
+		}
+		if container := probe.Container(); !slices.Contains(vc.sourceFormats, container) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedContainer, container)
+		}
+		job.Probe = probe
+		plan.SourceType = SourceSingleFile
+		plan.Inputs = 1
+		plan.Commands = append(plan.Commands, "use "+job.MergedFile+" as is, no merge")
+
+	case SourceDownload:
+		if err := vc.checkSourceURL(task.SourceURL); err != nil {
+			return nil, err
+		}
+		dir, err := vc.downloadDir(task)
+		if err != nil {
+			return nil, err
+		}
+		if task.Path == "" {
+			// Plan with the folder the download stage would give the task
+			withPath := *task
+			withPath.Path = dir
+			task = &withPath
+			job.Task = task
+		}
+		// ffprobe reads the source over HTTP without downloading all of it
+		probe, err := vc.runner.Probe(ctx, task.SourceURL)
+		if err != nil {
+			return nil, err
+		}
+		container := probe.Container()
+		if !slices.Contains(vc.sourceFormats, container) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedContainer, container)
+		}
+		plan.SourceSize, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+		job.Probe = probe
+		job.MergedFile = filepath.Join(dir, "merged."+container)
+		plan.SourceType = SourceDownload
+		plan.Inputs = 1
+		plan.Commands = append(plan.Commands, fmt.Sprintf("download %s into %s", redactURL(task.SourceURL), job.MergedFile))
+
+	default:
+		return nil, fmt.Errorf("%w: unknown source type: %s", ErrInvalidTask, task.SourceType)
+	}
+
+	if err := vc.checkSize(task, plan.SourceSize); err != nil {
+		return nil, err
+	}
+	if err := vc.checkProbe(task, job.Probe); err != nil {
+		return nil, err
+	}
+	vc.selectProfile(job)
+	if vc.wantsModeration(job) {
+		interval := vc.moderation.moderationInterval(job.Probe.DurationSeconds())
+		dir := filepath.Join(task.Path, "moderation")
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(moderationArgs(job.MergedFile, interval, dir)), vc.classifier.Name()+" moderation of the sampled frames")
+	}
+	if err := vc.transcodeStage(ctx, job); err != nil {
+		return nil, err
+	}
+	if stream := scte35Stream(job.Probe); stream != nil && len(task.AdBreaks) == 0 {
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(scte35Args(job.MergedFile, stream.Index, job.MergedFile+".scte35")))
+	}
+	if redacts(task) && job.Probe.VideoStream() != nil {
+		if task.DetectRedactions && vc.detector != nil {
+			interval := vc.detectionInterval
+			if interval <= 0 {
+				interval = DefaultDetectionInterval
+			}
+			dir := filepath.Join(task.Path, "detection")
+			plan.Commands = append(plan.Commands, ffmpeg.CommandLine(detectionArgs(job.MergedFile, interval.Seconds(), dir)), vc.detector.Name()+" detection of regions to redact")
+		}
+		filter, err := redactionFilter(task.Redactions, job.Probe.VideoStream())
+		if err != nil {
+			return nil, err
+		}
+		if filter == "" && task.DetectRedactions && vc.detector != nil {
+			filter = "<detected regions>"
+		}
+		if filter != "" {
+			redacted := filepath.Join(task.Path, "redacted.mkv")
+			plan.Commands = append(plan.Commands, ffmpeg.CommandLine(redactArgs(job.MergedFile, filter, redacted)))
+			job.MergedFile = redacted
+		}
+	}
+	transcoder := vc.transcoderFor(job)
+	if _, local := transcoder.(localTranscoder); local {
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(append([]string{"-i", job.MergedFile}, job.OutputArgs...)))
+	} else {
+		plan.Commands = append(plan.Commands, fmt.Sprintf("%s transcode of %s", transcoder.Name(), job.MergedFile))
+	}
+	if wantsSmoothStreaming(job) {
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(smoothStreamingArgs(job.Manifest, job.OutputDir)))
+	}
+	if wantsScrubbingProxy(job) {
+		proxyArgs := scrubbingProxyArgs(job.MergedFile, job.Profile.ScrubbingHeight, conformFrameRate(job.Probe.VideoStream(), job.Profile), vc.metadataArgs(nil, nil), filepath.Join(job.OutputDir, ScrubbingProxyName))
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(proxyArgs))
+	}
+	if wantsTrickPlay(job) {
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(trickPlayArgs(job.MergedFile, job.OutputDir, vc.metadataArgs(nil, nil))))
+	}
+	if wantsThumbnail(job) {
+		output := filepath.Join(job.OutputDir, ThumbnailName)
+		if thumbnailMode(job) == ThumbnailSmart {
+			luma, edges := thumbnailStatsFiles(job)
+			plan.Commands = append(plan.Commands, ffmpeg.CommandLine(thumbnailAnalysisArgs(job.MergedFile, thumbnailInterval(job.Probe.DurationSeconds()), luma, edges)),
+				"thumbnail of the selected frame to "+output)
+		} else {
+			plan.Commands = append(plan.Commands, ffmpeg.CommandLine(thumbnailArgs(job.MergedFile, roundMillis(fastThumbnailTime(job.Probe.DurationSeconds())), output)))
+		}
+	}
+	if wantsStoryboard(job) {
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(storyboardArgs(job.MergedFile, storyboardScenesFile(job), job.OutputDir)))
+	}
+	if vc.wantsCaptions(job) {
+		audio := captionAudioPath(job, vc.captioner)
+		audioArgs, err := captionAudioArgs(job.MergedFile, vc.captioner.AudioFormat(), audio)
+		if err != nil {
+			return nil, err
+		}
+		plan.Commands = append(plan.Commands, ffmpeg.CommandLine(audioArgs), fmt.Sprintf("%s captions of %s", vc.captioner.Name(), audio))
+	}
+
+	plan.Container = job.Probe.Container()
+	plan.Duration = job.Probe.DurationSeconds()
+	plan.Mode = job.Mode
+	plan.Profile = profileName(task)
+	plan.Version = job.Version
+	plan.Transcoder = transcoder.Name()
+	plan.OutputDir = job.OutputDir
+	plan.Outputs = outputLayout(job, vc.outputLayout)
+	if vc.wantsCaptions(job) {
+		// The language is only known once transcribed
+		language := task.CaptionLanguage
+		if language == "" {
+			language = "und"
+		}
+		plan.Outputs = append(plan.Outputs, filepath.Join(job.OutputDir, CaptionsDir, language+".vtt"))
+		if vc.translator != nil {
+			for _, to := range task.CaptionTranslations {
+				plan.Outputs = append(plan.Outputs, filepath.Join(job.OutputDir, CaptionsDir, to+".vtt"))
+			}
+		}
+	}
+	if vc.uploader != nil {
+		plan.UploadPrefix = job.Prefix
+	}
+	plan.EstimatedSize = estimateSize(job, plan.SourceSize)
+	plan.EstimatedSegments = vc.outputLayout.estimateSegments(job)
+	if source := sourceDuration(job); vc.estimator != nil && source > 0 {
+		if estimate, ok := vc.estimator.Estimate(ctx, plan.Profile, source); ok {
+			plan.EstimatedSeconds = estimate.Seconds()
+		}
+	}
+	return plan, nil
+}
+
+// logPlan logs the plan of the task instead of converting it
+func (vc *VideoConverter) logPlan(task *VideoTask) Result {
+	plan, err := vc.PlanTask(context.Background(), task)
+	if err != nil {
+		return classify(err)
+	}
+	serialized, _ := json.Marshal(plan)
+	slog.Info("Dry run", slog.Int("video_id", task.VideoID), slog.String("plan", string(serialized)))
+	return Success()
+}
+
+// totalSize returns the combined size of the files
+func totalSize(files []string) (int64, error) {
+	var total int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// outputLayout lists the files ffmpeg writes for the job, with the DASH
+// muxer's segment name templates
+func outputLayout(job *Job, layout OutputLayout) []string {
+	names := []string{layout.Manifest}
+	for _, template := range layout.segmentTemplates(job) {
+		names = append(names, expand(template, job.Task, job.Task.VideoID, job.Version))
+	}
+	if job.Mode == ModeAudioOnly {
+		names = append(names, "master.m3u8", "media_0.m3u8", "audio.mp3")
+	}
+	if wantsScrubbingProxy(job) {
+		names = append(names, ScrubbingProxyName)
+	}
+	if wantsThumbnail(job) {
+		names = append(names, ThumbnailName)
+	}
+	if wantsStoryboard(job) {
+		names = append(names, StoryboardName, filepath.Join(StoryboardDir, "scene-%04d.jpg"))
+	}
+	if wantsSmoothStreaming(job) {
+		names = append(names, filepath.Join(SmoothStreamingDir, SmoothStreamingManifest),
+			filepath.Join(SmoothStreamingDir, "QualityLevels(%d)", "Fragments(%s=%d)"))
+	}
+	if wantsTorrent(job) {
+		names = append(names, TorrentName)
+	}
+	if wantsTrickPlay(job) {
+		names = append(names, "master.m3u8", "media_0.m3u8",
+			filepath.Join(TrickPlayDir, TrickPlayPlaylist),
+			filepath.Join(TrickPlayDir, "trick-init.m4s"),
+			filepath.Join(TrickPlayDir, "trick-$Number%05d$.m4s"))
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(job.OutputDir, name)
+	}
+	return paths
+}
+
+// estimateSize roughly estimates the size of the output from the profile
+// bitrates, falling back to the source bitrate for copied or unconstrained
+// video. It is meant for comparing profiles, not for exact budgeting.
+func estimateSize(job *Job, sourceSize int64) int64 {
+	duration := job.Probe.DurationSeconds()
+	if duration <= 0 {
+		return sourceSize
+	}
+	if job.Mode == ModeAudioOnly {
+		// The DASH audio and the MP3 download
+		return int64(2 * defaultAudioBitrate * duration / 8)
+	}
+
+	var audioRate float64
+	if job.Probe.AudioStream() != nil {
+		audioRate = float64(parseBitrate(job.Profile.AudioBitrate, defaultAudioBitrate))
+	}
+	videoRate := float64(sourceSize)*8/duration - audioRate
+	if video := job.Probe.VideoStream(); video != nil && argValue(job.OutputArgs, "-c:v") != "copy" {
+		if job.Profile.VideoBitrate != "" {
+			videoRate = float64(parseBitrate(job.Profile.VideoBitrate, int(videoRate)))
+		} else if job.Profile.Height > 0 && video.Height > job.Profile.Height {
+			scale := float64(job.Profile.Height) / float64(video.Height)
+			videoRate *= scale * scale
+		}
+	}
+	return int64((max(videoRate, 0) + audioRate) * duration / 8)
+}
+
+// argValue returns the value following the option in args
+func argValue(args []string, option string) string {
+	if i := slices.Index(args, option); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
+
+// parseBitrate parses an ffmpeg bitrate such as "800k" or "2M" into bits
+// per second, returning def when it can't
+func parseBitrate(s string, def int) int {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		multiplier, s = 1000, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		multiplier, s = 1000000, s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return def
+	}
+	return int(v * float64(multiplier))
+}
@@ -0,0 +1,257 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// DefaultProfileName is the profile used by tasks that don't name one
+const DefaultProfileName = "default"
+
+// Profile is a named set of encoding settings. Empty codecs keep the
+// automatic behaviour: DASH-friendly streams are copied, anything else is
+// transcoded to H.264/AAC.
+type Profile struct {
+	Name         string `json:"name"`
+	VideoCodec   string `json:"video_codec,omitempty"`
+	VideoBitrate string `json:"video_bitrate,omitempty"`
+	Preset       string `json:"preset,omitempty"`
+	CRF          int    `json:"crf,omitempty"`
+	// Height scales the video down to at most this many lines, keeping
+	// the aspect ratio; with Width, the video is fit in the box as
+	// AspectPolicy says
+	Height       int    `json:"height,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	// ScrubbingProxy also writes an all-intra proxy for frame-accurate
+	// seeking, ScrubbingHeight lines high, DefaultScrubbingHeight when zero
+	ScrubbingProxy  bool `json:"scrubbing_proxy,omitempty"`
+	ScrubbingHeight int  `json:"scrubbing_height,omitempty"`
+	// TrickPlay also writes I-frame streams for fast-forward and rewind
+	// previews, signaled in the DASH manifest and an HLS master playlist
+	TrickPlay bool `json:"trick_play,omitempty"`
+	// MultiPeriod splits the DASH manifest of a video with ad breaks into
+	// a period per stretch of content, as some SSAI and DRM workflows need
+	MultiPeriod bool `json:"multi_period,omitempty"`
+	// MaxFrameRate caps the frame rate, within the source's family: a
+	// 59.94fps source becomes 29.97fps under a cap of 30
+	MaxFrameRate float64 `json:"max_frame_rate,omitempty"`
+	// Width scales the video down to at most this many columns
+	Width int `json:"width,omitempty"`
+	// AspectPolicy is AspectPreserve, the default, AspectPad or
+	// AspectCrop; the last two output exactly Width by Height
+	AspectPolicy string `json:"aspect_policy,omitempty"`
+	// Thumbnail also writes a thumbnail, picked as ThumbnailFast or
+	// ThumbnailSmart says
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Storyboard also writes the scenes of the video, with a thumbnail
+	// each, as JSON for editor timelines
+	Storyboard bool `json:"storyboard,omitempty"`
+	// VideoFilter and AudioFilter are ffmpeg filter chains appended to
+	// the renditions' filters, for one-off needs like "hqdn3d" or
+	// "unsharp"; they force a re-encode
+	VideoFilter string `json:"video_filter,omitempty"`
+	AudioFilter string `json:"audio_filter,omitempty"`
+	// MaxBytesPerMinute caps the size of each rendition per minute of
+	// video; one over it is handled as BudgetAction says, BudgetReencode
+	// when empty
+	MaxBytesPerMinute int64  `json:"max_bytes_per_minute,omitempty"`
+	BudgetAction      string `json:"budget_action,omitempty"`
+	// Torrent also writes a torrent of the output, with web seeds at the
+	// uploaded files, for P2P-assisted delivery, see WithTorrentSeeds
+	Torrent bool `json:"torrent,omitempty"`
+	// SmoothStreaming also packages the renditions for Smooth Streaming,
+	// for set-top boxes without DASH; it needs H.264 and AAC, so other
+	// source codecs are re-encoded rather than copied
+	SmoothStreaming bool `json:"smooth_streaming,omitempty"`
+	// OnDemand writes each rendition as a single fragmented MP4 with a
+	// sidx, addressed by byte ranges as the DASH on demand profile says,
+	// instead of a file per segment, named by the output layout's
+	// SingleFile. It can't be used with trick play or multiple periods.
+	OnDemand bool `json:"on_demand,omitempty"`
+	// KeepOrientation keeps Width and Height as given for portrait
+	// sources, which otherwise have them swapped, so a 1920x1080 profile
+	// encodes vertical video at 1080x1920 rather than letterboxed
+	KeepOrientation bool `json:"keep_orientation,omitempty"`
+	// Watermark is the path of an image, on the workers, overlaid on the
+	// bottom right corner of the video; it forces a re-encode
+	Watermark string `json:"watermark,omitempty"`
+}
+
+// DefaultProfile keeps the converter's automatic codec selection
+var DefaultProfile = Profile{Name: DefaultProfileName}
+
+// LoadProfiles reads a JSON array of profiles from a file
+func LoadProfiles(path string) ([]Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []Profile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles: %w", err)
+	}
+	for _, p := range profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("profile without a name in %s", path)
+		}
+		switch p.AspectPolicy {
+		case "", AspectPreserve:
+		case AspectPad, AspectCrop:
+			if p.Width <= 0 || p.Height <= 0 || p.Width%2 != 0 || p.Height%2 != 0 {
+				return nil, fmt.Errorf("profile %s: %s needs an even width and height", p.Name, p.AspectPolicy)
+			}
+		default:
+			return nil, fmt.Errorf("profile %s: unknown aspect policy %q", p.Name, p.AspectPolicy)
+		}
+		if err := checkThumbnailMode(p.Thumbnail); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if p.MaxBytesPerMinute < 0 {
+			return nil, fmt.Errorf("profile %s: negative max bytes per minute", p.Name)
+		}
+		if err := checkBudgetAction(p.BudgetAction); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if err := checkWatermark(p.Watermark); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if err := checkSmoothStreamingCodecs(p); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		if err := checkOnDemand(p, nil); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		for _, f := range []struct{ kind, chain, codec string }{{"video", p.VideoFilter, p.VideoCodec}, {"audio", p.AudioFilter, p.AudioCodec}} {
+			if f.chain == "" {
+				continue
+			}
+			if f.codec == "copy" {
+				return nil, fmt.Errorf("profile %s: %s filter with a copied %s stream", p.Name, f.kind, f.kind)
+			}
+			if err := checkCustomFilter(f.chain); err != nil {
+				return nil, fmt.Errorf("profile %s: %s %w", p.Name, f.kind, err)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// profile returns the task's profile, or the default one
+func (vc *VideoConverter) profile(task *VideoTask) (Profile, error) {
+	name := profileName(task)
+	if p, ok := vc.profiles[name]; ok {
+		return p, nil
+	}
+	if name == DefaultProfileName {
+		return DefaultProfile, nil
+	}
+	return Profile{}, fmt.Errorf("%w: unknown profile: %s", ErrInvalidTask, name)
+}
+
+// profileName returns the name of the profile the task asks for
+func profileName(task *VideoTask) string {
+	if task.Profile == "" {
+		return DefaultProfileName
+	}
+	return task.Profile
+}
+
+// orientProfile returns the profile for a portrait video: a landscape
+// box, or a Height alone, is turned to the video's orientation, so its
+// lines limit the shorter side, as they do for landscape video
+func orientProfile(profile Profile, video *ffmpeg.Stream) Profile {
+	if video == nil || profile.KeepOrientation || (profile.Width > 0 && profile.Width <= profile.Height) {
+		return profile
+	}
+	if width, height := video.DisplaySize(); height <= width {
+		return profile
+	}
+	profile.Width, profile.Height = profile.Height, profile.Width
+	return profile
+}
+
+// codecArgs returns the ffmpeg codec options for packaging the source to
+// DASH with the profile: unless the profile picks a codec, streams already
+// in DASH-friendly codecs are transmuxed and anything else is transcoded to
+// H.264/AAC
+func codecArgs(probe *ffmpeg.ProbeResult, profile Profile) []string {
+	video, audio := probe.VideoStream(), probe.AudioStream()
+	// AVI timestamps are unreliable for stream copy, always re-encode
+	container := probe.Container()
+	copyable := container != "avi"
+
+	args := []string{}
+	if video != nil {
+		codec := profile.VideoCodec
+		if codec == "" {
+			codec = "libx264"
+			// Scaling, capping the frame rate, normalizing colors and
+			// custom filters need a re-encode
+			if copyable && profile.Height == 0 && profile.Width == 0 && profile.VideoFilter == "" && profile.Watermark == "" && !exceedsFrameRate(video, profile) && !needsNormalization(video) && !isAnamorphic(video) && slices.Contains(dashCopyVideoCodecs, video.CodecName) && (!profile.SmoothStreaming || video.CodecName == "h264") {
+				codec = "copy"
+			}
+		}
+		args = append(args, "-c:v", codec)
+		if codec != "copy" {
+			if profile.VideoBitrate != "" {
+				args = append(args, "-b:v", profile.VideoBitrate)
+			}
+			if profile.Preset != "" {
+				args = append(args, "-preset", profile.Preset)
+			}
+			if profile.CRF > 0 {
+				args = append(args, "-crf", strconv.Itoa(profile.CRF))
+			}
+			filters := strings.Join(videoFilters(video, profile), ",")
+			if profile.Watermark != "" {
+				filters = watermarkGraph(filters, profile.Watermark)
+			}
+			if filters != "" {
+				args = append(args, "-vf", filters)
+			}
+			args = append(args, colorTagArgs(video)...)
+		}
+	}
+	if audio != nil {
+		codec := profile.AudioCodec
+		if codec == "" {
+			codec = "aac"
+			if copyable && profile.AudioFilter == "" && slices.Contains(dashCopyAudioCodecs, audio.CodecName) && (!profile.SmoothStreaming || audio.CodecName == "aac") {
+				codec = "copy"
+			}
+		}
+		args = append(args, "-c:a", codec)
+		if codec != "copy" && profile.AudioBitrate != "" {
+			args = append(args, "-b:a", profile.AudioBitrate)
+		}
+		if codec != "copy" && profile.AudioFilter != "" {
+			args = append(args, "-af", profile.AudioFilter)
+		}
+	}
+	return args
+}
+
+// RequiredEncoders are the ffmpeg encoders the profile may need; automatic
+// codec selection falls back to libx264 and aac when it can't transmux
+func (p Profile) RequiredEncoders() []string {
+	var encoders []string
+	for _, codec := range []string{p.VideoCodec, p.AudioCodec} {
+		if codec != "copy" && codec != "" {
+			encoders = append(encoders, codec)
+		}
+	}
+	if p.VideoCodec == "" || ((p.ScrubbingProxy || p.TrickPlay) && p.VideoCodec != "libx264") {
+		encoders = append(encoders, "libx264")
+	}
+	if p.AudioCodec == "" {
+		encoders = append(encoders, "aac")
+	}
+	return encoders
+}
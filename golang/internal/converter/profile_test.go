@@ -0,0 +1,97 @@
+package converter
+
+import (
+	"testing"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+func TestOrientProfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		profile    Profile
+		video      *ffmpeg.Stream
+		wantWidth  int
+		wantHeight int
+	}{
+		{
+			name:       "landscape source",
+			profile:    Profile{Width: 1280, Height: 720},
+			video:      &ffmpeg.Stream{Width: 1920, Height: 1080},
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+		{
+			name:       "portrait source",
+			profile:    Profile{Width: 1280, Height: 720},
+			video:      &ffmpeg.Stream{Width: 1080, Height: 1920},
+			wantWidth:  720,
+			wantHeight: 1280,
+		},
+		{
+			name:       "height alone limits the width of portrait sources",
+			profile:    Profile{Height: 720},
+			video:      &ffmpeg.Stream{Width: 1080, Height: 1920},
+			wantWidth:  720,
+			wantHeight: 0,
+		},
+		{
+			name:       "square source",
+			profile:    Profile{Width: 1280, Height: 720},
+			video:      &ffmpeg.Stream{Width: 1080, Height: 1080},
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+		{
+			name:    "source rotated by its display matrix",
+			profile: Profile{Width: 1280, Height: 720},
+			video: &ffmpeg.Stream{Width: 1920, Height: 1080,
+				SideData: []ffmpeg.SideData{{Type: "Display Matrix", Rotation: -90}}},
+			wantWidth:  720,
+			wantHeight: 1280,
+		},
+		{
+			name:       "source rotated by its rotate tag",
+			profile:    Profile{Width: 1280, Height: 720},
+			video:      &ffmpeg.Stream{Width: 1920, Height: 1080, Tags: map[string]string{"rotate": "270"}},
+			wantWidth:  720,
+			wantHeight: 1280,
+		},
+		{
+			name:    "upside down source stays landscape",
+			profile: Profile{Width: 1280, Height: 720},
+			video: &ffmpeg.Stream{Width: 1920, Height: 1080,
+				SideData: []ffmpeg.SideData{{Type: "Display Matrix", Rotation: 180}}},
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+		{
+			name:       "portrait profile",
+			profile:    Profile{Width: 720, Height: 1280},
+			video:      &ffmpeg.Stream{Width: 1080, Height: 1920},
+			wantWidth:  720,
+			wantHeight: 1280,
+		},
+		{
+			name:       "profile keeping its orientation",
+			profile:    Profile{Width: 1280, Height: 720, KeepOrientation: true},
+			video:      &ffmpeg.Stream{Width: 1080, Height: 1920},
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+		{
+			name:       "no video",
+			profile:    Profile{Width: 1280, Height: 720},
+			wantWidth:  1280,
+			wantHeight: 720,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := orientProfile(tt.profile, tt.video)
+			if got.Width != tt.wantWidth || got.Height != tt.wantHeight {
+				t.Errorf("size = %dx%d, want %dx%d", got.Width, got.Height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// DefaultDetectionInterval is how often frames are sampled for a
+// RegionDetector
+const DefaultDetectionInterval = time.Second
+
+// Redaction is a rectangle of the video, in pixels of the source, blurred
+// from Start to End seconds; an End of zero lasts until the end
+type Redaction struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Start  float64 `json:"start,omitempty"`
+	End    float64 `json:"end,omitempty"`
+}
+
+// RegionDetector finds regions to redact in a frame, such as faces, for
+// tasks with DetectRedactions, see WithRegionDetector
+type RegionDetector interface {
+	Name() string
+	// Detect returns the rectangles to blur in a JPEG frame, in its
+	// pixels; their times are ignored
+	Detect(ctx context.Context, frame string) ([]Redaction, error)
+}
+
+// WithRegionDetector detects the regions to redact with d, in frames
+// sampled every interval, DefaultDetectionInterval when zero
+func WithRegionDetector(d RegionDetector, interval time.Duration) Option {
+	return func(vc *VideoConverter) {
+		vc.detector = d
+		vc.detectionInterval = interval
+	}
+}
+
+// redacts reports whether the task blurs regions of its video, which
+// makes its output differ from that of an identical source
+func redacts(task *VideoTask) bool {
+	return len(task.Redactions) > 0 || task.DetectRedactions
+}
+
+// redactStage re-encodes the source with the task's regions, and those
+// the detector finds, blurred, so every rendition, proxy and trick play
+// stream is made from the redacted copy. It runs after the transcode
+// stage, which reads the ad breaks embedded in the original source.
+func (vc *VideoConverter) redactStage(ctx context.Context, job *Job) error {
+	if !redacts(job.Task) || job.DuplicateOf != 0 || job.Probe == nil || job.Probe.VideoStream() == nil {
+		return nil
+	}
+	if job.Task.DryRun || vc.dryRun {
+		return nil
+	}
+
+	redactions := append([]Redaction(nil), job.Task.Redactions...)
+	if job.Task.DetectRedactions {
+		if vc.detector == nil {
+			slog.Warn("Redaction detection requested but no detector is configured", slog.Int("video_id", job.Task.VideoID))
+		} else {
+			detected, err := vc.detectRedactions(ctx, job)
+			if err != nil {
+				return err
+			}
+			redactions = append(redactions, detected...)
+		}
+	}
+	filter, err := redactionFilter(redactions, job.Probe.VideoStream())
+	if err != nil {
+		return err
+	}
+	if filter == "" {
+		return nil
+	}
+
+	redacted := filepath.Join(job.Task.Path, "redacted.mkv")
+	slog.Info("Redacting video", slog.Int("video_id", job.Task.VideoID), slog.Int("regions", len(redactions)))
+	output, err := vc.runnerFor(job).Run(ctx, redactArgs(job.MergedFile, filter, redacted)...)
+	if err != nil {
+		os.Remove(redacted)
+		return fmt.Errorf("failed to redact video: %w", ffmpeg.ParseError(err, output))
+	}
+	if err := removeMerged(job); err != nil {
+		return err
+	}
+	job.MergedFile = redacted
+	job.Redacted = true
+	// The output no longer matches the source, so it can't be reused for
+	// an identical one
+	job.SourceHash = ""
+	return vc.sealMerged(job)
+}
+
+// redactArgs are the ffmpeg options writing a copy of the source with the
+// filter applied to its video and its audio as is. The copy is nearly
+// lossless, as it is encoded again for the output.
+func redactArgs(source, filter, output string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0", "0:a?"},
+			VideoCodec:   "libx264",
+			AudioCodec:   "copy",
+			VideoFilters: []string{filter},
+			Options:      []string{"-preset", "fast", "-crf", "12"},
+			File:         output,
+		}},
+	}.Args()
+}
+
+// redactionFilter returns the filtergraph blurring each redaction for its
+// time range: a copy of the frame is cropped to the region, blurred and
+// overlaid back. Regions are clamped to the frame.
+func redactionFilter(redactions []Redaction, video *ffmpeg.Stream) (string, error) {
+	var regions []Redaction
+	for _, r := range redactions {
+		if r.Width <= 0 || r.Height <= 0 || r.X < 0 || r.Y < 0 || r.Start < 0 || (r.End != 0 && r.End <= r.Start) {
+			return "", fmt.Errorf("%w: bad redaction %dx%d+%d+%d from %gs to %gs", ErrInvalidTask, r.Width, r.Height, r.X, r.Y, r.Start, r.End)
+		}
+		if video.Width > 0 && video.Height > 0 {
+			if r.X >= video.Width || r.Y >= video.Height {
+				continue
+			}
+			r.Width = min(r.Width, video.Width-r.X)
+			r.Height = min(r.Height, video.Height-r.Y)
+		}
+		regions = append(regions, r)
+	}
+	if len(regions) == 0 {
+		return "", nil
+	}
+
+	var graph strings.Builder
+	graph.WriteString("split=" + strconv.Itoa(len(regions)+1) + "[base]")
+	for i := range regions {
+		fmt.Fprintf(&graph, "[r%d]", i)
+	}
+	for i, r := range regions {
+		sigma := max(10, min(r.Width, r.Height)/6)
+		fmt.Fprintf(&graph, ";[r%d]crop=%d:%d:%d:%d,gblur=sigma=%d[b%d]", i, r.Width, r.Height, r.X, r.Y, sigma, i)
+	}
+	in := "base"
+	for i, r := range regions {
+		fmt.Fprintf(&graph, ";[%s][b%d]overlay=%d:%d", in, i, r.X, r.Y)
+		if r.Start > 0 || r.End > 0 {
+			end := "inf"
+			if r.End > 0 {
+				end = strconv.FormatFloat(r.End, 'f', -1, 64)
+			}
+			fmt.Fprintf(&graph, ":enable='between(t,%s,%s)'", strconv.FormatFloat(r.Start, 'f', -1, 64), end)
+		}
+		if i < len(regions)-1 {
+			in = "o" + strconv.Itoa(i)
+			graph.WriteString("[" + in + "]")
+		}
+	}
+	return graph.String(), nil
+}
+
+// detectRedactions samples frames of the source and asks the detector for
+// the regions to blur in each. A region stays blurred until the next
+// sampled frame, grown by a quarter to cover movement in between, and
+// regions overlapping in consecutive frames are merged into one.
+func (vc *VideoConverter) detectRedactions(ctx context.Context, job *Job) ([]Redaction, error) {
+	interval := vc.detectionInterval
+	if interval <= 0 {
+		interval = DefaultDetectionInterval
+	}
+	dir := filepath.Join(job.Task.Path, "detection")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create detection directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	output, err := vc.runnerFor(job).Run(ctx, detectionArgs(job.MergedFile, interval.Seconds(), dir)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample frames for redaction: %w", ffmpeg.ParseError(err, output))
+	}
+	frames, err := filepath.Glob(filepath.Join(dir, "frame-*.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(frames)
+
+	var done, open []Redaction
+	for i, frame := range frames {
+		found, err := vc.detector.Detect(ctx, frame)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect regions in frame %d: %w", i+1, err)
+		}
+		start := float64(i) * interval.Seconds()
+		var next []Redaction
+		for _, r := range found {
+			r = grow(r, 0.25)
+			r.Start, r.End = start, start+interval.Seconds()
+			for j, o := range open {
+				if o.Width > 0 && overlaps(o, r) {
+					r = union(o, r)
+					r.Start = o.Start
+					open[j].Width = 0 // merged
+					break
+				}
+			}
+			next = append(next, r)
+		}
+		for _, o := range open {
+			if o.Width > 0 {
+				done = append(done, o)
+			}
+		}
+		open = next
+	}
+	done = append(done, open...)
+	slog.Info("Detected regions to redact", slog.Int("video_id", job.Task.VideoID), slog.String("detector", vc.detector.Name()),
+		slog.Int("frames", len(frames)), slog.Int("regions", len(done)))
+	return done, nil
+}
+
+// detectionArgs are the ffmpeg options sampling a frame of the source, at
+// full size, every interval seconds into dir
+func detectionArgs(source string, interval float64, dir string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0"},
+			VideoFilters: []string{"fps=1/" + strconv.FormatFloat(interval, 'f', -1, 64)},
+			Options:      []string{"-q:v", "3"},
+			File:         filepath.Join(dir, "frame-%05d.jpg"),
+		}},
+	}.Args()
+}
+
+// grow enlarges the rectangle by the fraction of its size, around its center
+func grow(r Redaction, fraction float64) Redaction {
+	dx, dy := int(math.Round(float64(r.Width)*fraction/2)), int(math.Round(float64(r.Height)*fraction/2))
+	x, y := max(0, r.X-dx), max(0, r.Y-dy)
+	r.Width, r.Height = r.X+r.Width+dx-x, r.Y+r.Height+dy-y
+	r.X, r.Y = x, y
+	return r
+}
+
+// overlaps reports whether two rectangles intersect
+func overlaps(a, b Redaction) bool {
+	return a.X < b.X+b.Width && b.X < a.X+a.Width && a.Y < b.Y+b.Height && b.Y < a.Y+a.Height
+}
+
+// union returns the rectangle covering both, lasting until b ends
+func union(a, b Redaction) Redaction {
+	x, y := min(a.X, b.X), min(a.Y, b.Y)
+	return Redaction{
+		X:      x,
+		Y:      y,
+		Width:  max(a.X+a.Width, b.X+b.Width) - x,
+		Height: max(a.Y+a.Height, b.Y+b.Height) - y,
+		Start:  b.Start,
+		End:    b.End,
+	}
+}
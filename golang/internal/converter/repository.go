@@ -0,0 +1,182 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Repository stores what the converter needs to remember between tasks
+type Repository interface {
+	// IsProcessed reports whether the video was already converted successfully
+	IsProcessed(ctx context.Context, videoID int) (bool, error)
+	// MarkProcessed records a successful conversion
+	MarkProcessed(ctx context.Context, videoID int) error
+	// RegisterError stores the details of a failure in the error log
+	RegisterError(ctx context.Context, errorData map[string]interface{}) error
+	// FindSource returns the record of a processed source with the hash,
+	// converted with the profile, with settings fingerprinted by profileHash
+	FindSource(ctx context.Context, contentHash, profile, profileHash string) (SourceRecord, bool, error)
+	// SaveSource records the source hash of a video and where its output is
+	SaveSource(ctx context.Context, record SourceRecord) error
+	// LatestVersion returns the highest output version of the video, 0 when none
+	LatestVersion(ctx context.Context, videoID int) (int, error)
+	// SaveVersion records an output version, uploaded to prefix, and makes
+	// it the active one
+	SaveVersion(ctx context.Context, videoID, version int, profile, prefix string) error
+	// CreateBatch records a batch with its tasks pending
+	CreateBatch(ctx context.Context, batchID string, videoIDs []int) error
+	// UpdateBatchTask records the final status of a batch task
+	UpdateBatchTask(ctx context.Context, batchID string, videoID int, status string) error
+	// ClaimTask records that owner converts the task with the key until ttl
+	// passes, unless another owner's claim hasn't expired yet
+	ClaimTask(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+	// RenewClaim extends owner's claim by ttl
+	RenewClaim(ctx context.Context, key, owner string, ttl time.Duration) error
+	// ReleaseClaim removes owner's claim
+	ReleaseClaim(ctx context.Context, key, owner string) error
+	// SaveVerdict records the moderation verdict of a video for review
+	SaveVerdict(ctx context.Context, verdict ModerationVerdict) error
+	// SaveEncodeRecord records how an output version was made
+	SaveEncodeRecord(ctx context.Context, record EncodeRecord) error
+	// TenantSettings returns the settings of a tenant, false when it has none
+	TenantSettings(ctx context.Context, tenant string) (TenantSettings, bool, error)
+	// RecordConversion records a successful conversion all at once, so a
+	// failure leaves none of it recorded
+	RecordConversion(ctx context.Context, c Conversion) error
+}
+
+// Conversion is what the record stage stores about a successful conversion
+type Conversion struct {
+	VideoID int
+	// Version is the output version made and Encode how, nil when the
+	// output of a duplicate was reused
+	Version *OutputVersion
+	Encode  *EncodeRecord
+	// Source is the source record for deduplication, nil when the source
+	// wasn't hashed
+	Source *SourceRecord
+	// Events are added to the outbox, see OutboxPublisher
+	Events []OutboxEvent
+}
+
+// querier runs statements on the connection pool or in a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlRepository is the Repository backed by the processed_videos,
+// process_errors_log, video_sources, output_versions, batch, job_claims,
+// moderation_verdicts, encode_records, tenant_settings and outbox_events
+// tables
+type sqlRepository struct {
+	db *database.DB
+}
+
+// NewSQLRepository creates the Repository backed by the database
+func NewSQLRepository(db *database.DB) Repository {
+	return &sqlRepository{db: db}
+}
+
+func (r *sqlRepository) IsProcessed(ctx context.Context, videoID int) (bool, error) {
+	return IsProcessed(r.db, videoID), nil
+}
+
+func (r *sqlRepository) MarkProcessed(ctx context.Context, videoID int) error {
+	return MarkProcess(r.db, videoID)
+}
+
+func (r *sqlRepository) RegisterError(ctx context.Context, errorData map[string]interface{}) error {
+	return registerError(r.db, errorData)
+}
+
+func (r *sqlRepository) FindSource(ctx context.Context, contentHash, profile, profileHash string) (SourceRecord, bool, error) {
+	return FindSource(ctx, r.db, contentHash, profile, profileHash)
+}
+
+func (r *sqlRepository) SaveSource(ctx context.Context, record SourceRecord) error {
+	return SaveSource(ctx, r.db, record)
+}
+
+func (r *sqlRepository) LatestVersion(ctx context.Context, videoID int) (int, error) {
+	return LatestVersion(ctx, r.db, videoID)
+}
+
+func (r *sqlRepository) SaveVersion(ctx context.Context, videoID, version int, profile, prefix string) error {
+	return SaveVersion(ctx, r.db, videoID, version, profile, prefix)
+}
+
+func (r *sqlRepository) CreateBatch(ctx context.Context, batchID string, videoIDs []int) error {
+	return CreateBatch(ctx, r.db, batchID, videoIDs)
+}
+
+func (r *sqlRepository) UpdateBatchTask(ctx context.Context, batchID string, videoID int, status string) error {
+	return UpdateBatchTask(ctx, r.db, batchID, videoID, status)
+}
+
+func (r *sqlRepository) ClaimTask(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return ClaimTask(ctx, r.db, key, owner, ttl)
+}
+
+func (r *sqlRepository) RenewClaim(ctx context.Context, key, owner string, ttl time.Duration) error {
+	return RenewClaim(ctx, r.db, key, owner, ttl)
+}
+
+func (r *sqlRepository) ReleaseClaim(ctx context.Context, key, owner string) error {
+	return ReleaseClaim(ctx, r.db, key, owner)
+}
+
+func (r *sqlRepository) SaveVerdict(ctx context.Context, verdict ModerationVerdict) error {
+	return SaveVerdict(ctx, r.db, verdict)
+}
+
+func (r *sqlRepository) SaveEncodeRecord(ctx context.Context, record EncodeRecord) error {
+	return SaveEncodeRecord(ctx, r.db, record)
+}
+
+func (r *sqlRepository) TenantSettings(ctx context.Context, tenant string) (TenantSettings, bool, error) {
+	settings, err := GetTenantSettings(ctx, r.db, tenant)
+	if errors.Is(err, ErrTenantNotFound) {
+		return TenantSettings{}, false, nil
+	}
+	return settings, err == nil, err
+}
+
+func (r *sqlRepository) RecordConversion(ctx context.Context, c Conversion) error {
+	return database.Retry(ctx, func() error {
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if v := c.Version; v != nil {
+			if err := saveVersion(ctx, r.db, tx, c.VideoID, v.Version, v.Profile, v.Prefix); err != nil {
+				return err
+			}
+		}
+		if c.Encode != nil {
+			if err := saveEncodeRecord(ctx, r.db, tx, *c.Encode); err != nil {
+				return err
+			}
+		}
+		if c.Source != nil {
+			if err := saveSource(ctx, r.db, tx, *c.Source); err != nil {
+				return err
+			}
+		}
+		if err := markProcessed(ctx, r.db, tx, c.VideoID); err != nil {
+			return err
+		}
+		for _, event := range c.Events {
+			if err := saveOutboxEvent(ctx, r.db, tx, event); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,111 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// ErrInvalidTask is returned when a task message can never be processed as sent
+var ErrInvalidTask = errors.New("invalid task")
+
+// ErrTranscodeRejected is wrapped by remote transcoders when the service
+// rejects the media, so the task is dead-lettered instead of retried
+var ErrTranscodeRejected = errors.New("transcode rejected")
+
+// Outcome tells the consumer what to do with a message after handling it
+type Outcome int
+
+const (
+	// OutcomeSuccess acknowledges the message
+	OutcomeSuccess Outcome = iota
+	// OutcomeRetry requeues the message to be processed again
+	OutcomeRetry
+	// OutcomePermanent dead-letters the message, retrying would fail the same way
+	OutcomePermanent
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeRetry:
+		return "retry"
+	case OutcomePermanent:
+		return "permanent"
+	}
+	return "unknown"
+}
+
+// Result is the outcome of handling a message and the error that caused it
+type Result struct {
+	Outcome Outcome
+	Err     error
+	// Delay, on a retry, is how long to wait before handing the message
+	// out again. Such a retry was postponed rather than failed, so it
+	// doesn't count against the message's retry attempts.
+	Delay time.Duration
+}
+
+// Success is the result of a handled message
+func Success() Result {
+	return Result{Outcome: OutcomeSuccess}
+}
+
+// Retry is the result of a transient failure
+func Retry(err error) Result {
+	return Result{Outcome: OutcomeRetry, Err: err}
+}
+
+// Defer is the result of a message that can't be handled yet and should
+// come back after delay, e.g. a duplicate of a task still being converted
+func Defer(err error, delay time.Duration) Result {
+	return Result{Outcome: OutcomeRetry, Err: err, Delay: delay}
+}
+
+// Permanent is the result of a failure that retrying won't fix
+func Permanent(err error) Result {
+	return Result{Outcome: OutcomePermanent, Err: err}
+}
+
+// classify maps a processing error to a result: bad input and media that
+// ffmpeg rejects are permanent, anything else (database, storage, disk) is retried
+func classify(err error) Result {
+	if err == nil {
+		return Success()
+	}
+	// A conversion cut short by a shutdown is redelivered
+	if errors.Is(err, context.Canceled) {
+		return Retry(err)
+	}
+	// ffmpeg exits with an error on a full disk too, which isn't the media's fault
+	if errors.Is(err, ffmpeg.ErrNoSpace) {
+		return Retry(err)
+	}
+	switch {
+	case errors.Is(err, ErrInvalidTask),
+		errors.Is(err, ErrNoChunks),
+		errors.Is(err, ErrNoSourceFile),
+		errors.Is(err, ErrDownloadRejected),
+		errors.Is(err, ErrNoFrames),
+		errors.Is(err, ErrManifestMismatch),
+		errors.Is(err, ErrMergedTooSmall),
+		errors.Is(err, ErrUnsupportedContainer),
+		errors.Is(err, ErrTranscodeRejected),
+		errors.Is(err, ErrLimitExceeded),
+		errors.Is(err, ErrContentBlocked),
+		errors.Is(err, ffmpeg.ErrInvalidInput):
+		return Permanent(err)
+	}
+
+	// ffmpeg exiting with an error means it can't read the media; being
+	// killed by a signal (OOM, shutdown) is worth another attempt
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		return Permanent(err)
+	}
+	return Retry(err)
+}
@@ -0,0 +1,71 @@
+package converter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+)
+
+// ProfileRollout converts a share of the tasks asking for a profile with a
+// canary profile instead, to try new settings on real traffic. The canary
+// name is what the output version, encode record, job stats and metrics
+// are tagged with, so its results can be compared with the profile's.
+type ProfileRollout struct {
+	// Profile is the profile the tasks ask for, DefaultProfileName for
+	// those naming none
+	Profile string
+	// Canary is the profile converting the share of them
+	Canary string
+	// Percent is the share of the tasks, from 0 to 100
+	Percent float64
+}
+
+// WithProfileRollouts sends a share of the tasks asking for a profile to
+// a canary one; NewVideoConverter panics if a canary isn't a registered
+// profile
+func WithProfileRollouts(rollouts ...ProfileRollout) Option {
+	return func(vc *VideoConverter) {
+		vc.rollouts = append(vc.rollouts, rollouts...)
+	}
+}
+
+// checkRollouts returns an error for a rollout to an unknown profile or
+// out of range
+func (vc *VideoConverter) checkRollouts() error {
+	for _, r := range vc.rollouts {
+		if _, ok := vc.profiles[r.Canary]; !ok && r.Canary != DefaultProfileName {
+			return fmt.Errorf("rollout of %s to unknown profile %s", r.Profile, r.Canary)
+		}
+		if r.Percent < 0 || r.Percent > 100 {
+			return fmt.Errorf("rollout of %s to %s: percent %g out of range", r.Profile, r.Canary, r.Percent)
+		}
+	}
+	return nil
+}
+
+// applyRollout switches the task to the canary profile of the first
+// rollout of its profile that picks it, and returns the profile it asked
+// for, "" when none did. The pick hashes the video id, so retries and
+// reprocessing of a video land on the same profile.
+func (vc *VideoConverter) applyRollout(task *VideoTask) string {
+	name := profileName(task)
+	for _, r := range vc.rollouts {
+		if r.Profile != name || !inRollout(task.VideoID, r) {
+			continue
+		}
+		slog.Info("Converting with canary profile", slog.Int("video_id", task.VideoID),
+			slog.String("profile", name), slog.String("canary", r.Canary))
+		task.Profile = r.Canary
+		return name
+	}
+	return ""
+}
+
+// inRollout reports whether the video falls in the rollout's share. The
+// canary name is part of the hash, so each rollout picks other videos.
+func inRollout(videoID int, r ProfileRollout) bool {
+	h := fnv.New32a()
+	h.Write([]byte(r.Canary + "/" + strconv.Itoa(videoID)))
+	return float64(h.Sum32()%10000) < r.Percent*100
+}
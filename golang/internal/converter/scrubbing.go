@@ -0,0 +1,79 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+const (
+	// ScrubbingRendition names the scrubbing proxy in the job's timings
+	ScrubbingRendition = "scrubbing"
+	// ScrubbingProxyName is the proxy's file name next to the DASH output
+	ScrubbingProxyName = "scrubbing.mp4"
+	// DefaultScrubbingHeight is the proxy's height when the profile sets none
+	DefaultScrubbingHeight = 360
+)
+
+// wantsScrubbingProxy reports whether the job also writes a scrubbing
+// proxy: a video job whose task or profile asks for one
+func wantsScrubbingProxy(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && (job.Task.ScrubbingProxy || job.Profile.ScrubbingProxy)
+}
+
+// scrubbingProxyArgs are the ffmpeg options encoding a small, silent,
+// all-intra H.264 copy of the source: every frame is a keyframe, so editing
+// and review tools can seek to any frame without decoding its neighbours.
+// rate conforms the frame rate like the streaming rendition's, so frame
+// numbers match, "" to keep the source's, and metadata are the metadata
+// options of the output.
+func scrubbingProxyArgs(input string, height int, rate string, metadata []string, outputFile string) []string {
+	if height <= 0 {
+		height = DefaultScrubbingHeight
+	}
+	filters := []string{previewScale(height)}
+	if rate != "" {
+		filters = append([]string{"fps=" + rate}, filters...)
+	}
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: input}},
+		Outputs: []ffmpeg.Output{{
+			NoAudio:      true,
+			VideoCodec:   "libx264",
+			VideoFilters: filters,
+			Options: append([]string{
+				"-preset", "veryfast",
+				"-crf", "30",
+				"-g", "1",
+				"-keyint_min", "1",
+				"-sc_threshold", "0",
+				"-pix_fmt", "yuv420p",
+				"-movflags", "+faststart",
+			}, metadata...),
+			File: outputFile,
+		}},
+	}.Args()
+}
+
+// encodeScrubbingProxy writes the job's scrubbing proxy to its output
+// directory, so it is uploaded with the streaming renditions, and records
+// how long it took
+func (vc *VideoConverter) encodeScrubbingProxy(ctx context.Context, job *Job, runner ffmpeg.Runner) error {
+	outputFile := filepath.Join(job.OutputDir, ScrubbingProxyName)
+	slog.Info("Encoding scrubbing proxy", slog.String("path", outputFile))
+	started := time.Now()
+	output, err := runner.Run(ctx, scrubbingProxyArgs(job.MergedFile, job.Profile.ScrubbingHeight, conformFrameRate(job.Probe.VideoStream(), job.Profile), vc.metadataArgs(nil, nil), outputFile)...)
+	if err != nil {
+		return fmt.Errorf("failed to encode scrubbing proxy: %w", ffmpeg.ParseError(err, output))
+	}
+	if job.Timings.TranscodeMS == nil {
+		job.Timings.TranscodeMS = map[string]int64{}
+	}
+	job.Timings.TranscodeMS[ScrubbingRendition] = time.Since(started).Milliseconds()
+	return nil
+}
@@ -0,0 +1,253 @@
+package converter
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SCTE-35 splice commands and segmentation types the converter reads
+const (
+	scte35TableID         = 0xFC
+	scte35SpliceInsert    = 0x05
+	scte35TimeSignal      = 0x06
+	scte35SegmentationTag = 0x02
+	scte35ClockRate       = 90000
+	scte35PTSWrap         = 1 << 33
+)
+
+// scte35AdStarts are the segmentation types starting an ad: provider and
+// distributor advertisements, placement opportunities and overlays
+var scte35AdStarts = map[byte]bool{0x30: true, 0x32: true, 0x34: true, 0x36: true, 0x38: true, 0x3A: true, 0x3C: true, 0x44: true, 0x46: true}
+
+// scte35AdEnds are the segmentation types ending one
+var scte35AdEnds = map[byte]bool{0x31: true, 0x33: true, 0x35: true, 0x37: true, 0x39: true, 0x3B: true, 0x3D: true, 0x45: true, 0x47: true}
+
+var errSCTE35Truncated = errors.New("truncated scte-35 section")
+
+// scte35Cue is a splice point read from a splice_info_section: an ad
+// starting (out) or the program resuming, at a PTS on the 90kHz clock
+type scte35Cue struct {
+	out      bool
+	pts      uint64
+	duration uint64
+}
+
+// parseSCTE35 reads the cues of the splice_info_sections in data, as
+// written by ffmpeg's data muxer for an scte_35 stream. Only splice_insert
+// and time_signal commands with a time are cues; immediate splices can't
+// be placed in a VOD asset.
+func parseSCTE35(data []byte) ([]scte35Cue, error) {
+	var cues []scte35Cue
+	for len(data) >= 3 {
+		if data[0] != scte35TableID {
+			// Not a section start; resync on the next table id
+			data = data[1:]
+			continue
+		}
+		length := 3 + int(binary.BigEndian.Uint16(data[1:3])&0x0FFF)
+		if length > len(data) {
+			return cues, errSCTE35Truncated
+		}
+		cue, ok, err := parseSpliceInfoSection(data[:length])
+		if err != nil {
+			return cues, err
+		}
+		if ok {
+			cues = append(cues, cue)
+		}
+		data = data[length:]
+	}
+	return cues, nil
+}
+
+// parseSpliceInfoSection returns the cue of one section, if it has one
+func parseSpliceInfoSection(s []byte) (scte35Cue, bool, error) {
+	var cue scte35Cue
+	if len(s) < 14 {
+		return cue, false, errSCTE35Truncated
+	}
+	if s[4]&0x80 != 0 {
+		// Encrypted sections can't be read
+		return cue, false, nil
+	}
+	adjustment := uint64(s[4]&0x01)<<32 | uint64(binary.BigEndian.Uint32(s[5:9]))
+	commandLength := int(binary.BigEndian.Uint16(s[11:13]) & 0x0FFF)
+	commandType := s[13]
+	command := s[14:]
+	if commandLength != 0x0FFF && commandLength <= len(command) {
+		command = command[:commandLength]
+	}
+
+	var ok bool
+	var err error
+	switch commandType {
+	case scte35SpliceInsert:
+		cue, ok, err = parseSpliceInsert(command)
+	case scte35TimeSignal:
+		var pts uint64
+		var n int
+		pts, ok, n, err = parseSpliceTime(command)
+		if err != nil || !ok {
+			return cue, false, err
+		}
+		cue.pts = pts
+		if commandLength == 0x0FFF {
+			commandLength = n
+		}
+		ok, err = parseSegmentation(s, 14+commandLength, &cue)
+	default:
+		return cue, false, nil
+	}
+	if err != nil || !ok {
+		return cue, false, err
+	}
+	cue.pts = (cue.pts + adjustment) % scte35PTSWrap
+	return cue, true, nil
+}
+
+// parseSpliceInsert reads a splice_insert command
+func parseSpliceInsert(c []byte) (scte35Cue, bool, error) {
+	var cue scte35Cue
+	if len(c) < 5 {
+		return cue, false, errSCTE35Truncated
+	}
+	if c[4]&0x80 != 0 {
+		// Cancels an earlier event
+		return cue, false, nil
+	}
+	if len(c) < 6 {
+		return cue, false, errSCTE35Truncated
+	}
+	flags := c[5]
+	cue.out = flags&0x80 != 0
+	program, hasDuration, immediate := flags&0x40 != 0, flags&0x20 != 0, flags&0x10 != 0
+	if immediate {
+		return cue, false, nil
+	}
+	rest := c[6:]
+	if program {
+		pts, ok, n, err := parseSpliceTime(rest)
+		if err != nil || !ok {
+			return cue, false, err
+		}
+		cue.pts, rest = pts, rest[n:]
+	} else {
+		// Component splices; the first component's time stands for all
+		if len(rest) < 1 {
+			return cue, false, errSCTE35Truncated
+		}
+		count := int(rest[0])
+		rest = rest[1:]
+		found := false
+		for i := 0; i < count; i++ {
+			if len(rest) < 1 {
+				return cue, false, errSCTE35Truncated
+			}
+			pts, ok, n, err := parseSpliceTime(rest[1:])
+			if err != nil {
+				return cue, false, err
+			}
+			if ok && !found {
+				cue.pts, found = pts, true
+			}
+			rest = rest[1+n:]
+		}
+		if !found {
+			return cue, false, nil
+		}
+	}
+	if hasDuration {
+		if len(rest) < 5 {
+			return cue, false, errSCTE35Truncated
+		}
+		cue.duration = read33(rest)
+	}
+	return cue, true, nil
+}
+
+// parseSpliceTime reads a splice_time, returning its PTS, whether it has
+// one and its length
+func parseSpliceTime(b []byte) (uint64, bool, int, error) {
+	if len(b) < 1 {
+		return 0, false, 0, errSCTE35Truncated
+	}
+	if b[0]&0x80 == 0 {
+		return 0, false, 1, nil
+	}
+	if len(b) < 5 {
+		return 0, false, 0, errSCTE35Truncated
+	}
+	return read33(b), true, 5, nil
+}
+
+// parseSegmentation reads the segmentation descriptors following a
+// time_signal at offset, turning the cue into an ad start or end
+func parseSegmentation(s []byte, offset int, cue *scte35Cue) (bool, error) {
+	if offset+2 > len(s) {
+		return false, errSCTE35Truncated
+	}
+	loop := int(binary.BigEndian.Uint16(s[offset:]))
+	descriptors := s[offset+2:]
+	if loop > len(descriptors) {
+		return false, errSCTE35Truncated
+	}
+	descriptors = descriptors[:loop]
+	for len(descriptors) >= 2 {
+		tag, length := descriptors[0], int(descriptors[1])
+		if 2+length > len(descriptors) {
+			return false, errSCTE35Truncated
+		}
+		body := descriptors[2 : 2+length]
+		descriptors = descriptors[2+length:]
+		// The identifier, event id and cancel flag take 9 bytes
+		if tag != scte35SegmentationTag || length < 9 {
+			continue
+		}
+		d := body[4:] // after the identifier
+		if d[4]&0x80 != 0 {
+			continue
+		}
+		if len(d) < 6 {
+			return false, errSCTE35Truncated
+		}
+		flags := d[5]
+		d = d[6:]
+		if flags&0x80 == 0 {
+			// Component segmentation
+			if len(d) < 1 {
+				return false, errSCTE35Truncated
+			}
+			skip := 1 + 6*int(d[0])
+			if skip > len(d) {
+				return false, errSCTE35Truncated
+			}
+			d = d[skip:]
+		}
+		var duration uint64
+		if flags&0x40 != 0 {
+			if len(d) < 5 {
+				return false, errSCTE35Truncated
+			}
+			duration = uint64(d[0])<<32 | uint64(binary.BigEndian.Uint32(d[1:5]))
+			d = d[5:]
+		}
+		if len(d) < 2 || 2+int(d[1]) >= len(d) {
+			return false, errSCTE35Truncated
+		}
+		segmentationType := d[2+int(d[1])]
+		switch {
+		case scte35AdStarts[segmentationType]:
+			cue.out, cue.duration = true, duration
+			return true, nil
+		case scte35AdEnds[segmentationType]:
+			cue.out = false
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// read33 reads the 33 bit value ending a 5 byte field
+func read33(b []byte) uint64 {
+	return uint64(b[0]&0x01)<<32 | uint64(binary.BigEndian.Uint32(b[1:5]))
+}
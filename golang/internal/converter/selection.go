@@ -0,0 +1,155 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// Source orientations a ProfileRule matches
+const (
+	OrientationPortrait  = "portrait"
+	OrientationLandscape = "landscape"
+)
+
+// screenRecorders are names screen recording apps leave in the tags of
+// their files, lowercased
+var screenRecorders = []string{"screen", "obs studio", "camtasia", "loom", "kazam"}
+
+// ProfileRule picks a profile for the tasks naming none by what the probe
+// found in their source, such as a portrait profile for vertical video;
+// the first rule the source matches wins. Zero fields match any source.
+type ProfileRule struct {
+	// Profile is the profile picked
+	Profile string `json:"profile"`
+	// Orientation is OrientationPortrait or OrientationLandscape, of the
+	// video as displayed
+	Orientation string `json:"orientation,omitempty"`
+	// MinResolution is the least length of the shorter side of the video
+	// as displayed, such as 2160 for 4K
+	MinResolution int `json:"min_resolution,omitempty"`
+	// MaxFrameRate is the highest average frame rate, for slides and
+	// screen recordings
+	MaxFrameRate float64 `json:"max_frame_rate,omitempty"`
+	// ScreenRecording only matches sources whose tags name a screen
+	// recorder
+	ScreenRecording bool `json:"screen_recording,omitempty"`
+}
+
+// LoadProfileRules reads a JSON array of profile rules from a file
+func LoadProfileRules(path string) ([]ProfileRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile rules: %w", err)
+	}
+	var rules []ProfileRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse profile rules: %w", err)
+	}
+	for i, r := range rules {
+		if r.Profile == "" {
+			return nil, fmt.Errorf("profile rule %d without a profile in %s", i, path)
+		}
+		switch r.Orientation {
+		case "", OrientationPortrait, OrientationLandscape:
+		default:
+			return nil, fmt.Errorf("profile rule %d: unknown orientation %q", i, r.Orientation)
+		}
+		if r.MinResolution < 0 || r.MaxFrameRate < 0 {
+			return nil, fmt.Errorf("profile rule %d: negative limit", i)
+		}
+	}
+	return rules, nil
+}
+
+// WithProfileRules picks the profile of the tasks naming none by their
+// source; NewVideoConverter panics if a rule's profile isn't registered
+func WithProfileRules(rules ...ProfileRule) Option {
+	return func(vc *VideoConverter) {
+		vc.profileRules = append(vc.profileRules, rules...)
+	}
+}
+
+// checkProfileRules returns an error for a rule picking an unknown profile
+func (vc *VideoConverter) checkProfileRules() error {
+	for _, r := range vc.profileRules {
+		if _, ok := vc.profiles[r.Profile]; !ok && r.Profile != DefaultProfileName {
+			return fmt.Errorf("profile rule picks unknown profile %s", r.Profile)
+		}
+	}
+	return nil
+}
+
+// selectProfile switches a task naming no profile, even when a rollout of
+// the default profile picked a canary for it, to the profile of the first
+// rule its source matches, then rolls that profile out as if the task had
+// named it
+func (vc *VideoConverter) selectProfile(job *Job) {
+	if job.Task.Profile != "" && job.CanaryOf != DefaultProfileName {
+		return
+	}
+	for _, r := range vc.profileRules {
+		if !r.matches(job.Probe) {
+			continue
+		}
+		slog.Info("Selected profile by source", slog.Int("video_id", job.Task.VideoID), slog.String("profile", r.Profile))
+		job.Task.Profile = r.Profile
+		job.CanaryOf = vc.applyRollout(job.Task)
+		return
+	}
+}
+
+// matches reports whether the source is one the rule picks its profile for
+func (r ProfileRule) matches(probe *ffmpeg.ProbeResult) bool {
+	video := probe.VideoStream()
+	if video == nil {
+		return false
+	}
+	width, height := video.DisplaySize()
+	switch r.Orientation {
+	case OrientationPortrait:
+		if height <= width {
+			return false
+		}
+	case OrientationLandscape:
+		if width < height {
+			return false
+		}
+	}
+	if r.MinResolution > 0 && min(width, height) < r.MinResolution {
+		return false
+	}
+	if r.MaxFrameRate > 0 && video.FrameRate() > r.MaxFrameRate {
+		return false
+	}
+	if r.ScreenRecording && !isScreenRecording(probe) {
+		return false
+	}
+	return true
+}
+
+// isScreenRecording reports whether the tags of the source or its video
+// name a screen recorder
+func isScreenRecording(probe *ffmpeg.ProbeResult) bool {
+	var tags []string
+	for _, value := range probe.Format.Tags {
+		tags = append(tags, strings.ToLower(value))
+	}
+	if video := probe.VideoStream(); video != nil {
+		for _, value := range video.Tags {
+			tags = append(tags, strings.ToLower(value))
+		}
+	}
+	for _, tag := range tags {
+		for _, recorder := range screenRecorders {
+			if strings.Contains(tag, recorder) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package converter
+
+import (
+	"testing"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// videoProbe returns a probe of a source with a single video stream
+func videoProbe(width, height int, rate string, sideData ...ffmpeg.SideData) *ffmpeg.ProbeResult {
+	return &ffmpeg.ProbeResult{Streams: []ffmpeg.Stream{{
+		CodecType:    "video",
+		CodecName:    "h264",
+		Width:        width,
+		Height:       height,
+		AvgFrameRate: rate,
+		SideData:     sideData,
+	}}}
+}
+
+func TestSelectProfile(t *testing.T) {
+	rules := []ProfileRule{
+		{Profile: "slides", MaxFrameRate: 15, ScreenRecording: true},
+		{Profile: "uhd", MinResolution: 2160},
+		{Profile: "vertical", Orientation: OrientationPortrait},
+		{Profile: "wide", Orientation: OrientationLandscape},
+	}
+	screenRecording := videoProbe(1920, 1080, "10/1")
+	screenRecording.Format.Tags = map[string]string{"encoder": "OBS Studio 30.1"}
+
+	tests := []struct {
+		name         string
+		profile      string
+		canaryOf     string
+		rules        []ProfileRule
+		rollouts     []ProfileRollout
+		probe        *ffmpeg.ProbeResult
+		wantProfile  string
+		wantCanaryOf string
+	}{
+		{
+			name:        "no rules",
+			probe:       videoProbe(1080, 1920, "30/1"),
+			wantProfile: "",
+		},
+		{
+			name:        "portrait source",
+			rules:       rules,
+			probe:       videoProbe(1080, 1920, "30/1"),
+			wantProfile: "vertical",
+		},
+		{
+			name:        "landscape source",
+			rules:       rules,
+			probe:       videoProbe(1920, 1080, "30/1"),
+			wantProfile: "wide",
+		},
+		{
+			name:        "rotated source is portrait as displayed",
+			rules:       rules,
+			probe:       videoProbe(1920, 1080, "30/1", ffmpeg.SideData{Type: "Display Matrix", Rotation: -90}),
+			wantProfile: "vertical",
+		},
+		{
+			name:        "square source is landscape",
+			rules:       rules,
+			probe:       videoProbe(1080, 1080, "30/1"),
+			wantProfile: "wide",
+		},
+		{
+			name:        "first matching rule wins",
+			rules:       rules,
+			probe:       screenRecording,
+			wantProfile: "slides",
+		},
+		{
+			name:        "minimum resolution on the shorter side",
+			rules:       rules,
+			probe:       videoProbe(3840, 2160, "30/1"),
+			wantProfile: "uhd",
+		},
+		{
+			name:        "rotated 4K portrait",
+			rules:       rules,
+			probe:       videoProbe(3840, 2160, "30/1", ffmpeg.SideData{Type: "Display Matrix", Rotation: 90}),
+			wantProfile: "uhd",
+		},
+		{
+			name:        "screen recording over the frame rate",
+			rules:       rules[:1],
+			probe:       videoProbe(1920, 1080, "60/1"),
+			wantProfile: "",
+		},
+		{
+			name:        "task naming a profile keeps it",
+			profile:     "custom",
+			rules:       rules,
+			probe:       videoProbe(1080, 1920, "30/1"),
+			wantProfile: "custom",
+		},
+		{
+			name:        "canary of the default profile is replaced",
+			profile:     "default-canary",
+			canaryOf:    DefaultProfileName,
+			rules:       rules,
+			probe:       videoProbe(1080, 1920, "30/1"),
+			wantProfile: "vertical",
+		},
+		{
+			name:         "canary of another profile is kept",
+			profile:      "custom-canary",
+			canaryOf:     "custom",
+			rules:        rules,
+			probe:        videoProbe(1080, 1920, "30/1"),
+			wantProfile:  "custom-canary",
+			wantCanaryOf: "custom",
+		},
+		{
+			name:         "selected profile is rolled out",
+			rules:        rules,
+			rollouts:     []ProfileRollout{{Profile: "vertical", Canary: "vertical-canary", Percent: 100}},
+			probe:        videoProbe(1080, 1920, "30/1"),
+			wantProfile:  "vertical-canary",
+			wantCanaryOf: "vertical",
+		},
+		{
+			name:        "audio only source",
+			rules:       rules,
+			probe:       &ffmpeg.ProbeResult{Streams: []ffmpeg.Stream{{CodecType: "audio", CodecName: "aac"}}},
+			wantProfile: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := &VideoConverter{profileRules: tt.rules, rollouts: tt.rollouts}
+			job := &Job{
+				Task:     &VideoTask{VideoID: 1, Profile: tt.profile},
+				Probe:    tt.probe,
+				CanaryOf: tt.canaryOf,
+			}
+			vc.selectProfile(job)
+			if job.Task.Profile != tt.wantProfile {
+				t.Errorf("profile = %q, want %q", job.Task.Profile, tt.wantProfile)
+			}
+			if job.CanaryOf != tt.wantCanaryOf {
+				t.Errorf("canary of = %q, want %q", job.CanaryOf, tt.wantCanaryOf)
+			}
+		})
+	}
+}
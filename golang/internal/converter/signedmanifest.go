@@ -0,0 +1,174 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// representationPattern matches a Representation with its attributes
+	// and body
+	representationPattern = regexp.MustCompile(`(?s)<Representation\b([^>]*[^/>])>(.*?)</Representation>`)
+	// baseURLPattern matches a BaseURL and its URI
+	baseURLPattern = regexp.MustCompile(`<BaseURL>([^<]*)</BaseURL>`)
+	// templateIDPattern matches the identifiers of a SegmentTemplate URL,
+	// with their optional printf width
+	templateIDPattern = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(?:%0(\d+)d)?\$`)
+)
+
+// signedManifestName returns the name of the signed copy of a manifest
+func signedManifestName(manifest string) string {
+	ext := path.Ext(manifest)
+	return strings.TrimSuffix(manifest, ext) + ".signed" + ext
+}
+
+// uploadSignedManifest uploads a copy of the job's manifest naming its
+// segments by URLs signed with the converter's URLSigner, so it plays from
+// a private bucket, and records when they were signed
+func (vc *VideoConverter) uploadSignedManifest(ctx context.Context, job *Job) error {
+	mpd, err := os.ReadFile(job.Manifest)
+	if err != nil {
+		return err
+	}
+	var total float64
+	if job.Probe != nil {
+		total = job.Probe.DurationSeconds()
+	}
+	manifestKey := path.Join(job.Prefix, vc.outputLayout.Manifest)
+	signedAt := time.Now()
+	signed, err := signManifest(mpd, manifestKey, vc.signer.SignedURL, vc.signedURLTTL, total)
+	if err != nil {
+		return err
+	}
+	local := signedManifestName(job.Manifest)
+	if err := os.WriteFile(local, signed, 0o644); err != nil {
+		return err
+	}
+	if err := vc.uploader.Upload(ctx, local, signedManifestName(manifestKey)); err != nil {
+		return err
+	}
+	slog.Info("Signed manifest uploaded", slog.Int("video_id", job.Task.VideoID), slog.Duration("ttl", vc.signedURLTTL))
+	job.segmentsSignedAt = signedAt
+	return nil
+}
+
+// signManifest returns a copy of the manifest stored at manifestKey with
+// its relative URLs replaced by the signed URLs of the objects they name:
+// each BaseURL is signed, and each representation's SegmentTemplate
+// becomes a SegmentList of its segments' signed URLs, as a template can't
+// carry a signature per segment. The total duration counts the segments
+// of templates without a timeline.
+func signManifest(mpd []byte, manifestKey string, sign func(objectKey string, expires time.Duration) (string, error), ttl time.Duration, total float64) ([]byte, error) {
+	var signErr error
+	signURI := func(uri string) string {
+		uri = html.UnescapeString(uri)
+		if strings.Contains(uri, "://") {
+			return html.EscapeString(uri)
+		}
+		signed, err := sign(path.Join(path.Dir(manifestKey), uri), ttl)
+		if err != nil && signErr == nil {
+			signErr = fmt.Errorf("failed to sign %s: %w", uri, err)
+		}
+		return html.EscapeString(signed)
+	}
+
+	out := representationPattern.ReplaceAllStringFunc(string(mpd), func(rep string) string {
+		m := representationPattern.FindStringSubmatch(rep)
+		attrs, body := m[1], m[2]
+		loc := segmentTemplatePattern.FindStringSubmatchIndex(body)
+		if loc == nil {
+			return rep
+		}
+		if baseURLPattern.MatchString(body) {
+			signErr = errors.New("representation with both a BaseURL and a SegmentTemplate")
+			return rep
+		}
+		var inner string
+		if loc[4] >= 0 {
+			inner = body[loc[4]:loc[5]]
+		}
+		list, err := segmentList(body[loc[2]:loc[3]], inner, attrs, total, signURI)
+		if err != nil {
+			signErr = err
+			return rep
+		}
+		return strings.Replace(rep, body[loc[0]:loc[1]], list, 1)
+	})
+	if signErr != nil {
+		return nil, signErr
+	}
+	if segmentTemplatePattern.MatchString(out) {
+		return nil, errors.New("segment template outside a representation")
+	}
+	out = baseURLPattern.ReplaceAllStringFunc(out, func(b string) string {
+		return "<BaseURL>" + signURI(baseURLPattern.FindStringSubmatch(b)[1]) + "</BaseURL>"
+	})
+	if signErr != nil {
+		return nil, signErr
+	}
+	return []byte(out), nil
+}
+
+// segmentList returns the SegmentList of the segments a representation's
+// SegmentTemplate addresses, with their URLs signed by signURI
+func segmentList(attrs, body, representationAttrs string, total float64, signURI func(string) string) (string, error) {
+	t, err := parseSegmentTemplate(attrs, body, total)
+	if err != nil {
+		return "", err
+	}
+	values := map[string]string{}
+	for _, m := range xmlAttrPattern.FindAllStringSubmatch(attrs, -1) {
+		values[m[1]] = m[2]
+	}
+	ids := map[string]string{}
+	for _, m := range xmlAttrPattern.FindAllStringSubmatch(representationAttrs, -1) {
+		ids[m[1]] = m[2]
+	}
+	expandURL := func(template string, number, at int64) string {
+		return templateIDPattern.ReplaceAllStringFunc(template, func(id string) string {
+			m := templateIDPattern.FindStringSubmatch(id)
+			var value string
+			switch m[1] {
+			case "RepresentationID":
+				return ids["id"]
+			case "Bandwidth":
+				value = ids["bandwidth"]
+			case "Number":
+				value = strconv.FormatInt(number, 10)
+			case "Time":
+				value = strconv.FormatInt(at, 10)
+			}
+			if width, _ := strconv.Atoi(m[2]); len(value) < width {
+				value = strings.Repeat("0", width-len(value)) + value
+			}
+			return value
+		})
+	}
+
+	var list strings.Builder
+	fmt.Fprintf(&list, `<SegmentList timescale="%d" presentationTimeOffset="%d"`, t.timescale, t.offset)
+	if !t.timeline {
+		fmt.Fprintf(&list, ` duration="%s"`, values["duration"])
+	}
+	list.WriteString(">")
+	if init, ok := values["initialization"]; ok {
+		fmt.Fprintf(&list, "\n\t\t\t\t\t<Initialization sourceURL=\"%s\"/>", signURI(expandURL(init, 0, 0)))
+	}
+	if t.timeline {
+		list.WriteString("\n\t\t\t\t\t" + t.segmentTimeline(0, len(t.times)))
+	}
+	for i := range t.times {
+		fmt.Fprintf(&list, "\n\t\t\t\t\t<SegmentURL media=\"%s\"/>", signURI(expandURL(values["media"], t.start+int64(i), t.times[i])))
+	}
+	list.WriteString("\n\t\t\t\t</SegmentList>")
+	return list.String(), nil
+}
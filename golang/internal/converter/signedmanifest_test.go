@@ -0,0 +1,103 @@
+package converter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSign signs an object key by appending a query to its URL
+func fakeSign(objectKey string, expires time.Duration) (string, error) {
+	return "https://cdn.example.com/" + objectKey + "?sig=x&ttl=" + expires.String(), nil
+}
+
+func TestSignManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		mpd     string
+		total   float64
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "segment timeline",
+			mpd: `<Representation id="0" bandwidth="800000">
+				<SegmentTemplate timescale="1000" initialization="init-stream$RepresentationID$.m4s" media="chunk-stream$RepresentationID$-$Number%05d$.m4s" startNumber="1">
+					<SegmentTimeline>
+						<S t="0" d="4000" r="1" />
+						<S d="2000" />
+					</SegmentTimeline>
+				</SegmentTemplate>
+			</Representation>`,
+			want: []string{
+				`<SegmentList timescale="1000" presentationTimeOffset="0">`,
+				`<Initialization sourceURL="https://cdn.example.com/42/v1/init-stream0.m4s?sig=x&amp;ttl=1h0m0s"/>`,
+				`<S t="0" d="4000" r="1" />`,
+				`<S t="8000" d="2000" />`,
+				`<SegmentURL media="https://cdn.example.com/42/v1/chunk-stream0-00001.m4s?sig=x&amp;ttl=1h0m0s"/>`,
+				`<SegmentURL media="https://cdn.example.com/42/v1/chunk-stream0-00003.m4s?sig=x&amp;ttl=1h0m0s"/>`,
+			},
+		},
+		{
+			name: "fixed duration by time",
+			mpd: `<Representation id="1" bandwidth="128000">
+				<SegmentTemplate timescale="10" duration="40" initialization="$RepresentationID$/init.m4s" media="$RepresentationID$/$Time$.m4s"/>
+			</Representation>`,
+			total: 10,
+			want: []string{
+				`<SegmentList timescale="10" presentationTimeOffset="0" duration="40">`,
+				`<Initialization sourceURL="https://cdn.example.com/42/v1/1/init.m4s?sig=x&amp;ttl=1h0m0s"/>`,
+				`<SegmentURL media="https://cdn.example.com/42/v1/1/80.m4s?sig=x&amp;ttl=1h0m0s"/>`,
+			},
+		},
+		{
+			name: "single file and caption track",
+			mpd: `<Representation id="0" bandwidth="800000">
+				<BaseURL>single-stream0.mp4</BaseURL>
+				<SegmentBase indexRange="800-900"/>
+			</Representation>
+			<Representation id="captions-en" bandwidth="256">
+				<BaseURL>captions/en.vtt</BaseURL>
+			</Representation>`,
+			want: []string{
+				`<BaseURL>https://cdn.example.com/42/v1/single-stream0.mp4?sig=x&amp;ttl=1h0m0s</BaseURL>`,
+				`<BaseURL>https://cdn.example.com/42/v1/captions/en.vtt?sig=x&amp;ttl=1h0m0s</BaseURL>`,
+			},
+		},
+		{
+			name: "template of the adaptation set",
+			mpd: `<AdaptationSet>
+				<SegmentTemplate timescale="1000" duration="4000" media="$Number$.m4s"/>
+				<Representation id="0" bandwidth="800000"/>
+			</AdaptationSet>`,
+			total:   8,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := signManifest([]byte(tt.mpd), "42/v1/output.mpd", fakeSign, time.Hour, tt.total)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("signManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Contains(string(signed), "SegmentTemplate") {
+				t.Errorf("signed manifest still has a segment template:\n%s", signed)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(signed), want) {
+					t.Errorf("signed manifest is missing %s:\n%s", want, signed)
+				}
+			}
+		})
+	}
+}
+
+func TestSignManifestError(t *testing.T) {
+	errSign := errors.New("no signing key")
+	sign := func(string, time.Duration) (string, error) { return "", errSign }
+	mpd := `<Representation id="0" bandwidth="800000"><BaseURL>single-stream0.mp4</BaseURL></Representation>`
+	if _, err := signManifest([]byte(mpd), "42/v1/output.mpd", sign, time.Hour, 0); !errors.Is(err, errSign) {
+		t.Errorf("err = %v, want %v", err, errSign)
+	}
+}
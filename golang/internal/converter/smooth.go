@@ -0,0 +1,79 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+const (
+	// SmoothStreamingDir holds the Smooth Streaming presentation, below the
+	// output directory, so players request <prefix>/video.ism/Manifest and
+	// its QualityLevels(...)/Fragments(...) as IIS would serve them
+	SmoothStreamingDir = "video.ism"
+	// SmoothStreamingManifest is the client manifest (ISMC) in
+	// SmoothStreamingDir
+	SmoothStreamingManifest = "Manifest"
+)
+
+// smoothStreamingAudioCodecs are the audio encoders whose output Smooth
+// Streaming carries, besides copied AAC; its video must be H.264
+var smoothStreamingAudioCodecs = []string{"aac", "libfdk_aac"}
+
+// wantsSmoothStreaming reports whether the job also packages its
+// renditions for Smooth Streaming, for set-top boxes without DASH
+func wantsSmoothStreaming(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && job.Profile.SmoothStreaming
+}
+
+// checkSmoothStreamingCodecs returns an error when a profile's codecs
+// can't be carried by Smooth Streaming, which only knows H.264 and AAC
+func checkSmoothStreamingCodecs(p Profile) error {
+	if !p.SmoothStreaming {
+		return nil
+	}
+	if p.VideoCodec != "" && p.VideoCodec != "copy" && p.VideoCodec != "libx264" && !strings.HasPrefix(p.VideoCodec, "h264_") {
+		return fmt.Errorf("smooth streaming needs H.264 video, not %s", p.VideoCodec)
+	}
+	if p.AudioCodec != "" && p.AudioCodec != "copy" && !slices.Contains(smoothStreamingAudioCodecs, p.AudioCodec) {
+		return fmt.Errorf("smooth streaming needs AAC audio, not %s", p.AudioCodec)
+	}
+	return nil
+}
+
+// smoothStreamingArgs are the ffmpeg options remuxing the DASH renditions
+// of manifest, without re-encoding them, into a Smooth Streaming
+// presentation in outputDir, keeping every fragment as on demand content
+func smoothStreamingArgs(manifest, outputDir string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: manifest}},
+		Outputs: []ffmpeg.Output{{
+			Maps:  []string{"0:v?", "0:a?"},
+			Codec: "copy",
+			Options: []string{
+				"-window_size", "0",
+				"-extra_window_size", "0",
+				"-lookahead_count", "0",
+			},
+			Format: "smoothstreaming",
+			File:   filepath.Join(outputDir, SmoothStreamingDir),
+		}},
+	}.Args()
+}
+
+// packageSmoothStreaming writes the job's Smooth Streaming presentation
+// from its DASH renditions, once they are final
+func (vc *VideoConverter) packageSmoothStreaming(ctx context.Context, job *Job, runner ffmpeg.Runner) error {
+	slog.Info("Packaging smooth streaming", slog.String("path", filepath.Join(job.OutputDir, SmoothStreamingDir)))
+	output, err := runner.Run(ctx, smoothStreamingArgs(job.Manifest, job.OutputDir)...)
+	if err != nil {
+		return fmt.Errorf("failed to package smooth streaming: %w", ffmpeg.ParseError(err, output))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// ErrUnsupportedContainer is returned when the uploaded file isn't in an accepted container format
+var ErrUnsupportedContainer = errors.New("unsupported source container")
+
+// DefaultSourceFormats are the containers accepted when none are configured
+var DefaultSourceFormats = []string{"mp4", "mov", "mkv", "webm", "avi"}
+
+// dashCopyVideoCodecs and dashCopyAudioCodecs can be packaged to DASH without re-encoding
+var (
+	dashCopyVideoCodecs = []string{"h264", "hevc"}
+	dashCopyAudioCodecs = []string{"aac", "mp3", "ac3", "eac3", "opus"}
+)
+
+// detectSource probes the merged upload, checks its real container against
+// the accepted formats and, when rename is set, renames it with the
+// matching extension
+func (vc *VideoConverter) detectSource(runner ffmpeg.Runner, mergedFile string, rename bool) (string, *ffmpeg.ProbeResult, error) {
+	probe, err := runner.Probe(context.Background(), mergedFile)
+	if err != nil {
+		return mergedFile, nil, err
+	}
+
+	container := probe.Container()
+	if !slices.Contains(vc.sourceFormats, container) {
+		return mergedFile, probe, fmt.Errorf("%w: %s", ErrUnsupportedContainer, container)
+	}
+	slog.Info("Detected source container", slog.String("path", mergedFile), slog.String("container", container))
+	if !rename {
+		return mergedFile, probe, nil
+	}
+
+	renamed := filepath.Join(filepath.Dir(mergedFile), "merged."+container)
+	if err := os.Rename(mergedFile, renamed); err != nil {
+		return mergedFile, probe, fmt.Errorf("failed to rename merged file: %v", err)
+	}
+	return renamed, probe, nil
+}
+
+// Output modes recorded in the completion event
+const (
+	ModeVideo     = "video"
+	ModeAudioOnly = "audio_only"
+)
+
+// audioOnlyArgs packages the first audio stream as audio-only DASH with an
+// HLS playlist, plus an MP3 download next to the manifest, both with the
+// metadata options
+func audioOnlyArgs(job *Job, layout OutputLayout, metadata []string) []string {
+	args := []string{
+		"-map", "0:a:0",
+		"-c:a", "aac", "-b:a", "128k",
+	}
+	args = append(args, metadata...)
+	args = append(args, "-f", "dash", "-hls_playlist", "1")
+	args = append(args, layout.segmentArgs(job)...)
+	args = append(args,
+		job.Manifest,
+		"-map", "0:a:0",
+		"-c:a", "libmp3lame", "-b:a", "128k",
+	)
+	args = append(args, metadata...)
+	return append(args, filepath.Join(job.OutputDir, "audio.mp3"))
+}
@@ -0,0 +1,87 @@
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoSourceFile is returned when a single file task's file doesn't exist
+var ErrNoSourceFile = errors.New("source file not found")
+
+// sourceType returns the task's source type: a task with a source file or
+// URL and no type is a single file or download source
+func sourceType(task *VideoTask) string {
+	if task.SourceType == "" && task.SourceFile != "" {
+		return SourceSingleFile
+	}
+	if task.SourceType == "" && task.SourceURL != "" {
+		return SourceDownload
+	}
+	if task.SourceType == "" {
+		return SourceChunks
+	}
+	return task.SourceType
+}
+
+// sourceFilePath returns the task's source file, kept inside its folder
+// like the chunks
+func sourceFilePath(task *VideoTask) string {
+	return filepath.Join(task.Path, filepath.Clean("/"+task.SourceFile))
+}
+
+// ownsMergedFile reports whether the job's merged file was built by the
+// merge stage, and so may be renamed and removed; a single file source
+// belongs to the producer
+func ownsMergedFile(job *Job) bool {
+	return sourceType(job.Task) != SourceSingleFile || job.Redacted
+}
+
+// useSourceFile makes the job convert the task's file as is, in place of
+// a merged file. It is hashed so deduplication works as for chunks.
+func (vc *VideoConverter) useSourceFile(job *Job) error {
+	task := job.Task
+	if task.SourceFile == "" {
+		return fmt.Errorf("%w: %s source without a source_file", ErrInvalidTask, SourceSingleFile)
+	}
+	file := sourceFilePath(task)
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNoSourceFile, file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat source file: %v", err)
+	}
+	if err := vc.checkSize(task, info.Size()); err != nil {
+		return err
+	}
+	if info.Size() < vc.minMergedSize {
+		return fmt.Errorf("%w: %d bytes, expected at least %d", ErrMergedTooSmall, info.Size(), vc.minMergedSize)
+	}
+
+	sum, err := hashFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to hash source file: %v", err)
+	}
+	job.MergedFile = file
+	job.SourceHash = sum
+	return nil
+}
+
+// hashFile returns the hex sha256 of the file
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	fileHash := sha256.New()
+	if _, err := io.Copy(fileHash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), nil
+}
@@ -0,0 +1,146 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+const (
+	// StoryboardDir holds the scene thumbnails, below the output directory
+	StoryboardDir = "storyboard"
+	// StoryboardName is the storyboard's file name next to the DASH output
+	StoryboardName = "storyboard.json"
+	// sceneThreshold is the scene change score, from 0 to 1, starting a
+	// new scene
+	sceneThreshold = 0.4
+	// minSceneDuration is the shortest scene, in seconds, so flashes and
+	// fast cuts don't split the storyboard into slivers
+	minSceneDuration = 1
+	// sceneThumbnailHeight is the height of the scene thumbnails
+	sceneThumbnailHeight = 180
+)
+
+// Storyboard is the machine-readable outline of a video for editors:
+// its scenes, in order, each with a thumbnail of its first frame
+type Storyboard struct {
+	VideoID  int     `json:"video_id"`
+	Duration float64 `json:"duration"`
+	// Thumbnail is the video's thumbnail, relative to the manifest, when
+	// one was asked for
+	Thumbnail string  `json:"thumbnail,omitempty"`
+	Scenes    []Scene `json:"scenes"`
+}
+
+// Scene is a stretch of the video between two cuts, in seconds
+type Scene struct {
+	Index    int     `json:"index"`
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Duration float64 `json:"duration"`
+	// Score is how different the first frame is from the previous one,
+	// from sceneThreshold to 1; zero for the first scene
+	Score float64 `json:"score,omitempty"`
+	// Thumbnail is the scene's first frame, relative to the manifest
+	Thumbnail string `json:"thumbnail"`
+}
+
+// wantsStoryboard reports whether the job also writes a storyboard: a
+// video job whose task or profile asks for one
+func wantsStoryboard(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && (job.Task.Storyboard || job.Profile.Storyboard)
+}
+
+// storyboardScenesFile is where the detection writes the times of the
+// scene cuts
+func storyboardScenesFile(job *Job) string {
+	return filepath.Join(job.Task.Path, "storyboard-scenes.txt")
+}
+
+// storyboardArgs are the ffmpeg options detecting the scene cuts of the
+// source, printing their time and score into scenes and saving their
+// first frame, and the video's, as a small JPEG into the output directory
+func storyboardArgs(source, scenes, outputDir string) []string {
+	selectExpr := fmt.Sprintf("select='eq(n,0)+gt(scene,%s)*gte(t-prev_selected_t,%d)'", strconv.FormatFloat(sceneThreshold, 'f', -1, 64), minSceneDuration)
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0"},
+			NoAudio:      true,
+			VideoFilters: []string{selectExpr, "metadata=mode=print:file='" + scenes + "'", previewScale(sceneThumbnailHeight)},
+			Options:      []string{"-vsync", "vfr", "-q:v", "4"},
+			File:         filepath.Join(outputDir, StoryboardDir, "scene-%04d.jpg"),
+		}},
+	}.Args()
+}
+
+// encodeStoryboard detects the scenes of the video and writes their
+// thumbnails and the storyboard to the job's output directory, so they
+// are uploaded with the streaming renditions
+func (vc *VideoConverter) encodeStoryboard(ctx context.Context, job *Job, runner ffmpeg.Runner) error {
+	if err := os.MkdirAll(filepath.Join(job.OutputDir, StoryboardDir), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create storyboard directory: %w", err)
+	}
+	scenes := storyboardScenesFile(job)
+	defer os.Remove(scenes)
+	slog.Info("Detecting scenes for the storyboard", slog.String("path", job.OutputDir))
+	output, err := runner.Run(ctx, storyboardArgs(job.MergedFile, scenes, job.OutputDir)...)
+	if err != nil {
+		return fmt.Errorf("failed to detect scenes: %w", ffmpeg.ParseError(err, output))
+	}
+	cuts, err := readMetadataPrint(scenes)
+	if err != nil {
+		return fmt.Errorf("failed to read scene cuts: %w", err)
+	}
+
+	board := buildStoryboard(job, cuts)
+	data, err := json.MarshalIndent(board, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(job.OutputDir, StoryboardName), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write storyboard: %w", err)
+	}
+	slog.Info("Storyboard written", slog.Int("video_id", job.Task.VideoID), slog.Int("scenes", len(board.Scenes)))
+	return nil
+}
+
+// buildStoryboard turns the cuts, in the order their thumbnails were
+// saved, into scenes each lasting until the next cut
+func buildStoryboard(job *Job, cuts []map[string]float64) Storyboard {
+	duration := job.Probe.DurationSeconds()
+	board := Storyboard{VideoID: job.Task.VideoID, Duration: duration, Scenes: []Scene{}}
+	if wantsThumbnail(job) {
+		board.Thumbnail = ThumbnailName
+	}
+	for i, cut := range cuts {
+		end := duration
+		if i+1 < len(cuts) {
+			end = cuts[i+1]["pts_time"]
+		}
+		start := cut["pts_time"]
+		board.Scenes = append(board.Scenes, Scene{
+			Index:     i,
+			Start:     roundMillis(start),
+			End:       roundMillis(end),
+			Duration:  roundMillis(end - start),
+			Score:     roundMillis(cut["lavfi.scene_score"]),
+			Thumbnail: path.Join(StoryboardDir, fmt.Sprintf("scene-%04d.jpg", i+1)),
+		})
+	}
+	return board
+}
+
+// roundMillis rounds seconds to the millisecond
+func roundMillis(seconds float64) float64 {
+	return math.Round(seconds*1000) / 1000
+}
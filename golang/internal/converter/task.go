@@ -1,172 +1,257 @@
 package converter
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"sort"
-	"strconv"
 	"time"
+
+	"imersaofc/internal/cdn"
+	"imersaofc/internal/database"
+	"imersaofc/internal/events"
+	"imersaofc/internal/ffmpeg"
+	"imersaofc/internal/storage"
 )
 
 // VideoConverter handles video conversion tasks
-type VideoConverter struct{
-	db *sql.DB
+type VideoConverter struct {
+	repo              Repository
+	runner            ffmpeg.Runner
+	uploader          storage.Uploader
+	uploadConcurrency int
+	chunkLayout       ChunkLayout
+	outputLayout      OutputLayout
+	minMergedSize     int64
+	sourceFormats     []string
+	publisher         Publisher
+	signer            storage.URLSigner
+	signedURLTTL      time.Duration
+	invalidator       cdn.Invalidator
+	middlewares       []Middleware
+	handler           Handler
+	customStages      map[string]Stage
+	stageOrder        []string
+	stages            []Stage
+	events            *events.Bus
+	subscribers       []events.Subscriber
+	profiles          map[string]Profile
+	remoteTranscoder  Transcoder
+	remoteThreshold   RemoteThreshold
+	enqueuer          Enqueuer
+	dryRun            bool
+	estimator         Estimator
+	ffmpegLogs        FFmpegLogPolicy
+	limits            LimitPolicy
+	downloads         DownloadPolicy
+	fetchers          map[string]Fetcher
+	captioner         Captioner
+	translator        Translator
+	classifier        Classifier
+	moderation        ModerationPolicy
+	detector          RegionDetector
+	detectionInterval time.Duration
+	ffmpegVersion     string
+	rollouts          []ProfileRollout
+	workspaceKey      []byte
+	keepMetadata      bool
+	webSeeds          []string
+	trackers          []string
+	profileRules      []ProfileRule
 }
 
-// NewVideoConverter creates a new instance of VideoConverter
-func NewVideoConverter(db *sql.DB) *VideoConverter {
-	return &VideoConverter{
-		db: db,
+// NewVideoConverter creates a new instance of VideoConverter storing its
+// state in db, unless WithRepository replaces it. It panics if the
+// configured stage order names a stage that isn't registered, or a
+// rollout a profile that isn't.
+func NewVideoConverter(db *database.DB, opts ...Option) *VideoConverter {
+	vc := &VideoConverter{
+		runner:            ffmpeg.ExecRunner{},
+		uploadConcurrency: 4,
+		chunkLayout:       DefaultChunkLayout,
+		outputLayout:      DefaultOutputLayout,
+		minMergedSize:     DefaultMinMergedSize,
+		sourceFormats:     DefaultSourceFormats,
+		events:            events.NewBus(),
+	}
+	if db != nil {
+		vc.repo = NewSQLRepository(db)
+	}
+	for _, opt := range opts {
+		opt(vc)
+	}
+
+	for _, s := range vc.subscribers {
+		vc.events.Subscribe(s)
+	}
+
+	stages, err := vc.resolveStages()
+	if err != nil {
+		panic(err)
+	}
+	if err := vc.checkRollouts(); err != nil {
+		panic(err)
 	}
+	if err := vc.checkProfileRules(); err != nil {
+		panic(err)
+	}
+	vc.stages = stages
+
+	// Logging wraps everything, panics are recovered below it so the
+	// failure is logged, expired tasks are dropped before batch progress
+	// would count them as done, batches are expanded before anything looks
+	// at the task, and the idempotency check runs right before the task
+	// claims it, so a duplicate never converts alongside the first copy
+	mws := append([]Middleware{Logging, vc.recoverPanics, vc.skipExpired, vc.handleBatches}, vc.middlewares...)
+	mws = append(mws, SkipProcessed(vc.repo), vc.claimTasks)
+	vc.handler = Chain(vc.handleTask, mws...)
+	return vc
 }
 
 // VideoTask represents a video conversion task
 type VideoTask struct {
 	VideoID int    `json:"video_id"`
 	Path    string `json:"path"`
-}
 
-// HandlerMessage processes a video conversion message
-func (vc *VideoConverter) Handle(msg []byte) {
-	var task VideoTask
-
-	err := json.Unmarshal(msg, &task)
-	if err != nil {
-		vc.logError(task, "failed to unmarshal task", err)
-		return
-	}
+	// Chunks optionally lists the chunk files, relative to Path, in merge order
+	Chunks []string `json:"chunks,omitempty"`
+	// ChunkLayout optionally overrides the converter's chunk naming for this task
+	ChunkLayout ChunkLayout `json:"chunk_layout"`
 
-	if IsProcessed(vc.db, task.VideoID) {
-		slog.Warn("Video already processed", slog.Int("video_id", task.VideoID))
-		return
-	}
-
-	// Process the video
-	err = vc.processVideo(&task)
-	if err != nil {
-		vc.logError(task, "failed to process video", err)
-		return
-	}
+	// SourceType is "chunks" (default), "image_sequence", where the files
+	// are frames, "file", the default when SourceFile is set, or "url", the
+	// default when SourceURL is set
+	SourceType string `json:"source_type,omitempty"`
+	// SourceFile is the finished file, relative to Path, of a producer that
+	// uploads one file rather than chunks; it is converted without merging
+	SourceFile string `json:"source_file,omitempty"`
+	// SourceURL is an HTTP(S) URL, or one of a scheme with a Fetcher, that
+	// the source is downloaded from, into Path
+	// or, without one, the converter's download dir. SourceSHA256 is its
+	// optional hex sha256, checked once it is downloaded.
+	SourceURL    string `json:"source_url,omitempty"`
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	// FPS is the frame rate of an image sequence
+	FPS float64 `json:"fps,omitempty"`
 
-	err = MarkProcess(vc.db, task.VideoID)
-	if err != nil {
-		vc.logError(task, "failed to mark video as processed", err)
-		return
-	}
-	slog.Info("Video marked as processed", slog.Int("video_id", task.VideoID))
+	// Profile names the encoding profile, DefaultProfileName when empty
+	Profile string `json:"profile,omitempty"`
+	// ScrubbingProxy asks for a scrubbing proxy even if the profile doesn't
+	ScrubbingProxy bool `json:"scrubbing_proxy,omitempty"`
+	// TrickPlay asks for trick play streams even if the profile doesn't
+	TrickPlay bool `json:"trick_play,omitempty"`
+	// AdBreaks are the cue points signaled in the output for SSAI; when
+	// empty, those of SCTE-35 embedded in the source are used
+	AdBreaks []AdBreak `json:"ad_breaks,omitempty"`
+	// MultiPeriod splits the DASH manifest into a period per stretch of
+	// content between ad breaks, even if the profile doesn't
+	MultiPeriod bool `json:"multi_period,omitempty"`
+	// Captions transcribes the speech of the video into WebVTT captions,
+	// see WithCaptioner
+	Captions bool `json:"captions,omitempty"`
+	// CaptionLanguage is the spoken language, as an ISO 639-1 code, left
+	// to the captioner to detect when empty
+	CaptionLanguage string `json:"caption_language,omitempty"`
+	// CaptionTranslations are the languages the captions are translated
+	// into, as extra tracks, see WithTranslator
+	CaptionTranslations []string `json:"caption_translations,omitempty"`
+	// Redactions are regions of the video blurred for privacy, such as
+	// students in a classroom recording
+	Redactions []Redaction `json:"redactions,omitempty"`
+	// DetectRedactions also blurs the regions found by the configured
+	// RegionDetector, see WithRegionDetector
+	DetectRedactions bool `json:"detect_redactions,omitempty"`
+	// Thumbnail asks for a thumbnail, ThumbnailFast or ThumbnailSmart,
+	// even if the profile doesn't
+	Thumbnail string `json:"thumbnail,omitempty"`
+	// Storyboard asks for a storyboard even if the profile doesn't
+	Storyboard bool `json:"storyboard,omitempty"`
+	// Tenant names the customer the video belongs to, whose limits apply
+	// to it, see LimitPolicy
+	Tenant string `json:"tenant,omitempty"`
+	// Reprocess converts the video again even if it was already processed,
+	// writing a new output version next to the previous ones
+	Reprocess bool `json:"reprocess,omitempty"`
+	// BatchID is set on the tasks of a batch message, see BatchMessage
+	BatchID string `json:"batch_id,omitempty"`
+	// Deadline is when the task stops being worth converting, e.g. because
+	// the upload is deleted after it; a task picked up later is skipped
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// DryRun logs the plan of the conversion instead of running it, see Plan
+	DryRun bool `json:"dry_run,omitempty"`
+	// Metadata is embedded into the outputs, replacing the source's
+	Metadata *OutputMetadata `json:"metadata,omitempty"`
+	// Labels are free-form key/values, such as course_id or experiment,
+	// recorded with the job so jobs can be filtered and reported on by
+	// them, and carried to the completion event for routing
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
-// processVideo handles video processing (merging chunks and converting)
-func (vc *VideoConverter) processVideo(task *VideoTask) error {
-	mergedFile := filepath.Join(task.Path, "merged.mp4")
-	mpegDashPath := filepath.Join(task.Path, "mpeg-dash")
+// Handle processes a video conversion message through the middleware chain
+// and reports whether the consumer should ack, requeue or dead-letter it
+func (vc *VideoConverter) Handle(ctx context.Context, msg []byte) Result {
+	return vc.handler(ctx, msg)
+}
 
-	// Merge chunks
-	slog.Info("Merging chunks", slog.String("path", task.Path))
-	err := vc.mergeChunks(task.Path, mergedFile)
-	if err != nil {
-		vc.logError(*task, "failed to merge chunks", err)
-		return err
-	}
+// handleTask converts the video and marks it as processed
+func (vc *VideoConverter) handleTask(ctx context.Context, msg []byte) Result {
+	var task VideoTask
 
-	// Create directory for MPEG-DASH output
-	slog.Info("Creating mpeg-dash dir", slog.String("path", task.Path))
-	err = os.MkdirAll(mpegDashPath, os.ModePerm)
+	err := json.Unmarshal(msg, &task)
 	if err != nil {
-		vc.logError(*task, "failed to create mpeg-dash directory", err)
-		return err
+		err = fmt.Errorf("%w: %v", ErrInvalidTask, err)
+		vc.logError(task, PhaseDecode, "failed to unmarshal task", err)
+		vc.events.Publish(events.TaskFailed{Err: err, At: time.Now()})
+		return Permanent(err)
 	}
 
-	// Convert to MPEG-DASH
-	slog.Info("Converting video to mpeg-dash", slog.String("path", task.Path))
-	ffmpegCmd := exec.Command(
-		"ffmpeg", "-i", mergedFile, //Arquivo de entrada
-		"-f", "dash", // Formato de saída
-		filepath.Join(mpegDashPath, "output.mpd"), // Caminho para salvar o arquivo .mpd
-	)
-
-	output, err := ffmpegCmd.CombinedOutput()
-	if err != nil {
-		vc.logError(*task, "failed to convert video to mpeg-dash, output: "+string(output), err)
-		return err
+	if task.DryRun || vc.dryRun {
+		return vc.logPlan(&task)
 	}
-	slog.Info("Video convert to mpeg-dash", slog.String("path", mpegDashPath))
-
 
-	//Remove merged file after processing
-	slog.Info("Removing merged file", slog.String("path", mergedFile))
-	err = os.Remove(mergedFile)
+	// Process the video through the pipeline stages; failures are
+	// recorded by the pipeline with the stage that failed
+	err = vc.runPipeline(ctx, &task)
 	if err != nil {
-		vc.logError(*task, "failed to remove merged file", err)
-		return err
+		return classify(err)
 	}
-	return nil
+	return Success()
 }
 
-// logError handles logging the error in JSON format
-func (vc *VideoConverter) logError(task VideoTask, message string, err error) {
+// logError handles logging the error in JSON format; phase is the pipeline
+// stage, or PhaseDecode/PhaseHandle outside of it
+func (vc *VideoConverter) logError(task VideoTask, phase, message string, err error) {
 	errorData := map[string]interface{}{
-		"video_id": task.VideoID,
-		"error":    message,
-		"details":  err.Error(),
-		"time":     time.Now(),
+		"video_id":   task.VideoID,
+		"task":       task,
+		"phase":      phase,
+		"error_type": classify(err).Outcome.String(),
+		"error":      message,
+		"details":    err.Error(),
+		"time":       time.Now(),
+	}
+	// Recognized ffmpeg failures say what went wrong and what to do about it
+	var ffmpegErr *ffmpeg.Error
+	if errors.As(err, &ffmpegErr) {
+		errorData["cause"] = ffmpegErr.Code
+		errorData["hint"] = ffmpegErr.Hint
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		errorData["cause"] = "limit_" + limitErr.Limit
 	}
 	serializedError, _ := json.Marshal(errorData)
 	slog.Error("Processing error", slog.String("error_details", string(serializedError)))
 
-	RegisterError(vc.db, errorData, err)
-}
-
-// Método para extrair o número do nome do arquivo
-func (vc *VideoConverter) extractNumber(fileName string) int {
-	re := regexp.MustCompile(`\d+`)
-	numStr := re.FindString(filepath.Base(fileName)) // Pega o nome do arquivo, sem o caminho
-	num, err := strconv.Atoi(numStr)
-	if err != nil {
-		return -1
-	}
-	return num
+	vc.registerError(errorData, err)
 }
 
-// Método para mesclar os chunks
-func (vc *VideoConverter) mergeChunks(inputDir, outputFile string) error {
-	// Buscar todos os arquivos .chunk no diretório
-	chunks, err := filepath.Glob(filepath.Join(inputDir, "*.chunk"))
-	if err != nil {
-		return fmt.Errorf("failed to find chunks: %v", err)
-	}
-
-	// Ordenar os chunks numericamente
-	sort.Slice(chunks, func(i, j int) bool {
-		return vc.extractNumber(chunks[i]) < vc.extractNumber(chunks[j])
-	})
-
-	// Criar arquivo de saída
-	output, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
-	}
-	defer output.Close()
-
-	// Ler cada chunk e escrever no arquivo final
-	for _, chunk := range chunks {
-		input, err := os.Open(chunk)
-		if err != nil {
-			return fmt.Errorf("failed to open chunk: %v", err)
-		}
-
-		// Copiar dados do chunk para o arquivo de saída
-		_, err = output.ReadFrom(input)
-		if err != nil {
-			return fmt.Errorf("failed to write chunk %s to merged file: %v", chunk, err)
-		}
-		input.Close()
+// registerError stores the error in the repository; failing to do so is only logged
+func (vc *VideoConverter) registerError(errorData map[string]interface{}, err error) {
+	if dbErr := vc.repo.RegisterError(context.Background(), errorData); dbErr != nil {
+		slog.Error("Error storing error log in database", slog.String("error", dbErr.Error()))
+		return
 	}
-	return nil
+	slog.Info("Error log stored successfully", slog.String("error", err.Error()))
 }
@@ -0,0 +1,203 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// ErrTenantNotFound is returned for a tenant without settings
+var ErrTenantNotFound = errors.New("tenant settings not found")
+
+// watermarkPath matches the watermark images a profile or tenant may
+// overlay: absolute PNG or JPEG paths without characters ffmpeg's filter
+// syntax would interpret
+var watermarkPath = regexp.MustCompile(`^/[A-Za-z0-9._/-]+\.(png|jpg|jpeg)$`)
+
+// TenantSettings are a tenant's overrides of the converter's defaults,
+// stored in the tenant_settings table; empty fields keep the defaults
+type TenantSettings struct {
+	Tenant string `json:"tenant"`
+	// DefaultProfile converts the tenant's tasks naming no profile,
+	// instead of DefaultProfileName and the profile rules
+	DefaultProfile string `json:"default_profile,omitempty"`
+	// Watermark is the path of an image, on the workers, overlaid on the
+	// bottom right corner of every video of the tenant
+	Watermark string `json:"watermark,omitempty"`
+	// StoragePrefix replaces the output layout's Prefix for the tenant,
+	// with the same placeholders
+	StoragePrefix string    `json:"storage_prefix,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Validate reports settings the pipeline can't use
+func (s TenantSettings) Validate() error {
+	if s.Tenant == "" {
+		return errors.New("tenant is required")
+	}
+	if err := checkWatermark(s.Watermark); err != nil {
+		return err
+	}
+	if s.StoragePrefix != "" {
+		layout := OutputLayout{Prefix: s.StoragePrefix}
+		if err := layout.Validate(); err != nil {
+			return fmt.Errorf("storage prefix: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkWatermark returns an error for a watermark image path that isn't
+// safe to put in a filter graph
+func checkWatermark(file string) error {
+	if file == "" {
+		return nil
+	}
+	if !watermarkPath.MatchString(file) || strings.Contains(file, "..") || path.Clean(file) != file {
+		return fmt.Errorf("watermark %q must be an absolute .png or .jpg path of letters, digits, '.', '_', '-' and '/'", file)
+	}
+	return nil
+}
+
+// applyTenantSettings reads the settings of the task's tenant into the job
+// and gives a task naming no profile the tenant's default profile, before
+// rollouts pick canaries of it
+func (vc *VideoConverter) applyTenantSettings(ctx context.Context, job *Job) error {
+	if job.Task.Tenant == "" {
+		return nil
+	}
+	settings, ok, err := vc.repo.TenantSettings(ctx, job.Task.Tenant)
+	if err != nil {
+		return fmt.Errorf("failed to read tenant settings: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	job.Tenant = &settings
+	if job.Task.Profile == "" && settings.DefaultProfile != "" {
+		slog.Info("Using tenant default profile", slog.Int("video_id", job.Task.VideoID),
+			slog.String("tenant", settings.Tenant), slog.String("profile", settings.DefaultProfile))
+		job.Task.Profile = settings.DefaultProfile
+	}
+	return nil
+}
+
+// override returns the profile with the tenant's watermark, unchanged for
+// nil settings
+func (s *TenantSettings) override(profile Profile) Profile {
+	if s != nil && s.Watermark != "" {
+		profile.Watermark = s.Watermark
+	}
+	return profile
+}
+
+// layoutFor returns the output layout of the job, with its tenant's
+// storage prefix
+func (vc *VideoConverter) layoutFor(job *Job) OutputLayout {
+	layout := vc.outputLayout
+	if job.Tenant != nil && job.Tenant.StoragePrefix != "" {
+		layout.Prefix = job.Tenant.StoragePrefix
+	}
+	return layout
+}
+
+// tenantColumns are the columns scanned by scanTenantSettings
+const tenantColumns = "tenant, default_profile, watermark, storage_prefix, updated_at"
+
+// GetTenantSettings returns the settings of a tenant
+func GetTenantSettings(ctx context.Context, db *database.DB, tenant string) (TenantSettings, error) {
+	row := db.QueryRowContext(ctx, db.Rebind("SELECT "+tenantColumns+" FROM tenant_settings WHERE tenant = ?"), tenant)
+	s, err := scanTenantSettings(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TenantSettings{}, fmt.Errorf("%w: %s", ErrTenantNotFound, tenant)
+	}
+	return s, err
+}
+
+// ListTenantSettings returns the settings of every tenant, by tenant
+func ListTenantSettings(ctx context.Context, db *database.DB) ([]TenantSettings, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+tenantColumns+" FROM tenant_settings ORDER BY tenant")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []TenantSettings{}
+	for rows.Next() {
+		s, err := scanTenantSettings(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// SaveTenantSettings creates or replaces the settings of a tenant, in a
+// transaction so jobs never read the tenant without settings in between
+func SaveTenantSettings(ctx context.Context, db *database.DB, s TenantSettings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	del := db.Rebind("DELETE FROM tenant_settings WHERE tenant = ?")
+	ins := db.Rebind("INSERT INTO tenant_settings (" + tenantColumns + ") VALUES (?, ?, ?, ?, ?)")
+	return database.Retry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, del, s.Tenant); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, ins, s.Tenant, s.DefaultProfile, s.Watermark, s.StoragePrefix, s.UpdatedAt); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// DeleteTenantSettings removes the settings of a tenant, which goes back
+// to the defaults. It runs in a transaction like SaveTenantSettings, so it
+// waits for a save in progress instead of deleting between its statements.
+func DeleteTenantSettings(ctx context.Context, db *database.DB, tenant string) error {
+	var deleted int64
+	err := database.Retry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		res, err := tx.ExecContext(ctx, db.Rebind("DELETE FROM tenant_settings WHERE tenant = ?"), tenant)
+		if err != nil {
+			return err
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, tenant)
+	}
+	return nil
+}
+
+// scanTenantSettings scans the tenantColumns of a row
+func scanTenantSettings(row interface{ Scan(...any) error }) (TenantSettings, error) {
+	var s TenantSettings
+	err := row.Scan(&s.Tenant, &s.DefaultProfile, &s.Watermark, &s.StoragePrefix, &s.UpdatedAt)
+	return s, err
+}
@@ -0,0 +1,258 @@
+package converter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// Thumbnail modes of a task or profile
+const (
+	// ThumbnailFast takes the frame at a tenth of the video, with a single
+	// seek
+	ThumbnailFast = "fast"
+	// ThumbnailSmart samples frames over the whole video and takes the
+	// sharpest one that isn't black, blown out or flat
+	ThumbnailSmart = "smart"
+)
+
+const (
+	// ThumbnailName is the thumbnail's file name next to the DASH output
+	ThumbnailName = "thumbnail.jpg"
+	// thumbnailHeight is the height of the thumbnail, unless the video is
+	// smaller
+	thumbnailHeight = 720
+	// thumbnailCandidates is how many frames the smart mode samples
+	thumbnailCandidates = 30
+	// thumbnailAnalysisHeight is the height frames are analyzed at
+	thumbnailAnalysisHeight = 360
+)
+
+// Luma limits, on the 0-255 scale, of a frame worth a thumbnail: darker
+// ones are fades and black frames, brighter ones flashes, and those with
+// less contrast title cards or out of focus shots
+const (
+	thumbnailMinLuma     = 32
+	thumbnailMaxLuma     = 224
+	thumbnailMinContrast = 48
+)
+
+// thumbnailMode returns the job's thumbnail mode, the task's or else the
+// profile's, "" when it writes none
+func thumbnailMode(job *Job) string {
+	if job.Task.Thumbnail != "" {
+		return job.Task.Thumbnail
+	}
+	return job.Profile.Thumbnail
+}
+
+// wantsThumbnail reports whether the job also writes a thumbnail: a video
+// job whose task or profile asks for one
+func wantsThumbnail(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && thumbnailMode(job) != ""
+}
+
+// checkThumbnailMode returns an error for an unknown mode
+func checkThumbnailMode(mode string) error {
+	switch mode {
+	case "", ThumbnailFast, ThumbnailSmart:
+		return nil
+	}
+	return fmt.Errorf("unknown thumbnail mode %q", mode)
+}
+
+// frameStats are the measures of a sampled frame the smart mode picks from
+type frameStats struct {
+	at       float64 // seconds
+	luma     float64 // average
+	contrast float64 // spread between the 10th and 90th percentiles
+	edges    float64 // average of the edge map, higher when sharper
+}
+
+// worthy reports whether the frame is neither black, blown out nor flat
+func (s frameStats) worthy() bool {
+	return s.luma >= thumbnailMinLuma && s.luma <= thumbnailMaxLuma && s.contrast >= thumbnailMinContrast
+}
+
+// encodeThumbnail writes the job's thumbnail to its output directory, so
+// it is uploaded with the streaming renditions. ffmpeg applies the
+// source's rotation before any filter, so phone videos are measured and
+// saved upright.
+func (vc *VideoConverter) encodeThumbnail(ctx context.Context, job *Job, runner ffmpeg.Runner) error {
+	at := fastThumbnailTime(job.Probe.DurationSeconds())
+	if thumbnailMode(job) == ThumbnailSmart {
+		selected, err := vc.selectThumbnail(ctx, job, runner)
+		if err != nil {
+			return err
+		}
+		at = selected
+	}
+
+	outputFile := filepath.Join(job.OutputDir, ThumbnailName)
+	slog.Info("Encoding thumbnail", slog.String("path", outputFile), slog.Float64("at", at))
+	output, err := runner.Run(ctx, thumbnailArgs(job.MergedFile, roundMillis(at), outputFile)...)
+	if err != nil {
+		return fmt.Errorf("failed to encode thumbnail: %w", ffmpeg.ParseError(err, output))
+	}
+	return nil
+}
+
+// selectThumbnail measures frames sampled over the video and returns the
+// time of the sharpest worthy one, or of the sharpest one when none is,
+// such as for a screencast of a dark terminal
+func (vc *VideoConverter) selectThumbnail(ctx context.Context, job *Job, runner ffmpeg.Runner) (float64, error) {
+	duration := job.Probe.DurationSeconds()
+	luma, edges := thumbnailStatsFiles(job)
+	defer os.Remove(luma)
+	defer os.Remove(edges)
+	output, err := runner.Run(ctx, thumbnailAnalysisArgs(job.MergedFile, thumbnailInterval(duration), luma, edges)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to analyze frames for the thumbnail: %w", ffmpeg.ParseError(err, output))
+	}
+	frames, err := readFrameStats(luma, edges)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read thumbnail frame stats: %w", err)
+	}
+
+	best, found := -1, false
+	for i, f := range frames {
+		switch {
+		case f.worthy() && (!found || f.edges > frames[best].edges):
+			best, found = i, true
+		case !found && (best < 0 || f.edges > frames[best].edges):
+			best = i
+		}
+	}
+	if best < 0 {
+		slog.Warn("No frame measured for the thumbnail", slog.Int("video_id", job.Task.VideoID))
+		return fastThumbnailTime(duration), nil
+	}
+	if !found {
+		slog.Warn("No frame worth a thumbnail, taking the sharpest", slog.Int("video_id", job.Task.VideoID))
+	}
+	return frames[best].at, nil
+}
+
+// fastThumbnailTime is the time of the fast mode's frame, past intros and
+// fades in
+func fastThumbnailTime(duration float64) float64 {
+	return duration / 10
+}
+
+// thumbnailInterval returns the time between the frames the smart mode
+// samples, spread over the video but at most one a second
+func thumbnailInterval(duration float64) float64 {
+	return max(1, duration/thumbnailCandidates)
+}
+
+// thumbnailStatsFiles are where the analysis writes the stats of the
+// frames and of their edge maps
+func thumbnailStatsFiles(job *Job) (string, string) {
+	return filepath.Join(job.Task.Path, "thumbnail-luma.txt"), filepath.Join(job.Task.Path, "thumbnail-edges.txt")
+}
+
+// thumbnailAnalysisArgs are the ffmpeg options sampling a frame every
+// interval seconds, downscaled, and printing its signalstats into luma,
+// then those of its edge map into edges
+func thumbnailAnalysisArgs(source string, interval float64, luma, edges string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:    []string{"0:v:0"},
+			NoAudio: true,
+			VideoFilters: []string{
+				"fps=1/" + strconv.FormatFloat(interval, 'f', -1, 64),
+				previewScale(thumbnailAnalysisHeight),
+				"signalstats",
+				"metadata=mode=print:file='" + luma + "'",
+				"edgedetect",
+				"signalstats",
+				"metadata=mode=print:key=lavfi.signalstats.YAVG:file='" + edges + "'",
+			},
+			Format: "null",
+			File:   "-",
+		}},
+	}.Args()
+}
+
+// thumbnailArgs are the ffmpeg options saving the frame at the time, in
+// seconds, as a JPEG at most thumbnailHeight lines high
+func thumbnailArgs(source string, at float64, outputFile string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{Seek: at, File: source}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0"},
+			VideoFilters: []string{previewScale(thumbnailHeight)},
+			Frames:       1,
+			Options:      []string{"-q:v", "2"},
+			File:         outputFile,
+		}},
+	}.Args()
+}
+
+// readFrameStats reads the stats the analysis printed, a "frame:" line
+// with the frame's pts_time followed by a key=value line per stat
+func readFrameStats(luma, edges string) ([]frameStats, error) {
+	lumaFrames, err := readMetadataPrint(luma)
+	if err != nil {
+		return nil, err
+	}
+	edgeFrames, err := readMetadataPrint(edges)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([]frameStats, 0, len(lumaFrames))
+	for i, m := range lumaFrames {
+		s := frameStats{
+			at:       m["pts_time"],
+			luma:     m["lavfi.signalstats.YAVG"],
+			contrast: m["lavfi.signalstats.YHIGH"] - m["lavfi.signalstats.YLOW"],
+		}
+		if i < len(edgeFrames) {
+			s.edges = edgeFrames[i]["lavfi.signalstats.YAVG"]
+		}
+		frames = append(frames, s)
+	}
+	return frames, nil
+}
+
+// readMetadataPrint parses the output of ffmpeg's metadata filter in
+// print mode into the values of each frame
+func readMetadataPrint(file string) ([]map[string]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var frames []map[string]float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "frame:") {
+			frame := map[string]float64{}
+			for _, field := range strings.Fields(line) {
+				if name, value, ok := strings.Cut(field, ":"); ok {
+					frame[name], _ = strconv.ParseFloat(value, 64)
+				}
+			}
+			frames = append(frames, frame)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || len(frames) == 0 {
+			continue
+		}
+		frames[len(frames)-1][key], _ = strconv.ParseFloat(value, 64)
+	}
+	return frames, scanner.Err()
+}
@@ -0,0 +1,60 @@
+package converter
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"imersaofc/internal/torrent"
+)
+
+// TorrentName is the torrent's file name next to the DASH output
+const TorrentName = "video.torrent"
+
+// WithTorrentSeeds sets where the torrents of profiles with Torrent send
+// clients: webSeeds are the base URLs the uploaded outputs are served from,
+// such as the CDN's, the object keys appended, and trackers the announce
+// URLs. Without an uploader the torrents have no web seeds.
+func WithTorrentSeeds(webSeeds, trackers []string) Option {
+	return func(vc *VideoConverter) {
+		vc.webSeeds = webSeeds
+		vc.trackers = trackers
+	}
+}
+
+// wantsTorrent reports whether the job writes a torrent of its output
+func wantsTorrent(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && job.Profile.Torrent
+}
+
+// writeTorrent writes the torrent of the job's output, once the output is
+// final, as files changed afterwards wouldn't match their pieces. The
+// torrent is named after the last element of the upload prefix, so web
+// seeds serve its files at <web seed>/<prefix>/<path>.
+func (vc *VideoConverter) writeTorrent(job *Job) error {
+	name := filepath.Base(job.OutputDir)
+	var seeds []string
+	if vc.uploader != nil && job.Prefix != "" {
+		name = path.Base(job.Prefix)
+		for _, seed := range vc.webSeeds {
+			if dir := path.Dir(job.Prefix); dir != "." {
+				seed = strings.TrimSuffix(seed, "/") + "/" + dir
+			}
+			seeds = append(seeds, seed)
+		}
+	}
+	data, err := torrent.Create(job.OutputDir, name, torrent.Options{
+		WebSeeds:  seeds,
+		Trackers:  vc.trackers,
+		Exclude:   []string{TorrentName},
+		CreatedBy: "videoconverter",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create torrent: %w", err)
+	}
+	slog.Info("Writing torrent", slog.String("path", job.OutputDir), slog.Int("web_seeds", len(seeds)))
+	return os.WriteFile(filepath.Join(job.OutputDir, TorrentName), data, 0o644)
+}
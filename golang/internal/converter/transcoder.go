@@ -0,0 +1,76 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+// Transcoder writes the MPEG-DASH output of a job to job.OutputDir. The
+// local ffmpeg transcoder is always available; a remote one, such as a
+// managed cloud service, can take over heavy jobs.
+type Transcoder interface {
+	Name() string
+	Transcode(ctx context.Context, job *Job) error
+}
+
+// RemoteThreshold decides which jobs are offloaded to the remote transcoder.
+// A job is offloaded when it reaches either limit; zero disables a limit.
+type RemoteThreshold struct {
+	MinDuration time.Duration
+	MinSize     int64
+}
+
+// localTranscoder runs ffmpeg on this worker with the options chosen by the
+// transcode stage
+type localTranscoder struct {
+	runner ffmpeg.Runner
+}
+
+func (t localTranscoder) Name() string { return "local" }
+
+func (t localTranscoder) Transcode(ctx context.Context, job *Job) error {
+	args := append([]string{"-i", job.MergedFile}, job.OutputArgs...) //Arquivo de entrada
+	output, err := t.runner.Run(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("failed to convert video to mpeg-dash: %w", ffmpeg.ParseError(err, output))
+	}
+	return nil
+}
+
+// transcoderFor picks the transcoder for the job: video jobs at or above the
+// remote threshold go to the remote transcoder, everything else stays local
+func (vc *VideoConverter) transcoderFor(job *Job) Transcoder {
+	local := localTranscoder{runner: vc.runnerFor(job)}
+	if vc.remoteTranscoder == nil || job.Mode != ModeVideo || job.sealer != nil {
+		return local
+	}
+
+	t := vc.remoteThreshold
+	if t.MinDuration > 0 && job.Probe != nil {
+		if time.Duration(job.Probe.DurationSeconds()*float64(time.Second)) >= t.MinDuration {
+			return vc.remoteTranscoder
+		}
+	}
+	if t.MinSize > 0 && sourceSize(job) >= t.MinSize {
+		return vc.remoteTranscoder
+	}
+	return local
+}
+
+// sourceSize returns the size of the merged file, or the size reported by
+// the probe when it wasn't written, as in a dry run
+func sourceSize(job *Job) int64 {
+	if info, err := os.Stat(job.MergedFile); err == nil {
+		return info.Size()
+	}
+	if job.Probe != nil {
+		size, _ := strconv.ParseInt(job.Probe.Format.Size, 10, 64)
+		return size
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Translator translates caption text for the caption stage, see
+// WithTranslator
+type Translator interface {
+	Name() string
+	// Translate translates each text from the language from, as an ISO
+	// 639-1 code, empty to let the translator detect it, to the language
+	// to, returning the translations in the same order
+	Translate(ctx context.Context, texts []string, from, to string) ([]string, error)
+}
+
+// WithTranslator translates captions, with t, into the languages listed
+// by each task's caption_translations
+func WithTranslator(t Translator) Option {
+	return func(vc *VideoConverter) {
+		vc.translator = t
+	}
+}
+
+// translateCaptions adds a translated track to the job per language of
+// its task's CaptionTranslations, from its transcribed track. A failed
+// translation is only logged, so it doesn't throw away the transcription;
+// the completion event lists the languages that were produced.
+func (vc *VideoConverter) translateCaptions(ctx context.Context, job *Job, source CaptionTrack) {
+	if len(job.Task.CaptionTranslations) == 0 {
+		return
+	}
+	if vc.translator == nil {
+		slog.Warn("Caption translations requested but no translator is configured", slog.Int("video_id", job.Task.VideoID))
+		return
+	}
+	vtt, err := os.ReadFile(filepath.Join(job.OutputDir, filepath.FromSlash(source.File)))
+	if err != nil {
+		slog.Warn("Failed to read captions to translate", slog.Int("video_id", job.Task.VideoID), slog.String("error", err.Error()))
+		return
+	}
+	from := source.Language
+	if from == "und" {
+		from = ""
+	}
+	blocks := parseWebVTT(string(vtt))
+
+	for _, to := range job.Task.CaptionTranslations {
+		if strings.EqualFold(to, source.Language) || hasCaptionTrack(job, to) {
+			continue
+		}
+		slog.Info("Translating captions", slog.Int("video_id", job.Task.VideoID), slog.String("to", to), slog.String("translator", vc.translator.Name()))
+		translated, err := vc.translateWebVTT(ctx, blocks, from, to)
+		if err == nil {
+			name := path.Join(CaptionsDir, to+".vtt")
+			if err = os.WriteFile(filepath.Join(job.OutputDir, filepath.FromSlash(name)), []byte(translated), 0o644); err == nil {
+				job.Captions = append(job.Captions, CaptionTrack{Language: to, File: name})
+				continue
+			}
+		}
+		slog.Warn("Failed to translate captions", slog.Int("video_id", job.Task.VideoID), slog.String("to", to), slog.String("error", err.Error()))
+	}
+}
+
+// hasCaptionTrack reports whether the job already has captions in language
+func hasCaptionTrack(job *Job, language string) bool {
+	for _, track := range job.Captions {
+		if strings.EqualFold(track.Language, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// webVTTBlock is a block of a WebVTT file: the header, a comment, a style
+// or a cue, whose text is what gets translated
+type webVTTBlock struct {
+	// head is the block as is, up to and including a cue's timing line
+	head string
+	// text is a cue's payload, empty for other blocks
+	text string
+	cue  bool
+}
+
+// parseWebVTT splits a WebVTT file into its blocks
+func parseWebVTT(vtt string) []webVTTBlock {
+	vtt = strings.ReplaceAll(vtt, "\r\n", "\n")
+	var blocks []webVTTBlock
+	for _, block := range strings.Split(strings.TrimSpace(vtt), "\n\n") {
+		block = strings.Trim(block, "\n")
+		if block == "" {
+			continue
+		}
+		lines := strings.Split(block, "\n")
+		timing := -1
+		for i, line := range lines {
+			if strings.Contains(line, "-->") {
+				timing = i
+				break
+			}
+		}
+		if timing < 0 || strings.HasPrefix(lines[0], "NOTE") {
+			blocks = append(blocks, webVTTBlock{head: block})
+			continue
+		}
+		blocks = append(blocks, webVTTBlock{
+			head: strings.Join(lines[:timing+1], "\n"),
+			text: strings.Join(lines[timing+1:], "\n"),
+			cue:  true,
+		})
+	}
+	return blocks
+}
+
+// translateWebVTT translates the cue text of the blocks, keeping their
+// timings, and returns the translated WebVTT file
+func (vc *VideoConverter) translateWebVTT(ctx context.Context, blocks []webVTTBlock, from, to string) (string, error) {
+	var texts []string
+	for _, b := range blocks {
+		if b.cue {
+			texts = append(texts, b.text)
+		}
+	}
+	translations, err := vc.translator.Translate(ctx, texts, from, to)
+	if err != nil {
+		return "", err
+	}
+	if len(translations) != len(texts) {
+		return "", fmt.Errorf("%s returned %d translations for %d cues", vc.translator.Name(), len(translations), len(texts))
+	}
+
+	var out strings.Builder
+	next := 0
+	for i, b := range blocks {
+		if i > 0 {
+			out.WriteString("\n\n")
+		}
+		out.WriteString(b.head)
+		if b.cue {
+			out.WriteString("\n" + strings.TrimSpace(translations[next]))
+			next++
+		}
+	}
+	out.WriteString("\n")
+	return out.String(), nil
+}
@@ -0,0 +1,213 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/ffmpeg"
+)
+
+const (
+	// TrickPlayDir holds the trick play stream, below the output directory
+	TrickPlayDir = "trickplay"
+	// TrickPlayPlaylist is the HLS I-frame playlist in TrickPlayDir
+	TrickPlayPlaylist = "iframes.m3u8"
+	// TrickPlayInterval is the number of seconds between trick play frames;
+	// each one is a keyframe in a segment of its own
+	TrickPlayInterval = 2
+	// trickPlayHeight is the height of the trick play frames
+	trickPlayHeight = 240
+	// trickModeScheme marks a DASH adaptation set as trick mode
+	trickModeScheme = "http://dashif.org/guidelines/trickmode"
+)
+
+// wantsTrickPlay reports whether the job also writes trick play streams: a
+// video job whose task or profile asks for them
+func wantsTrickPlay(job *Job) bool {
+	return job.Mode == ModeVideo && job.DuplicateOf == 0 && (job.Task.TrickPlay || job.Profile.TrickPlay)
+}
+
+// trickPlayArgs are the ffmpeg options encoding one small keyframe every
+// TrickPlayInterval seconds as DASH with an HLS playlist, one frame per
+// segment, so players can show previews while seeking fast, with the
+// metadata options
+func trickPlayArgs(input, outputDir string, metadata []string) []string {
+	return ffmpeg.Command{
+		Overwrite: true,
+		Inputs:    []ffmpeg.Input{{File: input}},
+		Outputs: []ffmpeg.Output{{
+			Maps:         []string{"0:v:0"},
+			NoAudio:      true,
+			VideoCodec:   "libx264",
+			VideoFilters: []string{fmt.Sprintf("fps=1/%d", TrickPlayInterval), previewScale(trickPlayHeight)},
+			Options: append([]string{
+				"-preset", "veryfast",
+				"-crf", "32",
+				"-g", "1",
+				"-keyint_min", "1",
+				"-sc_threshold", "0",
+				"-pix_fmt", "yuv420p",
+				"-hls_playlist", "1",
+				"-seg_duration", strconv.Itoa(TrickPlayInterval),
+				"-init_seg_name", "trick-init.m4s",
+				"-media_seg_name", "trick-$Number%05d$.m4s",
+			}, metadata...),
+			Format: "dash",
+			File:   filepath.Join(outputDir, TrickPlayDir, "trick.mpd"),
+		}},
+	}.Args()
+}
+
+// encodeTrickPlay writes the trick play stream and signals it in the
+// job's DASH manifest and, when there is one, its HLS master playlist
+func (vc *VideoConverter) encodeTrickPlay(ctx context.Context, job *Job, runner ffmpeg.Runner) error {
+	dir := filepath.Join(job.OutputDir, TrickPlayDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create trick play directory: %w", err)
+	}
+	slog.Info("Encoding trick play stream", slog.String("path", dir))
+	output, err := runner.Run(ctx, trickPlayArgs(job.MergedFile, job.OutputDir, vc.metadataArgs(nil, nil))...)
+	if err != nil {
+		return fmt.Errorf("failed to encode trick play stream: %w", ffmpeg.ParseError(err, output))
+	}
+
+	if err := addTrickModeAdaptationSet(job.Manifest, filepath.Join(dir, "trick.mpd")); err != nil {
+		return fmt.Errorf("failed to add trick play to the dash manifest: %w", err)
+	}
+	master := filepath.Join(job.OutputDir, "master.m3u8")
+	if _, err := os.Stat(master); errors.Is(err, os.ErrNotExist) {
+		slog.Warn("No hls master playlist, trick play is only signaled in the dash manifest", slog.String("path", job.OutputDir))
+	} else if err := addIFrameStream(master, dir); err != nil {
+		return fmt.Errorf("failed to add trick play to the hls playlist: %w", err)
+	}
+
+	// Only the segments and the I-frame playlist are served
+	for _, name := range []string{"trick.mpd", "master.m3u8", "media_0.m3u8"} {
+		os.Remove(filepath.Join(dir, name))
+	}
+	return nil
+}
+
+var (
+	adaptationSetPattern = regexp.MustCompile(`(?s)<AdaptationSet\b[^>]*>.*?</AdaptationSet>`)
+	videoSetIDPattern    = regexp.MustCompile(`<AdaptationSet\b[^>]*\bid="([^"]*)"[^>]*\bcontentType="video"`)
+	idAttrPattern        = regexp.MustCompile(`\bid="[^"]*"`)
+	segmentAttrPattern   = regexp.MustCompile(`\b(initialization|media)="([^"]*)"`)
+)
+
+// addTrickModeAdaptationSet copies the video adaptation set of the trick
+// play manifest into the main manifest, marked as the trick mode of the
+// main video adaptation set and with its segments below TrickPlayDir
+func addTrickModeAdaptationSet(manifest, trickManifest string) error {
+	main, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	trick, err := os.ReadFile(trickManifest)
+	if err != nil {
+		return err
+	}
+	videoSet := videoSetIDPattern.FindSubmatch(main)
+	if videoSet == nil {
+		return errors.New("no video adaptation set")
+	}
+	set := adaptationSetPattern.Find(trick)
+	if set == nil {
+		return errors.New("no adaptation set in the trick play manifest")
+	}
+
+	// Ids must be unique within the period; the segment names don't use them
+	trickSet := idAttrPattern.ReplaceAllString(string(set), `id="trickplay"`)
+	trickSet = segmentAttrPattern.ReplaceAllString(trickSet, `$1="`+TrickPlayDir+`/$2"`)
+	property := fmt.Sprintf(`<EssentialProperty schemeIdUri="%s" value="%s"/>`, trickModeScheme, videoSet[1])
+	openEnd := strings.Index(trickSet, ">") + 1
+	trickSet = trickSet[:openEnd] + "\n\t\t\t" + property + trickSet[openEnd:]
+
+	i := strings.LastIndex(string(main), "</Period>")
+	if i < 0 {
+		return errors.New("no period in the manifest")
+	}
+	updated := string(main[:i]) + "\t" + trickSet + "\n\t" + string(main[i:])
+	return os.WriteFile(manifest, []byte(updated), 0o644)
+}
+
+// iFrameStreamExcluded are the EXT-X-STREAM-INF attributes an
+// EXT-X-I-FRAME-STREAM-INF can't have
+var iFrameStreamExcluded = []string{"FRAME-RATE", "AUDIO", "SUBTITLES", "CLOSED-CAPTIONS"}
+
+// addIFrameStream turns the trick play media playlist into an I-frame
+// playlist and adds it to the master playlist, with the attributes ffmpeg
+// wrote for the trick play stream
+func addIFrameStream(master, dir string) error {
+	media, err := os.ReadFile(filepath.Join(dir, "media_0.m3u8"))
+	if err != nil {
+		return err
+	}
+	trickMaster, err := os.ReadFile(filepath.Join(dir, "master.m3u8"))
+	if err != nil {
+		return err
+	}
+
+	var attrs []string
+	for _, line := range strings.Split(string(trickMaster), "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "#EXT-X-STREAM-INF:"); ok {
+			for _, attr := range splitAttributes(rest) {
+				name, _, _ := strings.Cut(attr, "=")
+				if !slices.Contains(iFrameStreamExcluded, name) {
+					attrs = append(attrs, attr)
+				}
+			}
+			break
+		}
+	}
+	if len(attrs) == 0 {
+		return errors.New("no stream in the trick play playlist")
+	}
+
+	// Every segment is a single keyframe, so the media playlist only needs
+	// the tag to be an I-frame playlist
+	var playlist []string
+	for _, line := range strings.Split(string(media), "\n") {
+		playlist = append(playlist, line)
+		if strings.HasPrefix(line, "#EXT-X-VERSION") {
+			playlist = append(playlist, "#EXT-X-I-FRAMES-ONLY")
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, TrickPlayPlaylist), []byte(strings.Join(playlist, "\n")), 0o644); err != nil {
+		return err
+	}
+
+	main, err := os.ReadFile(master)
+	if err != nil {
+		return err
+	}
+	attrs = append(attrs, fmt.Sprintf(`URI="%s/%s"`, TrickPlayDir, TrickPlayPlaylist))
+	updated := strings.TrimRight(string(main), "\n") + "\n#EXT-X-I-FRAME-STREAM-INF:" + strings.Join(attrs, ",") + "\n"
+	return os.WriteFile(master, []byte(updated), 0o644)
+}
+
+// splitAttributes splits an HLS attribute list at the commas outside of
+// quoted values
+func splitAttributes(list string) []string {
+	var attrs []string
+	quoted := false
+	start := 0
+	for i, r := range list {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			attrs = append(attrs, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(attrs, list[start:])
+}
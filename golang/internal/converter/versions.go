@@ -0,0 +1,142 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// ErrVersionNotFound is returned when a video has no output with the requested version
+var ErrVersionNotFound = errors.New("output version not found")
+
+// OutputVersion is one encode of a video. The first one is written to
+// mpeg-dash, reprocessing writes mpeg-dash/v2, v3... next to it, so earlier
+// encodes stay available and the CDN never serves a mix of two versions.
+type OutputVersion struct {
+	VideoID   int       `json:"video_id"`
+	Version   int       `json:"version"`
+	Profile   string    `json:"profile"`
+	Active    bool      `json:"active"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// versionDir returns the directory, relative to mpeg-dash, of a version
+func versionDir(version int) string {
+	if version <= 1 {
+		return ""
+	}
+	return "v" + strconv.Itoa(version)
+}
+
+// assignVersion picks the output version: reprocessing writes the version
+// after the latest one, anything else (re)writes the first version
+func (vc *VideoConverter) assignVersion(ctx context.Context, job *Job) error {
+	job.Version = 1
+	if job.Task.Reprocess {
+		latest, err := vc.repo.LatestVersion(ctx, job.Task.VideoID)
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			// Videos converted before versions were tracked have their
+			// output in mpeg-dash, which is version 1
+			processed, err := vc.repo.IsProcessed(ctx, job.Task.VideoID)
+			if err != nil {
+				return err
+			}
+			if processed {
+				latest = 1
+			}
+		}
+		job.Version = latest + 1
+	}
+	job.OutputDir = filepath.Join(job.Task.Path, "mpeg-dash", versionDir(job.Version))
+	job.Manifest = filepath.Join(job.OutputDir, vc.outputLayout.Manifest)
+	job.Prefix = vc.layoutFor(job).prefix(job.Task, job.Task.VideoID, job.Version)
+	return nil
+}
+
+// LatestVersion returns the highest recorded output version of the video, 0 when none
+func LatestVersion(ctx context.Context, db *database.DB, videoID int) (int, error) {
+	var latest sql.NullInt64
+	query := db.Rebind("SELECT MAX(version) FROM output_versions WHERE video_id = ?")
+	err := database.Retry(ctx, func() error {
+		return db.QueryRowContext(ctx, query, videoID).Scan(&latest)
+	})
+	return int(latest.Int64), err
+}
+
+// SaveVersion records a new output version, uploaded to prefix, and makes
+// it the active one
+func SaveVersion(ctx context.Context, db *database.DB, videoID, version int, profile, prefix string) error {
+	return database.Retry(ctx, func() error {
+		return saveVersion(ctx, db, db, videoID, version, profile, prefix)
+	})
+}
+
+// saveVersion records and activates an output version with q, the pool or
+// a transaction
+func saveVersion(ctx context.Context, db *database.DB, q querier, videoID, version int, profile, prefix string) error {
+	del := db.Rebind("DELETE FROM output_versions WHERE video_id = ? AND version = ?")
+	ins := db.Rebind("INSERT INTO output_versions (video_id, version, profile, prefix, active, created_at) VALUES (?, ?, ?, ?, ?, ?)")
+	update := db.Rebind("UPDATE output_versions SET active = (version = ?) WHERE video_id = ?")
+	if _, err := q.ExecContext(ctx, del, videoID, version); err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx, ins, videoID, version, profile, prefix, false, time.Now()); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx, update, version, videoID)
+	return err
+}
+
+// ActivateVersion makes the version the one served for the video, e.g. to
+// roll back to a previous encode
+func ActivateVersion(ctx context.Context, db *database.DB, videoID, version int) error {
+	var exists bool
+	check := db.Rebind("SELECT EXISTS(SELECT 1 FROM output_versions WHERE video_id = ? AND version = ?)")
+	if err := db.QueryRowContext(ctx, check, videoID, version).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrVersionNotFound
+	}
+	update := db.Rebind("UPDATE output_versions SET active = (version = ?) WHERE video_id = ?")
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, update, version, videoID)
+		return err
+	})
+}
+
+// ListVersions returns the recorded output versions of the video, oldest first
+func ListVersions(ctx context.Context, db *database.DB, videoID int) ([]OutputVersion, error) {
+	query := db.Rebind("SELECT version, profile, prefix, active, created_at FROM output_versions WHERE video_id = ? ORDER BY version")
+	rows, err := db.QueryContext(ctx, query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []OutputVersion{}
+	for rows.Next() {
+		v := OutputVersion{VideoID: videoID}
+		var prefix sql.NullString
+		if err := rows.Scan(&v.Version, &v.Profile, &prefix, &v.Active, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		v.Prefix = prefix.String
+		if !prefix.Valid {
+			// Versions recorded before the layout was configurable
+			task := &VideoTask{Profile: v.Profile}
+			v.Prefix = DefaultOutputLayout.prefix(task, videoID, v.Version)
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,163 @@
+// Package database opens pooled connections and retries transient failures
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// PoolConfig sizes the connection pool; zero values keep database/sql's defaults
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Retry attempts and backoff used by Retry
+const (
+	retryAttempts = 3
+	retryBackoff  = 200 * time.Millisecond
+	maxBackoff    = 5 * time.Second
+)
+
+// Open opens a pooled connection and waits up to timeout for the database
+// to accept it, so the worker doesn't crash when the database boots slower
+func Open(driverName, dsn string, pool PoolConfig, timeout time.Duration) (*DB, error) {
+	if _, err := DialectFor(driverName); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connect(driverName, db, pool, timeout)
+}
+
+// OpenRotating is Open with the DSN built again for each new connection,
+// so rotated credentials are used once the pool replaces its connections,
+// see PoolConfig.ConnMaxLifetime
+func OpenRotating(driverName string, dsn func(ctx context.Context) (string, error), pool PoolConfig, timeout time.Duration) (*DB, error) {
+	if _, err := DialectFor(driverName); err != nil {
+		return nil, err
+	}
+	// sql.Open doesn't connect, it's only here for the registered driver
+	registered, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	d := registered.Driver()
+	registered.Close()
+	return connect(driverName, sql.OpenDB(dsnConnector{driver: d, dsn: dsn}), pool, timeout)
+}
+
+// dsnConnector connects with the DSN of the moment
+type dsnConnector struct {
+	driver driver.Driver
+	dsn    func(ctx context.Context) (string, error)
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dsn, err := c.dsn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := d.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return connector.Connect(ctx)
+	}
+	return c.driver.Open(dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver { return c.driver }
+
+// connect sizes the pool and waits for the database to accept a connection
+func connect(driverName string, db *sql.DB, pool PoolConfig, timeout time.Duration) (*DB, error) {
+	dialect, err := DialectFor(driverName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			return &DB{DB: db, Dialect: dialect}, nil
+		}
+		slog.Warn("Waiting for database", slog.Int("attempt", attempt), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			db.Close()
+			return nil, fmt.Errorf("database not ready after %s: %w", timeout, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// IsTransient reports whether err is worth retrying: lost connections,
+// network errors, and serialization failures or deadlocks
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		state := stateErr.SQLState()
+		switch {
+		case strings.HasPrefix(state, "08"): // connection exception
+			return true
+		case state == "40001", state == "40P01": // serialization failure, deadlock
+			return true
+		case state == "57P01", state == "57P02", state == "57P03": // admin shutdown, cannot connect now
+			return true
+		}
+	}
+	return false
+}
+
+// Retry runs fn, retrying transient errors with exponential backoff
+func Retry(ctx context.Context, fn func() error) error {
+	backoff := retryBackoff
+	var err error
+	for attempt := 1; attempt <= retryAttempts; attempt++ {
+		err = fn()
+		if !IsTransient(err) {
+			return err
+		}
+		if attempt == retryAttempts {
+			break
+		}
+		slog.Warn("Retrying database operation", slog.Int("attempt", attempt), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return err
+}
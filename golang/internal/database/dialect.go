@@ -0,0 +1,89 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect hides the SQL differences between the supported databases.
+// Queries are written with ? placeholders and rebound per dialect.
+type Dialect interface {
+	Name() string
+	// Rebind rewrites ? placeholders into the dialect's syntax
+	Rebind(query string) string
+	// JSONText extracts a top-level key of a JSON column as text
+	JSONText(column, key string) string
+	// SkipLocked is the clause ending a SELECT that locks the rows it
+	// returns until the transaction ends, skipping those another
+	// transaction locked
+	SkipLocked() string
+}
+
+// Postgres is the dialect of PostgreSQL
+type Postgres struct{}
+
+func (Postgres) Name() string { return "postgres" }
+
+func (Postgres) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (Postgres) JSONText(column, key string) string {
+	return fmt.Sprintf("%s->>'%s'", column, key)
+}
+
+func (Postgres) SkipLocked() string { return "FOR UPDATE SKIP LOCKED" }
+
+// MySQL is the dialect of MySQL 8 and MariaDB 10.2+; SkipLocked needs
+// MariaDB 10.6
+type MySQL struct{}
+
+func (MySQL) Name() string { return "mysql" }
+
+func (MySQL) Rebind(query string) string { return query }
+
+func (MySQL) JSONText(column, key string) string {
+	return fmt.Sprintf("JSON_VALUE(%s, '$.%s')", column, key)
+}
+
+func (MySQL) SkipLocked() string { return "FOR UPDATE SKIP LOCKED" }
+
+// DialectFor returns the dialect of a database/sql driver name
+func DialectFor(driverName string) (Dialect, error) {
+	switch driverName {
+	case "postgres", "pgx":
+		return Postgres{}, nil
+	case "mysql":
+		return MySQL{}, nil
+	case "sqlite", "sqlite3":
+		return SQLite{}, nil
+	}
+	return nil, fmt.Errorf("unsupported database driver: %s", driverName)
+}
+
+// DB is a connection pool with the dialect its queries must be written in
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Rebind rewrites ? placeholders for the database's dialect
+func (db *DB) Rebind(query string) string {
+	return db.Dialect.Rebind(query)
+}
@@ -0,0 +1,178 @@
+CREATE TABLE IF NOT EXISTS processed_videos (
+    video_id INTEGER PRIMARY KEY,
+    status TEXT NOT NULL,
+    processed_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS process_errors_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    error_details TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS process_errors_log_created_at_idx ON process_errors_log (created_at);
+
+CREATE TABLE IF NOT EXISTS job_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    video_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    stage TEXT NOT NULL DEFAULT '',
+    old_status TEXT NOT NULL,
+    new_status TEXT NOT NULL,
+    worker_id TEXT NOT NULL,
+    details TEXT,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS job_events_video_id_idx ON job_events (video_id, id);
+
+CREATE TABLE IF NOT EXISTS job_labels (
+    video_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (video_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS job_labels_name_value_idx ON job_labels (name, value);
+
+CREATE TABLE IF NOT EXISTS video_sources (
+    video_id INTEGER PRIMARY KEY,
+    content_hash TEXT NOT NULL,
+    profile TEXT NOT NULL,
+    output_video_id INTEGER NOT NULL,
+    output_version INTEGER NOT NULL DEFAULT 1,
+    profile_hash TEXT NOT NULL DEFAULT '',
+    output_prefix TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS video_sources_content_hash_idx ON video_sources (content_hash, profile, profile_hash);
+
+CREATE TABLE IF NOT EXISTS output_versions (
+    video_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    profile TEXT NOT NULL,
+    prefix TEXT,
+    active BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (video_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS batches (
+    batch_id TEXT PRIMARY KEY,
+    total INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS batch_tasks (
+    batch_id TEXT NOT NULL,
+    video_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (batch_id, video_id)
+);
+
+CREATE TABLE IF NOT EXISTS job_timings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    video_id INTEGER NOT NULL,
+    profile TEXT NOT NULL,
+    worker_id TEXT NOT NULL,
+    source_seconds REAL NOT NULL,
+    processing_seconds REAL NOT NULL,
+    completed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS job_timings_profile_idx ON job_timings (profile, completed_at);
+
+CREATE TABLE IF NOT EXISTS job_estimates (
+    video_id INTEGER PRIMARY KEY,
+    source_seconds REAL NOT NULL,
+    estimate_seconds REAL NOT NULL,
+    eta TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS throughput_stats (
+    period_start TIMESTAMP NOT NULL,
+    worker_id TEXT NOT NULL,
+    profile TEXT NOT NULL,
+    jobs INTEGER NOT NULL,
+    source_seconds REAL NOT NULL,
+    processing_seconds REAL NOT NULL,
+    PRIMARY KEY (period_start, worker_id, profile)
+);
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id TEXT NOT NULL UNIQUE,
+    topic TEXT NOT NULL,
+    event_key TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    headers TEXT,
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (published_at, id);
+
+CREATE TABLE IF NOT EXISTS job_claims (
+    claim_key TEXT PRIMARY KEY,
+    owner TEXT NOT NULL,
+    claimed_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS moderation_verdicts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    video_id INTEGER NOT NULL,
+    classifier TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    scores TEXT NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    at_seconds REAL NOT NULL DEFAULT 0,
+    frames INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS moderation_verdicts_video_id_idx ON moderation_verdicts (video_id, id);
+
+CREATE TABLE IF NOT EXISTS encode_records (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    video_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    profile TEXT NOT NULL,
+    settings TEXT NOT NULL,
+    transcoder TEXT NOT NULL,
+    ffmpeg_version TEXT NOT NULL DEFAULT '',
+    commands TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS encode_records_video_id_idx ON encode_records (video_id, id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    delivery_id TEXT NOT NULL UNIQUE,
+    video_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    last_status_code INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_video_id_idx ON webhook_deliveries (video_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_status_idx ON webhook_deliveries (status, id);
+
+CREATE TABLE IF NOT EXISTS tenant_settings (
+    tenant TEXT PRIMARY KEY,
+    default_profile TEXT NOT NULL DEFAULT '',
+    watermark TEXT NOT NULL DEFAULT '',
+    storage_prefix TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+)
+
+//go:embed schema/sqlite.sql
+var sqliteSchema string
+
+// SQLite is the dialect of SQLite, used for local development and demos
+type SQLite struct{}
+
+func (SQLite) Name() string { return "sqlite" }
+
+func (SQLite) Rebind(query string) string { return query }
+
+func (SQLite) JSONText(column, key string) string {
+	// json_extract keeps the JSON type, compare as text like the other dialects
+	return fmt.Sprintf("CAST(json_extract(%s, '$.%s') AS TEXT)", column, key)
+}
+
+// SkipLocked is empty: SQLite has no row locks, a write transaction locks
+// the whole database
+func (SQLite) SkipLocked() string { return "" }
+
+// EnsureSchema creates the tables of an embedded database when they don't
+// exist yet; server databases are migrated with db.sql or db.mysql.sql
+func EnsureSchema(ctx context.Context, db *DB) error {
+	if _, ok := db.Dialect.(SQLite); !ok {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, sqliteSchema)
+	return err
+}
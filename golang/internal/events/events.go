@@ -0,0 +1,146 @@
+// Package events is an in-process bus for pipeline events, so metrics,
+// auditing and notifications can observe the pipeline without being part of it
+package events
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Event is emitted by the pipeline
+type Event interface {
+	// Name identifies the event type
+	Name() string
+}
+
+// TaskStarted is emitted when a task begins processing
+type TaskStarted struct {
+	VideoID int
+	// Labels are the task's labels
+	Labels map[string]string
+	At     time.Time
+}
+
+// StageCompleted is emitted after each pipeline stage succeeds. Rendition
+// is set for the stage encoding the output, to the rendition it encoded.
+type StageCompleted struct {
+	VideoID   int
+	Stage     string
+	Rendition string
+	Duration  time.Duration
+	At        time.Time
+}
+
+// TaskEstimated is emitted once the source duration is known, with the
+// expected processing time of the whole task and when it should finish
+type TaskEstimated struct {
+	VideoID        int
+	SourceDuration time.Duration
+	Estimate       time.Duration
+	ETA            time.Time
+	At             time.Time
+}
+
+// TaskFailed is emitted when a task stops with an error
+type TaskFailed struct {
+	VideoID int
+	Stage   string
+	Err     error
+	// Retryable tells whether the message will be retried
+	Retryable bool
+	At        time.Time
+}
+
+// TaskExpired is emitted when a task is picked up after its deadline and
+// skipped, e.g. because the user deleted the upload in the meantime
+type TaskExpired struct {
+	VideoID  int
+	Deadline time.Time
+	At       time.Time
+}
+
+// TaskSucceeded is emitted when every stage of a task succeeded.
+// SourceDuration is zero when the source wasn't probed.
+type TaskSucceeded struct {
+	VideoID        int
+	Mode           string
+	Profile        string
+	SourceDuration time.Duration
+	Duration       time.Duration
+	// Labels are the task's labels
+	Labels map[string]string
+	At     time.Time
+}
+
+// LiveStarted is emitted when a live stream starts being packaged, with
+// the storage prefix its manifest and segments are uploaded to
+type LiveStarted struct {
+	VideoID int
+	Prefix  string
+	At      time.Time
+}
+
+// LiveStopped is emitted when a live stream ends, with the error that
+// stopped it if the encoder didn't just disconnect
+type LiveStopped struct {
+	VideoID  int
+	Segments int
+	Duration time.Duration
+	Err      error
+	At       time.Time
+}
+
+func (TaskStarted) Name() string    { return "task_started" }
+func (StageCompleted) Name() string { return "stage_completed" }
+func (TaskEstimated) Name() string  { return "task_estimated" }
+func (TaskFailed) Name() string     { return "task_failed" }
+func (TaskExpired) Name() string    { return "task_expired" }
+func (TaskSucceeded) Name() string  { return "task_succeeded" }
+func (LiveStarted) Name() string    { return "live_started" }
+func (LiveStopped) Name() string    { return "live_stopped" }
+
+// Subscriber receives events; it runs on the publishing goroutine and
+// should hand slow work off
+type Subscriber func(Event)
+
+// Bus fans events out to its subscribers
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []Subscriber
+}
+
+// NewBus creates a new instance of Bus
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds a subscriber for every event
+func (b *Bus) Subscribe(s Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+}
+
+// Publish delivers the event to every subscriber; a panicking subscriber
+// is logged and doesn't affect the others or the pipeline
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	for _, s := range subscribers {
+		deliver(s, e)
+	}
+}
+
+func deliver(s Subscriber, e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Event subscriber panicked", slog.String("event", e.Name()), slog.Any("panic", r))
+		}
+	}()
+	s(e)
+}
@@ -0,0 +1,209 @@
+// Package fetch downloads conversion sources over FTP and SFTP, for
+// partners that deliver mezzanine files there rather than over HTTP
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// FTP fetches ftp:// sources with a plain FTP client: passive mode, binary
+// transfers and REST to resume. The URL's user and password log in,
+// anonymous when it has none; its path is relative to the login directory
+// unless it starts with %2F, as curl does.
+type FTP struct {
+	// Timeout bounds connecting, every command and every wait for data
+	// during the transfer, 30s when zero
+	Timeout time.Duration
+}
+
+// Open implements converter.Fetcher
+func (f FTP) Open(ctx context.Context, source *url.URL, offset int64, version string) (*converter.FetchedSource, error) {
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	host := source.Host
+	if source.Port() == "" {
+		host = net.JoinHostPort(source.Hostname(), "21")
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ftp server: %w", err)
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn), timeout: timeout}
+	fetched, err := c.open(ctx, source, offset, version)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return fetched, nil
+}
+
+// ftpConn is the control connection of an FTP session
+type ftpConn struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+}
+
+// cmd sends a command and reads its reply, which must have the expected
+// code; 5xx replies other than the expected one are permanent failures
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.reply(expect)
+}
+
+// reply reads a reply with the expected code
+func (c *ftpConn) reply(expect int) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	code, msg, err := c.text.ReadResponse(expect)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return code, msg, fmt.Errorf("%w: ftp %d %s", converter.ErrDownloadRejected, protoErr.Code, protoErr.Msg)
+	}
+	return code, msg, err
+}
+
+func (c *ftpConn) open(ctx context.Context, source *url.URL, offset int64, version string) (*converter.FetchedSource, error) {
+	if _, _, err := c.reply(220); err != nil {
+		return nil, err
+	}
+	user, password := "anonymous", "anonymous@"
+	if source.User != nil {
+		user = source.User.Username()
+		password, _ = source.User.Password()
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		if _, _, err := c.cmd(230, "PASS %s", password); err != nil {
+			return nil, err
+		}
+	} else if code != 230 {
+		return nil, fmt.Errorf("%w: ftp login refused with %d", converter.ErrDownloadRejected, code)
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	name := ftpPath(source)
+	fetched := &converter.FetchedSource{Size: -1}
+	// SIZE and MDTM are extensions; without them the source can't be resumed
+	if _, msg, err := c.cmd(213, "SIZE %s", name); err == nil {
+		fetched.Size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	}
+	if _, msg, err := c.cmd(213, "MDTM %s", name); err == nil && fetched.Size >= 0 {
+		fetched.Version = strings.TrimSpace(msg) + "/" + strconv.FormatInt(fetched.Size, 10)
+	}
+	if offset > 0 && version != "" && version == fetched.Version {
+		if _, _, err := c.cmd(350, "REST %d", offset); err == nil {
+			fetched.Offset = offset
+		}
+	}
+
+	data, err := c.passive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(1, "RETR %s", name); err != nil {
+		data.Close()
+		return nil, err
+	}
+	// The transfer can take long, the deadline only applies to commands
+	c.conn.SetDeadline(time.Time{})
+	fetched.Body = &ftpBody{data: data, c: c}
+	return fetched, nil
+}
+
+// passive opens a data connection, with EPSV or else PASV. The connection
+// goes to the control connection's host: the address in a PASV reply is
+// often a private one behind NAT.
+func (c *ftpConn) passive(ctx context.Context) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	var port int
+	if _, msg, err := c.cmd(229, "EPSV"); err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("malformed ftp epsv reply: %s", msg)
+		}
+		port, err = strconv.Atoi(msg[start+4 : end])
+		if err != nil {
+			return nil, fmt.Errorf("malformed ftp epsv reply: %s", msg)
+		}
+	} else {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("malformed ftp pasv reply: %s", msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed ftp pasv reply: %s", msg)
+		}
+		p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+		p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("malformed ftp pasv reply: %s", msg)
+		}
+		port = p1<<8 | p2
+	}
+	dialer := net.Dialer{Timeout: c.timeout}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func (c *ftpConn) close() {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.text.PrintfLine("QUIT")
+	c.text.Close()
+}
+
+// ftpBody is the data connection of a RETR; closing it checks the
+// transfer completed and ends the session
+type ftpBody struct {
+	data net.Conn
+	c    *ftpConn
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	// A stalled transfer fails like a command, so the download is retried
+	b.data.SetReadDeadline(time.Now().Add(b.c.timeout))
+	return b.data.Read(p)
+}
+
+func (b *ftpBody) Close() error {
+	b.data.Close()
+	defer b.c.close()
+	// 226 Transfer complete, or an error for a transfer cut short
+	_, _, err := b.c.reply(2)
+	return err
+}
+
+// ftpPath returns the path of the source as sent in FTP commands
+func ftpPath(source *url.URL) string {
+	name := strings.TrimPrefix(source.EscapedPath(), "/")
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
@@ -0,0 +1,431 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// SFTP fetches sftp:// sources through the sftp subsystem of the ssh
+// client, so known hosts, jump hosts and keys come from the ssh
+// configuration, as for the remote encode host. ssh runs in batch mode:
+// logins need a key. The URL's path is absolute, or relative to the home
+// directory when it starts with /~/, as curl does.
+type SFTP struct {
+	KeyFile string
+	// Timeout bounds connecting and every request, 30s when zero
+	Timeout time.Duration
+}
+
+// SFTP protocol version 3 packet types and status codes, see
+// draft-ietf-secsh-filexfer-02
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpRead    = 5
+	sftpFstat   = 8
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+	sftpAttrs   = 105
+
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+
+	sftpOpenRead   = 0x1
+	sftpAttrSize   = 0x1
+	sftpAttrUIDGID = 0x2
+	sftpAttrPerms  = 0x4
+	sftpAttrTimes  = 0x8
+)
+
+// sftpChunk is the size of a read, the largest every server accepts, and
+// sftpInflight how many reads are sent ahead so latency doesn't limit
+// the transfer
+const (
+	sftpChunk    = 32768
+	sftpInflight = 16
+)
+
+// Open implements converter.Fetcher
+func (f SFTP) Open(ctx context.Context, source *url.URL, offset int64, version string) (*converter.FetchedSource, error) {
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=" + strconv.Itoa(int(timeout.Seconds()))}
+	if port := source.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	if f.KeyFile != "" {
+		args = append(args, "-i", f.KeyFile)
+	}
+	host := source.Hostname()
+	if source.User != nil {
+		host = source.User.Username() + "@" + host
+	}
+	args = append(args, "-s", host, "sftp")
+
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s := &sftpSession{cmd: cmd, in: in, out: bufio.NewReader(out), timeout: timeout, stash: map[uint32]sftpReply{}}
+	cmd.Stderr = &s.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %w", err)
+	}
+	fetched, err := s.open(sftpPath(source), offset, version)
+	if err != nil {
+		s.close()
+		return nil, s.sshError(err)
+	}
+	return fetched, nil
+}
+
+// sftpPath returns the path of the source on the server
+func sftpPath(source *url.URL) string {
+	if rest, ok := strings.CutPrefix(source.Path, "/~/"); ok {
+		return rest
+	}
+	return source.Path
+}
+
+// sftpSession speaks SFTP over the stdin and stdout of ssh
+type sftpSession struct {
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	out     *bufio.Reader
+	stderr  bytes.Buffer
+	timeout time.Duration
+	lastID  uint32
+	// stash keeps replies read while waiting for another one
+	stash map[uint32]sftpReply
+}
+
+// sftpReply is a reply packet, without its request id
+type sftpReply struct {
+	typ  byte
+	data wire
+}
+
+func (s *sftpSession) open(path string, offset int64, version string) (*converter.FetchedSource, error) {
+	if err := s.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	typ, _, err := s.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion {
+		return nil, fmt.Errorf("sftp: unexpected packet %d instead of version", typ)
+	}
+
+	open := appendString(nil, path)
+	open = binary.BigEndian.AppendUint32(open, sftpOpenRead)
+	open = binary.BigEndian.AppendUint32(open, 0) // no attributes
+	reply, err := s.call(sftpOpen, open)
+	if err != nil {
+		return nil, err
+	}
+	if reply.typ != sftpHandle {
+		return nil, replyError(reply)
+	}
+	handle, ok := reply.data.string()
+	if !ok {
+		return nil, errors.New("sftp: malformed handle")
+	}
+
+	fetched := &converter.FetchedSource{Size: -1}
+	reply, err = s.call(sftpFstat, appendString(nil, handle))
+	if err != nil {
+		return nil, err
+	}
+	if reply.typ == sftpAttrs {
+		size, mtime, ok := parseAttrs(reply.data)
+		if ok && size >= 0 {
+			fetched.Size = size
+		}
+		if ok && size >= 0 && mtime >= 0 {
+			fetched.Version = strconv.FormatInt(mtime, 10) + "/" + strconv.FormatInt(size, 10)
+		}
+	}
+	if offset > 0 && version != "" && version == fetched.Version {
+		fetched.Offset = offset
+	}
+	fetched.Body = &sftpBody{s: s, handle: handle, next: fetched.Offset}
+	return fetched, nil
+}
+
+// send writes a packet
+func (s *sftpSession) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := s.in.Write(append(packet, payload...))
+	return err
+}
+
+// request sends a request and returns its id
+func (s *sftpSession) request(typ byte, payload []byte) (uint32, error) {
+	s.lastID++
+	id := s.lastID
+	return id, s.send(typ, append(binary.BigEndian.AppendUint32(nil, id), payload...))
+}
+
+// call sends a request and waits for its reply
+func (s *sftpSession) call(typ byte, payload []byte) (sftpReply, error) {
+	id, err := s.request(typ, payload)
+	if err != nil {
+		return sftpReply{}, err
+	}
+	return s.reply(id)
+}
+
+// reply returns the reply to the request, keeping the replies to other
+// requests read meanwhile
+func (s *sftpSession) reply(id uint32) (sftpReply, error) {
+	if reply, ok := s.stash[id]; ok {
+		delete(s.stash, id)
+		return reply, nil
+	}
+	for {
+		typ, data, err := s.readPacket()
+		if err != nil {
+			return sftpReply{}, err
+		}
+		got, ok := data.uint32()
+		if !ok {
+			return sftpReply{}, errors.New("sftp: malformed reply")
+		}
+		if got == id {
+			return sftpReply{typ: typ, data: data}, nil
+		}
+		s.stash[got] = sftpReply{typ: typ, data: data}
+	}
+}
+
+// readPacket reads a packet; ssh is killed when none comes in time
+func (s *sftpSession) readPacket() (byte, wire, error) {
+	timer := time.AfterFunc(s.timeout, func() { s.cmd.Process.Kill() })
+	defer timer.Stop()
+	var header [4]byte
+	if _, err := io.ReadFull(s.out, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(s.out, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], wire(packet[1:]), nil
+}
+
+// close ends the session, which closes the file on the server
+func (s *sftpSession) close() {
+	s.in.Close()
+	timer := time.AfterFunc(s.timeout, func() { s.cmd.Process.Kill() })
+	defer timer.Stop()
+	s.cmd.Wait()
+}
+
+// sshError adds what ssh reported to a failure of the session, e.g. a
+// refused key, which otherwise shows as an unexpected EOF
+func (s *sftpSession) sshError(err error) error {
+	if stderr := strings.TrimSpace(s.stderr.String()); stderr != "" {
+		return fmt.Errorf("%w: %s", err, stderr)
+	}
+	return err
+}
+
+// replyError turns an unexpected reply into an error; missing files and
+// denied access are permanent
+func replyError(reply sftpReply) error {
+	if reply.typ != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet %d", reply.typ)
+	}
+	code, _ := reply.data.uint32()
+	msg, _ := reply.data.string()
+	switch code {
+	case sftpStatusNoSuchFile, sftpStatusPermissionDenied:
+		return fmt.Errorf("%w: sftp: %s", converter.ErrDownloadRejected, msg)
+	}
+	return fmt.Errorf("sftp: %s (status %d)", msg, code)
+}
+
+// parseAttrs returns the size and modification time of file attributes,
+// -1 for those missing
+func parseAttrs(data wire) (size, mtime int64, ok bool) {
+	flags, ok := data.uint32()
+	if !ok {
+		return 0, 0, false
+	}
+	size, mtime = -1, -1
+	if flags&sftpAttrSize != 0 {
+		v, ok := data.uint64()
+		if !ok {
+			return 0, 0, false
+		}
+		size = int64(v)
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		data.uint32()
+		data.uint32()
+	}
+	if flags&sftpAttrPerms != 0 {
+		data.uint32()
+	}
+	if flags&sftpAttrTimes != 0 {
+		data.uint32() // atime
+		v, ok := data.uint32()
+		if !ok {
+			return 0, 0, false
+		}
+		mtime = int64(v)
+	}
+	return size, mtime, true
+}
+
+// sftpBody reads the file, keeping sftpInflight reads ahead
+type sftpBody struct {
+	s      *sftpSession
+	handle string
+	// next is the offset of the next read to send
+	next    int64
+	pending []pendingRead
+	buf     []byte
+	err     error
+}
+
+// pendingRead is a read sent and not answered yet
+type pendingRead struct {
+	id     uint32
+	offset int64
+}
+
+func (b *sftpBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.fill()
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// fill sends reads up to the window and waits for the oldest one
+func (b *sftpBody) fill() {
+	for len(b.pending) < sftpInflight {
+		read := appendString(nil, b.handle)
+		read = binary.BigEndian.AppendUint64(read, uint64(b.next))
+		read = binary.BigEndian.AppendUint32(read, sftpChunk)
+		id, err := b.s.request(sftpRead, read)
+		if err != nil {
+			b.err = b.s.sshError(err)
+			return
+		}
+		b.pending = append(b.pending, pendingRead{id: id, offset: b.next})
+		b.next += sftpChunk
+	}
+
+	head := b.pending[0]
+	b.pending = b.pending[1:]
+	reply, err := b.s.reply(head.id)
+	if err != nil {
+		b.err = b.s.sshError(err)
+		return
+	}
+	switch reply.typ {
+	case sftpData:
+		data, ok := reply.data.string()
+		if !ok {
+			b.err = errors.New("sftp: malformed data")
+			return
+		}
+		b.buf = []byte(data)
+		if len(data) < sftpChunk {
+			// A short read leaves a gap before the reads sent after it:
+			// drop them and carry on right after the data
+			for _, read := range b.pending {
+				if _, err := b.s.reply(read.id); err != nil {
+					b.err = b.s.sshError(err)
+					return
+				}
+			}
+			b.pending = nil
+			b.next = head.offset + int64(len(data))
+		}
+	case sftpStatus:
+		if code, _ := reply.data.uint32(); code == sftpStatusEOF {
+			b.err = io.EOF
+			return
+		}
+		b.err = replyError(reply)
+	default:
+		b.err = fmt.Errorf("sftp: unexpected packet %d", reply.typ)
+	}
+}
+
+func (b *sftpBody) Close() error {
+	b.s.close()
+	return nil
+}
+
+// wire reads the fields of a packet
+type wire []byte
+
+func (w *wire) uint32() (uint32, bool) {
+	if len(*w) < 4 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(*w)
+	*w = (*w)[4:]
+	return v, true
+}
+
+func (w *wire) uint64() (uint64, bool) {
+	if len(*w) < 8 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint64(*w)
+	*w = (*w)[8:]
+	return v, true
+}
+
+func (w *wire) string() (string, bool) {
+	n, ok := w.uint32()
+	if !ok || uint32(len(*w)) < n {
+		return "", false
+	}
+	s := string((*w)[:n])
+	*w = (*w)[n:]
+	return s, true
+}
+
+// appendString appends an SFTP string: its length and bytes
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,216 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// agentRunRequest asks the agent to run ffmpeg
+type agentRunRequest struct {
+	Args []string `json:"args"`
+}
+
+// agentProbeRequest asks the agent to probe a file
+type agentProbeRequest struct {
+	File string `json:"file"`
+}
+
+// agentResponse is the agent's answer to both requests. ExitCode is the
+// ffmpeg/ffprobe exit status, or -1 when it couldn't run or was killed.
+type agentResponse struct {
+	Output   []byte       `json:"output,omitempty"`
+	Probe    *ProbeResult `json:"probe,omitempty"`
+	ExitCode int          `json:"exit_code"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// NewAgent returns the HTTP handler of an encode agent, which runs ffmpeg
+// on this host for AgentRunner clients. Requests must carry the token as a
+// bearer token; it is required because callers choose the ffmpeg
+// arguments. Those can only name files below root, the PathMap.Remote of
+// the clients, which should be the agent's working directory so relative
+// paths resolve below it too.
+func NewAgent(runner Runner, token, root string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /run", func(w http.ResponseWriter, r *http.Request) {
+		var req agentRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkAgentArgs(root, req.Args); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		output, err := runner.Run(r.Context(), req.Args...)
+		writeAgentResponse(w, agentResponse{Output: output}, err)
+	})
+	mux.HandleFunc("POST /probe", func(w http.ResponseWriter, r *http.Request) {
+		var req agentProbeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkAgentArgs(root, []string{"-i", req.File}); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		probe, err := runner.Probe(r.Context(), req.File)
+		writeAgentResponse(w, agentResponse{Probe: probe}, err)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// urlScheme matches an argument naming an ffmpeg protocol, e.g. file:,
+// pipe: or http:, which could reach outside the agent's root
+var urlScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]+:`)
+
+// checkAgentArgs rejects ffmpeg arguments naming files outside root:
+// inputs must be absolute paths below it, and no argument may hold an
+// absolute path outside it, a parent directory reference or a protocol,
+// including the paths filters like movie or subtitles take as options
+func checkAgentArgs(root string, args []string) error {
+	root = filepath.Clean(root)
+	for i, arg := range args {
+		if i > 0 && args[i-1] == "-i" && !filepath.IsAbs(arg) {
+			return fmt.Errorf("input %q isn't an absolute path", arg)
+		}
+		if urlScheme.MatchString(arg) {
+			return fmt.Errorf("argument %q names a protocol", arg)
+		}
+		for _, part := range strings.FieldsFunc(arg, isPathDelimiter) {
+			if part == ".." || strings.HasPrefix(part, "../") || strings.Contains(part, "/../") || strings.HasSuffix(part, "/..") {
+				return fmt.Errorf("argument %q refers to a parent directory", arg)
+			}
+			if strings.HasPrefix(part, "/") && !withinRoot(root, part) {
+				return fmt.Errorf("path %q is outside %s", part, root)
+			}
+		}
+	}
+	return nil
+}
+
+// isPathDelimiter separates the paths within an argument, like the option
+// values of a filter graph
+func isPathDelimiter(r rune) bool {
+	return strings.ContainsRune("=:,;'\"[] ", r)
+}
+
+// withinRoot reports whether the absolute path is root or below it
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// writeAgentResponse fills in the exit status of err and writes the response
+func writeAgentResponse(w http.ResponseWriter, resp agentResponse, err error) {
+	if err != nil {
+		resp.Error = err.Error()
+		resp.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			resp.ExitCode = exitErr.ExitCode()
+		} else if errors.Is(err, ErrInvalidInput) {
+			resp.ExitCode = 1
+		}
+		slog.Warn("ffmpeg failed on agent", slog.Int("exit_code", resp.ExitCode), slog.String("error", err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// AgentRunner runs ffmpeg and ffprobe on a remote encode agent, see
+// NewAgent. The media must be reachable from the agent, see PathMap.
+type AgentRunner struct {
+	URL    string
+	Token  string
+	Paths  PathMap
+	Client *http.Client // http.DefaultClient when nil; encodes can take hours, so no timeout
+}
+
+// Run implements Runner
+func (r AgentRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	resp, err := r.call(ctx, "/run", agentRunRequest{Args: r.Paths.toRemote(args)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Output, resp.err("ffmpeg")
+}
+
+// Probe implements Runner
+func (r AgentRunner) Probe(ctx context.Context, file string) (*ProbeResult, error) {
+	resp, err := r.call(ctx, "/probe", agentProbeRequest{File: r.Paths.toRemote([]string{file})[0]})
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.err("ffprobe"); err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	return resp.Probe, nil
+}
+
+// err rebuilds the error of a failed run. A non-zero exit status means the
+// binary rejected the media, like an exited local ffmpeg, anything else is
+// reported as is so it is retried.
+func (resp agentResponse) err(bin string) error {
+	switch {
+	case resp.ExitCode > 0:
+		return fmt.Errorf("%w: remote %s exited with status %d: %s", ErrInvalidInput, bin, resp.ExitCode, resp.Error)
+	case resp.Error != "":
+		return fmt.Errorf("remote %s failed: %s", bin, resp.Error)
+	}
+	return nil
+}
+
+// call posts a request to the agent and decodes its response
+func (r AgentRunner) call(ctx context.Context, path string, in interface{}) (*agentResponse, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(r.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach encode agent: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return nil, fmt.Errorf("encode agent returned %s: %s", httpResp.Status, bytes.TrimSpace(data))
+	}
+
+	var resp agentResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode encode agent response: %w", err)
+	}
+	return &resp, nil
+}
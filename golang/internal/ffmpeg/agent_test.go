@@ -0,0 +1,82 @@
+package ffmpeg
+
+import "testing"
+
+func TestCheckAgentArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{
+			name: "media below the root",
+			args: []string{"-y", "-i", "/mnt/media/1/merged.mp4", "-vf", "scale=-2:720,fps=1/5", "-f", "dash", "/mnt/media/1/output.mpd"},
+		},
+		{
+			name: "relative output resolves below the root",
+			args: []string{"-i", "/mnt/media/1/merged.mp4", "output.mpd"},
+		},
+		{
+			name: "the root itself",
+			args: []string{"-i", "/mnt/media"},
+		},
+		{
+			name:    "relative input",
+			args:    []string{"-i", "merged.mp4", "/mnt/media/1/output.mpd"},
+			wantErr: true,
+		},
+		{
+			name:    "input outside the root",
+			args:    []string{"-i", "/etc/passwd", "/mnt/media/1/output.mp4"},
+			wantErr: true,
+		},
+		{
+			name:    "output outside the root",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "/etc/cron.d/job"},
+			wantErr: true,
+		},
+		{
+			name:    "sibling sharing the root's prefix",
+			args:    []string{"-i", "/mnt/media-other/merged.mp4"},
+			wantErr: true,
+		},
+		{
+			name:    "parent directory reference",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "/mnt/media/../../etc/job"},
+			wantErr: true,
+		},
+		{
+			name:    "relative parent directory reference",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "../job"},
+			wantErr: true,
+		},
+		{
+			name:    "protocol input",
+			args:    []string{"-i", "file:/etc/passwd", "/mnt/media/1/output.mp4"},
+			wantErr: true,
+		},
+		{
+			name:    "protocol output",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "-f", "mpegts", "tcp://example.com:9000"},
+			wantErr: true,
+		},
+		{
+			name:    "filter reading a file outside the root",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "-vf", "subtitles=/etc/passwd", "/mnt/media/1/output.mp4"},
+			wantErr: true,
+		},
+		{
+			name:    "segment names outside the root",
+			args:    []string{"-i", "/mnt/media/1/merged.mp4", "-hls_segment_filename", "/tmp/%d.ts", "/mnt/media/1/index.m3u8"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAgentArgs("/mnt/media/", tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAgentArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
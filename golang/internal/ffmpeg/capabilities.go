@@ -0,0 +1,165 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultMinVersion is the oldest ffmpeg release the converter is tested with
+const DefaultMinVersion = "4.4"
+
+// Capabilities describes the ffmpeg installation found at startup
+type Capabilities struct {
+	FFmpegPath  string
+	FFprobePath string
+	Version     string
+	Encoders    []string
+}
+
+// HasEncoder reports whether ffmpeg was built with the encoder
+func (c *Capabilities) HasEncoder(name string) bool {
+	return slices.Contains(c.Encoders, name)
+}
+
+// Runner returns an ExecRunner using the discovered binaries
+func (c *Capabilities) Runner() ExecRunner {
+	return ExecRunner{FFmpegPath: c.FFmpegPath, FFprobePath: c.FFprobePath}
+}
+
+// Report logs the capabilities, highlighting the encoders the converter cares about
+func (c *Capabilities) Report(interesting ...string) {
+	attrs := []any{
+		slog.String("ffmpeg", c.FFmpegPath),
+		slog.String("ffprobe", c.FFprobePath),
+		slog.String("version", c.Version),
+		slog.Int("encoders", len(c.Encoders)),
+	}
+	for _, name := range interesting {
+		attrs = append(attrs, slog.Bool(name, c.HasEncoder(name)))
+	}
+	slog.Info("ffmpeg capabilities", attrs...)
+}
+
+// Discover locates ffmpeg and ffprobe (in PATH when the paths are empty),
+// checks that ffmpeg is at least minVersion and lists its encoders
+func Discover(ctx context.Context, ffmpegPath, ffprobePath, minVersion string) (*Capabilities, error) {
+	var err error
+	caps := &Capabilities{}
+	if caps.FFmpegPath, err = exec.LookPath(orDefault(ffmpegPath, "ffmpeg")); err != nil {
+		return nil, fmt.Errorf("ffmpeg not found: %w", err)
+	}
+	if caps.FFprobePath, err = exec.LookPath(orDefault(ffprobePath, "ffprobe")); err != nil {
+		return nil, fmt.Errorf("ffprobe not found: %w", err)
+	}
+
+	run := func(args ...string) ([]byte, error) {
+		return exec.CommandContext(ctx, caps.FFmpegPath, args...).Output()
+	}
+	if err := caps.inspect(run, minVersion); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// DiscoverRemote checks the ffmpeg behind a remote runner, such as an SSH
+// host or an agent, the same way Discover checks the local one
+func DiscoverRemote(ctx context.Context, runner Runner, minVersion string) (*Capabilities, error) {
+	caps := &Capabilities{FFmpegPath: "remote", FFprobePath: "remote"}
+	run := func(args ...string) ([]byte, error) {
+		return runner.Run(ctx, args...)
+	}
+	if err := caps.inspect(run, minVersion); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+// inspect reads the version and encoders of ffmpeg through run, failing
+// when the version is older than minVersion
+func (c *Capabilities) inspect(run func(args ...string) ([]byte, error), minVersion string) error {
+	out, err := run("-version")
+	if err != nil {
+		return fmt.Errorf("failed to run ffmpeg -version: %w", err)
+	}
+	c.Version = parseVersion(out)
+	if minVersion != "" {
+		ok, comparable := versionAtLeast(c.Version, minVersion)
+		if !comparable {
+			// Git snapshots report a commit instead of a release number
+			slog.Warn("Unable to compare ffmpeg version", slog.String("version", c.Version), slog.String("min_version", minVersion))
+		} else if !ok {
+			return fmt.Errorf("ffmpeg %s is older than the required %s", c.Version, minVersion)
+		}
+	}
+
+	out, err = run("-hide_banner", "-encoders")
+	if err != nil {
+		return fmt.Errorf("failed to list ffmpeg encoders: %w", err)
+	}
+	c.Encoders = parseEncoders(out)
+	return nil
+}
+
+// parseVersion extracts the version from the first line of ffmpeg -version,
+// e.g. "ffmpeg version 6.1.1-3ubuntu5 Copyright ..."
+func parseVersion(out []byte) string {
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(line))
+	for i, f := range fields {
+		if f == "version" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+var releaseVersion = regexp.MustCompile(`^n?(\d+)(?:\.(\d+))?(?:\.(\d+))?`)
+
+// versionAtLeast compares release versions; comparable is false for
+// versions that aren't releases, like git snapshots
+func versionAtLeast(version, min string) (ok, comparable bool) {
+	v := releaseVersion.FindStringSubmatch(version)
+	m := releaseVersion.FindStringSubmatch(min)
+	if v == nil || m == nil {
+		return false, false
+	}
+	for i := 1; i <= 3; i++ {
+		a, _ := strconv.Atoi(v[i])
+		b, _ := strconv.Atoi(m[i])
+		if a != b {
+			return a > b, true
+		}
+	}
+	return true, true
+}
+
+// parseEncoders reads the encoder names from ffmpeg -encoders, whose
+// entries look like " V....D libx264   libx264 H.264 / AVC ..."
+func parseEncoders(out []byte) []string {
+	var encoders []string
+	listing := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "------" {
+			listing = true
+			continue
+		}
+		if !listing {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 {
+			encoders = append(encoders, fields[1])
+		}
+	}
+	return encoders
+}
@@ -0,0 +1,130 @@
+package ffmpeg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Command is an ffmpeg invocation built from typed options rather than
+// assembled by hand, so options land in the right place relative to the
+// files they apply to. Args returns the arguments for a Runner and String
+// the command line to log or reproduce it.
+type Command struct {
+	// Overwrite replaces existing output files, -y
+	Overwrite bool
+	Inputs    []Input
+	Outputs   []Output
+}
+
+// Input is a file ffmpeg reads, with the options applying to it
+type Input struct {
+	// Format forces the demuxer, -f
+	Format string
+	// Seek starts reading at this many seconds, -ss, fast and keyframe
+	// accurate; zero reads from the start
+	Seek float64
+	// Options are other input options, such as "-framerate", "25", in order
+	Options []string
+	File    string
+}
+
+// Output is a file ffmpeg writes, with the options applying to it
+type Output struct {
+	// Maps select the streams written, -map, such as "0:v:0" or "0:a?"
+	Maps []string
+	// NoVideo and NoAudio drop the video and audio streams, -vn and -an
+	NoVideo bool
+	NoAudio bool
+	// Codec applies to every stream, -c, VideoCodec and AudioCodec to
+	// those of their kind, -c:v and -c:a
+	Codec      string
+	VideoCodec string
+	AudioCodec string
+	// VideoFilters and AudioFilters are chained into -vf and -af
+	VideoFilters []string
+	AudioFilters []string
+	// Frames stops after this many video frames, -frames:v
+	Frames int
+	// Options are other output options, such as "-crf", "23", in order
+	Options []string
+	// Format forces the muxer, -f
+	Format string
+	File   string
+}
+
+// Args returns the command's arguments, without the ffmpeg binary
+func (c Command) Args() []string {
+	var args []string
+	if c.Overwrite {
+		args = append(args, "-y")
+	}
+	for _, in := range c.Inputs {
+		args = append(args, in.args()...)
+	}
+	for _, out := range c.Outputs {
+		args = append(args, out.args()...)
+	}
+	return args
+}
+
+// String returns the command line, quoted for a POSIX shell
+func (c Command) String() string {
+	return CommandLine(c.Args())
+}
+
+func (in Input) args() []string {
+	var args []string
+	if in.Format != "" {
+		args = append(args, "-f", in.Format)
+	}
+	if in.Seek > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(in.Seek, 'f', -1, 64))
+	}
+	args = append(args, in.Options...)
+	return append(args, "-i", in.File)
+}
+
+func (out Output) args() []string {
+	var args []string
+	for _, m := range out.Maps {
+		args = append(args, "-map", m)
+	}
+	if out.NoVideo {
+		args = append(args, "-vn")
+	}
+	if out.NoAudio {
+		args = append(args, "-an")
+	}
+	for _, codec := range []struct{ flag, name string }{{"-c", out.Codec}, {"-c:v", out.VideoCodec}, {"-c:a", out.AudioCodec}} {
+		if codec.name != "" {
+			args = append(args, codec.flag, codec.name)
+		}
+	}
+	if len(out.VideoFilters) > 0 {
+		args = append(args, "-vf", strings.Join(out.VideoFilters, ","))
+	}
+	if len(out.AudioFilters) > 0 {
+		args = append(args, "-af", strings.Join(out.AudioFilters, ","))
+	}
+	if out.Frames > 0 {
+		args = append(args, "-frames:v", strconv.Itoa(out.Frames))
+	}
+	args = append(args, out.Options...)
+	if out.Format != "" {
+		args = append(args, "-f", out.Format)
+	}
+	return append(args, out.File)
+}
+
+// CommandLine returns the ffmpeg command line running args, quoted for a
+// POSIX shell so it can be pasted to reproduce the run
+func CommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t'\"$|*?()<>&;\\") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return "ffmpeg " + strings.Join(quoted, " ")
+}
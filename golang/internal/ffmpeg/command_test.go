@@ -0,0 +1,100 @@
+package ffmpeg
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		want []string
+	}{
+		{
+			name: "empty output options",
+			cmd: Command{
+				Inputs:  []Input{{File: "in.mp4"}},
+				Outputs: []Output{{File: "out.mp4"}},
+			},
+			want: []string{"-i", "in.mp4", "out.mp4"},
+		},
+		{
+			name: "input options before the input",
+			cmd: Command{
+				Overwrite: true,
+				Inputs:    []Input{{Format: "image2", Seek: 1.5, Options: []string{"-framerate", "25"}, File: "%08d.png"}},
+				Outputs:   []Output{{File: "out.mp4"}},
+			},
+			want: []string{"-y", "-f", "image2", "-ss", "1.5", "-framerate", "25", "-i", "%08d.png", "out.mp4"},
+		},
+		{
+			name: "output options in a fixed order",
+			cmd: Command{
+				Overwrite: true,
+				Inputs:    []Input{{File: "in.mkv"}},
+				Outputs: []Output{{
+					Maps:         []string{"0:v:0", "0:a?"},
+					NoAudio:      true,
+					VideoCodec:   "libx264",
+					AudioCodec:   "aac",
+					VideoFilters: []string{"fps=30", "scale=-2:'min(720,ih)'"},
+					AudioFilters: []string{"loudnorm"},
+					Frames:       1,
+					Options:      []string{"-crf", "23"},
+					Format:       "mp4",
+					File:         "out.mp4",
+				}},
+			},
+			want: []string{"-y", "-i", "in.mkv",
+				"-map", "0:v:0", "-map", "0:a?", "-an",
+				"-c:v", "libx264", "-c:a", "aac",
+				"-vf", "fps=30,scale=-2:'min(720,ih)'", "-af", "loudnorm",
+				"-frames:v", "1", "-crf", "23", "-f", "mp4", "out.mp4"},
+		},
+		{
+			name: "stream copy to a null output",
+			cmd: Command{
+				Inputs:  []Input{{File: "in.ts"}},
+				Outputs: []Output{{NoVideo: true, Codec: "copy", Format: "null", File: "-"}},
+			},
+			want: []string{"-i", "in.ts", "-vn", "-c", "copy", "-f", "null", "-"},
+		},
+		{
+			name: "several inputs and outputs",
+			cmd: Command{
+				Inputs:  []Input{{File: "a.mp4"}, {File: "b.wav"}},
+				Outputs: []Output{{Maps: []string{"0:v", "1:a"}, File: "ab.mp4"}, {Maps: []string{"1:a"}, File: "b.mp3"}},
+			},
+			want: []string{"-i", "a.mp4", "-i", "b.wav", "-map", "0:v", "-map", "1:a", "ab.mp4", "-map", "1:a", "b.mp3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cmd.Args(); !slices.Equal(got, tt.want) {
+				t.Errorf("Args() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"plain", []string{"-i", "in.mp4", "out.mp4"}, "ffmpeg -i in.mp4 out.mp4"},
+		{"spaces", []string{"-i", "my video.mp4"}, "ffmpeg -i 'my video.mp4'"},
+		{"filter quotes", []string{"-vf", "scale=-2:'min(720,ih)'"}, `ffmpeg -vf 'scale=-2:'\''min(720,ih)'\'''`},
+		{"empty", []string{"-metadata", ""}, "ffmpeg -metadata ''"},
+		{"pattern", []string{"-i", "%08d.png"}, "ffmpeg -i %08d.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandLine(tt.args); got != tt.want {
+				t.Errorf("CommandLine() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
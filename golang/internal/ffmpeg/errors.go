@@ -0,0 +1,133 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Failures recognized in the output of ffmpeg and ffprobe, see ParseError
+var (
+	ErrMoovAtomNotFound = errors.New("moov atom not found")
+	ErrInvalidData      = errors.New("invalid data found when processing input")
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrUnknownEncoder   = errors.New("unknown encoder")
+	ErrMissingFile      = errors.New("no such file or directory")
+	ErrPermission       = errors.New("permission denied")
+	// ErrNoSpace is the one failure that isn't the media's fault: the task
+	// can succeed once disk space is freed
+	ErrNoSpace = errors.New("no space left on device")
+)
+
+// diagnosis maps output lines matching its pattern to a failure
+type diagnosis struct {
+	code    string
+	kind    error
+	pattern *regexp.Regexp
+	hint    string
+}
+
+// diagnoses are matched in order, so the more specific failures come
+// first: a truncated MP4 also reports invalid data
+var diagnoses = []diagnosis{
+	{
+		code:    "moov_atom_not_found",
+		kind:    ErrMoovAtomNotFound,
+		pattern: regexp.MustCompile(`(?i)moov atom not found`),
+		hint:    "The MP4 source is truncated or was never finalized; re-upload the complete file, or remux it with -movflags +faststart before uploading.",
+	},
+	{
+		code:    "no_space",
+		kind:    ErrNoSpace,
+		pattern: regexp.MustCompile(`(?i)no space left on device`),
+		hint:    "The worker's disk is full; free space under the upload root, the task is retried.",
+	},
+	{
+		code:    "unknown_encoder",
+		kind:    ErrUnknownEncoder,
+		pattern: regexp.MustCompile(`(?i)unknown encoder|encoder \(codec .*\) not found`),
+		hint:    "The profile asks for an encoder this ffmpeg build lacks; pick another profile or install an ffmpeg build with the encoder.",
+	},
+	{
+		code: "unsupported_codec",
+		kind: ErrUnsupportedCodec,
+		pattern: regexp.MustCompile(`(?i)unsupported codec|decoder \(codec .*\) not found|` +
+			`not currently supported in container|could not find codec parameters`),
+		hint: "A stream of the source uses a codec ffmpeg can't decode or put in the output; re-encode the source to H.264/AAC before uploading.",
+	},
+	{
+		code:    "invalid_data",
+		kind:    ErrInvalidData,
+		pattern: regexp.MustCompile(`(?i)invalid data found when processing input`),
+		hint:    "The source is corrupt or isn't a media file; check that every chunk was uploaded, in order, and that the upload is a supported format.",
+	},
+	{
+		code:    "missing_file",
+		kind:    ErrMissingFile,
+		pattern: regexp.MustCompile(`(?i)no such file or directory`),
+		hint:    "An input file is missing; the upload may have been cleaned up before the task ran, or the task's path is wrong.",
+	},
+	{
+		code:    "permission_denied",
+		kind:    ErrPermission,
+		pattern: regexp.MustCompile(`(?i)permission denied`),
+		hint:    "The worker can't read the source or write the output; check the ownership of the task's folder.",
+	},
+}
+
+// Error is a failure of ffmpeg or ffprobe recognized in their output
+type Error struct {
+	// Code names the failure in the error log, e.g. "moov_atom_not_found"
+	Code string
+	// Hint tells an operator what to do about it
+	Hint string
+	// Line is the output line the failure was recognized in
+	Line string
+	// Err is the error of running the binary
+	Err  error
+	kind error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Line)
+}
+
+// Unwrap returns the failure, such as ErrMoovAtomNotFound, and the error of
+// running the binary
+func (e *Error) Unwrap() []error {
+	return []error{e.kind, e.Err}
+}
+
+// tailLines is how many output lines are kept for unrecognized failures
+const tailLines = 5
+
+// ParseError turns a failed run and its output into an *Error when the
+// output shows a known failure. Otherwise err is returned with the last
+// lines of output, where ffmpeg reports what went wrong; the progress and
+// stream listing before them are left out.
+func ParseError(err error, output []byte) error {
+	if err == nil {
+		return nil
+	}
+	// Progress updates end in carriage returns rather than newlines
+	lines := strings.FieldsFunc(string(output), func(r rune) bool { return r == '\n' || r == '\r' })
+	for _, d := range diagnoses {
+		for _, line := range lines {
+			if d.pattern.MatchString(line) {
+				return &Error{Code: d.code, Hint: d.hint, Line: strings.TrimSpace(line), Err: err, kind: d.kind}
+			}
+		}
+	}
+
+	var tail []string
+	for i := len(lines) - 1; i >= 0 && len(tail) < tailLines; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			tail = append([]string{line}, tail...)
+		}
+	}
+	if len(tail) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, strings.Join(tail, "; "))
+}
@@ -0,0 +1,223 @@
+package ffmpeg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Stream is a single stream reported by ffprobe
+type Stream struct {
+	Index     int               `json:"index"`
+	CodecType string            `json:"codec_type"`
+	CodecName string            `json:"codec_name"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	PixFmt    string            `json:"pix_fmt"`
+	Tags      map[string]string `json:"tags"`
+	// Color properties, empty when the stream doesn't signal them
+	ColorSpace     string `json:"color_space,omitempty"`
+	ColorTransfer  string `json:"color_transfer,omitempty"`
+	ColorPrimaries string `json:"color_primaries,omitempty"`
+	// RFrameRate is the base frame rate and AvgFrameRate the average one,
+	// as rationals like "30000/1001"; they differ for variable frame rates
+	RFrameRate   string `json:"r_frame_rate,omitempty"`
+	AvgFrameRate string `json:"avg_frame_rate,omitempty"`
+	// SampleAspectRatio is the shape of a pixel and DisplayAspectRatio
+	// that of the frame, as ratios like "16:15"; anamorphic sources, such
+	// as DV and broadcast SD, have pixels that aren't square
+	SampleAspectRatio  string `json:"sample_aspect_ratio,omitempty"`
+	DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
+	// SideData carries the display matrix of phone videos, whose frames
+	// are stored sideways with a rotation to apply on playback
+	SideData []SideData `json:"side_data_list,omitempty"`
+}
+
+// SideData is a side data entry of a stream
+type SideData struct {
+	Type     string `json:"side_data_type"`
+	Rotation int    `json:"rotation,omitempty"`
+}
+
+// Rotation returns the degrees the stream is rotated by on playback, from
+// its display matrix or, for older ffprobe builds, its rotate tag
+func (s *Stream) Rotation() int {
+	for _, sd := range s.SideData {
+		if sd.Rotation != 0 {
+			return sd.Rotation
+		}
+	}
+	rotation, _ := strconv.Atoi(s.Tags["rotate"])
+	return rotation
+}
+
+// DisplaySize returns the size the stream is shown at: square pixels at
+// its sample aspect ratio, turned by its rotation, as ffmpeg outputs it
+func (s *Stream) DisplaySize() (width, height int) {
+	width, height = int(float64(s.Width)*s.PixelAspect()+0.5), s.Height
+	if rotation := (s.Rotation()%180 + 180) % 180; rotation == 90 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// PixelAspect returns the sample aspect ratio of the stream, 1 for square
+// pixels or when it's unknown
+func (s *Stream) PixelAspect() float64 {
+	if sar := ParseRational(strings.Replace(s.SampleAspectRatio, ":", "/", 1)); sar > 0 {
+		return sar
+	}
+	return 1
+}
+
+// FrameRate returns the average frame rate of the stream, or its base one
+// when the average is unknown, zero when neither is
+func (s *Stream) FrameRate() float64 {
+	if rate := ParseRational(s.AvgFrameRate); rate > 0 {
+		return rate
+	}
+	return ParseRational(s.RFrameRate)
+}
+
+// ParseRational parses an ffprobe rational such as "24000/1001", zero
+// when it's missing or "0/0"
+func ParseRational(r string) float64 {
+	num, den, ok := strings.Cut(r, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// Format is the container information reported by ffprobe
+type Format struct {
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	StartTime  string            `json:"start_time"`
+	Size       string            `json:"size"`
+	BitRate    string            `json:"bit_rate"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// ProbeResult is the parsed output of ffprobe
+type ProbeResult struct {
+	Format  Format   `json:"format"`
+	Streams []Stream `json:"streams"`
+}
+
+// Probe runs ffprobe from PATH on the file and parses its JSON output
+func Probe(ctx context.Context, file string) (*ProbeResult, error) {
+	return probe(ctx, "ffprobe", file)
+}
+
+func probe(ctx context.Context, ffprobePath, file string, files ...*os.File) (*ProbeResult, error) {
+	cmd := exec.CommandContext(ctx, ffprobePath, probeArgs(file)...)
+	cmd.ExtraFiles = files
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("ffprobe failed: %w", ParseError(err, exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+	return parseProbe(output)
+}
+
+// probeArgs are the ffprobe arguments that describe file as JSON
+func probeArgs(file string) []string {
+	return []string{
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		file,
+	}
+}
+
+// parseProbe decodes the JSON written by ffprobe
+func parseProbe(output []byte) (*ProbeResult, error) {
+	var result ProbeResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+	return &result, nil
+}
+
+// VideoStream returns the first video stream, if any
+func (p *ProbeResult) VideoStream() *Stream {
+	return p.firstStream("video")
+}
+
+// AudioStream returns the first audio stream, if any
+func (p *ProbeResult) AudioStream() *Stream {
+	return p.firstStream("audio")
+}
+
+func (p *ProbeResult) firstStream(codecType string) *Stream {
+	for i := range p.Streams {
+		// Cover art is reported as a video stream; skip attached pictures
+		if p.Streams[i].CodecType == codecType && p.Streams[i].CodecName != "mjpeg" && p.Streams[i].CodecName != "png" {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// DurationSeconds returns the container duration, or zero when unknown
+func (p *ProbeResult) DurationSeconds() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// StartSeconds returns the timestamp the container starts at, which
+// ffmpeg shifts outputs back to zero by, or zero when unknown
+func (p *ProbeResult) StartSeconds() float64 {
+	start, _ := strconv.ParseFloat(p.Format.StartTime, 64)
+	return start
+}
+
+// Container returns the short container name of the probed file: mp4, mov,
+// mkv, webm, avi, or ffprobe's own name for anything else
+func (p *ProbeResult) Container() string {
+	names := strings.Split(p.Format.FormatName, ",")
+	switch {
+	case slices.Contains(names, "mp4") || slices.Contains(names, "mov"):
+		if strings.TrimSpace(p.Format.Tags["major_brand"]) == "qt" {
+			return "mov"
+		}
+		return "mp4"
+	case slices.Contains(names, "matroska") || slices.Contains(names, "webm"):
+		if p.isWebM() {
+			return "webm"
+		}
+		return "mkv"
+	case slices.Contains(names, "avi"):
+		return "avi"
+	}
+	return names[0]
+}
+
+// isWebM reports whether every stream uses a codec allowed in WebM
+func (p *ProbeResult) isWebM() bool {
+	for _, s := range p.Streams {
+		switch s.CodecName {
+		case "vp8", "vp9", "av1", "opus", "vorbis":
+		default:
+			return false
+		}
+	}
+	return len(p.Streams) > 0
+}
@@ -0,0 +1,89 @@
+package ffmpeg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// ErrInvalidInput is returned by runners when ffmpeg rejects the media itself,
+// so retrying can't help
+var ErrInvalidInput = errors.New("ffmpeg rejected the input")
+
+// Runner runs ffmpeg and ffprobe; tests replace it with a fake
+type Runner interface {
+	// Run runs ffmpeg with args and returns its combined output
+	Run(ctx context.Context, args ...string) ([]byte, error)
+	// Probe describes a media file
+	Probe(ctx context.Context, file string) (*ProbeResult, error)
+}
+
+// Streamer is implemented by runners that can hand ffmpeg's output over
+// while it runs, so long encodes can be followed live
+type Streamer interface {
+	// Stream runs ffmpeg with args, writing its combined output to w
+	Stream(ctx context.Context, w io.Writer, args ...string) error
+}
+
+// FileRunner is a Runner that can hand ffmpeg and ffprobe open files,
+// which they read at FilePath, so an input needn't have a path other users
+// of the host can open
+type FileRunner interface {
+	Runner
+	// RunFiles runs ffmpeg with args and files open in it
+	RunFiles(ctx context.Context, files []*os.File, args ...string) ([]byte, error)
+	// ProbeFile describes the media of an open file
+	ProbeFile(ctx context.Context, file *os.File) (*ProbeResult, error)
+}
+
+// FilePath is the path ffmpeg opens the i-th file handed to RunFiles at
+func FilePath(i int) string {
+	return "/dev/fd/" + strconv.Itoa(3+i)
+}
+
+// ExecRunner runs the ffmpeg and ffprobe binaries, from PATH unless the
+// paths are set
+type ExecRunner struct {
+	FFmpegPath  string
+	FFprobePath string
+}
+
+// Run implements Runner
+func (r ExecRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, orDefault(r.FFmpegPath, "ffmpeg"), args...).CombinedOutput()
+}
+
+// Stream implements Streamer
+func (r ExecRunner) Stream(ctx context.Context, w io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, orDefault(r.FFmpegPath, "ffmpeg"), args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd.Run()
+}
+
+// RunFiles implements FileRunner
+func (r ExecRunner) RunFiles(ctx context.Context, files []*os.File, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, orDefault(r.FFmpegPath, "ffmpeg"), args...)
+	cmd.ExtraFiles = files
+	return cmd.CombinedOutput()
+}
+
+// Probe implements Runner
+func (r ExecRunner) Probe(ctx context.Context, file string) (*ProbeResult, error) {
+	return probe(ctx, orDefault(r.FFprobePath, "ffprobe"), file)
+}
+
+// ProbeFile implements FileRunner
+func (r ExecRunner) ProbeFile(ctx context.Context, file *os.File) (*ProbeResult, error) {
+	return probe(ctx, orDefault(r.FFprobePath, "ffprobe"), FilePath(0), file)
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
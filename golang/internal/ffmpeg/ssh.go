@@ -0,0 +1,110 @@
+package ffmpeg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PathMap translates local paths to where the same files are mounted on a
+// remote encode host, e.g. a shared volume at /media locally and /mnt/media
+// remotely. The zero value leaves paths unchanged.
+type PathMap struct {
+	Local  string
+	Remote string
+}
+
+// toRemote rewrites the arguments that are paths below Local
+func (m PathMap) toRemote(args []string) []string {
+	if m.Local == "" || m.Local == m.Remote {
+		return args
+	}
+	local := strings.TrimSuffix(m.Local, "/")
+	remote := strings.TrimSuffix(m.Remote, "/")
+	mapped := make([]string, len(args))
+	for i, arg := range args {
+		if arg == local || strings.HasPrefix(arg, local+"/") {
+			arg = remote + strings.TrimPrefix(arg, local)
+		}
+		mapped[i] = arg
+	}
+	return mapped
+}
+
+// SSHRunner runs ffmpeg and ffprobe on a remote host over ssh, so the
+// consumer can run on small nodes while encoding happens on a large one.
+// The media must be reachable from the host, see PathMap.
+type SSHRunner struct {
+	Host        string // [user@]host
+	Port        int
+	KeyFile     string
+	FFmpegPath  string // on the remote host, ffmpeg from its PATH when empty
+	FFprobePath string // on the remote host, ffprobe from its PATH when empty
+	Paths       PathMap
+}
+
+// Run implements Runner
+func (r SSHRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	output, err := r.command(ctx, orDefault(r.FFmpegPath, "ffmpeg"), args).CombinedOutput()
+	return output, sshError(err)
+}
+
+// Stream implements Streamer
+func (r SSHRunner) Stream(ctx context.Context, w io.Writer, args ...string) error {
+	cmd := r.command(ctx, orDefault(r.FFmpegPath, "ffmpeg"), args)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return sshError(cmd.Run())
+}
+
+// Probe implements Runner
+func (r SSHRunner) Probe(ctx context.Context, file string) (*ProbeResult, error) {
+	output, err := r.command(ctx, orDefault(r.FFprobePath, "ffprobe"), probeArgs(file)).Output()
+	if err = sshError(err); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("ffprobe failed: %w", ParseError(err, exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+	return parseProbe(output)
+}
+
+// command builds the ssh invocation of a remote binary
+func (r SSHRunner) command(ctx context.Context, bin string, args []string) *exec.Cmd {
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if r.Port != 0 {
+		sshArgs = append(sshArgs, "-p", strconv.Itoa(r.Port))
+	}
+	if r.KeyFile != "" {
+		sshArgs = append(sshArgs, "-i", r.KeyFile)
+	}
+
+	// ssh hands the command to the remote shell, so every word is quoted
+	words := []string{shellQuote(bin)}
+	for _, arg := range r.Paths.toRemote(args) {
+		words = append(words, shellQuote(arg))
+	}
+	sshArgs = append(sshArgs, r.Host, "--", strings.Join(words, " "))
+	return exec.CommandContext(ctx, "ssh", sshArgs...)
+}
+
+// sshError keeps the remote command's exit status, which means ffmpeg
+// rejected the media, but hides it for ssh's own failures (255) and remote
+// signals (above 128) so they are retried like a killed local ffmpeg
+func sshError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 128 {
+		return fmt.Errorf("ssh failed: %v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
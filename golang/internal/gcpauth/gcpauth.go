@@ -0,0 +1,145 @@
+// Package gcpauth provides OAuth2 access tokens for Google Cloud APIs, from
+// a service account key or the metadata server (workload identity)
+package gcpauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"imersaofc/internal/oauth"
+)
+
+// OAuth2 scopes of the APIs we call
+const (
+	ScopeStorage = "https://www.googleapis.com/auth/devstorage.read_write"
+	ScopePubSub  = "https://www.googleapis.com/auth/pubsub"
+)
+
+const gceMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// TokenSource provides OAuth2 access tokens for Google APIs
+type TokenSource = oauth.TokenSource
+
+// ServiceAccountKey is the subset of a Google service account JSON key we need
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// LoadServiceAccount reads and parses a service account JSON key file
+func LoadServiceAccount(file string) (*ServiceAccountKey, *rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	var key ServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, nil, errors.New("credentials file has no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("service account private key is not RSA")
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &key, rsaKey, nil
+}
+
+// NewServiceAccountTokenSource exchanges a signed JWT for access tokens to
+// the scope
+func NewServiceAccountTokenSource(client *http.Client, key *ServiceAccountKey, rsaKey *rsa.PrivateKey, scope string) TokenSource {
+	return oauth.Cache(func(ctx context.Context) (oauth.Token, error) {
+		now := time.Now()
+		claims := map[string]interface{}{
+			"iss":   key.ClientEmail,
+			"scope": scope,
+			"aud":   key.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		}
+		assertion, err := signJWT(rsaKey, claims)
+		if err != nil {
+			return oauth.Token{}, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return oauth.Token{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return doTokenRequest(client, req)
+	})
+}
+
+// NewMetadataTokenSource uses the GCE/GKE metadata server (workload identity)
+func NewMetadataTokenSource(client *http.Client) TokenSource {
+	return oauth.Cache(func(ctx context.Context) (oauth.Token, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceMetadataToken, nil)
+		if err != nil {
+			return oauth.Token{}, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return doTokenRequest(client, req)
+	})
+}
+
+// doTokenRequest executes a token request and decodes the response
+func doTokenRequest(client *http.Client, req *http.Request) (oauth.Token, error) {
+	var tok oauth.Token
+	resp, err := client.Do(req)
+	if err != nil {
+		return tok, fmt.Errorf("failed to fetch access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tok, fmt.Errorf("failed to fetch access token: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return tok, fmt.Errorf("failed to decode access token: %w", err)
+	}
+	return tok, nil
+}
+
+// signJWT builds an RS256 signed JWT with the given claims
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign jwt: %w", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
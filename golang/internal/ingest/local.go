@@ -0,0 +1,106 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// Errors returned when the local queue cannot accept more tasks
+var (
+	ErrQueueFull   = errors.New("local queue is full")
+	ErrQueueClosed = errors.New("local queue is closed")
+)
+
+// localMaxAttempts is how many times a task with a retryable error is run
+const localMaxAttempts = 3
+
+// localTask is a queued message and how many times it has been run
+type localTask struct {
+	msg      []byte
+	attempts int
+}
+
+// LocalQueue runs enqueued tasks in-process, one at a time, for small
+// deployments where ingest and conversion share a single service
+type LocalQueue struct {
+	tasks  chan localTask
+	handle func(msg []byte) converter.Result
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewLocalQueue creates a new instance of LocalQueue holding up to size pending tasks
+func NewLocalQueue(size int, handle func(msg []byte) converter.Result) *LocalQueue {
+	return &LocalQueue{
+		tasks:  make(chan localTask, size),
+		handle: handle,
+	}
+}
+
+// Enqueue schedules the task without blocking
+func (q *LocalQueue) Enqueue(task converter.VideoTask) error {
+	msg, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return q.push(localTask{msg: msg})
+}
+
+// push adds the task unless the queue is full or closed
+func (q *LocalQueue) push(task localTask) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.tasks <- task:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Run processes tasks until the queue is closed; tasks that fail with a
+// retryable error go back to the end of the queue a few times
+func (q *LocalQueue) Run() {
+	for task := range q.tasks {
+		result := q.handle(task.msg)
+		if result.Outcome != converter.OutcomeRetry {
+			continue
+		}
+		if result.Delay > 0 {
+			// Postponed, not failed: bring it back later without using an attempt
+			time.AfterFunc(result.Delay, func() {
+				if err := q.push(task); err != nil {
+					slog.Error("Dropping task", slog.String("reason", err.Error()), slog.String("error", result.Err.Error()))
+				}
+			})
+			continue
+		}
+		task.attempts++
+		if task.attempts >= localMaxAttempts {
+			slog.Error("Giving up on task", slog.Int("attempts", task.attempts), slog.String("error", result.Err.Error()))
+			continue
+		}
+		if err := q.push(task); err != nil {
+			slog.Error("Dropping task", slog.String("reason", err.Error()), slog.String("error", result.Err.Error()))
+		}
+	}
+}
+
+// Close stops accepting tasks; Run returns after draining pending ones
+func (q *LocalQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+}
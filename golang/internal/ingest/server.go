@@ -0,0 +1,190 @@
+package ingest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"imersaofc/internal/converter"
+)
+
+// Enqueuer hands a fully uploaded video over for conversion
+type Enqueuer interface {
+	Enqueue(task converter.VideoTask) error
+}
+
+// Server receives uploads over HTTP, either as numbered chunks or through
+// the tus resumable upload protocol, and enqueues the conversion once the
+// upload is complete
+type Server struct {
+	root          string
+	maxChunkSize  int64
+	maxUploadSize int64
+	enqueuer      Enqueuer
+	mux           *http.ServeMux
+	tusLocks      tusLocks
+}
+
+// NewServer creates a new instance of Server storing chunks below root.
+// maxUploadSize limits tus uploads; zero means unlimited.
+func NewServer(root string, maxChunkSize, maxUploadSize int64, enqueuer Enqueuer) *Server {
+	s := &Server{
+		root:          root,
+		maxChunkSize:  maxChunkSize,
+		maxUploadSize: maxUploadSize,
+		enqueuer:      enqueuer,
+		mux:           http.NewServeMux(),
+	}
+	s.mux.HandleFunc("POST /uploads/{video_id}/chunks/{n}", s.handleChunk)
+	s.mux.HandleFunc("POST /uploads/{video_id}/complete", s.handleComplete)
+	s.registerTus()
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// videoDir returns the working directory for a video's chunks
+func (s *Server) videoDir(videoID int) string {
+	return filepath.Join(s.root, strconv.Itoa(videoID))
+}
+
+// handleChunk writes the request body as chunk n of the video
+func (s *Server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	videoID, err := strconv.Atoi(r.PathValue("video_id"))
+	if err != nil || videoID <= 0 {
+		http.Error(w, "invalid video id", http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 {
+		http.Error(w, "invalid chunk index", http.StatusBadRequest)
+		return
+	}
+
+	dir := s.videoDir(videoID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		slog.Error("Error creating upload dir", slog.String("path", dir), slog.String("error", err.Error()))
+		http.Error(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	// Write to a temporary file first so a half-written chunk is never merged
+	chunkPath := filepath.Join(dir, fmt.Sprintf("%d.chunk", n))
+	tmpPath := chunkPath + ".part"
+	written, err := writeFile(tmpPath, http.MaxBytesReader(w, r.Body, s.maxChunkSize))
+	if err != nil {
+		os.Remove(tmpPath)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Error("Error writing chunk", slog.String("path", chunkPath), slog.String("error", err.Error()))
+		http.Error(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmpPath, chunkPath); err != nil {
+		slog.Error("Error renaming chunk", slog.String("path", chunkPath), slog.String("error", err.Error()))
+		http.Error(w, "failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Chunk stored", slog.Int("video_id", videoID), slog.Int("chunk", n), slog.Int64("bytes", written))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// completeRequest is the optional body of the complete endpoint
+type completeRequest struct {
+	TotalChunks int    `json:"total_chunks"`
+	Filename    string `json:"filename"`
+}
+
+// handleComplete validates the uploaded chunks and enqueues the conversion
+func (s *Server) handleComplete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := strconv.Atoi(r.PathValue("video_id"))
+	if err != nil || videoID <= 0 {
+		http.Error(w, "invalid video id", http.StatusBadRequest)
+		return
+	}
+
+	var req completeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dir := s.videoDir(videoID)
+	if req.TotalChunks > 0 {
+		manifest := converter.UploadManifest{OriginalFilename: req.Filename, ChunkCount: req.TotalChunks}
+		fileHash := sha256.New()
+		for i := 0; i < req.TotalChunks; i++ {
+			chunk, err := describeChunk(dir, i, fileHash)
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("missing chunk %d", i), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to read chunk", http.StatusInternalServerError)
+				return
+			}
+			manifest.Chunks = append(manifest.Chunks, chunk)
+		}
+		manifest.SHA256 = hex.EncodeToString(fileHash.Sum(nil))
+		if err := converter.WriteManifest(dir, manifest); err != nil {
+			http.Error(w, "failed to write upload manifest", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	task := converter.VideoTask{VideoID: videoID, Path: dir}
+	if err := s.enqueuer.Enqueue(task); err != nil {
+		slog.Error("Error enqueuing task", slog.Int("video_id", videoID), slog.String("error", err.Error()))
+		http.Error(w, "failed to enqueue conversion", http.StatusServiceUnavailable)
+		return
+	}
+
+	slog.Info("Upload complete, conversion enqueued", slog.Int("video_id", videoID))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// describeChunk computes the manifest entry of chunk n, also feeding its
+// data to fileHash
+func describeChunk(dir string, n int, fileHash io.Writer) (converter.ManifestChunk, error) {
+	chunk := converter.ManifestChunk{Index: n}
+	file, err := os.Open(filepath.Join(dir, fmt.Sprintf("%d.chunk", n)))
+	if err != nil {
+		return chunk, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	chunk.Size, err = io.Copy(io.MultiWriter(hash, fileHash), file)
+	chunk.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return chunk, err
+}
+
+// writeFile copies r into a new file at path
+func writeFile(path string, r io.Reader) (int64, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
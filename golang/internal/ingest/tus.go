@@ -0,0 +1,336 @@
+package ingest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"imersaofc/internal/converter"
+)
+
+const tusVersion = "1.0.0"
+
+// tusInfo is persisted next to an in-progress tus upload
+type tusInfo struct {
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// tusLocks serialises the requests changing an upload. Locks are never
+// removed: there is one per video directory, and dropping one a request
+// is waiting on would let the next request run alongside that one.
+type tusLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *tusLocks) get(id string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	if _, ok := l.locks[id]; !ok {
+		l.locks[id] = &sync.Mutex{}
+	}
+	return l.locks[id]
+}
+
+// registerTus adds the tus 1.0.0 core, creation and termination endpoints.
+// The upload id is the video id given in the "video_id" metadata, and the
+// finished upload is stored as a single chunk so the normal merge applies.
+func (s *Server) registerTus() {
+	s.mux.HandleFunc("OPTIONS /files", s.tusOptions)
+	s.mux.HandleFunc("POST /files", s.tusCreate)
+	s.mux.HandleFunc("HEAD /files/{id}", s.tusHead)
+	s.mux.HandleFunc("PATCH /files/{id}", s.tusPatch)
+	s.mux.HandleFunc("DELETE /files/{id}", s.tusDelete)
+}
+
+func (s *Server) tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+	if s.maxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.maxUploadSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreate starts a new upload for the video named in Upload-Metadata
+func (s *Server) tusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if s.maxUploadSize > 0 && length > s.maxUploadSize {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	videoID, err := strconv.Atoi(metadata["video_id"])
+	if err != nil || videoID <= 0 {
+		http.Error(w, "video_id metadata is required", http.StatusBadRequest)
+		return
+	}
+
+	dir := s.videoDir(videoID)
+	lock := s.tusLocks.get(dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Creating the upload again would truncate the bytes received so far,
+	// or overwrite the finished upload's chunk
+	if _, err := os.Stat(filepath.Join(dir, "0.chunk")); err == nil {
+		http.Error(w, "upload already completed", http.StatusConflict)
+		return
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		slog.Error("Error creating upload dir", slog.String("path", dir), slog.String("error", err.Error()))
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	infoFile, err := os.OpenFile(filepath.Join(dir, "tus.json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		http.Error(w, "upload already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	info, _ := json.Marshal(tusInfo{Length: length, Metadata: metadata})
+	_, err = infoFile.Write(info)
+	if closeErr := infoFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filepath.Join(dir, "tus.json"))
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(tusDataPath(dir), nil, 0o644); err != nil {
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Tus upload created", slog.Int("video_id", videoID), slog.Int64("length", length))
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", "/files/"+strconv.Itoa(videoID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusHead reports the current offset so clients can resume. A completed
+// upload whose conversion couldn't be enqueued is enqueued again first.
+func (s *Server) tusHead(w http.ResponseWriter, r *http.Request) {
+	dir, info, unlock, ok := s.loadTusUpload(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+	offset, err := tusOffset(dir, info)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	if completedTusUpload(dir) {
+		if err := s.completeTusUpload(dir); err != nil {
+			slog.Error("Error completing tus upload", slog.String("path", dir), slog.String("error", err.Error()))
+			http.Error(w, "failed to enqueue conversion", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends data at the offset negotiated by the client
+func (s *Server) tusPatch(w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	dir, info, unlock, ok := s.loadTusUpload(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	offset, err := tusOffset(dir, info)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset != offset {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	if offset < info.Length {
+		file, err := os.OpenFile(tusDataPath(dir), os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			http.Error(w, "failed to write upload", http.StatusInternalServerError)
+			return
+		}
+		// Keep whatever arrived before a disconnect so the client can resume from there
+		written, copyErr := io.Copy(file, io.LimitReader(r.Body, info.Length-offset))
+		closeErr := file.Close()
+		offset += written
+		if copyErr != nil || closeErr != nil {
+			slog.Warn("Tus patch interrupted", slog.String("path", dir), slog.Int64("offset", offset))
+			http.Error(w, "failed to write upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A retried PATCH at the full length enqueues an upload whose
+	// conversion couldn't be enqueued before
+	if offset == info.Length {
+		if err := s.completeTusUpload(dir); err != nil {
+			slog.Error("Error completing tus upload", slog.String("path", dir), slog.String("error", err.Error()))
+			http.Error(w, "failed to enqueue conversion", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDelete terminates an in-progress upload, or a completed one whose
+// conversion wasn't enqueued yet
+func (s *Server) tusDelete(w http.ResponseWriter, r *http.Request) {
+	dir, _, unlock, ok := s.loadTusUpload(w, r)
+	if !ok {
+		return
+	}
+	defer unlock()
+	os.Remove(tusDataPath(dir))
+	os.Remove(filepath.Join(dir, "0.chunk"))
+	os.Remove(filepath.Join(dir, "tus.json"))
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeTusUpload turns the upload into chunk 0 and enqueues the
+// conversion. The upload's info is only removed once enqueued, so until
+// then HEAD and PATCH still find the upload and retry.
+func (s *Server) completeTusUpload(dir string) error {
+	if !completedTusUpload(dir) {
+		if err := os.Rename(tusDataPath(dir), filepath.Join(dir, "0.chunk")); err != nil {
+			return err
+		}
+	}
+
+	videoID, _ := strconv.Atoi(filepath.Base(dir))
+	if err := s.enqueuer.Enqueue(converter.VideoTask{VideoID: videoID, Path: dir}); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(dir, "tus.json"))
+	slog.Info("Tus upload complete, conversion enqueued", slog.Int("video_id", videoID))
+	return nil
+}
+
+// completedTusUpload reports whether all the bytes of the upload arrived
+func completedTusUpload(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "0.chunk"))
+	return err == nil
+}
+
+// loadTusUpload resolves the upload named in the path, locks it and reads
+// its info; the caller unlocks it when ok
+func (s *Server) loadTusUpload(w http.ResponseWriter, r *http.Request) (string, tusInfo, func(), bool) {
+	var info tusInfo
+	videoID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || videoID <= 0 {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return "", info, nil, false
+	}
+	dir := s.videoDir(videoID)
+	lock := s.tusLocks.get(dir)
+	lock.Lock()
+	data, err := os.ReadFile(filepath.Join(dir, "tus.json"))
+	if err != nil {
+		lock.Unlock()
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return "", info, nil, false
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		lock.Unlock()
+		http.Error(w, "corrupt upload", http.StatusInternalServerError)
+		return "", info, nil, false
+	}
+	return dir, info, lock.Unlock, true
+}
+
+// tusDataPath is where bytes of an in-progress upload are appended
+func tusDataPath(dir string) string {
+	return filepath.Join(dir, "0.chunk.part")
+}
+
+// tusOffset returns how many bytes of the upload are stored
+func tusOffset(dir string, info tusInfo) (int64, error) {
+	if completedTusUpload(dir) {
+		return info.Length, nil
+	}
+	stat, err := os.Stat(tusDataPath(dir))
+	if err != nil {
+		return 0, err
+	}
+	return min(stat.Size(), info.Length), nil
+}
+
+// checkTusVersion rejects requests for unsupported protocol versions
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
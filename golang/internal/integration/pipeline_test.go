@@ -0,0 +1,186 @@
+//go:build integration
+
+// Package integration runs the real pipeline against Postgres and RabbitMQ
+// started with testcontainers. It needs Docker and ffmpeg, so it only
+// runs with the integration tag:
+//
+//	go test -tags integration ./internal/integration/
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	tcrabbitmq "github.com/testcontainers/testcontainers-go/modules/rabbitmq"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"imersaofc/internal/audit"
+	"imersaofc/internal/converter"
+	"imersaofc/internal/converter/convertertest"
+	"imersaofc/internal/database"
+	"imersaofc/internal/rabbitmq"
+)
+
+const (
+	exchange   = "conversion_exchange"
+	routingKey = "conversion"
+	queue      = "video_conversion_queue"
+	videoID    = 42
+)
+
+func startPostgres(t *testing.T, ctx context.Context) *database.DB {
+	t.Helper()
+	pg, err := postgres.Run(ctx, "postgres:13",
+		postgres.WithDatabase("converter"),
+		postgres.WithUsername("user"),
+		postgres.WithPassword("password"),
+		postgres.WithInitScripts(filepath.Join("..", "..", "db.sql")),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(2*time.Minute)),
+	)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	t.Cleanup(func() { testcontainers.TerminateContainer(pg) })
+
+	dsn, err := pg.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.Open("postgres", dsn, database.PoolConfig{MaxOpenConns: 5}, time.Minute)
+	if err != nil {
+		t.Fatalf("connecting to postgres: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func startRabbitMQ(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	rmq, err := tcrabbitmq.Run(ctx, "rabbitmq:3-management-alpine")
+	if err != nil {
+		t.Fatalf("starting rabbitmq: %v", err)
+	}
+	t.Cleanup(func() { testcontainers.TerminateContainer(rmq) })
+
+	url, err := rmq.AmqpURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url
+}
+
+// sampleChunks generates a short test video sliced into chunks the way
+// the Django app stores uploads
+func sampleChunks(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not installed")
+	}
+	chunkDir, err := convertertest.GenerateChunks(ctx, t.TempDir(), videoID, convertertest.MediaOptions{}, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunkDir
+}
+
+func TestPipeline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	db := startPostgres(t, ctx)
+	amqpURL := startRabbitMQ(t, ctx)
+	chunkDir := sampleChunks(t, ctx)
+
+	uploader := convertertest.NewUploader()
+	publisher := &convertertest.Publisher{}
+	recorder := audit.NewRecorder(db, "integration")
+	vc := converter.NewVideoConverter(db,
+		converter.WithUploader(uploader),
+		converter.WithPublisher(publisher),
+		converter.WithSubscriber(recorder.Record),
+	)
+
+	consumer := rabbitmq.NewConsumer(rabbitmq.ConsumerConfig{
+		URL:        amqpURL,
+		Queue:      queue,
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+	}, vc.Handle)
+	consumerCtx, stopConsumer := context.WithCancel(ctx)
+	defer stopConsumer()
+	consumerDone := make(chan error, 1)
+	go func() { consumerDone <- consumer.Run(consumerCtx) }()
+
+	// Give the consumer time to declare its queue before publishing
+	time.Sleep(2 * time.Second)
+	body, _ := json.Marshal(converter.VideoTask{VideoID: videoID, Path: chunkDir})
+	err := rabbitmq.Publish(amqpURL, nil, exchange, routingKey, rabbitmq.Publishing{
+		Properties: rabbitmq.Properties{ContentType: "application/json"},
+		Body:       body,
+	})
+	if err != nil {
+		t.Fatalf("publishing task: %v", err)
+	}
+
+	// The video is processed once the row shows up
+	deadline := time.Now().Add(2 * time.Minute)
+	for !converter.IsProcessed(db, videoID) {
+		if time.Now().After(deadline) {
+			t.Fatal("video was not processed in time")
+		}
+		select {
+		case err := <-consumerDone:
+			t.Fatalf("consumer stopped: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	// Output files
+	if _, err := os.Stat(filepath.Join(chunkDir, "mpeg-dash", "output.mpd")); err != nil {
+		t.Errorf("manifest not written: %v", err)
+	}
+	if _, ok := uploader.Object("42/mpeg-dash/output.mpd"); !ok {
+		t.Errorf("manifest not uploaded, got %v", uploader.Keys())
+	}
+	if events := publisher.Events(); len(events) != 1 || events[0].Status != "success" {
+		t.Errorf("unexpected completion events: %+v", events)
+	}
+
+	// Audit trail
+	list, err := audit.Events(ctx, db, videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 || list[len(list)-1].NewStatus != audit.StatusSuccess {
+		t.Errorf("unexpected job events: %+v", list)
+	}
+
+	// The message was acked: nothing is left in the queue
+	conn, err := rabbitmq.Dial(amqpURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ch.QueueInspect(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Messages != 0 {
+		t.Errorf("%d messages left in the queue", info.Messages)
+	}
+}
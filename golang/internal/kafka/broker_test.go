@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// batch is a record batch the fake broker received
+type batch struct {
+	topic     string
+	partition int32
+	producer  producerState
+	records   []Message
+}
+
+// fakeBroker is a single Kafka broker leading every partition of its
+// topics. produceError picks the error code of each produce request, none
+// when nil.
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int32
+
+	mu           sync.Mutex
+	produceError func(n int) int16
+	producerIDs  int64
+	metadata     int
+	batches      []batch
+}
+
+// newFakeBroker starts a broker with topics of partitions partitions
+func newFakeBroker(t *testing.T, partitions int32) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, partitions: partitions}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// newTestProducer creates a producer bootstrapped from the broker
+func newTestProducer(t *testing.T, b *fakeBroker) *Producer {
+	t.Helper()
+	p, err := NewProducer(ProducerConfig{Brokers: []string{b.ln.Addr().String()}, Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		p := &parser{buf: req}
+		apiKey := p.int16()
+		p.int16() // version
+		correlationID := p.int32()
+		p.string() // client id
+
+		resp := &builder{}
+		resp.int32(correlationID)
+		b.mu.Lock()
+		switch apiKey {
+		case apiInitProducerID:
+			b.producerIDs++
+			resp.int32(0)
+			resp.int16(0)
+			resp.int64(1000 + b.producerIDs)
+			resp.int16(0)
+		case apiMetadata:
+			b.metadata++
+			b.writeMetadata(resp, p)
+		case apiProduce:
+			b.produce(resp, p)
+		}
+		b.mu.Unlock()
+
+		frame := &builder{}
+		frame.bytes(resp.buf)
+		if _, err := conn.Write(frame.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) writeMetadata(resp *builder, req *parser) {
+	req.array()
+	topic := req.string()
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	resp.int32(1)
+	resp.int32(1) // node id
+	resp.string(host)
+	resp.int32(int32(portNumber))
+	resp.nullString()
+	resp.int32(1) // controller
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(topic)
+	resp.int8(0)
+	resp.int32(b.partitions)
+	for i := int32(0); i < b.partitions; i++ {
+		resp.int16(0)
+		resp.int32(i)
+		resp.int32(1) // leader
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+	}
+}
+
+func (b *fakeBroker) produce(resp *builder, req *parser) {
+	req.string() // transactional id
+	if acks := req.int16(); acks != -1 {
+		b.t.Errorf("produced with acks %d, want all in-sync replicas", acks)
+	}
+	req.int32()
+	req.array()
+	topic := req.string()
+	req.array()
+	partition := req.int32()
+	raw := req.take(int(req.int32()))
+
+	code := int16(0)
+	if b.produceError != nil {
+		code = b.produceError(len(b.batches))
+	}
+	received, err := decodeBatch(raw)
+	if err != nil {
+		b.t.Errorf("invalid record batch: %v", err)
+	}
+	received.topic, received.partition = topic, partition
+	b.batches = append(b.batches, received)
+
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(partition)
+	resp.int16(code)
+	resp.int64(0)
+	resp.int64(-1)
+	resp.int32(0) // throttle time
+}
+
+// received returns the batches received so far
+func (b *fakeBroker) received() []batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]batch(nil), b.batches...)
+}
+
+// decodeBatch decodes a v2 record batch, checking its length and CRC
+func decodeBatch(raw []byte) (batch, error) {
+	p := &parser{buf: raw}
+	p.int64() // base offset
+	length := p.int32()
+	if int(length) != len(raw)-12 {
+		return batch{}, ErrProtocol
+	}
+	p.int32() // leader epoch
+	if magic := p.int8(); magic != 2 {
+		return batch{}, ErrProtocol
+	}
+	crc := uint32(p.int32())
+	if crc32.Checksum(raw[p.pos:], castagnoli) != crc {
+		return batch{}, ErrProtocol
+	}
+	p.int16() // attributes
+	p.int32() // last offset delta
+	p.int64()
+	p.int64()
+	var b batch
+	b.producer.id = p.int64()
+	b.producer.epoch = p.int16()
+	b.producer.sequence = p.int32()
+	for i, n := 0, p.int32(); i < int(n) && p.err == nil; i++ {
+		r := &parser{buf: p.take(int(varint(p)))}
+		r.int8()  // attributes
+		varint(r) // timestamp delta
+		if delta := varint(r); delta != int64(i) {
+			return batch{}, ErrProtocol
+		}
+		msg := Message{Key: varBytes(r), Value: varBytes(r)}
+		if headers := varint(r); headers > 0 {
+			msg.Headers = map[string]string{}
+			for j := int64(0); j < headers; j++ {
+				msg.Headers[string(varBytes(r))] = string(varBytes(r))
+			}
+		}
+		if r.err != nil || r.pos != len(r.buf) {
+			return batch{}, ErrProtocol
+		}
+		b.records = append(b.records, msg)
+	}
+	if p.err != nil || p.pos != len(p.buf) {
+		return batch{}, ErrProtocol
+	}
+	return b, nil
+}
+
+func varint(p *parser) int64 {
+	if p.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(p.buf[p.pos:])
+	if n <= 0 {
+		p.err = ErrProtocol
+		return 0
+	}
+	p.pos += n
+	return v
+}
+
+func varBytes(p *parser) []byte {
+	n := varint(p)
+	if n < 0 {
+		return nil
+	}
+	return append([]byte{}, p.take(int(n))...)
+}
@@ -0,0 +1,370 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error code returned by a broker
+type Error int16
+
+// Error codes the producer handles
+const (
+	errUnknownTopicOrPartition Error = 3
+	errLeaderNotAvailable      Error = 5
+	errNotLeaderForPartition   Error = 6
+	errRequestTimedOut         Error = 7
+	errNetworkException        Error = 13
+	errNotEnoughReplicas       Error = 19
+	errNotEnoughReplicasAfter  Error = 20
+	errOutOfOrderSequence      Error = 45
+	errDuplicateSequence       Error = 46
+	errUnknownProducerID       Error = 59
+)
+
+func (e Error) Error() string {
+	return "kafka: broker error " + strconv.Itoa(int(e))
+}
+
+// retriable reports whether the request can be sent again as it is
+func (e Error) retriable() bool {
+	switch e {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderForPartition, errRequestTimedOut,
+		errNetworkException, errNotEnoughReplicas, errNotEnoughReplicasAfter:
+		return true
+	}
+	return false
+}
+
+// ProducerConfig configures a Producer
+type ProducerConfig struct {
+	// Brokers are the bootstrap "host:port" addresses
+	Brokers  []string
+	ClientID string
+	// Timeout bounds each request, 10s when zero
+	Timeout time.Duration
+	// Retries is how many times a failed produce is retried, 5 when zero
+	Retries int
+}
+
+// Producer is an idempotent producer: it acks with all in-sync replicas,
+// sends one batch per partition at a time and numbers batches so the
+// broker drops those it already has, which makes retries safe. Records
+// with the same key go to the same partition, in order.
+type Producer struct {
+	cfg ProducerConfig
+
+	mu        sync.Mutex
+	conns     map[int32]*conn
+	brokers   map[int32]string
+	leaders   map[string][]int32
+	producer  producerState
+	sequences map[topicPartition]int32
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// NewProducer creates a new instance of Producer; it connects on first use
+func NewProducer(cfg ProducerConfig) (*Producer, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka brokers are required")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "videoconverter"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 5
+	}
+	return &Producer{
+		cfg:       cfg,
+		conns:     map[int32]*conn{},
+		brokers:   map[int32]string{},
+		leaders:   map[string][]int32{},
+		producer:  producerState{id: -1, epoch: -1},
+		sequences: map[topicPartition]int32{},
+	}, nil
+}
+
+// Close closes the broker connections
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, c := range p.conns {
+		c.close()
+		delete(p.conns, id)
+	}
+	return nil
+}
+
+// Produce writes the messages to the topic and returns once every
+// partition they went to acknowledged them
+func (p *Producer) Produce(ctx context.Context, topic string, msgs ...Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.producer.id < 0 {
+		if err := p.initProducerID(); err != nil {
+			return err
+		}
+	}
+	if _, ok := p.leaders[topic]; !ok {
+		if err := p.refreshMetadata(topic); err != nil {
+			return err
+		}
+	}
+
+	// Keep the order of the messages within each partition
+	var order []int32
+	batches := map[int32][]Message{}
+	for _, msg := range msgs {
+		partition := partitionFor(msg.Key, len(p.leaders[topic]))
+		if _, ok := batches[partition]; !ok {
+			order = append(order, partition)
+		}
+		batches[partition] = append(batches[partition], msg)
+	}
+	for _, partition := range order {
+		if err := p.produceBatch(ctx, topicPartition{topic, partition}, batches[partition]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// produceBatch sends one batch, retrying it with the same sequence number
+func (p *Producer) produceBatch(ctx context.Context, tp topicPartition, msgs []Message) error {
+	var err error
+	for attempt := 0; attempt <= p.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+
+		state := p.producer
+		state.sequence = p.sequences[tp]
+		err = p.send(tp, recordBatch(msgs, state, time.Now()))
+		var brokerErr Error
+		switch {
+		case err == nil, errors.As(err, &brokerErr) && brokerErr == errDuplicateSequence:
+			p.sequences[tp] = state.sequence + int32(len(msgs))
+			return nil
+		case errors.As(err, &brokerErr) && (brokerErr == errOutOfOrderSequence || brokerErr == errUnknownProducerID):
+			// The broker lost track of this producer; start over with a new id
+			slog.Warn("Resetting idempotent producer", slog.String("topic", tp.topic), slog.String("error", err.Error()))
+			if initErr := p.initProducerID(); initErr != nil {
+				return initErr
+			}
+		case errors.As(err, &brokerErr) && !brokerErr.retriable():
+			return err
+		default:
+			// Retriable broker errors and lost connections: the leader may
+			// have moved
+			if metaErr := p.refreshMetadata(tp.topic); metaErr != nil {
+				slog.Warn("Error refreshing kafka metadata", slog.String("error", metaErr.Error()))
+			}
+		}
+	}
+	return fmt.Errorf("kafka: produce to %s/%d failed after %d retries: %w", tp.topic, tp.partition, p.cfg.Retries, err)
+}
+
+// send sends a produce request for one partition to its leader
+func (p *Producer) send(tp topicPartition, batch []byte) error {
+	leaders := p.leaders[tp.topic]
+	if int(tp.partition) >= len(leaders) || leaders[tp.partition] < 0 {
+		return errLeaderNotAvailable
+	}
+	c, err := p.conn(leaders[tp.partition])
+	if err != nil {
+		return err
+	}
+
+	req := &builder{}
+	req.nullString() // transactional id
+	req.int16(-1)    // acks from all in-sync replicas
+	req.int32(int32(p.cfg.Timeout.Milliseconds()))
+	req.int32(1)
+	req.string(tp.topic)
+	req.int32(1)
+	req.int32(tp.partition)
+	req.bytes(batch)
+
+	resp, err := c.roundTrip(apiProduce, produceVersion, req.buf)
+	if err != nil {
+		p.dropConn(leaders[tp.partition])
+		return err
+	}
+	var code int16
+	for i, topics := 0, resp.array(); i < topics; i++ {
+		resp.string()
+		for j, partitions := 0, resp.array(); j < partitions; j++ {
+			resp.int32()
+			code = resp.int16()
+			resp.int64() // base offset
+			resp.int64() // log append time
+		}
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if code != 0 {
+		return Error(code)
+	}
+	return nil
+}
+
+// initProducerID gets a new producer id and epoch, resetting the sequences
+func (p *Producer) initProducerID() error {
+	c, node, err := p.anyConn()
+	if err != nil {
+		return err
+	}
+	req := &builder{}
+	req.nullString() // transactional id
+	req.int32(int32(time.Minute.Milliseconds()))
+	resp, err := c.roundTrip(apiInitProducerID, initProducerIDVersion, req.buf)
+	if err != nil {
+		p.dropConn(node)
+		return err
+	}
+	resp.int32() // throttle time
+	code := resp.int16()
+	id, epoch := resp.int64(), resp.int16()
+	if resp.err != nil {
+		return resp.err
+	}
+	if code != 0 {
+		return fmt.Errorf("kafka: init producer id: %w", Error(code))
+	}
+	p.producer = producerState{id: id, epoch: epoch}
+	p.sequences = map[topicPartition]int32{}
+	return nil
+}
+
+// refreshMetadata reloads the brokers and the partition leaders of the topic
+func (p *Producer) refreshMetadata(topic string) error {
+	c, id, err := p.anyConn()
+	if err != nil {
+		return err
+	}
+	req := &builder{}
+	req.int32(1)
+	req.string(topic)
+	resp, err := c.roundTrip(apiMetadata, metadataVersion, req.buf)
+	if err != nil {
+		p.dropConn(id)
+		return err
+	}
+
+	brokers := map[int32]string{}
+	for i, n := 0, resp.array(); i < n; i++ {
+		node := resp.int32()
+		host := resp.string()
+		port := resp.int32()
+		resp.string() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.int32() // controller id
+	var leaders []int32
+	var topicErr int16
+	for i, n := 0, resp.array(); i < n; i++ {
+		topicErr = resp.int16()
+		resp.string()
+		resp.int8() // internal
+		partitions := resp.array()
+		leaders = make([]int32, partitions)
+		for j := 0; j < partitions; j++ {
+			resp.int16()
+			index := resp.int32()
+			leader := resp.int32()
+			for k, replicas := 0, resp.array(); k < replicas; k++ {
+				resp.int32()
+			}
+			for k, isr := 0, resp.array(); k < isr; k++ {
+				resp.int32()
+			}
+			if index >= 0 && int(index) < partitions {
+				leaders[index] = leader
+			}
+		}
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if topicErr != 0 {
+		return fmt.Errorf("kafka: metadata of %s: %w", topic, Error(topicErr))
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("kafka: topic %s has no partitions", topic)
+	}
+	for node, addr := range brokers {
+		if p.brokers[node] != addr {
+			p.dropConn(node)
+		}
+	}
+	p.brokers = brokers
+	p.leaders[topic] = leaders
+	return nil
+}
+
+// conn returns the connection to a broker, dialing it when needed
+func (p *Producer) conn(node int32) (*conn, error) {
+	if c, ok := p.conns[node]; ok {
+		return c, nil
+	}
+	addr, ok := p.brokers[node]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown broker %d", node)
+	}
+	c, err := dial(addr, p.cfg.ClientID, p.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[node] = c
+	return c, nil
+}
+
+// anyConn returns a connection to a known broker, or to a bootstrap one
+// before metadata was loaded. Bootstrap connections get negative ids.
+func (p *Producer) anyConn() (*conn, int32, error) {
+	for node := range p.brokers {
+		if c, err := p.conn(node); err == nil {
+			return c, node, nil
+		}
+	}
+	var err error
+	for i, addr := range p.cfg.Brokers {
+		node := int32(-1 - i)
+		if c, ok := p.conns[node]; ok {
+			return c, node, nil
+		}
+		var c *conn
+		if c, err = dial(addr, p.cfg.ClientID, p.cfg.Timeout); err == nil {
+			p.conns[node] = c
+			return c, node, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("kafka: no broker reachable: %w", err)
+}
+
+// dropConn closes the connection to a broker so the next request redials
+func (p *Producer) dropConn(node int32) {
+	if c, ok := p.conns[node]; ok {
+		c.close()
+		delete(p.conns, node)
+	}
+}
@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestProduce(t *testing.T) {
+	broker := newFakeBroker(t, 3)
+	p := newTestProducer(t, broker)
+
+	var msgs []Message
+	for id := 1; id <= 6; id++ {
+		msgs = append(msgs, Message{Key: []byte(strconv.Itoa(id)), Value: []byte("event " + strconv.Itoa(id))})
+	}
+	if err := p.Produce(context.Background(), "video.converted", msgs...); err != nil {
+		t.Fatalf("Produce() error = %v", err)
+	}
+	if err := p.Produce(context.Background(), "video.converted", msgs[0]); err != nil {
+		t.Fatalf("Produce() error = %v", err)
+	}
+
+	// Records go to the partition of their key, in order, and each
+	// partition numbers its batches from the records it already has
+	sequences := map[int32]int32{}
+	byPartition := map[int32][]string{}
+	for _, b := range broker.received() {
+		if b.topic != "video.converted" || b.producer.id != 1001 {
+			t.Errorf("batch for %s from producer %d", b.topic, b.producer.id)
+		}
+		if b.producer.sequence != sequences[b.partition] {
+			t.Errorf("partition %d batch sequence = %d, want %d", b.partition, b.producer.sequence, sequences[b.partition])
+		}
+		sequences[b.partition] += int32(len(b.records))
+		for _, r := range b.records {
+			byPartition[b.partition] = append(byPartition[b.partition], string(r.Key))
+		}
+	}
+	want := map[int32][]string{}
+	for _, msg := range append(msgs, msgs[0]) {
+		partition := partitionFor(msg.Key, 3)
+		want[partition] = append(want[partition], string(msg.Key))
+	}
+	if !reflect.DeepEqual(byPartition, want) {
+		t.Errorf("partitions received keys %v, want %v", byPartition, want)
+	}
+	if broker.metadata != 1 {
+		t.Errorf("metadata fetched %d times, want once", broker.metadata)
+	}
+}
+
+func TestProduceRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		errors  []Error
+		wantErr error
+		// wantBatches are the producer ids and sequences of the batches
+		// sent, and wantMetadata how many times metadata was fetched
+		wantBatches  []producerState
+		wantMetadata int
+	}{
+		{
+			name:         "leader moved",
+			errors:       []Error{errNotLeaderForPartition, 0},
+			wantBatches:  []producerState{{id: 1001}, {id: 1001}},
+			wantMetadata: 2,
+		},
+		{
+			name:         "retried batch already appended",
+			errors:       []Error{errRequestTimedOut, errDuplicateSequence},
+			wantBatches:  []producerState{{id: 1001}, {id: 1001}},
+			wantMetadata: 2,
+		},
+		{
+			name:         "broker lost the producer",
+			errors:       []Error{errUnknownProducerID, 0},
+			wantBatches:  []producerState{{id: 1001}, {id: 1002}},
+			wantMetadata: 1,
+		},
+		{
+			name:         "not retriable",
+			errors:       []Error{10},
+			wantErr:      Error(10),
+			wantBatches:  []producerState{{id: 1001}},
+			wantMetadata: 1,
+		},
+		{
+			name:         "retries exhausted",
+			errors:       []Error{errNotEnoughReplicas, errNotEnoughReplicas, errNotEnoughReplicas},
+			wantErr:      errNotEnoughReplicas,
+			wantBatches:  []producerState{{id: 1001}, {id: 1001}, {id: 1001}},
+			wantMetadata: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeBroker(t, 1)
+			broker.produceError = func(n int) int16 { return int16(tt.errors[n]) }
+			p := newTestProducer(t, broker)
+
+			err := p.Produce(context.Background(), "video.converted", Message{Key: []byte("3"), Value: []byte("event")})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Produce() error = %v, want %v", err, tt.wantErr)
+			}
+			batches := broker.received()
+			if len(batches) != len(tt.wantBatches) {
+				t.Fatalf("broker received %d batches, want %d", len(batches), len(tt.wantBatches))
+			}
+			for i, b := range batches {
+				if b.producer.id != tt.wantBatches[i].id || b.producer.sequence != tt.wantBatches[i].sequence {
+					t.Errorf("batch %d from producer %d with sequence %d, want %+v", i, b.producer.id, b.producer.sequence, tt.wantBatches[i])
+				}
+			}
+			if broker.metadata != tt.wantMetadata {
+				t.Errorf("metadata fetched %d times, want %d", broker.metadata, tt.wantMetadata)
+			}
+
+			// A produced batch moves the sequence on, a failed one doesn't
+			wantNext := int32(1)
+			if tt.wantErr != nil {
+				wantNext = 0
+			}
+			if got := p.sequences[topicPartition{"video.converted", 0}]; got != wantNext {
+				t.Errorf("next sequence = %d, want %d", got, wantNext)
+			}
+		})
+	}
+}
+
+func TestNewProducer(t *testing.T) {
+	if _, err := NewProducer(ProducerConfig{}); err == nil {
+		t.Error("NewProducer() without brokers succeeded")
+	}
+}
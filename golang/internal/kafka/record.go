@@ -0,0 +1,120 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Message is a record to produce
+type Message struct {
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// producerState identifies an idempotent producer's batches to the broker
+type producerState struct {
+	id       int64
+	epoch    int16
+	sequence int32
+}
+
+// recordBatch encodes the messages as a v2 record batch. The broker uses
+// the producer id, epoch and base sequence to drop a batch it already
+// appended, so a retried produce request isn't written twice.
+func recordBatch(msgs []Message, producer producerState, now time.Time) []byte {
+	timestamp := now.UnixMilli()
+	records := &builder{}
+	for i, msg := range msgs {
+		record := &builder{}
+		record.int8(0) // attributes
+		record.buf = binary.AppendVarint(record.buf, 0)
+		record.buf = binary.AppendVarint(record.buf, int64(i))
+		appendVarBytes(record, msg.Key)
+		appendVarBytes(record, msg.Value)
+		record.buf = binary.AppendVarint(record.buf, int64(len(msg.Headers)))
+		for k, v := range msg.Headers {
+			appendVarBytes(record, []byte(k))
+			appendVarBytes(record, []byte(v))
+		}
+		records.buf = binary.AppendVarint(records.buf, int64(len(record.buf)))
+		records.buf = append(records.buf, record.buf...)
+	}
+
+	// Everything after the CRC is covered by it
+	tail := &builder{}
+	tail.int16(0) // attributes: no compression, no transaction
+	tail.int32(int32(len(msgs) - 1))
+	tail.int64(timestamp)
+	tail.int64(timestamp)
+	tail.int64(producer.id)
+	tail.int16(producer.epoch)
+	tail.int32(producer.sequence)
+	tail.int32(int32(len(msgs)))
+	tail.buf = append(tail.buf, records.buf...)
+
+	batch := &builder{}
+	batch.int64(0) // base offset, assigned by the broker
+	// Length of what follows: leader epoch, magic, crc and tail
+	batch.int32(int32(4 + 1 + 4 + len(tail.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.buf = binary.BigEndian.AppendUint32(batch.buf, crc32.Checksum(tail.buf, castagnoli))
+	batch.buf = append(batch.buf, tail.buf...)
+	return batch.buf
+}
+
+// appendVarBytes appends a varint length and the bytes, -1 for nil
+func appendVarBytes(b *builder, p []byte) {
+	if p == nil {
+		b.buf = binary.AppendVarint(b.buf, -1)
+		return
+	}
+	b.buf = binary.AppendVarint(b.buf, int64(len(p)))
+	b.buf = append(b.buf, p...)
+}
+
+// partitionFor picks the partition of a key like the Java client's default
+// partitioner, so records with the same key land on the same partition
+// whichever client produced them
+func partitionFor(key []byte, partitions int) int32 {
+	return int32(murmur2(key)&0x7fffffff) % int32(partitions)
+}
+
+// murmur2 is the 32-bit MurmurHash2 variant used by Kafka clients
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	rest := data[length&^3:]
+	switch len(rest) {
+	case 3:
+		h ^= uint32(rest[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(rest[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(rest[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMurmur2(t *testing.T) {
+	// The vectors of the Java client's own tests
+	tests := []struct {
+		key  string
+		want int32
+	}{
+		{key: "21", want: -973932308},
+		{key: "foobar", want: -790332482},
+		{key: "a-little-bit-long-string", want: -985981536},
+		{key: "a-little-bit-longer-string", want: -1486304829},
+		{key: "lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", want: -58897971},
+		{key: "abc", want: 479470107},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := int32(murmur2([]byte(tt.key))); got != tt.want {
+				t.Errorf("murmur2(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		partitions int
+		want       int32
+	}{
+		{name: "positive hash", key: "abc", partitions: 10, want: 479470107 % 10},
+		{name: "negative hash is masked", key: "21", partitions: 10, want: (-973932308 & 0x7fffffff) % 10},
+		{name: "single partition", key: "foobar", partitions: 1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := partitionFor([]byte(tt.key), tt.partitions)
+			if got != tt.want {
+				t.Errorf("partitionFor(%q, %d) = %d, want %d", tt.key, tt.partitions, got, tt.want)
+			}
+			if got < 0 || int(got) >= tt.partitions {
+				t.Errorf("partition %d out of range", got)
+			}
+		})
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	msgs := []Message{
+		{Key: []byte("3"), Value: []byte(`{"video_id": 3}`), Headers: map[string]string{"event_id": "video.converted/3/1", "signature": "hmac-sha256=abc"}},
+		{Value: []byte("no key")},
+		{Key: []byte("4"), Value: []byte{}},
+	}
+	producer := producerState{id: 1001, epoch: 2, sequence: 7}
+	now := time.UnixMilli(1700000000123)
+	raw := recordBatch(msgs, producer, now)
+
+	got, err := decodeBatch(raw)
+	if err != nil {
+		t.Fatalf("decodeBatch() error = %v", err)
+	}
+	if got.producer != producer {
+		t.Errorf("producer = %+v, want %+v", got.producer, producer)
+	}
+	if !reflect.DeepEqual(got.records, msgs) {
+		t.Errorf("records = %+v, want %+v", got.records, msgs)
+	}
+	if ts := int64(binary.BigEndian.Uint64(raw[27:])); ts != now.UnixMilli() {
+		t.Errorf("first timestamp = %d, want %d", ts, now.UnixMilli())
+	}
+
+	// The CRC covers everything after it
+	raw[len(raw)-1] ^= 0xff
+	if _, err := decodeBatch(raw); err == nil {
+		t.Error("decodeBatch() accepted a corrupted batch")
+	}
+}
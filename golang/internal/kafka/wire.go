@@ -0,0 +1,177 @@
+// Package kafka is a minimal Kafka producer speaking the binary protocol
+// directly: metadata discovery, idempotent producer ids and record batch v2
+// produce requests, without compression, TLS or SASL
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrProtocol is returned when a response can't be decoded
+var ErrProtocol = errors.New("kafka: protocol error")
+
+// API keys and the versions we speak
+const (
+	apiProduce        = 0
+	apiMetadata       = 3
+	apiInitProducerID = 22
+
+	produceVersion        = 3
+	metadataVersion       = 1
+	initProducerIDVersion = 0
+)
+
+// builder encodes request fields
+type builder struct {
+	buf []byte
+}
+
+func (b *builder) int8(v int8)   { b.buf = append(b.buf, byte(v)) }
+func (b *builder) int16(v int16) { b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(v)) }
+func (b *builder) int32(v int32) { b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(v)) }
+func (b *builder) int64(v int64) { b.buf = binary.BigEndian.AppendUint64(b.buf, uint64(v)) }
+
+func (b *builder) string(s string) {
+	b.int16(int16(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// nullString encodes a nullable string as null
+func (b *builder) nullString() { b.int16(-1) }
+
+func (b *builder) bytes(p []byte) {
+	b.int32(int32(len(p)))
+	b.buf = append(b.buf, p...)
+}
+
+// parser decodes response fields, remembering the first error
+type parser struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (p *parser) take(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || p.pos+n > len(p.buf) {
+		p.err = ErrProtocol
+		return nil
+	}
+	b := p.buf[p.pos : p.pos+n]
+	p.pos += n
+	return b
+}
+
+func (p *parser) int8() int8 {
+	if b := p.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (p *parser) int16() int16 {
+	if b := p.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (p *parser) int32() int32 {
+	if b := p.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (p *parser) int64() int64 {
+	if b := p.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string decodes a string, nullable ones as ""
+func (p *parser) string() string {
+	n := p.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(p.take(int(n)))
+}
+
+// array decodes the length of an array, null ones as empty
+func (p *parser) array() int {
+	n := p.int32()
+	if n < 0 || int(n) > len(p.buf)-p.pos {
+		if n < 0 {
+			return 0
+		}
+		p.err = ErrProtocol
+		return 0
+	}
+	return int(n)
+}
+
+// conn is a connection to one broker. Requests are sent one at a time.
+type conn struct {
+	netConn       net.Conn
+	r             *bufio.Reader
+	clientID      string
+	correlationID int32
+	timeout       time.Duration
+}
+
+func dial(addr, clientID string, timeout time.Duration) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{netConn: netConn, r: bufio.NewReader(netConn), clientID: clientID, timeout: timeout}, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
+
+// roundTrip sends a request with a v1 header and returns the response body
+func (c *conn) roundTrip(apiKey, apiVersion int16, body []byte) (*parser, error) {
+	c.correlationID++
+	header := &builder{}
+	header.int16(apiKey)
+	header.int16(apiVersion)
+	header.int32(c.correlationID)
+	header.string(c.clientID)
+
+	frame := &builder{}
+	frame.int32(int32(len(header.buf) + len(body)))
+	frame.buf = append(frame.buf, header.buf...)
+	frame.buf = append(frame.buf, body...)
+
+	c.netConn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.netConn.SetDeadline(time.Time{})
+	if _, err := c.netConn.Write(frame.buf); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	p := &parser{buf: resp}
+	if id := p.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("%w: correlation id %d, expected %d", ErrProtocol, id, c.correlationID)
+	}
+	return p, nil
+}
@@ -0,0 +1,322 @@
+// Package mediaconvert offloads transcoding to AWS Elemental MediaConvert
+package mediaconvert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"imersaofc/internal/awsauth"
+	"imersaofc/internal/converter"
+	"imersaofc/internal/storage"
+)
+
+const apiVersion = "2017-08-29"
+
+// Config configures the MediaConvert transcoder
+type Config struct {
+	Region       string
+	Endpoint     string // account endpoint; empty uses the regional endpoint
+	RoleARN      string // IAM role MediaConvert assumes to read and write the bucket
+	Queue        string // queue ARN; empty uses the default queue
+	Prefix       string // key prefix for the job files in the staging bucket
+	PollInterval time.Duration
+	Timeout      time.Duration // how long to wait for a job before giving up
+}
+
+// Transcoder runs conversion jobs on MediaConvert, staging the source and
+// the output through an S3 bucket
+type Transcoder struct {
+	cfg     Config
+	creds   awsauth.Credentials
+	staging *storage.S3Uploader
+	client  *http.Client
+}
+
+// New creates a new instance of Transcoder; staging is the bucket
+// MediaConvert reads the source from and writes the output to
+func New(cfg Config, creds awsauth.Credentials, staging *storage.S3Uploader) (*Transcoder, error) {
+	if cfg.Region == "" || cfg.RoleARN == "" {
+		return nil, fmt.Errorf("mediaconvert region and role are required")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://mediaconvert.%s.amazonaws.com", cfg.Region)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 15 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Hour
+	}
+	return &Transcoder{
+		cfg:     cfg,
+		creds:   creds,
+		staging: staging,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Name identifies the transcoder in logs
+func (t *Transcoder) Name() string { return "mediaconvert" }
+
+// Transcode uploads the merged file, runs a DASH job on MediaConvert and
+// downloads the output into job.OutputDir. The staged files are removed
+// afterwards whether the job succeeded or not.
+func (t *Transcoder) Transcode(ctx context.Context, job *converter.Job) error {
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.Timeout)
+	defer cancel()
+
+	base := path.Join(t.cfg.Prefix, strconv.Itoa(job.Task.VideoID), strconv.FormatInt(time.Now().UnixNano(), 10))
+	inputKey := path.Join(base, "input", filepath.Base(job.MergedFile))
+	outputPrefix := path.Join(base, "output") + "/"
+	defer t.cleanup(base)
+
+	slog.Info("Staging source for mediaconvert", slog.String("key", inputKey))
+	if err := t.staging.Upload(ctx, job.MergedFile, inputKey); err != nil {
+		return fmt.Errorf("failed to stage source for mediaconvert: %w", err)
+	}
+
+	settings := jobSettings(
+		"s3://"+t.staging.Bucket()+"/"+inputKey,
+		"s3://"+t.staging.Bucket()+"/"+outputPrefix+strings.TrimSuffix(filepath.Base(job.Manifest), ".mpd"),
+		job,
+	)
+	id, err := t.createJob(ctx, job.Task.VideoID, settings)
+	if err != nil {
+		return err
+	}
+	slog.Info("Mediaconvert job created", slog.Int("video_id", job.Task.VideoID), slog.String("job_id", id))
+
+	if err := t.wait(ctx, id); err != nil {
+		return err
+	}
+
+	keys, err := t.staging.List(ctx, outputPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list mediaconvert output: %w", err)
+	}
+	for _, key := range keys {
+		local := filepath.Join(job.OutputDir, filepath.FromSlash(strings.TrimPrefix(key, outputPrefix)))
+		if err := t.staging.Download(ctx, key, local); err != nil {
+			return fmt.Errorf("failed to download mediaconvert output: %w", err)
+		}
+	}
+	return nil
+}
+
+// mcJob is the part of a MediaConvert job this client reads
+type mcJob struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	ErrorCode    int    `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// createJob submits the job and returns its id
+func (t *Transcoder) createJob(ctx context.Context, videoID int, settings map[string]interface{}) (string, error) {
+	body := map[string]interface{}{
+		"role":         t.cfg.RoleARN,
+		"settings":     settings,
+		"userMetadata": map[string]string{"video_id": strconv.Itoa(videoID)},
+	}
+	if t.cfg.Queue != "" {
+		body["queue"] = t.cfg.Queue
+	}
+	var resp struct {
+		Job mcJob `json:"job"`
+	}
+	if err := t.call(ctx, http.MethodPost, "/"+apiVersion+"/jobs", body, &resp); err != nil {
+		return "", fmt.Errorf("failed to create mediaconvert job: %w", err)
+	}
+	return resp.Job.ID, nil
+}
+
+// wait polls the job until it finishes
+func (t *Transcoder) wait(ctx context.Context, id string) error {
+	ticker := time.NewTicker(t.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		var resp struct {
+			Job mcJob `json:"job"`
+		}
+		if err := t.call(ctx, http.MethodGet, "/"+apiVersion+"/jobs/"+id, nil, &resp); err != nil {
+			return fmt.Errorf("failed to get mediaconvert job %s: %w", id, err)
+		}
+		switch resp.Job.Status {
+		case "COMPLETE":
+			return nil
+		case "ERROR":
+			return fmt.Errorf("%w: mediaconvert job %s failed: %d %s",
+				converter.ErrTranscodeRejected, id, resp.Job.ErrorCode, resp.Job.ErrorMessage)
+		case "CANCELED":
+			return fmt.Errorf("mediaconvert job %s was canceled", id)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for mediaconvert job %s: %w", id, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// call sends a signed request to the MediaConvert API and decodes the response into out
+func (t *Transcoder) call(ctx context.Context, method, apiPath string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, t.cfg.Endpoint+apiPath, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := awsauth.Sign(req, t.creds, t.cfg.Region, "mediaconvert", time.Now()); err != nil {
+		return err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// cleanup removes the staged source and output; failures are only logged
+func (t *Transcoder) cleanup(base string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	keys, err := t.staging.List(ctx, base+"/")
+	if err != nil {
+		slog.Warn("Error listing mediaconvert staging files", slog.String("prefix", base), slog.String("error", err.Error()))
+		return
+	}
+	for _, key := range keys {
+		if err := t.staging.Delete(ctx, key); err != nil {
+			slog.Warn("Error removing mediaconvert staging file", slog.String("key", key), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// jobSettings builds a DASH output group equivalent to the local ffmpeg
+// output, with the job's profile applied to the video rendition
+func jobSettings(input, destination string, job *converter.Job) map[string]interface{} {
+	profile := job.Profile
+	if profile.VideoFilter != "" || profile.AudioFilter != "" {
+		slog.Warn("Mediaconvert doesn't apply the profile's ffmpeg filters", slog.Int("video_id", job.Task.VideoID), slog.String("profile", profile.Name))
+	}
+
+	h264 := map[string]interface{}{
+		"rateControlMode": "QVBR",
+		"maxBitrate":      parseBitrate(profile.VideoBitrate, 5000000),
+		"qvbrSettings":    map[string]interface{}{"qvbrQualityLevel": 7},
+	}
+	video := map[string]interface{}{
+		"codecSettings": map[string]interface{}{"codec": "H_264", "h264Settings": h264},
+	}
+	if profile.Height > 0 {
+		video["height"] = profile.Height
+	}
+	if profile.Width > 0 {
+		video["width"] = profile.Width
+	}
+	if profile.Width > 0 && profile.Height > 0 {
+		video["scalingBehavior"] = scalingBehavior(profile.AspectPolicy)
+	}
+	outputs := []interface{}{
+		map[string]interface{}{
+			"nameModifier":      "_video",
+			"containerSettings": map[string]interface{}{"container": "MPD"},
+			"videoDescription":  video,
+		},
+	}
+
+	inputSettings := map[string]interface{}{
+		"fileInput":     input,
+		"videoSelector": map[string]interface{}{},
+	}
+	if job.Probe == nil || job.Probe.AudioStream() != nil {
+		inputSettings["audioSelectors"] = map[string]interface{}{
+			"Audio Selector 1": map[string]interface{}{"defaultSelection": "DEFAULT"},
+		}
+		outputs = append(outputs, map[string]interface{}{
+			"nameModifier":      "_audio",
+			"containerSettings": map[string]interface{}{"container": "MPD"},
+			"audioDescriptions": []interface{}{map[string]interface{}{
+				"audioSourceName": "Audio Selector 1",
+				"codecSettings": map[string]interface{}{
+					"codec": "AAC",
+					"aacSettings": map[string]interface{}{
+						"bitrate":    parseBitrate(profile.AudioBitrate, 128000),
+						"codingMode": "CODING_MODE_2_0",
+						"sampleRate": 48000,
+					},
+				},
+			}},
+		})
+	}
+
+	return map[string]interface{}{
+		"inputs": []interface{}{inputSettings},
+		"outputGroups": []interface{}{map[string]interface{}{
+			"name": "DASH ISO",
+			"outputGroupSettings": map[string]interface{}{
+				"type": "DASH_ISO_GROUP_SETTINGS",
+				"dashIsoGroupSettings": map[string]interface{}{
+					"destination":    destination,
+					"segmentLength":  4,
+					"fragmentLength": 2,
+				},
+			},
+			"outputs": outputs,
+		}},
+	}
+}
+
+// parseBitrate converts an ffmpeg style bitrate such as "2500k" or "3M" to
+// bits per second, returning def when it's empty or invalid
+func parseBitrate(s string, def int) int {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		multiplier, s = 1000, s[:len(s)-1]
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		multiplier, s = 1000000, s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return def
+	}
+	return int(v * float64(multiplier))
+}
+
+// scalingBehavior maps a profile's aspect policy to MediaConvert's
+func scalingBehavior(policy string) string {
+	switch policy {
+	case converter.AspectPad:
+		return "DEFAULT"
+	case converter.AspectCrop:
+		return "FILL"
+	default:
+		return "FIT_NO_UPSCALE"
+	}
+}
@@ -0,0 +1,356 @@
+// Package metrics exposes pipeline metrics to Prometheus, written in its
+// text exposition format, or in OpenMetrics with exemplars when the scraper
+// accepts it
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imersaofc/internal/events"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the stage duration
+// histogram: from quick merges to hour-long encodes
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+const (
+	// openMetricsType is the content type of scrapes in OpenMetrics
+	openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	// maxExemplarRunes is how long the labels of an exemplar may be in
+	// OpenMetrics, names and values together
+	maxExemplarRunes = 128
+)
+
+// Histogram counts observations in cumulative buckets per set of label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is the histogram of one set of label values
+type series struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+	// exemplars are the latest observation with an exemplar of each
+	// bucket, +Inf last
+	exemplars []*exemplar
+}
+
+// exemplar is an observation linked to what it was observed for, such as
+// the job of a task duration
+type exemplar struct {
+	labels string
+	value  float64
+	at     time.Time
+}
+
+// NewHistogram creates a new instance of Histogram with the bucket upper
+// bounds, which must be sorted, and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+}
+
+// Observe adds a value to the series of the label values, given in the
+// order of the histogram's label names
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.ObserveWithExemplar(value, nil, labelValues...)
+}
+
+// ObserveWithExemplar adds a value like Observe and keeps it as the
+// exemplar of its bucket, labeled with the exemplar labels. Labels beyond
+// what OpenMetrics allows an exemplar are dropped, the longest first.
+func (h *Histogram) ObserveWithExemplar(value float64, exemplarLabels map[string]string, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{
+			values:    labelValues,
+			counts:    make([]uint64, len(h.buckets)),
+			exemplars: make([]*exemplar, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	bucket := len(h.buckets)
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			bucket = min(bucket, i)
+		}
+	}
+	s.count++
+	s.sum += value
+	if len(exemplarLabels) > 0 {
+		s.exemplars[bucket] = &exemplar{labels: exemplarPairs(exemplarLabels), value: value, at: time.Now()}
+	}
+}
+
+// exemplarPairs formats the labels of an exemplar by name, keeping the
+// shortest ones that fit
+func exemplarPairs(labels map[string]string) string {
+	runes := make(map[string]int, len(labels))
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		runes[name] = len([]rune(name)) + len([]rune(value))
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if runes[names[i]] != runes[names[j]] {
+			return runes[names[i]] < runes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	length := 0
+	for i, name := range names {
+		if length+runes[name] > maxExemplarRunes {
+			names = names[:i]
+			break
+		}
+		length += runes[name]
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// write writes the histogram in the text exposition format, or in
+// OpenMetrics with the exemplars of its buckets, its series sorted so
+// scrapes are stable
+func (h *Histogram) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %d%s\n", h.name, h.labelPairs(s.values, formatFloat(bound)), s.counts[i],
+				s.exemplarSuffix(i, openMetrics))
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d%s\n", h.name, h.labelPairs(s.values, "+Inf"), s.count,
+			s.exemplarSuffix(len(h.buckets), openMetrics))
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, h.labelPairs(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, h.labelPairs(s.values, ""), s.count)
+	}
+}
+
+// labelPairs formats the label values, followed by the le label unless empty
+func (h *Histogram) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(h.labels)+1)
+	for i, name := range h.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"="+strconv.Quote(value))
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// exemplarSuffix formats the exemplar of a bucket for OpenMetrics, empty
+// without one or in the text exposition format, which has none
+func (s *series) exemplarSuffix(bucket int, openMetrics bool) string {
+	e := s.exemplars[bucket]
+	if !openMetrics || e == nil {
+		return ""
+	}
+	return fmt.Sprintf(" # {%s} %s %s", e.labels, formatFloat(e.value),
+		strconv.FormatFloat(float64(e.at.UnixMilli())/1000, 'f', 3, 64))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Gauge holds the latest value per set of label values
+type Gauge struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*gaugeValue
+}
+
+// gaugeValue is the value of one set of label values
+type gaugeValue struct {
+	labels []string
+	value  float64
+}
+
+// NewGauge creates a new instance of Gauge with the label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{name: name, help: help, labels: labels, values: map[string]*gaugeValue{}}
+}
+
+// Set sets the value of the label values, given in the order of the
+// gauge's label names
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = &gaugeValue{labels: labelValues, value: value}
+}
+
+// write writes the gauge, its values sorted so scrapes are stable; gauges
+// are the same in both formats
+func (g *Gauge) write(w io.Writer, openMetrics bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range keys {
+		v := g.values[key]
+		pairs := make([]string, 0, len(g.labels))
+		for i, name := range g.labels {
+			value := ""
+			if i < len(v.labels) {
+				value = v.labels[i]
+			}
+			pairs = append(pairs, name+"="+strconv.Quote(value))
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, strings.Join(pairs, ","), formatFloat(v.value))
+	}
+}
+
+// Collector is a metric a Registry serves, a Histogram or a Gauge
+type Collector interface {
+	write(w io.Writer, openMetrics bool)
+}
+
+// Registry serves its metrics to Prometheus scrapes
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates a new instance of Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a metric to the scrapes
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP writes every registered metric, in OpenMetrics when the
+// Accept header asks for it
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := r.collectors
+	r.mu.Unlock()
+	openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsType)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	for _, c := range collectors {
+		c.write(w, openMetrics)
+	}
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// Stages records how long each pipeline stage takes, by stage and, for
+// the stage encoding it, by rendition, and how long whole tasks take by
+// profile, so canary profiles can be compared with the ones they replace;
+// task durations carry the video and labels of the task as exemplars
+type Stages struct {
+	durations *Histogram
+	tasks     *Histogram
+}
+
+// NewStages creates a new instance of Stages registered with r
+func NewStages(r *Registry) *Stages {
+	durations := NewHistogram("videoconverter_stage_duration_seconds",
+		"Duration of the pipeline stages that succeeded.",
+		DurationBuckets, "stage", "rendition")
+	tasks := NewHistogram("videoconverter_task_duration_seconds",
+		"Duration of the tasks that succeeded.",
+		DurationBuckets, "profile", "mode")
+	r.Register(durations)
+	r.Register(tasks)
+	return &Stages{durations: durations, tasks: tasks}
+}
+
+// Record is an events.Subscriber observing completed stages and tasks
+func (s *Stages) Record(e events.Event) {
+	switch e := e.(type) {
+	case events.StageCompleted:
+		s.durations.Observe(e.Duration.Seconds(), e.Stage, e.Rendition)
+	case events.TaskSucceeded:
+		exemplar := map[string]string{"video_id": strconv.Itoa(e.VideoID)}
+		for name, value := range e.Labels {
+			if name != "video_id" {
+				exemplar[name] = value
+			}
+		}
+		s.tasks.ObserveWithExemplar(e.Duration.Seconds(), exemplar, e.Profile, e.Mode)
+	}
+}
+
+// Queues exposes the backlog of the consumed queues, so autoscalers can
+// add workers before tasks wait too long
+type Queues struct {
+	depth     *Gauge
+	oldestAge *Gauge
+}
+
+// NewQueues creates a new instance of Queues registered with r
+func NewQueues(r *Registry) *Queues {
+	depth := NewGauge("videoconverter_queue_depth",
+		"Messages ready in the queue, not yet delivered.", "queue")
+	oldestAge := NewGauge("videoconverter_queue_oldest_message_age_seconds",
+		"Age of the oldest message of the queue not yet processed.", "queue")
+	r.Register(depth)
+	r.Register(oldestAge)
+	return &Queues{depth: depth, oldestAge: oldestAge}
+}
+
+// Set records the latest backlog of a queue
+func (q *Queues) Set(queue string, depth int, oldestAge time.Duration) {
+	q.depth.Set(float64(depth), queue)
+	q.oldestAge.Set(oldestAge.Seconds(), queue)
+}
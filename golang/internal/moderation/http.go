@@ -0,0 +1,65 @@
+// Package moderation classifies sampled frames for the converter's
+// moderation stage
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTPClassifier posts each frame as image/jpeg to a classification
+// service, such as an NSFW model behind a small HTTP wrapper, which
+// answers with a JSON object of scores from 0 to 1 by label:
+//
+//	{"nsfw": 0.02, "violence": 0.1}
+type HTTPClassifier struct {
+	URL string
+	// Token, when set, is sent as a bearer token
+	Token string
+	// Client is a client with a 30 second timeout when nil
+	Client *http.Client
+}
+
+// Name implements converter.Classifier
+func (c HTTPClassifier) Name() string { return "http" }
+
+// Classify implements converter.Classifier
+func (c HTTPClassifier) Classify(ctx context.Context, frame string) (map[string]float64, error) {
+	f, err := os.Open(frame)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, f)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call classifier: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("classifier returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var scores map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&scores); err != nil {
+		return nil, fmt.Errorf("failed to decode classifier response: %w", err)
+	}
+	return scores, nil
+}
@@ -0,0 +1,51 @@
+// Package oauth caches OAuth2 access tokens, whichever way the cloud
+// issuing them is asked for one
+package oauth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenSource provides OAuth2 access tokens
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// Token is an OAuth2 token endpoint response
+type Token struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Cache returns a TokenSource caching the tokens fetch returns until
+// shortly before they expire
+func Cache(fetch func(ctx context.Context) (Token, error)) TokenSource {
+	return &cachedToken{fetch: fetch}
+}
+
+// cachedToken caches an access token until shortly before it expires
+type cachedToken struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+	fetch   func(ctx context.Context) (Token, error)
+}
+
+// Token returns the cached token or fetches a new one
+func (c *cachedToken) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+	resp, err := c.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = resp.AccessToken
+	c.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
@@ -0,0 +1,79 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var fetches atomic.Int32
+	tokens := Cache(func(ctx context.Context) (Token, error) {
+		n := fetches.Add(1)
+		return Token{AccessToken: "token-" + string(rune('0'+n)), ExpiresIn: 3600}, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		token, err := tokens.Token(context.Background())
+		if err != nil || token != "token-1" {
+			t.Fatalf("Token() = %q, %v, want token-1", token, err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched %d tokens, want 1", n)
+	}
+
+	// A token is refreshed a minute before it expires
+	tokens.(*cachedToken).expires = time.Now().Add(-time.Second)
+	if token, _ := tokens.Token(context.Background()); token != "token-2" {
+		t.Errorf("Token() after expiry = %q, want token-2", token)
+	}
+	if expires := tokens.(*cachedToken).expires; time.Until(expires) > 59*time.Minute {
+		t.Errorf("token cached until %v, want a minute before it expires", expires)
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	errUnavailable := errors.New("metadata server unavailable")
+	fail := true
+	tokens := Cache(func(ctx context.Context) (Token, error) {
+		if fail {
+			return Token{}, errUnavailable
+		}
+		return Token{AccessToken: "token", ExpiresIn: 3600}, nil
+	})
+	if _, err := tokens.Token(context.Background()); !errors.Is(err, errUnavailable) {
+		t.Fatalf("Token() error = %v, want %v", err, errUnavailable)
+	}
+	// Failures aren't cached
+	fail = false
+	if token, err := tokens.Token(context.Background()); err != nil || token != "token" {
+		t.Errorf("Token() after a failure = %q, %v, want token", token, err)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	var fetches atomic.Int32
+	tokens := Cache(func(ctx context.Context) (Token, error) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return Token{AccessToken: "token", ExpiresIn: 3600}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := tokens.Token(context.Background()); err != nil || token != "token" {
+				t.Errorf("Token() = %q, %v", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("concurrent callers fetched %d tokens, want 1", n)
+	}
+}
@@ -0,0 +1,229 @@
+// Package outbox stores completion events in the outbox_events table with
+// the conversion they report and relays them to Kafka afterwards, so an
+// event is never lost to a broker outage.
+//
+// Events are delivered at least once: a relay that crashes between
+// producing events and marking them published produces them again.
+// Consumers drop the duplicates by the id in EventIDHeader. Signed events
+// are signed when added to the outbox, so a duplicate carries the same
+// signature, and one read long after, by a lagging consumer, is as old as
+// the conversion: consumers verify them with a negative
+// signing.Verifier.Tolerance and rely on the event id against replays.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/database"
+	"imersaofc/internal/kafka"
+	"imersaofc/internal/signing"
+)
+
+// DefaultTopic is the topic completion events are relayed to
+const DefaultTopic = "video.converted"
+
+// EventIDHeader is the record header carrying the event's unique id,
+// which consumers drop duplicates by
+const EventIDHeader = "event_id"
+
+// Record headers of a signed event, see signing.Signature
+const (
+	SignatureKeyIDHeader     = "signature_key_id"
+	SignatureTimestampHeader = "signature_timestamp"
+	SignatureHeader          = "signature"
+)
+
+// Publisher is a converter.OutboxPublisher adding completion events to
+// the outbox, keyed by video id, in the transaction recording the
+// conversion. An event is identified by its video and output version, so
+// adding it again, e.g. when a task is reprocessed, doesn't add a second
+// one.
+type Publisher struct {
+	db     *database.DB
+	topic  string
+	signer *signing.Signer
+}
+
+// NewPublisher creates a new instance of Publisher writing events for
+// topic, signed by signer unless nil
+func NewPublisher(db *database.DB, topic string, signer *signing.Signer) *Publisher {
+	return &Publisher{db: db, topic: topic, signer: signer}
+}
+
+// OutboxEvent builds the outbox event of a completion event, signing it
+func (p *Publisher) OutboxEvent(ctx context.Context, event converter.CompletionEvent) (converter.OutboxEvent, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return converter.OutboxEvent{}, err
+	}
+	e := converter.OutboxEvent{
+		EventID: fmt.Sprintf("%s/%d/%d", p.topic, event.VideoID, event.Version),
+		Topic:   p.topic,
+		Key:     strconv.Itoa(event.VideoID),
+		Payload: payload,
+	}
+	if p.signer != nil {
+		sig, err := p.signer.Sign(ctx, payload)
+		if err != nil {
+			return converter.OutboxEvent{}, err
+		}
+		e.Headers = map[string]string{
+			SignatureKeyIDHeader:     sig.KeyID,
+			SignatureTimestampHeader: strconv.FormatInt(sig.Timestamp, 10),
+			SignatureHeader:          sig.Algorithm + "=" + sig.Value,
+		}
+	}
+	return e, nil
+}
+
+// Publish adds the event to the outbox on its own, for callers outside the
+// converter's record stage
+func (p *Publisher) Publish(ctx context.Context, event converter.CompletionEvent) error {
+	e, err := p.OutboxEvent(ctx, event)
+	if err != nil {
+		return err
+	}
+	return converter.SaveOutboxEvent(ctx, p.db, e)
+}
+
+// Producer writes records to a Kafka topic
+type Producer interface {
+	Produce(ctx context.Context, topic string, msgs ...kafka.Message) error
+}
+
+// RelayConfig configures a Relay
+type RelayConfig struct {
+	// Interval is how often the outbox is polled, 1s when zero
+	Interval time.Duration
+	// BatchSize is how many events are relayed per poll, 100 when zero
+	BatchSize int
+}
+
+// Relay produces the outbox events to Kafka in the order they were added
+// and marks them published. Each batch is locked while it is relayed, so
+// relays running side by side against Postgres or MySQL skip each other's
+// events rather than produce them twice, though the events of a video may
+// then be produced out of order. SQLite has no row locks: only one relay
+// should run against it.
+type Relay struct {
+	db       *database.DB
+	producer Producer
+	cfg      RelayConfig
+}
+
+// NewRelay creates a new instance of Relay
+func NewRelay(db *database.DB, producer Producer, cfg RelayConfig) *Relay {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	return &Relay{db: db, producer: producer, cfg: cfg}
+}
+
+// Run relays events until ctx is done. Failures are logged and retried on
+// the next poll, starting from the oldest unpublished event, so the
+// events of a video keep their order.
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := r.RelayBatch(ctx)
+			if err != nil {
+				slog.Error("Error relaying outbox events", slog.String("error", err.Error()))
+			}
+			if err != nil || n < r.cfg.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// pending is an outbox event waiting to be relayed
+type pending struct {
+	id      int64
+	eventID string
+	topic   string
+	key     string
+	payload string
+	headers sql.NullString
+}
+
+// RelayBatch relays the oldest unpublished events and returns how many.
+// The events are locked until those produced are marked published, all at
+// once: events produced before a failure to mark them are produced again.
+func (r *Relay) RelayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := r.db.Rebind(`SELECT id, event_id, topic, event_key, payload, headers FROM outbox_events
+		WHERE published_at IS NULL ORDER BY id LIMIT ? ` + r.db.Dialect.SkipLocked())
+	rows, err := tx.QueryContext(ctx, query, r.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var events []pending
+	for rows.Next() {
+		var e pending
+		if err := rows.Scan(&e.id, &e.eventID, &e.topic, &e.key, &e.payload, &e.headers); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Events produced are marked even when a later one fails, so they
+	// aren't produced again on the next poll
+	var relayed int
+	var relayErr error
+	update := r.db.Rebind("UPDATE outbox_events SET published_at = ? WHERE id = ?")
+	for _, e := range events {
+		msg := kafka.Message{
+			Key:     []byte(e.key),
+			Value:   []byte(e.payload),
+			Headers: map[string]string{},
+		}
+		if e.headers.Valid {
+			if err := json.Unmarshal([]byte(e.headers.String), &msg.Headers); err != nil {
+				relayErr = fmt.Errorf("event %s: invalid headers: %w", e.eventID, err)
+				break
+			}
+		}
+		msg.Headers[EventIDHeader] = e.eventID
+		if err := r.producer.Produce(ctx, e.topic, msg); err != nil {
+			relayErr = fmt.Errorf("event %s: %w", e.eventID, err)
+			break
+		}
+		if _, err := tx.ExecContext(ctx, update, time.Now(), e.id); err != nil {
+			relayErr = fmt.Errorf("event %s was produced but not marked published: %w", e.eventID, err)
+			break
+		}
+		relayed++
+		slog.Info("Outbox event relayed", slog.String("event_id", e.eventID), slog.String("topic", e.topic))
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%d events were produced but not marked published: %w", relayed, err)
+	}
+	return relayed, relayErr
+}
@@ -0,0 +1,186 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/database"
+	"imersaofc/internal/kafka"
+	"imersaofc/internal/signing"
+)
+
+// openTestDB opens an in-memory SQLite database with the schema
+func openTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	// Every connection to :memory: is a database of its own, keep just one
+	db, err := database.Open("sqlite", ":memory:", database.PoolConfig{MaxOpenConns: 1, MaxIdleConns: 1}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.EnsureSchema(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// produced is a message the fake producer wrote
+type produced struct {
+	topic string
+	kafka.Message
+}
+
+// fakeProducer records the messages it produces and fails the calls in
+// fail, counted from 1
+type fakeProducer struct {
+	calls    int
+	fail     map[int]bool
+	produced []produced
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	p.calls++
+	if p.fail[p.calls] {
+		return errors.New("kafka: broker error 7")
+	}
+	for _, msg := range msgs {
+		p.produced = append(p.produced, produced{topic: topic, Message: msg})
+	}
+	return nil
+}
+
+// unpublished returns the event ids of the unpublished events
+func unpublished(t *testing.T, db *database.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT event_id FROM outbox_events WHERE published_at IS NULL ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestPublisher(t *testing.T) {
+	db := openTestDB(t)
+	signer := signing.NewSigner(func(context.Context) (signing.Key, error) {
+		return signing.Key{ID: "2024-05", Algorithm: signing.HMACSHA256, Secret: []byte("secret")}, nil
+	})
+	p := NewPublisher(db, DefaultTopic, signer)
+	event := converter.CompletionEvent{VideoID: 3, Status: "completed", Version: 2}
+	// Reprocessing a task adds the same event again
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	if got, want := unpublished(t, db), []string{"video.converted/3/2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("outbox = %v, want %v", got, want)
+	}
+
+	var key, payload, headers string
+	db.QueryRow("SELECT event_key, payload, headers FROM outbox_events").Scan(&key, &payload, &headers)
+	if key != "3" {
+		t.Errorf("event key = %q, want the video id", key)
+	}
+	var h map[string]string
+	if err := json.Unmarshal([]byte(headers), &h); err != nil {
+		t.Fatalf("invalid headers %q: %v", headers, err)
+	}
+	algorithm, value, _ := strings.Cut(h[SignatureHeader], "=")
+	timestamp, _ := strconv.ParseInt(h[SignatureTimestampHeader], 10, 64)
+	sig := signing.Signature{KeyID: h[SignatureKeyIDHeader], Algorithm: algorithm, Timestamp: timestamp, Value: value}
+	verifier := signing.Verifier{Secrets: map[string][]byte{"2024-05": []byte("secret")}, Tolerance: -1}
+	if err := verifier.Verify(sig, []byte(payload)); err != nil {
+		t.Errorf("stored signature doesn't verify: %v", err)
+	}
+}
+
+func TestRelayBatch(t *testing.T) {
+	db := openTestDB(t)
+	p := NewPublisher(db, DefaultTopic, nil)
+	for _, id := range []int{1, 2, 1} {
+		event := converter.CompletionEvent{VideoID: id, Status: "completed", Version: len(unpublished(t, db))}
+		if err := p.Publish(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	producer := &fakeProducer{fail: map[int]bool{2: true}}
+	relay := NewRelay(db, producer, RelayConfig{BatchSize: 2})
+
+	// The events produced before a failure are marked published
+	n, err := relay.RelayBatch(context.Background())
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "video.converted/2/1") {
+		t.Fatalf("RelayBatch() = %d, %v, want 1 and the failed event", n, err)
+	}
+	if got, want := unpublished(t, db), []string{"video.converted/2/1", "video.converted/1/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unpublished = %v, want %v", got, want)
+	}
+
+	// The next poll starts over from the oldest unpublished event
+	if n, err := relay.RelayBatch(context.Background()); n != 2 || err != nil {
+		t.Fatalf("RelayBatch() = %d, %v, want 2", n, err)
+	}
+	if n, err := relay.RelayBatch(context.Background()); n != 0 || err != nil {
+		t.Errorf("RelayBatch() of an empty outbox = %d, %v", n, err)
+	}
+	if got := unpublished(t, db); len(got) != 0 {
+		t.Errorf("unpublished = %v, want none", got)
+	}
+
+	var ids []string
+	for _, msg := range producer.produced {
+		if msg.topic != DefaultTopic {
+			t.Errorf("produced to %s, want %s", msg.topic, DefaultTopic)
+		}
+		var event converter.CompletionEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil || string(msg.Key) != strconv.Itoa(event.VideoID) {
+			t.Errorf("produced %s with key %s", msg.Value, msg.Key)
+		}
+		ids = append(ids, msg.Headers[EventIDHeader])
+	}
+	if want := []string{"video.converted/1/0", "video.converted/2/1", "video.converted/1/2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("produced %v, want %v in order", ids, want)
+	}
+}
+
+func TestRelayBatchHeaders(t *testing.T) {
+	db := openTestDB(t)
+	events := []converter.OutboxEvent{
+		{EventID: "signed", Topic: "video.converted", Key: "1", Payload: []byte("{}"), Headers: map[string]string{SignatureKeyIDHeader: "2024-05"}},
+		{EventID: "broken", Topic: "video.converted", Key: "2", Payload: []byte("{}")},
+	}
+	for _, e := range events {
+		if err := converter.SaveOutboxEvent(context.Background(), db, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Exec("UPDATE outbox_events SET headers = 'not json' WHERE event_id = 'broken'")
+
+	producer := &fakeProducer{}
+	n, err := NewRelay(db, producer, RelayConfig{}).RelayBatch(context.Background())
+	if n != 1 || err == nil {
+		t.Fatalf("RelayBatch() = %d, %v, want 1 and an error for the invalid headers", n, err)
+	}
+	want := map[string]string{SignatureKeyIDHeader: "2024-05", EventIDHeader: "signed"}
+	if got := producer.produced[0].Headers; !reflect.DeepEqual(got, want) {
+		t.Errorf("headers = %v, want %v", got, want)
+	}
+	if got := unpublished(t, db); !reflect.DeepEqual(got, []string{"broken"}) {
+		t.Errorf("unpublished = %v, want the broken event", got)
+	}
+}
@@ -0,0 +1,160 @@
+// Package pubsub consumes and publishes conversion tasks through Google
+// Cloud Pub/Sub, over its REST API, for deployments on GCP
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"imersaofc/internal/gcpauth"
+)
+
+// DefaultEndpoint is the Pub/Sub REST endpoint
+const DefaultEndpoint = "https://pubsub.googleapis.com"
+
+// ClientConfig configures access to a Pub/Sub project
+type ClientConfig struct {
+	Project string
+	// CredentialsFile is a service account key; empty uses workload identity
+	CredentialsFile string
+	// Endpoint overrides DefaultEndpoint, e.g. "http://localhost:8085" for
+	// the emulator, which needs no credentials
+	Endpoint string
+}
+
+// Client calls the Pub/Sub REST API of a project
+type Client struct {
+	cfg    ClientConfig
+	client *http.Client
+	tokens gcpauth.TokenSource
+}
+
+// NewClient creates a new instance of Client
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if cfg.Project == "" {
+		return nil, fmt.Errorf("pubsub project is required")
+	}
+	c := &Client{cfg: cfg, client: &http.Client{Timeout: 90 * time.Second}}
+	if cfg.Endpoint == "" {
+		c.cfg.Endpoint = DefaultEndpoint
+		if cfg.CredentialsFile != "" {
+			key, rsaKey, err := gcpauth.LoadServiceAccount(cfg.CredentialsFile)
+			if err != nil {
+				return nil, err
+			}
+			c.tokens = gcpauth.NewServiceAccountTokenSource(c.client, key, rsaKey, gcpauth.ScopePubSub)
+		} else {
+			c.tokens = gcpauth.NewMetadataTokenSource(c.client)
+		}
+	}
+	c.cfg.Endpoint = strings.TrimSuffix(c.cfg.Endpoint, "/")
+	return c, nil
+}
+
+// Message is a message to publish
+type Message struct {
+	Data       []byte
+	Attributes map[string]string
+	// OrderingKey makes subscriptions with message ordering enabled
+	// deliver the messages sharing it in publishing order
+	OrderingKey string
+}
+
+// ReceivedMessage is a message pulled from a subscription
+type ReceivedMessage struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	// DeliveryAttempt is set when the subscription has a dead-letter policy
+	DeliveryAttempt int `json:"deliveryAttempt"`
+}
+
+// Publish publishes the message to the topic and returns its id
+func (c *Client) Publish(ctx context.Context, topic string, msg Message) (string, error) {
+	body := map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			"data":        base64.StdEncoding.EncodeToString(msg.Data),
+			"attributes":  msg.Attributes,
+			"orderingKey": msg.OrderingKey,
+		}},
+	}
+	var resp struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	if err := c.call(ctx, "topics/"+topic+":publish", body, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.MessageIDs) == 0 {
+		return "", fmt.Errorf("pubsub: publish to %s returned no message id", topic)
+	}
+	return resp.MessageIDs[0], nil
+}
+
+// Pull waits for up to max messages of the subscription
+func (c *Client) Pull(ctx context.Context, subscription string, max int) ([]ReceivedMessage, error) {
+	var resp struct {
+		ReceivedMessages []ReceivedMessage `json:"receivedMessages"`
+	}
+	err := c.call(ctx, "subscriptions/"+subscription+":pull", map[string]interface{}{"maxMessages": max}, &resp)
+	return resp.ReceivedMessages, err
+}
+
+// Acknowledge removes the messages from the subscription
+func (c *Client) Acknowledge(ctx context.Context, subscription string, ackIDs ...string) error {
+	return c.call(ctx, "subscriptions/"+subscription+":acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil)
+}
+
+// ModifyAckDeadline gives the messages deadline more time to be
+// acknowledged; a zero deadline makes them available for redelivery
+func (c *Client) ModifyAckDeadline(ctx context.Context, subscription string, deadline time.Duration, ackIDs ...string) error {
+	body := map[string]interface{}{"ackIds": ackIDs, "ackDeadlineSeconds": int(deadline.Seconds())}
+	return c.call(ctx, "subscriptions/"+subscription+":modifyAckDeadline", body, nil)
+}
+
+// call posts a JSON request to a method of a project resource and decodes
+// the response into out, when not nil
+func (c *Client) call(ctx context.Context, resource string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/v1/projects/%s/%s", c.cfg.Endpoint, c.cfg.Project, resource)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("pubsub: %s: %s: %s", resource, resp.Status, bytes.TrimSpace(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
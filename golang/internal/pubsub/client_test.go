@@ -0,0 +1,167 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is a call the fake Pub/Sub server received
+type request struct {
+	resource string
+	body     map[string]interface{}
+}
+
+// fakePubSub answers the REST calls of a project with canned responses
+// and records them
+type fakePubSub struct {
+	mu        sync.Mutex
+	requests  []request
+	responses map[string]string
+	failures  map[string]int
+}
+
+// newTestClient starts a fake Pub/Sub server and a client to its project
+func newTestClient(t *testing.T) (*Client, *fakePubSub) {
+	t.Helper()
+	fake := &fakePubSub{responses: map[string]string{}, failures: map[string]int{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client, err := NewClient(ClientConfig{Project: "videos", Endpoint: srv.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fake
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resource, ok := strings.CutPrefix(r.URL.Path, "/v1/projects/videos/")
+	if !ok || r.Method != http.MethodPost || r.Header.Get("Authorization") != "" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var body map[string]interface{}
+	data, _ := io.ReadAll(r.Body)
+	json.Unmarshal(data, &body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, request{resource: resource, body: body})
+	if status := f.failures[resource]; status != 0 {
+		http.Error(w, `{"error": {"status": "UNAVAILABLE"}}`, status)
+		return
+	}
+	resp, ok := f.responses[resource]
+	if !ok {
+		resp = "{}"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, resp)
+}
+
+// calls returns the resources called so far
+func (f *fakePubSub) calls() []request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]request(nil), f.requests...)
+}
+
+func TestPublish(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.responses["topics/tasks:publish"] = `{"messageIds": ["42"]}`
+
+	id, err := client.Publish(context.Background(), "tasks", Message{
+		Data:        []byte(`{"video_id": 3}`),
+		Attributes:  map[string]string{"content_type": "application/json"},
+		OrderingKey: "3",
+	})
+	if err != nil || id != "42" {
+		t.Fatalf("Publish() = %q, %v, want 42", id, err)
+	}
+	want := map[string]interface{}{"messages": []interface{}{map[string]interface{}{
+		"data":        "eyJ2aWRlb19pZCI6IDN9",
+		"attributes":  map[string]interface{}{"content_type": "application/json"},
+		"orderingKey": "3",
+	}}}
+	if got := fake.calls()[0].body; !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+
+	fake.responses["topics/tasks:publish"] = `{"messageIds": []}`
+	if _, err := client.Publish(context.Background(), "tasks", Message{}); err == nil {
+		t.Error("Publish() without a message id succeeded")
+	}
+}
+
+func TestPull(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.responses["subscriptions/tasks-sub:pull"] = `{"receivedMessages": [{
+		"ackId": "ack-1",
+		"message": {"data": "eyJ2aWRlb19pZCI6IDN9", "attributes": {"content_type": "application/json"},
+			"messageId": "42", "publishTime": "2024-05-01T10:00:00Z", "orderingKey": "3"},
+		"deliveryAttempt": 2
+	}]}`
+
+	msgs, err := client.Pull(context.Background(), "tasks-sub", 4)
+	if err != nil {
+		t.Fatalf("Pull() error = %v", err)
+	}
+	if got := fake.calls()[0].body["maxMessages"]; got != 4.0 {
+		t.Errorf("pulled maxMessages %v, want 4", got)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Pull() returned %d messages, want 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.AckID != "ack-1" || string(msg.Message.Data) != `{"video_id": 3}` || msg.Message.MessageID != "42" ||
+		msg.Message.OrderingKey != "3" || msg.DeliveryAttempt != 2 ||
+		!msg.Message.PublishTime.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Pull() = %+v", msg)
+	}
+}
+
+func TestAcknowledgeAndModifyAckDeadline(t *testing.T) {
+	client, fake := newTestClient(t)
+	if err := client.Acknowledge(context.Background(), "tasks-sub", "ack-1", "ack-2"); err != nil {
+		t.Fatalf("Acknowledge() error = %v", err)
+	}
+	if err := client.ModifyAckDeadline(context.Background(), "tasks-sub", 90*time.Second, "ack-3"); err != nil {
+		t.Fatalf("ModifyAckDeadline() error = %v", err)
+	}
+	want := []request{
+		{resource: "subscriptions/tasks-sub:acknowledge", body: map[string]interface{}{"ackIds": []interface{}{"ack-1", "ack-2"}}},
+		{resource: "subscriptions/tasks-sub:modifyAckDeadline", body: map[string]interface{}{"ackIds": []interface{}{"ack-3"}, "ackDeadlineSeconds": 90.0}},
+	}
+	if got := fake.calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %+v, want %+v", got, want)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.failures["subscriptions/tasks-sub:acknowledge"] = http.StatusServiceUnavailable
+	err := client.Acknowledge(context.Background(), "tasks-sub", "ack-1")
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "UNAVAILABLE") {
+		t.Errorf("Acknowledge() error = %v, want the status and body of the response", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient(ClientConfig{}); err == nil {
+		t.Error("NewClient() without a project succeeded")
+	}
+	client, err := NewClient(ClientConfig{Project: "videos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.cfg.Endpoint != DefaultEndpoint || client.tokens == nil {
+		t.Errorf("client of %s without tokens, want %s with workload identity", client.cfg.Endpoint, DefaultEndpoint)
+	}
+}
@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// ConsumerConfig configures the subscription tasks are consumed from
+type ConsumerConfig struct {
+	Subscription string
+	// Consumers is how many tasks are converted at the same time, 1 when zero
+	Consumers int
+	// AckDeadline is how long each extension of a message's ack deadline
+	// lasts while it is converted, 60s when zero and at most 10 minutes.
+	// Extensions are sent at half of it, so long encodes are not
+	// redelivered to another worker.
+	AckDeadline time.Duration
+	// DeadLetterTopic receives the tasks that failed permanently, which
+	// are then acknowledged. Without it they are only acknowledged; their
+	// failure is in the error log. Tasks to retry are nacked, so the
+	// subscription's retry and dead-letter policies apply to them.
+	DeadLetterTopic string
+
+	// ReconnectMin and ReconnectMax bound the exponential backoff after
+	// failed pulls, 1s and 30s when zero
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// OnPause is called when pulling starts failing, and OnResume once a
+	// pull succeeds again
+	OnPause  func(err error)
+	OnResume func()
+}
+
+// Consumer delivers conversion tasks pulled from a subscription to a
+// handler and settles each message according to the handler's result.
+// Tasks are published with the video id as ordering key, see Enqueuer, so
+// a subscription with message ordering enabled never converts two tasks
+// of a video at the same time.
+type Consumer struct {
+	client *Client
+	cfg    ConsumerConfig
+	handle func(ctx context.Context, msg []byte) converter.Result
+	paused atomic.Bool
+}
+
+// NewConsumer creates a new instance of Consumer
+func NewConsumer(client *Client, cfg ConsumerConfig, handle func(ctx context.Context, msg []byte) converter.Result) *Consumer {
+	if cfg.AckDeadline <= 0 {
+		cfg.AckDeadline = time.Minute
+	}
+	cfg.AckDeadline = min(cfg.AckDeadline, 10*time.Minute)
+	return &Consumer{client: client, cfg: cfg, handle: handle}
+}
+
+// Paused reports whether pulling is failing
+func (c *Consumer) Paused() bool {
+	return c.paused.Load()
+}
+
+// Serve pulls and converts tasks until ctx is done, backing off while
+// Pub/Sub can't be reached. It waits for the tasks being converted before
+// returning.
+func (c *Consumer) Serve(ctx context.Context) error {
+	minBackoff := c.cfg.ReconnectMin
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	maxBackoff := c.cfg.ReconnectMax
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	consumers := max(c.cfg.Consumers, 1)
+	slots := make(chan struct{}, consumers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slog.Info("Consuming tasks", slog.String("subscription", c.cfg.Subscription), slog.Int("consumers", consumers))
+
+	backoff := minBackoff
+	for {
+		// Only pull as many messages as there are free consumers, the
+		// others would wait with their ack deadline running
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case slots <- struct{}{}:
+		}
+		free := 1
+		for len(slots) < cap(slots) {
+			slots <- struct{}{}
+			free++
+		}
+
+		msgs, err := c.client.Pull(ctx, c.cfg.Subscription, free)
+		for i := len(msgs); i < free; i++ {
+			<-slots
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if c.paused.CompareAndSwap(false, true) {
+				slog.Warn("Consumer paused, Pub/Sub unavailable", slog.String("subscription", c.cfg.Subscription), slog.String("error", err.Error()))
+				if c.cfg.OnPause != nil {
+					c.cfg.OnPause(err)
+				}
+			}
+			wait := time.Duration(rand.Int63n(int64(backoff))) + minBackoff/2
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		if c.paused.CompareAndSwap(true, false) {
+			slog.Info("Consumer resumed", slog.String("subscription", c.cfg.Subscription))
+			if c.cfg.OnResume != nil {
+				c.cfg.OnResume()
+			}
+		}
+
+		for _, msg := range msgs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				c.process(ctx, msg)
+			}()
+		}
+	}
+}
+
+// process converts one message, extending its ack deadline meanwhile, and
+// settles it. The conversion stops when ctx is done; settling uses its own
+// context so a shutdown doesn't leave a finished task unacknowledged.
+func (c *Consumer) process(ctx context.Context, msg ReceivedMessage) {
+	done := make(chan struct{})
+	go c.extendDeadline(msg.AckID, done)
+	result := c.handle(ctx, msg.Message.Data)
+	close(done)
+
+	settleCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.settle(settleCtx, msg, result); err != nil {
+		slog.Error("Error settling message",
+			slog.String("subscription", c.cfg.Subscription),
+			slog.String("message_id", msg.Message.MessageID),
+			slog.String("error", err.Error()))
+	}
+}
+
+// extendDeadline keeps the message leased until done is closed
+func (c *Consumer) extendDeadline(ackID string, done <-chan struct{}) {
+	ticker := time.NewTicker(c.cfg.AckDeadline / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.cfg.AckDeadline/2)
+			err := c.client.ModifyAckDeadline(ctx, c.cfg.Subscription, c.cfg.AckDeadline, ackID)
+			cancel()
+			if err != nil {
+				slog.Warn("Error extending ack deadline", slog.String("subscription", c.cfg.Subscription), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// settle acks, nacks or dead-letters the message
+func (c *Consumer) settle(ctx context.Context, msg ReceivedMessage, result converter.Result) error {
+	switch result.Outcome {
+	case converter.OutcomeSuccess:
+		return c.client.Acknowledge(ctx, c.cfg.Subscription, msg.AckID)
+	case converter.OutcomeRetry:
+		// A postponed task comes back once its ack deadline, set to the
+		// delay, runs out
+		delay := min(result.Delay, 10*time.Minute)
+		slog.Warn("Nacking task",
+			slog.String("message_id", msg.Message.MessageID),
+			slog.Duration("delay", delay),
+			slog.String("error", result.Err.Error()))
+		return c.client.ModifyAckDeadline(ctx, c.cfg.Subscription, delay, msg.AckID)
+	default:
+		slog.Error("Dead-lettering task", slog.String("message_id", msg.Message.MessageID), slog.String("error", result.Err.Error()))
+		if c.cfg.DeadLetterTopic != "" {
+			attrs := map[string]string{
+				"source_subscription": c.cfg.Subscription,
+				"source_message_id":   msg.Message.MessageID,
+				"error":               result.Err.Error(),
+			}
+			if msg.DeliveryAttempt > 0 {
+				attrs["delivery_attempt"] = strconv.Itoa(msg.DeliveryAttempt)
+			}
+			dead := Message{Data: msg.Message.Data, Attributes: attrs}
+			if _, err := c.client.Publish(ctx, c.cfg.DeadLetterTopic, dead); err != nil {
+				// Leave it unacknowledged, it is redelivered and fails again
+				return err
+			}
+		}
+		return c.client.Acknowledge(ctx, c.cfg.Subscription, msg.AckID)
+	}
+}
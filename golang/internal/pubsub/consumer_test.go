@@ -0,0 +1,196 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+func TestConsumerSettle(t *testing.T) {
+	errFailed := errors.New("ffmpeg failed")
+	tests := []struct {
+		name       string
+		deadLetter string
+		failures   map[string]int
+		result     converter.Result
+		want       []request
+		wantErr    bool
+	}{
+		{
+			name:   "success is acknowledged",
+			result: converter.Success(),
+			want:   []request{ack()},
+		},
+		{
+			name:   "retry is nacked",
+			result: converter.Retry(errFailed),
+			want:   []request{modifyAckDeadline(0)},
+		},
+		{
+			name:   "postponed task comes back after the delay",
+			result: converter.Defer(errFailed, 2*time.Minute),
+			want:   []request{modifyAckDeadline(120)},
+		},
+		{
+			name:   "delay is capped at the maximum ack deadline",
+			result: converter.Defer(errFailed, time.Hour),
+			want:   []request{modifyAckDeadline(600)},
+		},
+		{
+			name:   "permanent failure without a dead-letter topic is acknowledged",
+			result: converter.Permanent(errFailed),
+			want:   []request{ack()},
+		},
+		{
+			name:       "permanent failure is dead-lettered and acknowledged",
+			deadLetter: "tasks-dead",
+			result:     converter.Permanent(errFailed),
+			want:       []request{deadLetter(), ack()},
+		},
+		{
+			name:       "failed dead-letter leaves the message unacknowledged",
+			deadLetter: "tasks-dead",
+			failures:   map[string]int{"topics/tasks-dead:publish": http.StatusInternalServerError},
+			result:     converter.Permanent(errFailed),
+			want:       []request{deadLetter()},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, fake := newTestClient(t)
+			fake.responses["topics/tasks-dead:publish"] = `{"messageIds": ["43"]}`
+			for resource, status := range tt.failures {
+				fake.failures[resource] = status
+			}
+			c := NewConsumer(client, ConsumerConfig{Subscription: "tasks-sub", DeadLetterTopic: tt.deadLetter}, nil)
+
+			var msg ReceivedMessage
+			msg.AckID = "ack-1"
+			msg.Message.Data = []byte(`{"video_id": 3}`)
+			msg.Message.MessageID = "42"
+			msg.DeliveryAttempt = 5
+			if err := c.settle(context.Background(), msg, tt.result); (err != nil) != tt.wantErr {
+				t.Fatalf("settle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := fake.calls(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("calls = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func ack() request {
+	return request{resource: "subscriptions/tasks-sub:acknowledge", body: map[string]interface{}{"ackIds": []interface{}{"ack-1"}}}
+}
+
+func modifyAckDeadline(seconds float64) request {
+	return request{resource: "subscriptions/tasks-sub:modifyAckDeadline", body: map[string]interface{}{"ackIds": []interface{}{"ack-1"}, "ackDeadlineSeconds": seconds}}
+}
+
+func deadLetter() request {
+	return request{resource: "topics/tasks-dead:publish", body: map[string]interface{}{"messages": []interface{}{map[string]interface{}{
+		"data": "eyJ2aWRlb19pZCI6IDN9",
+		"attributes": map[string]interface{}{
+			"source_subscription": "tasks-sub",
+			"source_message_id":   "42",
+			"error":               "ffmpeg failed",
+			"delivery_attempt":    "5",
+		},
+		"orderingKey": "",
+	}}}}
+}
+
+func TestConsumerServe(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.responses["subscriptions/tasks-sub:pull"] = `{"receivedMessages": [{"ackId": "ack-1", "message": {"data": "eyJ2aWRlb19pZCI6IDN9", "messageId": "42"}}]}`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handled := make(chan string, 1)
+	c := NewConsumer(client, ConsumerConfig{Subscription: "tasks-sub"}, func(ctx context.Context, msg []byte) converter.Result {
+		// Only hand out the message once
+		fake.mu.Lock()
+		fake.responses["subscriptions/tasks-sub:pull"] = "{}"
+		fake.mu.Unlock()
+		handled <- string(msg)
+		return converter.Success()
+	})
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(ctx) }()
+
+	select {
+	case msg := <-handled:
+		if msg != `{"video_id": 3}` {
+			t.Errorf("handled %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasCall(fake, ack()) {
+		if time.Now().After(deadline) {
+			t.Fatal("message wasn't acknowledged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestConsumerPausesWhilePullFails(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.failures["subscriptions/tasks-sub:pull"] = http.StatusServiceUnavailable
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	paused, resumed := make(chan error, 1), make(chan struct{}, 1)
+	c := NewConsumer(client, ConsumerConfig{
+		Subscription: "tasks-sub",
+		ReconnectMin: time.Millisecond,
+		ReconnectMax: 5 * time.Millisecond,
+		OnPause:      func(err error) { paused <- err },
+		OnResume:     func() { resumed <- struct{}{} },
+	}, nil)
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(ctx) }()
+
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't pause")
+	}
+	if !c.Paused() {
+		t.Error("Paused() = false while pulls fail")
+	}
+	fake.mu.Lock()
+	delete(fake.failures, "subscriptions/tasks-sub:pull")
+	fake.mu.Unlock()
+	select {
+	case <-resumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't resume")
+	}
+	if c.Paused() {
+		t.Error("Paused() = true after a pull succeeded")
+	}
+	cancel()
+	<-served
+}
+
+// hasCall reports whether the fake server received the call
+func hasCall(fake *fakePubSub, want request) bool {
+	for _, r := range fake.calls() {
+		if reflect.DeepEqual(r, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"imersaofc/internal/converter"
+)
+
+// Enqueuer publishes tasks to a topic, keyed by video id so they are
+// delivered in order to subscriptions with message ordering enabled
+type Enqueuer struct {
+	client *Client
+	topic  string
+}
+
+// NewEnqueuer creates a new instance of Enqueuer
+func NewEnqueuer(client *Client, topic string) *Enqueuer {
+	return &Enqueuer{client: client, topic: topic}
+}
+
+// Enqueue publishes the task
+func (e *Enqueuer) Enqueue(task converter.VideoTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return e.PublishJSON(body, strconv.Itoa(task.VideoID))
+}
+
+// PublishJSON publishes an encoded message, a task or a batch of tasks,
+// with the ordering key, none when empty
+func (e *Enqueuer) PublishJSON(body []byte, orderingKey string) error {
+	_, err := e.client.Publish(context.Background(), e.topic, Message{
+		Data:        body,
+		Attributes:  map[string]string{"content_type": "application/json"},
+		OrderingKey: orderingKey,
+	})
+	return err
+}
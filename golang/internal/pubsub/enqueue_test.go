@@ -0,0 +1,23 @@
+package pubsub
+
+import (
+	"testing"
+
+	"imersaofc/internal/converter"
+)
+
+func TestEnqueue(t *testing.T) {
+	client, fake := newTestClient(t)
+	fake.responses["topics/tasks:publish"] = `{"messageIds": ["42"]}`
+	task := converter.VideoTask{VideoID: 3, Path: "media/uploads/3"}
+	if err := NewEnqueuer(client, "tasks").Enqueue(task); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	msg := fake.calls()[0].body["messages"].([]interface{})[0].(map[string]interface{})
+	if msg["orderingKey"] != "3" {
+		t.Errorf("ordering key = %v, want the video id", msg["orderingKey"])
+	}
+	if attrs := msg["attributes"].(map[string]interface{}); attrs["content_type"] != "application/json" {
+		t.Errorf("attributes = %v, want a JSON content type", attrs)
+	}
+}
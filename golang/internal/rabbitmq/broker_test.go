@@ -0,0 +1,201 @@
+package rabbitmq
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// published is a message the fake broker received
+type published struct {
+	exchange, key string
+	Publishing
+}
+
+// fakeBroker is the broker side of a connection: it answers the
+// synchronous methods, confirms publishes with confirm, and reports the
+// other methods and the messages it receives
+type fakeBroker struct {
+	t    *testing.T
+	conn net.Conn
+	// confirm decides whether a publish is acked, true when nil; the
+	// broker doesn't confirm publishes at all when hold is set
+	confirm func(seq uint64) bool
+	hold    bool
+
+	methods   chan method
+	published chan published
+	seq       uint64
+}
+
+// newTestConnection opens a client connection to a fake broker
+func newTestConnection(t *testing.T) (*Connection, *fakeBroker) {
+	t.Helper()
+	client, server := net.Pipe()
+	b := &fakeBroker{t: t, conn: server, methods: make(chan method, 16), published: make(chan published, 16)}
+	go b.run()
+	conn, err := open(client, "PLAIN", "\x00guest\x00guest", "/")
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	t.Cleanup(func() { conn.shutdown(ErrClosed) })
+	return conn, b
+}
+
+func (b *fakeBroker) run() {
+	header := make([]byte, 8)
+	if _, err := b.conn.Read(header); err != nil {
+		return
+	}
+	b.send(0, classConnection, methodConnectionStart, nil)
+	b.read() // start-ok
+	var tune writer
+	tune.short(0)
+	tune.long(4096)
+	tune.short(60)
+	b.send(0, classConnection, methodConnectionTune, &tune)
+	b.read() // tune-ok
+	b.read() // open
+	b.send(0, classConnection, methodConnectionOpenOk, nil)
+
+	for {
+		f, ok := b.read()
+		if !ok {
+			return
+		}
+		if f.typ != frameMethod {
+			continue
+		}
+		m := decodeMethod(f.payload)
+		switch {
+		case m.class == classChannel && m.id == methodChannelOpen:
+			b.send(f.channel, classChannel, methodChannelOpenOk, nil)
+		case m.class == classBasic && m.id == methodBasicQos:
+			b.send(f.channel, classBasic, methodBasicQosOk, nil)
+		case m.class == classConfirm && m.id == methodConfirmSelect:
+			b.send(f.channel, classConfirm, methodConfirmSelectOk, nil)
+		case m.class == classBasic && m.id == methodBasicConsume:
+			m.args.short()
+			m.args.shortstr()
+			var ok writer
+			ok.shortstr(m.args.shortstr())
+			b.send(f.channel, classBasic, methodBasicConsumeOk, &ok)
+		case m.class == classBasic && m.id == methodBasicPublish:
+			b.receive(f.channel, m)
+		default:
+			b.methods <- m
+		}
+	}
+}
+
+// receive reads the content of a publish and confirms it
+func (b *fakeBroker) receive(channel uint16, m method) {
+	m.args.short()
+	p := published{exchange: m.args.shortstr(), key: m.args.shortstr()}
+	f, _ := b.read()
+	r := &reader{buf: f.payload}
+	r.short()
+	r.short()
+	size := r.longlong()
+	p.Properties = readProperties(r)
+	for uint64(len(p.Body)) < size {
+		f, ok := b.read()
+		if !ok {
+			return
+		}
+		p.Body = append(p.Body, f.payload...)
+	}
+	b.published <- p
+	if b.hold {
+		return
+	}
+
+	b.seq++
+	id := uint16(methodBasicAck)
+	if b.confirm != nil && !b.confirm(b.seq) {
+		id = methodBasicNack
+	}
+	var confirm writer
+	confirm.longlong(b.seq)
+	confirm.bit(false)
+	b.send(channel, classBasic, id, &confirm)
+}
+
+// read reads the next frame the client sent, skipping heartbeats
+func (b *fakeBroker) read() (frame, bool) {
+	for {
+		f, err := readFrame(b.conn)
+		if err != nil {
+			return frame{}, false
+		}
+		if f.typ != frameHeartbeat {
+			return f, true
+		}
+	}
+}
+
+// send writes a method to the client
+func (b *fakeBroker) send(channel, class, id uint16, args *writer) {
+	var w writer
+	w.short(class)
+	w.short(id)
+	if args != nil {
+		args.flushBits()
+		w.Write(args.Bytes())
+	}
+	writeFrame(b.conn, frame{typ: frameMethod, channel: channel, payload: w.Bytes()})
+}
+
+// deliver sends a message to the client's consumer
+func (b *fakeBroker) deliver(channel uint16, consumerTag string, deliveryTag uint64, msg Publishing) {
+	var w writer
+	w.shortstr(consumerTag)
+	w.longlong(deliveryTag)
+	w.bit(false)
+	w.shortstr("videos")
+	w.shortstr("jobs")
+	b.send(channel, classBasic, methodBasicDeliver, &w)
+
+	var h writer
+	h.short(classBasic)
+	h.short(0)
+	h.longlong(uint64(len(msg.Body)))
+	writeProperties(&h, msg.Properties)
+	writeFrame(b.conn, frame{typ: frameHeader, channel: channel, payload: h.Bytes()})
+	writeFrame(b.conn, frame{typ: frameBody, channel: channel, payload: msg.Body})
+}
+
+// nextMethod returns the next method the client sent besides those the
+// broker answers
+func (b *fakeBroker) nextMethod() method {
+	b.t.Helper()
+	select {
+	case m := <-b.methods:
+		return m
+	case <-time.After(5 * time.Second):
+		b.t.Fatal("timed out waiting for a method")
+		return method{}
+	}
+}
+
+// noMethod fails if the client sends another method
+func (b *fakeBroker) noMethod() {
+	b.t.Helper()
+	select {
+	case m := <-b.methods:
+		b.t.Errorf("unexpected method %d.%d", m.class, m.id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// nextPublished returns the next message the client published
+func (b *fakeBroker) nextPublished() published {
+	b.t.Helper()
+	select {
+	case p := <-b.published:
+		return p
+	case <-time.After(5 * time.Second):
+		b.t.Fatal("timed out waiting for a publish")
+		return published{}
+	}
+}
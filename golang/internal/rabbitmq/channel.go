@@ -0,0 +1,627 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrNacked is returned when the broker refuses responsibility for a
+// message published in confirm mode
+var ErrNacked = errors.New("amqp: publish nacked by broker")
+
+// Properties are the AMQP basic content properties of a message
+type Properties struct {
+	ContentType     string
+	ContentEncoding string
+	Headers         Table
+	DeliveryMode    uint8 // 2 for persistent
+	Priority        uint8
+	CorrelationID   string
+	ReplyTo         string
+	Expiration      string
+	MessageID       string
+	Timestamp       time.Time
+	Type            string
+	UserID          string
+	AppID           string
+}
+
+// Publishing is a message to publish
+type Publishing struct {
+	Properties
+	Body []byte
+}
+
+// Delivery is a message received from a consumer
+type Delivery struct {
+	Properties
+	ConsumerTag string
+	DeliveryTag uint64
+	Redelivered bool
+	Exchange    string
+	RoutingKey  string
+	Body        []byte
+
+	channel *Channel
+}
+
+// Ack acknowledges the delivery
+func (d Delivery) Ack() error {
+	var args writer
+	args.longlong(d.DeliveryTag)
+	args.bit(false)
+	return d.channel.conn.sendMethod(d.channel.id, classBasic, methodBasicAck, &args)
+}
+
+// Nack rejects the delivery, requeueing it or dead-lettering it
+func (d Delivery) Nack(requeue bool) error {
+	var args writer
+	args.longlong(d.DeliveryTag)
+	args.bit(false)
+	args.bit(requeue)
+	return d.channel.conn.sendMethod(d.channel.id, classBasic, methodBasicNack, &args)
+}
+
+// Reject rejects the delivery, requeueing it or dead-lettering it
+func (d Delivery) Reject(requeue bool) error {
+	var args writer
+	args.longlong(d.DeliveryTag)
+	args.bit(requeue)
+	return d.channel.conn.sendMethod(d.channel.id, classBasic, methodBasicReject, &args)
+}
+
+// Channel is an AMQP channel
+type Channel struct {
+	conn *Connection
+	id   uint16
+
+	callMu sync.Mutex
+	rpc    chan method
+
+	mu        sync.Mutex
+	consumers map[string]*deliveryQueue
+	closed    bool
+	closeErr  error
+	done      chan struct{}
+
+	// publishMu keeps the sequence numbers of confirm mode in the order
+	// messages are sent, see Confirm; confirms are waiting publishes by
+	// sequence number, nil outside confirm mode
+	publishMu  sync.Mutex
+	publishSeq uint64
+	confirms   map[uint64]chan bool
+
+	// content being assembled from deliver, header and body frames
+	pending  *Delivery
+	bodySize uint64
+}
+
+func newChannel(conn *Connection, id uint16) *Channel {
+	return &Channel{
+		conn:      conn,
+		id:        id,
+		rpc:       make(chan method, 1),
+		consumers: make(map[string]*deliveryQueue),
+		done:      make(chan struct{}),
+	}
+}
+
+// call sends a synchronous method and waits for its reply
+func (ch *Channel) call(class, id uint16, args *writer, replyID uint16) (method, error) {
+	ch.callMu.Lock()
+	defer ch.callMu.Unlock()
+
+	if err := ch.conn.sendMethod(ch.id, class, id, args); err != nil {
+		return method{}, err
+	}
+	select {
+	case m := <-ch.rpc:
+		if m.id != replyID {
+			return m, &Error{Code: 0, Reason: "unexpected reply", Channel: true}
+		}
+		return m, nil
+	case <-ch.done:
+		return method{}, ch.err()
+	}
+}
+
+func (ch *Channel) err() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closeErr != nil {
+		return ch.closeErr
+	}
+	return ErrClosed
+}
+
+// dispatch handles a frame addressed to this channel
+func (ch *Channel) dispatch(f frame) {
+	switch f.typ {
+	case frameMethod:
+		m := decodeMethod(f.payload)
+		switch {
+		case m.class == classBasic && m.id == methodBasicDeliver:
+			d := &Delivery{channel: ch}
+			d.ConsumerTag = m.args.shortstr()
+			d.DeliveryTag = m.args.longlong()
+			d.Redelivered = m.args.bit()
+			d.Exchange = m.args.shortstr()
+			d.RoutingKey = m.args.shortstr()
+			ch.pending = d
+		case m.class == classBasic && (m.id == methodBasicAck || m.id == methodBasicNack):
+			tag := m.args.longlong()
+			multiple := m.args.bit()
+			ch.confirm(tag, multiple, m.id == methodBasicAck)
+		case m.class == classBasic && m.id == methodBasicCancel:
+			ch.cancel(m.args.shortstr())
+		case m.class == classChannel && m.id == methodChannelClose:
+			code := m.args.short()
+			reason := m.args.shortstr()
+			ch.conn.sendMethod(ch.id, classChannel, methodChannelCloseOk, nil)
+			ch.conn.removeChannel(ch.id)
+			ch.shutdown(&Error{Code: code, Reason: reason, Channel: true})
+		case m.class == classChannel && m.id == methodChannelCloseOk:
+			ch.conn.removeChannel(ch.id)
+			ch.shutdown(ErrClosed)
+		default:
+			select {
+			case ch.rpc <- m:
+			default:
+			}
+		}
+	case frameHeader:
+		if ch.pending == nil {
+			return
+		}
+		r := &reader{buf: f.payload}
+		r.short() // class
+		r.short() // weight
+		ch.bodySize = r.longlong()
+		ch.pending.Properties = readProperties(r)
+		if ch.bodySize == 0 {
+			ch.deliver()
+		}
+	case frameBody:
+		if ch.pending == nil {
+			return
+		}
+		ch.pending.Body = append(ch.pending.Body, f.payload...)
+		if uint64(len(ch.pending.Body)) >= ch.bodySize {
+			ch.deliver()
+		}
+	}
+}
+
+// deliver hands the assembled message to its consumer
+func (ch *Channel) deliver() {
+	d := *ch.pending
+	ch.pending = nil
+	ch.mu.Lock()
+	q := ch.consumers[d.ConsumerTag]
+	ch.mu.Unlock()
+	if q != nil {
+		q.push(d)
+	}
+}
+
+// confirm settles the publishes the broker acked or nacked: the one with
+// the tag or, when multiple, every one up to it
+func (ch *Channel) confirm(tag uint64, multiple, ack bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	for seq, c := range ch.confirms {
+		if seq == tag || (multiple && seq < tag) {
+			c <- ack
+			delete(ch.confirms, seq)
+		}
+	}
+}
+
+// cancel ends a consumer the broker cancelled, because its queue was
+// deleted or moved to another node, closing its deliveries so whoever
+// consumes them sees the subscription end and can subscribe again
+func (ch *Channel) cancel(tag string) {
+	ch.mu.Lock()
+	q := ch.consumers[tag]
+	delete(ch.consumers, tag)
+	ch.mu.Unlock()
+	if q != nil {
+		slog.Warn("Consumer cancelled by broker", slog.String("consumer_tag", tag))
+		q.close()
+	}
+}
+
+// shutdown marks the channel closed and ends its consumers
+func (ch *Channel) shutdown(err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	ch.closeErr = err
+	close(ch.done)
+	for _, q := range ch.consumers {
+		q.close()
+	}
+}
+
+func (c *Connection) removeChannel(id uint16) {
+	c.mu.Lock()
+	delete(c.channels, id)
+	c.mu.Unlock()
+}
+
+// Close closes the channel
+func (ch *Channel) Close() error {
+	var args writer
+	args.short(200)
+	args.shortstr("bye")
+	args.short(0)
+	args.short(0)
+	if err := ch.conn.sendMethod(ch.id, classChannel, methodChannelClose, &args); err != nil {
+		return err
+	}
+	select {
+	case <-ch.done:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+// Qos limits how many unacknowledged messages the broker sends this channel
+func (ch *Channel) Qos(prefetchCount int) error {
+	var args writer
+	args.long(0)
+	args.short(uint16(prefetchCount))
+	args.bit(false)
+	_, err := ch.call(classBasic, methodBasicQos, &args, methodBasicQosOk)
+	return err
+}
+
+// ExchangeDeclare declares an exchange
+func (ch *Channel) ExchangeDeclare(name, kind string, durable bool, args Table) error {
+	var w writer
+	w.short(0)
+	w.shortstr(name)
+	w.shortstr(kind)
+	w.bit(false) // passive
+	w.bit(durable)
+	w.bit(false) // auto-delete
+	w.bit(false) // internal
+	w.bit(false) // no-wait
+	w.table(args)
+	_, err := ch.call(classExchange, methodExchangeDeclare, &w, methodExchangeDeclareOk)
+	return err
+}
+
+// QueueInfo is the broker's answer to a queue declaration
+type QueueInfo struct {
+	Name      string
+	Messages  int
+	Consumers int
+}
+
+// QueueDeclare declares a queue
+func (ch *Channel) QueueDeclare(name string, durable bool, args Table) (QueueInfo, error) {
+	return ch.queueDeclare(name, false, durable, args)
+}
+
+// QueueInspect passively declares a queue to read its message and consumer counts
+func (ch *Channel) QueueInspect(name string) (QueueInfo, error) {
+	return ch.queueDeclare(name, true, false, nil)
+}
+
+func (ch *Channel) queueDeclare(name string, passive, durable bool, args Table) (QueueInfo, error) {
+	var w writer
+	w.short(0)
+	w.shortstr(name)
+	w.bit(passive)
+	w.bit(durable)
+	w.bit(false) // exclusive
+	w.bit(false) // auto-delete
+	w.bit(false) // no-wait
+	w.table(args)
+	m, err := ch.call(classQueue, methodQueueDeclare, &w, methodQueueDeclareOk)
+	if err != nil {
+		return QueueInfo{}, err
+	}
+	info := QueueInfo{Name: m.args.shortstr()}
+	info.Messages = int(m.args.long())
+	info.Consumers = int(m.args.long())
+	return info, nil
+}
+
+// QueueBind binds a queue to an exchange
+func (ch *Channel) QueueBind(queue, exchange, key string, args Table) error {
+	var w writer
+	w.short(0)
+	w.shortstr(queue)
+	w.shortstr(exchange)
+	w.shortstr(key)
+	w.bit(false) // no-wait
+	w.table(args)
+	_, err := ch.call(classQueue, methodQueueBind, &w, methodQueueBindOk)
+	return err
+}
+
+// Consume starts a consumer on the queue; messages must be acknowledged
+func (ch *Channel) Consume(queue, consumerTag string) (<-chan Delivery, error) {
+	q := newDeliveryQueue()
+	ch.mu.Lock()
+	ch.consumers[consumerTag] = q
+	ch.mu.Unlock()
+
+	var w writer
+	w.short(0)
+	w.shortstr(queue)
+	w.shortstr(consumerTag)
+	w.bit(false) // no-local
+	w.bit(false) // no-ack
+	w.bit(false) // exclusive
+	w.bit(false) // no-wait
+	w.table(nil)
+	if _, err := ch.call(classBasic, methodBasicConsume, &w, methodBasicConsumeOk); err != nil {
+		ch.mu.Lock()
+		delete(ch.consumers, consumerTag)
+		ch.mu.Unlock()
+		q.close()
+		return nil, err
+	}
+	return q.out, nil
+}
+
+// Confirm puts the channel in confirm mode: the broker acks or nacks each
+// message published on it from then on, which PublishConfirmed waits for
+func (ch *Channel) Confirm() error {
+	var w writer
+	w.bit(false) // no-wait
+	if _, err := ch.call(classConfirm, methodConfirmSelect, &w, methodConfirmSelectOk); err != nil {
+		return err
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.confirms == nil {
+		ch.confirms = map[uint64]chan bool{}
+	}
+	return nil
+}
+
+// Publish sends a message to an exchange
+func (ch *Channel) Publish(exchange, key string, msg Publishing) error {
+	_, err := ch.publish(exchange, key, msg)
+	return err
+}
+
+// PublishConfirmed sends a message to an exchange on a channel in confirm
+// mode and waits until the broker is responsible for it. It returns
+// ErrNacked when the broker refuses it, and an error as well when the
+// channel closes or ctx is done first, in which case the message may or
+// may not have been taken.
+func (ch *Channel) PublishConfirmed(ctx context.Context, exchange, key string, msg Publishing) error {
+	confirm, err := ch.publish(exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	if confirm == nil {
+		return errors.New("amqp: channel isn't in confirm mode")
+	}
+	select {
+	case ack := <-confirm:
+		if !ack {
+			return ErrNacked
+		}
+		return nil
+	case <-ch.done:
+		return ch.err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish sends the frames of a message, returning where its confirm is
+// delivered in confirm mode
+func (ch *Channel) publish(exchange, key string, msg Publishing) (<-chan bool, error) {
+	var w writer
+	w.short(classBasic)
+	w.short(methodBasicPublish)
+	w.short(0)
+	w.shortstr(exchange)
+	w.shortstr(key)
+	w.bit(false) // mandatory
+	w.bit(false) // immediate
+	w.flushBits()
+	frames := []frame{{typ: frameMethod, channel: ch.id, payload: w.Bytes()}}
+
+	var h writer
+	h.short(classBasic)
+	h.short(0)
+	h.longlong(uint64(len(msg.Body)))
+	writeProperties(&h, msg.Properties)
+	frames = append(frames, frame{typ: frameHeader, channel: ch.id, payload: h.Bytes()})
+
+	maxBody := int(ch.conn.frameMax) - 8
+	for body := msg.Body; len(body) > 0; {
+		n := min(len(body), maxBody)
+		frames = append(frames, frame{typ: frameBody, channel: ch.id, payload: body[:n]})
+		body = body[n:]
+	}
+
+	ch.publishMu.Lock()
+	defer ch.publishMu.Unlock()
+	select {
+	case <-ch.done:
+		return nil, ch.err()
+	default:
+	}
+	var confirm chan bool
+	ch.mu.Lock()
+	if ch.confirms != nil {
+		ch.publishSeq++
+		confirm = make(chan bool, 1)
+		ch.confirms[ch.publishSeq] = confirm
+	}
+	ch.mu.Unlock()
+	if err := ch.conn.send(frames...); err != nil {
+		return nil, err
+	}
+	return confirm, nil
+}
+
+// writeProperties encodes the property flags and the properties that are set
+func writeProperties(w *writer, p Properties) {
+	var flags uint16
+	var props writer
+	if p.ContentType != "" {
+		flags |= 1 << 15
+		props.shortstr(p.ContentType)
+	}
+	if p.ContentEncoding != "" {
+		flags |= 1 << 14
+		props.shortstr(p.ContentEncoding)
+	}
+	if len(p.Headers) > 0 {
+		flags |= 1 << 13
+		props.table(p.Headers)
+	}
+	if p.DeliveryMode != 0 {
+		flags |= 1 << 12
+		props.octet(p.DeliveryMode)
+	}
+	if p.Priority != 0 {
+		flags |= 1 << 11
+		props.octet(p.Priority)
+	}
+	if p.CorrelationID != "" {
+		flags |= 1 << 10
+		props.shortstr(p.CorrelationID)
+	}
+	if p.ReplyTo != "" {
+		flags |= 1 << 9
+		props.shortstr(p.ReplyTo)
+	}
+	if p.Expiration != "" {
+		flags |= 1 << 8
+		props.shortstr(p.Expiration)
+	}
+	if p.MessageID != "" {
+		flags |= 1 << 7
+		props.shortstr(p.MessageID)
+	}
+	if !p.Timestamp.IsZero() {
+		flags |= 1 << 6
+		props.longlong(uint64(p.Timestamp.Unix()))
+	}
+	if p.Type != "" {
+		flags |= 1 << 5
+		props.shortstr(p.Type)
+	}
+	if p.UserID != "" {
+		flags |= 1 << 4
+		props.shortstr(p.UserID)
+	}
+	if p.AppID != "" {
+		flags |= 1 << 3
+		props.shortstr(p.AppID)
+	}
+	w.short(flags)
+	w.Write(props.Bytes())
+}
+
+// readProperties decodes the properties present in a content header
+func readProperties(r *reader) Properties {
+	var p Properties
+	flags := r.short()
+	if flags&(1<<15) != 0 {
+		p.ContentType = r.shortstr()
+	}
+	if flags&(1<<14) != 0 {
+		p.ContentEncoding = r.shortstr()
+	}
+	if flags&(1<<13) != 0 {
+		p.Headers = r.table()
+	}
+	if flags&(1<<12) != 0 {
+		p.DeliveryMode = r.octet()
+	}
+	if flags&(1<<11) != 0 {
+		p.Priority = r.octet()
+	}
+	if flags&(1<<10) != 0 {
+		p.CorrelationID = r.shortstr()
+	}
+	if flags&(1<<9) != 0 {
+		p.ReplyTo = r.shortstr()
+	}
+	if flags&(1<<8) != 0 {
+		p.Expiration = r.shortstr()
+	}
+	if flags&(1<<7) != 0 {
+		p.MessageID = r.shortstr()
+	}
+	if flags&(1<<6) != 0 {
+		p.Timestamp = time.Unix(int64(r.longlong()), 0)
+	}
+	if flags&(1<<5) != 0 {
+		p.Type = r.shortstr()
+	}
+	if flags&(1<<4) != 0 {
+		p.UserID = r.shortstr()
+	}
+	if flags&(1<<3) != 0 {
+		p.AppID = r.shortstr()
+	}
+	return p
+}
+
+// deliveryQueue buffers deliveries so a slow consumer never blocks the
+// connection's read loop; the broker's prefetch bounds its size
+type deliveryQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []Delivery
+	closed bool
+	out    chan Delivery
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	q := &deliveryQueue{out: make(chan Delivery)}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+func (q *deliveryQueue) push(d Delivery) {
+	q.mu.Lock()
+	q.items = append(q.items, d)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *deliveryQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *deliveryQueue) run() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		d := q.items[0]
+		q.items = q.items[1:]
+		q.mu.Unlock()
+		q.out <- d
+	}
+}
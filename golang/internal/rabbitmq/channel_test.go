@@ -0,0 +1,142 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPublishConfirmed(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	broker.confirm = func(seq uint64) bool { return seq != 2 }
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(); err != nil {
+		t.Fatalf("Confirm() error = %v", err)
+	}
+
+	msg := Publishing{Properties: Properties{ContentType: "application/json"}, Body: []byte(`{"video_id": 1}`)}
+	if err := ch.PublishConfirmed(context.Background(), "videos", "jobs", msg); err != nil {
+		t.Errorf("PublishConfirmed() of an acked message error = %v", err)
+	}
+	got := broker.nextPublished()
+	if got.exchange != "videos" || got.key != "jobs" || !reflect.DeepEqual(got.Publishing, msg) {
+		t.Errorf("published %+v, want %+v to videos/jobs", got, msg)
+	}
+	if err := ch.PublishConfirmed(context.Background(), "videos", "jobs", msg); !errors.Is(err, ErrNacked) {
+		t.Errorf("PublishConfirmed() of a nacked message error = %v, want %v", err, ErrNacked)
+	}
+}
+
+func TestPublishConfirmedLargeBody(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	ch, _ := conn.Channel()
+	ch.Confirm()
+	// Bigger than the frame size the broker tuned, so split in body frames
+	body := make([]byte, 10000)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	if err := ch.PublishConfirmed(context.Background(), "", "jobs", Publishing{Body: body}); err != nil {
+		t.Fatalf("PublishConfirmed() error = %v", err)
+	}
+	if got := broker.nextPublished(); !reflect.DeepEqual(got.Body, body) {
+		t.Errorf("published a body of %d bytes, want %d", len(got.Body), len(body))
+	}
+}
+
+func TestPublishConfirmedWithoutConfirmMode(t *testing.T) {
+	conn, _ := newTestConnection(t)
+	ch, _ := conn.Channel()
+	if err := ch.PublishConfirmed(context.Background(), "", "jobs", Publishing{}); err == nil {
+		t.Error("PublishConfirmed() outside confirm mode succeeded")
+	}
+}
+
+func TestPublishConfirmedChannelClosed(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	broker.hold = true
+	ch, _ := conn.Channel()
+	ch.Confirm()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ch.PublishConfirmed(ctx, "", "jobs", Publishing{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("PublishConfirmed() without a confirm error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	broker.nextPublished()
+
+	var args writer
+	args.short(404)
+	args.shortstr("NOT_FOUND")
+	args.short(0)
+	args.short(0)
+	broker.send(ch.id, classChannel, methodChannelClose, &args)
+	var closeErr *Error
+	if err := ch.PublishConfirmed(context.Background(), "", "jobs", Publishing{}); !errors.As(err, &closeErr) || closeErr.Code != 404 {
+		t.Errorf("PublishConfirmed() on a closed channel error = %v, want the broker's close", err)
+	}
+}
+
+func TestConfirmMultiple(t *testing.T) {
+	ch := &Channel{confirms: map[uint64]chan bool{}}
+	waits := map[uint64]chan bool{}
+	for seq := uint64(1); seq <= 3; seq++ {
+		waits[seq] = make(chan bool, 1)
+		ch.confirms[seq] = waits[seq]
+	}
+	ch.confirm(2, true, false)
+	for seq, want := range map[uint64]bool{1: false, 2: false} {
+		if got := <-waits[seq]; got != want {
+			t.Errorf("confirm of %d = %v, want %v", seq, got, want)
+		}
+	}
+	if len(ch.confirms) != 1 || ch.confirms[3] == nil {
+		t.Errorf("pending confirms = %v, want only 3", ch.confirms)
+	}
+	ch.confirm(3, false, true)
+	if got := <-waits[3]; !got {
+		t.Error("confirm of 3 = false, want true")
+	}
+}
+
+func TestConsumeDeliveryAndCancel(t *testing.T) {
+	conn, broker := newTestConnection(t)
+	ch, _ := conn.Channel()
+	deliveries, err := ch.Consume("jobs", "videoconverter-0")
+	if err != nil {
+		t.Fatalf("Consume() error = %v", err)
+	}
+
+	msg := Publishing{
+		Properties: Properties{ContentType: "application/json", Headers: Table{RetryAttemptHeader: int32(1)}},
+		Body:       []byte(`{"video_id": 2}`),
+	}
+	broker.deliver(ch.id, "videoconverter-0", 7, msg)
+	select {
+	case d := <-deliveries:
+		if d.DeliveryTag != 7 || d.RoutingKey != "jobs" || !reflect.DeepEqual(d.Properties, msg.Properties) || string(d.Body) != string(msg.Body) {
+			t.Errorf("delivery = %+v, want %+v", d, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the delivery")
+	}
+
+	// A broker cancel ends the subscription, so the consumer subscribes again
+	var cancel writer
+	cancel.shortstr("videoconverter-0")
+	cancel.bit(true)
+	broker.send(ch.id, classBasic, methodBasicCancel, &cancel)
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Error("received a delivery after the cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries still open after the broker cancelled the consumer")
+	}
+}
@@ -0,0 +1,410 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// ConsumerConfig configures where conversion tasks are consumed from
+type ConsumerConfig struct {
+	URL        string
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	// TLS configures amqps:// connections, see DialTLS
+	TLS *tls.Config
+	// DeadLetterExchange receives messages that failed permanently, kept
+	// in DeadLetterQueue when set
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// RetryDelays are the escalating delays of retries: a task to retry
+	// waits the next delay in a TTL queue, see Topology, and is
+	// dead-lettered once they are exhausted. Without delays it is
+	// requeued immediately, as many times as it fails.
+	RetryDelays []time.Duration
+	// Consumers is how many tasks of the queue are converted at the same
+	// time, 1 when zero
+	Consumers int
+	// Prefetch is how many unacknowledged messages each consumer holds,
+	// 1 when zero. Messages beyond the one being converted wait on this
+	// worker and are redelivered elsewhere only if it dies.
+	Prefetch int
+
+	// ReconnectMin and ReconnectMax bound the exponential backoff between
+	// reconnection attempts in Serve, 1s and 30s when zero
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// OnPause is called by Serve when the connection is lost, and OnResume
+	// once consuming again after an outage
+	OnPause  func(err error)
+	OnResume func()
+	// OnExpired settles messages picked up after the time in their
+	// DeadlineHeader, instead of the handler. Without it they are acked.
+	OnExpired func(msg []byte, deadline time.Time) converter.Result
+	// ManagementURL is the base URL of the broker's management API, with
+	// its credentials, read by Stats for the age of the queue's head
+	ManagementURL string
+}
+
+// Consumer delivers conversion tasks to a handler and settles each
+// message according to the handler's result
+type Consumer struct {
+	cfg    ConsumerConfig
+	handle func(ctx context.Context, msg []byte) converter.Result
+	paused atomic.Bool
+
+	// inFlight are when the messages being handled were published, and
+	// conn the connection of the running session, see Stats
+	mu       sync.Mutex
+	seq      uint64
+	inFlight map[uint64]time.Time
+	conn     *Connection
+}
+
+// NewConsumer creates a new instance of Consumer
+func NewConsumer(cfg ConsumerConfig, handle func(ctx context.Context, msg []byte) converter.Result) *Consumer {
+	return &Consumer{cfg: cfg, handle: handle}
+}
+
+// Paused reports whether Serve lost the connection and hasn't recovered yet
+func (c *Consumer) Paused() bool {
+	return c.paused.Load()
+}
+
+// Serve runs the consumer until ctx is done, surviving broker restarts:
+// when the connection is lost it reconnects with backoff, declares the
+// topology again and resubscribes, so the process doesn't crash
+func (c *Consumer) Serve(ctx context.Context) error {
+	minBackoff := c.cfg.ReconnectMin
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	maxBackoff := c.cfg.ReconnectMax
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	backoff := minBackoff
+	for {
+		err := c.session(ctx, func() {
+			backoff = minBackoff
+			if c.paused.CompareAndSwap(true, false) {
+				slog.Info("Consumer resumed", slog.String("queue", c.cfg.Queue))
+				if c.cfg.OnResume != nil {
+					c.cfg.OnResume()
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if c.paused.CompareAndSwap(false, true) {
+			slog.Warn("Consumer paused, broker unavailable", slog.String("queue", c.cfg.Queue), slog.String("error", err.Error()))
+			if c.cfg.OnPause != nil {
+				c.cfg.OnPause(err)
+			}
+		}
+
+		// Full jitter keeps a fleet of workers from reconnecting in lockstep
+		wait := time.Duration(rand.Int63n(int64(backoff))) + minBackoff/2
+		slog.Info("Reconnecting to broker", slog.String("queue", c.cfg.Queue), slog.Duration("in", wait), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// Run consumes tasks with the configured number of consumers, each on its
+// own channel, until ctx is done, the connection is lost or a consumer fails
+func (c *Consumer) Run(ctx context.Context) error {
+	return c.session(ctx, nil)
+}
+
+// session connects, declares the topology and consumes until the
+// connection or a consumer fails, calling connected once subscribed. It
+// waits for the tasks being converted before returning; their messages
+// can't be settled on a new connection and are redelivered by the broker.
+func (c *Consumer) session(ctx context.Context, connected func()) error {
+	conn, err := DialTLS(c.cfg.URL, c.cfg.TLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.setConn(conn)
+	defer c.setConn(nil)
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := c.Topology().Declare(ch); err != nil {
+		return err
+	}
+
+	consumers := max(c.cfg.Consumers, 1)
+	prefetch := max(c.cfg.Prefetch, 1)
+	// Stop the consumers, then wait for the tasks they are converting
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	closed := conn.NotifyClose()
+	errs := make(chan error, consumers)
+	for i := 0; i < consumers; i++ {
+		consumerCh := ch
+		if i > 0 {
+			if consumerCh, err = conn.Channel(); err != nil {
+				return err
+			}
+		}
+		deliveries, err := c.subscribe(consumerCh, prefetch, fmt.Sprintf("videoconverter-%d", i))
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.consume(ctx, deliveries)
+		}()
+	}
+	if connected != nil {
+		connected()
+	}
+	slog.Info("Consuming tasks",
+		slog.String("queue", c.cfg.Queue),
+		slog.Int("consumers", consumers),
+		slog.Int("prefetch", prefetch))
+
+	// The first consumer to stop stops the others; a message being
+	// converted when the connection closes is redelivered by the broker
+	select {
+	case err = <-errs:
+	case err = <-closed:
+		if err == nil {
+			err = ErrClosed
+		}
+	}
+	cancel()
+	return err
+}
+
+// subscribe sets the channel's prefetch and starts consuming the queue on
+// it, in confirm mode for the retries republished on it
+func (c *Consumer) subscribe(ch *Channel, prefetch int, tag string) (<-chan Delivery, error) {
+	if err := ch.Qos(prefetch); err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(); err != nil {
+		return nil, err
+	}
+	return ch.Consume(c.cfg.Queue, tag)
+}
+
+// consume handles deliveries one at a time until ctx is done or the channel closes
+func (c *Consumer) consume(ctx context.Context, deliveries <-chan Delivery) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return ErrClosed
+			}
+			key := c.track(d)
+			err := c.settle(ctx, d, c.handleDelivery(ctx, d))
+			c.untrack(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DeadlineHeader optionally carries when a message stops being worth
+// handling, as a timestamp, RFC 3339 string or Unix seconds
+const DeadlineHeader = "x-deadline"
+
+// handleDelivery passes the delivery to the handler unless it is past its deadline
+func (c *Consumer) handleDelivery(ctx context.Context, d Delivery) converter.Result {
+	deadline, ok := messageDeadline(d.Headers)
+	if !ok || time.Now().Before(deadline) {
+		return c.handle(ctx, d.Body)
+	}
+	if c.cfg.OnExpired != nil {
+		return c.cfg.OnExpired(d.Body, deadline)
+	}
+	slog.Warn("Message expired, skipping", slog.Uint64("delivery_tag", d.DeliveryTag), slog.Time("deadline", deadline))
+	return converter.Success()
+}
+
+// messageDeadline reads the deadline header
+func messageDeadline(headers Table) (time.Time, bool) {
+	switch v := headers[DeadlineHeader].(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			slog.Warn("Ignoring invalid deadline header", slog.String("value", v))
+			return time.Time{}, false
+		}
+		return t, true
+	case nil:
+		return time.Time{}, false
+	}
+	if seconds, ok := intField(headers[DeadlineHeader]); ok && seconds > 0 {
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Topology returns the broker setup the consumer declares on each connection
+func (c *Consumer) Topology() Topology {
+	return Topology{
+		Exchange:           c.cfg.Exchange,
+		RoutingKey:         c.cfg.RoutingKey,
+		Queue:              c.cfg.Queue,
+		DeadLetterExchange: c.cfg.DeadLetterExchange,
+		DeadLetterQueue:    c.cfg.DeadLetterQueue,
+		RetryDelays:        c.cfg.RetryDelays,
+	}
+}
+
+// settle acks, requeues or dead-letters the delivery
+func (c *Consumer) settle(ctx context.Context, d Delivery, result converter.Result) error {
+	switch result.Outcome {
+	case converter.OutcomeSuccess:
+		return d.Ack()
+	case converter.OutcomeRetry:
+		if result.Delay > 0 {
+			return c.postpone(ctx, d, result)
+		}
+		if len(c.cfg.RetryDelays) > 0 {
+			return c.retryLater(ctx, d, result)
+		}
+		slog.Warn("Requeueing task", slog.Uint64("delivery_tag", d.DeliveryTag), slog.String("error", result.Err.Error()))
+		return d.Nack(true)
+	default:
+		slog.Error("Dead-lettering task", slog.Uint64("delivery_tag", d.DeliveryTag), slog.String("error", result.Err.Error()))
+		return d.Reject(false)
+	}
+}
+
+// RetryAttemptHeader carries how many delayed retries a message went through
+const RetryAttemptHeader = "x-retry-attempt"
+
+// retryLater republishes the delivery to the retry queue of its next
+// attempt and acks it, or dead-letters it when no attempt is left
+func (c *Consumer) retryLater(ctx context.Context, d Delivery, result converter.Result) error {
+	attempt := retryAttempt(d.Headers)
+	if attempt >= len(c.cfg.RetryDelays) {
+		slog.Error("Retries exhausted, dead-lettering task",
+			slog.Uint64("delivery_tag", d.DeliveryTag),
+			slog.Int("attempts", attempt),
+			slog.String("error", result.Err.Error()))
+		return d.Reject(false)
+	}
+
+	delay := c.cfg.RetryDelays[attempt]
+	if err := c.republish(ctx, d, delay, attempt+1); err != nil {
+		return err
+	}
+	slog.Warn("Retrying task later",
+		slog.Uint64("delivery_tag", d.DeliveryTag),
+		slog.Int("attempt", attempt+1),
+		slog.Duration("delay", delay),
+		slog.String("error", result.Err.Error()))
+	return d.Ack()
+}
+
+// postpone hands the delivery out again after the result's delay without
+// counting an attempt: through the shortest retry queue at least that
+// long, or the longest one, or by holding it and then requeueing it when
+// there are no retry queues. Holding it stops as soon as ctx is done, so
+// shutting down isn't delayed.
+func (c *Consumer) postpone(ctx context.Context, d Delivery, result converter.Result) error {
+	slog.Warn("Postponing task",
+		slog.Uint64("delivery_tag", d.DeliveryTag),
+		slog.Duration("delay", result.Delay),
+		slog.String("error", result.Err.Error()))
+	if len(c.cfg.RetryDelays) == 0 {
+		timer := time.NewTimer(result.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		return d.Nack(true)
+	}
+
+	delay := c.cfg.RetryDelays[len(c.cfg.RetryDelays)-1]
+	for _, candidate := range c.cfg.RetryDelays {
+		if candidate >= result.Delay && candidate < delay {
+			delay = candidate
+		}
+	}
+	if err := c.republish(ctx, d, delay, retryAttempt(d.Headers)); err != nil {
+		return err
+	}
+	return d.Ack()
+}
+
+// republish publishes a copy of the delivery to the retry queue of the
+// delay, with the attempt in its headers, and waits for the broker to
+// confirm it. The caller only acks the delivery once confirmed, so a copy
+// the broker drops leaves the delivery unacked, to be redelivered.
+func (c *Consumer) republish(ctx context.Context, d Delivery, delay time.Duration, attempt int) error {
+	headers := Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[RetryAttemptHeader] = int32(attempt)
+	props := d.Properties
+	props.Headers = headers
+	props.DeliveryMode = 2
+	// The retry queue's TTL decides the delay
+	props.Expiration = ""
+
+	topology := c.Topology()
+	return d.channel.PublishConfirmed(ctx, topology.RetryExchange(), topology.RetryQueue(delay), Publishing{Properties: props, Body: d.Body})
+}
+
+// retryAttempt reads the retry attempt header, 0 when absent
+func retryAttempt(headers Table) int {
+	attempt, _ := intField(headers[RetryAttemptHeader])
+	return int(attempt)
+}
+
+// intField reads a table value of any integer width
+func intField(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int8:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,194 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// settledWith describes how a delivery was settled
+type settledWith struct {
+	id      uint16
+	requeue bool
+}
+
+// readSettle decodes an ack, nack or reject of the delivery tag
+func readSettle(t *testing.T, m method, tag uint64) settledWith {
+	t.Helper()
+	if m.class != classBasic {
+		t.Fatalf("method %d.%d isn't a settle", m.class, m.id)
+	}
+	if got := m.args.longlong(); got != tag {
+		t.Errorf("settled delivery %d, want %d", got, tag)
+	}
+	s := settledWith{id: m.id}
+	switch m.id {
+	case methodBasicAck:
+		m.args.bit()
+	case methodBasicNack:
+		m.args.bit()
+		s.requeue = m.args.bit()
+	case methodBasicReject:
+		s.requeue = m.args.bit()
+	}
+	return s
+}
+
+func TestConsumerSettle(t *testing.T) {
+	errFailed := errors.New("ffmpeg failed")
+	delays := []time.Duration{30 * time.Second, 5 * time.Minute}
+	tests := []struct {
+		name        string
+		delays      []time.Duration
+		attempt     int32
+		result      converter.Result
+		nack        bool
+		want        settledWith
+		wantRetry   string
+		wantAttempt int32
+		wantErr     error
+	}{
+		{
+			name:   "success is acked",
+			result: converter.Success(),
+			want:   settledWith{id: methodBasicAck},
+		},
+		{
+			name:   "permanent failure is dead-lettered",
+			result: converter.Permanent(errFailed),
+			want:   settledWith{id: methodBasicReject},
+		},
+		{
+			name:   "retry without delays is requeued",
+			result: converter.Retry(errFailed),
+			want:   settledWith{id: methodBasicNack, requeue: true},
+		},
+		{
+			name:        "retry waits the first delay",
+			delays:      delays,
+			result:      converter.Retry(errFailed),
+			want:        settledWith{id: methodBasicAck},
+			wantRetry:   "jobs.retry.30s",
+			wantAttempt: 1,
+		},
+		{
+			name:        "retry waits the next delay",
+			delays:      delays,
+			attempt:     1,
+			result:      converter.Retry(errFailed),
+			want:        settledWith{id: methodBasicAck},
+			wantRetry:   "jobs.retry.5m",
+			wantAttempt: 2,
+		},
+		{
+			name:    "exhausted retries are dead-lettered",
+			delays:  delays,
+			attempt: 2,
+			result:  converter.Retry(errFailed),
+			want:    settledWith{id: methodBasicReject},
+		},
+		{
+			name:        "postponed task doesn't use an attempt",
+			delays:      delays,
+			attempt:     1,
+			result:      converter.Defer(errFailed, time.Minute),
+			want:        settledWith{id: methodBasicAck},
+			wantRetry:   "jobs.retry.5m",
+			wantAttempt: 1,
+		},
+		{
+			name:   "postponed task without delays is requeued",
+			result: converter.Defer(errFailed, time.Millisecond),
+			want:   settledWith{id: methodBasicNack, requeue: true},
+		},
+		{
+			name:        "nacked retry stays unacked for redelivery",
+			delays:      delays,
+			result:      converter.Retry(errFailed),
+			nack:        true,
+			wantRetry:   "jobs.retry.30s",
+			wantAttempt: 1,
+			wantErr:     ErrNacked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, broker := newTestConnection(t)
+			broker.confirm = func(uint64) bool { return !tt.nack }
+			ch, err := conn.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := NewConsumer(ConsumerConfig{Queue: "jobs", RetryDelays: tt.delays}, nil)
+			if _, err := c.subscribe(ch, 1, "videoconverter-0"); err != nil {
+				t.Fatalf("subscribe() error = %v", err)
+			}
+
+			d := Delivery{
+				Properties:  Properties{ContentType: "application/json", Expiration: "1000"},
+				DeliveryTag: 5,
+				Body:        []byte(`{"video_id": 3}`),
+				channel:     ch,
+			}
+			if tt.attempt > 0 {
+				d.Headers = Table{RetryAttemptHeader: tt.attempt}
+			}
+			if err := c.settle(context.Background(), d, tt.result); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("settle() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantRetry != "" {
+				p := broker.nextPublished()
+				if p.exchange != "jobs.retry" || p.key != tt.wantRetry {
+					t.Errorf("republished to %s/%s, want jobs.retry/%s", p.exchange, p.key, tt.wantRetry)
+				}
+				if got := p.Headers[RetryAttemptHeader]; got != tt.wantAttempt {
+					t.Errorf("republished attempt %v, want %d", got, tt.wantAttempt)
+				}
+				if p.DeliveryMode != 2 || p.Expiration != "" || string(p.Body) != string(d.Body) {
+					t.Errorf("republished %+v, want a persistent copy without expiration", p.Publishing)
+				}
+			}
+			if tt.wantErr != nil {
+				broker.noMethod()
+				return
+			}
+			if got := readSettle(t, broker.nextMethod(), d.DeliveryTag); got != tt.want {
+				t.Errorf("settled with %+v, want %+v", got, tt.want)
+			}
+			broker.noMethod()
+		})
+	}
+}
+
+func TestMessageDeadline(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		value  interface{}
+		want   time.Time
+		wantOK bool
+	}{
+		{name: "absent"},
+		{name: "timestamp", value: at, want: at, wantOK: true},
+		{name: "RFC 3339", value: "2023-11-14T22:13:20Z", want: at, wantOK: true},
+		{name: "unix seconds", value: int64(1700000000), want: at, wantOK: true},
+		{name: "invalid string", value: "tomorrow"},
+		{name: "zero", value: int32(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := Table{}
+			if tt.value != nil {
+				headers[DeadlineHeader] = tt.value
+			}
+			got, ok := messageDeadline(headers)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("messageDeadline() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
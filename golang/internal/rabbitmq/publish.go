@@ -0,0 +1,57 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// Publish sends a single persistent message over a short-lived connection,
+// for tools that publish occasionally, and waits for the broker to confirm
+// it; config is for amqps:// URLs, see DialTLS. Messages are timestamped
+// when published unless set, which the management API needs to report the
+// age of a queue's head.
+func Publish(url string, config *tls.Config, exchange, key string, msg Publishing) error {
+	conn, err := DialTLS(url, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if msg.DeliveryMode == 0 {
+		msg.DeliveryMode = 2
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	if err := ch.Confirm(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := ch.PublishConfirmed(ctx, exchange, key, msg); err != nil {
+		return err
+	}
+	return ch.Close()
+}
+
+// Inspect reads the message and consumer counts of a queue over a
+// short-lived connection, e.g. to watch the dead-letter queue
+func Inspect(url string, config *tls.Config, queue string) (QueueInfo, error) {
+	conn, err := DialTLS(url, config)
+	if err != nil {
+		return QueueInfo{}, err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return QueueInfo{}, err
+	}
+	defer ch.Close()
+	return ch.QueueInspect(queue)
+}
@@ -0,0 +1,133 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// Topology is the broker setup the worker depends on: the exchange tasks
+// are published to, the conversion queue bound to it, the dead-letter
+// exchange and queue, and the TTL queues delayed retries wait in.
+//
+// Declaring it is idempotent, so every worker declares it on each
+// connection. Changing the arguments of an existing queue (for instance
+// adding a dead-letter exchange later) is refused by the broker; such a
+// queue has to be deleted or migrated by hand first.
+type Topology struct {
+	// Exchange is the direct exchange tasks are published to, with
+	// RoutingKey; the queue is only reachable through the default
+	// exchange when empty
+	Exchange   string
+	RoutingKey string
+	Queue      string
+	// DeadLetterExchange is a fanout exchange receiving the tasks that
+	// failed permanently, kept in DeadLetterQueue when set
+	DeadLetterExchange string
+	DeadLetterQueue    string
+	// RetryDelays are the TTLs of the retry queues, see RetryQueue
+	RetryDelays []time.Duration
+}
+
+// RetryExchange is the exchange retry queues are bound to, each with its own name as key
+func (t Topology) RetryExchange() string {
+	return t.Queue + ".retry"
+}
+
+// RetryQueue is the name of the queue where messages wait delay before
+// being dead-lettered back to the conversion queue
+func (t Topology) RetryQueue(delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", t.Queue, formatDelay(delay))
+}
+
+// formatDelay renders a delay in its largest whole unit: 30s, 5m, 1h
+func formatDelay(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// Declare declares every exchange, queue and binding of the topology
+func (t Topology) Declare(ch *Channel) error {
+	args := Table{}
+	if t.DeadLetterExchange != "" {
+		if err := ch.ExchangeDeclare(t.DeadLetterExchange, "fanout", true, nil); err != nil {
+			return err
+		}
+		args["x-dead-letter-exchange"] = t.DeadLetterExchange
+		if t.DeadLetterQueue != "" {
+			if _, err := ch.QueueDeclare(t.DeadLetterQueue, true, nil); err != nil {
+				return err
+			}
+			if err := ch.QueueBind(t.DeadLetterQueue, t.DeadLetterExchange, "", nil); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := ch.QueueDeclare(t.Queue, true, args); err != nil {
+		return err
+	}
+	if t.Exchange != "" {
+		if err := ch.ExchangeDeclare(t.Exchange, "direct", true, nil); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(t.Queue, t.Exchange, t.RoutingKey, nil); err != nil {
+			return err
+		}
+	}
+	return t.declareRetries(ch)
+}
+
+// declareRetries declares the retry exchange and a TTL queue per delay that
+// dead-letters expired messages back to the conversion queue
+func (t Topology) declareRetries(ch *Channel) error {
+	if len(t.RetryDelays) == 0 {
+		return nil
+	}
+	if err := ch.ExchangeDeclare(t.RetryExchange(), "direct", true, nil); err != nil {
+		return err
+	}
+	// Without an exchange, the default one routes by queue name
+	backExchange, backKey := t.Exchange, t.RoutingKey
+	if backExchange == "" {
+		backKey = t.Queue
+	}
+	for _, delay := range t.RetryDelays {
+		name := t.RetryQueue(delay)
+		args := Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    backExchange,
+			"x-dead-letter-routing-key": backKey,
+		}
+		if _, err := ch.QueueDeclare(name, true, args); err != nil {
+			return err
+		}
+		if err := ch.QueueBind(name, t.RetryExchange(), name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeclareTopology declares the topology over a short-lived connection,
+// e.g. to bootstrap a broker before any worker runs
+func DeclareTopology(url string, config *tls.Config, t Topology) error {
+	conn, err := DialTLS(url, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return t.Declare(ch)
+}
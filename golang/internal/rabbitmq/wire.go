@@ -0,0 +1,321 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Frame types and constants from the AMQP 0-9-1 specification
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// Table is an AMQP field table, used for arguments and message headers
+type Table map[string]interface{}
+
+// Decimal is an AMQP decimal value
+type Decimal struct {
+	Scale uint8
+	Value int32
+}
+
+// frame is a single AMQP frame
+type frame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+// readFrame reads one frame from r
+func readFrame(r io.Reader) (frame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{
+		typ:     header[0],
+		channel: binary.BigEndian.Uint16(header[1:3]),
+	}
+	size := binary.BigEndian.Uint32(header[3:7])
+	f.payload = make([]byte, size+1)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	if f.payload[size] != frameEnd {
+		return frame{}, errors.New("amqp: invalid frame end")
+	}
+	f.payload = f.payload[:size]
+	return f, nil
+}
+
+// writeFrame serialises a frame to w
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, 7, 8+len(f.payload))
+	buf[0] = f.typ
+	binary.BigEndian.PutUint16(buf[1:3], f.channel)
+	binary.BigEndian.PutUint32(buf[3:7], uint32(len(f.payload)))
+	buf = append(buf, f.payload...)
+	buf = append(buf, frameEnd)
+	_, err := w.Write(buf)
+	return err
+}
+
+// writer builds method and header payloads
+type writer struct {
+	bytes.Buffer
+	bits    byte
+	bitsPos int
+}
+
+func (w *writer) flushBits() {
+	if w.bitsPos > 0 {
+		w.WriteByte(w.bits)
+		w.bits, w.bitsPos = 0, 0
+	}
+}
+
+func (w *writer) bit(v bool) {
+	if v {
+		w.bits |= 1 << w.bitsPos
+	}
+	w.bitsPos++
+	if w.bitsPos == 8 {
+		w.flushBits()
+	}
+}
+
+func (w *writer) octet(v uint8) {
+	w.flushBits()
+	w.WriteByte(v)
+}
+
+func (w *writer) short(v uint16) {
+	w.flushBits()
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *writer) long(v uint32) {
+	w.flushBits()
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *writer) longlong(v uint64) {
+	w.flushBits()
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *writer) shortstr(s string) {
+	w.flushBits()
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *writer) longstr(s []byte) {
+	w.long(uint32(len(s)))
+	w.Write(s)
+}
+
+func (w *writer) table(t Table) {
+	var inner writer
+	for k, v := range t {
+		inner.shortstr(k)
+		inner.field(v)
+	}
+	w.longstr(inner.Bytes())
+}
+
+// field writes a single typed value of a field table
+func (w *writer) field(v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		w.WriteByte('t')
+		if v {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+	case int8:
+		w.WriteByte('b')
+		w.WriteByte(byte(v))
+	case uint8:
+		w.WriteByte('B')
+		w.WriteByte(v)
+	case int16:
+		w.WriteByte('s')
+		binary.Write(w, binary.BigEndian, v)
+	case uint16:
+		w.WriteByte('u')
+		binary.Write(w, binary.BigEndian, v)
+	case int32:
+		w.WriteByte('I')
+		binary.Write(w, binary.BigEndian, v)
+	case uint32:
+		w.WriteByte('i')
+		binary.Write(w, binary.BigEndian, v)
+	case int:
+		w.WriteByte('l')
+		binary.Write(w, binary.BigEndian, int64(v))
+	case int64:
+		w.WriteByte('l')
+		binary.Write(w, binary.BigEndian, v)
+	case float32:
+		w.WriteByte('f')
+		binary.Write(w, binary.BigEndian, v)
+	case float64:
+		w.WriteByte('d')
+		binary.Write(w, binary.BigEndian, v)
+	case Decimal:
+		w.WriteByte('D')
+		w.WriteByte(v.Scale)
+		binary.Write(w, binary.BigEndian, v.Value)
+	case string:
+		w.WriteByte('S')
+		w.longstr([]byte(v))
+	case []byte:
+		w.WriteByte('x')
+		w.longstr(v)
+	case []interface{}:
+		w.WriteByte('A')
+		var inner writer
+		for _, item := range v {
+			inner.field(item)
+		}
+		w.longstr(inner.Bytes())
+	case time.Time:
+		w.WriteByte('T')
+		binary.Write(w, binary.BigEndian, uint64(v.Unix()))
+	case Table:
+		w.WriteByte('F')
+		w.table(v)
+	case nil:
+		w.WriteByte('V')
+	default:
+		// Unsupported values are sent as their string form
+		w.WriteByte('S')
+		w.longstr([]byte(fmt.Sprint(v)))
+	}
+}
+
+// reader parses method and header payloads
+type reader struct {
+	buf     []byte
+	pos     int
+	bits    byte
+	bitsPos int
+	err     error
+}
+
+func (r *reader) next(n int) []byte {
+	r.bitsPos = 0
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if r.pos+n > len(r.buf) {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) bit() bool {
+	if r.bitsPos == 0 {
+		r.bits = r.next(1)[0]
+	}
+	v := r.bits&(1<<r.bitsPos) != 0
+	r.bitsPos = (r.bitsPos + 1) % 8
+	return v
+}
+
+func (r *reader) octet() uint8     { return r.next(1)[0] }
+func (r *reader) short() uint16    { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *reader) long() uint32     { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *reader) longlong() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+
+func (r *reader) shortstr() string {
+	n := int(r.octet())
+	return string(r.next(n))
+}
+
+func (r *reader) longstr() []byte {
+	n := int(r.long())
+	return append([]byte(nil), r.next(n)...)
+}
+
+func (r *reader) table() Table {
+	data := r.longstr()
+	inner := reader{buf: data}
+	t := Table{}
+	for inner.pos < len(inner.buf) && inner.err == nil {
+		key := inner.shortstr()
+		t[key] = inner.field()
+	}
+	if inner.err != nil && r.err == nil {
+		r.err = inner.err
+	}
+	return t
+}
+
+// field reads a single typed value of a field table
+func (r *reader) field() interface{} {
+	switch r.octet() {
+	case 't':
+		return r.octet() != 0
+	case 'b':
+		return int8(r.octet())
+	case 'B':
+		return r.octet()
+	case 's':
+		return int16(r.short())
+	case 'u':
+		return r.short()
+	case 'I':
+		return int32(r.long())
+	case 'i':
+		return r.long()
+	case 'l':
+		return int64(r.longlong())
+	case 'f':
+		return math.Float32frombits(r.long())
+	case 'd':
+		return math.Float64frombits(r.longlong())
+	case 'D':
+		scale := r.octet()
+		return Decimal{Scale: scale, Value: int32(r.long())}
+	case 'S':
+		return string(r.longstr())
+	case 'x':
+		return r.longstr()
+	case 'A':
+		data := r.longstr()
+		inner := reader{buf: data}
+		var items []interface{}
+		for inner.pos < len(inner.buf) && inner.err == nil {
+			items = append(items, inner.field())
+		}
+		return items
+	case 'T':
+		return time.Unix(int64(r.longlong()), 0)
+	case 'F':
+		return r.table()
+	case 'V':
+		return nil
+	}
+	if r.err == nil {
+		r.err = errors.New("amqp: unknown field type")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []frame{
+		{typ: frameMethod, channel: 1, payload: []byte{0, 60, 0, 40, 1, 2, 3}},
+		{typ: frameBody, channel: 65535, payload: bytes.Repeat([]byte("x"), 4096)},
+		{typ: frameHeartbeat, payload: []byte{}},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := writeFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("readFrame() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readFrame() = %+v, want %+v", got, want)
+		}
+	}
+	if _, err := readFrame(&buf); !errors.Is(err, io.EOF) {
+		t.Errorf("readFrame() past the end error = %v, want EOF", err)
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, frame{typ: frameMethod, channel: 1, payload: []byte{1, 2}})
+	valid := buf.Bytes()
+
+	badEnd := append([]byte(nil), valid...)
+	badEnd[len(badEnd)-1] = 0
+	if _, err := readFrame(bytes.NewReader(badEnd)); err == nil {
+		t.Error("readFrame() accepted a frame without its end octet")
+	}
+	if _, err := readFrame(bytes.NewReader(valid[:len(valid)-2])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readFrame() of a truncated frame error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	table := Table{
+		"bool":      true,
+		"int8":      int8(-8),
+		"uint8":     uint8(8),
+		"int16":     int16(-16),
+		"uint16":    uint16(16),
+		"int32":     int32(-32),
+		"uint32":    uint32(32),
+		"int64":     int64(-64),
+		"float32":   float32(1.5),
+		"float64":   2.25,
+		"decimal":   Decimal{Scale: 2, Value: 1234},
+		"string":    "video",
+		"bytes":     []byte{0, 1, 2},
+		"array":     []interface{}{"a", int32(1), nil},
+		"timestamp": at,
+		"table":     Table{"x-death": int64(3)},
+		"void":      nil,
+	}
+	var w writer
+	w.table(table)
+	r := reader{buf: w.Bytes()}
+	got := r.table()
+	if r.err != nil {
+		t.Fatalf("table() error = %v", r.err)
+	}
+	if !reflect.DeepEqual(got, table) {
+		t.Errorf("table() = %#v, want %#v", got, table)
+	}
+	if r.pos != len(r.buf) {
+		t.Errorf("table() read %d of %d bytes", r.pos, len(r.buf))
+	}
+}
+
+func TestTableWidensValues(t *testing.T) {
+	var w writer
+	w.table(Table{"int": 5, "duration": time.Second})
+	r := reader{buf: w.Bytes()}
+	got := r.table()
+	want := Table{"int": int64(5), "duration": "1s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("table() = %#v, want %#v", got, want)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var w writer
+	w.table(Table{"key": "value"})
+	data := w.Bytes()
+	r := reader{buf: data[:len(data)-3]}
+	r.table()
+	if !errors.Is(r.err, io.ErrUnexpectedEOF) {
+		t.Errorf("err = %v, want %v", r.err, io.ErrUnexpectedEOF)
+	}
+
+	r = reader{buf: []byte{'?'}}
+	r.field()
+	if r.err == nil {
+		t.Error("field() accepted an unknown field type")
+	}
+}
+
+func TestBits(t *testing.T) {
+	var w writer
+	w.longlong(42)
+	w.bit(true)
+	w.bit(false)
+	w.bit(true)
+	w.shortstr("key")
+	w.bit(true)
+	w.flushBits()
+
+	r := reader{buf: w.Bytes()}
+	if got := r.longlong(); got != 42 {
+		t.Errorf("longlong() = %d, want 42", got)
+	}
+	if a, b, c := r.bit(), r.bit(), r.bit(); !a || b || !c {
+		t.Errorf("bits = %v %v %v, want true false true", a, b, c)
+	}
+	if got := r.shortstr(); got != "key" {
+		t.Errorf("shortstr() = %q, want key", got)
+	}
+	if !r.bit() {
+		t.Error("bit() after a string = false, want true")
+	}
+	if r.err != nil || r.pos != len(r.buf) {
+		t.Errorf("read %d of %d bytes, err = %v", r.pos, len(r.buf), r.err)
+	}
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	props := Properties{
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Headers:         Table{RetryAttemptHeader: int32(2)},
+		DeliveryMode:    2,
+		Priority:        5,
+		CorrelationID:   "correlation",
+		ReplyTo:         "replies",
+		Expiration:      "60000",
+		MessageID:       "message",
+		Timestamp:       time.Unix(1700000000, 0),
+		Type:            "video.task",
+		UserID:          "guest",
+		AppID:           "django",
+	}
+	for _, want := range []Properties{props, {}, {ContentType: "text/plain", Timestamp: props.Timestamp}} {
+		var w writer
+		writeProperties(&w, want)
+		r := reader{buf: w.Bytes()}
+		got := readProperties(&r)
+		if r.err != nil {
+			t.Fatalf("readProperties() error = %v", r.err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("readProperties() = %+v, want %+v", got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package redaction finds the regions of frames to blur for the
+// converter's redact stage
+package redaction
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// HTTPDetector posts each frame as image/jpeg to a detection service, such
+// as a face detector behind a small HTTP wrapper, which answers with a
+// JSON array of the rectangles to blur, in pixels of the frame:
+//
+//	[{"x": 120, "y": 40, "width": 64, "height": 80}]
+type HTTPDetector struct {
+	URL string
+	// Token, when set, is sent as a bearer token
+	Token string
+	// Client is a client with a 30 second timeout when nil
+	Client *http.Client
+}
+
+// Name implements converter.RegionDetector
+func (d HTTPDetector) Name() string { return "http" }
+
+// Detect implements converter.RegionDetector
+func (d HTTPDetector) Detect(ctx context.Context, frame string) ([]converter.Redaction, error) {
+	f, err := os.Open(frame)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, f)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "image/jpeg")
+	if d.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.Token)
+	}
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call detector: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("detector returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var regions []converter.Redaction
+	if err := json.NewDecoder(resp.Body).Decode(&regions); err != nil {
+		return nil, fmt.Errorf("failed to decode detector response: %w", err)
+	}
+	return regions, nil
+}
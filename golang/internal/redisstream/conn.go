@@ -0,0 +1,163 @@
+// Package redisstream consumes and publishes conversion tasks through Redis
+// Streams and consumer groups, for teams that run Redis and no broker. It
+// speaks just enough of the RESP protocol for the stream commands.
+package redisstream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTimeout bounds a command that doesn't block
+const defaultTimeout = 10 * time.Second
+
+// ErrProtocol is returned when the server sends something we can't parse
+var ErrProtocol = errors.New("redis: protocol error")
+
+// Error is an error reply of the server
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Conn is a connection to a Redis server. Commands are serialized, so a
+// blocking read should have a connection of its own.
+type Conn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Dial connects to a redis:// URL, authenticating with its password (and
+// username) and selecting its database number, if any
+func Dial(rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid redis url: unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	netConn, err := net.DialTimeout("tcp", addr, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" && db != "0" {
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply: a string, int64, nil or a
+// []interface{} of those. Error replies are returned as Error.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	return c.DoTimeout(defaultTimeout, args...)
+}
+
+// DoTimeout is Do for commands that may block up to timeout on the server
+func (c *Conn) DoTimeout(timeout time.Duration, args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.read()
+	if e, ok := reply.(Error); ok && err == nil {
+		return nil, e
+	}
+	return reply, err
+}
+
+// read reads one reply
+func (c *Conn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, ErrProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return Error(line), nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Errors nested in arrays are kept as values
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, ErrProtocol
+}
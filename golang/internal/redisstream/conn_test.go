@@ -0,0 +1,231 @@
+package redisstream
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a Redis server that answers commands with reply, the raw
+// RESP to send back, and records them
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	reply    func(args []string) string
+	commands [][]string
+}
+
+// newFakeRedis starts a fake Redis server on a local port
+func newFakeRedis(t *testing.T, reply func(args []string) string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, reply: reply}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// URL is the redis:// URL of the server
+func (f *fakeRedis) URL() string {
+	return "redis://" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		reply := f.reply
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+// calls returns the commands received so far
+func (f *fakeRedis) calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+// readCommand reads an array of bulk strings, the way clients send commands
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// ok replies +OK to any command
+func ok([]string) string { return "+OK\r\n" }
+
+func TestDoEncodesCommand(t *testing.T) {
+	client, server := net.Pipe()
+	conn := &Conn{conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+	defer conn.Close()
+	want := "*3\r\n$4\r\nXADD\r\n$5\r\ntasks\r\n$8\r\ntask\r\n{}\r\n"
+	received := make(chan string, 1)
+	go func() {
+		// The argument's CRLF is sent as is, its length delimits it
+		req := make([]byte, len(want))
+		io.ReadFull(server, req)
+		received <- string(req)
+		io.WriteString(server, "+OK\r\n")
+	}()
+
+	if reply, err := conn.Do("XADD", "tasks", "task\r\n{}"); err != nil || reply != "OK" {
+		t.Fatalf("Do() = %v, %v, want OK", reply, err)
+	}
+	if got := <-received; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    interface{}
+		wantErr error
+	}{
+		{name: "simple string", reply: "+OK\r\n", want: "OK"},
+		{name: "error", reply: "-ERR unknown command\r\n", want: Error("ERR unknown command")},
+		{name: "integer", reply: ":-42\r\n", want: int64(-42)},
+		{name: "bulk string", reply: "$7\r\nline\r\n2\r\n", want: "line\r\n2"},
+		{name: "empty bulk string", reply: "$0\r\n\r\n", want: ""},
+		{name: "null bulk string", reply: "$-1\r\n"},
+		{name: "null array", reply: "*-1\r\n"},
+		{
+			name:  "nested array keeps errors as values",
+			reply: "*3\r\n:1\r\n*2\r\n$2\r\nid\r\n$-1\r\n-ERR nested\r\n",
+			want:  []interface{}{int64(1), []interface{}{"id", nil}, Error("ERR nested")},
+		},
+		{name: "unknown type", reply: "?1\r\n", wantErr: ErrProtocol},
+		{name: "invalid integer", reply: ":one\r\n", wantErr: ErrProtocol},
+		{name: "invalid length", reply: "$x\r\n", wantErr: ErrProtocol},
+		{name: "missing CR", reply: "+OK\n", wantErr: ErrProtocol},
+		{name: "truncated bulk string", reply: "$10\r\nshort\r\n", wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated array", reply: "*2\r\n:1\r\n", wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &Conn{r: bufio.NewReader(strings.NewReader(tt.reply))}
+			got, err := conn.read()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("read() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoErrorReply(t *testing.T) {
+	server := newFakeRedis(t, func([]string) string { return "-BUSYGROUP Consumer Group name already exists\r\n" })
+	conn, err := Dial(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reply, err := conn.Do("XGROUP", "CREATE", "tasks", "converters", "0")
+	var e Error
+	if reply != nil || !errors.As(err, &e) || !strings.HasPrefix(string(e), "BUSYGROUP") {
+		t.Errorf("Do() = %v, %v, want the error reply", reply, err)
+	}
+	// The connection is still usable after an error reply
+	server.mu.Lock()
+	server.reply = ok
+	server.mu.Unlock()
+	if reply, err := conn.Do("PING"); err != nil || reply != "OK" {
+		t.Errorf("Do() after an error reply = %v, %v", reply, err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    [][]string
+		wantErr bool
+	}{
+		{name: "no auth", path: "", want: nil},
+		{name: "password", path: ":secret@%s", want: [][]string{{"AUTH", "secret"}}},
+		{name: "username and database", path: "worker:secret@%s/2", want: [][]string{{"AUTH", "worker", "secret"}, {"SELECT", "2"}}},
+		{name: "default database", path: "%s/0", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, ok)
+			addr := server.ln.Addr().String()
+			url := "redis://" + addr
+			if tt.path != "" {
+				url = "redis://" + strings.Replace(tt.path, "%s", addr, 1)
+			}
+			conn, err := Dial(url)
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+			conn.Do("PING")
+			want := append(tt.want, []string{"PING"})
+			if got := server.calls(); !reflect.DeepEqual(got, want) {
+				t.Errorf("commands = %q, want %q", got, want)
+			}
+		})
+	}
+
+	server := newFakeRedis(t, func([]string) string { return "-WRONGPASS invalid username-password pair\r\n" })
+	if _, err := Dial("redis://:wrong@" + server.ln.Addr().String()); err == nil {
+		t.Error("Dial() with a wrong password succeeded")
+	}
+	if _, err := Dial("rediss://localhost"); err == nil {
+		t.Error("Dial() accepted a rediss:// URL")
+	}
+}
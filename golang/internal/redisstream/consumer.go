@@ -0,0 +1,370 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// TaskField is the entry field holding the task message
+const TaskField = "task"
+
+// readBlock is how long a read waits for new entries before the consumer
+// looks for stuck ones again
+const readBlock = 2 * time.Second
+
+// ConsumerConfig configures the stream and consumer group tasks are
+// consumed from
+type ConsumerConfig struct {
+	URL    string
+	Stream string
+	// Group is the consumer group, created at the start of the stream when
+	// missing, and Consumer this worker's name in it
+	Group    string
+	Consumer string
+	// Consumers is how many tasks are converted at the same time, 1 when zero
+	Consumers int
+	// ClaimIdle is how long an entry stays pending without a heartbeat
+	// before XAUTOCLAIM hands it to another consumer, 5m when zero. While
+	// an entry is converted its idle time is reset every third of it, so
+	// only entries of dead workers, and tasks that asked for a retry, are
+	// claimed.
+	ClaimIdle time.Duration
+	// MaxDeliveries is how many times an entry is delivered before it is
+	// dead-lettered, 5 when zero
+	MaxDeliveries int
+	// DeadLetterStream receives the tasks that failed permanently or ran
+	// out of deliveries, which are then acknowledged. Without it they are
+	// only acknowledged; their failure is in the error log.
+	DeadLetterStream string
+
+	// ReconnectMin and ReconnectMax bound the exponential backoff between
+	// reconnection attempts, 1s and 30s when zero
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+	// OnPause is called when the connection is lost, and OnResume once
+	// consuming again after an outage
+	OnPause  func(err error)
+	OnResume func()
+}
+
+// Entry is a stream entry
+type Entry struct {
+	ID     string
+	Fields map[string]string
+}
+
+// Consumer delivers conversion tasks read from a stream's consumer group
+// to a handler: successful tasks are acknowledged with XACK, tasks to
+// retry stay pending until XAUTOCLAIM picks them up again, and failed
+// ones are dead-lettered
+type Consumer struct {
+	cfg    ConsumerConfig
+	handle func(ctx context.Context, msg []byte) converter.Result
+	paused atomic.Bool
+}
+
+// NewConsumer creates a new instance of Consumer
+func NewConsumer(cfg ConsumerConfig, handle func(ctx context.Context, msg []byte) converter.Result) *Consumer {
+	if cfg.ClaimIdle <= 0 {
+		cfg.ClaimIdle = 5 * time.Minute
+	}
+	if cfg.MaxDeliveries <= 0 {
+		cfg.MaxDeliveries = 5
+	}
+	return &Consumer{cfg: cfg, handle: handle}
+}
+
+// Paused reports whether Serve lost the connection and hasn't recovered yet
+func (c *Consumer) Paused() bool {
+	return c.paused.Load()
+}
+
+// Serve consumes until ctx is done, reconnecting with backoff when the
+// connection to Redis is lost
+func (c *Consumer) Serve(ctx context.Context) error {
+	minBackoff := c.cfg.ReconnectMin
+	if minBackoff <= 0 {
+		minBackoff = time.Second
+	}
+	maxBackoff := c.cfg.ReconnectMax
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	backoff := minBackoff
+	for {
+		err := c.session(ctx, func() {
+			backoff = minBackoff
+			if c.paused.CompareAndSwap(true, false) {
+				slog.Info("Consumer resumed", slog.String("stream", c.cfg.Stream))
+				if c.cfg.OnResume != nil {
+					c.cfg.OnResume()
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if c.paused.CompareAndSwap(false, true) {
+			slog.Warn("Consumer paused, Redis unavailable", slog.String("stream", c.cfg.Stream), slog.String("error", err.Error()))
+			if c.cfg.OnPause != nil {
+				c.cfg.OnPause(err)
+			}
+		}
+
+		wait := time.Duration(rand.Int63n(int64(backoff))) + minBackoff/2
+		slog.Info("Reconnecting to Redis", slog.String("stream", c.cfg.Stream), slog.Duration("in", wait), slog.String("error", err.Error()))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// session connects, makes sure the group exists and consumes until the
+// connection fails, calling connected once ready. Blocking reads get a
+// connection of their own; acks, heartbeats and claims share the other.
+// It waits for the tasks being converted before returning; an entry that
+// couldn't be acknowledged is claimed again once idle.
+func (c *Consumer) session(ctx context.Context, connected func()) error {
+	reader, err := Dial(c.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	cmd, err := Dial(c.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer cmd.Close()
+
+	_, err = cmd.Do("XGROUP", "CREATE", c.cfg.Stream, c.cfg.Group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	connected()
+
+	consumers := max(c.cfg.Consumers, 1)
+	slots := make(chan struct{}, consumers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slog.Info("Consuming tasks",
+		slog.String("stream", c.cfg.Stream),
+		slog.String("group", c.cfg.Group),
+		slog.String("consumer", c.cfg.Consumer),
+		slog.Int("consumers", consumers))
+
+	var lastClaim time.Time
+	for {
+		// Only take as many entries as there are free consumers
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case slots <- struct{}{}:
+		}
+		free := 1
+		for len(slots) < cap(slots) {
+			slots <- struct{}{}
+			free++
+		}
+
+		var entries []Entry
+		claimed := false
+		if time.Since(lastClaim) >= c.cfg.ClaimIdle/2 {
+			lastClaim = time.Now()
+			entries, err = c.claim(cmd, free)
+			claimed = len(entries) > 0
+		}
+		if err == nil && !claimed {
+			entries, err = c.read(reader, free)
+		}
+		for i := len(entries); i < free; i++ {
+			<-slots
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			deliveries := 1
+			if claimed {
+				deliveries = c.deliveries(cmd, entry.ID)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				c.process(ctx, cmd, entry, deliveries)
+			}()
+		}
+	}
+}
+
+// read waits for entries never delivered to the group
+func (c *Consumer) read(conn *Conn, count int) ([]Entry, error) {
+	reply, err := conn.DoTimeout(readBlock+defaultTimeout, "XREADGROUP", "GROUP", c.cfg.Group, c.cfg.Consumer,
+		"COUNT", strconv.Itoa(count), "BLOCK", strconv.FormatInt(readBlock.Milliseconds(), 10),
+		"STREAMS", c.cfg.Stream, ">")
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	// [[stream, [entry...]]]
+	streams, ok := reply.([]interface{})
+	if !ok || len(streams) == 0 {
+		return nil, ErrProtocol
+	}
+	stream, ok := streams[0].([]interface{})
+	if !ok || len(stream) != 2 {
+		return nil, ErrProtocol
+	}
+	return parseEntries(stream[1])
+}
+
+// claim takes over entries pending for longer than ClaimIdle, left by dead
+// consumers or waiting for a retry
+func (c *Consumer) claim(conn *Conn, count int) ([]Entry, error) {
+	reply, err := conn.Do("XAUTOCLAIM", c.cfg.Stream, c.cfg.Group, c.cfg.Consumer,
+		strconv.FormatInt(c.cfg.ClaimIdle.Milliseconds(), 10), "0-0", "COUNT", strconv.Itoa(count))
+	if err != nil {
+		return nil, err
+	}
+	// [next-start, [entry...], deleted-ids] (no deleted ids before Redis 7)
+	parts, ok := reply.([]interface{})
+	if !ok || len(parts) < 2 {
+		return nil, ErrProtocol
+	}
+	entries, err := parseEntries(parts[1])
+	if len(entries) > 0 {
+		slog.Warn("Claimed stuck entries", slog.String("stream", c.cfg.Stream), slog.Int("entries", len(entries)))
+	}
+	return entries, err
+}
+
+// deliveries returns how many times the entry was delivered, 1 when it
+// can't be read
+func (c *Consumer) deliveries(conn *Conn, id string) int {
+	reply, err := conn.Do("XPENDING", c.cfg.Stream, c.cfg.Group, id, id, "1")
+	if err != nil {
+		return 1
+	}
+	// [[id, consumer, idle, deliveries]]
+	if rows, ok := reply.([]interface{}); ok && len(rows) == 1 {
+		if row, ok := rows[0].([]interface{}); ok && len(row) == 4 {
+			if n, ok := row[3].(int64); ok {
+				return int(n)
+			}
+		}
+	}
+	return 1
+}
+
+// process converts one entry, keeping it from being claimed meanwhile,
+// and settles it; the conversion stops when ctx is done
+func (c *Consumer) process(ctx context.Context, conn *Conn, entry Entry, deliveries int) {
+	var result converter.Result
+	if deliveries > c.cfg.MaxDeliveries {
+		result = converter.Permanent(fmt.Errorf("delivered %d times, more than the limit of %d", deliveries, c.cfg.MaxDeliveries))
+	} else {
+		done := make(chan struct{})
+		go c.heartbeat(conn, entry.ID, done)
+		result = c.handle(ctx, []byte(entry.Fields[TaskField]))
+		close(done)
+	}
+
+	if err := c.settle(conn, entry, result); err != nil {
+		slog.Error("Error settling entry",
+			slog.String("stream", c.cfg.Stream),
+			slog.String("id", entry.ID),
+			slog.String("error", err.Error()))
+	}
+}
+
+// heartbeat resets the idle time of the entry until done is closed.
+// XCLAIM with JUSTID doesn't count as a delivery.
+func (c *Consumer) heartbeat(conn *Conn, id string, done <-chan struct{}) {
+	ticker := time.NewTicker(c.cfg.ClaimIdle / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := conn.Do("XCLAIM", c.cfg.Stream, c.cfg.Group, c.cfg.Consumer, "0", id, "JUSTID"); err != nil {
+				slog.Warn("Error refreshing pending entry", slog.String("id", id), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// settle acknowledges, leaves pending or dead-letters the entry
+func (c *Consumer) settle(conn *Conn, entry Entry, result converter.Result) error {
+	switch result.Outcome {
+	case converter.OutcomeSuccess:
+		_, err := conn.Do("XACK", c.cfg.Stream, c.cfg.Group, entry.ID)
+		return err
+	case converter.OutcomeRetry:
+		slog.Warn("Leaving task pending for a retry",
+			slog.String("id", entry.ID),
+			slog.Duration("retry_in", c.cfg.ClaimIdle),
+			slog.String("error", result.Err.Error()))
+		return nil
+	default:
+		slog.Error("Dead-lettering task", slog.String("id", entry.ID), slog.String("error", result.Err.Error()))
+		if c.cfg.DeadLetterStream != "" {
+			_, err := conn.Do("XADD", c.cfg.DeadLetterStream, "*",
+				TaskField, entry.Fields[TaskField],
+				"source_stream", c.cfg.Stream,
+				"source_id", entry.ID,
+				"error", result.Err.Error())
+			if err != nil {
+				// Leave it pending, it is claimed and fails again
+				return err
+			}
+		}
+		_, err := conn.Do("XACK", c.cfg.Stream, c.cfg.Group, entry.ID)
+		return err
+	}
+}
+
+// parseEntries decodes a list of [id, [field, value, ...]] entries. Entries
+// deleted from the stream while pending come with no fields and are skipped.
+func parseEntries(reply interface{}) ([]Entry, error) {
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, ErrProtocol
+	}
+	entries := make([]Entry, 0, len(items))
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, ErrProtocol
+		}
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, ErrProtocol
+		}
+		fields, _ := pair[1].([]interface{})
+		if fields == nil {
+			continue
+		}
+		entry := Entry{ID: id, Fields: map[string]string{}}
+		for i := 0; i+1 < len(fields); i += 2 {
+			k, _ := fields[i].(string)
+			v, _ := fields[i+1].(string)
+			entry.Fields[k] = v
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
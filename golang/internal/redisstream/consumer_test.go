@@ -0,0 +1,225 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"imersaofc/internal/converter"
+)
+
+// bulk encodes a RESP bulk string
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// array encodes a RESP array of encoded items
+func array(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+// entry encodes a stream entry with a task
+func entry(id, task string) string {
+	return array(bulk(id), array(bulk(TaskField), bulk(task)))
+}
+
+func TestConsumerSettle(t *testing.T) {
+	errFailed := errors.New("ffmpeg failed")
+	xack := []string{"XACK", "tasks", "converters", "1-1"}
+	xadd := []string{"XADD", "tasks-dead", "*", "task", `{"video_id": 3}`, "source_stream", "tasks", "source_id", "1-1", "error", "ffmpeg failed"}
+	tests := []struct {
+		name       string
+		deadLetter string
+		failXADD   bool
+		result     converter.Result
+		want       [][]string
+		wantErr    bool
+	}{
+		{
+			name:   "success is acknowledged",
+			result: converter.Success(),
+			want:   [][]string{xack},
+		},
+		{
+			name:   "retry stays pending",
+			result: converter.Retry(errFailed),
+		},
+		{
+			name:   "permanent failure without a dead-letter stream is acknowledged",
+			result: converter.Permanent(errFailed),
+			want:   [][]string{xack},
+		},
+		{
+			name:       "permanent failure is dead-lettered and acknowledged",
+			deadLetter: "tasks-dead",
+			result:     converter.Permanent(errFailed),
+			want:       [][]string{xadd, xack},
+		},
+		{
+			name:       "failed dead-letter stays pending",
+			deadLetter: "tasks-dead",
+			failXADD:   true,
+			result:     converter.Permanent(errFailed),
+			want:       [][]string{xadd},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, func(args []string) string {
+				if args[0] == "XADD" && tt.failXADD {
+					return "-OOM command not allowed when used memory > 'maxmemory'\r\n"
+				}
+				return ":1\r\n"
+			})
+			conn, err := Dial(server.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewConsumer(ConsumerConfig{Stream: "tasks", Group: "converters", DeadLetterStream: tt.deadLetter}, nil)
+
+			e := Entry{ID: "1-1", Fields: map[string]string{TaskField: `{"video_id": 3}`}}
+			if err := c.settle(conn, e, tt.result); (err != nil) != tt.wantErr {
+				t.Fatalf("settle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := server.calls(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsumerServe(t *testing.T) {
+	handled := make(chan string, 2)
+	acked := make(chan string, 2)
+	read := false
+	server := newFakeRedis(t, func(args []string) string {
+		switch args[0] {
+		case "XGROUP":
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		case "XAUTOCLAIM":
+			// An entry of a dead worker, delivered too many times already
+			return array(bulk("0-0"), array(entry("1-1", `{"video_id": 1}`)), array())
+		case "XPENDING":
+			return array(array(bulk("1-1"), bulk("worker-1"), ":300000\r\n", ":6\r\n"))
+		case "XREADGROUP":
+			// Reads only come from the reader connection, one at a time
+			if !read {
+				read = true
+				return array(array(bulk("tasks"), array(entry("2-1", `{"video_id": 2}`))))
+			}
+			time.Sleep(10 * time.Millisecond)
+			return "*-1\r\n"
+		case "XACK":
+			acked <- args[3]
+			return ":1\r\n"
+		}
+		return bulk("3-1")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewConsumer(ConsumerConfig{URL: server.URL(), Stream: "tasks", Group: "converters", Consumer: "worker-2", DeadLetterStream: "tasks-dead"},
+		func(ctx context.Context, msg []byte) converter.Result {
+			handled <- string(msg)
+			return converter.Success()
+		})
+	served := make(chan error, 1)
+	go func() { served <- c.Serve(ctx) }()
+
+	for _, want := range []string{"1-1", "2-1"} {
+		select {
+		case id := <-acked:
+			if id != want {
+				t.Errorf("acknowledged %s, want %s", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the ack of %s", want)
+		}
+	}
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve() error = %v, want %v", err, context.Canceled)
+	}
+	if msg := <-handled; msg != `{"video_id": 2}` || len(handled) != 0 {
+		t.Errorf("handled %q, want only the new entry", msg)
+	}
+
+	var deadLettered bool
+	for _, cmd := range server.calls() {
+		if cmd[0] == "XADD" {
+			deadLettered = reflect.DeepEqual(cmd[:6], []string{"XADD", "tasks-dead", "*", "task", `{"video_id": 1}`, "source_stream"})
+			if !strings.Contains(cmd[len(cmd)-1], "delivered 6 times") {
+				t.Errorf("dead-lettered with error %q", cmd[len(cmd)-1])
+			}
+		}
+	}
+	if !deadLettered {
+		t.Error("entry delivered too many times wasn't dead-lettered")
+	}
+}
+
+func TestConsumerDeliveries(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  int
+	}{
+		{name: "pending entry", reply: array(array(bulk("1-1"), bulk("worker-1"), ":1000\r\n", ":3\r\n")), want: 3},
+		{name: "no longer pending", reply: array(), want: 1},
+		{name: "error", reply: "-NOGROUP No such key\r\n", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeRedis(t, func([]string) string { return tt.reply })
+			conn, err := Dial(server.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewConsumer(ConsumerConfig{Stream: "tasks", Group: "converters"}, nil)
+			if got := c.deliveries(conn, "1-1"); got != tt.want {
+				t.Errorf("deliveries() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   interface{}
+		want    []Entry
+		wantErr bool
+	}{
+		{
+			name: "entries",
+			reply: []interface{}{
+				[]interface{}{"1-1", []interface{}{"task", `{"video_id": 1}`, "source", "django"}},
+				// Deleted from the stream while pending
+				[]interface{}{"1-2", nil},
+			},
+			want: []Entry{{ID: "1-1", Fields: map[string]string{"task": `{"video_id": 1}`, "source": "django"}}},
+		},
+		{name: "empty", reply: []interface{}{}, want: []Entry{}},
+		{name: "not a list", reply: "OK", wantErr: true},
+		{name: "invalid entry", reply: []interface{}{[]interface{}{"1-1"}}, wantErr: true},
+		{name: "invalid id", reply: []interface{}{[]interface{}{int64(1), []interface{}{}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEntries(tt.reply)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEntries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEntries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package redisstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"imersaofc/internal/converter"
+)
+
+// Enqueuer appends tasks to a stream with XADD over a connection it opens
+// on first use and again after an error
+type Enqueuer struct {
+	url    string
+	stream string
+	// maxLen caps the stream length, approximately, 0 for no cap
+	maxLen int
+
+	mu   sync.Mutex
+	conn *Conn
+}
+
+// NewEnqueuer creates a new instance of Enqueuer. Streams keep acknowledged
+// entries, so maxLen should leave room for the backlog of every group;
+// 0 never trims.
+func NewEnqueuer(url, stream string, maxLen int) *Enqueuer {
+	return &Enqueuer{url: url, stream: stream, maxLen: maxLen}
+}
+
+// Enqueue appends the task
+func (e *Enqueuer) Enqueue(task converter.VideoTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return e.PublishJSON(body)
+}
+
+// PublishJSON appends an encoded message, a task or a batch of tasks
+func (e *Enqueuer) PublishJSON(body []byte) error {
+	if e.stream == "" {
+		return fmt.Errorf("redis stream is required")
+	}
+	args := []string{"XADD", e.stream}
+	if e.maxLen > 0 {
+		args = append(args, "MAXLEN", "~", strconv.Itoa(e.maxLen))
+	}
+	args = append(args, "*", TaskField, string(body))
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		conn, err := Dial(e.url)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	if _, err := e.conn.Do(args...); err != nil {
+		if _, reply := err.(Error); !reply {
+			e.conn.Close()
+			e.conn = nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package redisstream
+
+import (
+	"reflect"
+	"testing"
+
+	"imersaofc/internal/converter"
+)
+
+func TestEnqueue(t *testing.T) {
+	server := newFakeRedis(t, func([]string) string { return bulk("1-1") })
+	e := NewEnqueuer(server.URL(), "tasks", 1000)
+	if err := e.Enqueue(converter.VideoTask{VideoID: 3, Path: "media/uploads/3"}); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	want := [][]string{{"XADD", "tasks", "MAXLEN", "~", "1000", "*", "task", `{"video_id":3,"path":"media/uploads/3","chunk_layout":{}}`}}
+	if got := server.calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	if err := NewEnqueuer(server.URL(), "", 0).PublishJSON([]byte("{}")); err == nil {
+		t.Error("PublishJSON() without a stream succeeded")
+	}
+}
+
+func TestEnqueueReconnects(t *testing.T) {
+	server := newFakeRedis(t, func([]string) string { return bulk("1-1") })
+	e := NewEnqueuer(server.URL(), "tasks", 0)
+	if err := e.PublishJSON([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	// A broken connection is dropped and opened again on the next publish
+	e.conn.Close()
+	if err := e.PublishJSON([]byte("{}")); err == nil {
+		t.Fatal("PublishJSON() over a closed connection succeeded")
+	}
+	if err := e.PublishJSON([]byte("{}")); err != nil {
+		t.Errorf("PublishJSON() after reconnecting error = %v", err)
+	}
+	if got := len(server.calls()); got != 2 {
+		t.Errorf("server received %d commands, want 2", got)
+	}
+}
@@ -0,0 +1,84 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"imersaofc/internal/awsauth"
+)
+
+// AWSSecretsManager reads secrets from an AWS Secrets Manager secret whose
+// value is a JSON object: each name is one of its keys
+type AWSSecretsManager struct {
+	Region string
+	// SecretID is the name or ARN of the secret
+	SecretID string
+	Creds    awsauth.Credentials
+	// Endpoint overrides the regional endpoint, for VPC endpoints and tests
+	Endpoint string
+	Client   *http.Client
+}
+
+// Get implements Provider
+func (a AWSSecretsManager) Get(ctx context.Context, name string) (string, error) {
+	data, err := a.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return value, nil
+}
+
+// read fetches the current version of the secret
+func (a AWSSecretsManager) read(ctx context.Context) (map[string]string, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", a.Region)
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": a.SecretID})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if err := awsauth.Sign(req, a.Creds, a.Region, "secretsmanager", time.Now()); err != nil {
+		return nil, err
+	}
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aws secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("failed to read aws secret: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var secret struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("failed to decode aws secret: %w", err)
+	}
+	var data map[string]string
+	if err := json.Unmarshal([]byte(secret.SecretString), &data); err != nil {
+		return nil, fmt.Errorf("aws secret %s isn't a JSON object of strings: %w", a.SecretID, err)
+	}
+	return data, nil
+}
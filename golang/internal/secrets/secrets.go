@@ -0,0 +1,126 @@
+// Package secrets loads credentials such as database passwords, broker URLs
+// and storage keys from a secret store, caching them for a while so rotated
+// values are picked up without a restart
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by providers that don't hold the secret
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks secrets up by name, the name of the environment variable
+// they would otherwise be set in, such as POSTGRES_PASSWORD
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Env reads secrets from the environment
+type Env struct{}
+
+// Get implements Provider
+func (Env) Get(ctx context.Context, name string) (string, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// File reads each secret from a file named after it in Dir, as Docker and
+// Kubernetes mount them; the file is read again on each Get, so a rotated
+// mount is picked up
+type File struct {
+	Dir string
+}
+
+// Get implements Provider
+func (f File) Get(ctx context.Context, name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid secret name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(f.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Chain looks each secret up in its providers in order, returning the
+// first one found
+type Chain []Provider
+
+// Get implements Provider
+func (c Chain) Get(ctx context.Context, name string) (string, error) {
+	for _, p := range c {
+		value, err := p.Get(ctx, name)
+		if !errors.Is(err, ErrNotFound) {
+			return value, err
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// cachedSecret is a value and when it was fetched
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// Cached keeps the secrets of a remote provider for a TTL, so the store
+// isn't called on every connection while rotated values are still picked
+// up once the TTL expires
+type Cached struct {
+	next Provider
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	secrets map[string]cachedSecret
+}
+
+// NewCached creates a new instance of Cached
+func NewCached(next Provider, ttl time.Duration) *Cached {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &Cached{next: next, ttl: ttl, secrets: map[string]cachedSecret{}}
+}
+
+// Get returns the cached secret, or fetches it once expired. When the
+// store can't be reached, the expired value is kept, so an outage of the
+// store doesn't break connections whose credentials are still valid.
+func (c *Cached) Get(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.secrets[name]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < c.ttl {
+		return cached.value, nil
+	}
+
+	value, err := c.next.Get(ctx, name)
+	if err != nil {
+		if ok && !errors.Is(err, ErrNotFound) {
+			slog.Warn("Error refreshing secret, keeping the previous value", slog.String("name", name), slog.String("error", err.Error()))
+			return cached.value, nil
+		}
+		return "", err
+	}
+	if ok && value != cached.value {
+		slog.Info("Secret rotated", slog.String("name", name))
+	}
+	c.mu.Lock()
+	c.secrets[name] = cachedSecret{value: value, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return value, nil
+}
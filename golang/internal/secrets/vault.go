@@ -0,0 +1,91 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Vault reads secrets from a HashiCorp Vault KV version 2 secret: each
+// name is a key of the secret at Path
+type Vault struct {
+	// Address is the Vault server, such as https://vault:8200
+	Address string
+	// Mount is the KV engine's mount, "secret" when empty
+	Mount string
+	Path  string
+	// Token authenticates the requests; TokenFile, when set, is read on
+	// each request instead, as a Vault agent renews it there
+	Token     string
+	TokenFile string
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+	Client    *http.Client
+}
+
+// Get implements Provider
+func (v Vault) Get(ctx context.Context, name string) (string, error) {
+	data, err := v.read(ctx)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return value, nil
+}
+
+// read fetches the latest version of the secret
+func (v Vault) read(ctx context.Context) (map[string]string, error) {
+	mount := v.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	token := v.Token
+	if v.TokenFile != "" {
+		data, err := os.ReadFile(v.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimRight(v.Address, "/"), mount, strings.Trim(v.Path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("failed to read vault secret: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("failed to decode vault secret: %w", err)
+	}
+	return secret.Data.Data, nil
+}
@@ -0,0 +1,219 @@
+// Package signing signs the events the converter sends out, completion
+// webhooks and Kafka records, so consumers can verify the converter really
+// produced them. A signature covers the timestamp and the payload, and
+// names the key that made it, so consumers holding several keys verify
+// notifications across a key rotation.
+package signing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature algorithms
+const (
+	// HMACSHA256 signs with a secret shared with the consumers
+	HMACSHA256 = "hmac-sha256"
+	// Ed25519 signs with a private key, consumers verify with its public key
+	Ed25519 = "ed25519"
+)
+
+// HTTP headers of a signed webhook
+const (
+	KeyIDHeader     = "X-Signature-Key-Id"
+	TimestampHeader = "X-Signature-Timestamp"
+	// SignatureHeader holds "<algorithm>=<base64 signature>"
+	SignatureHeader = "X-Signature"
+)
+
+// ErrInvalidSignature is returned when a payload doesn't verify
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Key is a signing key, with an ID consumers look it up by
+type Key struct {
+	ID        string
+	Algorithm string
+	// Secret is the key of HMACSHA256, PrivateKey the one of Ed25519
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+}
+
+// ParseKey parses a key written as "id:hmac-sha256:secret" or
+// "id:ed25519:private key", the private key being a base64 seed or a PEM
+// encoded PKCS#8 key
+func ParseKey(s string) (Key, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return Key{}, errors.New("signing key isn't id:algorithm:key")
+	}
+	key := Key{ID: parts[0], Algorithm: parts[1]}
+	switch key.Algorithm {
+	case HMACSHA256:
+		key.Secret = []byte(parts[2])
+	case Ed25519:
+		private, err := parseEd25519(parts[2])
+		if err != nil {
+			return Key{}, fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+		key.PrivateKey = private
+	default:
+		return Key{}, fmt.Errorf("signing key %s: unknown algorithm %q", key.ID, key.Algorithm)
+	}
+	return key, nil
+}
+
+// parseEd25519 parses a base64 seed or a PEM encoded PKCS#8 key
+func parseEd25519(s string) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key isn't an ed25519 key")
+		}
+		return private, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 seed: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("seed must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Signature is the signature of a payload
+type Signature struct {
+	KeyID     string
+	Algorithm string
+	Timestamp int64
+	// Value is base64 encoded
+	Value string
+}
+
+// SetHeaders sets the signature headers of a webhook request
+func (s Signature) SetHeaders(h http.Header) {
+	h.Set(KeyIDHeader, s.KeyID)
+	h.Set(TimestampHeader, strconv.FormatInt(s.Timestamp, 10))
+	h.Set(SignatureHeader, s.Algorithm+"="+s.Value)
+}
+
+// Signer signs payloads with the current key of its source, read again on
+// each signature so a key rotated in the secret store is picked up without
+// a restart
+type Signer struct {
+	key func(ctx context.Context) (Key, error)
+}
+
+// NewSigner creates a new instance of Signer reading its key from key
+func NewSigner(key func(ctx context.Context) (Key, error)) *Signer {
+	return &Signer{key: key}
+}
+
+// Sign signs the payload, as of now
+func (s *Signer) Sign(ctx context.Context, payload []byte) (Signature, error) {
+	key, err := s.key(ctx)
+	if err != nil {
+		return Signature{}, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	sig := Signature{KeyID: key.ID, Algorithm: key.Algorithm, Timestamp: time.Now().Unix()}
+	signed := signedContent(sig.Timestamp, payload)
+	switch key.Algorithm {
+	case HMACSHA256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(signed)
+		sig.Value = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	case Ed25519:
+		sig.Value = base64.StdEncoding.EncodeToString(ed25519.Sign(key.PrivateKey, signed))
+	default:
+		return Signature{}, fmt.Errorf("unknown signing algorithm %q", key.Algorithm)
+	}
+	return sig, nil
+}
+
+// signedContent is what a signature covers: the timestamp, a dot and the
+// payload, so a captured notification can't be replayed as a newer one
+func signedContent(timestamp int64, payload []byte) []byte {
+	return append([]byte(strconv.FormatInt(timestamp, 10)+"."), payload...)
+}
+
+// Verifier checks signatures, for consumers written in Go
+type Verifier struct {
+	// Secrets are the HMACSHA256 secrets and PublicKeys the Ed25519 keys,
+	// by key ID; keeping the previous key during a rotation verifies the
+	// notifications signed before the converter picked up the new one
+	Secrets    map[string][]byte
+	PublicKeys map[string]ed25519.PublicKey
+	// Tolerance is how old a signature may be, 5 minutes when zero.
+	// Negative doesn't check the age, for records read from a log like
+	// Kafka, which a lagging consumer reads long after they were signed;
+	// such consumers drop replays by event id instead.
+	Tolerance time.Duration
+}
+
+// Verify checks the signature of the payload
+func (v Verifier) Verify(sig Signature, payload []byte) error {
+	tolerance := v.Tolerance
+	if tolerance == 0 {
+		tolerance = 5 * time.Minute
+	}
+	age := time.Since(time.Unix(sig.Timestamp, 0))
+	if tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return fmt.Errorf("%w: timestamp outside the tolerance", ErrInvalidSignature)
+	}
+	value, err := base64.StdEncoding.DecodeString(sig.Value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	signed := signedContent(sig.Timestamp, payload)
+	switch sig.Algorithm {
+	case HMACSHA256:
+		secret, ok := v.Secrets[sig.KeyID]
+		if !ok {
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, sig.KeyID)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(value, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+	case Ed25519:
+		public, ok := v.PublicKeys[sig.KeyID]
+		if !ok {
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, sig.KeyID)
+		}
+		if !ed25519.Verify(public, signed, value) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidSignature, sig.Algorithm)
+	}
+	return nil
+}
+
+// FromHeaders reads the signature of a webhook request
+func FromHeaders(h http.Header) (Signature, error) {
+	timestamp, err := strconv.ParseInt(h.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return Signature{}, fmt.Errorf("%w: missing or invalid %s", ErrInvalidSignature, TimestampHeader)
+	}
+	algorithm, value, ok := strings.Cut(h.Get(SignatureHeader), "=")
+	if !ok {
+		return Signature{}, fmt.Errorf("%w: missing or invalid %s", ErrInvalidSignature, SignatureHeader)
+	}
+	return Signature{KeyID: h.Get(KeyIDHeader), Algorithm: algorithm, Timestamp: timestamp, Value: value}, nil
+}
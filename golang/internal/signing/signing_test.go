@@ -0,0 +1,195 @@
+package signing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// staticKey is a key source always returning key
+func staticKey(key Key) func(context.Context) (Key, error) {
+	return func(context.Context) (Key, error) { return key, nil }
+}
+
+func TestParseKey(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	seed[0] = 1
+	private := ed25519.NewKeyFromSeed(seed)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	tests := []struct {
+		name    string
+		value   string
+		want    Key
+		wantErr bool
+	}{
+		{name: "hmac", value: "2024-05:hmac-sha256:s3cr3t:with:colons", want: Key{ID: "2024-05", Algorithm: HMACSHA256, Secret: []byte("s3cr3t:with:colons")}},
+		{name: "ed25519 seed", value: "k1:ed25519:" + base64.StdEncoding.EncodeToString(seed), want: Key{ID: "k1", Algorithm: Ed25519, PrivateKey: private}},
+		{name: "ed25519 pem", value: "k1:ed25519:" + pemKey, want: Key{ID: "k1", Algorithm: Ed25519, PrivateKey: private}},
+		{name: "surrounding whitespace", value: " k1:hmac-sha256:secret\n", want: Key{ID: "k1", Algorithm: HMACSHA256, Secret: []byte("secret")}},
+		{name: "missing id", value: ":hmac-sha256:secret", wantErr: true},
+		{name: "missing key", value: "k1:hmac-sha256:", wantErr: true},
+		{name: "unknown algorithm", value: "k1:rsa:secret", wantErr: true},
+		{name: "short seed", value: "k1:ed25519:" + base64.StdEncoding.EncodeToString(seed[:16]), wantErr: true},
+		{name: "invalid base64", value: "k1:ed25519:not base64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKey(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.ID != tt.want.ID || got.Algorithm != tt.want.Algorithm || string(got.Secret) != string(tt.want.Secret) || !got.PrivateKey.Equal(tt.want.PrivateKey) {
+				t.Errorf("ParseKey() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(nil)
+	keys := []Key{
+		{ID: "hmac", Algorithm: HMACSHA256, Secret: []byte("secret")},
+		{ID: "ed", Algorithm: Ed25519, PrivateKey: private},
+	}
+	verifier := Verifier{
+		Secrets:    map[string][]byte{"hmac": []byte("secret")},
+		PublicKeys: map[string]ed25519.PublicKey{"ed": private.Public().(ed25519.PublicKey)},
+	}
+	payload := []byte(`{"video_id": 3, "status": "completed"}`)
+	for _, key := range keys {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			sig, err := NewSigner(staticKey(key)).Sign(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			if sig.KeyID != key.ID || sig.Algorithm != key.Algorithm || time.Since(time.Unix(sig.Timestamp, 0)) > time.Minute {
+				t.Errorf("Sign() = %+v", sig)
+			}
+			if err := verifier.Verify(sig, payload); err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+
+			tampered := []struct {
+				name    string
+				sig     Signature
+				payload []byte
+			}{
+				{name: "payload", sig: sig, payload: []byte(`{"video_id": 4, "status": "completed"}`)},
+				{name: "timestamp", sig: withTimestamp(sig, sig.Timestamp-1), payload: payload},
+				{name: "value", sig: withValue(sig, base64.StdEncoding.EncodeToString(make([]byte, 32))), payload: payload},
+				{name: "invalid base64", sig: withValue(sig, "!"), payload: payload},
+				{name: "unknown key", sig: withKeyID(sig, "other"), payload: payload},
+			}
+			for _, tt := range tampered {
+				if err := verifier.Verify(tt.sig, tt.payload); !errors.Is(err, ErrInvalidSignature) {
+					t.Errorf("Verify() of a tampered %s error = %v, want %v", tt.name, err, ErrInvalidSignature)
+				}
+			}
+		})
+	}
+}
+
+func withTimestamp(s Signature, ts int64) Signature { s.Timestamp = ts; return s }
+func withValue(s Signature, v string) Signature     { s.Value = v; return s }
+func withKeyID(s Signature, id string) Signature    { s.KeyID = id; return s }
+
+func TestVerifyKeyRotation(t *testing.T) {
+	current := Key{ID: "2024-05", Algorithm: HMACSHA256, Secret: []byte("old")}
+	signer := NewSigner(func(context.Context) (Key, error) { return current, nil })
+	payload := []byte("{}")
+	before, _ := signer.Sign(context.Background(), payload)
+	// The signer reads the rotated key on its next signature
+	current = Key{ID: "2024-06", Algorithm: HMACSHA256, Secret: []byte("new")}
+	after, _ := signer.Sign(context.Background(), payload)
+	if after.KeyID != "2024-06" {
+		t.Fatalf("signed with %s after the rotation, want 2024-06", after.KeyID)
+	}
+
+	verifier := Verifier{Secrets: map[string][]byte{"2024-05": []byte("old"), "2024-06": []byte("new")}}
+	for _, sig := range []Signature{before, after} {
+		if err := verifier.Verify(sig, payload); err != nil {
+			t.Errorf("Verify() of key %s error = %v", sig.KeyID, err)
+		}
+	}
+	delete(verifier.Secrets, "2024-05")
+	if err := verifier.Verify(before, payload); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() with a retired key error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	key := Key{ID: "k1", Algorithm: HMACSHA256, Secret: []byte("secret")}
+	tests := []struct {
+		name      string
+		age       time.Duration
+		tolerance time.Duration
+		wantErr   bool
+	}{
+		{name: "recent", age: time.Minute},
+		{name: "older than the default", age: 6 * time.Minute, wantErr: true},
+		{name: "from the future", age: -6 * time.Minute, wantErr: true},
+		{name: "within a custom tolerance", age: time.Hour, tolerance: 2 * time.Hour},
+		{name: "negative skips the age check", age: 30 * 24 * time.Hour, tolerance: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte("{}")
+			sig := signAt(key, time.Now().Add(-tt.age), payload)
+			v := Verifier{Secrets: map[string][]byte{"k1": key.Secret}, Tolerance: tt.tolerance}
+			if err := v.Verify(sig, payload); (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// signAt signs the payload with an HMAC key as if at
+func signAt(key Key, at time.Time, payload []byte) Signature {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write(signedContent(at.Unix(), payload))
+	value := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return Signature{KeyID: key.ID, Algorithm: key.Algorithm, Timestamp: at.Unix(), Value: value}
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	sig := Signature{KeyID: "2024-05", Algorithm: HMACSHA256, Timestamp: 1700000000, Value: "c2lnbmF0dXJl"}
+	h := http.Header{}
+	sig.SetHeaders(h)
+	got, err := FromHeaders(h)
+	if err != nil || got != sig {
+		t.Errorf("FromHeaders() = %+v, %v, want %+v", got, err, sig)
+	}
+
+	h.Set(SignatureHeader, "no algorithm")
+	if _, err := FromHeaders(h); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("FromHeaders() without an algorithm error = %v", err)
+	}
+	h = http.Header{}
+	sig.SetHeaders(h)
+	h.Set(TimestampHeader, "yesterday")
+	if _, err := FromHeaders(h); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("FromHeaders() with an invalid timestamp error = %v", err)
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	errUnavailable := errors.New("secret store unavailable")
+	failing := NewSigner(func(context.Context) (Key, error) { return Key{}, errUnavailable })
+	if _, err := failing.Sign(context.Background(), nil); !errors.Is(err, errUnavailable) {
+		t.Errorf("Sign() error = %v, want %v", err, errUnavailable)
+	}
+	unknown := NewSigner(staticKey(Key{ID: "k1", Algorithm: "rsa"}))
+	if _, err := unknown.Sign(context.Background(), nil); err == nil {
+		t.Error("Sign() with an unknown algorithm succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Groupings of a throughput report
+const (
+	GroupByHour    = "hour"
+	GroupByWorker  = "worker"
+	GroupByProfile = "profile"
+)
+
+// ThroughputRow is the throughput of one group of a report
+type ThroughputRow struct {
+	// Key is the hour (RFC 3339), worker or profile of the group, empty for the total
+	Key               string  `json:"key"`
+	Jobs              int     `json:"jobs"`
+	SourceMinutes     float64 `json:"source_minutes"`
+	ProcessingMinutes float64 `json:"processing_minutes"`
+	// ActiveHours is the number of wall-clock hours with finished jobs
+	ActiveHours int `json:"active_hours"`
+	// SourceMinutesPerHour is the source converted per active wall-clock hour
+	SourceMinutesPerHour float64 `json:"source_minutes_per_hour"`
+	// Speed is the source converted per minute of processing
+	Speed float64 `json:"speed"`
+}
+
+// Report is the throughput of the jobs finished between From and To
+type Report struct {
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	GroupBy string          `json:"group_by"`
+	Rows    []ThroughputRow `json:"rows"`
+	Total   ThroughputRow   `json:"total"`
+}
+
+// group accumulates the hourly rows of one report row
+type group struct {
+	row   ThroughputRow
+	hours map[time.Time]bool
+}
+
+func (g *group) add(period time.Time, jobs int, source, processing float64) {
+	g.row.Jobs += jobs
+	g.row.SourceMinutes += source / 60
+	g.row.ProcessingMinutes += processing / 60
+	g.hours[period] = true
+}
+
+func (g *group) finish() ThroughputRow {
+	row := g.row
+	row.ActiveHours = len(g.hours)
+	if row.ActiveHours > 0 {
+		row.SourceMinutesPerHour = row.SourceMinutes / float64(row.ActiveHours)
+	}
+	if row.ProcessingMinutes > 0 {
+		row.Speed = row.SourceMinutes / row.ProcessingMinutes
+	}
+	return row
+}
+
+// Throughput reports the hourly totals of throughput_stats between from and
+// to, grouped by hour, worker or profile
+func Throughput(ctx context.Context, db *database.DB, from, to time.Time, groupBy string) (Report, error) {
+	report := Report{From: from, To: to, GroupBy: groupBy, Rows: []ThroughputRow{}}
+	switch groupBy {
+	case GroupByHour, GroupByWorker, GroupByProfile:
+	default:
+		return report, fmt.Errorf("unknown grouping: %s", groupBy)
+	}
+
+	query := db.Rebind(`SELECT period_start, worker_id, profile, jobs, source_seconds, processing_seconds
+		FROM throughput_stats WHERE period_start >= ? AND period_start < ?`)
+	rows, err := db.QueryContext(ctx, query, from.UTC().Truncate(time.Hour), to.UTC())
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	groups := map[string]*group{}
+	total := &group{hours: map[time.Time]bool{}}
+	for rows.Next() {
+		var (
+			period             time.Time
+			worker, profile    string
+			jobs               int
+			source, processing float64
+		)
+		if err := rows.Scan(&period, &worker, &profile, &jobs, &source, &processing); err != nil {
+			return report, err
+		}
+		period = period.UTC()
+
+		key := period.Format(time.RFC3339)
+		switch groupBy {
+		case GroupByWorker:
+			key = worker
+		case GroupByProfile:
+			key = profile
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &group{row: ThroughputRow{Key: key}, hours: map[time.Time]bool{}}
+			groups[key] = g
+		}
+		g.add(period, jobs, source, processing)
+		total.add(period, jobs, source, processing)
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	for _, g := range groups {
+		report.Rows = append(report.Rows, g.finish())
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Key < report.Rows[j].Key })
+	report.Total = total.finish()
+	return report, nil
+}
@@ -0,0 +1,235 @@
+// Package stats records how long conversions take relative to the duration
+// of their source, to estimate when new jobs and the queue will be done and
+// to report throughput for capacity planning
+package stats
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"imersaofc/internal/database"
+	"imersaofc/internal/events"
+)
+
+// Recorder stores the timing of finished jobs in job_timings, adds it to
+// the hourly totals of throughput_stats and keeps the estimate of running
+// jobs in job_estimates
+type Recorder struct {
+	db       *database.DB
+	workerID string
+}
+
+// NewRecorder creates a new instance of Recorder recording timings as workerID
+func NewRecorder(db *database.DB, workerID string) *Recorder {
+	return &Recorder{db: db, workerID: workerID}
+}
+
+// Record is an events.Subscriber. Failures are logged, stats never fail a task.
+func (r *Recorder) Record(e events.Event) {
+	var err error
+	switch e := e.(type) {
+	case events.TaskEstimated:
+		err = r.saveEstimate(e)
+	case events.TaskSucceeded:
+		if e.SourceDuration > 0 {
+			err = r.saveTiming(e)
+			if err == nil {
+				err = r.addThroughput(e)
+			}
+		}
+		if err == nil {
+			err = r.deleteEstimate(e.VideoID)
+		}
+	case events.TaskFailed:
+		if !e.Retryable && e.VideoID != 0 {
+			err = r.deleteEstimate(e.VideoID)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		slog.Error("Error storing job stats", slog.String("event", e.Name()), slog.String("error", err.Error()))
+	}
+}
+
+func (r *Recorder) saveTiming(e events.TaskSucceeded) error {
+	query := r.db.Rebind(`INSERT INTO job_timings (video_id, profile, worker_id, source_seconds, processing_seconds, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	_, err := r.db.Exec(query, e.VideoID, e.Profile, r.workerID, e.SourceDuration.Seconds(), e.Duration.Seconds(), e.At)
+	return err
+}
+
+// addThroughput adds the job to the hourly totals of its worker and
+// profile. Each worker only writes its own rows, so there is no race
+// between the update and the insert.
+func (r *Recorder) addThroughput(e events.TaskSucceeded) error {
+	period := e.At.UTC().Truncate(time.Hour)
+	update := r.db.Rebind(`UPDATE throughput_stats
+		SET jobs = jobs + 1, source_seconds = source_seconds + ?, processing_seconds = processing_seconds + ?
+		WHERE period_start = ? AND worker_id = ? AND profile = ?`)
+	result, err := r.db.Exec(update, e.SourceDuration.Seconds(), e.Duration.Seconds(), period, r.workerID, e.Profile)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	insert := r.db.Rebind(`INSERT INTO throughput_stats (period_start, worker_id, profile, jobs, source_seconds, processing_seconds)
+		VALUES (?, ?, ?, 1, ?, ?)`)
+	_, err = r.db.Exec(insert, period, r.workerID, e.Profile, e.SourceDuration.Seconds(), e.Duration.Seconds())
+	return err
+}
+
+func (r *Recorder) saveEstimate(e events.TaskEstimated) error {
+	if err := r.deleteEstimate(e.VideoID); err != nil {
+		return err
+	}
+	query := r.db.Rebind(`INSERT INTO job_estimates (video_id, source_seconds, estimate_seconds, eta, updated_at)
+		VALUES (?, ?, ?, ?, ?)`)
+	_, err := r.db.Exec(query, e.VideoID, e.SourceDuration.Seconds(), e.Estimate.Seconds(), e.ETA, e.At)
+	return err
+}
+
+func (r *Recorder) deleteEstimate(videoID int) error {
+	_, err := r.db.Exec(r.db.Rebind("DELETE FROM job_estimates WHERE video_id = ?"), videoID)
+	return err
+}
+
+// DefaultSampleSize is how many recent jobs the estimator averages over
+const DefaultSampleSize = 50
+
+// estimatorTTL is how long a computed throughput is reused
+const estimatorTTL = time.Minute
+
+// Estimator predicts processing times from the throughput of recent jobs
+// with the same profile, or of all recent jobs when the profile has none.
+// It implements converter.Estimator.
+type Estimator struct {
+	db         *database.DB
+	sampleSize int
+
+	mu    sync.Mutex
+	cache map[string]cachedSpeed
+}
+
+type cachedSpeed struct {
+	speed float64
+	at    time.Time
+}
+
+// NewEstimator creates a new instance of Estimator averaging over the last
+// sampleSize jobs, DefaultSampleSize when zero
+func NewEstimator(db *database.DB, sampleSize int) *Estimator {
+	if sampleSize <= 0 {
+		sampleSize = DefaultSampleSize
+	}
+	return &Estimator{db: db, sampleSize: sampleSize, cache: map[string]cachedSpeed{}}
+}
+
+// Estimate returns the expected processing time of a source
+func (e *Estimator) Estimate(ctx context.Context, profile string, source time.Duration) (time.Duration, bool) {
+	speed := e.cachedSpeed(ctx, profile)
+	if speed <= 0 {
+		speed = e.cachedSpeed(ctx, "")
+	}
+	if speed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(source) / speed), true
+}
+
+// cachedSpeed returns the speed of the profile, "" for every profile,
+// recomputing it once it is older than estimatorTTL
+func (e *Estimator) cachedSpeed(ctx context.Context, profile string) float64 {
+	e.mu.Lock()
+	cached, ok := e.cache[profile]
+	e.mu.Unlock()
+	if ok && time.Since(cached.at) < estimatorTTL {
+		return cached.speed
+	}
+
+	speed, err := Speed(ctx, e.db, profile, e.sampleSize)
+	if err != nil {
+		slog.Error("Error computing throughput", slog.String("profile", profile), slog.String("error", err.Error()))
+		return cached.speed
+	}
+	e.mu.Lock()
+	e.cache[profile] = cachedSpeed{speed: speed, at: time.Now()}
+	e.mu.Unlock()
+	return speed
+}
+
+// Speed returns how many seconds of source the last sampleSize jobs of the
+// profile ("" for any profile) converted per second of processing, 0 when
+// there are none
+func Speed(ctx context.Context, db *database.DB, profile string, sampleSize int) (float64, error) {
+	inner := "SELECT source_seconds, processing_seconds FROM job_timings"
+	args := []any{}
+	if profile != "" {
+		inner += " WHERE profile = ?"
+		args = append(args, profile)
+	}
+	inner += " ORDER BY completed_at DESC LIMIT ?"
+	args = append(args, sampleSize)
+
+	var source, processing sql.NullFloat64
+	query := db.Rebind("SELECT SUM(source_seconds), SUM(processing_seconds) FROM (" + inner + ") recent")
+	err := database.Retry(ctx, func() error {
+		return db.QueryRowContext(ctx, query, args...).Scan(&source, &processing)
+	})
+	if err != nil || processing.Float64 <= 0 {
+		return 0, err
+	}
+	return source.Float64 / processing.Float64, nil
+}
+
+// QueueEstimate is the outlook for the jobs being processed
+type QueueEstimate struct {
+	// Jobs is the number of started jobs with an estimate that haven't finished
+	Jobs int `json:"jobs"`
+	// RemainingSeconds is the processing time they still need, summed
+	RemainingSeconds float64 `json:"remaining_seconds"`
+	// Overdue counts the jobs already past their estimated completion
+	Overdue int `json:"overdue"`
+	// ETA is when the last of them is expected to finish
+	ETA *time.Time `json:"eta,omitempty"`
+	// Speed is the recent throughput over every profile, see Speed
+	Speed float64 `json:"speed"`
+}
+
+// QueueETA summarizes the estimates of the jobs in progress
+func QueueETA(ctx context.Context, db *database.DB) (QueueEstimate, error) {
+	var q QueueEstimate
+	rows, err := db.QueryContext(ctx, "SELECT eta FROM job_estimates")
+	if err != nil {
+		return q, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var eta time.Time
+		if err := rows.Scan(&eta); err != nil {
+			return q, err
+		}
+		q.Jobs++
+		if eta.Before(now) {
+			q.Overdue++
+			continue
+		}
+		q.RemainingSeconds += eta.Sub(now).Seconds()
+		if q.ETA == nil || eta.After(*q.ETA) {
+			last := eta
+			q.ETA = &last
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return q, err
+	}
+
+	q.Speed, err = Speed(ctx, db, "", DefaultSampleSize)
+	return q, err
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"imersaofc/internal/oauth"
+)
+
+const (
+	azureAPIVersion = "2021-08-06"
+	azureIMDSToken  = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fstorage.azure.com%2F"
+)
+
+// AzureConfig configures the Azure Blob Storage uploader
+type AzureConfig struct {
+	Account     string
+	Container   string
+	SASToken    string // shared access signature; empty uses managed identity
+	AccountKey  string // base64 account key, only used to sign read URLs
+	ClientID    string // user-assigned managed identity, optional
+	BlockSize   int    // size of each staged block in bytes
+	Parallelism int    // number of blocks uploaded concurrently per file
+}
+
+// AzureUploader uploads outputs as block blobs to Azure Blob Storage
+type AzureUploader struct {
+	cfg    AzureConfig
+	client *http.Client
+	tokens oauth.TokenSource
+}
+
+// NewAzureUploader creates a new instance of AzureUploader
+func NewAzureUploader(cfg AzureConfig) (*AzureUploader, error) {
+	if cfg.Account == "" || cfg.Container == "" {
+		return nil, fmt.Errorf("azure account and container are required")
+	}
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = 8 * 1024 * 1024
+	}
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = 4
+	}
+	cfg.SASToken = strings.TrimPrefix(cfg.SASToken, "?")
+
+	client := &http.Client{}
+	az := &AzureUploader{cfg: cfg, client: client}
+	if cfg.SASToken == "" {
+		az.tokens = newManagedIdentityTokenSource(client, cfg.ClientID)
+	}
+	return az, nil
+}
+
+// Upload stages the file as blocks in parallel and commits the block list.
+// Every block carries a Content-MD5 that Azure verifies on receipt.
+func (a *AzureUploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	sum, err := fileMD5(localPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	blockSize := int64(a.cfg.BlockSize)
+	count := int((size + blockSize - 1) / blockSize)
+
+	blockIDs := make([]string, count)
+	errs := make(chan error, count)
+	sem := make(chan struct{}, a.cfg.Parallelism)
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < count; i++ {
+		// Block ids must all have the same length before encoding
+		blockIDs[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", i)))
+		offset := int64(i) * blockSize
+		length := min(blockSize, size-offset)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, offset, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			buf := make([]byte, length)
+			if _, err := file.ReadAt(buf, offset); err != nil && err != io.EOF {
+				errs <- err
+				cancel()
+				return
+			}
+			if err := a.putBlock(ctx, objectKey, id, buf); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(blockIDs[i], offset, length)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	return a.putBlockList(ctx, objectKey, blockIDs, sum)
+}
+
+// putBlock stages a single block of the blob
+func (a *AzureUploader) putBlock(ctx context.Context, objectKey, id string, data []byte) error {
+	sum := md5.Sum(data)
+	headers := map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])}
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	resp, err := a.do(ctx, http.MethodPut, objectKey, query, data, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest && resp.Header.Get("x-ms-error-code") == "Md5Mismatch" {
+		return fmt.Errorf("%w: %s block %s", ErrChecksumMismatch, objectKey, id)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return azureError("failed to put block", resp)
+	}
+	return nil
+}
+
+// putBlockList commits the staged blocks in order, recording the whole-file MD5
+func (a *AzureUploader) putBlockList(ctx context.Context, objectKey string, ids []string, sum []byte) error {
+	list := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids}
+	body, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"Content-Type":           "application/xml",
+		"x-ms-blob-content-type": contentType(objectKey),
+		"x-ms-blob-content-md5":  base64.StdEncoding.EncodeToString(sum),
+	}
+	query := url.Values{"comp": {"blocklist"}}
+	resp, err := a.do(ctx, http.MethodPut, objectKey, query, append([]byte(xml.Header), body...), headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return azureError("failed to put block list", resp)
+	}
+	return nil
+}
+
+// Delete removes the blob; deleting a missing blob is not an error
+func (a *AzureUploader) Delete(ctx context.Context, objectKey string) error {
+	resp, err := a.do(ctx, http.MethodDelete, objectKey, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return azureError("failed to delete blob", resp)
+	}
+	return nil
+}
+
+// do builds, authenticates and sends a request against a blob
+func (a *AzureUploader) do(ctx context.Context, method, objectKey string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	rawQuery := query.Encode()
+	if a.cfg.SASToken != "" && rawQuery != "" {
+		rawQuery += "&" + a.cfg.SASToken
+	} else if a.cfg.SASToken != "" {
+		rawQuery = a.cfg.SASToken
+	}
+	endpoint := fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s?%s",
+		a.cfg.Account, a.cfg.Container, escapeKey(objectKey), rawQuery)
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if a.tokens != nil {
+		token, err := a.tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.client.Do(req)
+}
+
+// newManagedIdentityTokenSource fetches tokens from the Azure instance metadata service
+func newManagedIdentityTokenSource(client *http.Client, clientID string) oauth.TokenSource {
+	endpoint := azureIMDSToken
+	if clientID != "" {
+		endpoint += "&client_id=" + url.QueryEscape(clientID)
+	}
+	return oauth.Cache(func(ctx context.Context) (oauth.Token, error) {
+		var tok oauth.Token
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return tok, err
+		}
+		req.Header.Set("Metadata", "true")
+		resp, err := client.Do(req)
+		if err != nil {
+			return tok, fmt.Errorf("failed to fetch managed identity token: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return tok, fmt.Errorf("failed to fetch managed identity token: %s", resp.Status)
+		}
+		// IMDS returns expires_in as a string
+		var body struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   string `json:"expires_in"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return tok, fmt.Errorf("failed to decode managed identity token: %w", err)
+		}
+		tok.AccessToken = body.AccessToken
+		tok.ExpiresIn, _ = strconv.Atoi(body.ExpiresIn)
+		return tok, nil
+	})
+}
+
+// escapeKey escapes each segment of an object key for use in a URL path
+func escapeKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// azureError builds an error from a failed Azure response
+func azureError(message string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s: %s", message, resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"imersaofc/internal/gcpauth"
+)
+
+// gcsChunkAlign is the granularity GCS requires for resumable upload chunks
+const gcsChunkAlign = 256 * 1024
+
+// GCSConfig configures the Google Cloud Storage uploader
+type GCSConfig struct {
+	Bucket          string
+	StorageClass    string // e.g. STANDARD, NEARLINE; empty uses the bucket default
+	CredentialsFile string // service account key; empty uses workload identity
+	ChunkSize       int    // resumable upload chunk size in bytes
+}
+
+// GCSUploader uploads outputs to Google Cloud Storage using resumable uploads
+type GCSUploader struct {
+	cfg    GCSConfig
+	client *http.Client
+	tokens gcpauth.TokenSource
+	key    *gcpauth.ServiceAccountKey
+	rsaKey *rsa.PrivateKey
+}
+
+// NewGCSUploader creates a new instance of GCSUploader
+func NewGCSUploader(cfg GCSConfig) (*GCSUploader, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("gcs bucket is required")
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 8 * 1024 * 1024
+	}
+	cfg.ChunkSize = (cfg.ChunkSize + gcsChunkAlign - 1) / gcsChunkAlign * gcsChunkAlign
+
+	g := &GCSUploader{cfg: cfg, client: &http.Client{}}
+	if cfg.CredentialsFile != "" {
+		key, rsaKey, err := gcpauth.LoadServiceAccount(cfg.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		g.key, g.rsaKey = key, rsaKey
+		g.tokens = gcpauth.NewServiceAccountTokenSource(g.client, key, rsaKey, gcpauth.ScopeStorage)
+	} else {
+		g.tokens = gcpauth.NewMetadataTokenSource(g.client)
+	}
+	return g, nil
+}
+
+// Upload sends the file to GCS in chunks over a resumable upload session
+// and verifies the MD5 reported by GCS against the local file
+func (g *GCSUploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	sum, err := fileMD5(localPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	session, err := g.startSession(ctx, objectKey, size)
+	if err != nil {
+		return err
+	}
+
+	var stored string
+	if size == 0 {
+		_, stored, err = g.putChunk(ctx, session, nil, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, g.cfg.ChunkSize)
+	var offset int64
+	for offset < size {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		offset, stored, err = g.putChunk(ctx, session, buf[:n], offset, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stored != base64.StdEncoding.EncodeToString(sum) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, objectKey)
+	}
+	return nil
+}
+
+// startSession opens a resumable upload session and returns its URI
+func (g *GCSUploader) startSession(ctx context.Context, objectKey string, size int64) (string, error) {
+	meta := map[string]string{"name": objectKey}
+	if g.cfg.StorageClass != "" {
+		meta["storageClass"] = g.cfg.StorageClass
+	}
+	body, _ := json.Marshal(meta)
+
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable",
+		url.PathEscape(g.cfg.Bucket))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType(objectKey))
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := g.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", gcsError("failed to start resumable upload", resp)
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("gcs did not return a resumable session uri")
+	}
+	return session, nil
+}
+
+// putChunk uploads one chunk and returns the offset GCS expects next.
+// Once the whole object is stored it also returns the MD5 computed by GCS.
+func (g *GCSUploader) putChunk(ctx context.Context, session string, chunk []byte, offset, size int64) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(chunk) == 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		end := offset + int64(len(chunk)) - 1
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end, size))
+	}
+
+	resp, err := g.do(ctx, req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var object struct {
+			MD5Hash string `json:"md5Hash"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+			return 0, "", fmt.Errorf("failed to decode gcs object: %w", err)
+		}
+		return size, object.MD5Hash, nil
+	case http.StatusPermanentRedirect:
+		// The Range header tells how much GCS actually persisted ("bytes=0-N")
+		persisted := resp.Header.Get("Range")
+		if i := strings.LastIndex(persisted, "-"); i >= 0 {
+			if last, err := strconv.ParseInt(persisted[i+1:], 10, 64); err == nil {
+				return last + 1, "", nil
+			}
+		}
+		return 0, "", nil
+	}
+	return 0, "", gcsError("failed to upload chunk", resp)
+}
+
+// Delete removes the object; deleting a missing object is not an error
+func (g *GCSUploader) Delete(ctx context.Context, objectKey string) error {
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s",
+		url.PathEscape(g.cfg.Bucket), url.PathEscape(objectKey))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return gcsError("failed to delete object", resp)
+	}
+	return nil
+}
+
+// do authenticates and sends a request to GCS
+func (g *GCSUploader) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	token, err := g.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return g.client.Do(req)
+}
+
+// gcsError builds an error from a failed GCS response
+func gcsError(message string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s: %s", message, resp.Status, bytes.TrimSpace(body))
+}
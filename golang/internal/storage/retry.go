@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// RetryUploader retries failed uploads of a single file with exponential backoff
+type RetryUploader struct {
+	next        Uploader
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// NewRetryUploader creates a new instance of RetryUploader
+func NewRetryUploader(next Uploader, maxAttempts int, backoff time.Duration) *RetryUploader {
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	return &RetryUploader{next: next, maxAttempts: maxAttempts, backoff: backoff}
+}
+
+// Upload calls the wrapped uploader until it succeeds or attempts run out
+func (r *RetryUploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	wait := r.backoff
+	var err error
+	for attempt := 1; attempt <= r.maxAttempts; attempt++ {
+		err = r.next.Upload(ctx, localPath, objectKey)
+		if err == nil || errors.Is(err, context.Canceled) || attempt == r.maxAttempts {
+			break
+		}
+		slog.Warn("Upload failed, retrying",
+			slog.String("key", objectKey),
+			slog.Int("attempt", attempt),
+			slog.Duration("wait", wait),
+			slog.String("error", err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	return err
+}
+
+// Delete removes the object through the wrapped uploader, or returns
+// errors.ErrUnsupported if it can't delete
+func (r *RetryUploader) Delete(ctx context.Context, objectKey string) error {
+	d, ok := r.next.(Deleter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return d.Delete(ctx, objectKey)
+}
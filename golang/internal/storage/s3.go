@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"imersaofc/internal/awsauth"
+)
+
+// S3Config configures the Amazon S3 client
+type S3Config struct {
+	Bucket   string
+	Region   string
+	Endpoint string // S3-compatible endpoint using path-style URLs; empty uses AWS
+	Creds    awsauth.Credentials
+	// RefreshCreds, when set, is called for the credentials of each
+	// request instead of using Creds, so rotated keys are picked up
+	RefreshCreds func(ctx context.Context) (awsauth.Credentials, error)
+}
+
+// S3Uploader uploads outputs to Amazon S3 and reads objects back
+type S3Uploader struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// NewS3Uploader creates a new instance of S3Uploader
+func NewS3Uploader(cfg S3Config) (*S3Uploader, error) {
+	if cfg.Bucket == "" || cfg.Region == "" {
+		return nil, fmt.Errorf("s3 bucket and region are required")
+	}
+	return &S3Uploader{cfg: cfg, client: &http.Client{}}, nil
+}
+
+// Bucket returns the bucket the uploader writes to
+func (s *S3Uploader) Bucket() string {
+	return s.cfg.Bucket
+}
+
+// Upload streams the file to S3 with a single PUT; S3 rejects the object
+// when it doesn't match the Content-MD5 of the local file
+func (s *S3Uploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	sum, err := fileMD5(localPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(objectKey, nil), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", contentType(localPath))
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	req.Header.Set("X-Amz-Content-Sha256", awsauth.UnsignedPayload)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("failed to upload object", resp)
+	}
+	return nil
+}
+
+// Download copies the object to a local file, creating its directory
+func (s *S3Uploader) Download(ctx context.Context, objectKey, localPath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(objectKey, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("failed to download object", resp)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to download %s: %w", objectKey, err)
+	}
+	return file.Close()
+}
+
+// List returns the keys of every object under prefix
+func (s *S3Uploader) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("failed to list objects", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Delete removes the object; deleting a missing object is not an error
+func (s *S3Uploader) Delete(ctx context.Context, objectKey string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(objectKey, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("failed to delete object", resp)
+	}
+	return nil
+}
+
+// objectURL returns the URL of an object, or of the bucket when key is empty
+func (s *S3Uploader) objectURL(objectKey string, query url.Values) string {
+	var base string
+	if s.cfg.Endpoint != "" {
+		base = s.cfg.Endpoint + "/" + s.cfg.Bucket + "/"
+	} else {
+		base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", s.cfg.Bucket, s.cfg.Region)
+	}
+	u := base + escapeKey(objectKey)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do signs and sends a request to S3
+func (s *S3Uploader) do(req *http.Request) (*http.Response, error) {
+	creds := s.cfg.Creds
+	if s.cfg.RefreshCreds != nil {
+		var err error
+		if creds, err = s.cfg.RefreshCreds(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	if err := awsauth.Sign(req, creds, s.cfg.Region, "s3", time.Now()); err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// s3Error builds an error from a failed S3 response
+func s3Error(message string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s: %s: %s", message, resp.Status, bytes.TrimSpace(body))
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// ErrChecksumMismatch is returned when the stored object differs from the local file
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Uploader stores converted output files in a remote object store
+type Uploader interface {
+	// Upload copies the local file to the given object key
+	Upload(ctx context.Context, localPath, objectKey string) error
+}
+
+// Deleter is implemented by uploaders that can remove stored objects
+type Deleter interface {
+	// Delete removes the object; deleting a missing object is not an error
+	Delete(ctx context.Context, objectKey string) error
+}
+
+// UploadDir uploads every regular file below dir, keeping its relative layout under prefix.
+// Up to concurrency files are transferred at the same time; the first failure cancels the rest.
+func UploadDir(ctx context.Context, u Uploader, dir, prefix string, concurrency int) error {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for _, p := range files {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := path.Join(prefix, filepath.ToSlash(rel))
+
+		sem <- struct{}{}
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(p, key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			slog.Info("Uploading file", slog.String("path", p), slog.String("key", key))
+			if err := u.Upload(ctx, p, key); err != nil {
+				once.Do(func() {
+					firstErr = fmt.Errorf("failed to upload %s: %w", p, err)
+					cancel()
+				})
+			}
+		}(p, key)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// fileMD5 returns the MD5 digest of a local file
+func fileMD5(name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// contentType returns the MIME type used for an output file
+func contentType(name string) string {
+	switch filepath.Ext(name) {
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadPaused is the rate of a window in which nothing is uploaded
+const UploadPaused = -1
+
+// UploadWindow sets the upload rate between two times of the day, in the
+// worker's time zone; a window ending before it starts spans midnight
+type UploadWindow struct {
+	// Start and End are offsets from midnight
+	Start, End time.Duration
+	// BytesPerSecond caps the upload rate in the window; zero doesn't
+	// limit it and UploadPaused holds uploads until the window ends
+	BytesPerSecond int64
+}
+
+// UploadSchedule caps the upload bandwidth, so conversions don't saturate
+// the uplink, and can hold uploads to off-peak hours, for example to
+// trickle a large backfill at night
+type UploadSchedule struct {
+	// BytesPerSecond caps the upload rate outside the windows; zero
+	// doesn't limit it
+	BytesPerSecond int64
+	// Windows override the rate at times of the day, the first matching
+	// one wins
+	Windows []UploadWindow
+}
+
+// rate returns the upload rate at t
+func (s UploadSchedule) rate(t time.Time) int64 {
+	year, month, day := t.Date()
+	offset := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	for _, w := range s.Windows {
+		in := offset >= w.Start && offset < w.End
+		if w.End <= w.Start {
+			in = offset >= w.Start || offset < w.End
+		}
+		if in {
+			return w.BytesPerSecond
+		}
+	}
+	return s.BytesPerSecond
+}
+
+// ParseUploadWindows parses windows written as "22:00-06:00=5000000",
+// separated by commas, where the rate is in bytes per second, 0 for
+// unlimited or "pause"
+func ParseUploadWindows(list string) ([]UploadWindow, error) {
+	var windows []UploadWindow
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		span, rate, ok := strings.Cut(entry, "=")
+		start, end, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("upload window %q isn't start-end=rate", entry)
+		}
+		var w UploadWindow
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, fmt.Errorf("upload window %q: %w", entry, err)
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, fmt.Errorf("upload window %q: %w", entry, err)
+		}
+		if rate == "pause" {
+			w.BytesPerSecond = UploadPaused
+		} else if w.BytesPerSecond, err = strconv.ParseInt(rate, 10, 64); err != nil || w.BytesPerSecond < 0 {
+			return nil, fmt.Errorf("upload window %q: invalid rate %q", entry, rate)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseClock parses a time of the day such as "06:30"
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ThrottledUploader paces the uploads of the wrapped uploader as its
+// schedule says. Uploaders read the files themselves, so the pace is kept
+// file by file: each upload waits its turn for the bandwidth its size
+// takes, shared by the concurrent uploads. Files as small as segments
+// keep the average close to the cap.
+type ThrottledUploader struct {
+	next     Uploader
+	schedule UploadSchedule
+
+	mu sync.Mutex
+	// free is when the bandwidth reserved so far is used up
+	free time.Time
+}
+
+// NewThrottledUploader creates a new instance of ThrottledUploader
+func NewThrottledUploader(next Uploader, schedule UploadSchedule) *ThrottledUploader {
+	return &ThrottledUploader{next: next, schedule: schedule}
+}
+
+// Upload waits for the file's turn, then uploads it with the wrapped
+// uploader
+func (t *ThrottledUploader) Upload(ctx context.Context, localPath, objectKey string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	for paused := false; ; paused = true {
+		rate := t.schedule.rate(time.Now())
+		if rate != UploadPaused {
+			if err := t.wait(ctx, t.reserve(info.Size(), rate)); err != nil {
+				return err
+			}
+			return t.next.Upload(ctx, localPath, objectKey)
+		}
+		if !paused {
+			slog.Info("Upload held by the upload schedule", slog.String("key", objectKey))
+		}
+		// Checked each minute, windows are set to the minute
+		if err := t.wait(ctx, time.Now().Truncate(time.Minute).Add(time.Minute)); err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes the bandwidth to upload size bytes at rate and returns
+// when the upload may start
+func (t *ThrottledUploader) reserve(size, rate int64) time.Time {
+	now := time.Now()
+	if rate <= 0 {
+		return now
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start := t.free
+	if start.Before(now) {
+		start = now
+	}
+	t.free = start.Add(time.Duration(float64(size) / float64(rate) * float64(time.Second)))
+	return start
+}
+
+// wait sleeps until the time or the context is done
+func (t *ThrottledUploader) wait(ctx context.Context, until time.Time) error {
+	delay := time.Until(until)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delete removes the object through the wrapped uploader, or returns
+// errors.ErrUnsupported if it can't delete
+func (t *ThrottledUploader) Delete(ctx context.Context, objectKey string) error {
+	d, ok := t.next.(Deleter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return d.Delete(ctx, objectKey)
+}
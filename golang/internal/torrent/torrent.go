@@ -0,0 +1,202 @@
+// Package torrent writes BitTorrent metainfo files of a directory, with web
+// seeds (BEP 19) pointing at where the directory is served over HTTP, so
+// players can experiment with P2P-assisted delivery while the CDN keeps
+// serving every piece
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minPieceLength and maxPieceLength bound the piece length, which is
+	// doubled until the torrent has at most targetPieces pieces
+	minPieceLength = 256 << 10
+	maxPieceLength = 16 << 20
+	targetPieces   = 1500
+)
+
+// Options are the optional fields of a torrent
+type Options struct {
+	// WebSeeds are the base URLs the directory's parent is served from:
+	// clients fetch a file at <web seed>/<name>/<path>
+	WebSeeds []string
+	// Trackers are announce URLs; without any, clients find peers through
+	// the DHT and the web seeds
+	Trackers []string
+	// Exclude are paths, relative to the directory, left out of the torrent
+	Exclude []string
+	// CreatedBy names the program writing the torrent
+	CreatedBy string
+}
+
+// file is a file of the torrent
+type file struct {
+	path   string
+	rel    []string
+	length int64
+}
+
+// Create returns the metainfo of the files below dir as a multi-file
+// torrent named name, in path order
+func Create(dir, name string, opts Options) ([]byte, error) {
+	var files []file
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(opts.Exclude, filepath.ToSlash(rel)) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{path: p, rel: strings.Split(filepath.ToSlash(rel), "/"), length: info.Size()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %s", dir)
+	}
+
+	pieceLength := int64(minPieceLength)
+	for total/pieceLength > targetPieces && pieceLength < maxPieceLength {
+		pieceLength *= 2
+	}
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	fileList := make([]any, len(files))
+	for i, f := range files {
+		path := make([]any, len(f.rel))
+		for j, part := range f.rel {
+			path[j] = part
+		}
+		fileList[i] = map[string]any{"length": f.length, "path": path}
+	}
+	meta := map[string]any{
+		"info": map[string]any{
+			"name":         name,
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+			"files":        fileList,
+		},
+		"creation date": time.Now().Unix(),
+	}
+	if opts.CreatedBy != "" {
+		meta["created by"] = opts.CreatedBy
+	}
+	if len(opts.WebSeeds) > 0 {
+		seeds := make([]any, len(opts.WebSeeds))
+		for i, seed := range opts.WebSeeds {
+			// A trailing slash makes clients append the name and path
+			seeds[i] = strings.TrimSuffix(seed, "/") + "/"
+		}
+		meta["url-list"] = seeds
+	}
+	if len(opts.Trackers) > 0 {
+		meta["announce"] = opts.Trackers[0]
+		tiers := make([]any, len(opts.Trackers))
+		for i, tracker := range opts.Trackers {
+			tiers[i] = []any{tracker}
+		}
+		meta["announce-list"] = tiers
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// hashPieces returns the SHA-1 of each piece of the files laid end to end
+func hashPieces(files []file, pieceLength int64) ([]byte, error) {
+	var pieces []byte
+	piece := sha1.New()
+	var filled int64
+	for _, f := range files {
+		r, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, err := io.CopyN(piece, r, pieceLength-filled)
+			filled += n
+			if filled == pieceLength {
+				pieces = piece.Sum(pieces)
+				piece.Reset()
+				filled = 0
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+		r.Close()
+	}
+	if filled > 0 {
+		pieces = piece.Sum(pieces)
+	}
+	return pieces, nil
+}
+
+// encode writes v bencoded: strings, integers, lists and dictionaries,
+// whose keys are sorted as the format requires
+func encode(w *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		w.WriteString(strconv.Itoa(len(v)) + ":" + v)
+	case int64:
+		w.WriteString("i" + strconv.FormatInt(v, 10) + "e")
+	case []any:
+		w.WriteByte('l')
+		for _, item := range v {
+			if err := encode(w, item); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		w.WriteByte('d')
+		for _, key := range keys {
+			encode(w, key)
+			if err := encode(w, v[key]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	default:
+		return fmt.Errorf("can't bencode %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"imersaofc/internal/database"
+)
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// ErrDeliveryNotFound is returned for an unknown delivery
+var ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+// Delivery is the delivery of a completion event to the webhook, tracked
+// in the webhook_deliveries table with its attempts
+type Delivery struct {
+	ID int64 `json:"id"`
+	// DeliveryID identifies the event, as the Idempotency-Key header of
+	// each attempt, so the receiver can drop a re-delivery it already
+	// processed
+	DeliveryID string          `json:"delivery_id"`
+	VideoID    int             `json:"video_id"`
+	Version    int             `json:"version"`
+	URL        string          `json:"url"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	// LastError and LastStatusCode are the outcome of the last attempt,
+	// LastStatusCode being zero when no response came back
+	LastError      string     `json:"last_error,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// deliveryColumns are the columns scanned by scanDelivery
+const deliveryColumns = `id, delivery_id, video_id, version, url, payload, status, attempts,
+	last_error, last_status_code, created_at, updated_at, delivered_at`
+
+// createDelivery adds a pending delivery unless the event already has one,
+// which is returned instead
+func createDelivery(ctx context.Context, db *database.DB, d Delivery) (Delivery, error) {
+	err := database.Retry(ctx, func() error {
+		var count int
+		err := db.QueryRowContext(ctx, db.Rebind("SELECT COUNT(*) FROM webhook_deliveries WHERE delivery_id = ?"), d.DeliveryID).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+		query := db.Rebind(`INSERT INTO webhook_deliveries (delivery_id, video_id, version, url, payload, status, attempts, last_error, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, 0, '', ?, ?)`)
+		_, err = db.ExecContext(ctx, query, d.DeliveryID, d.VideoID, d.Version, d.URL, string(d.Payload), StatusPending, d.CreatedAt, d.CreatedAt)
+		return err
+	})
+	if err != nil {
+		return Delivery{}, err
+	}
+	row := db.QueryRowContext(ctx, db.Rebind("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE delivery_id = ?"), d.DeliveryID)
+	return scanDelivery(row)
+}
+
+// recordAttempt counts an attempt of the delivery to url, delivered when
+// attemptErr is nil
+func recordAttempt(ctx context.Context, db *database.DB, id int64, url string, statusCode int, attemptErr error) error {
+	now := time.Now()
+	status, lastError := StatusDelivered, ""
+	var deliveredAt *time.Time
+	if attemptErr != nil {
+		status, lastError = StatusFailed, attemptErr.Error()
+	} else {
+		deliveredAt = &now
+	}
+	query := db.Rebind(`UPDATE webhook_deliveries SET url = ?, status = ?, attempts = attempts + 1, last_error = ?,
+		last_status_code = ?, updated_at = ?, delivered_at = COALESCE(?, delivered_at) WHERE id = ?`)
+	return database.Retry(ctx, func() error {
+		_, err := db.ExecContext(ctx, query, url, status, lastError, statusCode, now, deliveredAt, id)
+		return err
+	})
+}
+
+// GetDelivery returns a delivery by id
+func GetDelivery(ctx context.Context, db *database.DB, id int64) (Delivery, error) {
+	row := db.QueryRowContext(ctx, db.Rebind("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?"), id)
+	d, err := scanDelivery(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Delivery{}, fmt.Errorf("%w: %d", ErrDeliveryNotFound, id)
+	}
+	return d, err
+}
+
+// DeliveryFilter selects the deliveries ListDeliveries returns; zero
+// fields match any
+type DeliveryFilter struct {
+	VideoID int
+	Status  string
+	// Limit caps how many are returned, 100 when zero
+	Limit int
+}
+
+// ListDeliveries returns the deliveries matching the filter, newest first
+func ListDeliveries(ctx context.Context, db *database.DB, filter DeliveryFilter) ([]Delivery, error) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE 1 = 1"
+	var args []any
+	if filter.VideoID != 0 {
+		query += " AND video_id = ?"
+		args = append(args, filter.VideoID)
+	}
+	if filter.Status != "" {
+		query += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanDelivery scans the deliveryColumns of a row
+func scanDelivery(row interface{ Scan(...any) error }) (Delivery, error) {
+	var d Delivery
+	var payload string
+	var deliveredAt sql.NullTime
+	err := row.Scan(&d.ID, &d.DeliveryID, &d.VideoID, &d.Version, &d.URL, &payload, &d.Status, &d.Attempts,
+		&d.LastError, &d.LastStatusCode, &d.CreatedAt, &d.UpdatedAt, &deliveredAt)
+	if err != nil {
+		return Delivery{}, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, nil
+}
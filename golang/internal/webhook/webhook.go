@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/database"
+	"imersaofc/internal/signing"
+)
+
+// IdempotencyKeyHeader carries the delivery id of the event, the same on
+// every attempt and re-delivery
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxAttempts is how many times an event is posted before its delivery is
+// left failed, to be re-delivered by hand
+const maxAttempts = 3
+
+// Sender posts completion events as JSON to an HTTP endpoint
+type Sender struct {
+	url    string
+	client *http.Client
+	signer *signing.Signer
+	db     *database.DB
+}
+
+// NewSender creates a new instance of Sender; events are signed with
+// signer, unless it is nil, see signing.FromHeaders, and their deliveries
+// are tracked in db, unless it is nil
+func NewSender(url string, signer *signing.Signer, db *database.DB) *Sender {
+	return &Sender{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		signer: signer,
+		db:     db,
+	}
+}
+
+// DeliveryID identifies the event of an output version
+func DeliveryID(event converter.CompletionEvent) string {
+	return fmt.Sprintf("%d/%d", event.VideoID, event.Version)
+}
+
+// Publish delivers the event to the webhook endpoint. An event already
+// delivered, e.g. when a task is redelivered after its webhook, isn't
+// posted again.
+func (s *Sender) Publish(ctx context.Context, event converter.CompletionEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	d := Delivery{
+		DeliveryID: DeliveryID(event),
+		VideoID:    event.VideoID,
+		Version:    event.Version,
+		URL:        s.url,
+		Payload:    body,
+		CreatedAt:  time.Now(),
+	}
+	if s.db != nil {
+		if d, err = createDelivery(ctx, s.db, d); err != nil {
+			return fmt.Errorf("failed to record webhook delivery: %w", err)
+		}
+		if d.Status == StatusDelivered {
+			slog.Info("Webhook already delivered", slog.String("delivery_id", d.DeliveryID))
+			return nil
+		}
+	}
+	return s.deliver(ctx, d)
+}
+
+// Redeliver posts a tracked delivery again, whatever its status, and
+// returns it updated
+func (s *Sender) Redeliver(ctx context.Context, id int64) (Delivery, error) {
+	if s.db == nil {
+		return Delivery{}, errors.New("webhook deliveries aren't tracked")
+	}
+	d, err := GetDelivery(ctx, s.db, id)
+	if err != nil {
+		return Delivery{}, err
+	}
+	slog.Info("Redelivering webhook", slog.Int64("id", id), slog.String("delivery_id", d.DeliveryID))
+	deliverErr := s.deliver(ctx, d)
+	if d, err = GetDelivery(ctx, s.db, id); err != nil {
+		return Delivery{}, err
+	}
+	return d, deliverErr
+}
+
+// deliver posts the delivery's payload up to maxAttempts times, backing
+// off between attempts, and records each one
+func (s *Sender) deliver(ctx context.Context, d Delivery) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var statusCode int
+		statusCode, err = s.post(ctx, d.DeliveryID, d.Payload)
+		if s.db != nil {
+			if dbErr := recordAttempt(ctx, s.db, d.ID, s.url, statusCode, err); dbErr != nil {
+				slog.Error("Error recording webhook attempt", slog.String("delivery_id", d.DeliveryID), slog.String("error", dbErr.Error()))
+			}
+		}
+		// Client errors won't go away by retrying, except timeouts and rate limits
+		retryable := statusCode == 0 || statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+		if err == nil || !retryable || attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+	return err
+}
+
+// post posts the payload once and returns the response's status code,
+// zero when none came back
+func (s *Sender) post(ctx context.Context, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyKeyHeader, deliveryID)
+	if s.signer != nil {
+		sig, err := s.signer.Sign(ctx, body)
+		if err != nil {
+			return 0, err
+		}
+		sig.SetHeaders(req.Header)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deliver webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,257 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"imersaofc/internal/converter"
+	"imersaofc/internal/database"
+	"imersaofc/internal/signing"
+)
+
+// openTestDB opens an in-memory SQLite database with the schema
+func openTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	// Every connection to :memory: is a database of its own, keep just one
+	db, err := database.Open("sqlite", ":memory:", database.PoolConfig{MaxOpenConns: 1, MaxIdleConns: 1}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.EnsureSchema(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// receiver is a webhook endpoint answering with the statuses in order,
+// the last one from then on
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	status := r.statuses[min(len(r.requests), len(r.statuses))-1]
+	w.WriteHeader(status)
+}
+
+// newReceiver starts a webhook endpoint
+func newReceiver(t *testing.T, statuses ...int) (*receiver, string) {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+var event = converter.CompletionEvent{VideoID: 3, Status: "completed", Version: 2}
+
+func TestPublish(t *testing.T) {
+	db := openTestDB(t)
+	r, url := newReceiver(t, http.StatusOK)
+	key := signing.Key{ID: "2024-05", Algorithm: signing.HMACSHA256, Secret: []byte("secret")}
+	signer := signing.NewSigner(func(context.Context) (signing.Key, error) { return key, nil })
+	s := NewSender(url, signer, db)
+
+	// A task redelivered after its webhook publishes the event again
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	if len(r.requests) != 1 {
+		t.Fatalf("webhook received %d requests, want 1", len(r.requests))
+	}
+	req := r.requests[0]
+	if got := req.Header.Get(IdempotencyKeyHeader); got != "3/2" {
+		t.Errorf("%s = %q, want 3/2", IdempotencyKeyHeader, got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	sig, err := signing.FromHeaders(req.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := signing.Verifier{Secrets: map[string][]byte{"2024-05": []byte("secret")}}
+	if err := verifier.Verify(sig, []byte(r.bodies[0])); err != nil {
+		t.Errorf("webhook signature doesn't verify: %v", err)
+	}
+
+	deliveries, err := ListDeliveries(context.Background(), db, DeliveryFilter{})
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("ListDeliveries() = %v, %v, want one delivery", deliveries, err)
+	}
+	d := deliveries[0]
+	if d.DeliveryID != "3/2" || d.Status != StatusDelivered || d.Attempts != 1 || d.LastStatusCode != http.StatusOK ||
+		d.LastError != "" || d.DeliveredAt == nil || d.URL != url || string(d.Payload) != r.bodies[0] {
+		t.Errorf("delivery = %+v", d)
+	}
+}
+
+func TestPublishRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantStatus   string
+		wantAttempts int
+		wantCode     int
+	}{
+		{
+			name:         "server error is retried",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusNoContent},
+			wantStatus:   StatusDelivered,
+			wantAttempts: 2,
+			wantCode:     http.StatusNoContent,
+		},
+		{
+			name:         "rate limit is retried",
+			statuses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			wantStatus:   StatusDelivered,
+			wantAttempts: 2,
+			wantCode:     http.StatusOK,
+		},
+		{
+			name:         "client error isn't retried",
+			statuses:     []int{http.StatusBadRequest},
+			wantErr:      true,
+			wantStatus:   StatusFailed,
+			wantAttempts: 1,
+			wantCode:     http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			r, url := newReceiver(t, tt.statuses...)
+			err := NewSender(url, nil, db).Publish(context.Background(), event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(r.requests) != tt.wantAttempts {
+				t.Errorf("webhook received %d requests, want %d", len(r.requests), tt.wantAttempts)
+			}
+			for _, req := range r.requests {
+				if got := req.Header.Get(IdempotencyKeyHeader); got != "3/2" {
+					t.Errorf("attempt with %s %q, want the same key on every attempt", IdempotencyKeyHeader, got)
+				}
+			}
+			d, err := GetDelivery(context.Background(), db, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Status != tt.wantStatus || d.Attempts != tt.wantAttempts || d.LastStatusCode != tt.wantCode || (d.LastError != "") != tt.wantErr {
+				t.Errorf("delivery = %+v", d)
+			}
+		})
+	}
+}
+
+func TestPublishCancelled(t *testing.T) {
+	db := openTestDB(t)
+	_, url := newReceiver(t, http.StatusBadGateway)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := NewSender(url, nil, db).Publish(ctx, event); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Publish() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d, _ := GetDelivery(context.Background(), db, 1); d.Status != StatusFailed || d.Attempts != 1 {
+		t.Errorf("delivery = %+v, want one failed attempt", d)
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	db := openTestDB(t)
+	r, url := newReceiver(t, http.StatusUnprocessableEntity, http.StatusOK)
+	s := NewSender(url, nil, db)
+	if err := s.Publish(context.Background(), event); err == nil {
+		t.Fatal("Publish() to a rejecting webhook succeeded")
+	}
+
+	d, err := s.Redeliver(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Redeliver() error = %v", err)
+	}
+	if d.Status != StatusDelivered || d.Attempts != 2 || d.LastError != "" || d.DeliveredAt == nil {
+		t.Errorf("redelivered delivery = %+v", d)
+	}
+	if len(r.requests) != 2 || r.bodies[0] != r.bodies[1] || r.requests[1].Header.Get(IdempotencyKeyHeader) != "3/2" {
+		t.Errorf("redelivery didn't post the same event with the same key")
+	}
+
+	if _, err := s.Redeliver(context.Background(), 42); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("Redeliver() of an unknown delivery error = %v, want %v", err, ErrDeliveryNotFound)
+	}
+	if _, err := NewSender(url, nil, nil).Redeliver(context.Background(), 1); err == nil {
+		t.Error("Redeliver() without tracked deliveries succeeded")
+	}
+}
+
+func TestListDeliveries(t *testing.T) {
+	db := openTestDB(t)
+	_, ok := newReceiver(t, http.StatusOK)
+	_, rejecting := newReceiver(t, http.StatusBadRequest)
+	NewSender(ok, nil, db).Publish(context.Background(), converter.CompletionEvent{VideoID: 1, Version: 1})
+	NewSender(rejecting, nil, db).Publish(context.Background(), converter.CompletionEvent{VideoID: 1, Version: 2})
+	NewSender(ok, nil, db).Publish(context.Background(), converter.CompletionEvent{VideoID: 2, Version: 1})
+
+	tests := []struct {
+		name   string
+		filter DeliveryFilter
+		want   []string
+	}{
+		{name: "all, newest first", want: []string{"2/1", "1/2", "1/1"}},
+		{name: "by video", filter: DeliveryFilter{VideoID: 1}, want: []string{"1/2", "1/1"}},
+		{name: "by status", filter: DeliveryFilter{Status: StatusFailed}, want: []string{"1/2"}},
+		{name: "limited", filter: DeliveryFilter{Limit: 1}, want: []string{"2/1"}},
+		{name: "none", filter: DeliveryFilter{VideoID: 3}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deliveries, err := ListDeliveries(context.Background(), db, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, d := range deliveries {
+				got = append(got, d.DeliveryID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ListDeliveries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishUntracked(t *testing.T) {
+	r, url := newReceiver(t, http.StatusOK)
+	s := NewSender(url, nil, nil)
+	for i := 0; i < 2; i++ {
+		if err := s.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	// Without tracking every publish is posted, the receiver drops the
+	// duplicate by its idempotency key
+	if len(r.requests) != 2 {
+		t.Errorf("webhook received %d requests, want 2", len(r.requests))
+	}
+}